@@ -1,20 +1,28 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
 	"github.com/cyverse-de/app-exposer/apps"
 	"github.com/cyverse-de/app-exposer/common"
+	"github.com/cyverse-de/app-exposer/dbrouter"
 	"github.com/cyverse-de/app-exposer/external"
+	"github.com/cyverse-de/app-exposer/faults"
 	"github.com/cyverse-de/app-exposer/instantlaunches"
 	"github.com/cyverse-de/app-exposer/internal"
+	"github.com/cyverse-de/app-exposer/kuberetry"
+	"github.com/cyverse-de/app-exposer/metrics"
 	"github.com/jmoiron/sqlx"
 	"github.com/knadh/koanf"
 	"github.com/nats-io/nats.go"
 	"go.opentelemetry.io/contrib/instrumentation/github.com/labstack/echo/otelecho"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
@@ -31,6 +39,10 @@ type ExposerApp struct {
 	router          *echo.Echo
 	db              *sqlx.DB
 	instantlaunches *instantlaunches.App
+	rateLimiter     *rateLimiter
+	health          *HealthChecker
+	config          configHolder
+	loadConfig      func() (*koanf.Koanf, error)
 }
 
 // ExposerAppInit contains configuration settings for creating a new ExposerApp.
@@ -43,10 +55,12 @@ type ExposerAppInit struct {
 	GetAnalysisIDService          string
 	CheckResourceAccessService    string
 	db                            *sqlx.DB
+	dbRouter                      *dbrouter.Router
 	UserSuffix                    string
 	IRODSZone                     string
 	IngressClass                  string
 	ClientSet                     kubernetes.Interface
+	RESTConfig                    *rest.Config
 	NATSCluster                   string
 	NATSTLSKey                    string
 	NATSTLSCert                   string
@@ -54,15 +68,13 @@ type ExposerAppInit struct {
 	NATSCredsFilePath             string
 	NATSMaxReconnects             int
 	NATSReconnectWait             int
+
+	// LoadConfig reads the configuration again when it's reloaded.
+	LoadConfig func() (*koanf.Koanf, error)
 }
 
 // NewExposerApp creates and returns a newly instantiated *ExposerApp.
 func NewExposerApp(init *ExposerAppInit, apps *apps.Apps, c *koanf.Koanf) *ExposerApp {
-	jobStatusURL := c.String("vice.job-status.base")
-	if jobStatusURL == "" {
-		jobStatusURL = "http://job-status-listener"
-	}
-
 	metadataBaseURL := c.String("metadata.base")
 	if metadataBaseURL == "" {
 		metadataBaseURL = "http://metadata"
@@ -97,7 +109,11 @@ func NewExposerApp(init *ExposerAppInit, apps *apps.Apps, c *koanf.Koanf) *Expos
 			log.Infof("reconnected to %s", nc.ConnectedUrl())
 		}),
 		nats.ClosedHandler(func(nc *nats.Conn) {
-			log.Errorf("connection closed: %s", nc.LastError().Error())
+			if err := nc.LastError(); err != nil {
+				log.Errorf("connection closed: %s", err.Error())
+			} else {
+				log.Info("connection closed")
+			}
 		}),
 	)
 	if err != nil {
@@ -112,6 +128,268 @@ func NewExposerApp(init *ExposerAppInit, apps *apps.Apps, c *koanf.Koanf) *Expos
 		log.Fatal(err)
 	}
 
+	reloadable, err := reloadableConfigFromKoanf(c)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	egressConfig := internal.EgressConfig{
+		DefaultProfile: c.String("vice.egress.default-profile"),
+		PlatformCIDRs:  c.Strings("vice.egress.platform-cidrs"),
+		DatastoreCIDRs: c.Strings("vice.egress.datastore-cidrs"),
+	}
+	if err = egressConfig.Validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	var registryMirrors internal.RegistryMirrors
+	if err = c.Unmarshal("vice.registry-mirrors", &registryMirrors); err != nil {
+		log.Fatal(err)
+	}
+	if err = registryMirrors.Validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	var registryPullSecrets internal.RegistryPullSecrets
+	if err = c.Unmarshal("vice.registry-pull-secrets", &registryPullSecrets); err != nil {
+		log.Fatal(err)
+	}
+	if err = registryPullSecrets.Validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	var spotNodes internal.SpotNodes
+	if err = c.Unmarshal("vice.spot-nodes", &spotNodes); err != nil {
+		log.Fatal(err)
+	}
+	if err = spotNodes.Validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	pullSecretsConfig := internal.PullSecretsConfig{
+		SourceNamespace: c.String("vice.pull-secrets.source-namespace"),
+		SourceName:      c.String("vice.pull-secrets.source-name"),
+		SyncInterval:    c.Duration("vice.pull-secrets.sync-interval"),
+	}
+	if err = pullSecretsConfig.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	if pullSecretsConfig.Enabled() && c.String("vice.image-pull-secret") == "" {
+		log.Fatal("vice.image-pull-secret must be set when the pull secrets are managed")
+	}
+
+	imageAccessConfig := internal.ImageAccessConfig{
+		Enabled:      c.Bool("vice.image-access-check.enabled"),
+		Registries:   c.Strings("vice.image-access-check.registries"),
+		RobotAccount: c.String("vice.image-access-check.robot-account"),
+		Timeout:      c.Duration("vice.image-access-check.timeout"),
+	}
+	if err = imageAccessConfig.Validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	var secretKeys internal.SecretKeys
+	if err = c.Unmarshal("vice.secret-keys", &secretKeys); err != nil {
+		log.Fatal(err)
+	}
+	secretKeyRing, err := internal.NewSecretKeyRing(secretKeys)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	imagePlatformsConfig := internal.ImagePlatformsConfig{
+		Enabled:  c.Bool("vice.image-platform-check.enabled"),
+		Platform: c.String("vice.image-platform-check.platform"),
+		Timeout:  c.Duration("vice.image-platform-check.timeout"),
+	}
+	if err = imagePlatformsConfig.Validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	historyRetentionConfig := internal.HistoryRetentionConfig{
+		Interval:  c.Duration("vice.history-retention.interval"),
+		BatchSize: c.Int("vice.history-retention.batch-size"),
+		Retention: map[string]time.Duration{},
+	}
+	for _, historyType := range c.MapKeys("vice.history-retention.retention") {
+		historyRetentionConfig.Retention[historyType] = c.Duration("vice.history-retention.retention." + historyType)
+	}
+	if err = historyRetentionConfig.Validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	launchLimiterConfig := internal.LaunchLimiterConfig{
+		Enabled:      c.Bool("vice.launch-limiter.enabled"),
+		MaxInFlight:  c.Int("vice.launch-limiter.max-in-flight"),
+		MaxQueued:    c.Int("vice.launch-limiter.max-queued"),
+		QueueTimeout: c.Duration("vice.launch-limiter.queue-timeout"),
+	}
+	if err = launchLimiterConfig.Validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	subdomainConfig := internal.SubdomainConfig{
+		Scheme: c.String("vice.subdomains.scheme"),
+	}
+	if err = subdomainConfig.Validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	// The analyses' hosts are in the frontend's domain unless another one is
+	// configured. The URL was checked when the configuration was loaded.
+	ingressTLSConfig := internal.IngressTLSConfig{
+		Enabled:       c.Bool("vice.ingress-tls.enabled"),
+		Mode:          c.String("vice.ingress-tls.mode"),
+		Domain:        c.String("vice.ingress-tls.domain"),
+		SecretName:    c.String("vice.ingress-tls.secret-name"),
+		Issuer:        c.String("vice.ingress-tls.issuer"),
+		ClusterIssuer: c.String("vice.ingress-tls.cluster-issuer"),
+	}
+	if ingressTLSConfig.Domain == "" {
+		frontURL, _ := url.Parse(c.String("k8s.frontend.base"))
+		ingressTLSConfig.Domain = frontURL.Hostname()
+	}
+	if err = ingressTLSConfig.Validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	provenanceConfig := internal.ProvenanceConfig{
+		Enabled:     c.Bool("vice.provenance.enabled"),
+		ClusterName: c.String("vice.provenance.cluster-name"),
+		FileName:    c.String("vice.provenance.file-name"),
+	}
+	if err = provenanceConfig.Validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	transferAccountingConfig := internal.TransferAccountingConfig{
+		Enabled: c.Bool("vice.transfer-accounting.enabled"),
+		Subject: c.String("vice.transfer-accounting.subject"),
+	}
+	if err = transferAccountingConfig.Validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	caCertsConfig := internal.CACertsConfig{
+		ConfigMap: c.String("vice.ca-certs.configmap"),
+		Secret:    c.String("vice.ca-certs.secret"),
+		Key:       c.String("vice.ca-certs.key"),
+		FileName:  c.String("vice.ca-certs.file-name"),
+	}
+	if err = caCertsConfig.Validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	sharedMemoryConfig := internal.SharedMemoryConfig{
+		Max: c.String("vice.shared-memory.max"),
+	}
+	if err = sharedMemoryConfig.Validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	placementConfig := internal.PlacementConfig{
+		Enabled:     c.Bool("vice.sticky-placement.enabled"),
+		TopologyKey: c.String("vice.sticky-placement.topology-key"),
+		Weight:      int32(c.Int("vice.sticky-placement.weight")),
+	}
+	if err = placementConfig.Validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	if maxGrace := c.Duration("vice.termination.max-grace-period"); maxGrace > 0 && c.Duration("vice.termination.grace-period") > maxGrace {
+		log.Fatal("vice.termination.grace-period must not be longer than vice.termination.max-grace-period")
+	}
+
+	demoConfig := internal.DemoConfig{
+		Enabled:    c.Bool("vice.demo-mode.enabled"),
+		TimeLimit:  c.Duration("vice.demo-mode.time-limit"),
+		CountQuota: c.Bool("vice.demo-mode.count-quota"),
+	}
+	if err = demoConfig.Validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	startupMonitorConfig := internal.StartupMonitorConfig{
+		Enabled:        c.Bool("vice.startup-monitor.enabled"),
+		Interval:       c.Duration("vice.startup-monitor.interval"),
+		DefaultTimeout: c.Duration("vice.startup-monitor.default-timeout"),
+	}
+	if err = startupMonitorConfig.Validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	logArchiveConfig := internal.LogArchiveConfig{
+		Enabled:    c.Bool("vice.log-archive.enabled"),
+		TailLines:  c.Int64("vice.log-archive.tail-lines"),
+		LimitBytes: c.Int64("vice.log-archive.limit-bytes"),
+	}
+	if err = logArchiveConfig.Validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	smokeTestConfig := internal.SmokeTestConfig{
+		User:           c.String("vice.smoke-test.user"),
+		UserID:         c.String("vice.smoke-test.user-id"),
+		Image:          c.String("vice.smoke-test.image"),
+		Port:           c.Int("vice.smoke-test.port"),
+		Timeout:        c.Duration("vice.smoke-test.timeout"),
+		CleanupTimeout: c.Duration("vice.smoke-test.cleanup-timeout"),
+		PollInterval:   c.Duration("vice.smoke-test.poll-interval"),
+	}
+	if err = smokeTestConfig.Validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	orphanReconcilerConfig := internal.OrphanReconcilerConfig{
+		Interval:    c.Duration("vice.orphan-reconciler.interval"),
+		GracePeriod: c.Duration("vice.orphan-reconciler.grace-period"),
+		DryRun:      c.Bool("vice.orphan-reconciler.dry-run"),
+	}
+
+	namespacesConfig := internal.NamespacesConfig{
+		Selector: c.String("vice.listing-namespaces.selector"),
+	}
+	if err = namespacesConfig.Validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	notificationsConfig := internal.NotificationsConfig{
+		Enabled:     c.Bool("vice.notifications.enabled"),
+		URL:         c.String("vice.notifications.base"),
+		AnalysesURL: c.String("vice.notifications.analyses-url"),
+		Timeout:     c.Duration("vice.notifications.timeout"),
+	}
+	if err = notificationsConfig.Validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	timeLimitWarningsConfig := internal.TimeLimitWarningsConfig{
+		Enabled:    c.Bool("vice.time-limit-warnings.enabled"),
+		Interval:   c.Duration("vice.time-limit-warnings.interval"),
+		ActionsURL: c.String("vice.time-limit-warnings.actions-url"),
+		LinkSecret: c.String("vice.time-limit-warnings.link-secret"),
+	}
+	for _, before := range c.Strings("vice.time-limit-warnings.before") {
+		d, err := time.ParseDuration(before)
+		if err != nil {
+			log.Fatalf("invalid time limit warning %s: %s", before, err)
+		}
+		timeLimitWarningsConfig.Before = append(timeLimitWarningsConfig.Before, d)
+	}
+	if err = timeLimitWarningsConfig.Validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	timeLimitsConfig := internal.TimeLimitsConfig{
+		Enabled:     c.Bool("vice.time-limits.enabled"),
+		Interval:    c.Duration("vice.time-limits.interval"),
+		MaxDuration: c.Duration("vice.time-limits.max-duration"),
+		Action:      c.String("vice.time-limits.action"),
+	}
+	if err = timeLimitsConfig.Validate(); err != nil {
+		log.Fatal(err)
+	}
+
 	internalInit := &internal.Init{
 		ViceNamespace:                 init.ViceNamespace,
 		PorklockImage:                 c.String("vice.file-transfers.image"),
@@ -128,16 +406,92 @@ func NewExposerApp(init *ExposerAppInit, apps *apps.Apps, c *koanf.Koanf) *Expos
 		CheckResourceAccessService:    init.CheckResourceAccessService,
 		VICEBackendNamespace:          c.String("vice.backend-namespace"),
 		AppsServiceBaseURL:            appsServiceBaseURL,
-		JobStatusURL:                  jobStatusURL,
+		JobStatusURL:                  reloadable.JobStatusURL,
 		UserSuffix:                    init.UserSuffix,
 		PermissionsURL:                permissionsURL,
 		KeycloakBaseURL:               c.String("keycloak.base"),
 		KeycloakRealm:                 c.String("keycloak.realm"),
 		KeycloakClientID:              c.String("keycloak.client-id"),
 		KeycloakClientSecret:          c.String("keycloak.client-secret"),
+		ProxyAuthBackend:              c.String("vice.proxy-auth.backend"),
+		OIDCIssuerURL:                 c.String("oidc.issuer-url"),
+		OIDCClientID:                  c.String("oidc.client-id"),
+		OIDCClientSecret:              c.String("oidc.client-secret"),
 		IRODSZone:                     init.IRODSZone,
 		IngressClass:                  init.IngressClass,
 		NATSEncodedConn:               conn,
+		OutboxMaxAttempts:             c.Int("vice.status-outbox.max-attempts"),
+		OutboxRetryInterval:           c.Duration("vice.status-outbox.retry-interval"),
+		CreatePDBs:                    c.Bool("vice.pod-disruption-budgets.enabled"),
+		EphemeralStorageInterval:      c.Duration("vice.ephemeral-storage-monitor.interval"),
+		EphemeralStorageThreshold:     c.Float64("vice.ephemeral-storage-monitor.threshold"),
+		ReaperInterval:                c.Duration("vice.deletion-reaper.interval"),
+		ReaperThreshold:               c.Duration("vice.deletion-reaper.threshold"),
+		OrphanReconciler:              orphanReconcilerConfig,
+		DiskUsageWarningThreshold:     c.Float64("vice.disk-usage.warning-threshold"),
+		DiskUsageCriticalThreshold:    c.Float64("vice.disk-usage.critical-threshold"),
+		RESTConfig:                    init.RESTConfig,
+		ResourcePresets:               reloadable.ResourcePresets,
+		TerminationGracePeriod:        c.Duration("vice.termination.grace-period"),
+		TerminationMaxGracePeriod:     c.Duration("vice.termination.max-grace-period"),
+		FlushOutputsOnStop:            c.Bool("vice.termination.flush-outputs"),
+		KueueQueueName:                c.String("vice.kueue.queue-name"),
+		CheckGPUCapacity:              c.Bool("vice.gpu-capacity-check.enabled"),
+		Egress:                        egressConfig,
+		CSIMountCheck:                 c.Bool("vice.csi-mount-check.enabled"),
+		CSIMountCheckTimeout:          c.Duration("vice.csi-mount-check.timeout"),
+		CACerts:                       caCertsConfig,
+		SharedMemory:                  sharedMemoryConfig,
+		Placement:                     placementConfig,
+		Demo:                          demoConfig,
+		Namespaces:                    namespacesConfig,
+		LaunchDryRun:                  c.Bool("vice.launch-dry-run.enabled"),
+		LaunchRollback:                c.Bool("vice.launch-rollback.enabled"),
+		Notifications:                 notificationsConfig,
+		TimeLimitWarnings:             timeLimitWarningsConfig,
+		TimeLimits:                    timeLimitsConfig,
+		RegistryMirrors:               registryMirrors,
+		RegistryPullSecrets:           registryPullSecrets,
+		PullSecrets:                   pullSecretsConfig,
+		ImageAccess:                   imageAccessConfig,
+		SecretKeys:                    secretKeyRing,
+		ImagePlatforms:                imagePlatformsConfig,
+		MaxDownloadBytes:              c.Int64("vice.file-browser.max-download-bytes"),
+		Embedding:                     reloadable.Embedding,
+		HistoryRetention:              historyRetentionConfig,
+		LaunchLimiter:                 launchLimiterConfig,
+		Subdomains:                    subdomainConfig,
+		IngressTLS:                    ingressTLSConfig,
+		Provenance:                    provenanceConfig,
+		TransferAccounting:            transferAccountingConfig,
+		SpotNodes:                     spotNodes,
+		StartupMonitor:                startupMonitorConfig,
+		LogArchive:                    logArchiveConfig,
+		SmokeTest:                     smokeTestConfig,
+		Maintenance:                   reloadable.Maintenance,
+		Policy: internal.PolicyConfig{
+			URL:      c.String("vice.policy-service.url"),
+			Timeout:  c.Duration("vice.policy-service.timeout"),
+			FailOpen: c.Bool("vice.policy-service.fail-open"),
+		},
+		Commands: internal.CommandsConfig{
+			Enabled:    c.Bool("vice.commands.enabled"),
+			Stream:     c.String("vice.commands.stream"),
+			Subject:    c.String("vice.commands.subject"),
+			Durable:    c.String("vice.commands.durable"),
+			MaxDeliver: c.Int("vice.commands.max-deliver"),
+		},
+	}
+
+	// Keep the credentials out of the logs and error responses.
+	common.RegisterSecret(
+		internalInit.KeycloakClientSecret,
+		internalInit.OIDCClientSecret,
+	)
+
+	internalInit.ProxyAuth, err = internal.NewProxyAuth(internalInit)
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	app := &ExposerApp{
@@ -147,20 +501,50 @@ func NewExposerApp(init *ExposerAppInit, apps *apps.Apps, c *koanf.Koanf) *Expos
 		clientset: init.ClientSet,
 		router:    echo.New(),
 		db:        init.db,
+
+		loadConfig: init.LoadConfig,
 	}
+	app.config.set(c)
 
+	app.router.Pre(prefixMiddleware(prefixConfigFromKoanf(c)))
+	app.router.Pre(requestIDMiddleware())
 	app.router.Use(otelecho.Middleware("app-exposer"))
 	app.router.Use(middleware.Logger())
 
+	if corsConfig := corsConfigFromKoanf(c); corsConfig.Enabled {
+		app.router.Use(corsMiddleware(corsConfig))
+	}
+
+	rateLimitConfig, err := rateLimitConfigFromKoanf(c)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// The middleware is always added so that rate limiting can be enabled
+	// when the configuration is reloaded.
+	app.rateLimiter = newRateLimiter(rateLimitConfig)
+	app.router.Use(app.rateLimiter.middleware())
+
+	if c.Bool("vice.test-mode.enabled") {
+		app.router.Use(faults.Middleware())
+	}
+
 	ilInit := &instantlaunches.Init{
 		UserSuffix:      init.UserSuffix,
 		MetadataBaseURL: metadataBaseURL,
 		PermissionsURL:  permissionsURL,
+		Router:          init.dbRouter,
 	}
 
 	app.router.HTTPErrorHandler = func(err error, c echo.Context) {
 		code := http.StatusInternalServerError
-		var body interface{}
+		var body common.ErrorResponse
+
+		// Launches that were rolled back respond with the error that made
+		// them fail, along with what was cleaned up.
+		rollback, rolledBack := err.(*internal.LaunchRollbackError)
+		if rolledBack {
+			err = rollback.Err
+		}
 
 		switch err := err.(type) {
 		case common.ErrorResponse:
@@ -168,23 +552,61 @@ func NewExposerApp(init *ExposerAppInit, apps *apps.Apps, c *koanf.Koanf) *Expos
 			body = err
 		case *common.ErrorResponse:
 			code = http.StatusBadRequest
-			body = err
+			body = *err
 		case *echo.HTTPError:
 			echoErr := err
 			code = echoErr.Code
 			body = common.NewErrorResponse(err)
 		default:
+			// Calls to the k8s API that failed while it was unavailable get a
+			// 503 so that the DE knows to try again later.
+			if unavailable, ok := kuberetry.AsUnavailable(err); ok {
+				code = http.StatusServiceUnavailable
+				c.Response().Header().Set("Retry-After", fmt.Sprintf("%d", retryAfterSeconds(unavailable.RetryAfter)))
+			}
 			body = common.NewErrorResponse(err)
 		}
 
+		if rolledBack {
+			details := rollback.Details()
+			if body.Details != nil {
+				for k, v := range *body.Details {
+					details[k] = v
+				}
+			}
+			body.Details = &details
+		}
+
 		c.JSON(code, body) // nolint:errcheck
 	}
 
 	app.router.GET("/", app.Greeting).Name = "greeting"
+
+	health := NewHealthChecker(init.db, nc, init.ClientSet, c.Duration("http.readiness.timeout"))
+	app.health = health
+	app.router.GET("/ready", health.ReadyHandler).Name = "ready"
+	app.router.GET("/live", health.LiveHandler).Name = "live"
+
+	if c.Bool("http.status-page.enabled") {
+		statusPage := NewStatusPage(health, app.internal, c.Duration("http.status-page.cache-ttl"), c.Duration("http.status-page.launch-window"))
+		app.router.GET("/status", statusPage.StatusHandler).Name = "status"
+	}
+
+	app.router.GET("/metrics", echo.WrapHandler(metrics.Handler())).Name = "metrics"
+
 	app.router.Static("/docs", "./docs")
 
+	app.router.POST("/resourcing/preview", app.internal.ResourcePreviewHandler)
+
+	analyses := app.router.Group("/analyses")
+	analyses.GET("/:analysis-id/description", app.internal.AnalysisDescriptionHandler)
+	analyses.POST("/:analysis-id/relaunch", app.internal.RelaunchAnalysisHandler)
+	analyses.GET("/:analysis-id/provenance", app.internal.AnalysisProvenanceHandler)
+
 	vice := app.router.Group("/vice")
 	vice.POST("/launch", app.internal.LaunchAppHandler)
+	vice.POST("/launch/preview", app.internal.LaunchPreviewHandler)
+	vice.POST("/launch/validate", app.internal.ValidateLaunchHandler)
 	vice.POST("/apply-labels", app.internal.ApplyAsyncLabelsHandler)
 	vice.GET("/async-data", app.internal.AsyncDataHandler)
 	vice.GET("/listing", app.internal.FilterableResourcesHandler)
@@ -192,12 +614,28 @@ func NewExposerApp(init *ExposerAppInit, apps *apps.Apps, c *koanf.Koanf) *Expos
 	vice.POST("/:id/save-output-files", app.internal.TriggerUploadsHandler)
 	vice.POST("/:id/exit", app.internal.ExitHandler)
 	vice.POST("/:id/save-and-exit", app.internal.SaveAndExitHandler)
+	vice.POST("/:id/restart", app.internal.RestartHandler)
+	vice.GET("/:id/history", app.internal.HistoryHandler)
 	vice.GET("/:analysis-id/pods", app.internal.PodsHandler)
 	vice.GET("/:analysis-id/logs", app.internal.LogsHandler)
+	vice.GET("/:analysis-id/events", app.internal.EventsHandler)
 	vice.POST("/:analysis-id/time-limit", app.internal.TimeLimitUpdateHandler)
 	vice.GET("/:analysis-id/time-limit", app.internal.GetTimeLimitHandler)
 	vice.GET("/:host/url-ready", app.internal.URLReadyHandler)
 	vice.GET("/:host/description", app.internal.DescribeAnalysisHandler)
+	vice.GET("/capabilities", app.internal.CapabilitiesHandler)
+	vice.GET("/resource-presets", app.internal.ResourcePresetsHandler)
+	vice.GET("/:id/disk-usage", app.internal.DiskUsageHandler)
+	vice.GET("/:id/mounts", app.internal.MountStatusHandler)
+	vice.GET("/:id/files", app.internal.ListFilesHandler)
+	vice.GET("/:id/files/download", app.internal.DownloadFileHandler)
+	vice.POST("/:id/snapshots", app.internal.CreateSnapshotHandler)
+	vice.GET("/:id/snapshots", app.internal.ListSnapshotsHandler)
+	vice.POST("/tools/:tool-id/egress-requests", app.internal.RequestEgressHandler)
+	vice.GET("/notifications/preferences", app.internal.GetNotificationPreferencesHandler)
+	vice.PUT("/notifications/preferences", app.internal.UpdateNotificationPreferencesHandler)
+	vice.GET("/time-limit-actions/:token", app.internal.TimeLimitActionHandler)
+	vice.POST("/instant-launches/evaluate", app.internal.EvaluateInstantLaunchesHandler)
 
 	vicelisting := vice.Group("/listing")
 	vicelisting.GET("/", app.internal.FilterableResourcesHandler)
@@ -212,6 +650,75 @@ func NewExposerApp(init *ExposerAppInit, apps *apps.Apps, c *koanf.Koanf) *Expos
 	viceadmin.GET("/:host/description", app.internal.AdminDescribeAnalysisHandler)
 	viceadmin.GET("/:host/url-ready", app.internal.AdminURLReadyHandler)
 
+	viceadmin.POST("/relabel", app.internal.AdminRelabelHandler)
+
+	viceadmin.GET("/outbox", app.internal.AdminListOutboxHandler)
+	viceadmin.POST("/outbox/:id/replay", app.internal.AdminReplayOutboxHandler)
+
+	viceadmin.GET("/tools/:tool-id/settings", app.internal.AdminGetToolSettingsHandler)
+	viceadmin.PUT("/tools/:tool-id/settings", app.internal.AdminUpdateToolSettingsHandler)
+
+	viceadmin.GET("/env", app.internal.AdminGetGlobalEnvHandler)
+	viceadmin.PUT("/env", app.internal.AdminUpdateGlobalEnvHandler)
+	viceadmin.GET("/apps/:app-id/env", app.internal.AdminGetAppEnvHandler)
+	viceadmin.PUT("/apps/:app-id/env", app.internal.AdminUpdateAppEnvHandler)
+	viceadmin.GET("/apps/:app-id/limits", app.internal.AdminGetAppLimitsHandler)
+	viceadmin.PUT("/apps/:app-id/limits", app.internal.AdminUpdateAppLimitsHandler)
+
+	viceadmin.GET("/image-pulls/stats", app.internal.AdminImagePullStatsHandler)
+
+	viceadmin.GET("/dashboards", app.internal.AdminDashboardsHandler)
+	viceadmin.GET("/dashboards/running-by-app", app.internal.AdminRunningByAppHandler)
+	viceadmin.GET("/dashboards/launches", app.internal.AdminLaunchesPerHourHandler)
+	viceadmin.GET("/dashboards/failures", app.internal.AdminFailuresByReasonHandler)
+	viceadmin.GET("/dashboards/utilization", app.internal.AdminUtilizationHandler)
+	viceadmin.GET("/dashboards/transfers", app.internal.AdminTransfersPerDayHandler)
+
+	viceadmin.GET("/labels/:kind/:value", app.internal.AdminGetLabelValueNameHandler)
+
+	viceadmin.GET("/config", configPreviewHandler(flag.CommandLine, app.config.get))
+	viceadmin.POST("/config/reload", app.ConfigReloadHandler)
+
+	viceadmin.GET("/users/:username/placement", app.internal.AdminGetUserPlacementHandler)
+	viceadmin.PUT("/users/:username/placement", app.internal.AdminSetUserPlacementHandler)
+	viceadmin.DELETE("/users/:username/placement", app.internal.AdminDeleteUserPlacementHandler)
+
+	viceadmin.GET("/users/:username/job-limit", app.internal.AdminGetUserJobLimitHandler)
+	viceadmin.PUT("/users/:username/job-limit", app.internal.AdminSetUserJobLimitHandler)
+	viceadmin.DELETE("/users/:username/job-limit", app.internal.AdminDeleteUserJobLimitHandler)
+	viceadmin.GET("/job-limit-groups", app.internal.AdminListJobLimitGroupsHandler)
+	viceadmin.PUT("/job-limit-groups/:name", app.internal.AdminSetJobLimitGroupHandler)
+	viceadmin.DELETE("/job-limit-groups/:name", app.internal.AdminDeleteJobLimitGroupHandler)
+
+	viceadmin.GET("/reaper/actions", app.internal.AdminListReapedResourcesHandler)
+	viceadmin.POST("/reaper/run", app.internal.AdminReapHandler)
+	viceadmin.POST("/reaper/orphans", app.internal.AdminReconcileOrphansHandler)
+
+	viceadmin.GET("/history/storage", app.internal.AdminHistoryStorageHandler)
+	viceadmin.POST("/history/prune", app.internal.AdminPruneHistoryHandler)
+
+	viceadmin.GET("/launch-limiter", app.internal.AdminLaunchLimiterHandler)
+
+	viceadmin.POST("/smoke-test", app.internal.AdminSmokeTestHandler)
+
+	viceadmin.GET("/egress-requests", app.internal.AdminListEgressRequestsHandler)
+	viceadmin.POST("/egress-requests/:id/approve", app.internal.AdminApproveEgressRequestHandler)
+	viceadmin.POST("/egress-requests/:id/deny", app.internal.AdminDenyEgressRequestHandler)
+
+	viceadmin.GET("/pull-secrets", app.internal.AdminListPullSecretsHandler)
+	viceadmin.POST("/pull-secrets/sync", app.internal.AdminSyncPullSecretsHandler)
+	viceadmin.PUT("/pull-secrets/credentials", app.internal.AdminRotatePullSecretsHandler)
+
+	viceadmin.GET("/registry-credentials", app.internal.AdminListRegistryCredentialsHandler)
+	viceadmin.POST("/registry-credentials/reencrypt", app.internal.AdminReencryptRegistryCredentialsHandler)
+	viceadmin.PUT("/registry-credentials/:registry/:project", app.internal.AdminSetRegistryCredentialHandler)
+	viceadmin.DELETE("/registry-credentials/:registry/:project", app.internal.AdminDeleteRegistryCredentialHandler)
+
+	viceadmin.GET("/workshops", app.internal.AdminListWorkshopsHandler)
+	viceadmin.POST("/workshops", app.internal.AdminCreateWorkshopHandler)
+	viceadmin.GET("/workshops/:id", app.internal.AdminGetWorkshopHandler)
+	viceadmin.POST("/workshops/:id/teardown", app.internal.AdminTearDownWorkshopHandler)
+
 	viceanalyses := viceadmin.Group("/analyses")
 	viceanalyses.GET("/", app.internal.AdminFilterableResourcesHandler)
 	viceanalyses.POST("/:analysis-id/download-input-files", app.internal.AdminTriggerDownloadsHandler)
@@ -221,6 +728,10 @@ func NewExposerApp(init *ExposerAppInit, apps *apps.Apps, c *koanf.Koanf) *Expos
 	viceanalyses.GET("/:analysis-id/time-limit", app.internal.AdminGetTimeLimitHandler)
 	viceanalyses.POST("/:analysis-id/time-limit", app.internal.AdminTimeLimitUpdateHandler)
 	viceanalyses.GET("/:analysis-id/external-id", app.internal.AdminGetExternalIDHandler)
+	viceanalyses.GET("/:analysis-id/kube", app.internal.AdminKubeResourcesHandler)
+	viceanalyses.GET("/:analysis-id/events", app.internal.AdminEventsHandler)
+	viceanalyses.GET("/:analysis-id/resources", app.internal.AdminGetAnalysisResourcesHandler)
+	viceanalyses.POST("/:analysis-id/resources", app.internal.AdminUpdateAnalysisResourcesHandler)
 
 	svc := app.router.Group("/service")
 	svc.POST("/:name", app.external.CreateServiceHandler)
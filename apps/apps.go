@@ -9,9 +9,11 @@ import (
 
 	"github.com/cockroachdb/apd"
 	"github.com/cyverse-de/app-exposer/common"
+	"github.com/cyverse-de/app-exposer/dbrouter"
 	"github.com/cyverse-de/model/v6"
 	"github.com/google/uuid"
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 	"github.com/sirupsen/logrus"
 	"go.opentelemetry.io/otel"
 )
@@ -24,30 +26,47 @@ type millicoresJob struct {
 	ID                 uuid.UUID
 	Job                model.Job
 	MillicoresReserved *apd.Decimal
+
+	// PlannedEndDate replaces the job's time limit if it's set.
+	PlannedEndDate *time.Time
 }
 
 // Apps provides an API for accessing information about apps.
 type Apps struct {
 	DB         *sqlx.DB
+	reads      *dbrouter.Router
 	UserSuffix string
 	addJob     chan millicoresJob
 	jobDone    chan uuid.UUID
 	exit       chan bool
+	finished   chan struct{}
 	jobs       map[string]bool
+
+	// The lookup caches are nil until ConfigureCache is called.
+	analysisIDs *lookupCache
+	userIPs     *lookupCache
 }
 
 // NewApps allocates a new *Apps instance.
 func NewApps(db *sqlx.DB, userSuffix string) *Apps {
 	return &Apps{
 		DB:         db,
+		reads:      dbrouter.New(db, nil, 0),
 		UserSuffix: userSuffix,
 		addJob:     make(chan millicoresJob),
 		jobDone:    make(chan uuid.UUID),
 		exit:       make(chan bool),
+		finished:   make(chan struct{}),
 		jobs:       map[string]bool{},
 	}
 }
 
+// UseRouter sends the read-only lookups through the router, which may send
+// them to a read replica. Writes always go to DB.
+func (a *Apps) UseRouter(router *dbrouter.Router) {
+	a.reads = router
+}
+
 // Run runs the goroutine for storing millicores reserved for new jobs.
 func (a *Apps) Run() {
 	for {
@@ -60,7 +79,7 @@ func (a *Apps) Run() {
 				var err error
 
 				log.Debugf("storing %s millicores reserved for %s", mj.MillicoresReserved.String(), mj.Job.InvocationID)
-				if err = a.storeMillicoresInternal(ctx, &mj.Job, mj.MillicoresReserved); err != nil {
+				if err = a.storeMillicoresInternal(ctx, &mj.Job, mj.MillicoresReserved, mj.PlannedEndDate); err != nil {
 					log.Error(err)
 				}
 				log.Debugf("done storing %s millicores reserved for %s", mj.MillicoresReserved.String(), mj.Job.InvocationID)
@@ -72,14 +91,22 @@ func (a *Apps) Run() {
 			delete(a.jobs, doneJobID.String())
 
 		case <-a.exit:
-			break
+			// Wait for the millicores that are being stored, so that they
+			// aren't lost when the database connection is closed.
+			for len(a.jobs) > 0 {
+				delete(a.jobs, (<-a.jobDone).String())
+			}
+			close(a.finished)
+			return
 		}
 	}
 }
 
-// Finish exits the goroutine for storing millicores reserved for new jobs.
+// Finish exits the goroutine for storing millicores reserved for new jobs
+// once the millicores that are being stored have been written.
 func (a *Apps) Finish() {
 	a.exit <- true
+	<-a.finished
 }
 
 const analysisIDByExternalIDQuery = `
@@ -92,14 +119,68 @@ const analysisIDByExternalIDQuery = `
 // GetAnalysisIDByExternalID returns the analysis ID based on the external ID
 // passed in.
 func (a *Apps) GetAnalysisIDByExternalID(ctx context.Context, externalID string) (string, error) {
+	if analysisID, ok := a.analysisIDs.get(externalID); ok {
+		return analysisID, nil
+	}
+
 	var analysisID string
-	err := a.DB.QueryRowContext(ctx, analysisIDByExternalIDQuery, externalID).Scan(&analysisID)
+	err := a.reads.QueryRowContext(ctx, analysisIDByExternalIDQuery, externalID).Scan(&analysisID)
 	if err != nil {
 		return "", err
 	}
+
+	a.analysisIDs.set(externalID, analysisID)
+
 	return analysisID, nil
 }
 
+const analysisIDsByExternalIDsQuery = `
+	SELECT s.external_id, j.id
+	  FROM jobs j
+	  JOIN job_steps s ON s.job_id = j.id
+	 WHERE s.external_id = ANY($1)
+`
+
+// GetAnalysisIDsByExternalIDs returns the analysis IDs for the external IDs
+// passed in, keyed by external ID. The IDs that aren't cached are looked up in
+// a single query. External IDs that don't belong to an analysis are left out.
+func (a *Apps) GetAnalysisIDsByExternalIDs(ctx context.Context, externalIDs []string) (map[string]string, error) {
+	analysisIDs := map[string]string{}
+
+	seen := map[string]bool{}
+	missing := []string{}
+	for _, externalID := range externalIDs {
+		if seen[externalID] {
+			continue
+		}
+		seen[externalID] = true
+
+		if analysisID, ok := a.analysisIDs.get(externalID); ok {
+			analysisIDs[externalID] = analysisID
+			continue
+		}
+		missing = append(missing, externalID)
+	}
+	if len(missing) == 0 {
+		return analysisIDs, nil
+	}
+
+	rows := []struct {
+		ExternalID string `db:"external_id"`
+		AnalysisID string `db:"id"`
+	}{}
+	if err := a.reads.SelectContext(ctx, &rows, analysisIDsByExternalIDsQuery, pq.Array(missing)); err != nil {
+		return nil, err
+	}
+
+	for _, row := range rows {
+		analysisIDs[row.ExternalID] = row.AnalysisID
+		a.analysisIDs.set(row.ExternalID, row.AnalysisID)
+	}
+
+	return analysisIDs, nil
+}
+
 const analysisIDBySubdomainQuery = `
 	SELECT j.id
 	  FROM jobs j
@@ -110,7 +191,7 @@ const analysisIDBySubdomainQuery = `
 // generated for it.
 func (a *Apps) GetAnalysisIDBySubdomain(ctx context.Context, subdomain string) (string, error) {
 	var analysisID string
-	err := a.DB.QueryRowContext(ctx, analysisIDBySubdomainQuery, subdomain).Scan(&analysisID)
+	err := a.reads.QueryRowContext(ctx, analysisIDBySubdomainQuery, subdomain).Scan(&analysisID)
 	if err != nil {
 		return "", err
 	}
@@ -133,7 +214,11 @@ func (a *Apps) GetUserIP(ctx context.Context, userID string) (string, error) {
 		retval string
 	)
 
-	err := a.DB.QueryRowContext(ctx, getUserIPQuery, userID).Scan(&ipAddr)
+	if cached, ok := a.userIPs.get(userID); ok {
+		return cached, nil
+	}
+
+	err := a.reads.QueryRowContext(ctx, getUserIPQuery, userID).Scan(&ipAddr)
 	if err != nil {
 		return "", err
 	}
@@ -144,9 +229,60 @@ func (a *Apps) GetUserIP(ctx context.Context, userID string) (string, error) {
 		retval = ""
 	}
 
+	a.userIPs.set(userID, retval)
+
 	return retval, nil
 }
 
+const getUserIPsQuery = `
+	SELECT DISTINCT ON (l.user_id)
+	       l.user_id,
+	       l.ip_address
+	  FROM logins l
+	 WHERE l.user_id = ANY($1)
+  ORDER BY l.user_id, l.login_time DESC
+`
+
+// GetUserIPs returns the latest login IP address for each of the user IDs
+// passed in, keyed by user ID. The users that aren't cached are looked up in
+// a single query. Users who have never logged in are left out.
+func (a *Apps) GetUserIPs(ctx context.Context, userIDs []string) (map[string]string, error) {
+	ipAddrs := map[string]string{}
+
+	seen := map[string]bool{}
+	missing := []string{}
+	for _, userID := range userIDs {
+		if seen[userID] {
+			continue
+		}
+		seen[userID] = true
+
+		if cached, ok := a.userIPs.get(userID); ok {
+			ipAddrs[userID] = cached
+			continue
+		}
+		missing = append(missing, userID)
+	}
+	if len(missing) == 0 {
+		return ipAddrs, nil
+	}
+
+	rows := []struct {
+		UserID string         `db:"user_id"`
+		IPAddr sql.NullString `db:"ip_address"`
+	}{}
+	if err := a.reads.SelectContext(ctx, &rows, getUserIPsQuery, pq.Array(missing)); err != nil {
+		return nil, err
+	}
+
+	for _, row := range rows {
+		ipAddrs[row.UserID] = row.IPAddr.String
+		a.userIPs.set(row.UserID, row.IPAddr.String)
+	}
+
+	return ipAddrs, nil
+}
+
 const getAnalysisStatusQuery = `
 	SELECT j.status
 	  FROM jobs j
@@ -156,13 +292,58 @@ const getAnalysisStatusQuery = `
 // GetAnalysisStatus gets the current status of the overall Analysis/Job in the database.
 func (a *Apps) GetAnalysisStatus(ctx context.Context, analysisID string) (string, error) {
 	var status string
-	err := a.DB.QueryRowContext(ctx, getAnalysisStatusQuery, analysisID).Scan(&status)
+	err := a.reads.QueryRowContext(ctx, getAnalysisStatusQuery, analysisID).Scan(&status)
 	if err != nil {
 		return "", err
 	}
 	return status, nil
 }
 
+// InteractiveJobType is the job type of VICE analyses.
+const InteractiveJobType = "Interactive"
+
+// AnalysisSummary contains the fields from the database that are needed to
+// decide how an analysis should be described.
+type AnalysisSummary struct {
+	// JobType is the type of the analysis's first step, for example
+	// Interactive or DE.
+	JobType string
+
+	// ExternalID is the external ID of the analysis's first step. It may be
+	// empty if the step hasn't been submitted yet.
+	ExternalID string
+
+	// Status is the overall status of the analysis.
+	Status string
+}
+
+const analysisSummaryQuery = `
+	SELECT t.name,
+	       COALESCE(s.external_id::text, ''),
+	       j.status
+	  FROM jobs j
+	  JOIN job_steps s ON s.job_id = j.id
+	  JOIN job_types t ON s.job_type_id = t.id
+	 WHERE j.id = $1
+	 ORDER BY s.step_number
+	 LIMIT 1
+`
+
+// GetAnalysisSummary returns the job type, external ID, and status of the
+// analysis.
+func (a *Apps) GetAnalysisSummary(ctx context.Context, analysisID string) (*AnalysisSummary, error) {
+	summary := &AnalysisSummary{}
+	err := a.reads.QueryRowContext(ctx, analysisSummaryQuery, analysisID).Scan(
+		&summary.JobType,
+		&summary.ExternalID,
+		&summary.Status,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return summary, nil
+}
+
 const userByAnalysisIDQuery = `
 	SELECT u.username,
 	       u.id
@@ -174,7 +355,7 @@ const userByAnalysisIDQuery = `
 // GetUserByAnalysisID returns the username and id of the user that launched the analysis.
 func (a *Apps) GetUserByAnalysisID(ctx context.Context, analysisID string) (string, string, error) {
 	var username, id string
-	err := a.DB.QueryRowContext(ctx, userByAnalysisIDQuery, analysisID).Scan(&username, &id)
+	err := a.reads.QueryRowContext(ctx, userByAnalysisIDQuery, analysisID).Scan(&username, &id)
 	if err != nil {
 		return "", "", err
 	}
@@ -191,7 +372,7 @@ const userByUsername = `
 // GetUserID returns the user's UUID based on their full username, including domain suffix.
 func (a *Apps) GetUserID(ctx context.Context, username string) (string, error) {
 	var id string
-	err := a.DB.QueryRowContext(ctx, userByUsername, username).Scan(&id)
+	err := a.reads.QueryRowContext(ctx, userByUsername, username).Scan(&id)
 	return id, err
 }
 
@@ -210,6 +391,13 @@ func (a *Apps) setMillicoresReserved(ctx context.Context, analysisID string, mil
 	return err
 }
 
+// SetAnalysisMillicoresReserved updates the number of millicores reserved for
+// an analysis that's already running. Unlike SetMillicoresReserved, it doesn't
+// wait for the analysis to be recorded.
+func (a *Apps) SetAnalysisMillicoresReserved(ctx context.Context, analysisID string, millicores *apd.Decimal) error {
+	return a.setMillicoresReserved(ctx, analysisID, millicores)
+}
+
 func (a *Apps) tryForAnalysisID(ctx context.Context, job *model.Job, maxAttempts int) (string, error) {
 	for i := 0; i < maxAttempts; i++ {
 		analysisID, err := a.GetAnalysisIDByExternalID(ctx, job.InvocationID)
@@ -222,7 +410,7 @@ func (a *Apps) tryForAnalysisID(ctx context.Context, job *model.Job, maxAttempts
 	return "", fmt.Errorf("failed to find analysis ID after %d attempts", maxAttempts)
 }
 
-func (a *Apps) storeMillicoresInternal(ctx context.Context, job *model.Job, millicores *apd.Decimal) error {
+func (a *Apps) storeMillicoresInternal(ctx context.Context, job *model.Job, millicores *apd.Decimal, plannedEndDate *time.Time) error {
 	analysisID, err := a.tryForAnalysisID(ctx, job, 30)
 	if err != nil {
 		return err
@@ -232,6 +420,23 @@ func (a *Apps) storeMillicoresInternal(ctx context.Context, job *model.Job, mill
 		return err
 	}
 
+	if plannedEndDate != nil {
+		if err = a.setPlannedEndDate(ctx, analysisID, *plannedEndDate); err != nil {
+			return err
+		}
+	}
+
+	return err
+}
+
+const setPlannedEndDateStmt = `
+	UPDATE jobs
+	SET planned_end_date = $2
+	WHERE id = $1;
+`
+
+func (a *Apps) setPlannedEndDate(ctx context.Context, analysisID string, end time.Time) error {
+	_, err := a.DB.ExecContext(ctx, setPlannedEndDateStmt, analysisID, end)
 	return err
 }
 
@@ -247,3 +452,18 @@ func (a *Apps) SetMillicoresReserved(job *model.Job, millicores *apd.Decimal) er
 
 	return nil
 }
+
+// SetMillicoresReservedWithEndDate updates the number of millicores reserved
+// for a single job and replaces its time limit with a fixed end date.
+func (a *Apps) SetMillicoresReservedWithEndDate(job *model.Job, millicores *apd.Decimal, end time.Time) error {
+	newjob := millicoresJob{
+		ID:                 uuid.New(),
+		Job:                *job,
+		MillicoresReserved: millicores,
+		PlannedEndDate:     &end,
+	}
+
+	a.addJob <- newjob
+
+	return nil
+}
@@ -0,0 +1,97 @@
+package apps
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cockroachdb/apd"
+	"github.com/cyverse-de/model/v6"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetAnalysisIDsByExternalIDs(t *testing.T) {
+	assert := assert.New(t)
+
+	mockdb, mock, err := sqlmock.New()
+	assert.NoError(err)
+	defer mockdb.Close()
+
+	a := NewApps(sqlx.NewDb(mockdb, "sqlmock"), "@example.org")
+	a.ConfigureCache(&CacheConfig{MaxEntries: 10, AnalysisIDTTL: time.Hour, UserIPTTL: time.Hour})
+	a.analysisIDs.set("e1", "a1")
+
+	// Only the IDs that aren't cached are looked up, once each, in a single
+	// query.
+	mock.ExpectQuery("SELECT s.external_id, j.id").
+		WithArgs(pq.Array([]string{"e2", "e3"})).
+		WillReturnRows(sqlmock.NewRows([]string{"external_id", "id"}).AddRow("e2", "a2"))
+
+	analysisIDs, err := a.GetAnalysisIDsByExternalIDs(context.Background(), []string{"e1", "e2", "e2", "e3"})
+	assert.NoError(err)
+	assert.Equal(map[string]string{"e1": "a1", "e2": "a2"}, analysisIDs)
+	assert.NoError(mock.ExpectationsWereMet())
+
+	// The results are cached.
+	analysisIDs, err = a.GetAnalysisIDsByExternalIDs(context.Background(), []string{"e2"})
+	assert.NoError(err)
+	assert.Equal(map[string]string{"e2": "a2"}, analysisIDs)
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestGetUserIPs(t *testing.T) {
+	assert := assert.New(t)
+
+	mockdb, mock, err := sqlmock.New()
+	assert.NoError(err)
+	defer mockdb.Close()
+
+	a := NewApps(sqlx.NewDb(mockdb, "sqlmock"), "@example.org")
+
+	mock.ExpectQuery("SELECT DISTINCT ON").
+		WithArgs(pq.Array([]string{"u1", "u2", "u3"})).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "ip_address"}).
+			AddRow("u1", "10.0.0.1").
+			AddRow("u2", nil))
+
+	ipAddrs, err := a.GetUserIPs(context.Background(), []string{"u1", "u2", "u3"})
+	assert.NoError(err)
+	assert.Equal(map[string]string{"u1": "10.0.0.1", "u2": ""}, ipAddrs)
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestFinishWaitsForMillicores(t *testing.T) {
+	assert := assert.New(t)
+
+	mockdb, mock, err := sqlmock.New()
+	assert.NoError(err)
+	defer mockdb.Close()
+
+	a := NewApps(sqlx.NewDb(mockdb, "sqlmock"), "@example.org")
+	mock.ExpectQuery("SELECT j.id").
+		WithArgs("e1").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("a1"))
+	mock.ExpectExec("UPDATE jobs").
+		WillDelayFor(100 * time.Millisecond).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	done := make(chan struct{})
+	go func() {
+		a.Run()
+		close(done)
+	}()
+
+	assert.NoError(a.SetMillicoresReserved(&model.Job{InvocationID: "e1"}, apd.New(1000, 0)))
+	a.Finish()
+
+	// The millicores were stored before Finish returned, and Run has exited.
+	assert.NoError(mock.ExpectationsWereMet())
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run didn't exit")
+	}
+}
@@ -0,0 +1,226 @@
+package apps
+
+import (
+	"container/list"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// CacheConfig contains the settings for the lookup caches in *Apps.
+type CacheConfig struct {
+	// MaxEntries is the most entries each cache holds. The least recently
+	// used entries are evicted first.
+	MaxEntries int
+
+	// AnalysisIDTTL is how long analysis IDs are cached. The external ID of
+	// an analysis never changes, so this can be long.
+	AnalysisIDTTL time.Duration
+
+	// UserIPTTL is how long the latest login IP of a user is cached.
+	UserIPTTL time.Duration
+}
+
+// CacheStats contains the hit and miss counts for a cache.
+type CacheStats struct {
+	Hits   uint64 `json:"hits"`
+	Misses uint64 `json:"misses"`
+	Size   int    `json:"size"`
+}
+
+type cacheEntry struct {
+	key     string
+	value   string
+	expires time.Time
+}
+
+// lookupCache is a size-limited LRU cache with expiring entries.
+type lookupCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	ttl        time.Duration
+	entries    map[string]*list.Element
+	order      *list.List
+	now        func() time.Time
+	hits       uint64
+	misses     uint64
+}
+
+func newLookupCache(maxEntries int, ttl time.Duration) *lookupCache {
+	return &lookupCache{
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		entries:    map[string]*list.Element{},
+		order:      list.New(),
+		now:        time.Now,
+	}
+}
+
+// get returns the cached value for the key and true, or false if the key
+// isn't cached or has expired. A nil cache never contains anything.
+func (c *lookupCache) get(key string) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		return "", false
+	}
+
+	entry := elem.Value.(*cacheEntry)
+	if !c.now().Before(entry.expires) {
+		c.removeElement(elem)
+		c.misses++
+		return "", false
+	}
+
+	c.order.MoveToFront(elem)
+	c.hits++
+	return entry.value, true
+}
+
+// set caches the value for the key, evicting the least recently used entry
+// if the cache is full.
+func (c *lookupCache) set(key, value string) {
+	if c == nil || c.maxEntries <= 0 || c.ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expires := c.now().Add(c.ttl)
+
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*cacheEntry)
+		entry.value = value
+		entry.expires = expires
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, value: value, expires: expires})
+
+	for c.order.Len() > c.maxEntries {
+		c.removeElement(c.order.Back())
+	}
+}
+
+// remove drops the key from the cache.
+func (c *lookupCache) remove(key string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.removeElement(elem)
+	}
+}
+
+// purge drops every entry from the cache.
+func (c *lookupCache) purge() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = map[string]*list.Element{}
+	c.order.Init()
+}
+
+// removeElement must be called with the lock held.
+func (c *lookupCache) removeElement(elem *list.Element) {
+	c.order.Remove(elem)
+	delete(c.entries, elem.Value.(*cacheEntry).key)
+}
+
+func (c *lookupCache) stats() CacheStats {
+	if c == nil {
+		return CacheStats{}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return CacheStats{Hits: c.hits, Misses: c.misses, Size: c.order.Len()}
+}
+
+// ConfigureCache enables caching of analysis ID and user IP lookups. Lookups
+// aren't cached until it's called.
+func (a *Apps) ConfigureCache(cfg *CacheConfig) {
+	a.analysisIDs = newLookupCache(cfg.MaxEntries, cfg.AnalysisIDTTL)
+	a.userIPs = newLookupCache(cfg.MaxEntries, cfg.UserIPTTL)
+}
+
+// CacheStats returns the statistics for the analysis ID and user IP caches.
+func (a *Apps) CacheStats() map[string]CacheStats {
+	return map[string]CacheStats{
+		"analysis_ids": a.analysisIDs.stats(),
+		"user_ips":     a.userIPs.stats(),
+	}
+}
+
+// InvalidateAnalysisID drops the cached analysis ID for the external ID.
+func (a *Apps) InvalidateAnalysisID(externalID string) {
+	a.analysisIDs.remove(externalID)
+}
+
+// InvalidateUserIP drops the cached login IP for the user.
+func (a *Apps) InvalidateUserIP(userID string) {
+	a.userIPs.remove(userID)
+}
+
+// PurgeCache drops every cached lookup.
+func (a *Apps) PurgeCache() {
+	a.analysisIDs.purge()
+	a.userIPs.purge()
+}
+
+// CacheInvalidation is the body of a message that invalidates cached
+// lookups. A message that doesn't name a user or an analysis, or that can't
+// be parsed, purges the caches entirely.
+type CacheInvalidation struct {
+	UserID     string `json:"user_id"`
+	ExternalID string `json:"external_id"`
+}
+
+// handleInvalidation invalidates the cached lookups named in the message
+// body.
+func (a *Apps) handleInvalidation(data []byte) {
+	msg := &CacheInvalidation{}
+	if err := json.Unmarshal(data, msg); err != nil || (msg.UserID == "" && msg.ExternalID == "") {
+		log.Debug("purging the lookup caches")
+		a.PurgeCache()
+		return
+	}
+
+	if msg.UserID != "" {
+		log.Debugf("invalidating the cached login IP for user %s", msg.UserID)
+		a.InvalidateUserIP(msg.UserID)
+	}
+	if msg.ExternalID != "" {
+		log.Debugf("invalidating the cached analysis ID for %s", msg.ExternalID)
+		a.InvalidateAnalysisID(msg.ExternalID)
+	}
+}
+
+// ListenForInvalidations subscribes to the NATS subject that other services
+// publish to when users log in or analyses change, such as
+// cyverse.de.logins.>.
+func (a *Apps) ListenForInvalidations(nc *nats.Conn, subject string) (*nats.Subscription, error) {
+	return nc.Subscribe(subject, func(msg *nats.Msg) {
+		a.handleInvalidation(msg.Data)
+	})
+}
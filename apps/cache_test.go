@@ -0,0 +1,117 @@
+package apps
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLookupCacheExpiration(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	c := newLookupCache(10, time.Minute)
+	c.now = func() time.Time { return now }
+
+	c.set("a", "1")
+	value, ok := c.get("a")
+	assert.True(ok)
+	assert.Equal("1", value)
+
+	now = now.Add(time.Minute)
+	_, ok = c.get("a")
+	assert.False(ok)
+	assert.Equal(CacheStats{Hits: 1, Misses: 1, Size: 0}, c.stats())
+}
+
+func TestLookupCacheEviction(t *testing.T) {
+	assert := assert.New(t)
+
+	c := newLookupCache(2, time.Hour)
+	c.set("a", "1")
+	c.set("b", "2")
+
+	// Using a makes b the least recently used entry.
+	_, ok := c.get("a")
+	assert.True(ok)
+
+	c.set("c", "3")
+	_, ok = c.get("b")
+	assert.False(ok)
+	_, ok = c.get("a")
+	assert.True(ok)
+	_, ok = c.get("c")
+	assert.True(ok)
+}
+
+func TestNilLookupCache(t *testing.T) {
+	var c *lookupCache
+	c.set("a", "1")
+	_, ok := c.get("a")
+	assert.False(t, ok)
+	c.remove("a")
+	c.purge()
+}
+
+func TestHandleInvalidation(t *testing.T) {
+	assert := assert.New(t)
+
+	a := &Apps{}
+	a.ConfigureCache(&CacheConfig{MaxEntries: 10, AnalysisIDTTL: time.Hour, UserIPTTL: time.Hour})
+
+	a.userIPs.set("u1", "10.0.0.1")
+	a.userIPs.set("u2", "10.0.0.2")
+	a.analysisIDs.set("e1", "a1")
+
+	a.handleInvalidation([]byte(`{"user_id": "u1"}`))
+	_, ok := a.userIPs.get("u1")
+	assert.False(ok)
+	_, ok = a.userIPs.get("u2")
+	assert.True(ok)
+	_, ok = a.analysisIDs.get("e1")
+	assert.True(ok)
+
+	a.handleInvalidation([]byte(`not json`))
+	_, ok = a.userIPs.get("u2")
+	assert.False(ok)
+	_, ok = a.analysisIDs.get("e1")
+	assert.False(ok)
+}
+
+func TestGetUserIPCached(t *testing.T) {
+	assert := assert.New(t)
+
+	mockdb, mock, err := sqlmock.New()
+	assert.NoError(err)
+	defer mockdb.Close()
+
+	a := NewApps(sqlx.NewDb(mockdb, "sqlmock"), "@example.org")
+	a.ConfigureCache(&CacheConfig{MaxEntries: 10, AnalysisIDTTL: time.Hour, UserIPTTL: time.Hour})
+
+	// Only the first lookup reaches the database.
+	mock.ExpectQuery("SELECT l.ip_address").
+		WithArgs("u1").
+		WillReturnRows(sqlmock.NewRows([]string{"ip_address"}).AddRow("10.0.0.1"))
+
+	for range [3]int{} {
+		ip, err := a.GetUserIP(context.Background(), "u1")
+		assert.NoError(err)
+		assert.Equal("10.0.0.1", ip)
+	}
+	assert.NoError(mock.ExpectationsWereMet())
+
+	// Lookups reach the database again after the user is invalidated.
+	a.InvalidateUserIP("u1")
+	mock.ExpectQuery("SELECT l.ip_address").
+		WithArgs("u1").
+		WillReturnRows(sqlmock.NewRows([]string{"ip_address"}).AddRow("10.0.0.2"))
+
+	ip, err := a.GetUserIP(context.Background(), "u1")
+	assert.NoError(err)
+	assert.Equal("10.0.0.2", ip)
+	assert.NoError(mock.ExpectationsWereMet())
+}
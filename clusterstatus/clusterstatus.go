@@ -0,0 +1,269 @@
+// Package clusterstatus collects the health and workload of the app-exposer
+// instances serving VICE analyses in each cluster, so that operators don't
+// have to query each one by hand.
+package clusterstatus
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/cyverse-de/app-exposer/internal"
+	"github.com/pkg/errors"
+)
+
+// Cluster is an app-exposer instance to check.
+type Cluster struct {
+	// Name identifies the cluster in the output.
+	Name string `json:"name"`
+
+	// URL is the base URL of the cluster's app-exposer.
+	URL string `json:"url"`
+}
+
+// ParseCluster parses a cluster given as name=url. The URL's host is used as
+// the name if only a URL is given.
+func ParseCluster(value string) (*Cluster, error) {
+	name, rawURL, found := strings.Cut(value, "=")
+	if !found {
+		rawURL = value
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid cluster URL %q", rawURL)
+	}
+	if !found {
+		name = u.Host
+	}
+	if name == "" {
+		return nil, fmt.Errorf("the cluster name in %q is empty", value)
+	}
+
+	return &Cluster{Name: name, URL: strings.TrimSuffix(rawURL, "/")}, nil
+}
+
+// readiness mirrors the response body of app-exposer's /ready endpoint.
+type readiness struct {
+	Ready        bool `json:"ready"`
+	Draining     bool `json:"draining"`
+	Dependencies map[string]struct {
+		Status string `json:"status"`
+		Error  string `json:"error"`
+	} `json:"dependencies"`
+}
+
+// Status is the health and workload of a cluster. The fields other than the
+// cluster and Reachable are only set if they could be looked up.
+type Status struct {
+	Cluster
+
+	// Reachable is false if the readiness check couldn't be requested at all.
+	Reachable bool `json:"reachable"`
+
+	// Ready and Draining come from the readiness check.
+	Ready    bool `json:"ready"`
+	Draining bool `json:"draining,omitempty"`
+
+	// Dependencies maps each of app-exposer's dependencies to ok, or to the
+	// error the readiness check reported for it.
+	Dependencies map[string]string `json:"dependencies,omitempty"`
+
+	// Analyses is the number of VICE analysis Deployments in the cluster.
+	Analyses *int `json:"analyses,omitempty"`
+
+	// Platform is the summary from the status page, if it's enabled.
+	Platform *internal.PlatformSummary `json:"platform,omitempty"`
+
+	// GPUResources is the total of each GPU resource allocatable on the GPU
+	// nodes.
+	GPUResources map[string]int64 `json:"gpu_resources,omitempty"`
+
+	// Errors lists the requests that failed.
+	Errors []string `json:"errors,omitempty"`
+}
+
+// Checker collects the status of clusters.
+type Checker struct {
+	Client *http.Client
+}
+
+// getJSON requests the path from the cluster's app-exposer and decodes the
+// response into v. Returns false if the endpoint doesn't exist.
+func (c *Checker) getJSON(ctx context.Context, cluster *Cluster, path string, v interface{}) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, cluster.URL+path, nil)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+
+	// The readiness check responds with a 503 when app-exposer isn't ready,
+	// but the body still says why.
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusServiceUnavailable {
+		return false, fmt.Errorf("GET %s returned %s", path, resp.Status)
+	}
+	if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return false, errors.Wrapf(err, "unable to parse the response to GET %s", path)
+	}
+	return true, nil
+}
+
+// Check returns the status of the cluster. It never fails; the requests that
+// didn't work are listed in the status's errors.
+func (c *Checker) Check(ctx context.Context, cluster *Cluster) *Status {
+	status := &Status{Cluster: *cluster}
+
+	ready := &readiness{}
+	if _, err := c.getJSON(ctx, cluster, "/ready", ready); err != nil {
+		status.Errors = append(status.Errors, err.Error())
+		return status
+	}
+	status.Reachable = true
+	status.Ready = ready.Ready
+	status.Draining = ready.Draining
+	status.Dependencies = map[string]string{}
+	for name, dependency := range ready.Dependencies {
+		status.Dependencies[name] = dependency.Status
+		if dependency.Error != "" {
+			status.Dependencies[name] = dependency.Error
+		}
+	}
+
+	listing := &internal.ResourceInfo{}
+	if found, err := c.getJSON(ctx, cluster, "/vice/admin/analyses/", listing); err != nil {
+		status.Errors = append(status.Errors, err.Error())
+	} else if found {
+		analyses := len(listing.Deployments)
+		status.Analyses = &analyses
+	}
+
+	platform := &internal.PlatformSummary{}
+	if found, err := c.getJSON(ctx, cluster, "/status", platform); err != nil {
+		status.Errors = append(status.Errors, err.Error())
+	} else if found {
+		status.Platform = platform
+	}
+
+	caps := &internal.ClusterCapabilities{}
+	if found, err := c.getJSON(ctx, cluster, "/vice/capabilities", caps); err != nil {
+		status.Errors = append(status.Errors, err.Error())
+	} else if found {
+		status.GPUResources = caps.GPUResources
+	}
+
+	return status
+}
+
+// CheckAll checks the clusters at the same time and returns their statuses
+// in the same order.
+func (c *Checker) CheckAll(ctx context.Context, clusters []*Cluster) []*Status {
+	statuses := make([]*Status, len(clusters))
+
+	var wg sync.WaitGroup
+	for idx, cluster := range clusters {
+		wg.Add(1)
+		go func(idx int, cluster *Cluster) {
+			defer wg.Done()
+			statuses[idx] = c.Check(ctx, cluster)
+		}(idx, cluster)
+	}
+	wg.Wait()
+
+	return statuses
+}
+
+// health summarizes the readiness of the cluster for the table.
+func (s *Status) health() string {
+	switch {
+	case !s.Reachable:
+		return "unreachable"
+	case s.Draining:
+		return "draining"
+	case s.Ready:
+		return "ready"
+	default:
+		failing := []string{}
+		for name, dependency := range s.Dependencies {
+			if dependency != "ok" {
+				failing = append(failing, name)
+			}
+		}
+		sort.Strings(failing)
+		return "not ready (" + strings.Join(failing, ", ") + ")"
+	}
+}
+
+// gpus formats the GPU resources for the table.
+func (s *Status) gpus() string {
+	if len(s.GPUResources) == 0 {
+		return "-"
+	}
+	names := make([]string, 0, len(s.GPUResources))
+	for name := range s.GPUResources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	values := make([]string, 0, len(names))
+	for _, name := range names {
+		values = append(values, fmt.Sprintf("%s=%d", strings.TrimPrefix(name, "nvidia.com/"), s.GPUResources[name]))
+	}
+	return strings.Join(values, ",")
+}
+
+// WriteTable writes the statuses as a table with a row per cluster. Values
+// that couldn't be looked up are shown as -.
+func WriteTable(w io.Writer, statuses []*Status) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CLUSTER\tHEALTH\tANALYSES\tSTARTING\tLAUNCHED\tFAILED\tGPUS\tERRORS")
+
+	for _, s := range statuses {
+		analyses, starting, launched, failed := "-", "-", "-", "-"
+		if s.Analyses != nil {
+			analyses = fmt.Sprint(*s.Analyses)
+		}
+		if s.Platform != nil && s.Platform.Queue != nil {
+			starting = fmt.Sprint(s.Platform.Queue.Starting)
+		}
+		if s.Platform != nil && s.Platform.Launches != nil {
+			launched = fmt.Sprint(s.Platform.Launches.Launched)
+			failed = fmt.Sprint(s.Platform.Launches.Failed)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%d\n", s.Name, s.health(), analyses, starting, launched, failed, s.gpus(), len(s.Errors))
+	}
+
+	return tw.Flush()
+}
+
+// WriteJSON writes the statuses as an indented JSON array.
+func WriteJSON(w io.Writer, statuses []*Status) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(statuses)
+}
+
+// Healthy returns true if every cluster is reachable and ready.
+func Healthy(statuses []*Status) bool {
+	for _, s := range statuses {
+		if !s.Reachable || !s.Ready {
+			return false
+		}
+	}
+	return true
+}
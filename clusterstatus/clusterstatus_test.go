@@ -0,0 +1,118 @@
+package clusterstatus
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCluster(t *testing.T) {
+	assert := assert.New(t)
+
+	cluster, err := ParseCluster("prod=http://app-exposer.prod/")
+	assert.NoError(err)
+	assert.Equal(&Cluster{Name: "prod", URL: "http://app-exposer.prod"}, cluster)
+
+	cluster, err = ParseCluster("http://app-exposer.qa:60000")
+	assert.NoError(err)
+	assert.Equal(&Cluster{Name: "app-exposer.qa:60000", URL: "http://app-exposer.qa:60000"}, cluster)
+
+	_, err = ParseCluster("prod=app-exposer")
+	assert.Error(err)
+	_, err = ParseCluster("=http://app-exposer.prod")
+	assert.Error(err)
+}
+
+// testServer serves the given responses by path and a 404 for the rest.
+func testServer(t *testing.T, responses map[string]string, readyStatus int) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := responses[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/ready" {
+			w.WriteHeader(readyStatus)
+		}
+		w.Write([]byte(body)) // nolint:errcheck
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestCheckAll(t *testing.T) {
+	assert := assert.New(t)
+
+	healthy := testServer(t, map[string]string{
+		"/ready":                `{"ready": true, "dependencies": {"database": {"status": "ok"}, "nats": {"status": "ok"}}}`,
+		"/vice/admin/analyses/": `{"deployments": [{}, {}, {}], "pods": []}`,
+		"/status":               `{"status": "operational", "launches": {"window_minutes": 60, "launched": 12, "failed": 1}, "queue": {"starting": 2}}`,
+		"/vice/capabilities":    `{"gpu_resources": {"nvidia.com/gpu": 8, "nvidia.com/mig-1g.5gb": 14}}`,
+	}, http.StatusOK)
+
+	// The status page is disabled and the database is down.
+	unready := testServer(t, map[string]string{
+		"/ready":                `{"ready": false, "dependencies": {"database": {"status": "unavailable", "error": "connection refused"}, "nats": {"status": "ok"}}}`,
+		"/vice/admin/analyses/": `{"deployments": []}`,
+		"/vice/capabilities":    `{"gpu_resources": {}}`,
+	}, http.StatusServiceUnavailable)
+
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	checker := &Checker{Client: http.DefaultClient}
+	statuses := checker.CheckAll(context.Background(), []*Cluster{
+		{Name: "prod", URL: healthy.URL},
+		{Name: "qa", URL: unready.URL},
+		{Name: "dev", URL: down.URL},
+	})
+	assert.Len(statuses, 3)
+
+	prod := statuses[0]
+	assert.True(prod.Reachable)
+	assert.True(prod.Ready)
+	assert.Equal(map[string]string{"database": "ok", "nats": "ok"}, prod.Dependencies)
+	if assert.NotNil(prod.Analyses) {
+		assert.Equal(3, *prod.Analyses)
+	}
+	if assert.NotNil(prod.Platform) && assert.NotNil(prod.Platform.Launches) {
+		assert.Equal(12, prod.Platform.Launches.Launched)
+		assert.Equal(2, prod.Platform.Queue.Starting)
+	}
+	assert.Equal(int64(8), prod.GPUResources["nvidia.com/gpu"])
+	assert.Empty(prod.Errors)
+
+	qa := statuses[1]
+	assert.True(qa.Reachable)
+	assert.False(qa.Ready)
+	assert.Equal("connection refused", qa.Dependencies["database"])
+	assert.Nil(qa.Platform)
+	assert.Empty(qa.Errors)
+
+	dev := statuses[2]
+	assert.False(dev.Reachable)
+	assert.Len(dev.Errors, 1)
+
+	assert.False(Healthy(statuses))
+	assert.True(Healthy(statuses[:1]))
+
+	var buf bytes.Buffer
+	assert.NoError(WriteTable(&buf, statuses))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if assert.Len(lines, 4) {
+		assert.Equal([]string{"prod", "ready", "3", "2", "12", "1", "gpu=8,mig-1g.5gb=14", "0"}, strings.Fields(lines[1]))
+		assert.Equal([]string{"qa", "not", "ready", "(database)", "0", "-", "-", "-", "-", "0"}, strings.Fields(lines[2]))
+		assert.Equal([]string{"dev", "unreachable", "-", "-", "-", "-", "-", "1"}, strings.Fields(lines[3]))
+	}
+
+	buf.Reset()
+	assert.NoError(WriteJSON(&buf, statuses[:1]))
+	assert.Contains(buf.String(), `"name": "prod"`)
+	assert.Contains(buf.String(), `"analyses": 3`)
+}
@@ -0,0 +1,127 @@
+// job-gen generates model.Job submissions from YAML descriptors. The
+// submissions can be posted to /vice/launch for local testing or used as
+// fixtures by the integration tests.
+//
+// Usage:
+//
+//	job-gen -f descriptors.yml -o out/
+//
+// Each descriptor in the file (separated by ---) produces one submission.
+// Submissions are written to stdout as JSON unless an output directory is
+// given, in which case each one is written to <name>-<uuid>.json.
+//
+// With -validate, the submissions are checked by the app-exposer at the given
+// base URL instead of being written out, and nothing is launched:
+//
+//	job-gen -f descriptors.yml -validate http://localhost:60000
+//
+// Every problem found with each submission is printed, or the results are
+// printed as JSON with -json, and job-gen exits with status 1 if any of the
+// submissions has problems or couldn't be validated.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/cyverse-de/app-exposer/jobgen"
+	"github.com/cyverse-de/app-exposer/launchlint"
+	"github.com/cyverse-de/model/v6"
+)
+
+func writeJob(w io.Writer, job *model.Job, indent bool) error {
+	encoder := json.NewEncoder(w)
+	if indent {
+		encoder.SetIndent("", "  ")
+	}
+	return encoder.Encode(job)
+}
+
+func main() {
+	var (
+		inputPath  = flag.String("f", "-", "Path to the YAML descriptors. Use - to read from stdin")
+		outputDir  = flag.String("o", "", "(optional) Directory to write the submissions to instead of stdout")
+		userSuffix = flag.String("user-suffix", "@iplantcollaborative.org", "The user suffix for all users in the DE installation")
+		indent     = flag.Bool("indent", true, "Indent the generated JSON")
+		validate   = flag.String("validate", "", "(optional) Base URL of the app-exposer to validate the submissions with instead of writing them out")
+		asJSON     = flag.Bool("json", false, "Print the validation results as JSON")
+		timeout    = flag.Duration("timeout", 30*time.Second, "How long to wait for each validation")
+	)
+	flag.Parse()
+
+	var in io.Reader = os.Stdin
+	if *inputPath != "-" {
+		f, err := os.Open(*inputPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		in = f
+	}
+
+	generator := &jobgen.Generator{UserSuffix: *userSuffix}
+
+	jobs, err := generator.GenerateAll(in)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *validate != "" {
+		linter := &launchlint.Linter{Client: &http.Client{Timeout: *timeout}, URL: *validate}
+		results := linter.ValidateAll(context.Background(), jobs)
+
+		write := launchlint.WriteReport
+		if *asJSON {
+			write = launchlint.WriteJSON
+		}
+		if err = write(os.Stdout, results); err != nil {
+			log.Fatal(err)
+		}
+
+		if !launchlint.Valid(results) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *outputDir == "" {
+		for _, job := range jobs {
+			if err = writeJob(os.Stdout, job, *indent); err != nil {
+				log.Fatal(err)
+			}
+		}
+		return
+	}
+
+	if err = os.MkdirAll(*outputDir, 0755); err != nil {
+		log.Fatal(err)
+	}
+
+	for _, job := range jobs {
+		outputPath := filepath.Join(*outputDir, fmt.Sprintf("%s-%s.json", job.Name, job.InvocationID))
+
+		f, err := os.Create(outputPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err = writeJob(f, job, *indent); err != nil {
+			f.Close()
+			log.Fatal(err)
+		}
+
+		if err = f.Close(); err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Println(outputPath)
+	}
+}
@@ -0,0 +1,175 @@
+// spec-diff compares the Kubernetes objects generated for recorded job
+// submissions by two versions of the spec builders, so that refactors of the
+// builders can be checked for unintended changes.
+//
+// Usage:
+//
+//	spec-diff render -jobs recorded/ -db postgres://... [-init init.json] -o before.json
+//	spec-diff compare before.json after.json
+//
+// The render command runs every *.json job in the directory through the spec
+// builders and writes the generated objects to a file. Nothing is created in
+// a cluster and nothing is written to the database; it's only read for the
+// user IPs, tool settings and default environment variables. The optional
+// init file is a JSON object with the internal.Init settings to use.
+//
+// To compare two revisions, build spec-diff in a worktree for each one, render
+// the same jobs with both, then compare the results:
+//
+//	git worktree add /tmp/before main
+//	(cd /tmp/before && go run ./cmd/spec-diff render -jobs $PWD/recorded -db $DB -o /tmp/before.json)
+//	go run ./cmd/spec-diff render -jobs recorded -db $DB -o /tmp/after.json
+//	go run ./cmd/spec-diff compare /tmp/before.json /tmp/after.json
+//
+// The compare command writes a JSON report of the differences to stdout and
+// exits with status 1 if there are any.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/cyverse-de/app-exposer/internal"
+	"github.com/cyverse-de/app-exposer/specdiff"
+	"github.com/cyverse-de/model/v6"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: spec-diff render -jobs <dir> -db <uri> [-init <file>] [-o <file>]")
+	fmt.Fprintln(os.Stderr, "       spec-diff compare <before> <after>")
+	os.Exit(2)
+}
+
+func readJSON(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("error parsing %s: %w", path, err)
+	}
+	return nil
+}
+
+func writeJSON(w io.Writer, v interface{}) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+func render(args []string) {
+	var (
+		flags      = flag.NewFlagSet("render", flag.ExitOnError)
+		jobsDir    = flags.String("jobs", "", "Directory containing the recorded job JSON files")
+		dbURI      = flags.String("db", "", "URI of the DE database to read user IPs and tool settings from")
+		initPath   = flags.String("init", "", "(optional) JSON file containing the internal.Init settings")
+		outputPath = flags.String("o", "", "(optional) File to write the objects to instead of stdout")
+	)
+	if err := flags.Parse(args); err != nil {
+		log.Fatal(err)
+	}
+	if *jobsDir == "" || *dbURI == "" {
+		usage()
+	}
+
+	init := &internal.Init{
+		ViceNamespace: "vice-apps",
+		UserSuffix:    "@iplantcollaborative.org",
+	}
+	if *initPath != "" {
+		if err := readJSON(*initPath, init); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	db, err := sqlx.Connect("postgres", *dbURI)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	simulator, err := internal.NewSimulator(init, db, fake.NewSimpleClientset())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	paths, err := filepath.Glob(filepath.Join(*jobsDir, "*.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	sort.Strings(paths)
+
+	rendering := specdiff.Rendering{}
+	for _, path := range paths {
+		job := &model.Job{}
+		if err = readJSON(path, job); err != nil {
+			log.Fatal(err)
+		}
+
+		resources, err := simulator.Simulate(context.Background(), job)
+		if err != nil {
+			log.Fatalf("error rendering %s: %s", path, err)
+		}
+		rendering[filepath.Base(path)] = resources
+	}
+
+	out := os.Stdout
+	if *outputPath != "" {
+		if out, err = os.Create(*outputPath); err != nil {
+			log.Fatal(err)
+		}
+		defer out.Close()
+	}
+
+	if err = writeJSON(out, rendering); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func compare(args []string) {
+	if len(args) != 2 {
+		usage()
+	}
+
+	var before, after specdiff.Rendering
+	if err := readJSON(args[0], &before); err != nil {
+		log.Fatal(err)
+	}
+	if err := readJSON(args[1], &after); err != nil {
+		log.Fatal(err)
+	}
+
+	report := specdiff.Compare(before, after)
+	if err := writeJSON(os.Stdout, report); err != nil {
+		log.Fatal(err)
+	}
+
+	if len(report.Changes) > 0 {
+		os.Exit(1)
+	}
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	switch os.Args[1] {
+	case "render":
+		render(os.Args[2:])
+	case "compare":
+		compare(os.Args[2:])
+	default:
+		usage()
+	}
+}
@@ -0,0 +1,68 @@
+// vice-status prints the health and workload of the app-exposer instances
+// serving VICE analyses, one per cluster, so that operators don't have to
+// query each one by hand.
+//
+// Usage:
+//
+//	vice-status [-json] [-timeout 10s] name=url [name=url ...]
+//
+// Each cluster is given as a name and the base URL of its app-exposer, such
+// as prod=http://app-exposer.prod. The readiness check, the analysis listing,
+// the status page, and the cluster capabilities are requested from each one
+// at the same time. The results are printed as a table, or as JSON with
+// -json, and vice-status exits with status 1 if any of the clusters is
+// unreachable or not ready.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/cyverse-de/app-exposer/clusterstatus"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: vice-status [-json] [-timeout <duration>] <name=url> [<name=url> ...]")
+	os.Exit(2)
+}
+
+func main() {
+	var (
+		asJSON  = flag.Bool("json", false, "Print the statuses as JSON instead of a table")
+		timeout = flag.Duration("timeout", 10*time.Second, "How long to wait for each cluster")
+	)
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+	}
+
+	clusters := []*clusterstatus.Cluster{}
+	for _, arg := range flag.Args() {
+		cluster, err := clusterstatus.ParseCluster(arg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		clusters = append(clusters, cluster)
+	}
+
+	checker := &clusterstatus.Checker{Client: &http.Client{Timeout: *timeout}}
+	statuses := checker.CheckAll(context.Background(), clusters)
+
+	write := clusterstatus.WriteTable
+	if *asJSON {
+		write = clusterstatus.WriteJSON
+	}
+	if err := write(os.Stdout, statuses); err != nil {
+		log.Fatal(err)
+	}
+
+	if !clusterstatus.Healthy(statuses) {
+		os.Exit(1)
+	}
+}
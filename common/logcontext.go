@@ -0,0 +1,75 @@
+package common
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/baggage"
+)
+
+// RequestIDField is the log field containing the request's correlation ID.
+const RequestIDField = "request-id"
+
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of the context that carries the request's
+// correlation ID.
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, requestID)
+}
+
+// RequestIDFromContext returns the correlation ID carried by the context, or
+// an empty string if it doesn't have one.
+func RequestIDFromContext(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey{}).(string)
+	return requestID
+}
+
+// ContextHook is a logrus hook that adds the correlation ID and selected
+// trace baggage from an entry's context to the entry's fields, so that every
+// line logged with log.WithContext(ctx) while handling a request can be found
+// together. Fields that are already set aren't replaced.
+type ContextHook struct {
+	// BaggageFields maps the baggage keys to copy to the names of the fields
+	// they're copied to.
+	BaggageFields map[string]string
+}
+
+// Levels returns all log levels.
+func (h ContextHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire adds the fields from the entry's context.
+func (h ContextHook) Fire(entry *logrus.Entry) error {
+	if entry.Context == nil {
+		return nil
+	}
+
+	added := logrus.Fields{}
+	if requestID := RequestIDFromContext(entry.Context); requestID != "" {
+		added[RequestIDField] = requestID
+	}
+	bag := baggage.FromContext(entry.Context)
+	for key, field := range h.BaggageFields {
+		if value := bag.Member(key).Value(); value != "" {
+			added[field] = value
+		}
+	}
+	if len(added) == 0 {
+		return nil
+	}
+
+	// The fields map may be shared with other entries, so it's replaced
+	// rather than modified.
+	fields := make(logrus.Fields, len(entry.Data)+len(added))
+	for k, v := range added {
+		fields[k] = v
+	}
+	for k, v := range entry.Data {
+		fields[k] = v
+	}
+	entry.Data = fields
+
+	return nil
+}
@@ -0,0 +1,37 @@
+package common
+
+import (
+	"context"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/baggage"
+)
+
+func TestContextHook(t *testing.T) {
+	assert := assert.New(t)
+
+	hook := ContextHook{BaggageFields: map[string]string{"vice.external-id": "external-id"}}
+
+	// Entries without a context are left alone.
+	entry := &logrus.Entry{Data: logrus.Fields{"package": "apps"}}
+	assert.NoError(hook.Fire(entry))
+	assert.Equal(logrus.Fields{"package": "apps"}, entry.Data)
+
+	member, err := baggage.NewMemberRaw("vice.external-id", "ext-1")
+	assert.NoError(err)
+	bag, err := baggage.New(member)
+	assert.NoError(err)
+	ctx := WithRequestID(baggage.ContextWithBaggage(context.Background(), bag), "req-1")
+
+	data := logrus.Fields{"package": "apps", "external-id": "explicit"}
+	entry = &logrus.Entry{Context: ctx, Data: data}
+	assert.NoError(hook.Fire(entry))
+	assert.Equal("req-1", entry.Data[RequestIDField])
+	assert.Equal("apps", entry.Data["package"])
+
+	// Fields that are already set win, and the original map isn't modified.
+	assert.Equal("explicit", entry.Data["external-id"])
+	assert.NotContains(data, RequestIDField)
+}
@@ -52,6 +52,7 @@ func DetailedError(writer http.ResponseWriter, cause error, code int) {
 	case error:
 		errorResponse = ErrorResponse{Message: val.Error()}
 	}
+	errorResponse.Message = Redact(errorResponse.Message)
 
 	// Return the response.
 	writer.WriteHeader(code)
@@ -77,5 +78,6 @@ func NewErrorResponse(err error) ErrorResponse {
 	case error:
 		errorResponse = ErrorResponse{Message: val.Error()}
 	}
+	errorResponse.Message = Redact(errorResponse.Message)
 	return errorResponse
 }
@@ -0,0 +1,134 @@
+package common
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Redacted replaces sensitive values in redacted strings.
+const Redacted = "[REDACTED]"
+
+// minSecretLength is the length below which registered secrets are ignored,
+// since replacing very short strings would mangle unrelated text.
+const minSecretLength = 4
+
+// redactPattern replaces the sensitive part of the text matched by a regular
+// expression. The replacement may refer to the capture groups.
+type redactPattern struct {
+	re          *regexp.Regexp
+	replacement string
+}
+
+// redactPatterns match sensitive values that show up in k8s specs, URLs, job
+// submissions, and error messages from other services.
+var redactPatterns = []redactPattern{
+	// Command-line flags such as --keycloak-client-secret or --password.
+	{
+		re:          regexp.MustCompile(`(?i)(--[a-z0-9-]*(?:secret|password|passwd|token)[= ])(\S+)`),
+		replacement: "${1}" + Redacted,
+	},
+
+	// Key/value pairs in JSON, YAML, query strings, and environment variables,
+	// including the Harbor credentials in the image auth field of a job.
+	{
+		re:          regexp.MustCompile(`(?i)((?:^|[^a-z0-9_-])"?[a-z0-9_-]*(?:secret|password|passwd|token|encrypted[_-]?key|api[_-]?key|auth)"?\s*[:=]\s*"?)([^"\s,&}]+)`),
+		replacement: "${1}" + Redacted,
+	},
+
+	// Passwords embedded in URLs, such as the database URI.
+	{
+		re:          regexp.MustCompile(`(://[^:/\s@]+:)([^@\s/]+)(@)`),
+		replacement: "${1}" + Redacted + "${3}",
+	},
+
+	// Authorization headers.
+	{
+		re:          regexp.MustCompile(`(?i)(\b(?:basic|bearer)\s+)[a-z0-9._~+/=-]+`),
+		replacement: "${1}" + Redacted,
+	},
+
+	// PEM-encoded private keys.
+	{
+		re:          regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`),
+		replacement: Redacted,
+	},
+}
+
+var (
+	secretsMu sync.RWMutex
+	secrets   []string
+)
+
+// RegisterSecret adds values that must never appear in logs or error
+// responses, such as the client secrets read from the configuration.
+func RegisterSecret(values ...string) {
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+
+	for _, value := range values {
+		if len(value) < minSecretLength {
+			continue
+		}
+		secrets = append(secrets, value)
+	}
+
+	// Replace longer secrets first in case one contains another.
+	sort.Slice(secrets, func(i, j int) bool {
+		return len(secrets[i]) > len(secrets[j])
+	})
+}
+
+// Redact returns a copy of s with sensitive values replaced.
+func Redact(s string) string {
+	if s == "" {
+		return s
+	}
+
+	secretsMu.RLock()
+	for _, secret := range secrets {
+		s = strings.ReplaceAll(s, secret, Redacted)
+	}
+	secretsMu.RUnlock()
+
+	for _, p := range redactPatterns {
+		s = p.re.ReplaceAllString(s, p.replacement)
+	}
+
+	return s
+}
+
+// RedactHook is a logrus hook that redacts sensitive values from log messages
+// and string or error fields before they're written.
+type RedactHook struct{}
+
+// Levels returns all log levels, since secrets must be redacted at every
+// level.
+func (h RedactHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire redacts the entry.
+func (h RedactHook) Fire(entry *logrus.Entry) error {
+	entry.Message = Redact(entry.Message)
+
+	// The fields map may be shared with other entries, so it's replaced
+	// rather than modified.
+	fields := make(logrus.Fields, len(entry.Data))
+	for k, v := range entry.Data {
+		switch val := v.(type) {
+		case string:
+			fields[k] = Redact(val)
+		case error:
+			fields[k] = Redact(val.Error())
+		default:
+			fields[k] = v
+		}
+	}
+	entry.Data = fields
+
+	return nil
+}
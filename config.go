@@ -0,0 +1,109 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/knadh/koanf"
+	"github.com/labstack/echo/v4"
+)
+
+// sensitiveConfigKey matches the last part of the flag names and configuration
+// keys whose values are always redacted, whatever they look like.
+var sensitiveConfigKey = regexp.MustCompile(`(?i)(secret|password|passwd|token|credential|api[-_]?key|encrypted[-_]?key|private[-_]?key)`)
+
+// ConfigValue is a single flag or configuration setting.
+type ConfigValue struct {
+	Name  string      `json:"name"`
+	Value interface{} `json:"value"`
+
+	// Default is true if a flag wasn't set on the command line.
+	Default bool `json:"default,omitempty"`
+}
+
+// EffectiveConfig is the configuration app-exposer is running with.
+type EffectiveConfig struct {
+	Flags  []ConfigValue `json:"flags"`
+	Config []ConfigValue `json:"config"`
+}
+
+// redactConfigValue returns the value with anything sensitive replaced. The
+// values of sensitive keys are replaced entirely; other strings only have
+// the parts that look like credentials, such as passwords in URLs, replaced.
+func redactConfigValue(name string, value interface{}) interface{} {
+	parts := strings.Split(name, ".")
+	if sensitiveConfigKey.MatchString(parts[len(parts)-1]) {
+		if value == nil || value == "" {
+			return value
+		}
+		return common.Redacted
+	}
+
+	switch v := value.(type) {
+	case string:
+		return common.Redact(v)
+	case []interface{}:
+		redacted := make([]interface{}, len(v))
+		for i, elem := range v {
+			redacted[i] = redactConfigValue(name, elem)
+		}
+		return redacted
+	case []string:
+		redacted := make([]string, len(v))
+		for i, elem := range v {
+			redacted[i] = common.Redact(elem)
+		}
+		return redacted
+	default:
+		return v
+	}
+}
+
+// effectiveConfig returns the flags, including the ones left at their
+// defaults, and the configuration values merged from the config file,
+// dotenv file, and environment, with secrets redacted. Both are sorted by
+// name.
+func effectiveConfig(flags *flag.FlagSet, c *koanf.Koanf) *EffectiveConfig {
+	set := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	config := &EffectiveConfig{
+		Flags:  []ConfigValue{},
+		Config: []ConfigValue{},
+	}
+
+	flags.VisitAll(func(f *flag.Flag) {
+		config.Flags = append(config.Flags, ConfigValue{
+			Name:    f.Name,
+			Value:   redactConfigValue(f.Name, f.Value.String()),
+			Default: !set[f.Name],
+		})
+	})
+
+	for name, value := range c.All() {
+		config.Config = append(config.Config, ConfigValue{
+			Name:  name,
+			Value: redactConfigValue(name, value),
+		})
+	}
+	sort.Slice(config.Config, func(a, b int) bool {
+		return config.Config[a].Name < config.Config[b].Name
+	})
+
+	return config
+}
+
+// configPreviewHandler returns a handler for the read-only endpoint that
+// returns the effective configuration, so the DE admin UI can show what
+// app-exposer is actually running with.
+func configPreviewHandler(flags *flag.FlagSet, config func() *koanf.Koanf) echo.HandlerFunc {
+	return func(ctx echo.Context) error {
+		return ctx.JSON(http.StatusOK, effectiveConfig(flags, config()))
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/knadh/koanf"
+	"github.com/knadh/koanf/providers/confmap"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func testConfig(t *testing.T) (*flag.FlagSet, *koanf.Koanf) {
+	flags := flag.NewFlagSet("app-exposer", flag.ContinueOnError)
+	flags.String("vice-namespace", "vice-apps", "")
+	flags.String("tlskey", "/etc/nats/tls/tls.key", "")
+	flags.Int("port", 60000, "")
+	if err := flags.Parse([]string{"--port", "8080"}); err != nil {
+		t.Fatal(err)
+	}
+
+	c := koanf.New(".")
+	err := c.Load(confmap.Provider(map[string]interface{}{
+		"db.uri":                     "postgres://de:hunter22@db:5432/de?sslmode=disable",
+		"keycloak.client-secret":     "s3cr3t-value",
+		"vice.ca-certs.key":          "ca.crt",
+		"vice.egress.platform-cidrs": []interface{}{"10.0.0.0/8"},
+		"vice.use_csi_driver":        true,
+		"oidc.client-secret":         "",
+	}, "."), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return flags, c
+}
+
+func TestEffectiveConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	config := effectiveConfig(testConfig(t))
+
+	assert.Equal([]ConfigValue{
+		{Name: "port", Value: "8080"},
+		{Name: "tlskey", Value: "/etc/nats/tls/tls.key", Default: true},
+		{Name: "vice-namespace", Value: "vice-apps", Default: true},
+	}, config.Flags)
+
+	values := map[string]interface{}{}
+	for _, value := range config.Config {
+		values[value.Name] = value.Value
+	}
+	assert.Equal("postgres://de:[REDACTED]@db:5432/de?sslmode=disable", values["db.uri"])
+	assert.Equal("[REDACTED]", values["keycloak.client-secret"])
+	assert.Equal("", values["oidc.client-secret"])
+	assert.Equal("ca.crt", values["vice.ca-certs.key"])
+	assert.Equal([]interface{}{"10.0.0.0/8"}, values["vice.egress.platform-cidrs"])
+	assert.Equal(true, values["vice.use_csi_driver"])
+	assert.Equal("db.uri", config.Config[0].Name)
+}
+
+func TestConfigPreviewHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	flags, config := testConfig(t)
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/vice/admin/config", nil), rec)
+	assert.NoError(configPreviewHandler(flags, func() *koanf.Koanf { return config })(c))
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.NotContains(rec.Body.String(), "hunter22")
+	assert.NotContains(rec.Body.String(), "s3cr3t-value")
+}
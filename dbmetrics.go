@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+
+	"github.com/cyverse-de/app-exposer/metrics"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/noop"
+)
+
+// dbQueryTimingName is the name of the histogram otelsql records the timing
+// of each query in, in milliseconds.
+const dbQueryTimingName = "go.sql.query_timing"
+
+var dbQueryDurations = metrics.NewHistogramVec(
+	"app_exposer_db_query_duration_seconds",
+	"How long database queries took, by database.",
+	[]float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	"database",
+)
+
+// dbMeterProvider passes the query timings otelsql records for a database to
+// the app_exposer_db_query_duration_seconds histogram, so that they're served
+// at /metrics. The rest of otelsql's metrics are dropped.
+type dbMeterProvider struct {
+	noop.MeterProvider
+	database string
+}
+
+// newDBMeterProvider returns a metric.MeterProvider for the database, such as
+// primary or replica.
+func newDBMeterProvider(database string) metric.MeterProvider {
+	return dbMeterProvider{database: database}
+}
+
+// Meter implements metric.MeterProvider.
+func (p dbMeterProvider) Meter(string, ...metric.MeterOption) metric.Meter {
+	return dbMeter{database: p.database}
+}
+
+// dbMeter creates the query timing histogram.
+type dbMeter struct {
+	noop.Meter
+	database string
+}
+
+// Int64Histogram implements metric.Meter.
+func (m dbMeter) Int64Histogram(name string, _ ...metric.Int64HistogramOption) (metric.Int64Histogram, error) {
+	if name != dbQueryTimingName {
+		return noop.Int64Histogram{}, nil
+	}
+	return dbQueryTiming{database: m.database}, nil
+}
+
+// dbQueryTiming records query timings in dbQueryDurations.
+type dbQueryTiming struct {
+	noop.Int64Histogram
+	database string
+}
+
+// Record implements metric.Int64Histogram. otelsql records whole
+// milliseconds, so queries that took less than one are recorded as zero.
+func (h dbQueryTiming) Record(_ context.Context, milliseconds int64, _ ...metric.RecordOption) {
+	metrics.Observe(dbQueryDurations, float64(milliseconds)/1000, h.database)
+}
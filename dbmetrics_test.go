@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cyverse-de/app-exposer/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/uptrace/opentelemetry-go-extra/otelsql"
+)
+
+func TestDBMeterProvider(t *testing.T) {
+	assert := assert.New(t)
+
+	_, mock, err := sqlmock.NewWithDSN("dbmetrics")
+	assert.NoError(err)
+	mock.ExpectQuery("SELECT 1").WillReturnRows(sqlmock.NewRows([]string{"one"}).AddRow(1))
+
+	db, err := otelsql.Open("sqlmock", "dbmetrics", otelsql.WithMeterProvider(newDBMeterProvider("test")))
+	assert.NoError(err)
+	defer db.Close()
+
+	before := metrics.HistogramCount(dbQueryDurations, "test")
+	var one int
+	assert.NoError(db.QueryRow("SELECT 1").Scan(&one))
+	assert.Equal(before+1, metrics.HistogramCount(dbQueryDurations, "test"))
+	assert.NoError(mock.ExpectationsWereMet())
+}
@@ -0,0 +1,161 @@
+// Package dbrouter sends read-only queries to an optional Postgres read
+// replica, falling back to the primary database when the replica fails. The
+// primary also serves the rest of the DE, so moving listings and lookups to a
+// replica reduces the load on it.
+//
+// Queries that change data, and reads that have to see those changes right
+// away, must keep using the primary database directly.
+package dbrouter
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/jmoiron/sqlx"
+	"github.com/sirupsen/logrus"
+)
+
+var log = common.Log.WithFields(logrus.Fields{"package": "dbrouter"})
+
+// DefaultCooldown is how long the replica is skipped after it fails when no
+// cooldown is configured.
+const DefaultCooldown = 30 * time.Second
+
+// Router routes read-only queries.
+type Router struct {
+	primary  *sqlx.DB
+	replica  *sqlx.DB
+	cooldown time.Duration
+
+	mu        sync.Mutex
+	skipUntil time.Time
+	now       func() time.Time
+}
+
+// New returns a *Router. The replica may be nil, in which case every query
+// goes to the primary.
+func New(primary, replica *sqlx.DB, cooldown time.Duration) *Router {
+	if cooldown <= 0 {
+		cooldown = DefaultCooldown
+	}
+	return &Router{
+		primary:  primary,
+		replica:  replica,
+		cooldown: cooldown,
+		now:      time.Now,
+	}
+}
+
+// Primary returns the primary database.
+func (r *Router) Primary() *sqlx.DB {
+	return r.primary
+}
+
+// useReplica returns true if read-only queries should go to the replica.
+func (r *Router) useReplica() bool {
+	if r.replica == nil {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return !r.now().Before(r.skipUntil)
+}
+
+// replicaFailed makes the router skip the replica for the cooldown.
+func (r *Router) replicaFailed(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.skipUntil = r.now().Add(r.cooldown)
+	log.Warnf("read replica query failed, using the primary database for %s: %s", r.cooldown, err)
+}
+
+// read runs the query on the replica if it's available. The query is run
+// again on the primary if it fails on the replica. Missing rows are retried
+// on the primary too, since the replica may not have caught up with recent
+// changes, but they don't count as a replica failure.
+func (r *Router) read(ctx context.Context, reset func(), query func(db *sqlx.DB) error) error {
+	if !r.useReplica() {
+		return query(r.primary)
+	}
+
+	err := query(r.replica)
+	if err == nil {
+		return nil
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return err
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		r.replicaFailed(err)
+	}
+
+	if reset != nil {
+		reset()
+	}
+	return query(r.primary)
+}
+
+// resetDest sets the value dest points to back to its zero value, so that a
+// partial result from the replica doesn't leak into the result from the
+// primary.
+func resetDest(dest interface{}) func() {
+	return func() {
+		v := reflect.ValueOf(dest)
+		if v.Kind() == reflect.Ptr && !v.IsNil() {
+			v.Elem().Set(reflect.Zero(v.Elem().Type()))
+		}
+	}
+}
+
+// GetContext is the read-only equivalent of sqlx.DB.GetContext.
+func (r *Router) GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	return r.read(ctx, resetDest(dest), func(db *sqlx.DB) error {
+		return db.GetContext(ctx, dest, query, args...)
+	})
+}
+
+// SelectContext is the read-only equivalent of sqlx.DB.SelectContext.
+func (r *Router) SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	return r.read(ctx, resetDest(dest), func(db *sqlx.DB) error {
+		return db.SelectContext(ctx, dest, query, args...)
+	})
+}
+
+// Row is the result of a read-only query that returns a single row. Like
+// sql.Row, the query is only run when the row is scanned.
+type Row struct {
+	router *Router
+	ctx    context.Context
+	query  string
+	args   []interface{}
+}
+
+// QueryRowContext is the read-only equivalent of sqlx.DB.QueryRowContext and
+// sqlx.DB.QueryRowxContext.
+func (r *Router) QueryRowContext(ctx context.Context, query string, args ...interface{}) *Row {
+	return &Row{router: r, ctx: ctx, query: query, args: args}
+}
+
+// Scan runs the query and copies the columns into dest.
+func (row *Row) Scan(dest ...interface{}) error {
+	reset := func() {
+		for _, d := range dest {
+			resetDest(d)()
+		}
+	}
+	return row.router.read(row.ctx, reset, func(db *sqlx.DB) error {
+		return db.QueryRowxContext(row.ctx, row.query, row.args...).Scan(dest...)
+	})
+}
+
+// StructScan runs the query and copies the columns into the fields of dest.
+func (row *Row) StructScan(dest interface{}) error {
+	return row.router.read(row.ctx, resetDest(dest), func(db *sqlx.DB) error {
+		return db.QueryRowxContext(row.ctx, row.query, row.args...).StructScan(dest)
+	})
+}
@@ -0,0 +1,105 @@
+package dbrouter
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+)
+
+func newMockDB(t *testing.T) (*sqlx.DB, sqlmock.Sqlmock) {
+	mockdb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { mockdb.Close() })
+	return sqlx.NewDb(mockdb, "sqlmock"), mock
+}
+
+func TestReadsUseReplica(t *testing.T) {
+	assert := assert.New(t)
+
+	primary, primaryMock := newMockDB(t)
+	replica, replicaMock := newMockDB(t)
+	router := New(primary, replica, time.Minute)
+
+	replicaMock.ExpectQuery("SELECT id").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("a1"))
+
+	var id string
+	assert.NoError(router.QueryRowContext(context.Background(), "SELECT id FROM jobs").Scan(&id))
+	assert.Equal("a1", id)
+
+	assert.NoError(replicaMock.ExpectationsWereMet())
+	assert.NoError(primaryMock.ExpectationsWereMet())
+}
+
+func TestReadsFallBackToPrimary(t *testing.T) {
+	assert := assert.New(t)
+
+	primary, primaryMock := newMockDB(t)
+	replica, replicaMock := newMockDB(t)
+	router := New(primary, replica, time.Minute)
+
+	now := time.Now()
+	router.now = func() time.Time { return now }
+
+	replicaMock.ExpectQuery("SELECT id").WillReturnError(errors.New("connection refused"))
+	primaryMock.ExpectQuery("SELECT id").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("a1").AddRow("a2"))
+
+	var ids []string
+	assert.NoError(router.SelectContext(context.Background(), &ids, "SELECT id FROM jobs"))
+	assert.Equal([]string{"a1", "a2"}, ids)
+
+	// The replica is skipped until the cooldown passes.
+	primaryMock.ExpectQuery("SELECT id").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("a3"))
+	var id string
+	assert.NoError(router.GetContext(context.Background(), &id, "SELECT id FROM jobs"))
+	assert.Equal("a3", id)
+
+	now = now.Add(2 * time.Minute)
+	replicaMock.ExpectQuery("SELECT id").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("a4"))
+	assert.NoError(router.GetContext(context.Background(), &id, "SELECT id FROM jobs"))
+	assert.Equal("a4", id)
+
+	assert.NoError(replicaMock.ExpectationsWereMet())
+	assert.NoError(primaryMock.ExpectationsWereMet())
+}
+
+func TestMissingRowsCheckPrimary(t *testing.T) {
+	assert := assert.New(t)
+
+	primary, primaryMock := newMockDB(t)
+	replica, replicaMock := newMockDB(t)
+	router := New(primary, replica, time.Minute)
+
+	// The replica may not have caught up yet.
+	replicaMock.ExpectQuery("SELECT id").WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	primaryMock.ExpectQuery("SELECT id").WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+	var id string
+	err := router.QueryRowContext(context.Background(), "SELECT id FROM jobs").Scan(&id)
+	assert.ErrorIs(err, sql.ErrNoRows)
+
+	// Missing rows don't put the replica on cooldown.
+	assert.True(router.useReplica())
+
+	assert.NoError(replicaMock.ExpectationsWereMet())
+	assert.NoError(primaryMock.ExpectationsWereMet())
+}
+
+func TestNoReplica(t *testing.T) {
+	primary, primaryMock := newMockDB(t)
+	router := New(primary, nil, 0)
+
+	primaryMock.ExpectQuery("SELECT id").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("a1"))
+
+	var id string
+	assert.NoError(t, router.GetContext(context.Background(), &id, "SELECT id FROM jobs"))
+	assert.Equal(t, "a1", id)
+	assert.NoError(t, primaryMock.ExpectationsWereMet())
+}
@@ -0,0 +1,239 @@
+// Package faults injects controlled failures into the calls app-exposer makes
+// to the k8s API. It's only enabled in test mode, so that the retry and
+// rollback behavior of the services calling app-exposer can be tested without
+// breaking a real cluster.
+//
+// Faults are requested per request with the X-Vice-Inject-Faults header, which
+// contains comma-separated resource=mode pairs, for example:
+//
+//	X-Vice-Inject-Faults: service=error,deployment=partial
+//
+// The supported modes are:
+//
+//	error   - the k8s API call fails with a 500 without being made.
+//	timeout - the k8s API call hangs until the request is cancelled or the
+//	          configured timeout passes, and then fails.
+//	partial - the k8s API call is made, but fails with a 500 afterwards, so the
+//	          resource exists even though the caller sees an error.
+//
+// Only calls that change resources are affected; reads always go through.
+package faults
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Header is the request header listing the faults to inject.
+const Header = "X-Vice-Inject-Faults"
+
+// The fault modes.
+const (
+	ModeError   = "error"
+	ModeTimeout = "timeout"
+	ModePartial = "partial"
+)
+
+// DefaultTimeout is how long timeout faults hang when no timeout is
+// configured.
+const DefaultTimeout = 30 * time.Second
+
+// resources maps the resource names accepted in the header to the resource
+// names used in k8s API paths.
+var resources = map[string]string{
+	"configmap":             "configmaps",
+	"secret":                "secrets",
+	"deployment":            "deployments",
+	"service":               "services",
+	"ingress":               "ingresses",
+	"persistentvolume":      "persistentvolumes",
+	"persistentvolumeclaim": "persistentvolumeclaims",
+	"poddisruptionbudget":   "poddisruptionbudgets",
+	"networkpolicy":         "networkpolicies",
+}
+
+// Faults maps k8s API resource names, such as deployments, to fault modes.
+type Faults map[string]string
+
+type contextKey struct{}
+
+// Parse parses the value of the X-Vice-Inject-Faults header.
+func Parse(value string) (Faults, error) {
+	faults := Faults{}
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		name, mode, found := strings.Cut(pair, "=")
+		if !found {
+			return nil, fmt.Errorf("fault %q must be in the form resource=mode", pair)
+		}
+
+		resource, ok := resources[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("unknown resource %q", name)
+		}
+
+		mode = strings.ToLower(strings.TrimSpace(mode))
+		switch mode {
+		case ModeError, ModeTimeout, ModePartial:
+		default:
+			return nil, fmt.Errorf("unknown fault mode %q", mode)
+		}
+
+		faults[resource] = mode
+	}
+	return faults, nil
+}
+
+// WithFaults returns a copy of the context carrying the faults.
+func WithFaults(ctx context.Context, faults Faults) context.Context {
+	return context.WithValue(ctx, contextKey{}, faults)
+}
+
+// FromContext returns the faults carried by the context, if any.
+func FromContext(ctx context.Context) Faults {
+	faults, _ := ctx.Value(contextKey{}).(Faults)
+	return faults
+}
+
+// Middleware returns echo middleware that adds the faults listed in the
+// request header to the request context. Requests with an invalid header are
+// rejected.
+func Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			value := c.Request().Header.Get(Header)
+			if value == "" {
+				return next(c)
+			}
+
+			faults, err := Parse(value)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid %s header: %s", Header, err))
+			}
+
+			req := c.Request()
+			c.SetRequest(req.WithContext(WithFaults(req.Context(), faults)))
+
+			return next(c)
+		}
+	}
+}
+
+// resourceFromPath returns the resource name from a k8s API path, such as
+// deployments for /apis/apps/v1/namespaces/vice-apps/deployments/a1234.
+func resourceFromPath(path string) string {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	for idx, part := range parts {
+		if part == "namespaces" && idx+2 < len(parts) {
+			return parts[idx+2]
+		}
+	}
+
+	// Cluster-scoped resources: /api/v1/<resource> or /apis/<group>/<version>/<resource>.
+	switch {
+	case len(parts) >= 3 && parts[0] == "api":
+		return parts[2]
+	case len(parts) >= 4 && parts[0] == "apis":
+		return parts[3]
+	}
+	return ""
+}
+
+// mutating returns true if the request changes a resource.
+func mutating(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	default:
+		return false
+	}
+}
+
+// statusResponse returns a response in the format the k8s API uses for
+// errors, so that client-go turns it into a StatusError.
+func statusResponse(req *http.Request, message string) *http.Response {
+	body := fmt.Sprintf(
+		`{"kind":"Status","apiVersion":"v1","status":"Failure","message":%q,"reason":"InternalError","code":500}`,
+		message,
+	)
+	return &http.Response{
+		Status:        "500 Internal Server Error",
+		StatusCode:    http.StatusInternalServerError,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+// transport injects the faults carried by the request context into calls to
+// the k8s API.
+type transport struct {
+	next    http.RoundTripper
+	timeout time.Duration
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	faults := FromContext(req.Context())
+	if len(faults) == 0 || !mutating(req.Method) {
+		return t.next.RoundTrip(req)
+	}
+
+	resource := resourceFromPath(req.URL.Path)
+	mode, ok := faults[resource]
+	if !ok {
+		return t.next.RoundTrip(req)
+	}
+
+	switch mode {
+	case ModeError:
+		return statusResponse(req, fmt.Sprintf("injected failure for %s %s", req.Method, resource)), nil
+
+	case ModeTimeout:
+		timer := time.NewTimer(t.timeout)
+		defer timer.Stop()
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-timer.C:
+			return nil, fmt.Errorf("injected timeout for %s %s", req.Method, resource)
+		}
+
+	case ModePartial:
+		resp, err := t.next.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return statusResponse(req, fmt.Sprintf("injected failure after %s %s", req.Method, resource)), nil
+	}
+
+	return t.next.RoundTrip(req)
+}
+
+// WrapTransport returns a function for wrapping the transport of a k8s client
+// configuration so that faults are injected into its calls. Timeout faults
+// hang for the timeout, or DefaultTimeout if it isn't positive.
+func WrapTransport(timeout time.Duration) func(http.RoundTripper) http.RoundTripper {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	return func(rt http.RoundTripper) http.RoundTripper {
+		return &transport{next: rt, timeout: timeout}
+	}
+}
@@ -0,0 +1,117 @@
+package faults
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+func TestParse(t *testing.T) {
+	assert := assert.New(t)
+
+	faults, err := Parse("service=error, Deployment=partial,networkpolicy=timeout")
+	assert.NoError(err)
+	assert.Equal(Faults{"services": ModeError, "deployments": ModePartial, "networkpolicies": ModeTimeout}, faults)
+
+	_, err = Parse("service")
+	assert.Error(err)
+	_, err = Parse("pod=error")
+	assert.Error(err)
+	_, err = Parse("service=explode")
+	assert.Error(err)
+}
+
+func TestResourceFromPath(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("deployments", resourceFromPath("/apis/apps/v1/namespaces/vice-apps/deployments/a1234"))
+	assert.Equal("configmaps", resourceFromPath("/api/v1/namespaces/vice-apps/configmaps"))
+	assert.Equal("persistentvolumes", resourceFromPath("/api/v1/persistentvolumes"))
+	assert.Equal("ingresses", resourceFromPath("/apis/networking.k8s.io/v1/namespaces/vice-apps/ingresses"))
+}
+
+func TestMiddleware(t *testing.T) {
+	assert := assert.New(t)
+
+	var got Faults
+	handler := Middleware()(func(c echo.Context) error {
+		got = FromContext(c.Request().Context())
+		return nil
+	})
+
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodPost, "/vice/launch", nil)
+	req.Header.Set(Header, "secret=error")
+	assert.NoError(handler(e.NewContext(req, httptest.NewRecorder())))
+	assert.Equal(Faults{"secrets": ModeError}, got)
+
+	req = httptest.NewRequest(http.MethodPost, "/vice/launch", nil)
+	req.Header.Set(Header, "secret=bogus")
+	assert.Error(handler(e.NewContext(req, httptest.NewRecorder())))
+}
+
+func TestTransport(t *testing.T) {
+	assert := assert.New(t)
+
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"kind":"ConfigMap","apiVersion":"v1","metadata":{"name":"cm","namespace":"vice-apps"}}`))
+	}))
+	defer server.Close()
+
+	config := &rest.Config{Host: server.URL}
+	config.Wrap(WrapTransport(10 * time.Millisecond))
+	clientset, err := kubernetes.NewForConfig(config)
+	assert.NoError(err)
+
+	client := clientset.CoreV1().ConfigMaps("vice-apps")
+	cm := &apiv1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "cm"}}
+
+	// Requests without faults go through.
+	_, err = client.Create(context.Background(), cm, metav1.CreateOptions{})
+	assert.NoError(err)
+	assert.Equal(int32(1), atomic.LoadInt32(&calls))
+
+	// Faults for other resources don't affect the request.
+	ctx := WithFaults(context.Background(), Faults{"secrets": ModeError})
+	_, err = client.Create(ctx, cm, metav1.CreateOptions{})
+	assert.NoError(err)
+	assert.Equal(int32(2), atomic.LoadInt32(&calls))
+
+	// Errors are returned without calling the API.
+	ctx = WithFaults(context.Background(), Faults{"configmaps": ModeError})
+	_, err = client.Create(ctx, cm, metav1.CreateOptions{})
+	assert.True(apierrors.IsInternalError(err))
+	assert.Equal(int32(2), atomic.LoadInt32(&calls))
+
+	// Reads aren't affected.
+	_, err = client.Get(ctx, "cm", metav1.GetOptions{})
+	assert.NoError(err)
+	assert.Equal(int32(3), atomic.LoadInt32(&calls))
+
+	// Partial failures call the API and then fail.
+	ctx = WithFaults(context.Background(), Faults{"configmaps": ModePartial})
+	_, err = client.Create(ctx, cm, metav1.CreateOptions{})
+	assert.True(apierrors.IsInternalError(err))
+	assert.Equal(int32(4), atomic.LoadInt32(&calls))
+
+	// Timeouts fail without calling the API.
+	ctx = WithFaults(context.Background(), Faults{"configmaps": ModeTimeout})
+	_, err = client.Create(ctx, cm, metav1.CreateOptions{})
+	assert.Error(err)
+	assert.Equal(int32(4), atomic.LoadInt32(&calls))
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/nats-io/nats.go"
+	"k8s.io/client-go/kubernetes"
+)
+
+const defaultReadinessTimeout = 2 * time.Second
+
+// The statuses reported for each dependency.
+const (
+	dependencyOK          = "ok"
+	dependencyUnavailable = "unavailable"
+)
+
+// dependencyCheck returns an error if a dependency can't be used.
+type dependencyCheck func(ctx context.Context) error
+
+// DependencyStatus describes the result of checking a single dependency.
+type DependencyStatus struct {
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
+	LatencyMS int64  `json:"latency_ms"`
+}
+
+// Readiness is the response body for readiness checks.
+type Readiness struct {
+	Ready        bool                        `json:"ready"`
+	Draining     bool                        `json:"draining,omitempty"`
+	Dependencies map[string]DependencyStatus `json:"dependencies"`
+}
+
+// HealthChecker checks the connections to app-exposer's dependencies so that
+// Kubernetes stops routing requests to an instance that can't serve them.
+type HealthChecker struct {
+	checks  map[string]dependencyCheck
+	timeout time.Duration
+
+	// draining is set when the instance is shutting down.
+	draining atomic.Bool
+}
+
+// SetDraining makes the readiness check fail so that Kubernetes stops sending
+// requests to an instance that's shutting down.
+func (h *HealthChecker) SetDraining() {
+	h.draining.Store(true)
+}
+
+// NewHealthChecker returns a *HealthChecker that checks the database, NATS,
+// and Kubernetes connections. The timeout limits each check; it defaults to
+// two seconds, so it must be shorter than the readiness probe's timeout.
+func NewHealthChecker(db *sqlx.DB, nc *nats.Conn, clientset kubernetes.Interface, timeout time.Duration) *HealthChecker {
+	if timeout <= 0 {
+		timeout = defaultReadinessTimeout
+	}
+	return &HealthChecker{
+		timeout: timeout,
+		checks: map[string]dependencyCheck{
+			"database": func(ctx context.Context) error {
+				return db.PingContext(ctx)
+			},
+			"nats": func(_ context.Context) error {
+				if status := nc.Status(); status != nats.CONNECTED {
+					return fmt.Errorf("connection is %s", status)
+				}
+				return nil
+			},
+			"kubernetes": func(ctx context.Context) error {
+				return clientset.Discovery().RESTClient().Get().AbsPath("/readyz").Do(ctx).Error()
+			},
+		},
+	}
+}
+
+// check runs the dependency checks concurrently and returns the status of
+// each one.
+func (h *HealthChecker) check(ctx context.Context) *Readiness {
+	readiness := &Readiness{
+		Ready:        true,
+		Dependencies: map[string]DependencyStatus{},
+	}
+
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	for name, check := range h.checks {
+		wg.Add(1)
+		go func(name string, check dependencyCheck) {
+			defer wg.Done()
+
+			checkCtx, cancel := context.WithTimeout(ctx, h.timeout)
+			defer cancel()
+
+			start := time.Now()
+			err := check(checkCtx)
+			status := DependencyStatus{
+				Status:    dependencyOK,
+				LatencyMS: time.Since(start).Milliseconds(),
+			}
+			if err != nil {
+				status.Status = dependencyUnavailable
+				status.Error = err.Error()
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			readiness.Dependencies[name] = status
+			if err != nil {
+				readiness.Ready = false
+			}
+		}(name, check)
+	}
+	wg.Wait()
+
+	return readiness
+}
+
+// ReadyHandler reports whether the instance can serve requests, along with
+// the status of each dependency. It responds with a 503 if any dependency is
+// unavailable or the instance is shutting down.
+func (h *HealthChecker) ReadyHandler(c echo.Context) error {
+	if h.draining.Load() {
+		return c.JSON(http.StatusServiceUnavailable, &Readiness{
+			Draining:     true,
+			Dependencies: map[string]DependencyStatus{},
+		})
+	}
+
+	readiness := h.check(c.Request().Context())
+	if !readiness.Ready {
+		for name, status := range readiness.Dependencies {
+			if status.Status != dependencyOK {
+				log.Warnf("not ready: %s is %s: %s", name, status.Status, status.Error)
+			}
+		}
+		return c.JSON(http.StatusServiceUnavailable, readiness)
+	}
+	return c.JSON(http.StatusOK, readiness)
+}
+
+// LiveHandler reports that the process is running. It doesn't check the
+// dependencies, so that Kubernetes doesn't restart instances while a
+// dependency is down.
+func (h *HealthChecker) LiveHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, map[string]string{
+		"status": "alive",
+	})
+}
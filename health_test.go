@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func healthRequest(h *HealthChecker, handler echo.HandlerFunc) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/ready", nil), rec)
+	_ = handler(c)
+	return rec
+}
+
+func TestReadyHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	ok := func(context.Context) error { return nil }
+	h := &HealthChecker{
+		timeout: 50 * time.Millisecond,
+		checks:  map[string]dependencyCheck{"database": ok, "nats": ok, "kubernetes": ok},
+	}
+
+	rec := healthRequest(h, h.ReadyHandler)
+	assert.Equal(http.StatusOK, rec.Code)
+	readiness := &Readiness{}
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), readiness))
+	assert.True(readiness.Ready)
+	assert.Len(readiness.Dependencies, 3)
+
+	// Each dependency is reported separately, and checks that hang are cut
+	// off by the timeout.
+	h.checks["database"] = func(context.Context) error { return errors.New("connection refused") }
+	h.checks["kubernetes"] = func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	rec = healthRequest(h, h.ReadyHandler)
+	assert.Equal(http.StatusServiceUnavailable, rec.Code)
+	readiness = &Readiness{}
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), readiness))
+	assert.False(readiness.Ready)
+	assert.Equal(dependencyUnavailable, readiness.Dependencies["database"].Status)
+	assert.Equal("connection refused", readiness.Dependencies["database"].Error)
+	assert.Equal(dependencyUnavailable, readiness.Dependencies["kubernetes"].Status)
+	assert.Equal(dependencyOK, readiness.Dependencies["nats"].Status)
+
+	// Liveness doesn't depend on the dependencies.
+	rec = healthRequest(h, h.LiveHandler)
+	assert.Equal(http.StatusOK, rec.Code)
+}
+
+func TestReadyHandlerDraining(t *testing.T) {
+	assert := assert.New(t)
+
+	ok := func(context.Context) error { return nil }
+	h := &HealthChecker{
+		timeout: 50 * time.Millisecond,
+		checks:  map[string]dependencyCheck{"database": ok},
+	}
+	h.SetDraining()
+
+	// The readiness check fails while the instance is shutting down, but
+	// it's still alive.
+	rec := healthRequest(h, h.ReadyHandler)
+	assert.Equal(http.StatusServiceUnavailable, rec.Code)
+	readiness := &Readiness{}
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), readiness))
+	assert.False(readiness.Ready)
+	assert.True(readiness.Draining)
+
+	rec = healthRequest(h, h.LiveHandler)
+	assert.Equal(http.StatusOK, rec.Code)
+}
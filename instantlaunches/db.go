@@ -45,7 +45,7 @@ WHERE il.id = any($1);
 // passed in. Includes quick launch, app, and submission info.
 func (a *App) ListFullInstantLaunchesByIDs(ctx context.Context, ids []string) ([]FullInstantLaunch, error) {
 	fullListing := []FullInstantLaunch{}
-	err := a.DB.SelectContext(ctx, &fullListing, fullListingQuery, pq.Array(ids))
+	err := a.reads.SelectContext(ctx, &fullListing, fullListingQuery, pq.Array(ids))
 	return fullListing, err
 }
 
@@ -71,7 +71,7 @@ const getInstantLaunchQuery = `
 // GetInstantLaunch returns a stored instant launch by ID.
 func (a *App) GetInstantLaunch(ctx context.Context, id string) (*InstantLaunch, error) {
 	il := &InstantLaunch{}
-	err := a.DB.QueryRowxContext(ctx, getInstantLaunchQuery, id).StructScan(il)
+	err := a.reads.QueryRowContext(ctx, getInstantLaunchQuery, id).StructScan(il)
 	return il, err
 }
 
@@ -114,7 +114,7 @@ WHERE il.id = $1;
 // includes quick launch, app, and submission information.
 func (a *App) FullInstantLaunch(ctx context.Context, id string) (*FullInstantLaunch, error) {
 	fil := &FullInstantLaunch{}
-	err := a.DB.QueryRowxContext(ctx, fullInstantLaunchQuery, id).StructScan(fil)
+	err := a.reads.QueryRowContext(ctx, fullInstantLaunchQuery, id).StructScan(fil)
 	return fil, err
 }
 
@@ -150,7 +150,7 @@ const listInstantLaunchesQuery = `
 // ListInstantLaunches lists all registered instant launches.
 func (a *App) ListInstantLaunches(ctx context.Context) ([]InstantLaunch, error) {
 	all := []InstantLaunch{}
-	err := a.DB.SelectContext(ctx, &all, listInstantLaunchesQuery)
+	err := a.reads.SelectContext(ctx, &all, listInstantLaunchesQuery)
 	return all, err
 }
 
@@ -189,7 +189,7 @@ FROM instant_launches il
 // FullListInstantLaunches returns a full listing of instant launches.
 func (a *App) FullListInstantLaunches(ctx context.Context) ([]FullInstantLaunch, error) {
 	all := []FullInstantLaunch{}
-	err := a.DB.SelectContext(ctx, &all, fullListInstantLaunchesQuery)
+	err := a.reads.SelectContext(ctx, &all, fullListInstantLaunchesQuery)
 	return all, err
 }
 
@@ -207,7 +207,7 @@ const userMappingQuery = `
 // UserMapping returns the user's instant launch mappings.
 func (a *App) UserMapping(ctx context.Context, user string) (*UserInstantLaunchMapping, error) {
 	m := &UserInstantLaunchMapping{}
-	err := a.DB.GetContext(ctx, m, userMappingQuery, user)
+	err := a.reads.GetContext(ctx, m, userMappingQuery, user)
 	return m, err
 }
 
@@ -279,7 +279,7 @@ const allUserMappingsQuery = `
 // AllUserMappings returns all of the user's instant launch mappings regardless of version.
 func (a *App) AllUserMappings(ctx context.Context, user string) ([]UserInstantLaunchMapping, error) {
 	m := []UserInstantLaunchMapping{}
-	err := a.DB.SelectContext(ctx, &m, allUserMappingsQuery, user)
+	err := a.reads.SelectContext(ctx, &m, allUserMappingsQuery, user)
 	return m, err
 }
 
@@ -296,7 +296,7 @@ const userMappingsByVersionQuery = `
 // UserMappingsByVersion returns a specific version of the user's instant launch mappings.
 func (a *App) UserMappingsByVersion(ctx context.Context, user string, version int) (UserInstantLaunchMapping, error) {
 	m := UserInstantLaunchMapping{}
-	err := a.DB.GetContext(ctx, &m, userMappingsByVersionQuery, user, version)
+	err := a.reads.GetContext(ctx, &m, userMappingsByVersionQuery, user, version)
 	return m, err
 }
 
@@ -346,7 +346,7 @@ const latestDefaultsQuery = `
 // LatestDefaults returns the latest version of the default instant launches.
 func (a *App) LatestDefaults(ctx context.Context) (DefaultInstantLaunchMapping, error) {
 	m := DefaultInstantLaunchMapping{}
-	err := a.DB.GetContext(ctx, &m, latestDefaultsQuery)
+	err := a.reads.GetContext(ctx, &m, latestDefaultsQuery)
 	return m, err
 }
 
@@ -405,7 +405,7 @@ const defaultsByVersionQuery = `
 // DefaultsByVersion returns a specific version of the default instant launches.
 func (a *App) DefaultsByVersion(ctx context.Context, version int) (*DefaultInstantLaunchMapping, error) {
 	m := &DefaultInstantLaunchMapping{}
-	err := a.DB.GetContext(ctx, m, defaultsByVersionQuery, version)
+	err := a.reads.GetContext(ctx, m, defaultsByVersionQuery, version)
 	return m, err
 }
 
@@ -445,7 +445,7 @@ const listAllDefaultsQuery = `
 // ListAllDefaults returns a list of all of the default instant launches, including their version.
 func (a *App) ListAllDefaults(ctx context.Context) (ListAllDefaultsResponse, error) {
 	m := ListAllDefaultsResponse{Defaults: []DefaultInstantLaunchMapping{}}
-	err := a.DB.SelectContext(ctx, &m.Defaults, listAllDefaultsQuery)
+	err := a.reads.SelectContext(ctx, &m.Defaults, listAllDefaultsQuery)
 	return m, err
 }
 
@@ -468,6 +468,6 @@ const listPublicQLsQuery = `
 // includes quick launches that were created by the authenticated user and public quick launches.
 func (a *App) ListViablePublicQuickLaunches(ctx context.Context, user string) ([]QuickLaunch, error) {
 	l := []QuickLaunch{}
-	err := a.DB.SelectContext(ctx, &l, listPublicQLsQuery, user)
+	err := a.reads.SelectContext(ctx, &l, listPublicQLsQuery, user)
 	return l, err
 }
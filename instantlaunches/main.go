@@ -23,6 +23,7 @@ import (
 	"io"
 	"net/http"
 
+	"github.com/cyverse-de/app-exposer/dbrouter"
 	"github.com/cyverse-de/app-exposer/permissions"
 	"github.com/jmoiron/sqlx"
 	"github.com/jmoiron/sqlx/types"
@@ -175,6 +176,7 @@ type QuickLaunch struct {
 // App provides an API for managing instant launches.
 type App struct {
 	DB              *sqlx.DB
+	reads           *dbrouter.Router
 	Group           *echo.Group
 	UserSuffix      string
 	MetadataBaseURL string
@@ -186,12 +188,22 @@ type Init struct {
 	UserSuffix      string
 	MetadataBaseURL string
 	PermissionsURL  string
+
+	// Router sends read-only queries to a read replica if one is configured.
+	// Reads use the primary database if it's nil.
+	Router *dbrouter.Router
 }
 
 // New returns a newly created *App.
 func New(db *sqlx.DB, group *echo.Group, init *Init) *App {
+	reads := init.Router
+	if reads == nil {
+		reads = dbrouter.New(db, nil, 0)
+	}
+
 	instance := &App{
 		DB:              db,
+		reads:           reads,
 		Group:           group,
 		UserSuffix:      init.UserSuffix,
 		MetadataBaseURL: init.MetadataBaseURL,
@@ -18,7 +18,7 @@ func (i *Internal) AsyncDataHandler(c echo.Context) error {
 
 	analysisID, err := i.apps.GetAnalysisIDByExternalID(ctx, externalID)
 	if err != nil {
-		log.Error(err)
+		log.WithContext(ctx).Error(err)
 		return err
 	}
 
@@ -38,10 +38,10 @@ func (i *Internal) AsyncDataHandler(c echo.Context) error {
 	labels := deployments.Items[0].GetLabels()
 	userID := labels["user-id"]
 
-	subdomain := IngressName(userID, externalID)
+	subdomain := subdomainFromLabels(labels)
 	ipAddr, err := i.apps.GetUserIP(ctx, userID)
 	if err != nil {
-		log.Error(err)
+		log.WithContext(ctx).Error(err)
 		return err
 	}
 
@@ -61,7 +61,7 @@ func (i *Internal) getExternalIDByAnalysisID(ctx context.Context, analysisID str
 		return "", err
 	}
 
-	log.Infof("username %s", username)
+	log.WithContext(ctx).Infof("username %s", username)
 
 	externalIDs, err := i.getExternalIDs(ctx, username, analysisID)
 	if err != nil {
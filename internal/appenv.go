@@ -0,0 +1,252 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/cyverse-de/model/v6"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// reservedEnvVars are the environment variables app-exposer always sets in the
+// analysis container. They can't be overridden by the default environment.
+var reservedEnvVars = map[string]bool{
+	"REDIRECT_URL":        true,
+	"IPLANT_USER":         true,
+	"IPLANT_EXECUTION_ID": true,
+}
+
+// validateEnvVars returns an error if any of the variable names can't be used
+// in the default environment.
+func validateEnvVars(vars map[string]string) error {
+	for name := range vars {
+		if reservedEnvVars[name] {
+			return fmt.Errorf("%s is set by app-exposer and can't be overridden", name)
+		}
+		if errs := validation.IsEnvVarName(name); len(errs) > 0 {
+			return fmt.Errorf("invalid environment variable name %q: %s", name, errs[0])
+		}
+	}
+	return nil
+}
+
+const getDefaultEnvironmentSQL = `
+	SELECT app_id IS NULL AS global, name, value
+	  FROM vice_app_env_vars
+	 WHERE app_id IS NULL
+	    OR app_id = $1
+`
+
+// getDefaultEnvironment returns the default environment for the analysis,
+// with the variables for its app taking precedence over the global ones.
+func (i *Internal) getDefaultEnvironment(ctx context.Context, job *model.Job) (map[string]string, error) {
+	var appID *string
+	if job.AppID != "" {
+		appID = &job.AppID
+	}
+
+	rows, err := i.db.QueryContext(ctx, getDefaultEnvironmentSQL, appID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error looking up the default environment for app %s", job.AppID)
+	}
+	defer rows.Close()
+
+	global := map[string]string{}
+	app := map[string]string{}
+	for rows.Next() {
+		var (
+			isGlobal    bool
+			name, value string
+		)
+		if err = rows.Scan(&isGlobal, &name, &value); err != nil {
+			return nil, errors.Wrapf(err, "error reading the default environment for app %s", job.AppID)
+		}
+		if isGlobal {
+			global[name] = value
+		} else {
+			app[name] = value
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrapf(err, "error reading the default environment for app %s", job.AppID)
+	}
+
+	for name, value := range app {
+		global[name] = value
+	}
+
+	return global, nil
+}
+
+// analysisEnvironment returns the environment for the analysis container.
+func (i *Internal) analysisEnvironment(job *model.Job, defaults map[string]string) []apiv1.EnvVar {
+	return i.stepEnvironment(job, &job.Steps[0], defaults)
+}
+
+// stepEnvironment returns the environment for the container of one of the
+// job's steps. The step's environment takes precedence over the default
+// environment, and the variables app-exposer sets take precedence over both.
+func (i *Internal) stepEnvironment(job *model.Job, step *model.Step, defaults map[string]string) []apiv1.EnvVar {
+	merged := map[string]string{}
+	for name, value := range defaults {
+		merged[name] = value
+	}
+	for name, value := range step.Environment {
+		merged[name] = value
+	}
+
+	names := make([]string, 0, len(merged))
+	for name := range merged {
+		if !reservedEnvVars[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	env := make([]apiv1.EnvVar, 0, len(names)+len(reservedEnvVars))
+	for _, name := range names {
+		env = append(env, apiv1.EnvVar{Name: name, Value: merged[name]})
+	}
+
+	return append(
+		env,
+		apiv1.EnvVar{
+			Name:  "REDIRECT_URL",
+			Value: i.getFrontendURL(job).String(),
+		},
+		apiv1.EnvVar{
+			Name:  "IPLANT_USER",
+			Value: job.Submitter,
+		},
+		apiv1.EnvVar{
+			Name:  "IPLANT_EXECUTION_ID",
+			Value: job.InvocationID,
+		},
+	)
+}
+
+const listEnvVarsSQL = `
+	SELECT name, value
+	  FROM vice_app_env_vars
+	 WHERE app_id IS NOT DISTINCT FROM $1
+`
+
+const deleteEnvVarsSQL = `
+	DELETE FROM vice_app_env_vars
+	 WHERE app_id IS NOT DISTINCT FROM $1
+`
+
+const insertEnvVarSQL = `
+	INSERT INTO vice_app_env_vars (app_id, name, value)
+	VALUES ($1, $2, $3)
+`
+
+// listEnvVars returns the variables for the app, or the global variables if
+// appID is nil.
+func (i *Internal) listEnvVars(ctx context.Context, appID *string) (map[string]string, error) {
+	rows, err := i.db.QueryContext(ctx, listEnvVarsSQL, appID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	vars := map[string]string{}
+	for rows.Next() {
+		var name, value string
+		if err = rows.Scan(&name, &value); err != nil {
+			return nil, err
+		}
+		vars[name] = value
+	}
+
+	return vars, rows.Err()
+}
+
+// replaceEnvVars replaces the variables for the app, or the global variables
+// if appID is nil.
+func (i *Internal) replaceEnvVars(ctx context.Context, appID *string, vars map[string]string) error {
+	tx, err := i.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // nolint:errcheck
+
+	if _, err = tx.ExecContext(ctx, deleteEnvVarsSQL, appID); err != nil {
+		return err
+	}
+
+	for name, value := range vars {
+		if _, err = tx.ExecContext(ctx, insertEnvVarSQL, appID, name, value); err != nil {
+			return errors.Wrapf(err, "error setting environment variable %s", name)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// updateEnvVarsHandler replaces the variables for the app, or the global
+// variables if appID is nil, with the ones in the request body.
+func (i *Internal) updateEnvVarsHandler(c echo.Context, appID *string) error {
+	// c.Bind would also copy the path parameters into the map.
+	vars := map[string]string{}
+	if err := json.NewDecoder(c.Request().Body).Decode(&vars); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	if err := validateEnvVars(vars); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	if err := i.replaceEnvVars(c.Request().Context(), appID, vars); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, vars)
+}
+
+// AdminGetGlobalEnvHandler returns the environment variables added to every
+// VICE analysis.
+func (i *Internal) AdminGetGlobalEnvHandler(c echo.Context) error {
+	vars, err := i.listEnvVars(c.Request().Context(), nil)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, vars)
+}
+
+// AdminUpdateGlobalEnvHandler replaces the environment variables added to
+// every VICE analysis.
+func (i *Internal) AdminUpdateGlobalEnvHandler(c echo.Context) error {
+	return i.updateEnvVarsHandler(c, nil)
+}
+
+// AdminGetAppEnvHandler returns the environment variables added to the VICE
+// analyses for an app.
+func (i *Internal) AdminGetAppEnvHandler(c echo.Context) error {
+	appID := c.Param("app-id")
+	if appID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "app-id parameter is empty")
+	}
+
+	vars, err := i.listEnvVars(c.Request().Context(), &appID)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, vars)
+}
+
+// AdminUpdateAppEnvHandler replaces the environment variables added to the
+// VICE analyses for an app.
+func (i *Internal) AdminUpdateAppEnvHandler(c echo.Context) error {
+	appID := c.Param("app-id")
+	if appID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "app-id parameter is empty")
+	}
+	return i.updateEnvVarsHandler(c, &appID)
+}
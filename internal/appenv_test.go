@@ -0,0 +1,111 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cyverse-de/model/v6"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+func TestValidateEnvVars(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(validateEnvVars(map[string]string{"HTTPS_PROXY": "http://proxy:3128", "SSL_CERT_FILE": "/etc/ssl/ca.pem"}))
+	assert.Error(validateEnvVars(map[string]string{"IPLANT_USER": "someone"}))
+	assert.Error(validateEnvVars(map[string]string{"1BAD": "x"}))
+	assert.Error(validateEnvVars(map[string]string{"": "x"}))
+}
+
+func TestGetDefaultEnvironment(t *testing.T) {
+	assert := assert.New(t)
+
+	mockdb, mock, err := sqlmock.New()
+	assert.NoError(err)
+	defer mockdb.Close()
+
+	i := &Internal{db: sqlx.NewDb(mockdb, "sqlmock")}
+
+	mock.ExpectQuery(regexp.QuoteMeta("FROM vice_app_env_vars")).
+		WithArgs("a1").
+		WillReturnRows(sqlmock.NewRows([]string{"global", "name", "value"}).
+			AddRow(false, "HTTPS_PROXY", "http://app-proxy:3128").
+			AddRow(true, "HTTPS_PROXY", "http://proxy:3128").
+			AddRow(true, "NO_PROXY", ".cyverse.org"))
+
+	env, err := i.getDefaultEnvironment(context.Background(), &model.Job{AppID: "a1"})
+	assert.NoError(err)
+	assert.Equal(map[string]string{"HTTPS_PROXY": "http://app-proxy:3128", "NO_PROXY": ".cyverse.org"}, env)
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestAnalysisEnvironment(t *testing.T) {
+	i := &Internal{Init: Init{FrontendBaseURL: "https://cyverse.run"}}
+
+	job := &model.Job{
+		InvocationID: "e1",
+		Submitter:    "ipcdev",
+		UserID:       "u1",
+		Steps: []model.Step{
+			{Environment: map[string]string{"NO_PROXY": "localhost", "IPLANT_USER": "someone-else"}},
+		},
+	}
+	defaults := map[string]string{"HTTPS_PROXY": "http://proxy:3128", "NO_PROXY": ".cyverse.org"}
+
+	env := i.analysisEnvironment(job, defaults)
+
+	assert.Equal(t, []apiv1.EnvVar{
+		{Name: "HTTPS_PROXY", Value: "http://proxy:3128"},
+		{Name: "NO_PROXY", Value: "localhost"},
+		{Name: "REDIRECT_URL", Value: i.getFrontendURL(job).String()},
+		{Name: "IPLANT_USER", Value: "ipcdev"},
+		{Name: "IPLANT_EXECUTION_ID", Value: "e1"},
+	}, env)
+}
+
+func TestUpdateAppEnvHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	mockdb, mock, err := sqlmock.New()
+	assert.NoError(err)
+	defer mockdb.Close()
+
+	i := &Internal{db: sqlx.NewDb(mockdb, "sqlmock")}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM vice_app_env_vars")).
+		WithArgs("a1").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO vice_app_env_vars")).
+		WithArgs("a1", "HTTPS_PROXY", "http://proxy:3128").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodPut, "/", strings.NewReader(`{"HTTPS_PROXY":"http://proxy:3128"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.SetParamNames("app-id")
+	c.SetParamValues("a1")
+
+	assert.NoError(i.AdminUpdateAppEnvHandler(c))
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.NoError(mock.ExpectationsWereMet())
+
+	// Reserved variables are rejected before anything is changed.
+	req = httptest.NewRequest(http.MethodPut, "/", strings.NewReader(`{"REDIRECT_URL":"https://example.org"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	c = e.NewContext(req, httptest.NewRecorder())
+	c.SetParamNames("app-id")
+	c.SetParamValues("a1")
+	assert.Error(i.AdminUpdateAppEnvHandler(c))
+}
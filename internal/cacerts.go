@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	apiv1 "k8s.io/api/core/v1"
+)
+
+const (
+	caCertsVolumeName = "ca-certs"
+	caCertsMountDir   = "/etc/ssl/certs"
+)
+
+// CACertsConfig names the ConfigMap or Secret in the VICE namespace containing
+// the institutional CA bundle. The bundle is added to /etc/ssl/certs in the
+// analysis, proxy, and file transfer containers so that they can reach
+// services that use certificates signed by the institution's private CA.
+type CACertsConfig struct {
+	// ConfigMap is the name of the ConfigMap containing the bundle.
+	ConfigMap string
+
+	// Secret is the name of the Secret containing the bundle. Only one of
+	// ConfigMap and Secret may be set.
+	Secret string
+
+	// Key is the key of the bundle in the ConfigMap or Secret.
+	Key string
+
+	// FileName is the name of the bundle in /etc/ssl/certs.
+	FileName string
+}
+
+// Enabled returns true if a CA bundle should be mounted.
+func (c *CACertsConfig) Enabled() bool {
+	return c.ConfigMap != "" || c.Secret != ""
+}
+
+// Validate returns an error if the configuration can't be used.
+func (c *CACertsConfig) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+	if c.ConfigMap != "" && c.Secret != "" {
+		return errors.New("only one of the CA certificates ConfigMap and Secret may be set")
+	}
+	if c.Key == "" {
+		return errors.New("the key of the CA bundle must be set")
+	}
+	if c.FileName == "" || strings.Contains(c.FileName, "/") {
+		return fmt.Errorf("invalid CA bundle file name %q", c.FileName)
+	}
+	return nil
+}
+
+// caCertsVolumes returns the Volume containing the CA bundle, if one is
+// configured.
+func (i *Internal) caCertsVolumes() []apiv1.Volume {
+	if !i.CACerts.Enabled() {
+		return nil
+	}
+
+	items := []apiv1.KeyToPath{{Key: i.CACerts.Key, Path: i.CACerts.FileName}}
+
+	volume := apiv1.Volume{Name: caCertsVolumeName}
+	if i.CACerts.Secret != "" {
+		volume.VolumeSource = apiv1.VolumeSource{
+			Secret: &apiv1.SecretVolumeSource{
+				SecretName: i.CACerts.Secret,
+				Items:      items,
+			},
+		}
+	} else {
+		volume.VolumeSource = apiv1.VolumeSource{
+			ConfigMap: &apiv1.ConfigMapVolumeSource{
+				LocalObjectReference: apiv1.LocalObjectReference{
+					Name: i.CACerts.ConfigMap,
+				},
+				Items: items,
+			},
+		}
+	}
+
+	return []apiv1.Volume{volume}
+}
+
+// caCertsVolumeMounts returns the VolumeMounts that add the CA bundle to
+// /etc/ssl/certs, if one is configured. The bundle is mounted as a single
+// file so that the certificates in the image are still available.
+func (i *Internal) caCertsVolumeMounts() []apiv1.VolumeMount {
+	if !i.CACerts.Enabled() {
+		return nil
+	}
+
+	return []apiv1.VolumeMount{
+		{
+			Name:      caCertsVolumeName,
+			MountPath: path.Join(caCertsMountDir, i.CACerts.FileName),
+			SubPath:   i.CACerts.FileName,
+			ReadOnly:  true,
+		},
+	}
+}
@@ -0,0 +1,65 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/cyverse-de/model/v6"
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+func TestCACertsConfigValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError((&CACertsConfig{}).Validate())
+	assert.NoError((&CACertsConfig{ConfigMap: "ca", Key: "ca.crt", FileName: "ca.crt"}).Validate())
+	assert.Error((&CACertsConfig{ConfigMap: "ca", Secret: "ca", Key: "ca.crt", FileName: "ca.crt"}).Validate())
+	assert.Error((&CACertsConfig{Secret: "ca", FileName: "ca.crt"}).Validate())
+	assert.Error((&CACertsConfig{Secret: "ca", Key: "ca.crt", FileName: "../ca.crt"}).Validate())
+}
+
+func TestCACertsMounts(t *testing.T) {
+	assert := assert.New(t)
+
+	job := &model.Job{
+		InvocationID: "e1",
+		Steps: []model.Step{{
+			Component: model.StepComponent{
+				Container: model.Container{
+					Ports: []model.Ports{{ContainerPort: 8888}},
+				},
+			},
+		}},
+	}
+
+	i := &Internal{Init: Init{FrontendBaseURL: "https://cyverse.run", ProxyAuth: &noProxyAuth{}}}
+	for _, volume := range i.deploymentVolumes(job) {
+		assert.NotEqual(caCertsVolumeName, volume.Name)
+	}
+
+	i.CACerts = CACertsConfig{Secret: "institutional-ca", Key: "bundle.pem", FileName: "institutional-ca.crt"}
+
+	volumes := i.caCertsVolumes()
+	if assert.Len(volumes, 1) && assert.NotNil(volumes[0].Secret) {
+		assert.Equal("institutional-ca", volumes[0].Secret.SecretName)
+		assert.Equal([]apiv1.KeyToPath{{Key: "bundle.pem", Path: "institutional-ca.crt"}}, volumes[0].Secret.Items)
+	}
+
+	// The analysis, proxy, and file transfer containers all get the bundle.
+	containers := i.deploymentContainers(job, &ToolSettings{}, nil)
+	assert.Len(containers, 3)
+	for _, container := range containers {
+		assert.Contains(container.VolumeMounts, apiv1.VolumeMount{
+			Name:      caCertsVolumeName,
+			MountPath: "/etc/ssl/certs/institutional-ca.crt",
+			SubPath:   "institutional-ca.crt",
+			ReadOnly:  true,
+		}, container.Name)
+	}
+
+	i.CACerts = CACertsConfig{ConfigMap: "institutional-ca", Key: "bundle.pem", FileName: "institutional-ca.crt"}
+	volumes = i.caCertsVolumes()
+	if assert.Len(volumes, 1) && assert.NotNil(volumes[0].ConfigMap) {
+		assert.Equal("institutional-ca", volumes[0].ConfigMap.Name)
+	}
+}
@@ -0,0 +1,52 @@
+package internal
+
+import (
+	"context"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// WarmLookupCaches looks up the analysis ID and user IP for every running
+// VICE analysis so that they're cached before the first relabeling pass and
+// listing requests. Lookup failures are logged and skipped, since the values
+// will be looked up again when they're needed.
+func (i *Internal) WarmLookupCaches(ctx context.Context) error {
+	ctx, span := startResourceSpan(ctx, "WarmLookupCaches", "deployment")
+	defer span.End()
+
+	deplist, err := i.clientset.AppsV1().Deployments(i.ViceNamespace).List(ctx, metav1.ListOptions{
+		LabelSelector: getListSelector(map[string]string{}).String(),
+	})
+	if err != nil {
+		return err
+	}
+
+	externalIDs := []string{}
+	userIDs := []string{}
+	users := map[string]bool{}
+	for _, dep := range deplist.Items {
+		if externalID := dep.Labels["external-id"]; externalID != "" {
+			externalIDs = append(externalIDs, externalID)
+		}
+		if userID := dep.Labels["user-id"]; userID != "" && !users[userID] {
+			users[userID] = true
+			userIDs = append(userIDs, userID)
+		}
+	}
+
+	// The IDs are looked up in batches, which caches them.
+	if len(externalIDs) > 0 {
+		if _, err = i.apps.GetAnalysisIDsByExternalIDs(ctx, externalIDs); err != nil {
+			log.WithContext(ctx).Warnf("unable to look up the analysis IDs: %s", err)
+		}
+	}
+	if len(userIDs) > 0 {
+		if _, err = i.apps.GetUserIPs(ctx, userIDs); err != nil {
+			log.WithContext(ctx).Warnf("unable to look up the login IPs: %s", err)
+		}
+	}
+
+	log.WithContext(ctx).Infof("warmed the lookup caches for %d analyses and %d users", len(deplist.Items), len(users))
+
+	return nil
+}
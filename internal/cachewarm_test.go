@@ -0,0 +1,68 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cyverse-de/app-exposer/apps"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func warmTestDeployment(externalID, userID string) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      externalID,
+			Namespace: "vice-apps",
+			Labels: map[string]string{
+				"app-type":    "interactive",
+				"external-id": externalID,
+				"user-id":     userID,
+			},
+		},
+	}
+}
+
+func TestWarmLookupCaches(t *testing.T) {
+	assert := assert.New(t)
+
+	mockdb, mock, err := sqlmock.New()
+	assert.NoError(err)
+	defer mockdb.Close()
+
+	a := apps.NewApps(sqlx.NewDb(mockdb, "sqlmock"), "@example.org")
+	a.ConfigureCache(&apps.CacheConfig{MaxEntries: 10, AnalysisIDTTL: time.Hour, UserIPTTL: time.Hour})
+
+	i := &Internal{
+		Init: Init{ViceNamespace: "vice-apps"},
+		clientset: fake.NewSimpleClientset(
+			warmTestDeployment("e1", "u1"),
+			warmTestDeployment("e2", "u1"),
+		),
+		apps: a,
+	}
+
+	// Each kind of ID is looked up in a single query.
+	mock.MatchExpectationsInOrder(false)
+	mock.ExpectQuery("SELECT s.external_id, j.id").
+		WithArgs(pq.Array([]string{"e1", "e2"})).
+		WillReturnRows(sqlmock.NewRows([]string{"external_id", "id"}).AddRow("e1", "a1").AddRow("e2", "a2"))
+	mock.ExpectQuery("l.ip_address").
+		WithArgs(pq.Array([]string{"u1"})).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "ip_address"}).AddRow("u1", "10.0.0.1"))
+
+	assert.NoError(i.WarmLookupCaches(context.Background()))
+	assert.NoError(mock.ExpectationsWereMet())
+
+	// The warmed values are served from the cache.
+	analysisID, err := a.GetAnalysisIDByExternalID(context.Background(), "e2")
+	assert.NoError(err)
+	assert.Equal("a2", analysisID)
+	assert.Equal(uint64(1), a.CacheStats()["analysis_ids"].Hits)
+}
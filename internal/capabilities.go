@@ -0,0 +1,230 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/cyverse-de/model/v6"
+	"github.com/labstack/echo/v4"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// nvidiaResourcePrefix is the prefix for the extended resources advertised
+// by the NVIDIA device plugin, e.g. nvidia.com/gpu or nvidia.com/mig-1g.5gb.
+const nvidiaResourcePrefix = "nvidia.com"
+
+// ClusterCapabilities describes the resources that the cluster can provide to
+// VICE analyses.
+type ClusterCapabilities struct {
+	// GPUResources maps the name of each GPU resource, including MIG
+	// partitions, to the total amount allocatable on the GPU nodes.
+	GPUResources map[string]int64 `json:"gpu_resources"`
+}
+
+// gpuResourceNames returns the sorted names of the GPU resources the cluster
+// provides.
+func (cc *ClusterCapabilities) gpuResourceNames() []string {
+	names := make([]string, 0, len(cc.GPUResources))
+	for name := range cc.GPUResources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// gpuNodeSelector returns the label selector for the nodes that VICE analyses
+// requiring a GPU may be scheduled on. Spot nodes are left out.
+func (i *Internal) gpuNodeSelector() (labels.Selector, error) {
+	return i.SpotNodes.selector(labels.Set(map[string]string{
+		gpuAffinityKey: gpuAffinityValue,
+	}))
+}
+
+// clusterCapabilities sums up the GPU resources that are allocatable on the
+// nodes that VICE analyses requiring a GPU may be scheduled on.
+func (i *Internal) clusterCapabilities(ctx context.Context) (*ClusterCapabilities, error) {
+	selector, err := i.gpuNodeSelector()
+	if err != nil {
+		return nil, err
+	}
+
+	nodes, err := i.clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{
+		LabelSelector: selector.String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	caps := &ClusterCapabilities{
+		GPUResources: map[string]int64{},
+	}
+
+	for _, node := range nodes.Items {
+		for name, quantity := range node.Status.Allocatable {
+			if strings.HasPrefix(string(name), nvidiaResourcePrefix+"/") {
+				caps.GPUResources[string(name)] += quantity.Value()
+			}
+		}
+	}
+
+	return caps, nil
+}
+
+// gpuCapacity describes how much of a GPU resource is in use on the nodes
+// that analyses can currently be scheduled on.
+type gpuCapacity struct {
+	Allocatable int64
+	Requested   int64
+}
+
+// nodeSchedulable returns true if new pods can be scheduled on the node.
+func nodeSchedulable(node *apiv1.Node) bool {
+	if node.Spec.Unschedulable {
+		return false
+	}
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == apiv1.NodeReady {
+			return condition.Status == apiv1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// podGPURequest returns the amount of the GPU resource requested by the pod's
+// containers. Extended resources can't be overcommitted, so a limit without a
+// request counts as a request.
+func podGPURequest(pod *apiv1.Pod, resource apiv1.ResourceName) int64 {
+	var total int64
+	for _, container := range pod.Spec.Containers {
+		if quantity, ok := container.Resources.Requests[resource]; ok {
+			total += quantity.Value()
+		} else if quantity, ok := container.Resources.Limits[resource]; ok {
+			total += quantity.Value()
+		}
+	}
+	return total
+}
+
+// gpuCapacity adds up the amount of the GPU resource that's allocatable on
+// the schedulable GPU nodes and the amount requested by the pods that are
+// running or waiting to run on them.
+func (i *Internal) gpuCapacity(ctx context.Context, resource apiv1.ResourceName) (*gpuCapacity, error) {
+	selector, err := i.gpuNodeSelector()
+	if err != nil {
+		return nil, err
+	}
+
+	nodes, err := i.clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{
+		LabelSelector: selector.String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	capacity := &gpuCapacity{}
+	schedulable := map[string]bool{}
+	for idx := range nodes.Items {
+		node := &nodes.Items[idx]
+		if !nodeSchedulable(node) {
+			continue
+		}
+		if quantity, ok := node.Status.Allocatable[resource]; ok && quantity.Value() > 0 {
+			schedulable[node.Name] = true
+			capacity.Allocatable += quantity.Value()
+		}
+	}
+	if capacity.Allocatable == 0 {
+		return capacity, nil
+	}
+
+	// GPUs may be used by pods in any namespace.
+	pods, err := i.clientset.CoreV1().Pods("").List(ctx, metav1.ListOptions{
+		FieldSelector: "status.phase!=Succeeded,status.phase!=Failed",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for idx := range pods.Items {
+		pod := &pods.Items[idx]
+		if !schedulable[pod.Spec.NodeName] {
+			continue
+		}
+		if pod.Status.Phase == apiv1.PodSucceeded || pod.Status.Phase == apiv1.PodFailed {
+			continue
+		}
+		capacity.Requested += podGPURequest(pod, resource)
+	}
+
+	return capacity, nil
+}
+
+// validateGPURequest makes sure the cluster can give the analysis the GPU it
+// will request. Analyses using MIG profiles the cluster doesn't provide are
+// rejected. Analyses are also rejected if every GPU of the kind they need is
+// in use, rather than being left Pending until one frees up, unless Kueue is
+// configured to queue them.
+func (i *Internal) validateGPURequest(ctx context.Context, job *model.Job, settings *ToolSettings) error {
+	if !settings.needsGPU(job) {
+		return nil
+	}
+
+	resource := settings.gpuResourceName()
+
+	if settings.MIGProfile != "" {
+		caps, err := i.clusterCapabilities(ctx)
+		if err != nil {
+			return err
+		}
+
+		if caps.GPUResources[string(resource)] == 0 {
+			return common.ErrorResponse{
+				ErrorCode: "ERR_GPU_PROFILE_UNAVAILABLE",
+				Message:   fmt.Sprintf("the cluster does not provide the %s GPU profile", settings.MIGProfile),
+				Details: &map[string]interface{}{
+					"requested": string(resource),
+					"available": caps.gpuResourceNames(),
+				},
+			}
+		}
+	}
+
+	if !i.CheckGPUCapacity || i.KueueQueueName != "" {
+		return nil
+	}
+
+	capacity, err := i.gpuCapacity(ctx, resource)
+	if err != nil {
+		return err
+	}
+
+	if capacity.Allocatable-capacity.Requested >= 1 {
+		return nil
+	}
+
+	return common.ErrorResponse{
+		ErrorCode: "ERR_GPU_CAPACITY_UNAVAILABLE",
+		Message:   fmt.Sprintf("no %s GPUs are free right now; please try again later", resource),
+		Details: &map[string]interface{}{
+			"requested":   string(resource),
+			"allocatable": capacity.Allocatable,
+			"in_use":      capacity.Requested,
+		},
+	}
+}
+
+// CapabilitiesHandler returns the resources the cluster can provide to VICE
+// analyses.
+func (i *Internal) CapabilitiesHandler(c echo.Context) error {
+	caps, err := i.clusterCapabilities(c.Request().Context())
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, caps)
+}
@@ -0,0 +1,398 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// The commands that may be sent to app-exposer over JetStream.
+const (
+	terminateCommand   = "terminate"
+	saveAndExitCommand = "save-and-exit"
+	extendCommand      = "extend"
+)
+
+// The statuses recorded for a command in the audit table.
+const (
+	commandReceived  = "received"
+	commandCompleted = "completed"
+	commandSkipped   = "skipped"
+	commandFailed    = "failed"
+	commandRejected  = "rejected"
+)
+
+const (
+	defaultCommandsStream     = "VICE_COMMANDS"
+	defaultCommandsSubject    = "cyverse.vice.commands.>"
+	defaultCommandsDurable    = "app-exposer"
+	defaultCommandsMaxDeliver = 10
+
+	// commandProgressInterval is how often the consumer tells the server that
+	// a long-running command is still being worked on so that it isn't
+	// redelivered.
+	commandProgressInterval = 15 * time.Second
+
+	// commandRetryDelay is the base delay before a failed command is
+	// redelivered. It's multiplied by the number of delivery attempts.
+	commandRetryDelay = 30 * time.Second
+
+	// The sizes of the vice_command_audit columns the command's fields are
+	// stored in. Longer values would make every attempt to record the
+	// command fail, so the command is rejected instead.
+	maxCommandIDLength   = 64
+	maxCommandNameLength = 32
+)
+
+// CommandsConfig contains the settings for the JetStream consumer that
+// processes analysis commands sent by other DE services.
+type CommandsConfig struct {
+	Enabled    bool
+	Stream     string
+	Subject    string
+	Durable    string
+	MaxDeliver int
+}
+
+// AnalysisCommand is a request from another DE service to terminate or extend
+// a running VICE analysis.
+type AnalysisCommand struct {
+	// RequestID uniquely identifies the request. Required for extensions so
+	// that redelivered requests don't extend the time limit more than once.
+	RequestID string `json:"request_id"`
+
+	// Command is one of terminate, save-and-exit, or extend.
+	Command string `json:"command"`
+
+	// ExternalID is the external ID of the analysis the command applies to.
+	ExternalID string `json:"external_id"`
+
+	// RequestedBy is the name of the service or user that sent the command.
+	RequestedBy string `json:"requested_by"`
+
+	// Reason is a human-readable explanation that's stored in the audit record.
+	Reason string `json:"reason"`
+}
+
+// parseAnalysisCommand unmarshals and validates a command message.
+func parseAnalysisCommand(data []byte) (*AnalysisCommand, error) {
+	cmd := &AnalysisCommand{}
+	if err := json.Unmarshal(data, cmd); err != nil {
+		return nil, errors.Wrap(err, "unable to parse the command")
+	}
+
+	if cmd.ExternalID == "" {
+		return cmd, errors.New("external_id is required")
+	}
+	if len(cmd.ExternalID) > maxCommandIDLength {
+		return cmd, fmt.Errorf("external_id must not be longer than %d characters", maxCommandIDLength)
+	}
+	if len(cmd.RequestID) > maxCommandIDLength {
+		return cmd, fmt.Errorf("request_id must not be longer than %d characters", maxCommandIDLength)
+	}
+
+	switch cmd.Command {
+	case terminateCommand, saveAndExitCommand:
+	case extendCommand:
+		if cmd.RequestID == "" {
+			return cmd, errors.New("request_id is required for extend commands")
+		}
+	default:
+		return cmd, fmt.Errorf("unknown command %q", cmd.Command)
+	}
+
+	return cmd, nil
+}
+
+// truncate returns a copy of the command with the fields that are too long
+// for the audit table cut short, so that rejected commands can still be
+// recorded.
+func (cmd *AnalysisCommand) truncate() *AnalysisCommand {
+	cut := func(value string, max int) string {
+		if len(value) > max {
+			return value[:max]
+		}
+		return value
+	}
+
+	truncated := *cmd
+	truncated.RequestID = cut(cmd.RequestID, maxCommandIDLength)
+	truncated.ExternalID = cut(cmd.ExternalID, maxCommandIDLength)
+	truncated.Command = cut(cmd.Command, maxCommandNameLength)
+	return &truncated
+}
+
+// idempotencyKey returns the request ID that must match for a previously
+// completed command to count as a duplicate. Terminations only happen once
+// per analysis, so any completed termination for the analysis counts.
+func (cmd *AnalysisCommand) idempotencyKey() string {
+	if cmd.Command == extendCommand {
+		return cmd.RequestID
+	}
+	return ""
+}
+
+const commandCompletedSQL = `
+	SELECT EXISTS (
+		SELECT 1
+		  FROM vice_command_audit
+		 WHERE external_id = $1
+		   AND command IN ($2, $3)
+		   AND status = 'completed'
+		   AND ($4 = '' OR request_id = $4)
+	)
+`
+
+// commandCompleted returns true if an equivalent command has already been
+// completed for the analysis.
+func (i *Internal) commandCompleted(ctx context.Context, cmd *AnalysisCommand) (bool, error) {
+	// A save-and-exit and a terminate both end the analysis, so either one
+	// makes the other redundant.
+	first, second := cmd.Command, cmd.Command
+	if cmd.Command == terminateCommand || cmd.Command == saveAndExitCommand {
+		first, second = terminateCommand, saveAndExitCommand
+	}
+
+	var completed bool
+	err := i.db.QueryRowContext(
+		ctx,
+		commandCompletedSQL,
+		cmd.ExternalID,
+		first,
+		second,
+		cmd.idempotencyKey(),
+	).Scan(&completed)
+	return completed, err
+}
+
+const insertCommandAuditSQL = `
+	INSERT INTO vice_command_audit (request_id, command, external_id, requested_by, reason, delivery_attempt, status)
+	VALUES ($1, $2, $3, $4, $5, $6, $7)
+	RETURNING id
+`
+
+const updateCommandAuditSQL = `
+	UPDATE vice_command_audit
+	   SET status = $2,
+	       error = $3,
+	       completed_at = now()
+	 WHERE id = $1
+`
+
+func (i *Internal) auditCommand(ctx context.Context, cmd *AnalysisCommand, attempt uint64, status string) (string, error) {
+	var id string
+	err := i.db.QueryRowContext(
+		ctx,
+		insertCommandAuditSQL,
+		cmd.RequestID,
+		cmd.Command,
+		cmd.ExternalID,
+		cmd.RequestedBy,
+		cmd.Reason,
+		attempt,
+		status,
+	).Scan(&id)
+	return id, err
+}
+
+func (i *Internal) finishCommandAudit(ctx context.Context, id, status string, cmdErr error) {
+	var errMsg *string
+	if cmdErr != nil {
+		m := common.Redact(cmdErr.Error())
+		errMsg = &m
+	}
+	if _, err := i.db.ExecContext(ctx, updateCommandAuditSQL, id, status, errMsg); err != nil {
+		log.WithContext(ctx).Error(errors.Wrapf(err, "unable to update the audit record %s", id))
+	}
+}
+
+// runCommand performs the action requested by the command.
+func (i *Internal) runCommand(ctx context.Context, cmd *AnalysisCommand) error {
+	switch cmd.Command {
+	case terminateCommand:
+		return i.doExit(ctx, cmd.ExternalID)
+
+	case saveAndExitCommand:
+		if err := i.doFileTransfer(ctx, cmd.ExternalID, uploadBasePath, uploadKind, false); err != nil {
+			// Log but don't exit. Possible to cancel a job that hasn't started yet
+			log.WithContext(ctx).Error(errors.Wrapf(err, "error saving the outputs for %s", cmd.ExternalID))
+		}
+		return i.doExit(ctx, cmd.ExternalID)
+
+	case extendCommand:
+		analysisID, err := i.apps.GetAnalysisIDByExternalID(ctx, cmd.ExternalID)
+		if err != nil {
+			return errors.Wrapf(err, "unable to look up the analysis ID for %s", cmd.ExternalID)
+		}
+		user, _, err := i.apps.GetUserByAnalysisID(ctx, analysisID)
+		if err != nil {
+			return errors.Wrapf(err, "unable to look up the user for analysis %s", analysisID)
+		}
+		_, err = i.updateTimeLimit(ctx, user, analysisID)
+		return err
+
+	default:
+		return fmt.Errorf("unknown command %q", cmd.Command)
+	}
+}
+
+// handleCommandMessage processes a single command delivered by JetStream. The
+// message is only acknowledged once the command has been completed, so
+// commands that fail are redelivered until the consumer's delivery limit is
+// reached.
+func (i *Internal) handleCommandMessage(msg *nats.Msg) {
+	// Continue the trace started by the service that sent the command.
+	ctx := context.Background()
+	if msg.Header != nil {
+		ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(msg.Header))
+	}
+	ctx, span := startSpan(ctx, "handleCommandMessage", attribute.String("messaging.destination", msg.Subject))
+	defer span.End()
+
+	var attempt uint64 = 1
+	if meta, err := msg.Metadata(); err == nil {
+		attempt = meta.NumDelivered
+	}
+
+	cmd, err := parseAnalysisCommand(msg.Data)
+	if err != nil {
+		log.WithContext(ctx).Error(errors.Wrapf(err, "rejecting command on %s", msg.Subject))
+		if cmd != nil {
+			if id, auditErr := i.auditCommand(ctx, cmd.truncate(), attempt, commandRejected); auditErr == nil {
+				i.finishCommandAudit(ctx, id, commandRejected, err)
+			}
+		}
+		if err = msg.Term(); err != nil {
+			log.WithContext(ctx).Error(err)
+		}
+		return
+	}
+
+	log.WithContext(ctx).Infof("received %s command for %s from %s", cmd.Command, cmd.ExternalID, cmd.RequestedBy)
+
+	ctx = withExternalIDBaggage(ctx, cmd.ExternalID)
+	span.SetAttributes(
+		attribute.String(externalIDBaggageKey, cmd.ExternalID),
+		attribute.String("vice.command", cmd.Command),
+	)
+
+	completed, err := i.commandCompleted(ctx, cmd)
+	if err != nil {
+		log.WithContext(ctx).Error(errors.Wrapf(err, "unable to check for earlier %s commands for %s", cmd.Command, cmd.ExternalID))
+		if err = msg.NakWithDelay(commandRetryDelay); err != nil {
+			log.WithContext(ctx).Error(err)
+		}
+		return
+	}
+
+	auditID, err := i.auditCommand(ctx, cmd, attempt, commandReceived)
+	if err != nil {
+		log.WithContext(ctx).Error(errors.Wrapf(err, "unable to record the %s command for %s", cmd.Command, cmd.ExternalID))
+		if err = msg.NakWithDelay(commandRetryDelay); err != nil {
+			log.WithContext(ctx).Error(err)
+		}
+		return
+	}
+
+	if completed {
+		log.WithContext(ctx).Infof("skipping duplicate %s command for %s", cmd.Command, cmd.ExternalID)
+		i.finishCommandAudit(ctx, auditID, commandSkipped, nil)
+		if err = msg.Ack(); err != nil {
+			log.WithContext(ctx).Error(err)
+		}
+		return
+	}
+
+	// Keep the message from being redelivered while the command is running.
+	// Saving outputs in particular can take a long time.
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(commandProgressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := msg.InProgress(); err != nil {
+					log.WithContext(ctx).Error(err)
+				}
+			}
+		}
+	}()
+
+	err = i.runCommand(ctx, cmd)
+	close(done)
+
+	if err != nil {
+		log.WithContext(ctx).Error(errors.Wrapf(err, "error running %s command for %s", cmd.Command, cmd.ExternalID))
+		i.finishCommandAudit(ctx, auditID, commandFailed, err)
+		if err = msg.NakWithDelay(time.Duration(attempt) * commandRetryDelay); err != nil {
+			log.WithContext(ctx).Error(err)
+		}
+		return
+	}
+
+	i.finishCommandAudit(ctx, auditID, commandCompleted, nil)
+	if err = msg.Ack(); err != nil {
+		log.WithContext(ctx).Error(err)
+	}
+}
+
+// ListenForCommands subscribes to the JetStream stream that other DE services
+// publish analysis commands to. The stream is created if it doesn't already
+// exist. Returns the subscription so the caller can drain it on shutdown.
+func (i *Internal) ListenForCommands() (*nats.Subscription, error) {
+	cfg := i.Commands
+	if cfg.Stream == "" {
+		cfg.Stream = defaultCommandsStream
+	}
+	if cfg.Subject == "" {
+		cfg.Subject = defaultCommandsSubject
+	}
+	if cfg.Durable == "" {
+		cfg.Durable = defaultCommandsDurable
+	}
+	if cfg.MaxDeliver <= 0 {
+		cfg.MaxDeliver = defaultCommandsMaxDeliver
+	}
+
+	js, err := i.NATSEncodedConn.Conn.JetStream()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to get the JetStream context")
+	}
+
+	if _, err = js.StreamInfo(cfg.Stream); err == nats.ErrStreamNotFound {
+		log.Infof("creating JetStream stream %s for subject %s", cfg.Stream, cfg.Subject)
+		if _, err = js.AddStream(&nats.StreamConfig{
+			Name:      cfg.Stream,
+			Subjects:  []string{cfg.Subject},
+			Retention: nats.WorkQueuePolicy,
+			Storage:   nats.FileStorage,
+		}); err != nil {
+			return nil, errors.Wrapf(err, "unable to create the %s stream", cfg.Stream)
+		}
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "unable to look up the %s stream", cfg.Stream)
+	}
+
+	// Commands are handled in their own goroutines so that a long-running
+	// save-and-exit doesn't hold up the commands queued behind it.
+	return js.Subscribe(
+		cfg.Subject,
+		func(msg *nats.Msg) { go i.handleCommandMessage(msg) },
+		nats.BindStream(cfg.Stream),
+		nats.Durable(cfg.Durable),
+		nats.ManualAck(),
+		nats.AckExplicit(),
+		nats.MaxDeliver(cfg.MaxDeliver),
+	)
+}
@@ -0,0 +1,107 @@
+package internal
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAnalysisCommand(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  string
+		valid bool
+	}{
+		{"terminate", `{"command":"terminate","external_id":"e"}`, true},
+		{"save and exit", `{"command":"save-and-exit","external_id":"e"}`, true},
+		{"extend", `{"command":"extend","external_id":"e","request_id":"r"}`, true},
+		{"extend without request id", `{"command":"extend","external_id":"e"}`, false},
+		{"missing external id", `{"command":"terminate"}`, false},
+		{"unknown command", `{"command":"reboot","external_id":"e"}`, false},
+		{"long request id", `{"command":"extend","external_id":"e","request_id":"` + strings.Repeat("r", 65) + `"}`, false},
+		{"long external id", `{"command":"terminate","external_id":"` + strings.Repeat("e", 65) + `"}`, false},
+		{"malformed", `{`, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseAnalysisCommand([]byte(tt.data))
+			if tt.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestAnalysisCommandTruncate(t *testing.T) {
+	assert := assert.New(t)
+
+	cmd := &AnalysisCommand{
+		RequestID:  strings.Repeat("r", 100),
+		ExternalID: "e",
+		Command:    strings.Repeat("c", 40),
+	}
+	truncated := cmd.truncate()
+	assert.Len(truncated.RequestID, maxCommandIDLength)
+	assert.Equal("e", truncated.ExternalID)
+	assert.Len(truncated.Command, maxCommandNameLength)
+	assert.Len(cmd.RequestID, 100)
+}
+
+func TestCommandCompleted(t *testing.T) {
+	tests := []struct {
+		name   string
+		cmd    *AnalysisCommand
+		first  string
+		second string
+		key    string
+	}{
+		{
+			name:   "terminate",
+			cmd:    &AnalysisCommand{Command: terminateCommand, ExternalID: "e", RequestID: "r"},
+			first:  terminateCommand,
+			second: saveAndExitCommand,
+			key:    "",
+		},
+		{
+			name:   "save and exit",
+			cmd:    &AnalysisCommand{Command: saveAndExitCommand, ExternalID: "e"},
+			first:  terminateCommand,
+			second: saveAndExitCommand,
+			key:    "",
+		},
+		{
+			name:   "extend",
+			cmd:    &AnalysisCommand{Command: extendCommand, ExternalID: "e", RequestID: "r"},
+			first:  extendCommand,
+			second: extendCommand,
+			key:    "r",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockdb, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+			if err != nil {
+				t.Fatalf("error connecting to mock database %s", err)
+			}
+			defer mockdb.Close()
+
+			mock.ExpectQuery(commandCompletedSQL).
+				WithArgs("e", tt.first, tt.second, tt.key).
+				WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+
+			i := &Internal{db: sqlx.NewDb(mockdb, "sqlmock")}
+			completed, err := i.commandCompleted(context.Background(), tt.cmd)
+			assert.NoError(t, err)
+			assert.True(t, completed)
+			assert.NoError(t, mock.ExpectationsWereMet(), "expectations were not met")
+		})
+	}
+}
@@ -0,0 +1,281 @@
+package internal
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/cyverse-de/app-exposer/apps"
+	"github.com/labstack/echo/v4"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// The dashboard endpoints return flat JSON arrays that Grafana's Infinity and
+// JSON datasources can turn into tables and time series without any
+// transformation, so operators can build dashboards without giving Grafana
+// access to the database.
+
+// durationParam returns the value of the duration query parameter, or def if
+// it isn't set.
+func durationParam(c echo.Context, name string, def time.Duration) (time.Duration, error) {
+	value := c.QueryParam(name)
+	if value == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("%s must be a positive duration, such as 24h", name))
+	}
+	return d, nil
+}
+
+// dashboardSeries lists the dashboard endpoints under /vice/admin/dashboards.
+var dashboardSeries = []string{
+	"running-by-app",
+	"launches",
+	"failures",
+	"utilization",
+	"transfers",
+}
+
+// AdminDashboardsHandler lists the dashboard endpoints. Grafana calls it to
+// test the datasource.
+func (i *Internal) AdminDashboardsHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, dashboardSeries)
+}
+
+// RunningByApp is the number of running analyses of an app.
+type RunningByApp struct {
+	AppID   string `json:"app_id"`
+	AppName string `json:"app_name"`
+	Count   int    `json:"count"`
+}
+
+// AdminRunningByAppHandler returns the number of running analyses of each
+// app, with the most used apps first.
+func (i *Internal) AdminRunningByAppHandler(c echo.Context) error {
+	set := labels.Set(map[string]string{
+		"app-type": "interactive",
+	})
+	deployments, err := i.clientset.AppsV1().Deployments(i.ViceNamespace).List(c.Request().Context(), metav1.ListOptions{
+		LabelSelector: set.AsSelector().String(),
+	})
+	if err != nil {
+		return err
+	}
+
+	byApp := map[string]*RunningByApp{}
+	for _, deployment := range deployments.Items {
+		if deployment.DeletionTimestamp != nil {
+			continue
+		}
+		appID := deployment.Labels["app-id"]
+		if _, ok := byApp[appID]; !ok {
+			byApp[appID] = &RunningByApp{AppID: appID, AppName: deployment.Labels["app-name"]}
+		}
+		byApp[appID].Count++
+	}
+
+	running := []RunningByApp{}
+	for _, app := range byApp {
+		running = append(running, *app)
+	}
+	sort.Slice(running, func(a, b int) bool {
+		if running[a].Count != running[b].Count {
+			return running[a].Count > running[b].Count
+		}
+		return running[a].AppName < running[b].AppName
+	})
+
+	return c.JSON(http.StatusOK, running)
+}
+
+// LaunchesPerHour is the number of VICE analyses launched during an hour.
+type LaunchesPerHour struct {
+	Hour     time.Time `json:"hour" db:"hour"`
+	Launches int       `json:"launches" db:"launches"`
+}
+
+// Hours without any launches are included so the series has no gaps.
+const launchesPerHourSQL = `
+	WITH launches AS (
+		SELECT date_trunc('hour', j.start_date) AS hour
+		  FROM jobs j
+		  JOIN job_steps s ON s.job_id = j.id
+		  JOIN job_types t ON s.job_type_id = t.id
+		 WHERE t.name = $2
+		   AND s.step_number = 1
+		   AND j.start_date >= $1
+	)
+	SELECT h.hour, count(l.hour) AS launches
+	  FROM generate_series(date_trunc('hour', $1::timestamp with time zone), now(), interval '1 hour') AS h(hour)
+	  LEFT JOIN launches l ON l.hour = h.hour
+	 GROUP BY h.hour
+	 ORDER BY h.hour
+`
+
+// AdminLaunchesPerHourHandler returns the number of VICE analyses launched
+// during each hour. The optional since query parameter is a duration, such
+// as 24h, and defaults to a day.
+func (i *Internal) AdminLaunchesPerHourHandler(c echo.Context) error {
+	since, err := durationParam(c, "since", 24*time.Hour)
+	if err != nil {
+		return err
+	}
+
+	launches := []LaunchesPerHour{}
+	if err = i.db.SelectContext(c.Request().Context(), &launches, launchesPerHourSQL, time.Now().Add(-since), apps.InteractiveJobType); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, launches)
+}
+
+// FailuresByReason is the number of analyses with a container that failed
+// for a reason.
+type FailuresByReason struct {
+	Reason   string `json:"reason" db:"reason"`
+	Analyses int    `json:"analyses" db:"analyses"`
+}
+
+// Containers that were still running when their analysis exited aren't
+// failures.
+const failuresByReasonSQL = `
+	SELECT reason, count(DISTINCT external_id) AS analyses
+	  FROM vice_container_summaries
+	 WHERE recorded_at >= $1
+	   AND reason NOT IN ('', $2)
+	   AND (exit_code IS NULL OR exit_code != 0)
+	 GROUP BY reason
+	 ORDER BY analyses DESC, reason
+`
+
+// AdminFailuresByReasonHandler returns the number of analyses with a
+// container that failed for each reason, such as OOMKilled or
+// ImagePullBackOff, taken from the container summaries recorded when
+// analyses exit. The optional since query parameter is a duration, such as
+// 168h, and defaults to a week.
+func (i *Internal) AdminFailuresByReasonHandler(c echo.Context) error {
+	since, err := durationParam(c, "since", 7*24*time.Hour)
+	if err != nil {
+		return err
+	}
+
+	failures := []FailuresByReason{}
+	if err = i.db.SelectContext(c.Request().Context(), &failures, failuresByReasonSQL, time.Now().Add(-since), stoppedReason); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, failures)
+}
+
+// ResourceUtilization is the amount of a resource that's allocatable on the
+// schedulable nodes and the amount requested by the pods running or waiting
+// to run on them. CPU is in millicores and memory is in bytes.
+type ResourceUtilization struct {
+	Resource      string  `json:"resource"`
+	Allocatable   int64   `json:"allocatable"`
+	Requested     int64   `json:"requested"`
+	VICERequested int64   `json:"vice_requested"`
+	Utilization   float64 `json:"utilization"`
+}
+
+// utilizationResources are the resources reported by the utilization
+// endpoint.
+var utilizationResources = []apiv1.ResourceName{
+	apiv1.ResourceCPU,
+	apiv1.ResourceMemory,
+	apiv1.ResourceName(nvidiaResourcePrefix + "/gpu"),
+}
+
+// resourceAmount returns the quantity in the units reported by the
+// utilization endpoint.
+func resourceAmount(resource apiv1.ResourceName, list apiv1.ResourceList) int64 {
+	quantity, ok := list[resource]
+	if !ok {
+		return 0
+	}
+	if resource == apiv1.ResourceCPU {
+		return quantity.MilliValue()
+	}
+	return quantity.Value()
+}
+
+// podRequest returns the amount of the resource requested by the pod's
+// containers.
+func podRequest(pod *apiv1.Pod, resource apiv1.ResourceName) int64 {
+	if resource != apiv1.ResourceCPU && resource != apiv1.ResourceMemory {
+		return podGPURequest(pod, resource)
+	}
+	var total int64
+	for _, container := range pod.Spec.Containers {
+		total += resourceAmount(resource, container.Resources.Requests)
+	}
+	return total
+}
+
+// AdminUtilizationHandler returns the cluster's utilization of CPU, memory,
+// and GPUs, along with the share of it requested by VICE analyses.
+func (i *Internal) AdminUtilizationHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	nodes, err := i.clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	totals := map[apiv1.ResourceName]*ResourceUtilization{}
+	for _, resource := range utilizationResources {
+		totals[resource] = &ResourceUtilization{Resource: string(resource)}
+	}
+
+	schedulable := map[string]bool{}
+	for idx := range nodes.Items {
+		node := &nodes.Items[idx]
+		if !nodeSchedulable(node) {
+			continue
+		}
+		schedulable[node.Name] = true
+		for _, resource := range utilizationResources {
+			totals[resource].Allocatable += resourceAmount(resource, node.Status.Allocatable)
+		}
+	}
+
+	pods, err := i.clientset.CoreV1().Pods("").List(ctx, metav1.ListOptions{
+		FieldSelector: "status.phase!=Succeeded,status.phase!=Failed",
+	})
+	if err != nil {
+		return err
+	}
+
+	for idx := range pods.Items {
+		pod := &pods.Items[idx]
+		if !schedulable[pod.Spec.NodeName] {
+			continue
+		}
+		if pod.Status.Phase == apiv1.PodSucceeded || pod.Status.Phase == apiv1.PodFailed {
+			continue
+		}
+		for _, resource := range utilizationResources {
+			requested := podRequest(pod, resource)
+			totals[resource].Requested += requested
+			if pod.Namespace == i.ViceNamespace {
+				totals[resource].VICERequested += requested
+			}
+		}
+	}
+
+	utilization := []ResourceUtilization{}
+	for _, resource := range utilizationResources {
+		total := totals[resource]
+		if total.Allocatable > 0 {
+			total.Utilization = float64(total.Requested) / float64(total.Allocatable)
+		}
+		utilization = append(utilization, *total)
+	}
+
+	return c.JSON(http.StatusOK, utilization)
+}
@@ -0,0 +1,171 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	resourcev1 "k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func appDeployment(externalID, appID, appName string) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      externalID,
+			Namespace: "vice-apps",
+			Labels: map[string]string{
+				"external-id": externalID,
+				"app-id":      appID,
+				"app-name":    appName,
+				"app-type":    "interactive",
+			},
+		},
+	}
+}
+
+func requestingPod(name, namespace, node string, requests map[string]string) *apiv1.Pod {
+	list := apiv1.ResourceList{}
+	for k, v := range requests {
+		list[apiv1.ResourceName(k)] = resourcev1.MustParse(v)
+	}
+	return &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Spec: apiv1.PodSpec{
+			NodeName: node,
+			Containers: []apiv1.Container{
+				{Name: "main", Resources: apiv1.ResourceRequirements{Requests: list}},
+			},
+		},
+		Status: apiv1.PodStatus{Phase: apiv1.PodRunning},
+	}
+}
+
+func TestAdminRunningByAppHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	terminating := appDeployment("e4", "a2", "rstudio")
+	now := metav1.Now()
+	terminating.DeletionTimestamp = &now
+
+	i := &Internal{
+		Init: Init{ViceNamespace: "vice-apps"},
+		clientset: fake.NewSimpleClientset(
+			appDeployment("e1", "a1", "jupyter"),
+			appDeployment("e2", "a1", "jupyter"),
+			appDeployment("e3", "a2", "rstudio"),
+			terminating,
+		),
+	}
+
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+	assert.NoError(i.AdminRunningByAppHandler(c))
+
+	var running []RunningByApp
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &running))
+	assert.Equal([]RunningByApp{
+		{AppID: "a1", AppName: "jupyter", Count: 2},
+		{AppID: "a2", AppName: "rstudio", Count: 1},
+	}, running)
+}
+
+func TestAdminUtilizationHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	cordoned := gpuNode("c", map[string]string{"cpu": "16"})
+	cordoned.Spec.Unschedulable = true
+
+	i := &Internal{
+		Init: Init{ViceNamespace: "vice-apps"},
+		clientset: fake.NewSimpleClientset(
+			gpuNode("a", map[string]string{"cpu": "8", "memory": "32Gi", "nvidia.com/gpu": "2"}),
+			gpuNode("b", map[string]string{"cpu": "8", "memory": "32Gi"}),
+			cordoned,
+			requestingPod("vice", "vice-apps", "a", map[string]string{"cpu": "2", "memory": "8Gi", "nvidia.com/gpu": "1"}),
+			requestingPod("other", "kube-system", "b", map[string]string{"cpu": "2"}),
+			requestingPod("cordoned", "kube-system", "c", map[string]string{"cpu": "4"}),
+		),
+	}
+
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+	assert.NoError(i.AdminUtilizationHandler(c))
+
+	var utilization []ResourceUtilization
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &utilization))
+	if assert.Len(utilization, 3) {
+		assert.Equal(ResourceUtilization{
+			Resource: "cpu", Allocatable: 16000, Requested: 4000, VICERequested: 2000, Utilization: 0.25,
+		}, utilization[0])
+		assert.Equal(int64(64<<30), utilization[1].Allocatable)
+		assert.Equal(int64(8<<30), utilization[1].VICERequested)
+		assert.Equal(ResourceUtilization{
+			Resource: "nvidia.com/gpu", Allocatable: 2, Requested: 1, VICERequested: 1, Utilization: 0.5,
+		}, utilization[2])
+	}
+}
+
+func TestAdminLaunchesPerHourHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	mockdb, mock, err := sqlmock.New()
+	assert.NoError(err)
+	defer mockdb.Close()
+
+	i := &Internal{db: sqlx.NewDb(mockdb, "sqlmock")}
+
+	hour := time.Date(2024, 1, 2, 3, 0, 0, 0, time.UTC)
+	mock.ExpectQuery(regexp.QuoteMeta("FROM generate_series")).
+		WithArgs(sqlmock.AnyArg(), "Interactive").
+		WillReturnRows(sqlmock.NewRows([]string{"hour", "launches"}).
+			AddRow(hour, 3).
+			AddRow(hour.Add(time.Hour), 0))
+
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/?since=2h", nil), rec)
+	assert.NoError(i.AdminLaunchesPerHourHandler(c))
+	assert.Contains(rec.Body.String(), `"launches":3`)
+	assert.NoError(mock.ExpectationsWereMet())
+
+	c = echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/?since=soon", nil), httptest.NewRecorder())
+	err = i.AdminLaunchesPerHourHandler(c)
+	if assert.Error(err) {
+		assert.Equal(http.StatusBadRequest, err.(*echo.HTTPError).Code)
+	}
+}
+
+func TestAdminFailuresByReasonHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	mockdb, mock, err := sqlmock.New()
+	assert.NoError(err)
+	defer mockdb.Close()
+
+	i := &Internal{db: sqlx.NewDb(mockdb, "sqlmock")}
+
+	mock.ExpectQuery(regexp.QuoteMeta("FROM vice_container_summaries")).
+		WithArgs(sqlmock.AnyArg(), stoppedReason).
+		WillReturnRows(sqlmock.NewRows([]string{"reason", "analyses"}).
+			AddRow("OOMKilled", 4).
+			AddRow("ImagePullBackOff", 1))
+
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+	assert.NoError(i.AdminFailuresByReasonHandler(c))
+
+	var failures []FailuresByReason
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &failures))
+	assert.Equal([]FailuresByReason{{Reason: "OOMKilled", Analyses: 4}, {Reason: "ImagePullBackOff", Analyses: 1}}, failures)
+	assert.NoError(mock.ExpectationsWereMet())
+}
@@ -0,0 +1,117 @@
+package internal
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/cyverse-de/model/v6"
+)
+
+// maxDatasetMetadataLength limits the length of each dataset metadata value.
+const maxDatasetMetadataLength = 2048
+
+// The attributes of the AVUs added to the outputs for dataset metadata.
+const (
+	datasetIdentifierAttr = "dataset-identifier"
+	datasetTitleAttr      = "dataset-title"
+	datasetDescAttr       = "dataset-description"
+	datasetPIAttr         = "dataset-principal-investigator"
+	datasetGrantAttr      = "dataset-grant"
+)
+
+var (
+	doiRegexp = regexp.MustCompile(`^10\.\d{4,9}/\S+$`)
+	arkRegexp = regexp.MustCompile(`(?i)^ark:/?\d{5,}/\S+$`)
+)
+
+// doiPrefixes are removed from DOIs so that they're recorded the same way
+// however they were written.
+var doiPrefixes = []string{"https://doi.org/", "http://doi.org/", "https://dx.doi.org/", "doi:"}
+
+// DatasetMetadata describes the dataset an analysis's outputs belong to, so
+// that published outputs keep their provenance. It's recorded as AVUs on the
+// outputs when they're uploaded.
+type DatasetMetadata struct {
+	// Identifier is the dataset's DOI or ARK, such as 10.25739/abcd-1234 or
+	// ark:/12345/x6np1wh8k.
+	Identifier            string `json:"identifier"`
+	Title                 string `json:"title"`
+	Description           string `json:"description"`
+	PrincipalInvestigator string `json:"principal_investigator"`
+	Grant                 string `json:"grant"`
+}
+
+// normalizeIdentifier returns the identifier without a DOI resolver prefix
+// and the unit it's recorded with, either DOI or ARK. The unit is empty if
+// the identifier is neither.
+func normalizeIdentifier(identifier string) (string, string) {
+	for _, prefix := range doiPrefixes {
+		if len(identifier) >= len(prefix) && strings.EqualFold(identifier[:len(prefix)], prefix) {
+			identifier = identifier[len(prefix):]
+			break
+		}
+	}
+
+	switch {
+	case doiRegexp.MatchString(identifier):
+		return identifier, "DOI"
+	case arkRegexp.MatchString(identifier):
+		return identifier, "ARK"
+	default:
+		return identifier, ""
+	}
+}
+
+// fileMetadata returns the AVUs for the dataset metadata, along with the
+// problems with it. The file transfer tools take AVUs as comma-separated
+// arguments, so values can't contain commas.
+func (m *DatasetMetadata) fileMetadata() ([]model.FileMetadata, submissionErrors) {
+	errs := submissionErrors{}
+	avus := []model.FileMetadata{}
+
+	add := func(field, attr, value, unit string) {
+		value = strings.TrimSpace(value)
+		switch {
+		case value == "":
+			return
+		case strings.ContainsAny(value, ",\r\n"):
+			errs.add("dataset_metadata."+field, "must not contain commas or line breaks")
+		case len(value) > maxDatasetMetadataLength:
+			errs.add("dataset_metadata."+field, "must be at most %d characters long", maxDatasetMetadataLength)
+		default:
+			avus = append(avus, model.FileMetadata{Attribute: attr, Value: value, Unit: unit})
+		}
+	}
+
+	if identifier := strings.TrimSpace(m.Identifier); identifier != "" {
+		identifier, unit := normalizeIdentifier(identifier)
+		if unit == "" {
+			errs.add("dataset_metadata.identifier", "must be a DOI or an ARK, got %q", identifier)
+		} else {
+			add("identifier", datasetIdentifierAttr, identifier, unit)
+		}
+	}
+	add("title", datasetTitleAttr, m.Title, "")
+	add("description", datasetDescAttr, m.Description, "")
+	add("principal_investigator", datasetPIAttr, m.PrincipalInvestigator, "")
+	add("grant", datasetGrantAttr, m.Grant, "")
+
+	return avus, errs
+}
+
+// applyDatasetMetadata adds the dataset metadata in the launch request to the
+// AVUs that the file transfer container sets on the outputs it uploads.
+// Returns an ERR_INVALID_SUBMISSION error if the metadata can't be recorded.
+func applyDatasetMetadata(job *model.Job, opts *launchOptions) error {
+	if opts.DatasetMetadata == nil {
+		return nil
+	}
+
+	avus, errs := opts.DatasetMetadata.fileMetadata()
+	if err := errs.response(); err != nil {
+		return err
+	}
+
+	job.FileMetadata = append(job.FileMetadata, avus...)
+	return nil
+}
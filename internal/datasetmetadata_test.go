@@ -0,0 +1,71 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/cyverse-de/model/v6"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeIdentifier(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		identifier string
+		expected   string
+		unit       string
+	}{
+		{"10.25739/abcd-1234", "10.25739/abcd-1234", "DOI"},
+		{"doi:10.25739/abcd-1234", "10.25739/abcd-1234", "DOI"},
+		{"https://doi.org/10.25739/abcd-1234", "10.25739/abcd-1234", "DOI"},
+		{"ark:/12345/x6np1wh8k", "ark:/12345/x6np1wh8k", "ARK"},
+		{"ARK:12345/x6np1wh8k", "ARK:12345/x6np1wh8k", "ARK"},
+		{"https://example.org/dataset", "https://example.org/dataset", ""},
+	}
+	for _, test := range tests {
+		identifier, unit := normalizeIdentifier(test.identifier)
+		assert.Equal(test.expected, identifier, test.identifier)
+		assert.Equal(test.unit, unit, test.identifier)
+	}
+}
+
+func TestApplyDatasetMetadata(t *testing.T) {
+	assert := assert.New(t)
+
+	job := &model.Job{InvocationID: "e1", FileMetadata: []model.FileMetadata{{Attribute: "ipc-execution-id", Value: "e1", Unit: "UUID"}}}
+
+	// Launches without dataset metadata are left alone.
+	assert.NoError(applyDatasetMetadata(job, &launchOptions{}))
+	assert.Len(job.FileMetadata, 1)
+
+	assert.NoError(applyDatasetMetadata(job, &launchOptions{DatasetMetadata: &DatasetMetadata{
+		Identifier:            "doi:10.25739/abcd-1234",
+		Title:                 " Soil samples ",
+		PrincipalInvestigator: "J. Doe",
+	}}))
+	assert.Equal([]model.FileMetadata{
+		{Attribute: "ipc-execution-id", Value: "e1", Unit: "UUID"},
+		{Attribute: datasetIdentifierAttr, Value: "10.25739/abcd-1234", Unit: "DOI"},
+		{Attribute: datasetTitleAttr, Value: "Soil samples"},
+		{Attribute: datasetPIAttr, Value: "J. Doe"},
+	}, job.FileMetadata)
+
+	// The AVUs are passed to the file transfer container, which sets them on
+	// the outputs it uploads.
+	assert.Contains(fileTransferCommand(job), "dataset-title,Soil samples,")
+
+	// Metadata that can't be passed along is rejected.
+	err := applyDatasetMetadata(&model.Job{}, &launchOptions{DatasetMetadata: &DatasetMetadata{
+		Identifier:  "not an identifier",
+		Description: "first, second",
+	}})
+	if assert.Error(err) {
+		errResp := err.(common.ErrorResponse)
+		assert.Equal("ERR_INVALID_SUBMISSION", errResp.ErrorCode)
+		assert.Equal([]FieldError{
+			{Field: "dataset_metadata.identifier", Message: `must be a DOI or an ARK, got "not an identifier"`},
+			{Field: "dataset_metadata.description", Message: "must not contain commas or line breaks"},
+		}, (*errResp.Details)["errors"])
+	}
+}
@@ -0,0 +1,139 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/cockroachdb/apd"
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/cyverse-de/model/v6"
+	"github.com/labstack/echo/v4"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// demoLabel marks the Deployments and pods of analyses launched in demo mode.
+const demoLabel = "vice-demo"
+
+// DemoConfig contains the settings for demo mode, a launch option meant for
+// public instant launches embedded in documentation and workshops. Demo
+// analyses can't write to the data store, never upload their outputs, and
+// have a short time limit that can't be extended.
+type DemoConfig struct {
+	Enabled bool
+
+	// TimeLimit is how long demo analyses may run.
+	TimeLimit time.Duration
+
+	// CountQuota is true if demo analyses count against their users' job
+	// limits and resource usage.
+	CountQuota bool
+}
+
+// Validate returns an error if the configuration can't be used.
+func (c *DemoConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.TimeLimit <= 0 {
+		return fmt.Errorf("the demo mode time limit must be greater than 0")
+	}
+	return nil
+}
+
+// checkDemoRequest returns an error if the launch request asks for demo mode
+// when it isn't enabled.
+func (i *Internal) checkDemoRequest(opts *launchOptions) error {
+	if opts.Demo && !i.Demo.Enabled {
+		return echo.NewHTTPError(http.StatusBadRequest, "demo mode is not enabled")
+	}
+	return nil
+}
+
+// skipsQuota returns true if the analysis doesn't count against its user's
+// job limits and resource usage.
+func (i *Internal) skipsQuota(opts *launchOptions) bool {
+	return opts.Demo && !i.Demo.CountQuota
+}
+
+// applyDemoMode labels the Deployment of a demo analysis and makes sure it
+// can't write to the data store. The CSI data volume, which holds the inputs,
+// the output folder, and the home and shared folders, is mounted read-only.
+// The preStop hooks only flush the outputs, so they're removed.
+func (i *Internal) applyDemoMode(deployment *appsv1.Deployment, job *model.Job, opts *launchOptions) {
+	if !opts.Demo {
+		return
+	}
+
+	if deployment.Labels == nil {
+		deployment.Labels = map[string]string{}
+	}
+	deployment.Labels[demoLabel] = "true"
+	if deployment.Spec.Template.Labels == nil {
+		deployment.Spec.Template.Labels = map[string]string{}
+	}
+	deployment.Spec.Template.Labels[demoLabel] = "true"
+
+	dataVolumeName := i.getCSIDataVolumeClaimName(job)
+	containers := deployment.Spec.Template.Spec.Containers
+	for c := range containers {
+		containers[c].Lifecycle = nil
+		for m := range containers[c].VolumeMounts {
+			if containers[c].VolumeMounts[m].Name == dataVolumeName {
+				containers[c].VolumeMounts[m].ReadOnly = true
+			}
+		}
+	}
+}
+
+// reserveMillicores records the millicores reserved for the analysis. Demo
+// analyses that don't count against quotas reserve nothing, and every demo
+// analysis gets a fixed end date in place of the usual time limit.
+func (i *Internal) reserveMillicores(job *model.Job, millicores *apd.Decimal, opts *launchOptions) error {
+	if i.skipsQuota(opts) {
+		millicores = apd.New(0, 0)
+	}
+	if opts.Demo {
+		return i.apps.SetMillicoresReservedWithEndDate(job, millicores, time.Now().Add(i.Demo.TimeLimit))
+	}
+	return i.apps.SetMillicoresReserved(job, millicores)
+}
+
+// isDemoAnalysis returns true if the analysis was launched in demo mode.
+func (i *Internal) isDemoAnalysis(ctx context.Context, externalID string) (bool, error) {
+	set := labels.Set(map[string]string{
+		"external-id": externalID,
+		demoLabel:     "true",
+	})
+	deployments, err := i.clientset.AppsV1().Deployments(i.ViceNamespace).List(ctx, metav1.ListOptions{
+		LabelSelector: set.AsSelector().String(),
+	})
+	if err != nil {
+		return false, err
+	}
+	return len(deployments.Items) > 0, nil
+}
+
+// checkDemoTimeLimitExtension returns an error if the analysis was launched in
+// demo mode, since its time limit can't be extended.
+func (i *Internal) checkDemoTimeLimitExtension(ctx context.Context, analysisID string) error {
+	externalID, err := i.getExternalIDByAnalysisID(ctx, analysisID)
+	if err != nil {
+		return err
+	}
+
+	demo, err := i.isDemoAnalysis(ctx, externalID)
+	if err != nil {
+		return err
+	}
+	if demo {
+		return common.ErrorResponse{
+			ErrorCode: "ERR_DEMO_TIME_LIMIT",
+			Message:   fmt.Sprintf("the time limit of demo analysis %s can't be extended", analysisID),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/model/v6"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func demoDeployment(externalID string) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      externalID,
+			Namespace: "vice-apps",
+			Labels: map[string]string{
+				"external-id": externalID,
+				"username":    "ipctest",
+				demoLabel:     "true",
+			},
+		},
+	}
+}
+
+func TestDemoConfigValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError((&DemoConfig{}).Validate())
+	assert.NoError((&DemoConfig{Enabled: true, TimeLimit: time.Hour}).Validate())
+	assert.Error((&DemoConfig{Enabled: true}).Validate())
+}
+
+func TestCheckDemoRequest(t *testing.T) {
+	assert := assert.New(t)
+
+	i := &Internal{}
+	assert.NoError(i.checkDemoRequest(&launchOptions{}))
+	err := i.checkDemoRequest(&launchOptions{Demo: true})
+	if assert.Error(err) {
+		assert.Equal(http.StatusBadRequest, err.(*echo.HTTPError).Code)
+	}
+
+	i.Demo = DemoConfig{Enabled: true, TimeLimit: time.Hour}
+	assert.NoError(i.checkDemoRequest(&launchOptions{Demo: true}))
+	assert.True(i.skipsQuota(&launchOptions{Demo: true}))
+	assert.False(i.skipsQuota(&launchOptions{}))
+
+	i.Demo.CountQuota = true
+	assert.False(i.skipsQuota(&launchOptions{Demo: true}))
+}
+
+func TestApplyDemoMode(t *testing.T) {
+	assert := assert.New(t)
+
+	i := &Internal{}
+	job := &model.Job{InvocationID: "e1"}
+	dataVolume := i.getCSIDataVolumeClaimName(job)
+	deployment := &appsv1.Deployment{
+		Spec: appsv1.DeploymentSpec{
+			Template: apiv1.PodTemplateSpec{
+				Spec: apiv1.PodSpec{
+					Containers: []apiv1.Container{
+						{
+							Name:      "analysis",
+							Lifecycle: &apiv1.Lifecycle{PreStop: &apiv1.LifecycleHandler{}},
+							VolumeMounts: []apiv1.VolumeMount{
+								{Name: dataVolume, MountPath: csiDriverLocalMountPath},
+								{Name: workingDirVolumeName, MountPath: "/de-app-work"},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	// Nothing changes for regular analyses.
+	i.applyDemoMode(deployment, job, &launchOptions{})
+	assert.Empty(deployment.Labels)
+	assert.NotNil(deployment.Spec.Template.Spec.Containers[0].Lifecycle)
+
+	i.applyDemoMode(deployment, job, &launchOptions{Demo: true})
+	assert.Equal("true", deployment.Labels[demoLabel])
+	assert.Equal("true", deployment.Spec.Template.Labels[demoLabel])
+	container := deployment.Spec.Template.Spec.Containers[0]
+	assert.Nil(container.Lifecycle)
+	assert.True(container.VolumeMounts[0].ReadOnly)
+	assert.False(container.VolumeMounts[1].ReadOnly)
+}
+
+func TestDemoUploadsAreSkipped(t *testing.T) {
+	assert := assert.New(t)
+
+	i := &Internal{
+		Init:      Init{ViceNamespace: "vice-apps"},
+		clientset: fake.NewSimpleClientset(demoDeployment("e1")),
+	}
+
+	demo, err := i.isDemoAnalysis(context.Background(), "e1")
+	assert.NoError(err)
+	assert.True(demo)
+
+	demo, err = i.isDemoAnalysis(context.Background(), "e2")
+	assert.NoError(err)
+	assert.False(demo)
+
+	// There are no services to upload from, so this only succeeds because
+	// the upload is skipped.
+	assert.NoError(i.doFileTransfer(context.Background(), "e1", uploadBasePath, uploadKind, false))
+	assert.Error(i.doFileTransfer(context.Background(), "e2", uploadBasePath, uploadKind, false))
+}
+
+func TestDemoAnalysesSkipQuota(t *testing.T) {
+	assert := assert.New(t)
+
+	i := &Internal{
+		Init:      Init{ViceNamespace: "vice-apps"},
+		clientset: fake.NewSimpleClientset(demoDeployment("e1")),
+	}
+
+	count, err := i.countJobsForUser(context.Background(), "ipctest")
+	assert.NoError(err)
+	assert.Equal(0, count)
+
+	status, err := i.validateJob(context.Background(), &model.Job{ExecutionTarget: "interapps"}, false)
+	assert.NoError(err)
+	assert.Equal(http.StatusOK, status)
+}
@@ -2,12 +2,15 @@ package internal
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/url"
 	"strconv"
 	"strings"
 
+	"github.com/cyverse-de/app-exposer/common"
 	"github.com/cyverse-de/model/v6"
+	"github.com/pkg/errors"
 	appsv1 "k8s.io/api/apps/v1"
 	apiv1 "k8s.io/api/core/v1"
 	resourcev1 "k8s.io/apimachinery/pkg/api/resource"
@@ -103,6 +106,8 @@ func (i *Internal) deploymentVolumes(job *model.Job) []apiv1.Volume {
 		},
 	)
 
+	output = append(output, i.caCertsVolumes()...)
+
 	shmSize := sharedMemoryAmount(job)
 	if shmSize != nil {
 		output = append(output,
@@ -124,11 +129,11 @@ func (i *Internal) deploymentVolumes(job *model.Job) []apiv1.Volume {
 func (i *Internal) getFrontendURL(job *model.Job) *url.URL {
 	// This should be parsed in main(), so we shouldn't worry about it here.
 	frontURL, _ := url.Parse(i.FrontendBaseURL)
-	frontURL.Host = fmt.Sprintf("%s.%s", IngressName(job.UserID, job.InvocationID), frontURL.Host)
+	frontURL.Host = fmt.Sprintf("%s.%s", i.jobSubdomain(job), frontURL.Host)
 	return frontURL
 }
 
-func (i *Internal) viceProxyCommand(job *model.Job) []string {
+func (i *Internal) viceProxyCommand(job *model.Job, settings *ToolSettings) []string {
 	frontURL := i.getFrontendURL(job)
 	backendURL := fmt.Sprintf("http://localhost:%s", strconv.Itoa(job.Steps[0].Component.Container.Ports[0].ContainerPort))
 
@@ -143,12 +148,13 @@ func (i *Internal) viceProxyCommand(job *model.Job) []string {
 		"--external-id", job.InvocationID,
 		"--get-analysis-id-base", fmt.Sprintf("http://%s.%s", i.GetAnalysisIDService, i.VICEBackendNamespace),
 		"--check-resource-access-base", fmt.Sprintf("http://%s.%s", i.CheckResourceAccessService, i.VICEBackendNamespace),
-		"--keycloak-base-url", i.KeycloakBaseURL,
-		"--keycloak-realm", i.KeycloakRealm,
-		"--keycloak-client-id", i.KeycloakClientID,
-		"--keycloak-client-secret", i.KeycloakClientSecret,
 	}
 
+	// The credentials are referenced through environment variables populated
+	// from a Secret so that they don't show up in the pod spec.
+	output = append(output, i.ProxyAuth.ProxyArgs()...)
+	output = append(output, settings.sessionTokenProxyArgs()...)
+
 	return output
 }
 
@@ -253,7 +259,7 @@ func storageRequest(job *model.Job) resourcev1.Quantity {
 
 // inputStagingContainer returns the init container to be used for staging input files. This init container
 // is only used when iRODS CSI driver integration is disabled.
-func (i *Internal) inputStagingContainer(job *model.Job) apiv1.Container {
+func (i *Internal) inputStagingContainer(job *model.Job, settings *ToolSettings) apiv1.Container {
 	return apiv1.Container{
 		Name:            fileTransfersInitContainerName,
 		Image:           fmt.Sprintf("%s:%s", i.PorklockImage, i.PorklockTag),
@@ -269,8 +275,8 @@ func (i *Internal) inputStagingContainer(job *model.Job) apiv1.Container {
 			},
 		},
 		SecurityContext: &apiv1.SecurityContext{
-			RunAsUser:  int64Ptr(int64(job.Steps[0].Component.Container.UID)),
-			RunAsGroup: int64Ptr(int64(job.Steps[0].Component.Container.UID)),
+			RunAsUser:  int64Ptr(settings.runAsUser(job)),
+			RunAsGroup: int64Ptr(settings.runAsGroup(job)),
 			Capabilities: &apiv1.Capabilities{
 				Drop: []apiv1.Capability{
 					"SETPCAP",
@@ -297,16 +303,18 @@ func (i *Internal) inputStagingContainer(job *model.Job) apiv1.Container {
 // It may seem odd to use the file transfer image to initialize the working directory when no files are actually
 // being transferred, but it works. We use it for a couple of different reasons. First, we need a Unix shell and
 // it has one. Second, it's already set up so that we can configure it in a way that avoids image pull rate limits.
-func (i *Internal) workingDirPrepContainer(job *model.Job) apiv1.Container {
+func (i *Internal) workingDirPrepContainer(job *model.Job, settings *ToolSettings) apiv1.Container {
 
-	// Build the command used to initialize the working directory.
+	// Build the command used to initialize the working directory. The paths
+	// are passed as positional parameters so that they aren't interpreted by
+	// the shell.
 	workingDirInitCommand := []string{
 		"bash",
 		"-c",
-		strings.Join([]string{
-			fmt.Sprintf("ln -s \"%s\" \"data\"", csiDriverLocalMountPath),
-			fmt.Sprintf("ln -s \"%s/home\" .", i.getZoneMountPath()),
-		}, " && "),
+		`ln -s "$1" data && ln -s "$2/home" .`,
+		"bash",
+		csiDriverLocalMountPath,
+		i.getZoneMountPath(),
 	}
 
 	// Build the init container spec.
@@ -324,8 +332,8 @@ func (i *Internal) workingDirPrepContainer(job *model.Job) apiv1.Container {
 			},
 		},
 		SecurityContext: &apiv1.SecurityContext{
-			RunAsUser:  int64Ptr(int64(job.Steps[0].Component.Container.UID)),
-			RunAsGroup: int64Ptr(int64(job.Steps[0].Component.Container.UID)),
+			RunAsUser:  int64Ptr(settings.runAsUser(job)),
+			RunAsGroup: int64Ptr(settings.runAsGroup(job)),
 			Capabilities: &apiv1.Capabilities{
 				Drop: []apiv1.Capability{
 					"SETPCAP",
@@ -354,13 +362,25 @@ func workingDirMountPath(job *model.Job) string {
 
 // initContainers returns a []apiv1.Container used for the InitContainers in
 // the VICE app Deployment resource.
-func (i *Internal) initContainers(job *model.Job) []apiv1.Container {
+func (i *Internal) initContainers(job *model.Job, settings *ToolSettings) []apiv1.Container {
 	output := []apiv1.Container{}
 
 	if !i.UseCSIDriver {
-		output = append(output, i.inputStagingContainer(job))
+		output = append(output, i.inputStagingContainer(job, settings))
+		if input := restoredSnapshot(job); input != nil {
+			output = append(output, i.snapshotRestoreContainer(job, settings, input))
+		}
 	} else {
-		output = append(output, i.workingDirPrepContainer(job))
+		output = append(output, i.workingDirPrepContainer(job, settings))
+
+		if i.CSIMountCheck {
+			mountCheck, err := i.mountCheckContainer(job, settings)
+			if err != nil {
+				log.Warn(err)
+			} else {
+				output = append(output, mountCheck)
+			}
+		}
 	}
 
 	return output
@@ -392,37 +412,12 @@ func sharedMemoryAmount(job *model.Job) *resourcev1.Quantity {
 	return nil
 }
 
-func (i *Internal) defineAnalysisContainer(job *model.Job) apiv1.Container {
-	analysisEnvironment := []apiv1.EnvVar{}
-	for envKey, envVal := range job.Steps[0].Environment {
-		analysisEnvironment = append(
-			analysisEnvironment,
-			apiv1.EnvVar{
-				Name:  envKey,
-				Value: envVal,
-			},
-		)
-	}
-
-	analysisEnvironment = append(
-		analysisEnvironment,
-		apiv1.EnvVar{
-			Name:  "REDIRECT_URL",
-			Value: i.getFrontendURL(job).String(),
-		},
-		apiv1.EnvVar{
-			Name:  "IPLANT_USER",
-			Value: job.Submitter,
-		},
-		apiv1.EnvVar{
-			Name:  "IPLANT_EXECUTION_ID",
-			Value: job.InvocationID,
-		},
-	)
-
+// analysisResources returns the resource requests and limits for the analysis
+// container, after the defaults and tool settings have been applied.
+func analysisResources(job *model.Job, settings *ToolSettings) apiv1.ResourceRequirements {
 	cpuRequest := cpuResourceRequest(job)
 	memRequest := memResourceRequest(job)
-	storageRequest := storageRequest(job)
+	storageRequest := settings.ephemeralStorageRequest(job)
 
 	requests := apiv1.ResourceList{
 		apiv1.ResourceCPU:              cpuRequest,     // job contains # cores
@@ -438,16 +433,69 @@ func (i *Internal) defineAnalysisContainer(job *model.Job) apiv1.Container {
 		apiv1.ResourceMemory: memLimit, // job contains # bytes mem
 	}
 
-	// If a GPU device is configured, then add it to the resource limits.
-	if gpuEnabled(job) {
+	if storageLimit, ok := settings.ephemeralStorageLimit(job); ok {
+		limits[apiv1.ResourceEphemeralStorage] = storageLimit
+	}
+
+	// If a GPU device or MIG profile is configured, then add it to the
+	// resource limits.
+	if settings.needsGPU(job) {
 		gpuLimit, err := resourcev1.ParseQuantity("1")
 		if err != nil {
 			log.Warn(err)
 		} else {
-			limits[apiv1.ResourceName("nvidia.com/gpu")] = gpuLimit
+			limits[settings.gpuResourceName()] = gpuLimit
+		}
+	}
+
+	return apiv1.ResourceRequirements{
+		Limits:   limits,
+		Requests: requests,
+	}
+}
+
+// entryPointCommand returns the Command for the analysis container, or nil
+// to use the image's entry point. An entry point written as a JSON array, for
+// example ["python", "-m", "app"], is in exec form and each element becomes a
+// separate argument, the way the Dockerfile ENTRYPOINT instruction treats it.
+// Any other entry point is a single executable. Neither form is run through a
+// shell, so the arguments are never re-split or re-quoted.
+func entryPointCommand(entryPoint string) ([]string, error) {
+	if entryPoint == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(strings.TrimSpace(entryPoint), "[") {
+		return []string{entryPoint}, nil
+	}
+
+	var command []string
+	if err := json.Unmarshal([]byte(entryPoint), &command); err != nil {
+		return nil, errors.Wrapf(err, "invalid exec form entry point %s", entryPoint)
+	}
+	if len(command) == 0 || command[0] == "" {
+		return nil, fmt.Errorf("the exec form entry point %s has no executable", entryPoint)
+	}
+	return command, nil
+}
+
+// validateEntryPoint returns an error if the entry point of any of the
+// analysis's steps can't be turned into a command.
+func validateEntryPoint(job *model.Job) error {
+	for idx := range job.Steps {
+		if _, err := entryPointCommand(job.Steps[idx].Component.Container.EntryPoint); err != nil {
+			return common.ErrorResponse{
+				ErrorCode: "ERR_INVALID_ENTRYPOINT",
+				Message:   err.Error(),
+			}
 		}
 	}
+	return nil
+}
 
+// analysisVolumeMounts returns the volume mounts shared by the analysis
+// container and its sidecars: the working directory, the data store, shared
+// memory, and the CA certificates.
+func (i *Internal) analysisVolumeMounts(job *model.Job) []apiv1.VolumeMount {
 	volumeMounts := []apiv1.VolumeMount{}
 	if i.UseCSIDriver {
 		volumeMounts = append(volumeMounts, apiv1.VolumeMount{
@@ -473,6 +521,13 @@ func (i *Internal) defineAnalysisContainer(job *model.Job) apiv1.Container {
 			ReadOnly:  false,
 		})
 	}
+	volumeMounts = append(volumeMounts, i.caCertsVolumeMounts()...)
+
+	return volumeMounts
+}
+
+func (i *Internal) defineAnalysisContainer(job *model.Job, settings *ToolSettings, defaultEnv map[string]string) apiv1.Container {
+	analysisEnvironment := i.analysisEnvironment(job, defaultEnv)
 
 	analysisContainer := apiv1.Container{
 		Name: analysisContainerName,
@@ -482,16 +537,13 @@ func (i *Internal) defineAnalysisContainer(job *model.Job) apiv1.Container {
 			job.Steps[0].Component.Container.Image.Tag,
 		),
 		ImagePullPolicy: apiv1.PullPolicy(apiv1.PullAlways),
-		Env:             analysisEnvironment,
-		Resources: apiv1.ResourceRequirements{
-			Limits:   limits,
-			Requests: requests,
-		},
-		VolumeMounts: volumeMounts,
-		Ports:        analysisPorts(&job.Steps[0]),
+		Env:             append(analysisEnvironment, settings.sessionTokenEnv(job)...),
+		Resources:       analysisResources(job, settings),
+		VolumeMounts:    i.analysisVolumeMounts(job),
+		Ports:           analysisPorts(&job.Steps[0]),
 		SecurityContext: &apiv1.SecurityContext{
-			RunAsUser:  int64Ptr(int64(job.Steps[0].Component.Container.UID)),
-			RunAsGroup: int64Ptr(int64(job.Steps[0].Component.Container.UID)),
+			RunAsUser:  int64Ptr(settings.runAsUser(job)),
+			RunAsGroup: int64Ptr(settings.runAsGroup(job)),
 			// Capabilities: &apiv1.Capabilities{
 			// 	Drop: []apiv1.Capability{
 			// 		"SETPCAP",
@@ -506,26 +558,14 @@ func (i *Internal) defineAnalysisContainer(job *model.Job) apiv1.Container {
 			// 	},
 			// },
 		},
-		ReadinessProbe: &apiv1.Probe{
-			InitialDelaySeconds: 0,
-			TimeoutSeconds:      30,
-			SuccessThreshold:    1,
-			FailureThreshold:    10,
-			PeriodSeconds:       31,
-			ProbeHandler: apiv1.ProbeHandler{
-				HTTPGet: &apiv1.HTTPGetAction{
-					Port:   intstr.FromInt(job.Steps[0].Component.Container.Ports[0].ContainerPort),
-					Scheme: apiv1.URISchemeHTTP,
-					Path:   "/",
-				},
-			},
-		},
+		ReadinessProbe: settings.readinessProbe(job),
+		LivenessProbe:  settings.livenessProbe(job),
+		StartupProbe:   i.startupProbe(job, settings),
 	}
 
-	if job.Steps[0].Component.Container.EntryPoint != "" {
-		analysisContainer.Command = []string{
-			job.Steps[0].Component.Container.EntryPoint,
-		}
+	// The entry point was validated when the analysis was launched.
+	if command, err := entryPointCommand(job.Steps[0].Component.Container.EntryPoint); err == nil {
+		analysisContainer.Command = command
 	}
 
 	// Default to the container working directory if it isn't set.
@@ -543,13 +583,16 @@ func (i *Internal) defineAnalysisContainer(job *model.Job) apiv1.Container {
 
 // deploymentContainers returns the Containers needed for the VICE analysis
 // Deployment. It does not call the k8s API.
-func (i *Internal) deploymentContainers(job *model.Job) []apiv1.Container {
+func (i *Internal) deploymentContainers(job *model.Job, settings *ToolSettings, defaultEnv map[string]string) []apiv1.Container {
 	output := []apiv1.Container{}
 
 	output = append(output, apiv1.Container{
 		Name:            viceProxyContainerName,
 		Image:           i.ViceProxyImage,
-		Command:         i.viceProxyCommand(job),
+		Command:         i.viceProxyCommand(job, settings),
+		EnvFrom:         i.proxyCredentialsEnvFrom(job),
+		Env:             settings.sessionTokenProxyEnv(job),
+		VolumeMounts:    i.caCertsVolumeMounts(),
 		ImagePullPolicy: apiv1.PullPolicy(apiv1.PullAlways),
 		Ports: []apiv1.ContainerPort{
 			{
@@ -559,8 +602,8 @@ func (i *Internal) deploymentContainers(job *model.Job) []apiv1.Container {
 			},
 		},
 		SecurityContext: &apiv1.SecurityContext{
-			RunAsUser:  int64Ptr(int64(job.Steps[0].Component.Container.UID)),
-			RunAsGroup: int64Ptr(int64(job.Steps[0].Component.Container.UID)),
+			RunAsUser:  int64Ptr(settings.runAsUser(job)),
+			RunAsGroup: int64Ptr(settings.runAsGroup(job)),
 			Capabilities: &apiv1.Capabilities{
 				Drop: []apiv1.Capability{
 					"SETPCAP",
@@ -595,6 +638,7 @@ func (i *Internal) deploymentContainers(job *model.Job) []apiv1.Container {
 			ImagePullPolicy: apiv1.PullPolicy(apiv1.PullAlways),
 			WorkingDir:      inputPathListMountPath,
 			VolumeMounts:    i.fileTransfersVolumeMounts(job),
+			Lifecycle:       i.fileTransfersLifecycle(settings),
 			Ports: []apiv1.ContainerPort{
 				{
 					Name:          fileTransfersPortName,
@@ -603,8 +647,8 @@ func (i *Internal) deploymentContainers(job *model.Job) []apiv1.Container {
 				},
 			},
 			SecurityContext: &apiv1.SecurityContext{
-				RunAsUser:  int64Ptr(int64(job.Steps[0].Component.Container.UID)),
-				RunAsGroup: int64Ptr(int64(job.Steps[0].Component.Container.UID)),
+				RunAsUser:  int64Ptr(settings.runAsUser(job)),
+				RunAsGroup: int64Ptr(settings.runAsGroup(job)),
 				Capabilities: &apiv1.Capabilities{
 					Drop: []apiv1.Capability{
 						"SETPCAP",
@@ -633,30 +677,49 @@ func (i *Internal) deploymentContainers(job *model.Job) []apiv1.Container {
 		})
 	}
 
-	output = append(output, i.defineAnalysisContainer(job))
+	output = append(output, i.defineAnalysisContainer(job, settings, defaultEnv))
+	output = append(output, i.sidecarContainers(job, settings, defaultEnv)...)
 	return output
 }
 
-// imagePullSecrets creates an array of LocalObjectReference that refer to any
-// configured secrets to use for pulling images This is passed the job because
-// it may be advantageous, in the future, to add secrets depending on the
-// images actually needed by the job, but at present this uses a static value
-func (i *Internal) imagePullSecrets(_ *model.Job) []apiv1.LocalObjectReference {
+// imagePullSecrets creates an array of LocalObjectReference that refer to
+// the secrets to use for pulling the job's images: the secret used for every
+// analysis, if there is one, followed by the secrets for the registries the
+// job's images are in.
+func (i *Internal) imagePullSecrets(job *model.Job) []apiv1.LocalObjectReference {
+	refs := []apiv1.LocalObjectReference{}
 	if i.ImagePullSecretName != "" {
-		return []apiv1.LocalObjectReference{
-			{Name: i.ImagePullSecretName},
+		refs = append(refs, apiv1.LocalObjectReference{Name: i.ImagePullSecretName})
+	}
+	for _, name := range i.registryPullSecretNames(job) {
+		if name != i.ImagePullSecretName {
+			refs = append(refs, apiv1.LocalObjectReference{Name: name})
 		}
 	}
-	return []apiv1.LocalObjectReference{}
+	return refs
 }
 
 // getDeployment assembles and returns the Deployment for the VICE analysis. It does
 // not call the k8s API.
-func (i *Internal) getDeployment(ctx context.Context, job *model.Job) (*appsv1.Deployment, error) {
+func (i *Internal) getDeployment(ctx context.Context, job *model.Job, settings *ToolSettings) (*appsv1.Deployment, error) {
+	ctx, span := startResourceSpan(ctx, "getDeployment", "deployment")
+	defer span.End()
+
 	labels, err := i.labelsFromJob(ctx, job)
 	if err != nil {
 		return nil, err
 	}
+	i.addQueueLabel(labels)
+
+	defaultEnv, err := i.getDefaultEnvironment(ctx, job)
+	if err != nil {
+		return nil, err
+	}
+
+	preferredPlacement, err := i.placementAffinity(ctx, job.UserID)
+	if err != nil {
+		return nil, err
+	}
 
 	autoMount := false
 
@@ -682,7 +745,7 @@ func (i *Internal) getDeployment(ctx context.Context, job *model.Job) (*appsv1.D
 	}
 
 	// Add the tolerations and node selector requirements for jobs that require a GPU.
-	if gpuEnabled(job) {
+	if settings.needsGPU(job) {
 		tolerations = append(tolerations, apiv1.Toleration{
 			Key:      gpuTolerationKey,
 			Operator: apiv1.TolerationOperator(gpuTolerationOperator),
@@ -699,10 +762,16 @@ func (i *Internal) getDeployment(ctx context.Context, job *model.Job) (*appsv1.D
 		})
 	}
 
+	// Keep the analysis off of the nodes in spot node pools.
+	nodeSelectorRequirements = append(nodeSelectorRequirements, i.SpotNodes.nodeSelectorRequirements()...)
+
 	deployment := &appsv1.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:   job.InvocationID,
 			Labels: labels,
+			Annotations: map[string]string{
+				startupTimeoutAnnotation: i.startupTimeout(settings).String(),
+			},
 		},
 		Spec: appsv1.DeploymentSpec{
 			Replicas: int32Ptr(1),
@@ -716,17 +785,19 @@ func (i *Internal) getDeployment(ctx context.Context, job *model.Job) (*appsv1.D
 					Labels: labels,
 				},
 				Spec: apiv1.PodSpec{
-					Hostname:                     IngressName(job.UserID, job.InvocationID),
-					RestartPolicy:                apiv1.RestartPolicy("Always"),
-					Volumes:                      i.deploymentVolumes(job),
-					InitContainers:               i.initContainers(job),
-					Containers:                   i.deploymentContainers(job),
-					ImagePullSecrets:             i.imagePullSecrets(job),
-					AutomountServiceAccountToken: &autoMount,
+					Hostname:                      labels["subdomain"],
+					RestartPolicy:                 apiv1.RestartPolicy("Always"),
+					TerminationGracePeriodSeconds: i.terminationGracePeriodSeconds(settings),
+					Volumes:                       i.deploymentVolumes(job),
+					InitContainers:                i.initContainers(job, settings),
+					Containers:                    i.deploymentContainers(job, settings, defaultEnv),
+					ImagePullSecrets:              i.imagePullSecrets(job),
+					AutomountServiceAccountToken:  &autoMount,
 					SecurityContext: &apiv1.PodSecurityContext{
-						RunAsUser:  int64Ptr(int64(job.Steps[0].Component.Container.UID)),
-						RunAsGroup: int64Ptr(int64(job.Steps[0].Component.Container.UID)),
-						FSGroup:    int64Ptr(int64(job.Steps[0].Component.Container.UID)),
+						RunAsUser:          int64Ptr(settings.runAsUser(job)),
+						RunAsGroup:         int64Ptr(settings.runAsGroup(job)),
+						FSGroup:            int64Ptr(settings.runAsGroup(job)),
+						SupplementalGroups: settings.SupplementalGroups,
 					},
 					Tolerations: tolerations,
 					Affinity: &apiv1.Affinity{
@@ -738,6 +809,7 @@ func (i *Internal) getDeployment(ctx context.Context, job *model.Job) (*appsv1.D
 									},
 								},
 							},
+							PreferredDuringSchedulingIgnoredDuringExecution: preferredPlacement,
 						},
 					},
 				},
@@ -745,5 +817,13 @@ func (i *Internal) getDeployment(ctx context.Context, job *model.Job) (*appsv1.D
 		},
 	}
 
+	// Record the tool's time limit so that it can be enforced.
+	if timeLimit := toolTimeLimit(job); timeLimit > 0 {
+		deployment.Annotations[timeLimitAnnotation] = strconv.FormatInt(int64(timeLimit.Seconds()), 10)
+	}
+
+	// Pull the images from the cluster's registry mirrors.
+	i.rewriteImages(&deployment.Spec.Template.Spec)
+
 	return deployment, nil
 }
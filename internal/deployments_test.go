@@ -0,0 +1,57 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/cyverse-de/model/v6"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEntryPointCommand(t *testing.T) {
+	assert := assert.New(t)
+
+	command, err := entryPointCommand("")
+	assert.NoError(err)
+	assert.Nil(command)
+
+	// A plain entry point is a single executable, even if it has spaces.
+	command, err = entryPointCommand("/opt/my tool/run")
+	assert.NoError(err)
+	assert.Equal([]string{"/opt/my tool/run"}, command)
+
+	command, err = entryPointCommand(`["python", "-c", "print('a b')", "$HOME"]`)
+	assert.NoError(err)
+	assert.Equal([]string{"python", "-c", "print('a b')", "$HOME"}, command)
+
+	_, err = entryPointCommand(`["python", `)
+	assert.Error(err)
+	_, err = entryPointCommand(`[]`)
+	assert.Error(err)
+	_, err = entryPointCommand(`["", "-c"]`)
+	assert.Error(err)
+}
+
+func TestAnalysisContainerExecForm(t *testing.T) {
+	assert := assert.New(t)
+
+	i := &Internal{}
+	job := &model.Job{Steps: []model.Step{{}}}
+	container := &job.Steps[0].Component.Container
+	container.Ports = []model.Ports{{ContainerPort: 8888}}
+	container.EntryPoint = `["jupyter", "lab", "--ip=0.0.0.0"]`
+	job.Steps[0].Config.Params = []model.StepParam{
+		{Name: "--notebook-dir", Value: "/home/jovyan/my data", Order: 1},
+	}
+
+	assert.NoError(validateEntryPoint(job))
+	analysis := i.defineAnalysisContainer(job, &ToolSettings{}, nil)
+	assert.Equal([]string{"jupyter", "lab", "--ip=0.0.0.0"}, analysis.Command)
+	assert.Equal([]string{"--notebook-dir", "/home/jovyan/my data"}, analysis.Args)
+
+	container.EntryPoint = `["jupyter"`
+	err := validateEntryPoint(job)
+	if assert.Error(err) {
+		assert.Equal("ERR_INVALID_ENTRYPOINT", err.(common.ErrorResponse).ErrorCode)
+	}
+}
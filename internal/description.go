@@ -0,0 +1,124 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+
+	"github.com/cyverse-de/app-exposer/apps"
+	"github.com/cyverse-de/app-exposer/permissions"
+	"github.com/labstack/echo/v4"
+)
+
+// The app types reported in analysis descriptions.
+const (
+	interactiveAppType = "interactive"
+	batchAppType       = "batch"
+)
+
+// AnalysisDescription is the consolidated description of an analysis, for
+// both VICE and batch analyses.
+type AnalysisDescription struct {
+	AnalysisID string `json:"analysis_id"`
+	ExternalID string `json:"external_id,omitempty"`
+
+	// AppType is interactive for VICE analyses and batch for everything else.
+	AppType string `json:"app_type"`
+
+	// JobType is the job type recorded in the database, for example
+	// Interactive or DE.
+	JobType string `json:"job_type"`
+
+	// Status is the overall status of the analysis from the database.
+	Status string `json:"status"`
+
+	// Resources lists the k8s resources of a VICE analysis. It's omitted for
+	// batch analyses, since app-exposer doesn't manage their resources.
+	Resources *ResourceInfo `json:"resources,omitempty"`
+
+	// Transfers is the amount of data downloaded to and uploaded from a VICE
+	// analysis. It's omitted for batch analyses.
+	Transfers *TransferTotals `json:"transfers,omitempty"`
+}
+
+// describeAnalysis returns the consolidated description of the analysis.
+func (i *Internal) describeAnalysis(ctx context.Context, analysisID string) (*AnalysisDescription, error) {
+	summary, err := i.apps.GetAnalysisSummary(ctx, analysisID)
+	if err == sql.ErrNoRows {
+		return nil, echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("analysis %s not found", analysisID))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	description := &AnalysisDescription{
+		AnalysisID: analysisID,
+		ExternalID: summary.ExternalID,
+		AppType:    batchAppType,
+		JobType:    summary.JobType,
+		Status:     summary.Status,
+	}
+
+	if summary.JobType != apps.InteractiveJobType {
+		return description, nil
+	}
+	description.AppType = interactiveAppType
+
+	if summary.ExternalID == "" {
+		description.Resources = &ResourceInfo{}
+		return description, nil
+	}
+
+	description.Resources, err = i.doResourceListing(ctx, map[string]string{
+		"external-id": summary.ExternalID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	description.Transfers, err = i.getTransferTotals(ctx, summary.ExternalID)
+	if err != nil {
+		return nil, err
+	}
+
+	return description, nil
+}
+
+// AnalysisDescriptionHandler returns the consolidated description of the
+// analysis, so that the DE's analysis detail page only has to make one call
+// regardless of the type of the analysis. The user must have access to the
+// analysis.
+func (i *Internal) AnalysisDescriptionHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	analysisID := c.Param("analysis-id")
+	if analysisID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "analysis-id parameter is empty")
+	}
+
+	user := c.QueryParam("user")
+	if user == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "user query parameter must be set")
+	}
+
+	p := &permissions.Permissions{
+		BaseURL: i.PermissionsURL,
+	}
+
+	allowed, err := p.IsAllowed(ctx, user, analysisID)
+	if err != nil {
+		return err
+	}
+
+	if !allowed {
+		return echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("user %s cannot access analysis %s", user, analysisID))
+	}
+
+	description, err := i.describeAnalysis(ctx, analysisID)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, description)
+}
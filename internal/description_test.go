@@ -0,0 +1,125 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cyverse-de/app-exposer/apps"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newDescriptionTestInternal(t *testing.T) (*Internal, sqlmock.Sqlmock) {
+	mockdb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { mockdb.Close() })
+
+	db := sqlx.NewDb(mockdb, "sqlmock")
+	i := &Internal{
+		Init: Init{ViceNamespace: "vice-apps"},
+		clientset: fake.NewSimpleClientset(
+			warmTestDeployment("e1", "u1"),
+			warmTestDeployment("e2", "u1"),
+		),
+		db:   db,
+		apps: apps.NewApps(db, "@example.org"),
+	}
+
+	return i, mock
+}
+
+func expectAnalysisSummary(mock sqlmock.Sqlmock, analysisID, jobType, externalID, status string) {
+	mock.ExpectQuery(regexp.QuoteMeta("JOIN job_types t")).
+		WithArgs(analysisID).
+		WillReturnRows(sqlmock.NewRows([]string{"name", "external_id", "status"}).AddRow(jobType, externalID, status))
+}
+
+func TestDescribeAnalysis(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	i, mock := newDescriptionTestInternal(t)
+
+	// VICE analyses include their own k8s resources and the amount of data
+	// transferred for them.
+	expectAnalysisSummary(mock, "a1", apps.InteractiveJobType, "e1", "Running")
+	mock.ExpectQuery(regexp.QuoteMeta("FROM vice_transfer_sizes")).WithArgs("e1").
+		WillReturnRows(sqlmock.NewRows([]string{"kind", "bytes", "transfers"}).
+			AddRow(downloadKind, 1024, 1).
+			AddRow(uploadKind, 4096, 2))
+	description, err := i.describeAnalysis(ctx, "a1")
+	if assert.NoError(err) {
+		assert.Equal(interactiveAppType, description.AppType)
+		assert.Equal("Running", description.Status)
+		if assert.NotNil(description.Resources) && assert.Len(description.Resources.Deployments, 1) {
+			assert.Equal("e1", description.Resources.Deployments[0].ExternalID)
+		}
+		assert.Equal(&TransferTotals{BytesDownloaded: 1024, BytesUploaded: 4096, Downloads: 1, Uploads: 2}, description.Transfers)
+	}
+
+	// Batch analyses only have their status.
+	expectAnalysisSummary(mock, "a2", "DE", "", "Submitted")
+	description, err = i.describeAnalysis(ctx, "a2")
+	if assert.NoError(err) {
+		assert.Equal(batchAppType, description.AppType)
+		assert.Equal("DE", description.JobType)
+		assert.Nil(description.Resources)
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta("JOIN job_types t")).WithArgs("a3").WillReturnError(sql.ErrNoRows)
+	_, err = i.describeAnalysis(ctx, "a3")
+	if assert.Error(err) {
+		assert.Equal(http.StatusNotFound, err.(*echo.HTTPError).Code)
+	}
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestAnalysisDescriptionHandlerPermissions(t *testing.T) {
+	assert := assert.New(t)
+
+	permissionsServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/permissions/subjects/user/ipcdev/analysis/a1" {
+			w.Write([]byte(`{"permissions": [{"permission_level": "own"}]}`)) // nolint:errcheck
+			return
+		}
+		w.Write([]byte(`{"permissions": []}`)) // nolint:errcheck
+	}))
+	defer permissionsServer.Close()
+
+	i, mock := newDescriptionTestInternal(t)
+	i.PermissionsURL = permissionsServer.URL
+
+	newContext := func(user string) (echo.Context, *httptest.ResponseRecorder) {
+		req := httptest.NewRequest(http.MethodGet, "/?user="+user, nil)
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(req, rec)
+		c.SetParamNames("analysis-id")
+		c.SetParamValues("a1")
+		return c, rec
+	}
+
+	expectAnalysisSummary(mock, "a1", "DE", "", "Completed")
+	c, rec := newContext("ipcdev")
+	assert.NoError(i.AnalysisDescriptionHandler(c))
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Contains(rec.Body.String(), `"app_type":"batch"`)
+
+	c, _ = newContext("someone-else")
+	err := i.AnalysisDescriptionHandler(c)
+	if assert.Error(err) {
+		assert.Equal(http.StatusForbidden, err.(*echo.HTTPError).Code)
+	}
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
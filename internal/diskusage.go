@@ -0,0 +1,263 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+const (
+	// diskUsageTimeout limits how long du may run in the analysis pod.
+	diskUsageTimeout = 30 * time.Second
+
+	defaultDiskUsageWarningThreshold  = 0.8
+	defaultDiskUsageCriticalThreshold = 0.95
+)
+
+// The alert levels reported for working directory usage.
+const (
+	diskUsageOK       = "ok"
+	diskUsageWarning  = "warning"
+	diskUsageCritical = "critical"
+)
+
+// podExecFunc runs a command in a container and returns what it wrote to
+// stdout.
+type podExecFunc func(ctx context.Context, namespace, pod, container string, command []string) (string, error)
+
+// DiskUsage describes how much of the working directory volume an analysis is
+// using.
+type DiskUsage struct {
+	ExternalID     string  `json:"external_id"`
+	Path           string  `json:"path"`
+	UsedBytes      int64   `json:"used_bytes"`
+	CapacityBytes  int64   `json:"capacity_bytes"`
+	AvailableBytes int64   `json:"available_bytes"`
+	PercentUsed    float64 `json:"percent_used"`
+	Alert          string  `json:"alert"`
+}
+
+// execInPod runs a command in a container using the exec subresource.
+func (i *Internal) execInPod(ctx context.Context, namespace, pod, container string, command []string) (string, error) {
+	if i.RESTConfig == nil {
+		return "", errors.New("no Kubernetes client configuration is available for running commands in pods")
+	}
+
+	req := i.clientset.CoreV1().RESTClient().
+		Post().
+		Resource("pods").
+		Namespace(namespace).
+		Name(pod).
+		SubResource("exec").
+		VersionedParams(&apiv1.PodExecOptions{
+			Container: container,
+			Command:   command,
+			Stdout:    true,
+			Stderr:    true,
+		}, scheme.ParameterCodec)
+
+	executor, err := remotecommand.NewSPDYExecutor(i.RESTConfig, http.MethodPost, req.URL())
+	if err != nil {
+		return "", err
+	}
+
+	var stdout, stderr bytes.Buffer
+	if err = executor.StreamWithContext(ctx, remotecommand.StreamOptions{
+		Stdout: &stdout,
+		Stderr: &stderr,
+	}); err != nil {
+		return "", errors.Wrapf(err, "error running %s in %s/%s: %s", command[0], pod, container, stderr.String())
+	}
+
+	return stdout.String(), nil
+}
+
+// workingDirLocation returns the container that has the working directory
+// volume mounted and the path it's mounted at. The file transfer container
+// is used when the pod has one so that the analysis container's image doesn't
+// need to provide du and df.
+func workingDirLocation(pod *apiv1.Pod) (string, string, error) {
+	for _, container := range pod.Spec.Containers {
+		if container.Name != fileTransfersContainerName {
+			continue
+		}
+		for _, mount := range container.VolumeMounts {
+			if mount.Name == fileTransfersVolumeName {
+				return container.Name, mount.MountPath, nil
+			}
+		}
+	}
+
+	for _, container := range pod.Spec.Containers {
+		if container.Name != analysisContainerName {
+			continue
+		}
+		for _, mount := range container.VolumeMounts {
+			if mount.Name == workingDirVolumeName || mount.Name == fileTransfersVolumeName {
+				return container.Name, mount.MountPath, nil
+			}
+		}
+	}
+
+	return "", "", fmt.Errorf("pod %s does not mount a working directory", pod.Name)
+}
+
+// diskUsageCommand prints the size of the directory followed by the
+// filesystem statistics for the volume it's on, both in kilobytes. The path is
+// passed as a positional parameter so that it isn't interpreted by the shell.
+func diskUsageCommand(path string) []string {
+	return []string{"sh", "-c", `du -sk "$1" && df -Pk "$1"`, "sh", path}
+}
+
+// parseDiskUsage parses the output of diskUsageCommand.
+func parseDiskUsage(output string) (used, capacity, available int64, err error) {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) < 3 {
+		return 0, 0, 0, fmt.Errorf("unexpected disk usage output: %q", output)
+	}
+
+	duFields := strings.Fields(lines[0])
+	if len(duFields) < 1 {
+		return 0, 0, 0, fmt.Errorf("unexpected du output: %q", lines[0])
+	}
+	if used, err = strconv.ParseInt(duFields[0], 10, 64); err != nil {
+		return 0, 0, 0, errors.Wrap(err, "unable to parse the du output")
+	}
+
+	// The first line of the df output is a header.
+	dfFields := strings.Fields(lines[len(lines)-1])
+	if len(dfFields) < 4 {
+		return 0, 0, 0, fmt.Errorf("unexpected df output: %q", lines[len(lines)-1])
+	}
+	if capacity, err = strconv.ParseInt(dfFields[1], 10, 64); err != nil {
+		return 0, 0, 0, errors.Wrap(err, "unable to parse the df capacity")
+	}
+	if available, err = strconv.ParseInt(dfFields[3], 10, 64); err != nil {
+		return 0, 0, 0, errors.Wrap(err, "unable to parse the df available space")
+	}
+
+	return used * 1024, capacity * 1024, available * 1024, nil
+}
+
+// diskUsageAlert returns the alert level for the fraction of the volume in use.
+func (i *Internal) diskUsageAlert(fraction float64) string {
+	warning := i.DiskUsageWarningThreshold
+	if warning <= 0 {
+		warning = defaultDiskUsageWarningThreshold
+	}
+	critical := i.DiskUsageCriticalThreshold
+	if critical <= 0 {
+		critical = defaultDiskUsageCriticalThreshold
+	}
+
+	switch {
+	case fraction >= critical:
+		return diskUsageCritical
+	case fraction >= warning:
+		return diskUsageWarning
+	default:
+		return diskUsageOK
+	}
+}
+
+// runningAnalysisPod returns a running pod of the analysis. Returns a 404
+// error if the analysis doesn't have one.
+func (i *Internal) runningAnalysisPod(ctx context.Context, externalID string) (*apiv1.Pod, error) {
+	set := labels.Set(map[string]string{
+		"external-id": externalID,
+	})
+
+	podlist, err := i.clientset.CoreV1().Pods(i.ViceNamespace).List(ctx, metav1.ListOptions{
+		LabelSelector: set.AsSelector().String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for idx := range podlist.Items {
+		if podlist.Items[idx].Status.Phase == apiv1.PodRunning {
+			return &podlist.Items[idx], nil
+		}
+	}
+
+	return nil, echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("no running pod found for %s", externalID))
+}
+
+// getDiskUsage reports the working directory usage of the analysis.
+func (i *Internal) getDiskUsage(ctx context.Context, externalID string) (*DiskUsage, error) {
+	ctx, span := otel.Tracer(otelName).Start(ctx, "getDiskUsage")
+	defer span.End()
+
+	pod, err := i.runningAnalysisPod(ctx, externalID)
+	if err != nil {
+		return nil, err
+	}
+
+	container, path, err := workingDirLocation(pod)
+	if err != nil {
+		return nil, err
+	}
+
+	execCtx, cancel := context.WithTimeout(ctx, diskUsageTimeout)
+	defer cancel()
+
+	output, err := i.podExec(execCtx, pod.Namespace, pod.Name, container, diskUsageCommand(path))
+	if err != nil {
+		return nil, err
+	}
+
+	used, capacity, available, err := parseDiskUsage(output)
+	if err != nil {
+		return nil, err
+	}
+
+	usage := &DiskUsage{
+		ExternalID:     externalID,
+		Path:           path,
+		UsedBytes:      used,
+		CapacityBytes:  capacity,
+		AvailableBytes: available,
+	}
+
+	var fraction float64
+	if capacity > 0 {
+		fraction = float64(capacity-available) / float64(capacity)
+	}
+	usage.PercentUsed = fraction * 100
+	usage.Alert = i.diskUsageAlert(fraction)
+
+	if usage.Alert != diskUsageOK {
+		log.WithContext(ctx).Warnf("working directory for %s is %.1f%% full (%s)", externalID, usage.PercentUsed, usage.Alert)
+	}
+
+	return usage, nil
+}
+
+// DiskUsageHandler returns the working directory usage of a running
+// analysis, along with an alert level based on how full its volume is.
+func (i *Internal) DiskUsageHandler(c echo.Context) error {
+	id := c.Param("id")
+	if id == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "id parameter is empty")
+	}
+
+	usage, err := i.getDiskUsage(c.Request().Context(), id)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, usage)
+}
@@ -0,0 +1,126 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const testDiskUsageOutput = `1048576	/input-files
+Filesystem     1024-blocks    Used Available Capacity Mounted on
+/dev/sda1          2097152 1887437    209715      90% /input-files
+`
+
+func TestParseDiskUsage(t *testing.T) {
+	assert := assert.New(t)
+
+	used, capacity, available, err := parseDiskUsage(testDiskUsageOutput)
+	assert.NoError(err)
+	assert.Equal(int64(1048576*1024), used)
+	assert.Equal(int64(2097152*1024), capacity)
+	assert.Equal(int64(209715*1024), available)
+
+	_, _, _, err = parseDiskUsage("du: cannot access '/input-files'")
+	assert.Error(err)
+}
+
+func TestWorkingDirLocation(t *testing.T) {
+	assert := assert.New(t)
+
+	pod := &apiv1.Pod{
+		Spec: apiv1.PodSpec{
+			Containers: []apiv1.Container{
+				{
+					Name:         analysisContainerName,
+					VolumeMounts: []apiv1.VolumeMount{{Name: workingDirVolumeName, MountPath: "/de-app-work"}},
+				},
+			},
+		},
+	}
+
+	container, path, err := workingDirLocation(pod)
+	assert.NoError(err)
+	assert.Equal(analysisContainerName, container)
+	assert.Equal("/de-app-work", path)
+
+	pod.Spec.Containers = append(pod.Spec.Containers, apiv1.Container{
+		Name:         fileTransfersContainerName,
+		VolumeMounts: []apiv1.VolumeMount{{Name: fileTransfersVolumeName, MountPath: fileTransfersInputsMountPath}},
+	})
+
+	container, path, err = workingDirLocation(pod)
+	assert.NoError(err)
+	assert.Equal(fileTransfersContainerName, container, "the file transfer container should be preferred")
+	assert.Equal(fileTransfersInputsMountPath, path)
+
+	_, _, err = workingDirLocation(&apiv1.Pod{})
+	assert.Error(err)
+}
+
+func TestDiskUsageHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	pod := &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "analysis-pod",
+			Namespace: "vice-apps",
+			Labels:    map[string]string{"external-id": "ext-1"},
+		},
+		Spec: apiv1.PodSpec{
+			Containers: []apiv1.Container{
+				{
+					Name:         fileTransfersContainerName,
+					VolumeMounts: []apiv1.VolumeMount{{Name: fileTransfersVolumeName, MountPath: fileTransfersInputsMountPath}},
+				},
+			},
+		},
+		Status: apiv1.PodStatus{Phase: apiv1.PodRunning},
+	}
+
+	i := &Internal{
+		Init:      Init{ViceNamespace: "vice-apps"},
+		clientset: fake.NewSimpleClientset(pod),
+	}
+	i.podExec = func(_ context.Context, namespace, podName, container string, command []string) (string, error) {
+		assert.Equal("vice-apps", namespace)
+		assert.Equal("analysis-pod", podName)
+		assert.Equal(fileTransfersContainerName, container)
+		assert.Equal(fileTransfersInputsMountPath, command[len(command)-1])
+		return testDiskUsageOutput, nil
+	}
+
+	e := echo.New()
+	rec := httptest.NewRecorder()
+	c := e.NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+	c.SetParamNames("id")
+	c.SetParamValues("ext-1")
+
+	assert.NoError(i.DiskUsageHandler(c))
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Contains(rec.Body.String(), `"alert":"warning"`)
+
+	// Analyses without a running pod aren't found.
+	rec = httptest.NewRecorder()
+	c = e.NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+	c.SetParamNames("id")
+	c.SetParamValues("ext-2")
+
+	err := i.DiskUsageHandler(c)
+	httpErr, ok := err.(*echo.HTTPError)
+	assert.True(ok)
+	assert.Equal(http.StatusNotFound, httpErr.Code)
+}
+
+func TestDiskUsageAlert(t *testing.T) {
+	i := &Internal{}
+	assert.Equal(t, diskUsageOK, i.diskUsageAlert(0.5))
+	assert.Equal(t, diskUsageWarning, i.diskUsageAlert(0.85))
+	assert.Equal(t, diskUsageCritical, i.diskUsageAlert(0.99))
+}
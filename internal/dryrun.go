@@ -0,0 +1,272 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/cyverse-de/model/v6"
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// dryRunFieldManager is the field manager used for the server-side apply dry
+// runs.
+const dryRunFieldManager = "app-exposer"
+
+// dryRunResource is a resource generated for an analysis, along with the
+// function that sends a server-side apply patch for it to the cluster.
+type dryRunResource struct {
+	apiVersion string
+	kind       string
+	name       string
+	object     interface{}
+	patch      func(ctx context.Context, name string, data []byte, opts metav1.PatchOptions) error
+}
+
+// applyPatchData returns the body of a server-side apply patch for the
+// object. The generated objects don't set their type, which apply patches
+// need.
+func applyPatchData(resource *dryRunResource) ([]byte, error) {
+	data, err := json.Marshal(resource.object)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := map[string]interface{}{}
+	if err = json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	fields["apiVersion"] = resource.apiVersion
+	fields["kind"] = resource.kind
+	delete(fields, "status")
+
+	return json.Marshal(fields)
+}
+
+// dryRunResources returns the resources that would be created for the
+// analysis.
+func (i *Internal) dryRunResources(ctx context.Context, job *model.Job, deployment *appsv1.Deployment, settings *ToolSettings) ([]*dryRunResource, error) {
+	core := i.clientset.CoreV1()
+	resources := []*dryRunResource{}
+
+	add := func(apiVersion, kind, name string, object interface{}, patch func(context.Context, string, []byte, metav1.PatchOptions) error) {
+		resources = append(resources, &dryRunResource{
+			apiVersion: apiVersion,
+			kind:       kind,
+			name:       name,
+			object:     object,
+			patch:      patch,
+		})
+	}
+
+	configMapPatch := func(ctx context.Context, name string, data []byte, opts metav1.PatchOptions) error {
+		_, err := core.ConfigMaps(i.ViceNamespace).Patch(ctx, name, types.ApplyPatchType, data, opts)
+		return err
+	}
+
+	excludes, err := i.excludesConfigMap(ctx, job)
+	if err != nil {
+		return nil, err
+	}
+	add("v1", "ConfigMap", excludes.Name, excludes, configMapPatch)
+
+	inputs, err := i.inputPathListConfigMap(ctx, job)
+	if err != nil {
+		return nil, err
+	}
+	add("v1", "ConfigMap", inputs.Name, inputs, configMapPatch)
+
+	secret, err := i.proxyCredentialsSecret(ctx, job)
+	if err != nil {
+		return nil, err
+	}
+	secretPatch := func(ctx context.Context, name string, data []byte, opts metav1.PatchOptions) error {
+		_, err := core.Secrets(i.ViceNamespace).Patch(ctx, name, types.ApplyPatchType, data, opts)
+		return err
+	}
+	if secret != nil {
+		add("v1", "Secret", secret.Name, secret, secretPatch)
+	}
+
+	tokenSecret, err := i.sessionTokenSecret(ctx, job, settings)
+	if err != nil {
+		return nil, err
+	}
+	if tokenSecret != nil {
+		add("v1", "Secret", tokenSecret.Name, tokenSecret, secretPatch)
+	}
+
+	add("apps/v1", "Deployment", deployment.Name, deployment, func(ctx context.Context, name string, data []byte, opts metav1.PatchOptions) error {
+		_, err := i.clientset.AppsV1().Deployments(i.ViceNamespace).Patch(ctx, name, types.ApplyPatchType, data, opts)
+		return err
+	})
+
+	volumes, err := i.getPersistentVolumes(ctx, job, settings)
+	if err != nil {
+		return nil, err
+	}
+	for _, volume := range volumes {
+		add("v1", "PersistentVolume", volume.Name, volume, func(ctx context.Context, name string, data []byte, opts metav1.PatchOptions) error {
+			_, err := core.PersistentVolumes().Patch(ctx, name, types.ApplyPatchType, data, opts)
+			return err
+		})
+	}
+
+	claims, err := i.getPersistentVolumeClaims(ctx, job)
+	if err != nil {
+		return nil, err
+	}
+	for _, claim := range claims {
+		add("v1", "PersistentVolumeClaim", claim.Name, claim, func(ctx context.Context, name string, data []byte, opts metav1.PatchOptions) error {
+			_, err := core.PersistentVolumeClaims(i.ViceNamespace).Patch(ctx, name, types.ApplyPatchType, data, opts)
+			return err
+		})
+	}
+
+	svc, err := i.getService(ctx, job, settings)
+	if err != nil {
+		return nil, err
+	}
+	add("v1", "Service", svc.Name, svc, func(ctx context.Context, name string, data []byte, opts metav1.PatchOptions) error {
+		_, err := core.Services(i.ViceNamespace).Patch(ctx, name, types.ApplyPatchType, data, opts)
+		return err
+	})
+
+	ingress, err := i.getIngress(ctx, job, svc, settings, i.IngressClass)
+	if err != nil {
+		return nil, err
+	}
+	add("networking.k8s.io/v1", "Ingress", ingress.Name, ingress, func(ctx context.Context, name string, data []byte, opts metav1.PatchOptions) error {
+		_, err := i.clientset.NetworkingV1().Ingresses(i.ViceNamespace).Patch(ctx, name, types.ApplyPatchType, data, opts)
+		return err
+	})
+
+	pdb, err := i.getPodDisruptionBudget(ctx, job, settings)
+	if err != nil {
+		return nil, err
+	}
+	if pdb != nil {
+		add("policy/v1", "PodDisruptionBudget", pdb.Name, pdb, func(ctx context.Context, name string, data []byte, opts metav1.PatchOptions) error {
+			_, err := i.clientset.PolicyV1().PodDisruptionBudgets(i.ViceNamespace).Patch(ctx, name, types.ApplyPatchType, data, opts)
+			return err
+		})
+	}
+
+	policy, err := i.getEgressNetworkPolicy(ctx, job, settings)
+	if err != nil {
+		return nil, err
+	}
+	if policy != nil {
+		add("networking.k8s.io/v1", "NetworkPolicy", policy.Name, policy, func(ctx context.Context, name string, data []byte, opts metav1.PatchOptions) error {
+			_, err := i.clientset.NetworkingV1().NetworkPolicies(i.ViceNamespace).Patch(ctx, name, types.ApplyPatchType, data, opts)
+			return err
+		})
+	}
+
+	return resources, nil
+}
+
+// dryRunError converts an error returned by a dry run into a launch error if
+// the cluster rejected the resource, rather than failing to process the
+// request.
+func dryRunError(kind, name string, err error) error {
+	if !apierrors.IsInvalid(err) && !apierrors.IsForbidden(err) && !apierrors.IsBadRequest(err) {
+		return errors.Wrapf(err, "error validating %s %s", kind, name)
+	}
+
+	status := apierrors.APIStatus(nil)
+	if !errors.As(err, &status) {
+		return errors.Wrapf(err, "error validating %s %s", kind, name)
+	}
+
+	causes := []string{}
+	if details := status.Status().Details; details != nil {
+		for _, cause := range details.Causes {
+			if cause.Field != "" {
+				causes = append(causes, fmt.Sprintf("%s: %s", cause.Field, cause.Message))
+			} else {
+				causes = append(causes, cause.Message)
+			}
+		}
+	}
+
+	return common.ErrorResponse{
+		ErrorCode: "ERR_RESOURCE_REJECTED",
+		Message:   fmt.Sprintf("the cluster rejected the analysis's %s %s: %s", kind, name, status.Status().Message),
+		Details: &map[string]interface{}{
+			"kind":   kind,
+			"name":   name,
+			"reason": string(status.Status().Reason),
+			"causes": causes,
+		},
+	}
+}
+
+// dryRunPod creates a pod from the Deployment's pod template with dryRun=All.
+// Pod security admission only warns about Deployments, so this is what
+// catches pods it would reject.
+func (i *Internal) dryRunPod(ctx context.Context, deployment *appsv1.Deployment) error {
+	template := deployment.Spec.Template
+	pod := &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: deployment.Name + "-",
+			Labels:       template.Labels,
+			Annotations:  template.Annotations,
+		},
+		Spec: template.Spec,
+	}
+
+	_, err := i.clientset.CoreV1().Pods(i.ViceNamespace).Create(ctx, pod, metav1.CreateOptions{
+		DryRun:          []string{metav1.DryRunAll},
+		FieldValidation: metav1.FieldValidationStrict,
+	})
+	if err != nil {
+		return dryRunError("Pod", pod.GenerateName, err)
+	}
+	return nil
+}
+
+// dryRunLaunch sends the resources generated for the analysis to the cluster
+// as server-side apply patches with dryRun=All, so that schema validation and
+// admission errors, such as unknown fields on older clusters or pod security
+// denials, are returned before anything is created. Does nothing unless the
+// launch dry run is enabled.
+func (i *Internal) dryRunLaunch(ctx context.Context, job *model.Job, deployment *appsv1.Deployment, settings *ToolSettings) (err error) {
+	if !i.LaunchDryRun {
+		return nil
+	}
+
+	ctx, span := startSpan(ctx, "dryRunLaunch")
+	defer func() { endSpan(span, err) }()
+
+	resources, err := i.dryRunResources(ctx, job, deployment, settings)
+	if err != nil {
+		return err
+	}
+
+	force := true
+	opts := metav1.PatchOptions{
+		DryRun:          []string{metav1.DryRunAll},
+		Force:           &force,
+		FieldManager:    dryRunFieldManager,
+		FieldValidation: metav1.FieldValidationStrict,
+	}
+
+	for _, resource := range resources {
+		data, err := applyPatchData(resource)
+		if err != nil {
+			return errors.Wrapf(err, "error encoding %s %s", resource.kind, resource.name)
+		}
+		if err = resource.patch(ctx, resource.name, data, opts); err != nil {
+			return dryRunError(resource.kind, resource.name, err)
+		}
+	}
+
+	return i.dryRunPod(ctx, deployment)
+}
@@ -0,0 +1,144 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/cyverse-de/model/v6"
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func dryRunTestJob() (*model.Job, *appsv1.Deployment) {
+	job := &model.Job{InvocationID: "e1", UserID: "u1", Name: "analysis"}
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "e1"},
+		Spec: appsv1.DeploymentSpec{
+			Template: apiv1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"external-id": "e1"}},
+				Spec: apiv1.PodSpec{
+					Containers: []apiv1.Container{{Name: "analysis", Image: "jupyter"}},
+				},
+			},
+		},
+	}
+	return job, deployment
+}
+
+func TestDryRunLaunch(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock, clientset := newLaunchTestInternal(t)
+	i.LaunchDryRun = true
+	expectUserIP(mock)
+	patched := []string{}
+	clientset.PrependReactor("patch", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patch := action.(k8stesting.PatchActionImpl)
+		assert.Equal(types.ApplyPatchType, patch.PatchType)
+
+		var body map[string]interface{}
+		assert.NoError(json.Unmarshal(patch.Patch, &body))
+		patched = append(patched, body["kind"].(string)+"/"+patch.Name)
+		return true, nil, nil
+	})
+	clientset.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, nil
+	})
+
+	job, deployment := dryRunTestJob()
+	assert.NoError(i.dryRunLaunch(context.Background(), job, deployment, &ToolSettings{}))
+	assert.Equal([]string{
+		"ConfigMap/excludes-file-e1",
+		"ConfigMap/input-path-list-e1",
+		"Secret/" + proxyCredentialsSecretName(job),
+		"Deployment/e1",
+		"Service/vice-e1",
+		"Ingress/e1",
+	}, patched)
+
+	// Nothing is created by the dry run.
+	for _, action := range clientset.Actions() {
+		if action.GetVerb() == "create" {
+			assert.Equal("pods", action.GetResource().Resource)
+		}
+	}
+
+	// Nothing is sent to the cluster when the dry run is disabled.
+	i.LaunchDryRun = false
+	clientset.ClearActions()
+	assert.NoError(i.dryRunLaunch(context.Background(), job, deployment, &ToolSettings{}))
+	assert.Empty(clientset.Actions())
+}
+
+func TestDryRunLaunchRejected(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock, clientset := newLaunchTestInternal(t)
+	i.LaunchDryRun = true
+	expectUserIP(mock)
+	clientset.PrependReactor("patch", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetResource().Resource != "deployments" {
+			return true, nil, nil
+		}
+		return true, nil, apierrors.NewInvalid(
+			schema.GroupKind{Group: "apps", Kind: "Deployment"},
+			"e1",
+			field.ErrorList{field.Forbidden(field.NewPath("spec", "template", "spec", "hostUsers"), "unknown field")},
+		)
+	})
+
+	job, deployment := dryRunTestJob()
+	err := i.dryRunLaunch(context.Background(), job, deployment, &ToolSettings{})
+	if assert.Error(err) {
+		response, ok := err.(common.ErrorResponse)
+		if assert.True(ok) {
+			assert.Equal("ERR_RESOURCE_REJECTED", response.ErrorCode)
+			assert.Equal("Deployment", (*response.Details)["kind"])
+			assert.Equal(string(metav1.StatusReasonInvalid), (*response.Details)["reason"])
+			assert.Len((*response.Details)["causes"], 1)
+		}
+	}
+}
+
+func TestDryRunPodForbidden(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock, clientset := newLaunchTestInternal(t)
+	i.LaunchDryRun = true
+	expectUserIP(mock)
+	clientset.PrependReactor("patch", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, nil
+	})
+	clientset.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewForbidden(
+			schema.GroupResource{Resource: "pods"},
+			"e1-",
+			errors.New(`violates PodSecurity "restricted:latest": allowPrivilegeEscalation != false`),
+		)
+	})
+
+	job, deployment := dryRunTestJob()
+	err := i.dryRunLaunch(context.Background(), job, deployment, &ToolSettings{})
+	if assert.Error(err) {
+		response, ok := err.(common.ErrorResponse)
+		if assert.True(ok) {
+			assert.Equal("Pod", (*response.Details)["kind"])
+			assert.Contains(response.Message, "PodSecurity")
+		}
+	}
+
+	// Other failures aren't reported as rejected resources.
+	_, ok := dryRunError("Pod", "e1-", apierrors.NewServiceUnavailable("down")).(common.ErrorResponse)
+	assert.False(ok)
+}
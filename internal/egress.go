@@ -0,0 +1,552 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cyverse-de/model/v6"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	apiv1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// The egress profiles that may be selected for a tool.
+const (
+	// EgressNone only allows access to DNS and the DE services the analysis
+	// pod needs.
+	EgressNone = "none"
+
+	// EgressDatastoreOnly also allows access to the data store.
+	EgressDatastoreOnly = "datastore-only"
+
+	// EgressAllowlist also allows access to the CIDRs and hosts listed in the
+	// tool settings.
+	EgressAllowlist = "allowlist"
+
+	// EgressUnrestricted doesn't limit egress. Integrators have to get an
+	// administrator's approval to use it.
+	EgressUnrestricted = "unrestricted"
+)
+
+// The states of an egress request.
+const (
+	egressRequestPending  = "pending"
+	egressRequestApproved = "approved"
+	egressRequestDenied   = "denied"
+)
+
+// EgressConfig contains the service-wide egress settings.
+type EgressConfig struct {
+	// DefaultProfile is used for tools that don't have an egress profile.
+	DefaultProfile string
+
+	// PlatformCIDRs are the networks every analysis pod must be able to
+	// reach, such as the ones hosting Keycloak.
+	PlatformCIDRs []string
+
+	// DatastoreCIDRs are the networks hosting the data store.
+	DatastoreCIDRs []string
+}
+
+// Validate returns an error if the default profile or the CIDRs are invalid.
+func (c *EgressConfig) Validate() error {
+	if c.DefaultProfile != "" && !validEgressProfile(c.DefaultProfile) {
+		return fmt.Errorf("unknown default egress profile %q", c.DefaultProfile)
+	}
+	if c.DefaultProfile == EgressAllowlist {
+		return fmt.Errorf("the default egress profile can't be %s", EgressAllowlist)
+	}
+	for _, cidr := range append(append([]string{}, c.PlatformCIDRs...), c.DatastoreCIDRs...) {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return errors.Wrapf(err, "invalid egress CIDR %q", cidr)
+		}
+	}
+	return nil
+}
+
+// lookupIPAddr resolves the hosts in egress allowlists. It's a variable so
+// that the tests can replace it.
+var lookupIPAddr = net.DefaultResolver.LookupIPAddr
+
+// validEgressProfile returns true if the profile is one of the known profiles.
+func validEgressProfile(profile string) bool {
+	switch profile {
+	case EgressNone, EgressDatastoreOnly, EgressAllowlist, EgressUnrestricted:
+		return true
+	default:
+		return false
+	}
+}
+
+// validateEgress returns an error if the egress profile or allowlist are
+// invalid. Each allowlist entry must be a CIDR or a host name.
+func validateEgress(profile string, allowlist []string) error {
+	if profile != "" && !validEgressProfile(profile) {
+		return fmt.Errorf("unknown egress profile %q", profile)
+	}
+	if len(allowlist) > 0 && profile != EgressAllowlist {
+		return fmt.Errorf("an egress allowlist may only be used with the %s profile", EgressAllowlist)
+	}
+	for _, entry := range allowlist {
+		if _, _, err := net.ParseCIDR(entry); err == nil {
+			continue
+		}
+		if errs := validation.IsDNS1123Subdomain(entry); len(errs) > 0 {
+			return fmt.Errorf("egress allowlist entry %q is neither a CIDR nor a host name", entry)
+		}
+	}
+	return nil
+}
+
+// egressProfile returns the egress profile for the tool.
+func (i *Internal) egressProfile(settings *ToolSettings) string {
+	if settings.EgressProfile != "" {
+		return settings.EgressProfile
+	}
+	if i.Egress.DefaultProfile != "" {
+		return i.Egress.DefaultProfile
+	}
+	return EgressUnrestricted
+}
+
+// egressNetworkPolicyName returns the name of the NetworkPolicy that limits
+// the analysis's egress.
+func egressNetworkPolicyName(job *model.Job) string {
+	return fmt.Sprintf("vice-egress-%s", job.InvocationID)
+}
+
+// resolveAllowlist converts the allowlist entries to CIDRs. Host names are
+// resolved when the analysis launches, so the NetworkPolicy won't follow
+// changes to their addresses.
+func resolveAllowlist(ctx context.Context, allowlist []string) ([]string, error) {
+	cidrs := []string{}
+	for _, entry := range allowlist {
+		if _, _, err := net.ParseCIDR(entry); err == nil {
+			cidrs = append(cidrs, entry)
+			continue
+		}
+
+		addrs, err := lookupIPAddr(ctx, entry)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to resolve egress allowlist host %s", entry)
+		}
+		for _, addr := range addrs {
+			if addr.IP.To4() != nil {
+				cidrs = append(cidrs, fmt.Sprintf("%s/32", addr.IP))
+			} else {
+				cidrs = append(cidrs, fmt.Sprintf("%s/128", addr.IP))
+			}
+		}
+	}
+	return cidrs, nil
+}
+
+// egressCIDRs returns the networks the analysis may reach with the profile.
+func (i *Internal) egressCIDRs(ctx context.Context, profile string, settings *ToolSettings) ([]string, error) {
+	cidrs := append([]string{}, i.Egress.PlatformCIDRs...)
+
+	// The file transfers container needs the data store when the CSI driver
+	// isn't used, whatever the profile.
+	if profile != EgressNone || !i.UseCSIDriver {
+		cidrs = append(cidrs, i.Egress.DatastoreCIDRs...)
+	}
+
+	if profile == EgressAllowlist {
+		allowed, err := resolveAllowlist(ctx, settings.EgressAllowlist)
+		if err != nil {
+			return nil, err
+		}
+		cidrs = append(cidrs, allowed...)
+	}
+
+	return cidrs, nil
+}
+
+// getEgressNetworkPolicy returns the NetworkPolicy that limits the analysis's
+// egress, or nil if the analysis's egress is unrestricted. This does NOT call
+// the k8s API to actually create the NetworkPolicy.
+func (i *Internal) getEgressNetworkPolicy(ctx context.Context, job *model.Job, settings *ToolSettings) (*netv1.NetworkPolicy, error) {
+	profile := i.egressProfile(settings)
+	if profile == EgressUnrestricted {
+		return nil, nil
+	}
+
+	labels, err := i.labelsFromJob(ctx, job)
+	if err != nil {
+		return nil, err
+	}
+
+	cidrs, err := i.egressCIDRs(ctx, profile, settings)
+	if err != nil {
+		return nil, err
+	}
+
+	udp := apiv1.ProtocolUDP
+	tcp := apiv1.ProtocolTCP
+	dnsPort := intstr.FromInt(53)
+
+	rules := []netv1.NetworkPolicyEgressRule{
+		{
+			Ports: []netv1.NetworkPolicyPort{
+				{Protocol: &udp, Port: &dnsPort},
+				{Protocol: &tcp, Port: &dnsPort},
+			},
+		},
+	}
+
+	if len(cidrs) > 0 {
+		peers := make([]netv1.NetworkPolicyPeer, len(cidrs))
+		for idx, cidr := range cidrs {
+			peers[idx] = netv1.NetworkPolicyPeer{IPBlock: &netv1.IPBlock{CIDR: cidr}}
+		}
+		rules = append(rules, netv1.NetworkPolicyEgressRule{To: peers})
+	}
+
+	return &netv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   egressNetworkPolicyName(job),
+			Labels: labels,
+		},
+		Spec: netv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{
+				MatchLabels: map[string]string{
+					"external-id": job.InvocationID,
+				},
+			},
+			PolicyTypes: []netv1.PolicyType{netv1.PolicyTypeEgress},
+			Egress:      rules,
+		},
+	}, nil
+}
+
+// UpsertEgressNetworkPolicy uses the Job passed in to assemble the
+// NetworkPolicy limiting the analysis's egress. It then calls the k8s API to
+// create the NetworkPolicy if it does not already exist or to update it if it
+// does. Nothing is created if the analysis's egress is unrestricted.
+func (i *Internal) UpsertEgressNetworkPolicy(ctx context.Context, job *model.Job, settings *ToolSettings) (err error) {
+	ctx, span := startResourceSpan(ctx, "UpsertEgressNetworkPolicy", "networkpolicy")
+	defer func() { recordUpsertError("networkpolicy", err); endSpan(span, err) }()
+
+	policy, err := i.getEgressNetworkPolicy(ctx, job, settings)
+	if err != nil {
+		return err
+	}
+	if policy == nil {
+		return nil
+	}
+
+	npclient := i.clientset.NetworkingV1().NetworkPolicies(i.ViceNamespace)
+
+	existing, err := npclient.Get(ctx, policy.Name, metav1.GetOptions{})
+	if err != nil {
+		_, err = npclient.Create(ctx, policy, metav1.CreateOptions{})
+		if err != nil {
+			return err
+		}
+	} else {
+		policy.ResourceVersion = existing.ResourceVersion
+		_, err = npclient.Update(ctx, policy, metav1.UpdateOptions{})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// EgressRequest is a request from a tool integrator to change the egress
+// profile of a tool.
+type EgressRequest struct {
+	ID            string     `json:"id" db:"id"`
+	ToolID        string     `json:"tool_id" db:"tool_id"`
+	Profile       string     `json:"profile" db:"profile"`
+	Allowlist     []string   `json:"allowlist" db:"-"`
+	Justification string     `json:"justification" db:"justification"`
+	RequestedBy   string     `json:"requested_by" db:"requested_by"`
+	Status        string     `json:"status" db:"status"`
+	DecidedBy     *string    `json:"decided_by" db:"decided_by"`
+	CreatedAt     time.Time  `json:"created_at" db:"created_at"`
+	DecidedAt     *time.Time `json:"decided_at" db:"decided_at"`
+
+	// RawAllowlist is the allowlist as it's stored in the database.
+	RawAllowlist []byte `json:"-" db:"allowlist"`
+}
+
+const insertEgressRequestSQL = `
+	INSERT INTO vice_egress_requests (tool_id, profile, allowlist, justification, requested_by, status, decided_by, decided_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	RETURNING id, created_at
+`
+
+const listEgressRequestsSQL = `
+	SELECT id, tool_id, profile, allowlist, justification, requested_by, status, decided_by, created_at, decided_at
+	  FROM vice_egress_requests
+	 WHERE ($1 = '' OR status = $1)
+	 ORDER BY created_at
+`
+
+const getEgressRequestSQL = `
+	SELECT id, tool_id, profile, allowlist, justification, requested_by, status, decided_by, created_at, decided_at
+	  FROM vice_egress_requests
+	 WHERE id = $1
+`
+
+const decideEgressRequestSQL = `
+	UPDATE vice_egress_requests
+	   SET status = $2,
+	       decided_by = $3,
+	       decided_at = now()
+	 WHERE id = $1
+	   AND status = 'pending'
+`
+
+// mergeToolEgressSQL replaces the egress settings of a tool without changing
+// its other settings.
+const mergeToolEgressSQL = `
+	INSERT INTO vice_tool_settings (tool_id, settings)
+	VALUES ($1, $2)
+	ON CONFLICT (tool_id) DO UPDATE
+	   SET settings = (vice_tool_settings.settings - 'egress_profile' - 'egress_allowlist') || EXCLUDED.settings
+`
+
+// applyToolEgress sets the egress profile and allowlist of the tool.
+func (i *Internal) applyToolEgress(ctx context.Context, tx *sql.Tx, toolID, profile string, allowlist []string) error {
+	settings := map[string]interface{}{"egress_profile": profile}
+	if len(allowlist) > 0 {
+		settings["egress_allowlist"] = allowlist
+	}
+
+	raw, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+
+	if _, err = tx.ExecContext(ctx, mergeToolEgressSQL, toolID, raw); err != nil {
+		return errors.Wrapf(err, "error updating the egress settings for tool %s", toolID)
+	}
+
+	return nil
+}
+
+// RequestEgressHandler records a tool integrator's request to change the
+// egress profile of a tool. Profiles other than unrestricted are applied
+// right away. Requests for unrestricted egress wait for an administrator's
+// approval.
+func (i *Internal) RequestEgressHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	toolID := c.Param("tool-id")
+	if toolID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "tool-id parameter is empty")
+	}
+
+	user := c.QueryParam("user")
+	if user == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "user query parameter must be set")
+	}
+
+	req := &EgressRequest{}
+	if err := c.Bind(req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	if req.Profile == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "profile must be set")
+	}
+	if err := validateEgress(req.Profile, req.Allowlist); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if req.Profile == EgressUnrestricted && strings.TrimSpace(req.Justification) == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "a justification is required for unrestricted egress")
+	}
+
+	req.ToolID = toolID
+	req.RequestedBy = user
+	if req.Allowlist == nil {
+		req.Allowlist = []string{}
+	}
+
+	var (
+		decidedBy *string
+		decidedAt *time.Time
+		status    = egressRequestPending
+	)
+	if req.Profile != EgressUnrestricted {
+		now := time.Now()
+		status = egressRequestApproved
+		decidedBy = &user
+		decidedAt = &now
+	}
+	req.Status = status
+	req.DecidedBy = decidedBy
+	req.DecidedAt = decidedAt
+
+	allowlist, err := json.Marshal(req.Allowlist)
+	if err != nil {
+		return err
+	}
+
+	tx, err := i.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // nolint:errcheck
+
+	err = tx.QueryRowContext(
+		ctx,
+		insertEgressRequestSQL,
+		toolID,
+		req.Profile,
+		allowlist,
+		req.Justification,
+		user,
+		status,
+		decidedBy,
+		decidedAt,
+	).Scan(&req.ID, &req.CreatedAt)
+	if err != nil {
+		return errors.Wrapf(err, "error recording the egress request for tool %s", toolID)
+	}
+
+	if status == egressRequestApproved {
+		if err = i.applyToolEgress(ctx, tx, toolID, req.Profile, req.Allowlist); err != nil {
+			return err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	if status == egressRequestPending {
+		return c.JSON(http.StatusAccepted, req)
+	}
+	return c.JSON(http.StatusOK, req)
+}
+
+// parseAllowlists fills in the allowlists of the requests from the raw JSON.
+func parseAllowlists(requests []EgressRequest) error {
+	for idx := range requests {
+		requests[idx].Allowlist = []string{}
+		if len(requests[idx].RawAllowlist) == 0 {
+			continue
+		}
+		if err := json.Unmarshal(requests[idx].RawAllowlist, &requests[idx].Allowlist); err != nil {
+			return errors.Wrapf(err, "error parsing the allowlist of egress request %s", requests[idx].ID)
+		}
+	}
+	return nil
+}
+
+// AdminListEgressRequestsHandler lists the egress requests. Only pending
+// requests are listed unless the 'status' query parameter says otherwise; a
+// status of 'all' lists every request.
+func (i *Internal) AdminListEgressRequestsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	status := c.QueryParam("status")
+	switch status {
+	case "":
+		status = egressRequestPending
+	case "all":
+		status = ""
+	case egressRequestPending, egressRequestApproved, egressRequestDenied:
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("unknown status %q", status))
+	}
+
+	requests := []EgressRequest{}
+	if err := i.db.SelectContext(ctx, &requests, listEgressRequestsSQL, status); err != nil {
+		return err
+	}
+
+	if err := parseAllowlists(requests); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string][]EgressRequest{
+		"requests": requests,
+	})
+}
+
+// decideEgressRequest approves or denies a pending egress request. Approved
+// requests are applied to the tool's settings.
+func (i *Internal) decideEgressRequest(c echo.Context, status string) error {
+	ctx := c.Request().Context()
+
+	id := c.Param("id")
+	if id == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "id parameter is empty")
+	}
+
+	user := c.QueryParam("user")
+	if user == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "user query parameter must be set")
+	}
+
+	tx, err := i.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // nolint:errcheck
+
+	requests := []EgressRequest{}
+	if err = tx.SelectContext(ctx, &requests, getEgressRequestSQL, id); err != nil {
+		return err
+	}
+	if len(requests) == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("egress request %s not found", id))
+	}
+	if err = parseAllowlists(requests); err != nil {
+		return err
+	}
+	req := requests[0]
+
+	result, err := tx.ExecContext(ctx, decideEgressRequestSQL, id, status, user)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return echo.NewHTTPError(http.StatusConflict, fmt.Sprintf("egress request %s has already been %s", id, req.Status))
+	}
+
+	if status == egressRequestApproved {
+		if err = i.applyToolEgress(ctx, tx.Tx, req.ToolID, req.Profile, req.Allowlist); err != nil {
+			return err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	req.Status = status
+	req.DecidedBy = &user
+	req.DecidedAt = &now
+
+	return c.JSON(http.StatusOK, req)
+}
+
+// AdminApproveEgressRequestHandler approves a pending egress request and
+// applies it to the tool's settings.
+func (i *Internal) AdminApproveEgressRequestHandler(c echo.Context) error {
+	return i.decideEgressRequest(c, egressRequestApproved)
+}
+
+// AdminDenyEgressRequestHandler denies a pending egress request.
+func (i *Internal) AdminDenyEgressRequestHandler(c echo.Context) error {
+	return i.decideEgressRequest(c, egressRequestDenied)
+}
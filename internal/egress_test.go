@@ -0,0 +1,141 @@
+package internal
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cyverse-de/model/v6"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestValidateEgress(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(validateEgress("", nil))
+	assert.NoError(validateEgress(EgressNone, nil))
+	assert.NoError(validateEgress(EgressAllowlist, []string{"10.0.0.0/8", "data.example.org"}))
+	assert.Error(validateEgress("bogus", nil))
+	assert.Error(validateEgress(EgressNone, []string{"10.0.0.0/8"}))
+	assert.Error(validateEgress(EgressAllowlist, []string{"not a host"}))
+
+	assert.Error((&ToolSettings{EgressProfile: "bogus"}).Validate())
+}
+
+func TestEgressConfigValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError((&EgressConfig{}).Validate())
+	assert.NoError((&EgressConfig{DefaultProfile: EgressNone, PlatformCIDRs: []string{"10.1.0.0/16"}}).Validate())
+	assert.Error((&EgressConfig{DefaultProfile: EgressAllowlist}).Validate())
+	assert.Error((&EgressConfig{DatastoreCIDRs: []string{"10.1.0.0"}}).Validate())
+}
+
+func TestEgressCIDRs(t *testing.T) {
+	assert := assert.New(t)
+
+	origLookup := lookupIPAddr
+	defer func() { lookupIPAddr = origLookup }()
+	lookupIPAddr = func(_ context.Context, host string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: net.ParseIP("192.0.2.10")}, {IP: net.ParseIP("2001:db8::1")}}, nil
+	}
+
+	i := &Internal{Init: Init{
+		UseCSIDriver: true,
+		Egress: EgressConfig{
+			PlatformCIDRs:  []string{"10.1.0.0/16"},
+			DatastoreCIDRs: []string{"10.2.0.0/16"},
+		},
+	}}
+	ctx := context.Background()
+
+	cidrs, err := i.egressCIDRs(ctx, EgressNone, &ToolSettings{})
+	assert.NoError(err)
+	assert.Equal([]string{"10.1.0.0/16"}, cidrs)
+
+	cidrs, err = i.egressCIDRs(ctx, EgressDatastoreOnly, &ToolSettings{})
+	assert.NoError(err)
+	assert.Equal([]string{"10.1.0.0/16", "10.2.0.0/16"}, cidrs)
+
+	settings := &ToolSettings{EgressProfile: EgressAllowlist, EgressAllowlist: []string{"172.16.0.0/12", "data.example.org"}}
+	cidrs, err = i.egressCIDRs(ctx, EgressAllowlist, settings)
+	assert.NoError(err)
+	assert.Equal([]string{"10.1.0.0/16", "10.2.0.0/16", "172.16.0.0/12", "192.0.2.10/32", "2001:db8::1/128"}, cidrs)
+
+	// The file transfers container needs the data store without the CSI driver.
+	i.UseCSIDriver = false
+	cidrs, err = i.egressCIDRs(ctx, EgressNone, &ToolSettings{})
+	assert.NoError(err)
+	assert.Equal([]string{"10.1.0.0/16", "10.2.0.0/16"}, cidrs)
+}
+
+func TestEgressProfile(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(EgressUnrestricted, (&Internal{}).egressProfile(&ToolSettings{}))
+
+	i := &Internal{Init: Init{Egress: EgressConfig{DefaultProfile: EgressDatastoreOnly}}}
+	assert.Equal(EgressDatastoreOnly, i.egressProfile(&ToolSettings{}))
+	assert.Equal(EgressNone, i.egressProfile(&ToolSettings{EgressProfile: EgressNone}))
+}
+
+func TestUpsertEgressNetworkPolicyUnrestricted(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	i := &Internal{Init: Init{ViceNamespace: "vice-apps"}, clientset: clientset}
+
+	job := &model.Job{InvocationID: "a"}
+	assert.NoError(t, i.UpsertEgressNetworkPolicy(context.Background(), job, &ToolSettings{}))
+
+	policies, err := clientset.NetworkingV1().NetworkPolicies("vice-apps").List(context.Background(), metav1.ListOptions{})
+	assert.NoError(t, err)
+	assert.Empty(t, policies.Items)
+}
+
+func TestRequestEgressHandlerUnrestricted(t *testing.T) {
+	assert := assert.New(t)
+
+	mockdb, mock, err := sqlmock.New()
+	assert.NoError(err)
+	defer mockdb.Close()
+
+	i := &Internal{db: sqlx.NewDb(mockdb, "sqlmock")}
+
+	// Unrestricted egress waits for approval, so the tool settings aren't
+	// changed.
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("INSERT INTO vice_egress_requests")).
+		WithArgs("t1", EgressUnrestricted, []byte("[]"), "needs pypi", "ipcdev", egressRequestPending, nil, nil).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow("r1", time.Now()))
+	mock.ExpectCommit()
+
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodPost, "/?user=ipcdev", strings.NewReader(`{"profile":"unrestricted","justification":"needs pypi"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.SetParamNames("tool-id")
+	c.SetParamValues("t1")
+
+	assert.NoError(i.RequestEgressHandler(c))
+	assert.Equal(http.StatusAccepted, rec.Code)
+	assert.Contains(rec.Body.String(), `"status":"pending"`)
+	assert.NoError(mock.ExpectationsWereMet())
+
+	// A justification is required.
+	req = httptest.NewRequest(http.MethodPost, "/?user=ipcdev", strings.NewReader(`{"profile":"unrestricted"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	c = e.NewContext(req, httptest.NewRecorder())
+	c.SetParamNames("tool-id")
+	c.SetParamValues("t1")
+	assert.Error(i.RequestEgressHandler(c))
+}
@@ -0,0 +1,98 @@
+package internal
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// embeddingAnnotation is the ingress-nginx annotation used to set the headers
+// that control whether VICE apps may be embedded in other sites.
+const embeddingAnnotation = "nginx.ingress.kubernetes.io/configuration-snippet"
+
+// The keyword sources that may be used as frame ancestors.
+const (
+	frameAncestorsSelf = "'self'"
+	frameAncestorsNone = "'none'"
+)
+
+// frameAncestorRegexp matches the origins that may embed VICE apps, such as
+// https://canvas.example.edu or https://*.instructure.com. It's strict
+// because the origins end up in the ingress's nginx configuration.
+var frameAncestorRegexp = regexp.MustCompile(`^https://(\*\.)?[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?(\.[A-Za-z0-9]([A-Za-z0-9-]*[A-Za-z0-9])?)*(:[0-9]{1,5})?$`)
+
+// EmbeddingConfig contains the service-wide settings for embedding VICE apps
+// in other sites.
+type EmbeddingConfig struct {
+	// Enabled adds the framing headers to the analyses' ingresses. The
+	// ingress controller's defaults are used if it isn't set.
+	Enabled bool
+
+	// DefaultFrameAncestors are used for tools that don't list their own.
+	DefaultFrameAncestors []string
+}
+
+// Validate returns an error if the default frame ancestors are invalid.
+func (c *EmbeddingConfig) Validate() error {
+	return validateFrameAncestors(c.DefaultFrameAncestors)
+}
+
+// validateFrameAncestors returns an error if the sources can't be used in a
+// frame-ancestors directive. 'none' can't be combined with other sources.
+func validateFrameAncestors(ancestors []string) error {
+	for _, ancestor := range ancestors {
+		switch {
+		case ancestor == frameAncestorsNone && len(ancestors) > 1:
+			return fmt.Errorf("%s can't be combined with other frame ancestors", frameAncestorsNone)
+		case ancestor == frameAncestorsSelf || ancestor == frameAncestorsNone:
+		case !frameAncestorRegexp.MatchString(ancestor):
+			return fmt.Errorf("invalid frame ancestor %q; must be %s, %s, or an https origin", ancestor, frameAncestorsSelf, frameAncestorsNone)
+		}
+	}
+	return nil
+}
+
+// frameAncestors returns the sources that may embed the tool's analyses.
+func (i *Internal) frameAncestors(settings *ToolSettings) []string {
+	if len(settings.FrameAncestors) > 0 {
+		return settings.FrameAncestors
+	}
+	return i.reloadable().Embedding.DefaultFrameAncestors
+}
+
+// frameAncestorsSnippet returns the nginx configuration that sets the framing
+// headers. X-Frame-Options can't list other origins, so it's removed when
+// they're allowed and browsers that support CSP use frame-ancestors instead.
+func frameAncestorsSnippet(ancestors []string) string {
+	lines := []string{
+		fmt.Sprintf(`more_set_headers "Content-Security-Policy: frame-ancestors %s";`, strings.Join(ancestors, " ")),
+	}
+
+	switch {
+	case len(ancestors) == 1 && ancestors[0] == frameAncestorsNone:
+		lines = append(lines, `more_set_headers "X-Frame-Options: DENY";`)
+	case len(ancestors) == 1 && ancestors[0] == frameAncestorsSelf:
+		lines = append(lines, `more_set_headers "X-Frame-Options: SAMEORIGIN";`)
+	default:
+		lines = append(lines, `more_clear_headers "X-Frame-Options";`)
+	}
+
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// ingressAnnotations returns the annotations for the analysis's ingress, or
+// nil if it doesn't need any.
+func (i *Internal) ingressAnnotations(settings *ToolSettings) map[string]string {
+	if !i.reloadable().Embedding.Enabled {
+		return nil
+	}
+
+	ancestors := i.frameAncestors(settings)
+	if len(ancestors) == 0 {
+		return nil
+	}
+
+	return map[string]string{
+		embeddingAnnotation: frameAncestorsSnippet(ancestors),
+	}
+}
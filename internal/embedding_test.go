@@ -0,0 +1,51 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateFrameAncestors(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(validateFrameAncestors(nil))
+	assert.NoError(validateFrameAncestors([]string{"'none'"}))
+	assert.NoError(validateFrameAncestors([]string{"'self'", "https://canvas.example.edu", "https://*.instructure.com:8443"}))
+
+	assert.Error(validateFrameAncestors([]string{"'none'", "'self'"}))
+	assert.Error(validateFrameAncestors([]string{"http://canvas.example.edu"}))
+	assert.Error(validateFrameAncestors([]string{"*"}))
+	assert.Error(validateFrameAncestors([]string{"https://canvas.example.edu/course"}))
+	assert.Error(validateFrameAncestors([]string{`https://a.edu"; more_set_headers "X: y`}))
+	assert.Error(validateFrameAncestors([]string{"https://a.edu\nreturn 302"}))
+
+	assert.Error((&ToolSettings{FrameAncestors: []string{"self"}}).Validate())
+	assert.Error((&EmbeddingConfig{DefaultFrameAncestors: []string{"none"}}).Validate())
+}
+
+func TestIngressAnnotations(t *testing.T) {
+	assert := assert.New(t)
+
+	i := &Internal{Init: Init{Embedding: EmbeddingConfig{DefaultFrameAncestors: []string{"'self'"}}}}
+
+	// The ingress controller's defaults are used unless it's enabled.
+	assert.Nil(i.ingressAnnotations(&ToolSettings{}))
+
+	i.Embedding.Enabled = true
+	annotations := i.ingressAnnotations(&ToolSettings{})
+	assert.Equal(
+		"more_set_headers \"Content-Security-Policy: frame-ancestors 'self'\";\nmore_set_headers \"X-Frame-Options: SAMEORIGIN\";\n",
+		annotations[embeddingAnnotation],
+	)
+
+	annotations = i.ingressAnnotations(&ToolSettings{FrameAncestors: []string{"'self'", "https://canvas.example.edu"}})
+	assert.Contains(annotations[embeddingAnnotation], "frame-ancestors 'self' https://canvas.example.edu\";")
+	assert.Contains(annotations[embeddingAnnotation], `more_clear_headers "X-Frame-Options";`)
+
+	annotations = i.ingressAnnotations(&ToolSettings{FrameAncestors: []string{"'none'"}})
+	assert.Contains(annotations[embeddingAnnotation], "X-Frame-Options: DENY")
+
+	i.Embedding.DefaultFrameAncestors = nil
+	assert.Nil(i.ingressAnnotations(&ToolSettings{}))
+}
@@ -0,0 +1,262 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	apiv1 "k8s.io/api/core/v1"
+	resourcev1 "k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	defaultEphemeralStorageInterval  = time.Minute
+	defaultEphemeralStorageThreshold = 0.9
+)
+
+// nodeStatsSummary contains the parts of the kubelet's stats summary that the
+// ephemeral storage monitor needs.
+type nodeStatsSummary struct {
+	Pods []podStatsSummary `json:"pods"`
+}
+
+type podStatsSummary struct {
+	PodRef struct {
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+		UID       string `json:"uid"`
+	} `json:"podRef"`
+	Containers []containerStatsSummary `json:"containers"`
+}
+
+type containerStatsSummary struct {
+	Name   string        `json:"name"`
+	Rootfs *fsStatsUsage `json:"rootfs,omitempty"`
+	Logs   *fsStatsUsage `json:"logs,omitempty"`
+}
+
+type fsStatsUsage struct {
+	UsedBytes *uint64 `json:"usedBytes,omitempty"`
+}
+
+// ephemeralUsage returns the number of bytes of ephemeral storage used by the
+// container. The kubelet counts the container's writable layer and its logs
+// against its ephemeral storage limit.
+func (c *containerStatsSummary) ephemeralUsage() uint64 {
+	var used uint64
+	if c.Rootfs != nil && c.Rootfs.UsedBytes != nil {
+		used += *c.Rootfs.UsedBytes
+	}
+	if c.Logs != nil && c.Logs.UsedBytes != nil {
+		used += *c.Logs.UsedBytes
+	}
+	return used
+}
+
+// analysisEphemeralLimit returns the ephemeral storage limit of the pod's
+// analysis container and true, or false if it doesn't have one.
+func analysisEphemeralLimit(pod *apiv1.Pod) (resourcev1.Quantity, bool) {
+	for _, container := range pod.Spec.Containers {
+		if container.Name != analysisContainerName {
+			continue
+		}
+		limit, ok := container.Resources.Limits[apiv1.ResourceEphemeralStorage]
+		return limit, ok && !limit.IsZero()
+	}
+	return resourcev1.Quantity{}, false
+}
+
+// EphemeralStorageMonitor periodically compares the ephemeral storage used by
+// analysis containers to their limits and warns users whose analyses are about
+// to be evicted by the kubelet, so they have a chance to save their work.
+type EphemeralStorageMonitor struct {
+	internal  *Internal
+	interval  time.Duration
+	threshold float64
+
+	// fetchSummary returns the kubelet's stats summary for a node.
+	fetchSummary func(ctx context.Context, node string) (*nodeStatsSummary, error)
+
+	mu     sync.Mutex
+	warned map[types.UID]bool
+}
+
+// NewEphemeralStorageMonitor returns a new *EphemeralStorageMonitor.
+func NewEphemeralStorageMonitor(i *Internal) *EphemeralStorageMonitor {
+	m := &EphemeralStorageMonitor{
+		internal:  i,
+		interval:  i.EphemeralStorageInterval,
+		threshold: i.EphemeralStorageThreshold,
+		warned:    map[types.UID]bool{},
+	}
+	if m.interval <= 0 {
+		m.interval = defaultEphemeralStorageInterval
+	}
+	if m.threshold <= 0 || m.threshold > 1 {
+		m.threshold = defaultEphemeralStorageThreshold
+	}
+	m.fetchSummary = m.kubeletSummary
+	return m
+}
+
+// kubeletSummary fetches the stats summary for a node through the API
+// server's node proxy.
+func (m *EphemeralStorageMonitor) kubeletSummary(ctx context.Context, node string) (*nodeStatsSummary, error) {
+	raw, err := m.internal.clientset.CoreV1().RESTClient().
+		Get().
+		Resource("nodes").
+		Name(node).
+		SubResource("proxy").
+		Suffix("stats/summary").
+		DoRaw(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to get the stats summary for node %s", node)
+	}
+
+	summary := &nodeStatsSummary{}
+	if err = json.Unmarshal(raw, summary); err != nil {
+		return nil, errors.Wrapf(err, "unable to parse the stats summary for node %s", node)
+	}
+
+	return summary, nil
+}
+
+// warn lets the user know that the analysis is close to its limit.
+func (m *EphemeralStorageMonitor) warn(ctx context.Context, pod *apiv1.Pod, used uint64, limit resourcev1.Quantity) {
+	externalID := pod.Labels["external-id"]
+	usedQuantity := resourcev1.NewQuantity(int64(used), resourcev1.BinarySI)
+
+	log.WithContext(ctx).Warnf(
+		"analysis container in pod %s for %s is using %s of its %s ephemeral storage limit",
+		pod.Name,
+		externalID,
+		usedQuantity.String(),
+		limit.String(),
+	)
+
+	if externalID == "" {
+		return
+	}
+
+	msg := fmt.Sprintf(
+		"This analysis is using %s of its %s local storage limit. Move files into the working directory or save your work; the analysis will be stopped if it exceeds the limit.",
+		usedQuantity.String(),
+		limit.String(),
+	)
+	if err := m.internal.statusPublisher.Running(ctx, externalID, msg); err != nil {
+		log.WithContext(ctx).Error(err)
+	}
+}
+
+// check compares the usage of every analysis container that has a limit to
+// that limit. Users are only warned once each time their usage crosses the
+// threshold.
+func (m *EphemeralStorageMonitor) check(ctx context.Context) error {
+	ctx, span := otel.Tracer(otelName).Start(ctx, "EphemeralStorageMonitor.check")
+	defer span.End()
+
+	set := labels.Set(map[string]string{
+		"app-type": "interactive",
+	})
+
+	podlist, err := m.internal.clientset.CoreV1().Pods(m.internal.ViceNamespace).List(ctx, metav1.ListOptions{
+		LabelSelector: set.AsSelector().String(),
+	})
+	if err != nil {
+		return errors.Wrap(err, "unable to list the analysis pods")
+	}
+
+	// Only pods with a limit can be evicted for using too much storage.
+	podsByNode := map[string][]*apiv1.Pod{}
+	seen := map[types.UID]bool{}
+	for idx := range podlist.Items {
+		pod := &podlist.Items[idx]
+		seen[pod.UID] = true
+		if pod.Spec.NodeName == "" {
+			continue
+		}
+		if _, ok := analysisEphemeralLimit(pod); ok {
+			podsByNode[pod.Spec.NodeName] = append(podsByNode[pod.Spec.NodeName], pod)
+		}
+	}
+
+	m.mu.Lock()
+	for uid := range m.warned {
+		if !seen[uid] {
+			delete(m.warned, uid)
+		}
+	}
+	m.mu.Unlock()
+
+	for node, pods := range podsByNode {
+		summary, err := m.fetchSummary(ctx, node)
+		if err != nil {
+			log.WithContext(ctx).Error(err)
+			continue
+		}
+
+		usage := map[string]uint64{}
+		for _, podStats := range summary.Pods {
+			for _, containerStats := range podStats.Containers {
+				if containerStats.Name == analysisContainerName {
+					usage[podStats.PodRef.UID] = containerStats.ephemeralUsage()
+				}
+			}
+		}
+
+		for _, pod := range pods {
+			used, ok := usage[string(pod.UID)]
+			if !ok {
+				continue
+			}
+			limit, _ := analysisEphemeralLimit(pod)
+
+			nearLimit := float64(used) >= m.threshold*float64(limit.Value())
+
+			m.mu.Lock()
+			alreadyWarned := m.warned[pod.UID]
+			if nearLimit {
+				m.warned[pod.UID] = true
+			} else {
+				delete(m.warned, pod.UID)
+			}
+			m.mu.Unlock()
+
+			if nearLimit && !alreadyWarned {
+				m.warn(ctx, pod, used, limit)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Run checks the analysis pods periodically until the context is canceled.
+func (m *EphemeralStorageMonitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := m.check(ctx); err != nil {
+				log.WithContext(ctx).Error(err)
+			}
+		}
+	}
+}
+
+// RunEphemeralStorageMonitor starts checking the ephemeral storage usage of
+// analysis containers. Blocks until the context is canceled.
+func (i *Internal) RunEphemeralStorageMonitor(ctx context.Context) {
+	NewEphemeralStorageMonitor(i).Run(ctx)
+}
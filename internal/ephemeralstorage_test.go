@@ -0,0 +1,104 @@
+package internal
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cyverse-de/model/v6"
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	resourcev1 "k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func analysisPod(name, node, limit string) *apiv1.Pod {
+	pod := &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "vice-apps",
+			UID:       types.UID("uid-" + name),
+			Labels:    map[string]string{"app-type": "interactive"},
+		},
+		Spec: apiv1.PodSpec{
+			NodeName:   node,
+			Containers: []apiv1.Container{{Name: analysisContainerName}},
+		},
+	}
+	if limit != "" {
+		pod.Spec.Containers[0].Resources.Limits = apiv1.ResourceList{
+			apiv1.ResourceEphemeralStorage: resourcev1.MustParse(limit),
+		}
+	}
+	return pod
+}
+
+func summaryFor(usage map[string]uint64) *nodeStatsSummary {
+	summary := &nodeStatsSummary{}
+	for uid, used := range usage {
+		used := used
+		pod := podStatsSummary{
+			Containers: []containerStatsSummary{
+				{Name: analysisContainerName, Rootfs: &fsStatsUsage{UsedBytes: &used}},
+			},
+		}
+		pod.PodRef.UID = uid
+		summary.Pods = append(summary.Pods, pod)
+	}
+	return summary
+}
+
+func TestEphemeralStorageMonitorCheck(t *testing.T) {
+	assert := assert.New(t)
+
+	clientset := fake.NewSimpleClientset(
+		analysisPod("near", "node1", "1000"),
+		analysisPod("far", "node1", "1000"),
+		analysisPod("unlimited", "node1", ""),
+	)
+	i := &Internal{Init: Init{ViceNamespace: "vice-apps"}, clientset: clientset}
+
+	usage := map[string]uint64{
+		"uid-near":      950,
+		"uid-far":       100,
+		"uid-unlimited": 5000,
+	}
+
+	m := NewEphemeralStorageMonitor(i)
+	m.fetchSummary = func(_ context.Context, node string) (*nodeStatsSummary, error) {
+		assert.Equal("node1", node)
+		return summaryFor(usage), nil
+	}
+
+	assert.NoError(m.check(context.Background()))
+	assert.True(m.warned["uid-near"])
+	assert.False(m.warned["uid-far"])
+	assert.False(m.warned["uid-unlimited"], "pods without a limit can't be evicted for using storage")
+
+	// Warnings are cleared once usage drops back below the threshold.
+	usage["uid-near"] = 10
+	assert.NoError(m.check(context.Background()))
+	assert.False(m.warned["uid-near"])
+}
+
+func TestToolSettingsEphemeralStorage(t *testing.T) {
+	assert := assert.New(t)
+
+	job := &model.Job{Steps: []model.Step{{}}}
+
+	settings := &ToolSettings{EphemeralStorageRequest: "10Gi", EphemeralStorageLimit: "5Gi"}
+	request := settings.ephemeralStorageRequest(job)
+	assert.Equal("10Gi", request.String())
+
+	limit, ok := settings.ephemeralStorageLimit(job)
+	assert.True(ok)
+	assert.Equal("10Gi", limit.String(), "the limit must not be less than the request")
+
+	_, ok = (&ToolSettings{}).ephemeralStorageLimit(job)
+	assert.False(ok)
+
+	assert.Error(settings.Validate())
+	assert.Error((&ToolSettings{EphemeralStorageLimit: "lots"}).Validate())
+	assert.NoError((&ToolSettings{EphemeralStorageRequest: "1Gi", EphemeralStorageLimit: "2Gi"}).Validate())
+}
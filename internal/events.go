@@ -0,0 +1,286 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// The categories of the entries in an analysis's event timeline.
+const (
+	eventCategoryScheduling = "scheduling"
+	eventCategoryImage      = "image"
+	eventCategoryVolume     = "volume"
+	eventCategoryProbe      = "probe"
+	eventCategoryOOM        = "oom"
+	eventCategoryContainer  = "container"
+	eventCategoryLifecycle  = "lifecycle"
+	eventCategoryOther      = "other"
+)
+
+// oomKilledReason is the reason the kubelet gives for containers that were
+// killed for using more memory than their limit.
+const oomKilledReason = "OOMKilled"
+
+// The sources of the entries in an analysis's event timeline.
+const (
+	eventSourceEvent           = "event"
+	eventSourceContainerStatus = "container-status"
+)
+
+// AnalysisEvent is an entry in an analysis's event timeline.
+type AnalysisEvent struct {
+	// Time is the last time the event happened, and FirstTime is the first.
+	Time      time.Time `json:"time"`
+	FirstTime time.Time `json:"first_time"`
+	Count     int32     `json:"count"`
+
+	// Type is Normal or Warning.
+	Type     string `json:"type"`
+	Category string `json:"category"`
+	Reason   string `json:"reason"`
+	Message  string `json:"message"`
+
+	// Kind and Name identify the k8s object the event is about, and
+	// Container is the container in the pod it's about, if any.
+	Kind      string `json:"kind"`
+	Name      string `json:"name"`
+	Container string `json:"container,omitempty"`
+
+	// Source is event for k8s Events and container-status for entries read
+	// from the status of the analysis's pods, such as OOM kills.
+	Source string `json:"source"`
+}
+
+// eventCategory returns the category of the k8s event.
+func eventCategory(event *apiv1.Event) string {
+	message := strings.ToLower(event.Message)
+	switch {
+	case event.Reason == "Scheduled" ||
+		event.Reason == "FailedScheduling" ||
+		event.Reason == "Preempted" ||
+		event.Reason == "NotTriggerScaleUp" ||
+		event.Reason == "TriggeredScaleUp":
+		return eventCategoryScheduling
+	case event.Reason == pullingReason ||
+		event.Reason == pulledReason ||
+		event.Reason == "ErrImageNeverPull" ||
+		event.Reason == "InspectFailed" ||
+		((event.Reason == failedReason || event.Reason == backOffReason) && strings.Contains(message, "pull")):
+		return eventCategoryImage
+	case isMountEvent(event) || event.Reason == "SuccessfulAttachVolume":
+		return eventCategoryVolume
+	case event.Reason == "Unhealthy" || strings.Contains(message, "probe"):
+		return eventCategoryProbe
+	case strings.Contains(message, "oom") || strings.Contains(message, "out of memory"):
+		return eventCategoryOOM
+	case event.Reason == "Created" ||
+		event.Reason == "Started" ||
+		event.Reason == "Killing" ||
+		event.Reason == failedReason ||
+		event.Reason == backOffReason:
+		return eventCategoryContainer
+	case event.Reason == "ScalingReplicaSet" ||
+		event.Reason == "SuccessfulCreate" ||
+		event.Reason == "SuccessfulDelete" ||
+		event.Reason == "Sync":
+		return eventCategoryLifecycle
+	default:
+		return eventCategoryOther
+	}
+}
+
+// eventFirstTime returns the first time the event happened.
+func eventFirstTime(event *apiv1.Event) time.Time {
+	if !event.FirstTimestamp.IsZero() {
+		return event.FirstTimestamp.Time
+	}
+	return eventTime(event)
+}
+
+// analysisEventFromEvent normalizes the k8s event.
+func analysisEventFromEvent(event *apiv1.Event) AnalysisEvent {
+	entry := AnalysisEvent{
+		Time:      eventTime(event),
+		FirstTime: eventFirstTime(event),
+		Count:     event.Count,
+		Type:      event.Type,
+		Category:  eventCategory(event),
+		Reason:    event.Reason,
+		Message:   event.Message,
+		Kind:      event.InvolvedObject.Kind,
+		Name:      event.InvolvedObject.Name,
+		Source:    eventSourceEvent,
+	}
+	if entry.Count < 1 {
+		entry.Count = 1
+	}
+	if match := containerFieldPathRegexp.FindStringSubmatch(event.InvolvedObject.FieldPath); match != nil {
+		entry.Container = match[1]
+	}
+	return entry
+}
+
+// oomKillEvents returns the OOM kills recorded in the statuses of the pod's
+// containers. The kubelet doesn't emit events about the pod for them, so
+// they'd be missing from the timeline otherwise. Only the last termination
+// of each container is known.
+func oomKillEvents(pod *apiv1.Pod) []AnalysisEvent {
+	entries := []AnalysisEvent{}
+
+	add := func(container string, terminated *apiv1.ContainerStateTerminated) {
+		if terminated == nil || terminated.Reason != oomKilledReason {
+			return
+		}
+		when := terminated.FinishedAt.Time
+		entries = append(entries, AnalysisEvent{
+			Time:      when,
+			FirstTime: when,
+			Count:     1,
+			Type:      apiv1.EventTypeWarning,
+			Category:  eventCategoryOOM,
+			Reason:    oomKilledReason,
+			Message:   fmt.Sprintf("container %s was killed for using more memory than its limit (exit code %d)", container, terminated.ExitCode),
+			Kind:      "Pod",
+			Name:      pod.Name,
+			Container: container,
+			Source:    eventSourceContainerStatus,
+		})
+	}
+
+	statuses := append([]apiv1.ContainerStatus{}, pod.Status.InitContainerStatuses...)
+	statuses = append(statuses, pod.Status.ContainerStatuses...)
+	for idx := range statuses {
+		status := &statuses[idx]
+		add(status.Name, status.State.Terminated)
+		add(status.Name, status.LastTerminationState.Terminated)
+	}
+
+	return entries
+}
+
+// analysisEvents returns the timeline of the events about the analysis's
+// Deployment, ReplicaSets, pods, Service, and Ingress, oldest first. k8s
+// only keeps events for a while, an hour by default, so older events are
+// missing.
+func (i *Internal) analysisEvents(ctx context.Context, externalID string) ([]AnalysisEvent, error) {
+	ctx, span := startSpan(ctx, "analysisEvents")
+	defer span.End()
+
+	set := labels.Set(map[string]string{
+		"external-id": externalID,
+	})
+	listoptions := metav1.ListOptions{
+		LabelSelector: set.AsSelector().String(),
+	}
+
+	// The objects the events may be about, keyed by kind and name.
+	objects := map[string]bool{
+		"Deployment/" + externalID:                   true,
+		"Service/vice-" + externalID:                 true,
+		"Ingress/" + externalID:                      true,
+		"PodDisruptionBudget/vice-pdb-" + externalID: true,
+	}
+
+	replicasets, err := i.clientset.AppsV1().ReplicaSets(i.ViceNamespace).List(ctx, listoptions)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error listing the replica sets for %s", externalID)
+	}
+	for _, replicaset := range replicasets.Items {
+		objects["ReplicaSet/"+replicaset.Name] = true
+	}
+
+	entries := []AnalysisEvent{}
+
+	pods, err := i.clientset.CoreV1().Pods(i.ViceNamespace).List(ctx, listoptions)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error listing the pods for %s", externalID)
+	}
+	for idx := range pods.Items {
+		objects["Pod/"+pods.Items[idx].Name] = true
+		entries = append(entries, oomKillEvents(&pods.Items[idx])...)
+	}
+
+	events, err := i.clientset.CoreV1().Events(i.ViceNamespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing events")
+	}
+	for idx := range events.Items {
+		event := &events.Items[idx]
+		if !objects[event.InvolvedObject.Kind+"/"+event.InvolvedObject.Name] {
+			continue
+		}
+		entries = append(entries, analysisEventFromEvent(event))
+	}
+
+	sort.SliceStable(entries, func(a, b int) bool {
+		return entries[a].Time.Before(entries[b].Time)
+	})
+
+	return entries, nil
+}
+
+// eventsResponse returns the response for the events endpoints.
+func (i *Internal) eventsResponse(c echo.Context, analysisID, externalID string) error {
+	events, err := i.analysisEvents(c.Request().Context(), externalID)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"analysis_id": analysisID,
+		"external_id": externalID,
+		"events":      events,
+	})
+}
+
+// EventsHandler returns the timeline of the k8s events about the user's
+// analysis, such as scheduling failures, image pull errors, OOM kills, and
+// failed probes, so that the DE can show users why their analysis isn't
+// working.
+func (i *Internal) EventsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	analysisID := c.Param("analysis-id")
+	user := c.QueryParam("user")
+
+	if user == "" {
+		return echo.NewHTTPError(http.StatusForbidden, "user not set")
+	}
+
+	externalIDs, err := i.getExternalIDs(ctx, user, analysisID)
+	if err != nil {
+		return err
+	}
+
+	if len(externalIDs) == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("no external-id found for analysis-id %s", analysisID))
+	}
+
+	return i.eventsResponse(c, analysisID, externalIDs[0])
+}
+
+// AdminEventsHandler returns the timeline of the k8s events about any
+// analysis, for support staff.
+func (i *Internal) AdminEventsHandler(c echo.Context) error {
+	analysisID := c.Param("analysis-id")
+	if analysisID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "analysis-id parameter is empty")
+	}
+
+	externalID, err := i.getExternalIDByAnalysisID(c.Request().Context(), analysisID)
+	if err != nil {
+		return err
+	}
+
+	return i.eventsResponse(c, analysisID, externalID)
+}
@@ -0,0 +1,112 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func timelineEvent(name, kind, objectName, fieldPath, eventType, reason, message string, at time.Time) *apiv1.Event {
+	return &apiv1.Event{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "vice-apps"},
+		InvolvedObject: apiv1.ObjectReference{
+			Kind:      kind,
+			Name:      objectName,
+			FieldPath: fieldPath,
+		},
+		Type:           eventType,
+		Reason:         reason,
+		Message:        message,
+		FirstTimestamp: metav1.NewTime(at),
+		LastTimestamp:  metav1.NewTime(at),
+	}
+}
+
+func TestEventCategory(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		reason, message, category string
+	}{
+		{"FailedScheduling", "0/3 nodes are available: 3 Insufficient memory.", eventCategoryScheduling},
+		{"Pulling", `Pulling image "discoenv/jupyter:v1"`, eventCategoryImage},
+		{"Failed", "Error: ErrImagePull", eventCategoryImage},
+		{"BackOff", `Back-off pulling image "discoenv/jupyter:v1"`, eventCategoryImage},
+		{"BackOff", "Back-off restarting failed container", eventCategoryContainer},
+		{"FailedMount", "MountVolume.SetUp failed for volume", eventCategoryVolume},
+		{"Unhealthy", "Readiness probe failed: connection refused", eventCategoryProbe},
+		{"Killing", "Container analysis failed liveness probe, will be restarted", eventCategoryProbe},
+		{"Started", "Started container analysis", eventCategoryContainer},
+		{"ScalingReplicaSet", "Scaled up replica set a1234-5d8f to 1", eventCategoryLifecycle},
+		{"Evicted", "The node was low on resource: memory.", eventCategoryOther},
+	}
+	for _, test := range tests {
+		eventType := apiv1.EventTypeNormal
+		if test.reason == "FailedMount" {
+			eventType = apiv1.EventTypeWarning
+		}
+		event := timelineEvent("e", "Pod", "p", "", eventType, test.reason, test.message, time.Now())
+		assert.Equal(test.category, eventCategory(event), test.message)
+	}
+}
+
+func TestAnalysisEvents(t *testing.T) {
+	assert := assert.New(t)
+
+	start := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	analysisLabels := map[string]string{"external-id": "a1234"}
+
+	pod := &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "a1234-5d8f-x1", Namespace: "vice-apps", Labels: analysisLabels},
+		Status: apiv1.PodStatus{
+			ContainerStatuses: []apiv1.ContainerStatus{{
+				Name:  analysisContainerName,
+				State: apiv1.ContainerState{Running: &apiv1.ContainerStateRunning{}},
+				LastTerminationState: apiv1.ContainerState{Terminated: &apiv1.ContainerStateTerminated{
+					Reason:     oomKilledReason,
+					ExitCode:   137,
+					FinishedAt: metav1.NewTime(start.Add(3 * time.Minute)),
+				}},
+			}},
+		},
+	}
+
+	i := &Internal{
+		Init: Init{ViceNamespace: "vice-apps"},
+		clientset: fake.NewSimpleClientset(
+			pod,
+			&appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{Name: "a1234-5d8f", Namespace: "vice-apps", Labels: analysisLabels}},
+			timelineEvent("e1", "Deployment", "a1234", "", apiv1.EventTypeNormal, "ScalingReplicaSet", "Scaled up replica set a1234-5d8f to 1", start),
+			timelineEvent("e2", "Pod", "a1234-5d8f-x1", "", apiv1.EventTypeWarning, "FailedScheduling", "0/3 nodes are available", start.Add(time.Second)),
+			timelineEvent("e3", "Pod", "a1234-5d8f-x1", "spec.containers{analysis}", apiv1.EventTypeWarning, "Failed", "Error: ErrImagePull", start.Add(time.Minute)),
+			timelineEvent("e4", "ReplicaSet", "a1234-5d8f", "", apiv1.EventTypeNormal, "SuccessfulCreate", "Created pod: a1234-5d8f-x1", start.Add(500*time.Millisecond)),
+			timelineEvent("other", "Pod", "b5678-1111-x1", "", apiv1.EventTypeWarning, "FailedScheduling", "0/3 nodes are available", start),
+		),
+	}
+
+	events, err := i.analysisEvents(context.Background(), "a1234")
+	assert.NoError(err)
+	if assert.Len(events, 5) {
+		reasons := []string{}
+		for _, event := range events {
+			reasons = append(reasons, event.Reason)
+		}
+		assert.Equal([]string{"ScalingReplicaSet", "SuccessfulCreate", "FailedScheduling", "Failed", oomKilledReason}, reasons)
+
+		assert.Equal(eventCategoryImage, events[3].Category)
+		assert.Equal("analysis", events[3].Container)
+		assert.Equal(int32(1), events[3].Count)
+		assert.Equal(eventSourceEvent, events[3].Source)
+
+		assert.Equal(eventCategoryOOM, events[4].Category)
+		assert.Equal(analysisContainerName, events[4].Container)
+		assert.Equal(eventSourceContainerStatus, events[4].Source)
+		assert.Contains(events[4].Message, "exit code 137")
+	}
+}
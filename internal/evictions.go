@@ -0,0 +1,213 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+const (
+	// evictionRewatchDelay is how long to wait before re-establishing the pod
+	// watch after it closes or fails.
+	evictionRewatchDelay = 5 * time.Second
+
+	// evictionSavedAnnotation is set on a disrupted pod by the replica that
+	// takes responsibility for saving its outputs.
+	evictionSavedAnnotation = "vice.cyverse.org/eviction-saver"
+)
+
+// podDisruption returns the reason a pod is being evicted or preempted and
+// true if it is. Pods that are being shut down because of node pressure or
+// preemption have the DisruptionTarget condition set while their containers
+// are still running; pods that were evicted outright have the Evicted reason.
+func podDisruption(pod *apiv1.Pod) (string, bool) {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == apiv1.DisruptionTarget && condition.Status == apiv1.ConditionTrue {
+			return condition.Reason, true
+		}
+	}
+
+	switch pod.Status.Reason {
+	case "Evicted", "Preempting":
+		return pod.Status.Reason, true
+	}
+
+	return "", false
+}
+
+// EvictionSaver watches VICE analysis pods and saves the outputs of analyses
+// whose pods are being evicted or preempted, so that users don't lose their
+// work after node pressure events.
+type EvictionSaver struct {
+	internal *Internal
+
+	mu      sync.Mutex
+	handled map[types.UID]bool
+}
+
+// NewEvictionSaver returns a new *EvictionSaver.
+func NewEvictionSaver(i *Internal) *EvictionSaver {
+	return &EvictionSaver{
+		internal: i,
+		handled:  map[types.UID]bool{},
+	}
+}
+
+// claim returns true the first time it's called for a pod.
+func (e *EvictionSaver) claim(uid types.UID) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.handled[uid] {
+		return false
+	}
+	e.handled[uid] = true
+	return true
+}
+
+// forget stops tracking a pod once it's been deleted.
+func (e *EvictionSaver) forget(uid types.UID) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.handled, uid)
+}
+
+// save uploads the outputs of the analysis running in the pod and lets the
+// user know what happened.
+func (e *EvictionSaver) save(ctx context.Context, pod *apiv1.Pod, reason string) {
+	ctx, span := otel.Tracer(otelName).Start(ctx, "EvictionSaver.save")
+	defer span.End()
+
+	externalID := pod.Labels["external-id"]
+	if externalID == "" {
+		return
+	}
+
+	log.WithContext(ctx).Warnf("pod %s for analysis %s is being disrupted (%s), saving outputs", pod.Name, externalID, reason)
+
+	msg := fmt.Sprintf(
+		"The pod running this analysis is being shut down by the cluster (%s). Saving output files.",
+		reason,
+	)
+	if err := e.internal.statusPublisher.Running(ctx, externalID, msg); err != nil {
+		log.WithContext(ctx).Error(err)
+	}
+
+	if err := e.internal.doFileTransfer(ctx, externalID, uploadBasePath, uploadKind, false); err != nil {
+		log.WithContext(ctx).Error(errors.Wrapf(err, "error saving outputs for disrupted analysis %s", externalID))
+		msg = "Output files could not be saved before the analysis pod was shut down."
+	} else {
+		msg = "Output files were saved before the analysis pod was shut down."
+	}
+
+	if err := e.internal.statusPublisher.Running(ctx, externalID, msg); err != nil {
+		log.WithContext(ctx).Error(err)
+	}
+
+	err := e.internal.notify(ctx, &analysisNotification{
+		ExternalID: externalID,
+		Event:      NotificationFailed,
+		Subject:    "Your analysis was shut down",
+		Message:    fmt.Sprintf("The pod running your VICE analysis was shut down by the cluster (%s). %s", reason, msg),
+	})
+	if err != nil {
+		log.WithContext(ctx).Error(err)
+	}
+}
+
+// handleEvent processes a single pod watch event.
+func (e *EvictionSaver) handleEvent(ctx context.Context, event watch.Event) {
+	pod, ok := event.Object.(*apiv1.Pod)
+	if !ok {
+		return
+	}
+
+	if event.Type == watch.Deleted {
+		e.forget(pod.UID)
+		return
+	}
+
+	reason, disrupted := podDisruption(pod)
+	if !disrupted || !e.claim(pod.UID) {
+		return
+	}
+
+	annotated, err := e.annotate(ctx, pod)
+	if err != nil {
+		// The pod may have changed since the event was sent. Try again when
+		// the next event for it arrives.
+		log.WithContext(ctx).Infof("unable to annotate disrupted pod %s: %s", pod.Name, err)
+		e.forget(pod.UID)
+		return
+	}
+	if !annotated {
+		return
+	}
+
+	go e.save(ctx, pod, reason)
+}
+
+// annotate marks the pod as being handled by this replica, returning false
+// if another replica has already done so. The update uses the pod's resource
+// version, so only one app-exposer replica can succeed.
+func (e *EvictionSaver) annotate(ctx context.Context, pod *apiv1.Pod) (bool, error) {
+	if _, ok := pod.Annotations[evictionSavedAnnotation]; ok {
+		return false, nil
+	}
+
+	updated := pod.DeepCopy()
+	if updated.Annotations == nil {
+		updated.Annotations = map[string]string{}
+	}
+	updated.Annotations[evictionSavedAnnotation] = hostname()
+
+	podclient := e.internal.clientset.CoreV1().Pods(pod.Namespace)
+	if _, err := podclient.Update(ctx, updated, metav1.UpdateOptions{}); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Run watches the analysis pods until the context is canceled.
+func (e *EvictionSaver) Run(ctx context.Context) {
+	set := labels.Set(map[string]string{
+		"app-type": "interactive",
+	})
+
+	podclient := e.internal.clientset.CoreV1().Pods(e.internal.ViceNamespace)
+
+	for {
+		w, err := podclient.Watch(ctx, metav1.ListOptions{
+			LabelSelector: set.AsSelector().String(),
+		})
+		if err != nil {
+			log.WithContext(ctx).Error(errors.Wrap(err, "error watching analysis pods for evictions"))
+		} else {
+			for event := range w.ResultChan() {
+				e.handleEvent(ctx, event)
+			}
+			w.Stop()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(evictionRewatchDelay):
+		}
+	}
+}
+
+// RunEvictionSaver starts watching for disrupted analysis pods. Blocks until
+// the context is canceled.
+func (i *Internal) RunEvictionSaver(ctx context.Context) {
+	NewEvictionSaver(i).Run(ctx)
+}
@@ -0,0 +1,58 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+func TestPodDisruption(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    apiv1.PodStatus
+		reason    string
+		disrupted bool
+	}{
+		{
+			name:      "running",
+			status:    apiv1.PodStatus{Phase: apiv1.PodRunning},
+			disrupted: false,
+		},
+		{
+			name:      "evicted",
+			status:    apiv1.PodStatus{Phase: apiv1.PodFailed, Reason: "Evicted"},
+			reason:    "Evicted",
+			disrupted: true,
+		},
+		{
+			name: "preempted",
+			status: apiv1.PodStatus{
+				Phase: apiv1.PodRunning,
+				Conditions: []apiv1.PodCondition{
+					{Type: apiv1.PodReady, Status: apiv1.ConditionTrue},
+					{Type: apiv1.DisruptionTarget, Status: apiv1.ConditionTrue, Reason: "PreemptionByScheduler"},
+				},
+			},
+			reason:    "PreemptionByScheduler",
+			disrupted: true,
+		},
+		{
+			name: "disruption condition false",
+			status: apiv1.PodStatus{
+				Conditions: []apiv1.PodCondition{
+					{Type: apiv1.DisruptionTarget, Status: apiv1.ConditionFalse},
+				},
+			},
+			disrupted: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reason, disrupted := podDisruption(&apiv1.Pod{Status: tt.status})
+			assert.Equal(t, tt.disrupted, disrupted)
+			assert.Equal(t, tt.reason, reason)
+		})
+	}
+}
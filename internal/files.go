@@ -0,0 +1,326 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cyverse-de/app-exposer/permissions"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+)
+
+const (
+	// fileBrowserTimeout limits how long the commands that list and read the
+	// working directory may run in the analysis pod.
+	fileBrowserTimeout = 30 * time.Second
+
+	defaultMaxDownloadBytes int64 = 16 << 20
+)
+
+// The types reported for the entries in the working directory.
+const (
+	workingDirFileType    = "file"
+	workingDirDirType     = "directory"
+	workingDirSymlinkType = "symlink"
+	workingDirOtherType   = "other"
+)
+
+// workingDirStatFormat is the stat format used to describe files. The name is
+// last so that names containing the separator can still be parsed.
+const workingDirStatFormat = "%F|%s|%Y|%n"
+
+// WorkingDirFile describes a file or directory in an analysis's working
+// directory.
+type WorkingDirFile struct {
+	Name     string    `json:"name"`
+	Path     string    `json:"path"`
+	Type     string    `json:"type"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// statCommand prints the description of the file the path resolves to, or
+// nothing if it doesn't exist. Symbolic links are resolved so that the
+// caller can check that the file is inside the working directory.
+func statCommand(filePath string) []string {
+	return []string{
+		"sh", "-c",
+		`f=$(realpath -- "$1" 2>/dev/null) && [ -e "$f" ] && stat -c "$2" -- "$f" || true`,
+		"sh", filePath, workingDirStatFormat,
+	}
+}
+
+// listCommand prints the description of each entry in the directory,
+// including hidden ones, without following symbolic links.
+func listCommand(dir string) []string {
+	return []string{
+		"sh", "-c",
+		`cd -- "$1" || exit 1; for f in * .[!.]* ..?*; do if [ -e "$f" ] || [ -L "$f" ]; then stat -c "$2" -- "$f"; fi; done; exit 0`,
+		"sh", dir, workingDirStatFormat,
+	}
+}
+
+// catCommand prints the contents of the file.
+func catCommand(filePath string) []string {
+	return []string{"cat", "--", filePath}
+}
+
+// parseStatLine parses a line of output in workingDirStatFormat. The name is
+// left as stat printed it.
+func parseStatLine(line string) (*WorkingDirFile, error) {
+	fields := strings.SplitN(line, "|", 4)
+	if len(fields) != 4 {
+		return nil, fmt.Errorf("unexpected stat output: %q", line)
+	}
+
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to parse the size in %q", line)
+	}
+	modified, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to parse the modification time in %q", line)
+	}
+
+	file := &WorkingDirFile{
+		Name:     fields[3],
+		Size:     size,
+		Modified: time.Unix(modified, 0).UTC(),
+	}
+	switch fields[0] {
+	case "regular file", "regular empty file":
+		file.Type = workingDirFileType
+	case "directory":
+		file.Type = workingDirDirType
+	case "symbolic link":
+		file.Type = workingDirSymlinkType
+	default:
+		file.Type = workingDirOtherType
+	}
+
+	return file, nil
+}
+
+// insideDir returns true if the absolute path is the directory or is inside
+// it.
+func insideDir(dir, filePath string) bool {
+	return filePath == dir || strings.HasPrefix(filePath, strings.TrimSuffix(dir, "/")+"/")
+}
+
+// relativePath returns the path of a file in the working directory relative
+// to the directory's mount point, starting with a slash.
+func relativePath(root, filePath string) string {
+	return path.Join("/", strings.TrimPrefix(filePath, root))
+}
+
+// workingDirTarget is a file or directory requested from an analysis's
+// working directory, along with where to run commands to read it.
+type workingDirTarget struct {
+	namespace string
+	pod       string
+	container string
+	root      string
+	file      *WorkingDirFile
+	fullPath  string
+}
+
+// statWorkingDirPath looks up the file at the path, which is relative to the
+// analysis's working directory. Returns a 404 error if it doesn't exist and a
+// 403 error if it resolves to a file outside of the working directory.
+func (i *Internal) statWorkingDirPath(ctx context.Context, externalID, requested string) (*workingDirTarget, error) {
+	pod, err := i.runningAnalysisPod(ctx, externalID)
+	if err != nil {
+		return nil, err
+	}
+
+	container, root, err := workingDirLocation(pod)
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := i.podExec(ctx, pod.Namespace, pod.Name, container, statCommand(path.Join(root, path.Clean("/"+requested))))
+	if err != nil {
+		return nil, err
+	}
+	output = strings.TrimSuffix(output, "\n")
+	if output == "" {
+		return nil, echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("%s doesn't exist in the working directory", requested))
+	}
+
+	file, err := parseStatLine(output)
+	if err != nil {
+		return nil, err
+	}
+
+	fullPath := file.Name
+	if !insideDir(root, fullPath) {
+		return nil, echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("%s is outside of the working directory", requested))
+	}
+	file.Name = path.Base(fullPath)
+	file.Path = relativePath(root, fullPath)
+
+	return &workingDirTarget{
+		namespace: pod.Namespace,
+		pod:       pod.Name,
+		container: container,
+		root:      root,
+		file:      file,
+		fullPath:  fullPath,
+	}, nil
+}
+
+// listWorkingDir lists the entries in a directory of the analysis's working
+// directory.
+func (i *Internal) listWorkingDir(ctx context.Context, target *workingDirTarget) ([]WorkingDirFile, error) {
+	output, err := i.podExec(ctx, target.namespace, target.pod, target.container, listCommand(target.fullPath))
+	if err != nil {
+		return nil, err
+	}
+
+	files := []WorkingDirFile{}
+	for _, line := range strings.Split(output, "\n") {
+		if line == "" {
+			continue
+		}
+		file, err := parseStatLine(line)
+		if err != nil {
+			// Names containing newlines split the output.
+			log.WithContext(ctx).Warn(err)
+			continue
+		}
+		file.Path = path.Join(target.file.Path, file.Name)
+		files = append(files, *file)
+	}
+
+	return files, nil
+}
+
+// checkWorkingDirAccess returns an error unless the user has access to the
+// analysis with the external ID. The working directory can hold anything the
+// analysis's owner put there, so only the users the analysis is shared with
+// may browse it.
+func (i *Internal) checkWorkingDirAccess(ctx context.Context, user, externalID string) error {
+	if user == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "user query parameter must be set")
+	}
+
+	analysisID, err := i.apps.GetAnalysisIDByExternalID(ctx, externalID)
+	if err == sql.ErrNoRows {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("no analysis found for external-id %s", externalID))
+	}
+	if err != nil {
+		return err
+	}
+
+	p := &permissions.Permissions{
+		BaseURL: i.PermissionsURL,
+	}
+
+	allowed, err := p.IsAllowed(ctx, user, analysisID)
+	if err != nil {
+		return err
+	}
+
+	if !allowed {
+		return echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("user %s cannot access analysis %s", user, analysisID))
+	}
+
+	return nil
+}
+
+// ListFilesHandler lists the contents of a directory in a running analysis's
+// working directory. The path query parameter is relative to the working
+// directory and defaults to the working directory itself.
+func (i *Internal) ListFilesHandler(c echo.Context) error {
+	id := c.Param("id")
+	if id == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "id parameter is empty")
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request().Context(), fileBrowserTimeout)
+	defer cancel()
+
+	if err := i.checkWorkingDirAccess(ctx, c.QueryParam("user"), id); err != nil {
+		return err
+	}
+
+	target, err := i.statWorkingDirPath(ctx, id, c.QueryParam("path"))
+	if err != nil {
+		return err
+	}
+	if target.file.Type != workingDirDirType {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("%s is not a directory", target.file.Path))
+	}
+
+	files, err := i.listWorkingDir(ctx, target)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"external_id": id,
+		"path":        target.file.Path,
+		"files":       files,
+	})
+}
+
+// DownloadFileHandler returns the contents of a file in a running analysis's
+// working directory, so that users can get intermediate results without
+// saving the outputs. Only files up to the configured size may be downloaded,
+// and the user must have access to the analysis.
+func (i *Internal) DownloadFileHandler(c echo.Context) error {
+	id := c.Param("id")
+	if id == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "id parameter is empty")
+	}
+
+	requested := c.QueryParam("path")
+	if requested == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "path query parameter is required")
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request().Context(), fileBrowserTimeout)
+	defer cancel()
+
+	if err := i.checkWorkingDirAccess(ctx, c.QueryParam("user"), id); err != nil {
+		return err
+	}
+
+	target, err := i.statWorkingDirPath(ctx, id, requested)
+	if err != nil {
+		return err
+	}
+	if target.file.Type != workingDirFileType {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("%s is not a regular file", target.file.Path))
+	}
+
+	maxBytes := i.MaxDownloadBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultMaxDownloadBytes
+	}
+	if target.file.Size > maxBytes {
+		return echo.NewHTTPError(
+			http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("%s is %d bytes; only files up to %d bytes can be downloaded from running analyses", target.file.Path, target.file.Size, maxBytes),
+		)
+	}
+
+	contents, err := i.podExec(ctx, target.namespace, target.pod, target.container, catCommand(target.fullPath))
+	if err != nil {
+		return err
+	}
+
+	data := []byte(contents)
+	c.Response().Header().Set(
+		echo.HeaderContentDisposition,
+		mime.FormatMediaType("attachment", map[string]string{"filename": target.file.Name}),
+	)
+	return c.Blob(http.StatusOK, http.DetectContentType(data), data)
+}
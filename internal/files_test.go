@@ -0,0 +1,228 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cyverse-de/app-exposer/apps"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// newFilesTestInternal returns an *Internal whose analysis pod has a working
+// directory containing a results directory, a small and a large file, and a
+// link to a file outside of the working directory. Only ipcdev has access to
+// the analysis.
+func newFilesTestInternal(t *testing.T) *Internal {
+	mockdb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { mockdb.Close() })
+
+	// The analysis ID is cached after it's looked up.
+	a := apps.NewApps(sqlx.NewDb(mockdb, "sqlmock"), "@example.org")
+	a.ConfigureCache(&apps.CacheConfig{MaxEntries: 10, AnalysisIDTTL: time.Hour, UserIPTTL: time.Hour})
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT j.id")).WithArgs("ext-1").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("a1"))
+
+	permissionsServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/permissions/subjects/user/ipcdev/analysis/a1" {
+			w.Write([]byte(`{"permissions": [{"permission_level": "own"}]}`)) // nolint:errcheck
+			return
+		}
+		w.Write([]byte(`{"permissions": []}`)) // nolint:errcheck
+	}))
+	t.Cleanup(permissionsServer.Close)
+
+	pod := &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "analysis-pod",
+			Namespace: "vice-apps",
+			Labels:    map[string]string{"external-id": "ext-1"},
+		},
+		Spec: apiv1.PodSpec{
+			Containers: []apiv1.Container{
+				{
+					Name:         fileTransfersContainerName,
+					VolumeMounts: []apiv1.VolumeMount{{Name: fileTransfersVolumeName, MountPath: "/input-files"}},
+				},
+			},
+		},
+		Status: apiv1.PodStatus{Phase: apiv1.PodRunning},
+	}
+
+	stats := map[string]string{
+		"/input-files":                   "directory|4096|1700000000|/input-files",
+		"/input-files/results":           "directory|4096|1700000000|/input-files/results",
+		"/input-files/results/table.csv": "regular file|12|1700000100|/input-files/results/table.csv",
+		"/input-files/results/big.h5":    "regular file|1048576|1700000200|/input-files/results/big.h5",
+		"/input-files/results/passwd":    "regular file|1024|1600000000|/etc/passwd",
+	}
+	listings := map[string]string{
+		"/input-files/results": "regular file|1048576|1700000200|big.h5\n" +
+			"symbolic link|11|1700000000|passwd\n" +
+			"regular file|12|1700000100|table.csv\n" +
+			"directory|4096|1700000300|.ipynb_checkpoints\n",
+	}
+
+	i := &Internal{
+		Init:      Init{ViceNamespace: "vice-apps", MaxDownloadBytes: 1024, PermissionsURL: permissionsServer.URL},
+		clientset: fake.NewSimpleClientset(pod),
+		apps:      a,
+	}
+	i.podExec = func(_ context.Context, namespace, podName, container string, command []string) (string, error) {
+		assert.Equal(t, "analysis-pod", podName)
+		assert.Equal(t, fileTransfersContainerName, container)
+		switch {
+		case command[0] == "cat":
+			return "a,b\n1,2\n3,4\n", nil
+		case command[2] == statCommand("")[2]:
+			if stat, ok := stats[command[4]]; ok {
+				return stat + "\n", nil
+			}
+			return "", nil
+		default:
+			return listings[command[4]], nil
+		}
+	}
+	return i
+}
+
+func filesRequest(i *Internal, handler func(*Internal, echo.Context) error, filePath string) (*httptest.ResponseRecorder, error) {
+	return filesRequestAs(i, handler, "ipcdev", filePath)
+}
+
+func filesRequestAs(i *Internal, handler func(*Internal, echo.Context) error, user, filePath string) (*httptest.ResponseRecorder, error) {
+	query := url.Values{"user": {user}, "path": {filePath}}
+	req := httptest.NewRequest(http.MethodGet, "/vice/ext-1/files?"+query.Encode(), nil)
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+	c.SetParamNames("id")
+	c.SetParamValues("ext-1")
+	return rec, handler(i, c)
+}
+
+func TestParseStatLine(t *testing.T) {
+	assert := assert.New(t)
+
+	file, err := parseStatLine("regular empty file|0|1700000000|a|b.txt")
+	if assert.NoError(err) {
+		assert.Equal("a|b.txt", file.Name)
+		assert.Equal(workingDirFileType, file.Type)
+		assert.Equal(int64(1700000000), file.Modified.Unix())
+	}
+
+	file, err = parseStatLine("fifo|0|1700000000|pipe")
+	if assert.NoError(err) {
+		assert.Equal(workingDirOtherType, file.Type)
+	}
+
+	_, err = parseStatLine("stat: cannot stat 'x'")
+	assert.Error(err)
+
+	assert.True(insideDir("/input-files", "/input-files"))
+	assert.True(insideDir("/input-files", "/input-files/results"))
+	assert.False(insideDir("/input-files", "/input-files-2/results"))
+	assert.Equal("/", relativePath("/input-files", "/input-files"))
+	assert.Equal("/results", relativePath("/input-files", "/input-files/results"))
+}
+
+func TestListFilesHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	i := newFilesTestInternal(t)
+
+	rec, err := filesRequest(i, (*Internal).ListFilesHandler, "results/../results/")
+	if assert.NoError(err) {
+		body := struct {
+			Path  string           `json:"path"`
+			Files []WorkingDirFile `json:"files"`
+		}{}
+		assert.NoError(json.Unmarshal(rec.Body.Bytes(), &body))
+		assert.Equal("/results", body.Path)
+		if assert.Len(body.Files, 4) {
+			assert.Equal("/results/big.h5", body.Files[0].Path)
+			assert.Equal(int64(1048576), body.Files[0].Size)
+			assert.Equal(workingDirSymlinkType, body.Files[1].Type)
+			assert.Equal(workingDirDirType, body.Files[3].Type)
+		}
+	}
+
+	// Paths can't escape the working directory.
+	_, err = filesRequest(i, (*Internal).ListFilesHandler, "../../etc")
+	if assert.Error(err) {
+		assert.Equal(http.StatusNotFound, err.(*echo.HTTPError).Code)
+	}
+
+	_, err = filesRequest(i, (*Internal).ListFilesHandler, "results/table.csv")
+	if assert.Error(err) {
+		assert.Equal(http.StatusBadRequest, err.(*echo.HTTPError).Code)
+	}
+}
+
+func TestDownloadFileHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	i := newFilesTestInternal(t)
+
+	rec, err := filesRequest(i, (*Internal).DownloadFileHandler, "/results/table.csv")
+	if assert.NoError(err) {
+		assert.Equal("a,b\n1,2\n3,4\n", rec.Body.String())
+		assert.Equal(`attachment; filename=table.csv`, rec.Header().Get(echo.HeaderContentDisposition))
+	}
+
+	_, err = filesRequest(i, (*Internal).DownloadFileHandler, "results/big.h5")
+	if assert.Error(err) {
+		assert.Equal(http.StatusRequestEntityTooLarge, err.(*echo.HTTPError).Code)
+	}
+
+	// Links to files outside of the working directory can't be followed.
+	_, err = filesRequest(i, (*Internal).DownloadFileHandler, "results/passwd")
+	if assert.Error(err) {
+		assert.Equal(http.StatusForbidden, err.(*echo.HTTPError).Code)
+	}
+
+	_, err = filesRequest(i, (*Internal).DownloadFileHandler, "results")
+	if assert.Error(err) {
+		assert.Equal(http.StatusBadRequest, err.(*echo.HTTPError).Code)
+	}
+
+	_, err = filesRequest(i, (*Internal).DownloadFileHandler, "")
+	if assert.Error(err) {
+		assert.Equal(http.StatusBadRequest, err.(*echo.HTTPError).Code)
+	}
+}
+
+func TestFilesHandlersPermissions(t *testing.T) {
+	assert := assert.New(t)
+
+	i := newFilesTestInternal(t)
+
+	for _, handler := range []func(*Internal, echo.Context) error{
+		(*Internal).ListFilesHandler,
+		(*Internal).DownloadFileHandler,
+	} {
+		_, err := filesRequestAs(i, handler, "someone-else", "/results/table.csv")
+		if assert.Error(err) {
+			assert.Equal(http.StatusForbidden, err.(*echo.HTTPError).Code)
+		}
+
+		_, err = filesRequestAs(i, handler, "", "/results/table.csv")
+		if assert.Error(err) {
+			assert.Equal(http.StatusBadRequest, err.(*echo.HTTPError).Code)
+		}
+	}
+}
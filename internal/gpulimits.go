@@ -0,0 +1,136 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/cyverse-de/model/v6"
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// getGPULimitForUserSQL returns the user's own GPU limit if they have one and
+// the default limit otherwise. Usernames are stored the same way as the
+// launchers in job_limits.
+const getGPULimitForUserSQL = `
+	SELECT max_gpus
+	  FROM vice_gpu_limits
+	 WHERE username = regexp_replace($1, '-', '_')
+	    OR username IS NULL
+	 ORDER BY username NULLS LAST
+	 LIMIT 1
+`
+
+// getGPULimitForUser returns the number of GPUs the user's VICE analyses may
+// use at once, or nil if there's no limit.
+func (i *Internal) getGPULimitForUser(ctx context.Context, user string) (*int, error) {
+	var gpuLimit int
+	err := i.db.QueryRowContext(ctx, getGPULimitForUserSQL, user).Scan(&gpuLimit)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &gpuLimit, nil
+}
+
+// deploymentGPUs returns the number of GPUs, including MIG partitions,
+// requested by the Deployment's containers.
+func deploymentGPUs(deployment *appsv1.Deployment) int64 {
+	var total int64
+	for _, container := range deployment.Spec.Template.Spec.Containers {
+		for name, quantity := range container.Resources.Limits {
+			if strings.HasPrefix(string(name), nvidiaResourcePrefix+"/") {
+				total += quantity.Value()
+			}
+		}
+	}
+	return total
+}
+
+// countGPUsForUser returns the number of GPUs used by the user's VICE
+// analyses. Analyses that are shutting down are left out, as are demo
+// analyses unless demo mode is configured to count them.
+func (i *Internal) countGPUsForUser(ctx context.Context, username string) (int, error) {
+	set := labels.Set(map[string]string{
+		"username": username,
+	})
+
+	deployments, err := i.clientset.AppsV1().Deployments(i.ViceNamespace).List(ctx, metav1.ListOptions{
+		LabelSelector: set.AsSelector().String(),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var total int64
+	for idx := range deployments.Items {
+		deployment := &deployments.Items[idx]
+		if deployment.DeletionTimestamp != nil {
+			continue
+		}
+		if deployment.Labels[demoLabel] == "true" && !i.Demo.CountQuota {
+			continue
+		}
+		total += deploymentGPUs(deployment)
+	}
+	return int(total), nil
+}
+
+// gpuLimitError returns the error for a user who would use more GPUs than
+// they may if another GPU analysis were launched, or nil if they can launch
+// one.
+func gpuLimitError(user string, gpuLimit *int, gpuCount int) error {
+	if gpuLimit == nil || gpuCount < *gpuLimit {
+		return nil
+	}
+
+	msg := fmt.Sprintf("%s is already using %d or more GPUs, which is as many as they may use at once", user, *gpuLimit)
+	if *gpuLimit == 0 {
+		msg = fmt.Sprintf("%s is not permitted to run analyses that use GPUs", user)
+	}
+
+	return common.ErrorResponse{
+		ErrorCode: "ERR_GPU_LIMIT_REACHED",
+		Message:   msg,
+		Details: &map[string]interface{}{
+			"gpuCount": gpuCount,
+			"gpuLimit": *gpuLimit,
+		},
+	}
+}
+
+// checkUserGPULimit returns an error if the job needs a GPU and its user is
+// already using as many GPUs as they may. The GPU limits are independent of
+// the concurrent job limits, so that a few users can't take every GPU in a
+// small node pool.
+func (i *Internal) checkUserGPULimit(ctx context.Context, job *model.Job) error {
+	gpuLimit, err := i.getGPULimitForUser(ctx, job.Submitter)
+	if err != nil {
+		return errors.Wrapf(err, "unable to determine the GPU limit for %s", job.Submitter)
+	}
+	if gpuLimit == nil {
+		return nil
+	}
+
+	settings, err := i.getToolSettings(ctx, job)
+	if err != nil {
+		return err
+	}
+	if !settings.needsGPU(job) {
+		return nil
+	}
+
+	gpuCount, err := i.countGPUsForUser(ctx, labelValueString(job.Submitter))
+	if err != nil {
+		return errors.Wrapf(err, "unable to determine the number of GPUs that %s is currently using", job.Submitter)
+	}
+
+	return gpuLimitError(job.Submitter, gpuLimit, gpuCount)
+}
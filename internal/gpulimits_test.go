@@ -0,0 +1,202 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/cyverse-de/app-exposer/resourcing"
+	"github.com/cyverse-de/model/v6"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	resourcev1 "k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func gpuDeployment(name, username string, gpus map[string]string, extraLabels map[string]string) *appsv1.Deployment {
+	limits := apiv1.ResourceList{apiv1.ResourceCPU: resourcev1.MustParse("1")}
+	for k, v := range gpus {
+		limits[apiv1.ResourceName(k)] = resourcev1.MustParse(v)
+	}
+
+	deploymentLabels := map[string]string{"username": username}
+	for k, v := range extraLabels {
+		deploymentLabels[k] = v
+	}
+
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "vice-apps",
+			Labels:    deploymentLabels,
+		},
+		Spec: appsv1.DeploymentSpec{
+			Template: apiv1.PodTemplateSpec{
+				Spec: apiv1.PodSpec{
+					Containers: []apiv1.Container{{
+						Name:      analysisContainerName,
+						Resources: apiv1.ResourceRequirements{Limits: limits},
+					}},
+				},
+			},
+		},
+	}
+}
+
+func TestCountGPUsForUser(t *testing.T) {
+	assert := assert.New(t)
+
+	deleting := gpuDeployment("deleting", "ipcdev", map[string]string{"nvidia.com/gpu": "1"}, nil)
+	now := metav1.NewTime(time.Now())
+	deleting.DeletionTimestamp = &now
+
+	i := &Internal{
+		Init: Init{ViceNamespace: "vice-apps"},
+		clientset: fake.NewSimpleClientset(
+			gpuDeployment("gpu", "ipcdev", map[string]string{"nvidia.com/gpu": "1"}, nil),
+			gpuDeployment("mig", "ipcdev", map[string]string{"nvidia.com/mig-1g.5gb": "1"}, nil),
+			gpuDeployment("cpu", "ipcdev", nil, nil),
+			gpuDeployment("demo", "ipcdev", map[string]string{"nvidia.com/gpu": "1"}, map[string]string{demoLabel: "true"}),
+			gpuDeployment("other", "someone-else", map[string]string{"nvidia.com/gpu": "1"}, nil),
+			deleting,
+		),
+	}
+
+	count, err := i.countGPUsForUser(context.Background(), "ipcdev")
+	assert.NoError(err)
+	assert.Equal(2, count)
+
+	// Demo analyses count if demo mode is configured to count them.
+	i.Demo.CountQuota = true
+	count, err = i.countGPUsForUser(context.Background(), "ipcdev")
+	assert.NoError(err)
+	assert.Equal(3, count)
+}
+
+func TestGPULimitError(t *testing.T) {
+	assert := assert.New(t)
+
+	limit := func(n int) *int { return &n }
+
+	assert.NoError(gpuLimitError("ipcdev", nil, 10))
+	assert.NoError(gpuLimitError("ipcdev", limit(2), 1))
+
+	err := gpuLimitError("ipcdev", limit(2), 2)
+	if assert.Error(err) {
+		assert.Equal("ERR_GPU_LIMIT_REACHED", err.(common.ErrorResponse).ErrorCode)
+		assert.Contains(err.Error(), "already using 2 or more GPUs")
+	}
+
+	err = gpuLimitError("ipcdev", limit(0), 0)
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "not permitted to run analyses that use GPUs")
+	}
+}
+
+func TestCheckUserGPULimit(t *testing.T) {
+	assert := assert.New(t)
+
+	mockdb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockdb.Close()
+
+	i := &Internal{
+		Init: Init{ViceNamespace: "vice-apps"},
+		db:   sqlx.NewDb(mockdb, "sqlmock"),
+		clientset: fake.NewSimpleClientset(
+			gpuDeployment("gpu", "ipcdev", map[string]string{"nvidia.com/gpu": "1"}, nil),
+		),
+	}
+
+	newJob := func(devices ...model.Device) *model.Job {
+		return &model.Job{
+			Submitter: "ipcdev",
+			Steps: []model.Step{{
+				Component: model.StepComponent{
+					Container: model.Container{Devices: devices},
+				},
+			}},
+		}
+	}
+	gpuJob := newJob(model.Device{HostPath: "/dev/nvidia0"})
+
+	expectLimit := func(rows *sqlmock.Rows) {
+		mock.ExpectQuery(regexp.QuoteMeta("FROM vice_gpu_limits")).WithArgs("ipcdev").WillReturnRows(rows)
+	}
+
+	// Users without a limit aren't limited.
+	expectLimit(sqlmock.NewRows([]string{"max_gpus"}))
+	assert.NoError(i.checkUserGPULimit(context.Background(), gpuJob))
+
+	// Analyses that don't need a GPU aren't limited.
+	expectLimit(sqlmock.NewRows([]string{"max_gpus"}).AddRow(1))
+	assert.NoError(i.checkUserGPULimit(context.Background(), newJob()))
+
+	expectLimit(sqlmock.NewRows([]string{"max_gpus"}).AddRow(2))
+	assert.NoError(i.checkUserGPULimit(context.Background(), gpuJob))
+
+	expectLimit(sqlmock.NewRows([]string{"max_gpus"}).AddRow(1))
+	err = i.checkUserGPULimit(context.Background(), gpuJob)
+	if assert.Error(err) {
+		assert.Equal("ERR_GPU_LIMIT_REACHED", err.(common.ErrorResponse).ErrorCode)
+	}
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestLaunchAppHandlerGPUPreset(t *testing.T) {
+	assert := assert.New(t)
+
+	mockdb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockdb.Close()
+
+	clientset := fake.NewSimpleClientset()
+	i := &Internal{
+		Init: Init{
+			ViceNamespace: "vice-apps",
+			ResourcePresets: resourcing.Presets{
+				{Name: "small", CPUCores: 1, Memory: "4Gi"},
+				{Name: "gpu", CPUCores: 8, Memory: "64Gi", GPUs: 1},
+			},
+		},
+		db:        sqlx.NewDb(mockdb, "sqlmock"),
+		clientset: clientset,
+	}
+
+	// The job doesn't ask for a GPU, but the preset adds one, so the user's
+	// limit of zero GPUs applies.
+	mock.ExpectQuery(regexp.QuoteMeta("FROM vice_gpu_limits")).WithArgs("ipcdev@example.org").
+		WillReturnRows(sqlmock.NewRows([]string{"max_gpus"}).AddRow(0))
+	mock.ExpectQuery(regexp.QuoteMeta("FROM vice_tool_settings")).WillReturnRows(sqlmock.NewRows([]string{"settings"}))
+
+	body := validationJob(t, map[string]interface{}{"resource_preset": "gpu"})
+	req := httptest.NewRequest(http.MethodPost, "/vice/launch", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	err = i.LaunchAppHandler(echo.New().NewContext(req, httptest.NewRecorder()))
+	if assert.Error(err) {
+		if assert.IsType(common.ErrorResponse{}, err) {
+			assert.Equal("ERR_GPU_LIMIT_REACHED", err.(common.ErrorResponse).ErrorCode)
+		}
+	}
+
+	// Nothing was created.
+	for _, action := range clientset.Actions() {
+		assert.Equal("list", action.GetVerb())
+	}
+	assert.NoError(mock.ExpectationsWereMet())
+}
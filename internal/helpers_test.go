@@ -0,0 +1,64 @@
+package internal
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cyverse-de/app-exposer/apps"
+	"github.com/jmoiron/sqlx"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// newLaunchTestInternal returns an Internal that can generate and launch
+// analyses against a fake cluster, along with the mock of its database and
+// the fake clientset. Tests set the queries they expect on the mock and
+// change the configuration they need before using it.
+func newLaunchTestInternal(t *testing.T) (*Internal, sqlmock.Sqlmock, *fake.Clientset) {
+	t.Helper()
+
+	mockdb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { mockdb.Close() })
+
+	db := sqlx.NewDb(mockdb, "sqlmock")
+	a := apps.NewApps(db, "@example.org")
+	a.ConfigureCache(&apps.CacheConfig{MaxEntries: 10, AnalysisIDTTL: time.Hour, UserIPTTL: time.Hour})
+
+	proxyAuth, err := NewProxyAuth(&Init{KeycloakClientSecret: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientset := fake.NewSimpleClientset()
+	i := &Internal{
+		Init: Init{
+			ViceNamespace:                 "vice-apps",
+			ViceDefaultBackendService:     "vice-default-backend",
+			ViceDefaultBackendServicePort: 80,
+			ProxyAuth:                     proxyAuth,
+		},
+		db:        db,
+		clientset: clientset,
+		apps:      a,
+	}
+	return i, mock, clientset
+}
+
+// expectUserIP sets the mock up to return an IP address for user u1, which
+// the generated analyses are allowed to be reached from.
+func expectUserIP(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery("SELECT l.ip_address").WithArgs("u1").WillReturnRows(sqlmock.NewRows([]string{"ip_address"}).AddRow("10.0.0.1"))
+}
+
+// expectLaunchSpecQueries sets the mock up for the queries made while
+// turning a submission into an analysis's resources: the tool settings, the
+// user's IP address, and the environment variables, none of which are set.
+func expectLaunchSpecQueries(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery(regexp.QuoteMeta("FROM vice_tool_settings")).WillReturnRows(sqlmock.NewRows([]string{"settings"}))
+	expectUserIP(mock)
+	mock.ExpectQuery(regexp.QuoteMeta("FROM vice_app_env_vars")).WillReturnRows(sqlmock.NewRows([]string{"global", "name", "value"}))
+}
@@ -0,0 +1,199 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// stoppedReason is recorded for containers that were still running when the
+// analysis exited.
+const stoppedReason = "StoppedOnExit"
+
+// ContainerSummary describes how a container in an analysis pod ran.
+type ContainerSummary struct {
+	ExternalID      string     `json:"external_id" db:"external_id"`
+	PodName         string     `json:"pod_name" db:"pod_name"`
+	ContainerName   string     `json:"container_name" db:"container_name"`
+	InitContainer   bool       `json:"init_container" db:"init_container"`
+	Image           string     `json:"image" db:"image"`
+	StartedAt       *time.Time `json:"started_at" db:"started_at"`
+	FinishedAt      *time.Time `json:"finished_at" db:"finished_at"`
+	DurationSeconds *float64   `json:"duration_seconds" db:"-"`
+	ExitCode        *int32     `json:"exit_code" db:"exit_code"`
+	Reason          string     `json:"reason" db:"reason"`
+	RestartCount    int32      `json:"restart_count" db:"restart_count"`
+	LastExitCode    *int32     `json:"last_exit_code" db:"last_exit_code"`
+	LastReason      string     `json:"last_reason" db:"last_reason"`
+}
+
+// setDuration fills in the duration if the start and finish times are known.
+func (s *ContainerSummary) setDuration() {
+	if s.StartedAt == nil || s.FinishedAt == nil {
+		return
+	}
+	duration := s.FinishedAt.Sub(*s.StartedAt).Seconds()
+	s.DurationSeconds = &duration
+}
+
+func timePtr(t metav1.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	value := t.Time
+	return &value
+}
+
+// containerSummary summarizes the status of a container. Containers that are
+// still running are treated as if they stopped at the given time.
+func containerSummary(externalID, podName string, status *apiv1.ContainerStatus, init bool, now time.Time) ContainerSummary {
+	summary := ContainerSummary{
+		ExternalID:    externalID,
+		PodName:       podName,
+		ContainerName: status.Name,
+		InitContainer: init,
+		Image:         status.Image,
+		RestartCount:  status.RestartCount,
+	}
+
+	switch {
+	case status.State.Terminated != nil:
+		terminated := status.State.Terminated
+		summary.StartedAt = timePtr(terminated.StartedAt)
+		summary.FinishedAt = timePtr(terminated.FinishedAt)
+		summary.ExitCode = &terminated.ExitCode
+		summary.Reason = terminated.Reason
+	case status.State.Running != nil:
+		summary.StartedAt = timePtr(status.State.Running.StartedAt)
+		summary.FinishedAt = &now
+		summary.Reason = stoppedReason
+	case status.State.Waiting != nil:
+		summary.Reason = status.State.Waiting.Reason
+	}
+
+	if last := status.LastTerminationState.Terminated; last != nil {
+		summary.LastExitCode = &last.ExitCode
+		summary.LastReason = last.Reason
+	}
+
+	summary.setDuration()
+
+	return summary
+}
+
+// podContainerSummaries summarizes the init containers and containers in the
+// pod.
+func podContainerSummaries(externalID string, pod *apiv1.Pod, now time.Time) []ContainerSummary {
+	summaries := []ContainerSummary{}
+	for idx := range pod.Status.InitContainerStatuses {
+		summaries = append(summaries, containerSummary(externalID, pod.Name, &pod.Status.InitContainerStatuses[idx], true, now))
+	}
+	for idx := range pod.Status.ContainerStatuses {
+		summaries = append(summaries, containerSummary(externalID, pod.Name, &pod.Status.ContainerStatuses[idx], false, now))
+	}
+	return summaries
+}
+
+const upsertContainerSummarySQL = `
+	INSERT INTO vice_container_summaries (
+		external_id, pod_name, container_name, init_container, image, started_at, finished_at,
+		exit_code, reason, restart_count, last_exit_code, last_reason
+	)
+	VALUES (
+		:external_id, :pod_name, :container_name, :init_container, :image, :started_at, :finished_at,
+		:exit_code, :reason, :restart_count, :last_exit_code, :last_reason
+	)
+	ON CONFLICT (external_id, pod_name, container_name) DO UPDATE
+	   SET init_container = EXCLUDED.init_container,
+	       image = EXCLUDED.image,
+	       started_at = EXCLUDED.started_at,
+	       finished_at = EXCLUDED.finished_at,
+	       exit_code = EXCLUDED.exit_code,
+	       reason = EXCLUDED.reason,
+	       restart_count = EXCLUDED.restart_count,
+	       last_exit_code = EXCLUDED.last_exit_code,
+	       last_reason = EXCLUDED.last_reason,
+	       recorded_at = now()
+`
+
+// saveContainerSummaries records the summaries of the containers in the
+// analysis's pods so that they're still available after the pods are deleted.
+func (i *Internal) saveContainerSummaries(ctx context.Context, externalID string) (err error) {
+	ctx, span := startResourceSpan(ctx, "saveContainerSummaries", "pod")
+	defer func() { endSpan(span, err) }()
+
+	set := labels.Set(map[string]string{
+		"external-id": externalID,
+	})
+
+	podlist, err := i.clientset.CoreV1().Pods(i.ViceNamespace).List(ctx, metav1.ListOptions{
+		LabelSelector: set.AsSelector().String(),
+	})
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for idx := range podlist.Items {
+		for _, summary := range podContainerSummaries(externalID, &podlist.Items[idx], now) {
+			if _, err = i.db.NamedExecContext(ctx, upsertContainerSummarySQL, &summary); err != nil {
+				return errors.Wrapf(err, "error saving the summary of container %s in pod %s", summary.ContainerName, summary.PodName)
+			}
+		}
+	}
+
+	return nil
+}
+
+const listContainerSummariesSQL = `
+	SELECT external_id, pod_name, container_name, init_container, image, started_at, finished_at,
+	       exit_code, reason, restart_count, last_exit_code, last_reason
+	  FROM vice_container_summaries
+	 WHERE external_id = $1
+	 ORDER BY pod_name, init_container DESC, started_at NULLS LAST, container_name
+`
+
+// HistoryHandler returns the summaries of the containers that ran in an
+// analysis's pods, which are recorded when the analysis exits, along with the
+// image pulls for those containers and the restarts after failed liveness
+// probes.
+func (i *Internal) HistoryHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	id := c.Param("id")
+	if id == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "id parameter is empty")
+	}
+
+	summaries := []ContainerSummary{}
+	if err := i.db.SelectContext(ctx, &summaries, listContainerSummariesSQL, id); err != nil {
+		return err
+	}
+
+	for idx := range summaries {
+		summaries[idx].setDuration()
+	}
+
+	pulls, err := i.listImagePulls(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	restarts, err := i.listContainerRestarts(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"external_id": id,
+		"containers":  summaries,
+		"image_pulls": pulls,
+		"restarts":    restarts,
+	})
+}
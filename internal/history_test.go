@@ -0,0 +1,173 @@
+package internal
+
+import (
+	"context"
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+var (
+	historyStart  = time.Date(2024, 1, 2, 3, 0, 0, 0, time.UTC)
+	historyFinish = historyStart.Add(90 * time.Second)
+	historyNow    = historyStart.Add(time.Hour)
+)
+
+func historyTestPod() *apiv1.Pod {
+	return &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "a1234-abcde",
+			Namespace: "vice-apps",
+			Labels:    map[string]string{"external-id": "a1234"},
+		},
+		Status: apiv1.PodStatus{
+			InitContainerStatuses: []apiv1.ContainerStatus{
+				{
+					Name:  fileTransfersInitContainerName,
+					Image: "discoenv/vice-file-transfers:latest",
+					State: apiv1.ContainerState{
+						Terminated: &apiv1.ContainerStateTerminated{
+							ExitCode:   0,
+							Reason:     "Completed",
+							StartedAt:  metav1.NewTime(historyStart),
+							FinishedAt: metav1.NewTime(historyFinish),
+						},
+					},
+				},
+			},
+			ContainerStatuses: []apiv1.ContainerStatus{
+				{
+					Name:         analysisContainerName,
+					Image:        "discoenv/jupyter:v1",
+					RestartCount: 1,
+					State: apiv1.ContainerState{
+						Running: &apiv1.ContainerStateRunning{StartedAt: metav1.NewTime(historyFinish)},
+					},
+					LastTerminationState: apiv1.ContainerState{
+						Terminated: &apiv1.ContainerStateTerminated{ExitCode: 137, Reason: "OOMKilled"},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestPodContainerSummaries(t *testing.T) {
+	assert := assert.New(t)
+
+	summaries := podContainerSummaries("a1234", historyTestPod(), historyNow)
+	if !assert.Len(summaries, 2) {
+		return
+	}
+
+	initSummary := summaries[0]
+	assert.True(initSummary.InitContainer)
+	assert.Equal(int32(0), *initSummary.ExitCode)
+	assert.Equal("Completed", initSummary.Reason)
+	assert.Equal(90.0, *initSummary.DurationSeconds)
+
+	analysis := summaries[1]
+	assert.False(analysis.InitContainer)
+	assert.Nil(analysis.ExitCode)
+	assert.Equal(stoppedReason, analysis.Reason)
+	assert.Equal(historyNow, *analysis.FinishedAt)
+	assert.Equal(int32(1), analysis.RestartCount)
+	assert.Equal(int32(137), *analysis.LastExitCode)
+	assert.Equal("OOMKilled", analysis.LastReason)
+}
+
+func TestSaveContainerSummaries(t *testing.T) {
+	assert := assert.New(t)
+
+	mockdb, mock, err := sqlmock.New()
+	assert.NoError(err)
+	defer mockdb.Close()
+
+	i := &Internal{
+		Init:      Init{ViceNamespace: "vice-apps"},
+		clientset: fake.NewSimpleClientset(historyTestPod()),
+		db:        sqlx.NewDb(mockdb, "sqlmock"),
+	}
+
+	insert := mock.ExpectExec(regexp.QuoteMeta("INSERT INTO vice_container_summaries"))
+	insert.WithArgs(
+		"a1234", "a1234-abcde", fileTransfersInitContainerName, true, "discoenv/vice-file-transfers:latest",
+		sqlmock.AnyArg(), sqlmock.AnyArg(), int32(0), "Completed", int32(0), nil, "",
+	).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO vice_container_summaries")).
+		WithArgs(anyArgs(12)...).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	assert.NoError(i.saveContainerSummaries(context.Background(), "a1234"))
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func anyArgs(n int) []driver.Value {
+	args := make([]driver.Value, n)
+	for idx := range args {
+		args[idx] = sqlmock.AnyArg()
+	}
+	return args
+}
+
+func TestHistoryHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	mockdb, mock, err := sqlmock.New()
+	assert.NoError(err)
+	defer mockdb.Close()
+
+	i := &Internal{db: sqlx.NewDb(mockdb, "sqlmock")}
+
+	mock.ExpectQuery(regexp.QuoteMeta("FROM vice_container_summaries")).
+		WithArgs("a1234").
+		WillReturnRows(sqlmock.NewRows([]string{
+			"external_id", "pod_name", "container_name", "init_container", "image", "started_at", "finished_at",
+			"exit_code", "reason", "restart_count", "last_exit_code", "last_reason",
+		}).AddRow(
+			"a1234", "a1234-abcde", analysisContainerName, false, "discoenv/jupyter:v1", historyStart, historyFinish,
+			1, "Error", 0, nil, "",
+		))
+	mock.ExpectQuery(regexp.QuoteMeta("FROM vice_image_pulls")).
+		WithArgs("a1234").
+		WillReturnRows(sqlmock.NewRows([]string{
+			"external_id", "pod_name", "container_name", "image", "started_at", "finished_at",
+			"pull_seconds", "cached", "failures", "failure_message",
+		}).AddRow(
+			"a1234", "a1234-abcde", analysisContainerName, "discoenv/jupyter:v1", historyStart, historyStart.Add(30*time.Second),
+			30.0, false, 0, "",
+		))
+	mock.ExpectQuery(regexp.QuoteMeta("FROM vice_container_restarts")).
+		WithArgs("a1234").
+		WillReturnRows(sqlmock.NewRows([]string{
+			"external_id", "pod_name", "container_name", "reason", "message", "restarted_at",
+		}).AddRow(
+			"a1234", "a1234-abcde", analysisContainerName, livenessRestartReason,
+			"Container analysis failed liveness probe, will be restarted", historyFinish,
+		))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+	c.SetParamNames("id")
+	c.SetParamValues("a1234")
+
+	assert.NoError(i.HistoryHandler(c))
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Contains(rec.Body.String(), `"duration_seconds":90`)
+	assert.Contains(rec.Body.String(), `"exit_code":1`)
+	assert.Contains(rec.Body.String(), `"pull_seconds":30`)
+	assert.Contains(rec.Body.String(), `"reason":"LivenessProbeFailed"`)
+	assert.NoError(mock.ExpectationsWereMet())
+}
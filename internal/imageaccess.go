@@ -0,0 +1,556 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/cyverse-de/model/v6"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+)
+
+const defaultImageAccessTimeout = 10 * time.Second
+
+// manifestMediaTypes are the manifest formats accepted when checking whether
+// an image exists.
+var manifestMediaTypes = strings.Join([]string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}, ", ")
+
+// ImageAccessConfig contains the settings for checking that analysis images
+// in the DE's Harbor registries can be pulled before the analyses are
+// launched.
+type ImageAccessConfig struct {
+	Enabled bool
+
+	// Registries lists the hosts of the registries to check, such as
+	// harbor.cyverse.org. Images in other registries aren't checked.
+	Registries []string
+
+	// RobotAccount is the name of the DE's robot account, which users grant
+	// access to their private projects. It's included in the errors for
+	// private images.
+	RobotAccount string
+
+	// Timeout limits how long each check can take.
+	Timeout time.Duration
+}
+
+// Validate returns an error if the configuration can't be used.
+func (c *ImageAccessConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if len(c.Registries) == 0 {
+		return fmt.Errorf("at least one registry must be listed to check image access")
+	}
+	for _, registry := range c.Registries {
+		if registry == "" || strings.Contains(registry, "/") {
+			return fmt.Errorf("invalid registry host %q", registry)
+		}
+	}
+	return nil
+}
+
+// RegistryCredential is a robot account that can pull the images in one
+// project of a registry.
+type RegistryCredential struct {
+	Registry string `json:"registry" db:"registry"`
+	Project  string `json:"project" db:"project"`
+	Username string `json:"username" db:"username"`
+	Secret   string `json:"secret,omitempty" db:"secret"`
+
+	// KeyID is the ID of the secret key that encrypted the stored secret. It's
+	// empty if the secret is stored unencrypted.
+	KeyID string `json:"key_id,omitempty" db:"-"`
+}
+
+// RegistryChecker checks whether images can be pulled from a registry using
+// the Docker registry HTTP API.
+type RegistryChecker struct {
+	client     *http.Client
+	registries map[string]bool
+}
+
+// newRegistryClient returns an HTTP client for registry requests that gives
+// up after the timeout.
+func newRegistryClient(timeout time.Duration) *http.Client {
+	if timeout <= 0 {
+		timeout = defaultImageAccessTimeout
+	}
+	return &http.Client{
+		Transport: httpClient.Transport,
+		Timeout:   timeout,
+	}
+}
+
+// NewRegistryChecker returns a *RegistryChecker for the configuration.
+func NewRegistryChecker(cfg *ImageAccessConfig) *RegistryChecker {
+	registries := map[string]bool{}
+	for _, registry := range cfg.Registries {
+		registries[registry] = true
+	}
+
+	return &RegistryChecker{
+		client:     newRegistryClient(cfg.Timeout),
+		registries: registries,
+	}
+}
+
+// parseBearerChallenge returns the parameters of a Bearer WWW-Authenticate
+// challenge, or nil if the challenge isn't for a bearer token.
+func parseBearerChallenge(challenge string) map[string]string {
+	scheme, rest, _ := strings.Cut(challenge, " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return nil
+	}
+
+	params := map[string]string{}
+	for _, param := range strings.Split(rest, ",") {
+		key, value, found := strings.Cut(strings.TrimSpace(param), "=")
+		if found {
+			params[key] = strings.Trim(value, `"`)
+		}
+	}
+	return params
+}
+
+// token requests a pull token for the challenge, using the credential if
+// there is one. Returns the status code of the token service's response if
+// it refused to issue a token.
+func (r *RegistryChecker) token(ctx context.Context, challenge map[string]string, credential *RegistryCredential) (string, int, error) {
+	tokenURL, err := url.Parse(challenge["realm"])
+	if err != nil {
+		return "", 0, errors.Wrapf(err, "invalid token realm %s", challenge["realm"])
+	}
+	q := tokenURL.Query()
+	for _, key := range []string{"service", "scope"} {
+		if challenge[key] != "" {
+			q.Set(key, challenge[key])
+		}
+	}
+	tokenURL.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, tokenURL.String(), nil)
+	if err != nil {
+		return "", 0, err
+	}
+	if credential != nil {
+		req.SetBasicAuth(credential.Username, credential.Secret)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return "", 0, errors.Wrapf(err, "error from GET %s", tokenURL.String())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", resp.StatusCode, nil
+	}
+
+	body := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	if err = json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", 0, errors.Wrapf(err, "error decoding the token from %s", tokenURL.String())
+	}
+	if body.Token == "" {
+		body.Token = body.AccessToken
+	}
+	return body.Token, resp.StatusCode, nil
+}
+
+// registrySession sends requests for a repository to a registry. It gets a
+// bearer token the first time the registry asks for one and uses it for the
+// rest of the session's requests.
+type registrySession struct {
+	checker       *RegistryChecker
+	registry      string
+	repository    string
+	credential    *RegistryCredential
+	authorization string
+}
+
+// newSession returns a *registrySession for the repository, which
+// authenticates with the credential if it isn't nil.
+func (r *RegistryChecker) newSession(registry, repository string, credential *RegistryCredential) *registrySession {
+	return &registrySession{
+		checker:    r,
+		registry:   registry,
+		repository: repository,
+		credential: credential,
+	}
+}
+
+// do sends a request for a path under the repository, such as
+// manifests/latest. The caller must close the response body. If the registry
+// refuses to issue a token, the response is nil and the status code is that
+// of the token service's response.
+func (s *registrySession) do(ctx context.Context, method, path, accept string) (*http.Response, int, error) {
+	requestURL := fmt.Sprintf("https://%s/v2/%s/%s", s.registry, s.repository, path)
+
+	send := func() (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, method, requestURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		if s.authorization != "" {
+			req.Header.Set("Authorization", s.authorization)
+		}
+		resp, err := s.checker.client.Do(req)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error from %s %s", method, requestURL)
+		}
+		return resp, nil
+	}
+
+	resp, err := send()
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.StatusCode != http.StatusUnauthorized || s.authorization != "" {
+		return resp, resp.StatusCode, nil
+	}
+
+	challenge := parseBearerChallenge(resp.Header.Get("WWW-Authenticate"))
+	if challenge == nil {
+		return resp, resp.StatusCode, nil
+	}
+	resp.Body.Close()
+
+	token, status, err := s.checker.token(ctx, challenge, s.credential)
+	if err != nil {
+		return nil, 0, err
+	}
+	if token == "" {
+		return nil, status, nil
+	}
+	s.authorization = "Bearer " + token
+
+	if resp, err = send(); err != nil {
+		return nil, 0, err
+	}
+	return resp, resp.StatusCode, nil
+}
+
+// manifestStatus returns the status code of a HEAD request for the image's
+// manifest, authenticating with the credential if the registry asks for it.
+func (r *RegistryChecker) manifestStatus(ctx context.Context, registry, repository, reference string, credential *RegistryCredential) (int, error) {
+	resp, status, err := r.newSession(registry, repository, credential).do(ctx, http.MethodHead, "manifests/"+reference, manifestMediaTypes)
+	if err != nil {
+		return 0, err
+	}
+	if resp != nil {
+		resp.Body.Close()
+	}
+	return status, nil
+}
+
+// splitImage returns the registry, repository, and tag or digest of the
+// analysis's image.
+func splitImage(image *model.ContainerImage) (string, string, string) {
+	registry, repository, _ := strings.Cut(normalizeImage(image.Name), "/")
+
+	reference := image.Tag
+	if at := strings.LastIndex(repository, "@"); at >= 0 {
+		repository, reference = repository[:at], repository[at+1:]
+	} else if colon := strings.LastIndex(repository, ":"); colon > strings.LastIndex(repository, "/") {
+		repository, reference = repository[:colon], repository[colon+1:]
+	}
+	if reference == "" {
+		reference = "latest"
+	}
+
+	return registry, repository, reference
+}
+
+const getRegistryCredentialSQL = `
+	SELECT registry, project, username, secret
+	  FROM vice_registry_credentials
+	 WHERE registry = $1
+	   AND project = $2
+`
+
+const listRegistryCredentialsSQL = `
+	SELECT registry, project, username, secret
+	  FROM vice_registry_credentials
+	 ORDER BY registry, project
+`
+
+const upsertRegistryCredentialSQL = `
+	INSERT INTO vice_registry_credentials (registry, project, username, secret)
+	VALUES ($1, $2, $3, $4)
+	ON CONFLICT (registry, project) DO UPDATE
+	   SET username = EXCLUDED.username,
+	       secret = EXCLUDED.secret
+`
+
+// The secret is only replaced if it hasn't changed since it was read, so
+// re-encrypting it never overwrites a secret set in the meantime.
+const reencryptRegistrySecretSQL = `
+	UPDATE vice_registry_credentials
+	   SET secret = $4
+	 WHERE registry = $1
+	   AND project = $2
+	   AND secret = $3
+`
+
+const deleteRegistryCredentialSQL = `
+	DELETE FROM vice_registry_credentials
+	 WHERE registry = $1
+	   AND project = $2
+`
+
+// registryCredential returns the robot account for the registry project, or
+// nil if there isn't one.
+func (i *Internal) registryCredential(ctx context.Context, registry, project string) (*RegistryCredential, error) {
+	credential := &RegistryCredential{}
+	err := i.db.GetContext(ctx, credential, getRegistryCredentialSQL, registry, project)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting the credentials for project %s in %s", project, registry)
+	}
+
+	stored := credential.Secret
+	if credential.Secret, err = i.SecretKeys.Decrypt(stored); err != nil {
+		return nil, errors.Wrapf(err, "error decrypting the credentials for project %s in %s", project, registry)
+	}
+
+	// Secrets stored before encryption was configured or encrypted with an
+	// old key are encrypted again with the current key as they're used.
+	if i.SecretKeys.Stale(stored) {
+		if _, err = i.reencryptRegistrySecret(ctx, credential, stored); err != nil {
+			log.WithContext(ctx).Error(err)
+		}
+	}
+
+	return credential, nil
+}
+
+// reencryptRegistrySecret stores the credential's secret encrypted with the
+// current key in place of the stored value. Returns false if the stored value
+// has changed since it was read.
+func (i *Internal) reencryptRegistrySecret(ctx context.Context, credential *RegistryCredential, stored string) (bool, error) {
+	encrypted, err := i.SecretKeys.Encrypt(credential.Secret)
+	if err != nil {
+		return false, err
+	}
+
+	result, err := i.db.ExecContext(ctx, reencryptRegistrySecretSQL, credential.Registry, credential.Project, stored, encrypted)
+	if err != nil {
+		return false, errors.Wrapf(err, "error re-encrypting the credentials for project %s in %s", credential.Project, credential.Registry)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// checkImageAccess returns an error if the analysis's image is in one of the
+// checked registries and either doesn't exist or can't be pulled by the DE.
+// Images in private projects are checked with the project's robot account.
+// Launches go ahead if the registry can't be reached, since the image may
+// still be pullable from a mirror or the nodes' caches.
+func (i *Internal) checkImageAccess(ctx context.Context, job *model.Job) error {
+	if i.registries == nil || len(job.Steps) == 0 {
+		return nil
+	}
+
+	image := &job.Steps[0].Component.Container.Image
+	registry, repository, reference := splitImage(image)
+	if !i.registries.registries[registry] {
+		return nil
+	}
+	project, _, _ := strings.Cut(repository, "/")
+
+	credential, err := i.registryCredential(ctx, registry, project)
+	if err != nil {
+		return err
+	}
+
+	status, err := i.registries.manifestStatus(ctx, registry, repository, reference, credential)
+	if err != nil {
+		log.WithContext(ctx).Errorf("unable to check access to image %s: %s", image.Name, err)
+		return nil
+	}
+
+	details := &map[string]interface{}{
+		"image":    fmt.Sprintf("%s/%s:%s", registry, repository, reference),
+		"registry": registry,
+		"project":  project,
+	}
+	switch status {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		robot := "the DE's robot account"
+		if i.ImageAccess.RobotAccount != "" {
+			robot = fmt.Sprintf("the DE's robot account %s", i.ImageAccess.RobotAccount)
+		}
+		return common.ErrorResponse{
+			ErrorCode: "ERR_IMAGE_PRIVATE",
+			Message: fmt.Sprintf(
+				"image %s is private; grant %s pull access to the %s project in %s",
+				image.Name, robot, project, registry,
+			),
+			Details: details,
+		}
+	case http.StatusNotFound:
+		return common.ErrorResponse{
+			ErrorCode: "ERR_IMAGE_NOT_FOUND",
+			Message:   fmt.Sprintf("image %s:%s doesn't exist in %s", repository, reference, registry),
+			Details:   details,
+		}
+	case http.StatusOK:
+		return nil
+	default:
+		log.WithContext(ctx).Warnf("unexpected status %d checking access to image %s", status, image.Name)
+		return nil
+	}
+}
+
+// AdminListRegistryCredentialsHandler lists the robot accounts for the
+// private registry projects. The secrets aren't included.
+func (i *Internal) AdminListRegistryCredentialsHandler(c echo.Context) error {
+	credentials := []RegistryCredential{}
+	if err := i.db.SelectContext(c.Request().Context(), &credentials, listRegistryCredentialsSQL); err != nil {
+		return err
+	}
+	for idx := range credentials {
+		credentials[idx].KeyID = secretKeyID(credentials[idx].Secret)
+		credentials[idx].Secret = ""
+	}
+
+	return c.JSON(http.StatusOK, map[string][]RegistryCredential{
+		"credentials": credentials,
+	})
+}
+
+// AdminSetRegistryCredentialHandler sets the robot account used to check
+// images in a private registry project.
+func (i *Internal) AdminSetRegistryCredentialHandler(c echo.Context) error {
+	credential := &RegistryCredential{}
+	if err := c.Bind(credential); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	credential.Registry = c.Param("registry")
+	credential.Project = c.Param("project")
+
+	if credential.Username == "" || credential.Secret == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "username and secret must be set")
+	}
+
+	encrypted, err := i.SecretKeys.Encrypt(credential.Secret)
+	if err != nil {
+		return err
+	}
+
+	_, err = i.db.ExecContext(
+		c.Request().Context(),
+		upsertRegistryCredentialSQL,
+		credential.Registry,
+		credential.Project,
+		credential.Username,
+		encrypted,
+	)
+	if err != nil {
+		return errors.Wrapf(err, "error setting the credentials for project %s in %s", credential.Project, credential.Registry)
+	}
+
+	credential.Secret = ""
+	credential.KeyID = i.SecretKeys.CurrentKeyID()
+	return c.JSON(http.StatusOK, credential)
+}
+
+// AdminDeleteRegistryCredentialHandler deletes the robot account for a
+// private registry project.
+func (i *Internal) AdminDeleteRegistryCredentialHandler(c echo.Context) error {
+	registry, project := c.Param("registry"), c.Param("project")
+
+	result, err := i.db.ExecContext(c.Request().Context(), deleteRegistryCredentialSQL, registry, project)
+	if err != nil {
+		return errors.Wrapf(err, "error deleting the credentials for project %s in %s", project, registry)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("no credentials for project %s in %s", project, registry))
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// SecretReencryption is the result of re-encrypting the stored secrets with
+// the current key.
+type SecretReencryption struct {
+	KeyID       string   `json:"key_id"`
+	Reencrypted int      `json:"reencrypted"`
+	Failed      []string `json:"failed"`
+}
+
+// AdminReencryptRegistryCredentialsHandler encrypts the registry secrets that
+// aren't encrypted with the current key again, so that the old keys can be
+// removed. Secrets are also re-encrypted as they're used, but the ones for
+// projects nobody launches from would otherwise never be.
+func (i *Internal) AdminReencryptRegistryCredentialsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if i.SecretKeys == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "no secret keys are configured")
+	}
+
+	credentials := []RegistryCredential{}
+	if err := i.db.SelectContext(ctx, &credentials, listRegistryCredentialsSQL); err != nil {
+		return err
+	}
+
+	result := &SecretReencryption{
+		KeyID:  i.SecretKeys.CurrentKeyID(),
+		Failed: []string{},
+	}
+	for idx := range credentials {
+		credential := &credentials[idx]
+		stored := credential.Secret
+		if !i.SecretKeys.Stale(stored) {
+			continue
+		}
+
+		name := credential.Registry + "/" + credential.Project
+		var err error
+		if credential.Secret, err = i.SecretKeys.Decrypt(stored); err != nil {
+			log.WithContext(ctx).Error(errors.Wrapf(err, "error decrypting the credentials for %s", name))
+			result.Failed = append(result.Failed, name)
+			continue
+		}
+
+		// The secret was changed since it was listed if nothing was updated,
+		// and it's encrypted with the current key in that case.
+		updated, err := i.reencryptRegistrySecret(ctx, credential, stored)
+		if err != nil {
+			log.WithContext(ctx).Error(err)
+			result.Failed = append(result.Failed, name)
+			continue
+		}
+		if updated {
+			result.Reencrypted++
+		}
+	}
+
+	return c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,149 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/cyverse-de/model/v6"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+)
+
+// newFakeHarbor returns a registry that serves de/jupyter:latest to anyone
+// and private/rstudio:latest to the robot account.
+func newFakeHarbor(t *testing.T) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/service/token" {
+			username, password, ok := r.BasicAuth()
+			scope := r.URL.Query().Get("scope")
+			switch {
+			case ok && (username != "robot$private" || password != "secret"):
+				w.WriteHeader(http.StatusUnauthorized)
+			case ok:
+				_, _ = w.Write([]byte(`{"token": "robot"}`))
+			case strings.HasPrefix(scope, "repository:private/"):
+				_, _ = w.Write([]byte(`{"token": "anonymous-private"}`))
+			default:
+				_, _ = w.Write([]byte(`{"token": "anonymous"}`))
+			}
+			return
+		}
+
+		repository := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v2/"), "/manifests/latest")
+		authorization := r.Header.Get("Authorization")
+		if authorization == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+server.URL+`/service/token",service="harbor-registry",scope="repository:`+repository+`:pull"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		switch {
+		case repository == "de/jupyter":
+			w.WriteHeader(http.StatusOK)
+		case repository == "private/rstudio" && authorization == "Bearer robot":
+			w.WriteHeader(http.StatusOK)
+		case repository == "private/rstudio":
+			w.WriteHeader(http.StatusUnauthorized)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func imageJob(name string) *model.Job {
+	return &model.Job{Steps: []model.Step{{
+		Component: model.StepComponent{
+			Container: model.Container{Image: model.ContainerImage{Name: name, Tag: "latest"}},
+		},
+	}}}
+}
+
+func TestImageAccessConfigValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError((&ImageAccessConfig{}).Validate())
+	assert.NoError((&ImageAccessConfig{Enabled: true, Registries: []string{"harbor.cyverse.org"}}).Validate())
+	assert.Error((&ImageAccessConfig{Enabled: true}).Validate())
+	assert.Error((&ImageAccessConfig{Enabled: true, Registries: []string{"harbor.cyverse.org/de"}}).Validate())
+}
+
+func TestSplitImage(t *testing.T) {
+	assert := assert.New(t)
+
+	registry, repository, reference := splitImage(&model.ContainerImage{Name: "harbor.cyverse.org/de/jupyter", Tag: "v1"})
+	assert.Equal([]string{"harbor.cyverse.org", "de/jupyter", "v1"}, []string{registry, repository, reference})
+
+	registry, repository, reference = splitImage(&model.ContainerImage{Name: "localhost:5000/de/jupyter:v2"})
+	assert.Equal([]string{"localhost:5000", "de/jupyter", "v2"}, []string{registry, repository, reference})
+
+	registry, repository, reference = splitImage(&model.ContainerImage{Name: "ubuntu"})
+	assert.Equal([]string{"docker.io", "library/ubuntu", "latest"}, []string{registry, repository, reference})
+}
+
+func TestCheckImageAccess(t *testing.T) {
+	assert := assert.New(t)
+
+	harbor := newFakeHarbor(t)
+	host := strings.TrimPrefix(harbor.URL, "https://")
+
+	mockdb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockdb.Close()
+
+	i := &Internal{
+		Init: Init{
+			ImageAccess: ImageAccessConfig{Enabled: true, Registries: []string{host}, RobotAccount: "robot$de"},
+		},
+		db: sqlx.NewDb(mockdb, "sqlmock"),
+	}
+	i.registries = NewRegistryChecker(&i.ImageAccess)
+	i.registries.client = harbor.Client()
+
+	credentialColumns := []string{"registry", "project", "username", "secret"}
+	ctx := context.Background()
+
+	// Public images don't need credentials.
+	mock.ExpectQuery("FROM vice_registry_credentials").WithArgs(host, "de").WillReturnRows(sqlmock.NewRows(credentialColumns))
+	assert.NoError(i.checkImageAccess(ctx, imageJob(host+"/de/jupyter")))
+
+	// Private images fail without the project's robot account.
+	mock.ExpectQuery("FROM vice_registry_credentials").WithArgs(host, "private").WillReturnRows(sqlmock.NewRows(credentialColumns))
+	err = i.checkImageAccess(ctx, imageJob(host+"/private/rstudio"))
+	if assert.Error(err) {
+		assert.Equal("ERR_IMAGE_PRIVATE", err.(common.ErrorResponse).ErrorCode)
+		assert.Contains(err.Error(), "robot$de")
+	}
+
+	// Or with the wrong one.
+	mock.ExpectQuery("FROM vice_registry_credentials").WithArgs(host, "private").
+		WillReturnRows(sqlmock.NewRows(credentialColumns).AddRow(host, "private", "robot$private", "expired"))
+	err = i.checkImageAccess(ctx, imageJob(host+"/private/rstudio"))
+	if assert.Error(err) {
+		assert.Equal("ERR_IMAGE_PRIVATE", err.(common.ErrorResponse).ErrorCode)
+	}
+
+	mock.ExpectQuery("FROM vice_registry_credentials").WithArgs(host, "private").
+		WillReturnRows(sqlmock.NewRows(credentialColumns).AddRow(host, "private", "robot$private", "secret"))
+	assert.NoError(i.checkImageAccess(ctx, imageJob(host+"/private/rstudio")))
+
+	mock.ExpectQuery("FROM vice_registry_credentials").WithArgs(host, "de").WillReturnRows(sqlmock.NewRows(credentialColumns))
+	err = i.checkImageAccess(ctx, imageJob(host+"/de/missing"))
+	if assert.Error(err) {
+		assert.Equal("ERR_IMAGE_NOT_FOUND", err.(common.ErrorResponse).ErrorCode)
+	}
+
+	// Images in other registries aren't checked.
+	assert.NoError(i.checkImageAccess(ctx, imageJob("jupyter/datascience-notebook")))
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
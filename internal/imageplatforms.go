@@ -0,0 +1,253 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/cyverse-de/model/v6"
+	"github.com/pkg/errors"
+)
+
+// defaultImagePlatform is the platform the images must support if the
+// configuration doesn't say.
+const defaultImagePlatform = "linux/amd64"
+
+// maxManifestSize limits the size of the manifests and image configurations
+// read from registries.
+const maxManifestSize = 4 << 20
+
+// The manifest media types that list the manifests for several platforms.
+var manifestListMediaTypes = map[string]bool{
+	"application/vnd.oci.image.index.v1+json":                   true,
+	"application/vnd.docker.distribution.manifest.list.v2+json": true,
+}
+
+// ImagePlatformsConfig contains the settings for checking that the images of
+// an analysis's steps can run on the cluster's nodes before the analysis is
+// launched.
+type ImagePlatformsConfig struct {
+	Enabled bool
+
+	// Platform is the OS and architecture of the nodes, such as linux/amd64
+	// or linux/arm64/v8.
+	Platform string
+
+	// Timeout limits how long checking each image can take.
+	Timeout time.Duration
+}
+
+// Validate returns an error if the configuration can't be used.
+func (c *ImagePlatformsConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if _, err := parsePlatform(c.platform()); err != nil {
+		return err
+	}
+	return nil
+}
+
+// platform returns the platform the images must support.
+func (c *ImagePlatformsConfig) platform() string {
+	if c.Platform == "" {
+		return defaultImagePlatform
+	}
+	return c.Platform
+}
+
+// Platform is the OS and CPU architecture an image was built for.
+type Platform struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// parsePlatform parses a platform in os/arch[/variant] form.
+func parsePlatform(platform string) (Platform, error) {
+	parts := strings.Split(platform, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return Platform{}, fmt.Errorf("invalid platform %q; must be os/arch or os/arch/variant", platform)
+	}
+	p := Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+func (p Platform) String() string {
+	if p.Variant == "" {
+		return fmt.Sprintf("%s/%s", p.OS, p.Architecture)
+	}
+	return fmt.Sprintf("%s/%s/%s", p.OS, p.Architecture, p.Variant)
+}
+
+// supports returns true if an image built for the platform can run on nodes
+// of the required platform. The variant only has to match if the required
+// platform has one.
+func (p Platform) supports(required Platform) bool {
+	return p.OS == required.OS &&
+		p.Architecture == required.Architecture &&
+		(required.Variant == "" || p.Variant == "" || p.Variant == required.Variant)
+}
+
+// imageManifest contains the fields of image manifests and manifest lists
+// that describe which platforms the image supports.
+type imageManifest struct {
+	MediaType string `json:"mediaType"`
+	Manifests []struct {
+		Platform *Platform `json:"platform"`
+	} `json:"manifests"`
+	Config struct {
+		Digest string `json:"digest"`
+	} `json:"config"`
+}
+
+// getJSON decodes the response for a path under the session's repository.
+// Returns the response's media type.
+func (s *registrySession) getJSON(ctx context.Context, path, accept string, v interface{}) (string, error) {
+	resp, status, err := s.do(ctx, http.MethodGet, path, accept)
+	if err != nil {
+		return "", err
+	}
+	if resp == nil {
+		return "", fmt.Errorf("status %d requesting a token for %s", status, s.repository)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status %d from GET %s/%s", resp.StatusCode, s.repository, path)
+	}
+
+	if err = json.NewDecoder(io.LimitReader(resp.Body, maxManifestSize)).Decode(v); err != nil {
+		return "", errors.Wrapf(err, "error decoding %s/%s", s.repository, path)
+	}
+
+	mediaType, _, _ := strings.Cut(resp.Header.Get("Content-Type"), ";")
+	return mediaType, nil
+}
+
+// imagePlatforms returns the platforms an image supports. Images with a
+// single manifest support the platform in their configuration.
+func (r *RegistryChecker) imagePlatforms(ctx context.Context, registry, repository, reference string, credential *RegistryCredential) ([]Platform, error) {
+	session := r.newSession(registry, repository, credential)
+
+	manifest := &imageManifest{}
+	mediaType, err := session.getJSON(ctx, "manifests/"+reference, manifestMediaTypes, manifest)
+	if err != nil {
+		return nil, err
+	}
+	if manifest.MediaType != "" {
+		mediaType = manifest.MediaType
+	}
+
+	platforms := []Platform{}
+	if manifestListMediaTypes[mediaType] {
+		for _, entry := range manifest.Manifests {
+			// Attestations are listed with an unknown platform.
+			if entry.Platform != nil && entry.Platform.OS != "unknown" {
+				platforms = append(platforms, *entry.Platform)
+			}
+		}
+		return platforms, nil
+	}
+
+	if manifest.Config.Digest == "" {
+		return nil, fmt.Errorf("the manifest for %s:%s doesn't have a configuration", repository, reference)
+	}
+
+	config := &Platform{}
+	if _, err = session.getJSON(ctx, "blobs/"+manifest.Config.Digest, "", config); err != nil {
+		return nil, err
+	}
+	return append(platforms, *config), nil
+}
+
+// IncompatibleStep describes a step whose image doesn't support the
+// platform of the cluster's nodes.
+type IncompatibleStep struct {
+	Step      int      `json:"step"`
+	Name      string   `json:"name"`
+	Image     string   `json:"image"`
+	Platforms []string `json:"platforms"`
+}
+
+// checkImagePlatforms returns an error listing the steps of the job whose
+// images don't support the platform of the cluster's nodes, which would
+// otherwise fail with exec format errors once they start. Images are checked
+// with the robot account for their project if the registry is one of the
+// ones image access is checked for. Steps whose images can't be checked are
+// allowed.
+func (i *Internal) checkImagePlatforms(ctx context.Context, job *model.Job) error {
+	if i.platforms == nil {
+		return nil
+	}
+
+	required, err := parsePlatform(i.ImagePlatforms.platform())
+	if err != nil {
+		return err
+	}
+
+	incompatible := []IncompatibleStep{}
+	for idx := range job.Steps {
+		step := &job.Steps[idx]
+		image := &step.Component.Container.Image
+		registry, repository, reference := splitImage(image)
+
+		var credential *RegistryCredential
+		if i.registries != nil && i.registries.registries[registry] {
+			project, _, _ := strings.Cut(repository, "/")
+			if credential, err = i.registryCredential(ctx, registry, project); err != nil {
+				return err
+			}
+		}
+
+		platforms, err := i.platforms.imagePlatforms(ctx, registry, repository, reference, credential)
+		if err != nil {
+			log.WithContext(ctx).Errorf("unable to check the platforms of image %s: %s", image.Name, err)
+			continue
+		}
+
+		supported := false
+		names := []string{}
+		for _, platform := range platforms {
+			supported = supported || platform.supports(required)
+			names = append(names, platform.String())
+		}
+		if !supported {
+			incompatible = append(incompatible, IncompatibleStep{
+				Step:      idx + 1,
+				Name:      step.Component.Name,
+				Image:     fmt.Sprintf("%s/%s:%s", registry, repository, reference),
+				Platforms: names,
+			})
+		}
+	}
+
+	if len(incompatible) == 0 {
+		return nil
+	}
+
+	reports := []string{}
+	for _, step := range incompatible {
+		reports = append(reports, fmt.Sprintf("step %d uses %s, which supports %s", step.Step, step.Image, strings.Join(step.Platforms, ", ")))
+	}
+
+	return common.ErrorResponse{
+		ErrorCode: "ERR_IMAGE_PLATFORM_UNSUPPORTED",
+		Message: fmt.Sprintf(
+			"the images for %d step(s) don't support %s: %s",
+			len(incompatible), required, strings.Join(reports, "; "),
+		),
+		Details: &map[string]interface{}{
+			"platform": required.String(),
+			"steps":    incompatible,
+		},
+	}
+}
@@ -0,0 +1,128 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/cyverse-de/model/v6"
+	"github.com/stretchr/testify/assert"
+)
+
+// newFakePlatformRegistry returns a registry with a multi-platform image, an
+// image that's only built for arm64, and a single-platform amd64 image.
+func newFakePlatformRegistry(t *testing.T) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			_, _ = w.Write([]byte(`{"token": "anonymous"}`))
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer anonymous" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+server.URL+`/token",service="registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/v2/de/jupyter/manifests/latest":
+			w.Header().Set("Content-Type", "application/vnd.oci.image.index.v1+json")
+			_, _ = w.Write([]byte(`{"manifests": [
+				{"platform": {"os": "linux", "architecture": "amd64"}},
+				{"platform": {"os": "linux", "architecture": "arm64", "variant": "v8"}},
+				{"platform": {"os": "unknown", "architecture": "unknown"}}
+			]}`))
+		case "/v2/de/arm/manifests/latest":
+			_, _ = w.Write([]byte(`{
+				"mediaType": "application/vnd.docker.distribution.manifest.list.v2+json",
+				"manifests": [{"platform": {"os": "linux", "architecture": "arm64", "variant": "v8"}}]
+			}`))
+		case "/v2/de/rstudio/manifests/latest":
+			w.Header().Set("Content-Type", "application/vnd.docker.distribution.manifest.v2+json")
+			_, _ = w.Write([]byte(`{"config": {"digest": "sha256:abc"}}`))
+		case "/v2/de/rstudio/blobs/sha256:abc":
+			_, _ = w.Write([]byte(`{"os": "linux", "architecture": "amd64", "rootfs": {}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestParsePlatform(t *testing.T) {
+	assert := assert.New(t)
+
+	platform, err := parsePlatform("linux/arm64/v8")
+	if assert.NoError(err) {
+		assert.Equal(Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}, platform)
+		assert.Equal("linux/arm64/v8", platform.String())
+	}
+
+	for _, invalid := range []string{"", "linux", "linux/", "linux/arm64/v8/x"} {
+		_, err = parsePlatform(invalid)
+		assert.Error(err, invalid)
+	}
+
+	assert.NoError((&ImagePlatformsConfig{Enabled: true}).Validate())
+	assert.Error((&ImagePlatformsConfig{Enabled: true, Platform: "amd64"}).Validate())
+
+	amd64 := Platform{OS: "linux", Architecture: "amd64"}
+	assert.True(amd64.supports(amd64))
+	assert.False(Platform{OS: "linux", Architecture: "arm64"}.supports(amd64))
+	assert.True(Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}.supports(Platform{OS: "linux", Architecture: "arm64"}))
+	assert.False(Platform{OS: "linux", Architecture: "arm", Variant: "v6"}.supports(Platform{OS: "linux", Architecture: "arm", Variant: "v7"}))
+}
+
+func TestCheckImagePlatforms(t *testing.T) {
+	assert := assert.New(t)
+
+	registry := newFakePlatformRegistry(t)
+	host := strings.TrimPrefix(registry.URL, "https://")
+
+	i := &Internal{
+		Init:      Init{ImagePlatforms: ImagePlatformsConfig{Enabled: true}},
+		platforms: &RegistryChecker{client: registry.Client()},
+	}
+	ctx := context.Background()
+
+	stepsJob := func(names ...string) *model.Job {
+		job := &model.Job{}
+		for _, name := range names {
+			step := model.Step{}
+			step.Component.Name = strings.TrimPrefix(name, host+"/de/")
+			step.Component.Container.Image = model.ContainerImage{Name: name, Tag: "latest"}
+			job.Steps = append(job.Steps, step)
+		}
+		return job
+	}
+
+	assert.NoError(i.checkImagePlatforms(ctx, stepsJob(host+"/de/jupyter", host+"/de/rstudio")))
+
+	// Images that can't be checked are allowed.
+	assert.NoError(i.checkImagePlatforms(ctx, stepsJob(host+"/de/missing")))
+
+	err := i.checkImagePlatforms(ctx, stepsJob(host+"/de/jupyter", host+"/de/arm"))
+	if assert.Error(err) {
+		response := err.(common.ErrorResponse)
+		assert.Equal("ERR_IMAGE_PLATFORM_UNSUPPORTED", response.ErrorCode)
+		assert.Contains(response.Message, "step 2 uses "+host+"/de/arm:latest, which supports linux/arm64/v8")
+		steps := (*response.Details)["steps"].([]IncompatibleStep)
+		if assert.Len(steps, 1) {
+			assert.Equal(2, steps[0].Step)
+			assert.Equal("arm", steps[0].Name)
+		}
+	}
+
+	// The same images are fine on arm64 nodes, except for the amd64-only one.
+	i.ImagePlatforms.Platform = "linux/arm64"
+	assert.NoError(i.checkImagePlatforms(ctx, stepsJob(host+"/de/jupyter", host+"/de/arm")))
+	assert.Error(i.checkImagePlatforms(ctx, stepsJob(host+"/de/rstudio")))
+
+	// Nothing is checked when the check is disabled.
+	i.platforms = nil
+	assert.NoError(i.checkImagePlatforms(ctx, stepsJob(host+"/de/rstudio")))
+}
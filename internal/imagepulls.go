@@ -0,0 +1,344 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	apiv1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// imagePullRewatchDelay is how long to wait before re-establishing the event
+// watch after it closes or fails.
+const imagePullRewatchDelay = 5 * time.Second
+
+// The kubelet event reasons that describe image pulls.
+const (
+	pullingReason = "Pulling"
+	pulledReason  = "Pulled"
+	failedReason  = "Failed"
+	backOffReason = "BackOff"
+)
+
+var (
+	// pullImageRegexp extracts the image from the kubelet's image pull event
+	// messages, which quote it.
+	pullImageRegexp = regexp.MustCompile(`image "([^"]+)"`)
+
+	// pullDurationRegexp extracts the pull time from the Pulled event
+	// message, for example: Successfully pulled image "x" in 3.105s (3.105s
+	// including waiting).
+	pullDurationRegexp = regexp.MustCompile(`\bin ([0-9][0-9.a-zµ]*s)\b`)
+
+	// containerFieldPathRegexp extracts the container name from the field
+	// path of the object an event is about, for example
+	// spec.containers{analysis}.
+	containerFieldPathRegexp = regexp.MustCompile(`^spec\.(?:init)?[cC]ontainers\{([^}]+)\}$`)
+)
+
+// ImagePull describes how the image for a container in an analysis pod was
+// pulled.
+type ImagePull struct {
+	ExternalID     string     `json:"external_id" db:"external_id"`
+	PodName        string     `json:"pod_name" db:"pod_name"`
+	ContainerName  string     `json:"container_name" db:"container_name"`
+	Image          string     `json:"image" db:"image"`
+	StartedAt      *time.Time `json:"started_at" db:"started_at"`
+	FinishedAt     *time.Time `json:"finished_at" db:"finished_at"`
+	PullSeconds    *float64   `json:"pull_seconds" db:"pull_seconds"`
+	Cached         bool       `json:"cached" db:"cached"`
+	Failures       int32      `json:"failures" db:"failures"`
+	FailureMessage string     `json:"failure_message" db:"failure_message"`
+}
+
+// imagePullFromEvent returns the image pull information in a kubelet event
+// about an analysis pod, and false if the event isn't about an image pull.
+// The returned ImagePull only contains the fields the event provides.
+func imagePullFromEvent(externalID string, event *apiv1.Event) (*ImagePull, bool) {
+	match := containerFieldPathRegexp.FindStringSubmatch(event.InvolvedObject.FieldPath)
+	if match == nil {
+		return nil, false
+	}
+
+	pull := &ImagePull{
+		ExternalID:    externalID,
+		PodName:       event.InvolvedObject.Name,
+		ContainerName: match[1],
+	}
+	if image := pullImageRegexp.FindStringSubmatch(event.Message); image != nil {
+		pull.Image = image[1]
+	}
+
+	when := eventTime(event)
+
+	switch event.Reason {
+	case pullingReason:
+		pull.StartedAt = &when
+
+	case pulledReason:
+		pull.FinishedAt = &when
+		if strings.Contains(event.Message, "already present") {
+			pull.Cached = true
+			pull.StartedAt = &when
+			seconds := 0.0
+			pull.PullSeconds = &seconds
+		} else if duration := pullDurationRegexp.FindStringSubmatch(event.Message); duration != nil {
+			if d, err := time.ParseDuration(duration[1]); err == nil {
+				seconds := d.Seconds()
+				pull.PullSeconds = &seconds
+			}
+		}
+
+	case failedReason, backOffReason:
+		// The same reasons are used for containers that fail to start, so
+		// only the messages about pulling count.
+		if !strings.Contains(strings.ToLower(event.Message), "pull") {
+			return nil, false
+		}
+		pull.Failures = event.Count
+		if pull.Failures < 1 {
+			pull.Failures = 1
+		}
+		pull.FailureMessage = event.Message
+
+	default:
+		return nil, false
+	}
+
+	return pull, true
+}
+
+// The failure counts come from the count of the event, which grows as the
+// kubelet retries, so the largest count is kept. That also makes recording
+// the same event twice harmless, which happens when the watch restarts.
+const upsertImagePullSQL = `
+	INSERT INTO vice_image_pulls (
+		external_id, pod_name, container_name, image, started_at, finished_at,
+		pull_seconds, cached, failures, failure_message
+	)
+	VALUES (
+		:external_id, :pod_name, :container_name, :image, :started_at, :finished_at,
+		:pull_seconds, :cached, :failures, :failure_message
+	)
+	ON CONFLICT (external_id, pod_name, container_name) DO UPDATE
+	   SET image = COALESCE(NULLIF(EXCLUDED.image, ''), vice_image_pulls.image),
+	       started_at = COALESCE(vice_image_pulls.started_at, EXCLUDED.started_at),
+	       finished_at = COALESCE(EXCLUDED.finished_at, vice_image_pulls.finished_at),
+	       pull_seconds = COALESCE(EXCLUDED.pull_seconds, vice_image_pulls.pull_seconds),
+	       cached = vice_image_pulls.cached OR EXCLUDED.cached,
+	       failures = GREATEST(vice_image_pulls.failures, EXCLUDED.failures),
+	       failure_message = COALESCE(NULLIF(EXCLUDED.failure_message, ''), vice_image_pulls.failure_message),
+	       recorded_at = now()
+`
+
+// ImagePullRecorder watches the kubelet events for analysis pods and records
+// how long the images took to pull and whether the pulls failed. It also
+// records the containers the kubelet restarts after failed liveness probes.
+type ImagePullRecorder struct {
+	internal *Internal
+
+	// externalIDs maps the names of analysis pods to their external IDs.
+	mu          sync.Mutex
+	externalIDs map[string]string
+}
+
+// NewImagePullRecorder returns a new *ImagePullRecorder.
+func NewImagePullRecorder(i *Internal) *ImagePullRecorder {
+	return &ImagePullRecorder{
+		internal:    i,
+		externalIDs: map[string]string{},
+	}
+}
+
+// externalID returns the external ID of the analysis running in the pod, or
+// an empty string if the pod isn't part of a VICE analysis.
+func (r *ImagePullRecorder) externalID(ctx context.Context, podName string) (string, error) {
+	r.mu.Lock()
+	externalID, ok := r.externalIDs[podName]
+	r.mu.Unlock()
+	if ok {
+		return externalID, nil
+	}
+
+	pod, err := r.internal.clientset.CoreV1().Pods(r.internal.ViceNamespace).Get(ctx, podName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if pod.Labels["app-type"] == "interactive" {
+		externalID = pod.Labels["external-id"]
+	}
+
+	r.mu.Lock()
+	r.externalIDs[podName] = externalID
+	r.mu.Unlock()
+
+	return externalID, nil
+}
+
+// handleEvent records the image pull information or the liveness probe
+// restart in a single event.
+func (r *ImagePullRecorder) handleEvent(ctx context.Context, watchEvent watch.Event) {
+	event, ok := watchEvent.Object.(*apiv1.Event)
+	if !ok || watchEvent.Type == watch.Deleted || event.InvolvedObject.Kind != "Pod" {
+		return
+	}
+
+	// Check the event before looking up the pod, since most events aren't
+	// about image pulls or restarts.
+	_, isPull := imagePullFromEvent("", event)
+	_, isRestart := containerRestartFromEvent("", event)
+	if !isPull && !isRestart {
+		return
+	}
+
+	externalID, err := r.externalID(ctx, event.InvolvedObject.Name)
+	if err != nil {
+		log.WithContext(ctx).Error(errors.Wrapf(err, "error looking up pod %s for event %s", event.InvolvedObject.Name, event.Reason))
+		return
+	}
+	if externalID == "" {
+		return
+	}
+
+	if isRestart {
+		restart, _ := containerRestartFromEvent(externalID, event)
+		if _, err = r.internal.db.NamedExecContext(ctx, insertContainerRestartSQL, restart); err != nil {
+			log.WithContext(ctx).Error(errors.Wrapf(err, "error recording the restart of container %s in pod %s", restart.ContainerName, restart.PodName))
+		}
+		return
+	}
+
+	pull, _ := imagePullFromEvent(externalID, event)
+	if _, err = r.internal.db.NamedExecContext(ctx, upsertImagePullSQL, pull); err != nil {
+		log.WithContext(ctx).Error(errors.Wrapf(err, "error recording the image pull for container %s in pod %s", pull.ContainerName, pull.PodName))
+	}
+}
+
+// Run watches the events in the VICE namespace until the context is canceled.
+func (r *ImagePullRecorder) Run(ctx context.Context) {
+	eventclient := r.internal.clientset.CoreV1().Events(r.internal.ViceNamespace)
+	selector := fields.OneTermEqualSelector("involvedObject.kind", "Pod").String()
+
+	for {
+		w, err := eventclient.Watch(ctx, metav1.ListOptions{FieldSelector: selector})
+		if err != nil {
+			log.WithContext(ctx).Error(errors.Wrap(err, "error watching analysis pod events for image pulls"))
+		} else {
+			for event := range w.ResultChan() {
+				r.handleEvent(ctx, event)
+			}
+			w.Stop()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(imagePullRewatchDelay):
+		}
+
+		// Pods that have been deleted won't have any more events.
+		r.mu.Lock()
+		r.externalIDs = map[string]string{}
+		r.mu.Unlock()
+	}
+}
+
+// RunImagePullRecorder starts recording image pulls for analysis pods. Blocks
+// until the context is canceled.
+func (i *Internal) RunImagePullRecorder(ctx context.Context) {
+	NewImagePullRecorder(i).Run(ctx)
+}
+
+const listImagePullsSQL = `
+	SELECT external_id, pod_name, container_name, image, started_at, finished_at,
+	       pull_seconds, cached, failures, failure_message
+	  FROM vice_image_pulls
+	 WHERE external_id = $1
+	 ORDER BY pod_name, started_at NULLS LAST, container_name
+`
+
+// listImagePulls returns the image pulls recorded for the analysis.
+func (i *Internal) listImagePulls(ctx context.Context, externalID string) ([]ImagePull, error) {
+	pulls := []ImagePull{}
+	if err := i.db.SelectContext(ctx, &pulls, listImagePullsSQL, externalID); err != nil {
+		return nil, err
+	}
+	return pulls, nil
+}
+
+// ImagePullStats summarizes the pulls of an image across analyses.
+type ImagePullStats struct {
+	Image            string   `json:"image" db:"image"`
+	Pulls            int64    `json:"pulls" db:"pulls"`
+	CachedPulls      int64    `json:"cached_pulls" db:"cached_pulls"`
+	FailedPulls      int64    `json:"failed_pulls" db:"failed_pulls"`
+	MeanPullSeconds  *float64 `json:"mean_pull_seconds" db:"mean_pull_seconds"`
+	MaxPullSeconds   *float64 `json:"max_pull_seconds" db:"max_pull_seconds"`
+	TotalPullSeconds *float64 `json:"total_pull_seconds" db:"total_pull_seconds"`
+}
+
+// The mean only includes pulls that had to download the image, since those
+// are the ones that pre-pulling or slimming would speed up.
+const imagePullStatsSQL = `
+	SELECT image,
+	       count(*) AS pulls,
+	       count(*) FILTER (WHERE cached) AS cached_pulls,
+	       count(*) FILTER (WHERE failures > 0) AS failed_pulls,
+	       avg(pull_seconds) FILTER (WHERE NOT cached) AS mean_pull_seconds,
+	       max(pull_seconds) AS max_pull_seconds,
+	       sum(pull_seconds) AS total_pull_seconds
+	  FROM vice_image_pulls
+	 WHERE image != ''
+	   AND recorded_at >= $1
+	 GROUP BY image
+	 ORDER BY total_pull_seconds DESC NULLS LAST, failed_pulls DESC, image
+	 LIMIT $2
+`
+
+// defaultImagePullStatsLimit is the number of images listed if the request
+// doesn't say.
+const defaultImagePullStatsLimit = 50
+
+// AdminImagePullStatsHandler summarizes the recorded image pulls by image,
+// with the images that spent the most time being pulled first. The optional
+// since query parameter is a duration, such as 168h, limiting the pulls to
+// the ones recorded recently; it defaults to a week.
+func (i *Internal) AdminImagePullStatsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	since, err := durationParam(c, "since", 7*24*time.Hour)
+	if err != nil {
+		return err
+	}
+
+	limit := defaultImagePullStatsLimit
+	if value := c.QueryParam("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit must be a positive integer")
+		}
+		limit = n
+	}
+
+	stats := []ImagePullStats{}
+	if err := i.db.SelectContext(ctx, &stats, imagePullStatsSQL, time.Now().Add(-since), limit); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"images": stats,
+	})
+}
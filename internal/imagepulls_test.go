@@ -0,0 +1,157 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func imagePullEvent(reason, message string, count int32) *apiv1.Event {
+	return &apiv1.Event{
+		ObjectMeta: metav1.ObjectMeta{Name: "a1234-abcde.1", Namespace: "vice-apps"},
+		InvolvedObject: apiv1.ObjectReference{
+			Kind:      "Pod",
+			Name:      "a1234-abcde",
+			FieldPath: "spec.containers{analysis}",
+		},
+		Reason:        reason,
+		Message:       message,
+		Count:         count,
+		LastTimestamp: metav1.NewTime(historyStart),
+	}
+}
+
+func TestImagePullFromEvent(t *testing.T) {
+	assert := assert.New(t)
+
+	pull, ok := imagePullFromEvent("a1234", imagePullEvent(pullingReason, `Pulling image "discoenv/jupyter:v1"`, 1))
+	assert.True(ok)
+	assert.Equal("analysis", pull.ContainerName)
+	assert.Equal("discoenv/jupyter:v1", pull.Image)
+	assert.Equal(historyStart, *pull.StartedAt)
+	assert.Nil(pull.FinishedAt)
+
+	pull, ok = imagePullFromEvent("a1234", imagePullEvent(
+		pulledReason,
+		`Successfully pulled image "discoenv/jupyter:v1" in 3.105s (3.105s including waiting)`,
+		1,
+	))
+	assert.True(ok)
+	assert.False(pull.Cached)
+	assert.InDelta(3.105, *pull.PullSeconds, 0.0001)
+
+	pull, ok = imagePullFromEvent("a1234", imagePullEvent(
+		pulledReason,
+		`Container image "discoenv/jupyter:v1" already present on machine`,
+		1,
+	))
+	assert.True(ok)
+	assert.True(pull.Cached)
+	assert.Equal(0.0, *pull.PullSeconds)
+
+	pull, ok = imagePullFromEvent("a1234", imagePullEvent(
+		failedReason,
+		`Failed to pull image "discoenv/jupyter:v2": manifest unknown`,
+		3,
+	))
+	assert.True(ok)
+	assert.Equal(int32(3), pull.Failures)
+	assert.Equal("discoenv/jupyter:v2", pull.Image)
+
+	pull, ok = imagePullFromEvent("a1234", imagePullEvent(backOffReason, `Back-off pulling image "discoenv/jupyter:v2"`, 0))
+	assert.True(ok)
+	assert.Equal(int32(1), pull.Failures)
+
+	_, ok = imagePullFromEvent("a1234", imagePullEvent(backOffReason, "Back-off restarting failed container", 5))
+	assert.False(ok)
+
+	_, ok = imagePullFromEvent("a1234", imagePullEvent("Scheduled", "Successfully assigned vice-apps/a1234-abcde", 1))
+	assert.False(ok)
+
+	event := imagePullEvent(pullingReason, `Pulling image "discoenv/jupyter:v1"`, 1)
+	event.InvolvedObject.FieldPath = ""
+	_, ok = imagePullFromEvent("a1234", event)
+	assert.False(ok)
+}
+
+func TestImagePullRecorderHandleEvent(t *testing.T) {
+	assert := assert.New(t)
+
+	mockdb, mock, err := sqlmock.New()
+	assert.NoError(err)
+	defer mockdb.Close()
+
+	pod := historyTestPod()
+	pod.Labels["app-type"] = "interactive"
+	otherPod := &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "vice-apps"},
+	}
+
+	i := &Internal{
+		Init:      Init{ViceNamespace: "vice-apps"},
+		clientset: fake.NewSimpleClientset(pod, otherPod),
+		db:        sqlx.NewDb(mockdb, "sqlmock"),
+	}
+	r := NewImagePullRecorder(i)
+
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO vice_image_pulls")).
+		WithArgs(anyArgs(10)...).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	r.handleEvent(context.Background(), watch.Event{
+		Type:   watch.Added,
+		Object: imagePullEvent(pullingReason, `Pulling image "discoenv/jupyter:v1"`, 1),
+	})
+
+	// Events for pods that aren't analyses aren't recorded.
+	event := imagePullEvent(pullingReason, `Pulling image "busybox"`, 1)
+	event.InvolvedObject.Name = "other"
+	r.handleEvent(context.Background(), watch.Event{Type: watch.Added, Object: event})
+
+	assert.Equal("a1234", r.externalIDs[pod.Name])
+	assert.Equal("", r.externalIDs["other"])
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestAdminImagePullStatsHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	mockdb, mock, err := sqlmock.New()
+	assert.NoError(err)
+	defer mockdb.Close()
+
+	i := &Internal{db: sqlx.NewDb(mockdb, "sqlmock")}
+
+	mock.ExpectQuery(regexp.QuoteMeta("FROM vice_image_pulls")).
+		WithArgs(sqlmock.AnyArg(), 10).
+		WillReturnRows(sqlmock.NewRows([]string{
+			"image", "pulls", "cached_pulls", "failed_pulls", "mean_pull_seconds", "max_pull_seconds", "total_pull_seconds",
+		}).AddRow("discoenv/jupyter:v1", 4, 1, 0, 20.0, 30.0, 60.0))
+
+	req := httptest.NewRequest(http.MethodGet, "/?since=24h&limit=10", nil)
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+
+	assert.NoError(i.AdminImagePullStatsHandler(c))
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Contains(rec.Body.String(), `"mean_pull_seconds":20`)
+	assert.NoError(mock.ExpectationsWereMet())
+
+	req = httptest.NewRequest(http.MethodGet, "/?since=yesterday", nil)
+	c = echo.New().NewContext(req, httptest.NewRecorder())
+	err = i.AdminImagePullStatsHandler(c)
+	if assert.Error(err) {
+		assert.Equal(http.StatusBadRequest, err.(*echo.HTTPError).Code)
+	}
+}
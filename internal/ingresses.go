@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/sha256"
 	"fmt"
+	"strings"
 
 	"github.com/cyverse-de/model/v6"
 	apiv1 "k8s.io/api/core/v1"
@@ -11,15 +12,131 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
-// IngressName returns the name of the ingress created for the running VICE
-// analysis. This should match the name created in the apps service.
+// The ways the analyses' Ingresses can get their TLS certificates.
+const (
+	// IngressTLSWildcard uses an existing wildcard certificate for the VICE
+	// domain in every Ingress.
+	IngressTLSWildcard = "wildcard"
+
+	// IngressTLSPerHost has cert-manager issue a certificate for each
+	// analysis's host.
+	IngressTLSPerHost = "per-host"
+)
+
+// The annotations cert-manager reads from Ingresses to issue their
+// certificates.
+const (
+	certManagerIssuerAnnotation        = "cert-manager.io/issuer"
+	certManagerClusterIssuerAnnotation = "cert-manager.io/cluster-issuer"
+)
+
+// IngressTLSConfig contains the settings for terminating TLS at the
+// analyses' Ingresses, for clusters that don't sit behind a load balancer
+// with the wildcard certificate.
+type IngressTLSConfig struct {
+	Enabled bool
+
+	// Mode is IngressTLSWildcard or IngressTLSPerHost.
+	Mode string
+
+	// Domain is the domain the analyses' hosts are in. The Ingresses match
+	// the full host names rather than just the subdomains when TLS is
+	// enabled.
+	Domain string
+
+	// SecretName is the Secret holding the wildcard certificate in wildcard
+	// mode.
+	SecretName string
+
+	// Issuer or ClusterIssuer is the cert-manager issuer for the
+	// certificates in per-host mode.
+	Issuer        string
+	ClusterIssuer string
+}
+
+// Validate returns an error if the configuration can't be used.
+func (c *IngressTLSConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.Domain == "" {
+		return fmt.Errorf("the domain must be set for ingress TLS")
+	}
+
+	switch c.Mode {
+	case IngressTLSWildcard:
+		if c.SecretName == "" {
+			return fmt.Errorf("the secret name must be set for wildcard ingress TLS")
+		}
+	case IngressTLSPerHost:
+		if (c.Issuer == "") == (c.ClusterIssuer == "") {
+			return fmt.Errorf("exactly one of the issuer and the cluster issuer must be set for per-host ingress TLS")
+		}
+	default:
+		return fmt.Errorf("unknown ingress TLS mode %q; it must be %s or %s", c.Mode, IngressTLSWildcard, IngressTLSPerHost)
+	}
+	return nil
+}
+
+// host returns the host name the Ingress for the analysis with the
+// subdomain matches.
+func (c *IngressTLSConfig) host(subdomain string) string {
+	if !c.Enabled {
+		return subdomain
+	}
+	return fmt.Sprintf("%s.%s", subdomain, c.Domain)
+}
+
+// apply adds the TLS section and the cert-manager annotations to the
+// Ingress, which must already have its rule for the host.
+func (c *IngressTLSConfig) apply(ingress *netv1.Ingress, host string) {
+	if !c.Enabled {
+		return
+	}
+
+	// Per-host certificates are stored in a Secret named after the Ingress,
+	// which cert-manager creates.
+	secretName := c.SecretName
+	if c.Mode == IngressTLSPerHost {
+		secretName = fmt.Sprintf("%s-tls", ingress.Name)
+		if ingress.Annotations == nil {
+			ingress.Annotations = map[string]string{}
+		}
+		if c.Issuer != "" {
+			ingress.Annotations[certManagerIssuerAnnotation] = c.Issuer
+		} else {
+			ingress.Annotations[certManagerClusterIssuerAnnotation] = c.ClusterIssuer
+		}
+	}
+
+	ingress.Spec.TLS = []netv1.IngressTLS{
+		{
+			Hosts:      []string{host},
+			SecretName: secretName,
+		},
+	}
+}
+
+// ingressHostMatches returns true if the Ingress rule's host is for the
+// subdomain, whether or not the rule includes the domain.
+func ingressHostMatches(ruleHost, subdomain string) bool {
+	return ruleHost == subdomain || strings.HasPrefix(ruleHost, subdomain+".")
+}
+
+// IngressName returns the hash-based subdomain of the running VICE analysis.
+// This should match the name created in the apps service. The subdomain
+// actually used depends on the configured scheme; see subdomain.
 func IngressName(userID, invocationID string) string {
 	return fmt.Sprintf("a%x", sha256.Sum256([]byte(fmt.Sprintf("%s%s", userID, invocationID))))[0:9]
 }
 
-// getIngress assembles and returns the Ingress needed for the VICE analysis.
-// It does not call the k8s API.
-func (i *Internal) getIngress(ctx context.Context, job *model.Job, svc *apiv1.Service, class string) (*netv1.Ingress, error) {
+// getIngress assembles and returns the Ingress needed for the VICE analysis,
+// including a path for each of the tool's subpath routes. It does not call
+// the k8s API.
+func (i *Internal) getIngress(ctx context.Context, job *model.Job, svc *apiv1.Service, settings *ToolSettings, class string) (*netv1.Ingress, error) {
+	ctx, span := startResourceSpan(ctx, "getIngress", "ingress")
+	defer span.End()
+
 	var (
 		rules       []netv1.IngressRule
 		defaultPort int32
@@ -29,7 +146,7 @@ func (i *Internal) getIngress(ctx context.Context, job *model.Job, svc *apiv1.Se
 	if err != nil {
 		return nil, err
 	}
-	ingressName := IngressName(job.UserID, job.InvocationID)
+	host := i.IngressTLS.host(labels["subdomain"])
 
 	// Find the proxy port, use it as the default
 	for _, port := range svc.Spec.Ports {
@@ -64,31 +181,36 @@ func (i *Internal) getIngress(ctx context.Context, job *model.Job, svc *apiv1.Se
 		},
 	}
 
-	// Add the rule to pass along requests to the Service's proxy port.
+	// Add the rule to pass along requests to the Service's proxy port, after
+	// the paths routed to other ports of the analysis container.
 	pathTytpe := netv1.PathTypeImplementationSpecific
+	paths := routeIngressPaths(svc.Name, settings.Routes)
+	paths = append(paths, netv1.HTTPIngressPath{
+		PathType: &pathTytpe,
+		Backend:  *backend, // service backend, not the default backend
+	})
 	rules = append(rules, netv1.IngressRule{
-		Host: ingressName,
+		Host: host,
 		IngressRuleValue: netv1.IngressRuleValue{
 			HTTP: &netv1.HTTPIngressRuleValue{
-				Paths: []netv1.HTTPIngressPath{
-					{
-						PathType: &pathTytpe,
-						Backend:  *backend, // service backend, not the default backend
-					},
-				},
+				Paths: paths,
 			},
 		},
 	})
 
-	return &netv1.Ingress{
+	ingress := &netv1.Ingress{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:   job.InvocationID,
-			Labels: labels,
+			Name:        job.InvocationID,
+			Labels:      labels,
+			Annotations: i.ingressAnnotations(settings),
 		},
 		Spec: netv1.IngressSpec{
 			DefaultBackend:   defaultBackend, // default backend, not the service backend
 			IngressClassName: &class,
 			Rules:            rules,
 		},
-	}, nil
+	}
+	i.IngressTLS.apply(ingress, host)
+
+	return ingress, nil
 }
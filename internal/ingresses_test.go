@@ -0,0 +1,87 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cyverse-de/app-exposer/apps"
+	"github.com/cyverse-de/model/v6"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIngressTLSConfigValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError((&IngressTLSConfig{}).Validate())
+	assert.NoError((&IngressTLSConfig{Enabled: true, Mode: IngressTLSWildcard, Domain: "cyverse.run", SecretName: "vice-wildcard-tls"}).Validate())
+	assert.NoError((&IngressTLSConfig{Enabled: true, Mode: IngressTLSPerHost, Domain: "cyverse.run", ClusterIssuer: "letsencrypt"}).Validate())
+
+	assert.Error((&IngressTLSConfig{Enabled: true, Mode: IngressTLSWildcard, SecretName: "vice-wildcard-tls"}).Validate())
+	assert.Error((&IngressTLSConfig{Enabled: true, Mode: IngressTLSWildcard, Domain: "cyverse.run"}).Validate())
+	assert.Error((&IngressTLSConfig{Enabled: true, Mode: IngressTLSPerHost, Domain: "cyverse.run"}).Validate())
+	assert.Error((&IngressTLSConfig{Enabled: true, Mode: IngressTLSPerHost, Domain: "cyverse.run", Issuer: "a", ClusterIssuer: "b"}).Validate())
+	assert.Error((&IngressTLSConfig{Enabled: true, Mode: "acme", Domain: "cyverse.run"}).Validate())
+}
+
+func TestIngressTLS(t *testing.T) {
+	assert := assert.New(t)
+
+	mockdb, mock, err := sqlmock.New()
+	assert.NoError(err)
+	defer mockdb.Close()
+
+	a := apps.NewApps(sqlx.NewDb(mockdb, "sqlmock"), "@example.org")
+	a.ConfigureCache(&apps.CacheConfig{MaxEntries: 10, AnalysisIDTTL: time.Hour, UserIPTTL: time.Hour})
+	mock.ExpectQuery("SELECT l.ip_address").WithArgs("u1").WillReturnRows(sqlmock.NewRows([]string{"ip_address"}).AddRow("10.0.0.1"))
+
+	i := &Internal{
+		Init: Init{ViceDefaultBackendService: "vice-default-backend", ViceDefaultBackendServicePort: 80},
+		apps: a,
+	}
+	job := &model.Job{InvocationID: "e1", UserID: "u1", Name: "analysis"}
+	settings := &ToolSettings{}
+	subdomain := IngressName("u1", "e1")
+
+	svc, err := i.getService(context.Background(), job, settings)
+	assert.NoError(err)
+
+	// Without TLS, the Ingress only matches the subdomain.
+	ingress, err := i.getIngress(context.Background(), job, svc, settings, "nginx")
+	assert.NoError(err)
+	assert.Equal(subdomain, ingress.Spec.Rules[0].Host)
+	assert.Empty(ingress.Spec.TLS)
+
+	// Per-host certificates are issued by cert-manager into a Secret named
+	// after the Ingress.
+	i.IngressTLS = IngressTLSConfig{Enabled: true, Mode: IngressTLSPerHost, Domain: "cyverse.run", ClusterIssuer: "letsencrypt"}
+	ingress, err = i.getIngress(context.Background(), job, svc, settings, "nginx")
+	assert.NoError(err)
+	host := subdomain + ".cyverse.run"
+	assert.Equal(host, ingress.Spec.Rules[0].Host)
+	if assert.Len(ingress.Spec.TLS, 1) {
+		assert.Equal([]string{host}, ingress.Spec.TLS[0].Hosts)
+		assert.Equal("e1-tls", ingress.Spec.TLS[0].SecretName)
+	}
+	assert.Equal("letsencrypt", ingress.Annotations[certManagerClusterIssuerAnnotation])
+
+	// The wildcard certificate is shared, and cert-manager isn't involved.
+	i.IngressTLS = IngressTLSConfig{Enabled: true, Mode: IngressTLSWildcard, Domain: "cyverse.run", SecretName: "vice-wildcard-tls"}
+	ingress, err = i.getIngress(context.Background(), job, svc, settings, "nginx")
+	assert.NoError(err)
+	if assert.Len(ingress.Spec.TLS, 1) {
+		assert.Equal([]string{host}, ingress.Spec.TLS[0].Hosts)
+		assert.Equal("vice-wildcard-tls", ingress.Spec.TLS[0].SecretName)
+	}
+	assert.NotContains(ingress.Annotations, certManagerClusterIssuerAnnotation)
+	assert.NotContains(ingress.Annotations, certManagerIssuerAnnotation)
+
+	// Analyses are found by their subdomains either way.
+	assert.True(ingressHostMatches(host, subdomain))
+	assert.True(ingressHostMatches(subdomain, subdomain))
+	assert.False(ingressHostMatches(subdomain+"0.cyverse.run", subdomain))
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
@@ -1,18 +1,23 @@
 package internal
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/cockroachdb/apd"
 	"github.com/cyverse-de/app-exposer/apps"
 	"github.com/cyverse-de/app-exposer/common"
 	"github.com/cyverse-de/app-exposer/permissions"
+	"github.com/cyverse-de/app-exposer/resourcing"
 	"github.com/gosimple/slug"
 	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
@@ -28,6 +33,7 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 
 	"github.com/labstack/echo/v4"
 )
@@ -95,9 +101,65 @@ type Init struct {
 	KeycloakRealm                 string
 	KeycloakClientID              string
 	KeycloakClientSecret          string
+	ProxyAuthBackend              string
+	OIDCIssuerURL                 string
+	OIDCClientID                  string
+	OIDCClientSecret              string
+	ProxyAuth                     ProxyAuth
 	IRODSZone                     string
 	IngressClass                  string
 	NATSEncodedConn               *nats.EncodedConn
+	OutboxMaxAttempts             int
+	OutboxRetryInterval           time.Duration
+	Commands                      CommandsConfig
+	CreatePDBs                    bool
+	EphemeralStorageInterval      time.Duration
+	EphemeralStorageThreshold     float64
+	ReaperInterval                time.Duration
+	ReaperThreshold               time.Duration
+	OrphanReconciler              OrphanReconcilerConfig
+	DiskUsageWarningThreshold     float64
+	DiskUsageCriticalThreshold    float64
+	RESTConfig                    *rest.Config
+	ResourcePresets               resourcing.Presets
+	TerminationGracePeriod        time.Duration
+	TerminationMaxGracePeriod     time.Duration
+	FlushOutputsOnStop            bool
+	Policy                        PolicyConfig
+	KueueQueueName                string
+	CheckGPUCapacity              bool
+	Egress                        EgressConfig
+	CSIMountCheck                 bool
+	CSIMountCheckTimeout          time.Duration
+	CACerts                       CACertsConfig
+	SharedMemory                  SharedMemoryConfig
+	Placement                     PlacementConfig
+	Demo                          DemoConfig
+	Namespaces                    NamespacesConfig
+	LaunchDryRun                  bool
+	LaunchRollback                bool
+	Notifications                 NotificationsConfig
+	TimeLimitWarnings             TimeLimitWarningsConfig
+	TimeLimits                    TimeLimitsConfig
+	RegistryMirrors               RegistryMirrors
+	RegistryPullSecrets           RegistryPullSecrets
+	PullSecrets                   PullSecretsConfig
+	ImageAccess                   ImageAccessConfig
+	SecretKeys                    *SecretKeyRing
+	ImagePlatforms                ImagePlatformsConfig
+	MaxDownloadBytes              int64
+	Embedding                     EmbeddingConfig
+	Maintenance                   MaintenanceConfig
+	HistoryRetention              HistoryRetentionConfig
+	LaunchLimiter                 LaunchLimiterConfig
+	Subdomains                    SubdomainConfig
+	IngressTLS                    IngressTLSConfig
+	Provenance                    ProvenanceConfig
+	TransferAccounting            TransferAccountingConfig
+	SpotNodes                     SpotNodes
+	StartupMonitor                StartupMonitorConfig
+	LogArchive                    LogArchiveConfig
+	SmokeTest                     SmokeTestConfig
 }
 
 // Internal contains information and operations for launching VICE apps inside the
@@ -107,47 +169,104 @@ type Internal struct {
 	clientset       kubernetes.Interface
 	db              *sqlx.DB
 	statusPublisher AnalysisStatusPublisher
+	outbox          *OutboxPublisher
 	apps            *apps.Apps
+	podExec         podExecFunc
+	policy          DeploymentPolicy
+	labelValues     labelValueCache
+	subdomains      subdomainCache
+	notifications   *NotificationAgent
+	registries      *RegistryChecker
+	platforms       *RegistryChecker
+	launchLimiter   *LaunchLimiter
+	hostLocations   hostLocationCache
+	readyStates     readyStates
+	jsl             *JSLPublisher
+
+	// reloadMu guards the settings in Init that can be reloaded.
+	reloadMu sync.RWMutex
+
+	// smokeTestMu keeps more than one smoke test from running at a time.
+	smokeTestMu sync.Mutex
 }
 
 // New creates a new *Internal.
 func New(init *Init, db *sqlx.DB, clientset kubernetes.Interface, apps *apps.Apps) *Internal {
-	return &Internal{
-		Init:      *init,
-		db:        db,
-		clientset: clientset,
-		statusPublisher: &JSLPublisher{
-			statusURL: init.JobStatusURL,
-		},
-		apps: apps,
+	jsl := &JSLPublisher{
+		statusURL: init.JobStatusURL,
+	}
+	outbox := NewOutboxPublisher(
+		jsl,
+		db,
+		init.OutboxMaxAttempts,
+		init.OutboxRetryInterval,
+	)
+
+	i := &Internal{
+		Init:            *init,
+		db:              db,
+		clientset:       clientset,
+		statusPublisher: outbox,
+		outbox:          outbox,
+		apps:            apps,
+		jsl:             jsl,
+	}
+	i.podExec = i.execInPod
+
+	if init.Policy.URL != "" {
+		i.policy = NewWebhookPolicy(&init.Policy)
+	}
+
+	if init.Notifications.Enabled {
+		i.notifications = NewNotificationAgent(&init.Notifications)
+	}
+
+	if init.ImageAccess.Enabled {
+		i.registries = NewRegistryChecker(&init.ImageAccess)
+	}
+
+	if init.ImagePlatforms.Enabled {
+		i.platforms = &RegistryChecker{client: newRegistryClient(init.ImagePlatforms.Timeout)}
 	}
+
+	if init.LaunchLimiter.Enabled {
+		i.launchLimiter = NewLaunchLimiter(&init.LaunchLimiter)
+	}
+
+	return i
 }
 
 // labelsFromJob returns a map[string]string that can be used as labels for K8s resources.
 func (i *Internal) labelsFromJob(ctx context.Context, job *model.Job) (map[string]string, error) {
-	name := []rune(job.Name)
+	ipAddr, err := i.apps.GetUserIP(ctx, job.UserID)
+	if err != nil {
+		return nil, err
+	}
 
-	var stringmax int
-	if len(name) >= 63 {
-		stringmax = 62
-	} else {
-		stringmax = len(name) - 1
+	appName, err := i.labelValue(ctx, appNameKind, job.AppName)
+	if err != nil {
+		return nil, err
 	}
 
-	ipAddr, err := i.apps.GetUserIP(ctx, job.UserID)
+	analysisName, err := i.labelValue(ctx, analysisNameKind, job.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	subdomain, err := i.subdomain(ctx, job)
 	if err != nil {
 		return nil, err
 	}
 
 	return map[string]string{
 		"external-id":   job.InvocationID,
-		"app-name":      labelValueString(job.AppName),
+		"app-name":      appName,
 		"app-id":        job.AppID,
 		"username":      labelValueString(job.Submitter),
 		"user-id":       job.UserID,
-		"analysis-name": labelValueString(string(name[:stringmax])),
+		"analysis-name": analysisName,
 		"app-type":      "interactive",
-		"subdomain":     IngressName(job.UserID, job.InvocationID),
+		"subdomain":     subdomain,
 		"login-ip":      ipAddr,
 	}, nil
 }
@@ -156,7 +275,10 @@ func (i *Internal) labelsFromJob(ctx context.Context, job *model.Job) (map[strin
 // containing the files that should not be uploaded to iRODS. It then calls
 // the k8s API to create the ConfigMap if it does not already exist or to
 // update it if it does.
-func (i *Internal) UpsertExcludesConfigMap(ctx context.Context, job *model.Job) error {
+func (i *Internal) UpsertExcludesConfigMap(ctx context.Context, job *model.Job) (err error) {
+	ctx, span := startResourceSpan(ctx, "UpsertExcludesConfigMap", "configmap")
+	defer func() { recordUpsertError("configmap", err); endSpan(span, err) }()
+
 	excludesCM, err := i.excludesConfigMap(ctx, job)
 	if err != nil {
 		return err
@@ -166,7 +288,7 @@ func (i *Internal) UpsertExcludesConfigMap(ctx context.Context, job *model.Job)
 
 	_, err = cmclient.Get(ctx, excludesConfigMapName(job), metav1.GetOptions{})
 	if err != nil {
-		log.Info(err)
+		log.WithContext(ctx).Info(err)
 		_, err = cmclient.Create(ctx, excludesCM, metav1.CreateOptions{})
 		if err != nil {
 			return err
@@ -184,7 +306,10 @@ func (i *Internal) UpsertExcludesConfigMap(ctx context.Context, job *model.Job)
 // containing the path list of files to download from iRODS for the VICE analysis.
 // It then uses the k8s API to create the ConfigMap if it does not already exist or to
 // update it if it does.
-func (i *Internal) UpsertInputPathListConfigMap(ctx context.Context, job *model.Job) error {
+func (i *Internal) UpsertInputPathListConfigMap(ctx context.Context, job *model.Job) (err error) {
+	ctx, span := startResourceSpan(ctx, "UpsertInputPathListConfigMap", "configmap")
+	defer func() { recordUpsertError("configmap", err); endSpan(span, err) }()
+
 	inputCM, err := i.inputPathListConfigMap(ctx, job)
 	if err != nil {
 		return err
@@ -210,9 +335,37 @@ func (i *Internal) UpsertInputPathListConfigMap(ctx context.Context, job *model.
 
 // UpsertDeployment uses the Job passed in to assemble a Deployment for the
 // VICE analysis. If then uses the k8s API to create the Deployment if it does
-// not already exist or to update it if it does.
-func (i *Internal) UpsertDeployment(ctx context.Context, deployment *appsv1.Deployment, job *model.Job) error {
-	var err error
+// not already exist or to update it if it does. The persistent volumes,
+// Service, and Ingress for the analysis are created along with it.
+func (i *Internal) UpsertDeployment(ctx context.Context, deployment *appsv1.Deployment, job *model.Job, settings *ToolSettings) (err error) {
+	ctx, span := startSpan(ctx, "UpsertDeployment")
+	defer func() { endSpan(span, err) }()
+
+	if err = i.upsertDeploymentResource(ctx, deployment, job); err != nil {
+		return err
+	}
+
+	// Create the persistent volumes and persistent volume claims for the job.
+	if err = i.upsertPersistentVolumes(ctx, job, settings); err != nil {
+		return err
+	}
+
+	// Create the service for the job.
+	svc, err := i.upsertService(ctx, job, settings)
+	if err != nil {
+		return err
+	}
+
+	// Create the ingress for the job
+	return i.upsertIngress(ctx, job, svc, settings)
+}
+
+// upsertDeploymentResource creates the Deployment if it does not already
+// exist or updates it if it does.
+func (i *Internal) upsertDeploymentResource(ctx context.Context, deployment *appsv1.Deployment, job *model.Job) (err error) {
+	ctx, span := startResourceSpan(ctx, "upsertDeploymentResource", "deployment")
+	defer func() { recordUpsertError("deployment", err); endSpan(span, err) }()
+
 	depclient := i.clientset.AppsV1().Deployments(i.ViceNamespace)
 
 	_, err = depclient.Get(ctx, job.InvocationID, metav1.GetOptions{})
@@ -228,8 +381,16 @@ func (i *Internal) UpsertDeployment(ctx context.Context, deployment *appsv1.Depl
 		}
 	}
 
-	// Create the persistent volumes and persistent volume claims for the job.
-	volumes, err := i.getPersistentVolumes(ctx, job)
+	return nil
+}
+
+// upsertPersistentVolumes creates or updates the persistent volumes and
+// persistent volume claims for the job.
+func (i *Internal) upsertPersistentVolumes(ctx context.Context, job *model.Job, settings *ToolSettings) (err error) {
+	ctx, span := startResourceSpan(ctx, "upsertPersistentVolumes", "persistentvolume")
+	defer func() { recordUpsertError("persistentvolume", err); endSpan(span, err) }()
+
+	volumes, err := i.getPersistentVolumes(ctx, job, settings)
 	if err != nil {
 		return err
 	}
@@ -277,22 +438,36 @@ func (i *Internal) UpsertDeployment(ctx context.Context, deployment *appsv1.Depl
 		}
 	}
 
-	// Create the service for the job.
-	svc, err := i.getService(ctx, job)
+	return nil
+}
+
+// upsertService creates the Service for the job if it does not already exist.
+func (i *Internal) upsertService(ctx context.Context, job *model.Job, settings *ToolSettings) (_ *apiv1.Service, err error) {
+	ctx, span := startResourceSpan(ctx, "upsertService", "service")
+	defer func() { recordUpsertError("service", err); endSpan(span, err) }()
+
+	svc, err := i.getService(ctx, job, settings)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	svcclient := i.clientset.CoreV1().Services(i.ViceNamespace)
 	_, err = svcclient.Get(ctx, job.InvocationID, metav1.GetOptions{})
 	if err != nil {
 		_, err = svcclient.Create(ctx, svc, metav1.CreateOptions{})
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 
-	// Create the ingress for the job
-	ingress, err := i.getIngress(ctx, job, svc, i.Init.IngressClass)
+	return svc, nil
+}
+
+// upsertIngress creates the Ingress for the job if it does not already exist.
+func (i *Internal) upsertIngress(ctx context.Context, job *model.Job, svc *apiv1.Service, settings *ToolSettings) (err error) {
+	ctx, span := startResourceSpan(ctx, "upsertIngress", "ingress")
+	defer func() { recordUpsertError("ingress", err); endSpan(span, err) }()
+
+	ingress, err := i.getIngress(ctx, job, svc, settings, i.Init.IngressClass)
 	if err != nil {
 		return err
 	}
@@ -346,35 +521,226 @@ func getMillicoresFromDeployment(deployment *appsv1.Deployment) (*apd.Decimal, e
 		return nil, err
 	}
 
+	// The sidecars' CPU limits count towards the reservation as well.
+	for _, container := range containers {
+		if !isSidecarContainer(container.Name) {
+			continue
+		}
+		limit, ok := container.Resources.Limits[apiv1.ResourceCPU]
+		if !ok {
+			continue
+		}
+		_, err = apd.BaseContext.Add(millicores, millicores, apd.New(limit.MilliValue(), 0))
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	log.Debugf("%s millicores reservation found", millicores.String())
 
 	return millicores, nil
 }
 
+// launchOptions contains the fields in a launch request that aren't part of
+// the job submission.
+type launchOptions struct {
+	// ResourcePreset is the name of the resource preset to use instead of the
+	// resource values in the submission.
+	ResourcePreset string `json:"resource_preset"`
+
+	// SharedMemory is the size of /dev/shm to use instead of the one from the
+	// app, for example 4Gi.
+	SharedMemory string `json:"shared_memory"`
+
+	// Demo is true if the analysis should run in demo mode.
+	Demo bool `json:"demo"`
+
+	// DatasetMetadata describes the dataset the outputs belong to. It's
+	// recorded as AVUs on the outputs.
+	DatasetMetadata *DatasetMetadata `json:"dataset_metadata"`
+
+	// AppVersion is the version of the app being launched. It's recorded in
+	// the provenance manifest, since the job submission doesn't include it.
+	AppVersion string `json:"app_version"`
+
+	// RestoreSnapshot is the ID of a snapshot of the working directory of an
+	// earlier analysis of the same app to restore into the new analysis.
+	RestoreSnapshot string `json:"restore_snapshot"`
+}
+
+// bindLaunchRequest reads the job and the launch options from the request
+// body.
+func bindLaunchRequest(c echo.Context, job *model.Job) (*launchOptions, error) {
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	opts := &launchOptions{}
+	if len(body) > 0 {
+		if err = json.Unmarshal(body, opts); err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+	}
+
+	c.Request().Body = io.NopCloser(bytes.NewReader(body))
+	if err = c.Bind(job); err != nil {
+		return nil, err
+	}
+
+	return opts, nil
+}
+
 // LaunchAppHandler is the HTTP handler that orchestrates the launching of a VICE analysis inside
 // the k8s cluster. This get passed to the router to be associated with a route. The Job
 // is passed in as the body of the request.
-func (i *Internal) LaunchAppHandler(c echo.Context) error {
-	var (
-		job *model.Job
-		err error
-	)
+func (i *Internal) LaunchAppHandler(c echo.Context) (err error) {
+	var job *model.Job
+
+	start := time.Now()
+	defer func() { observeLaunch(time.Since(start), err) }()
 
 	ctx := c.Request().Context()
 
 	job = &model.Job{}
 
-	if err = c.Bind(job); err != nil {
+	opts, err := bindLaunchRequest(c, job)
+	if err != nil {
+		return err
+	}
+
+	// The analysis identifiers are propagated to every service called while
+	// the analysis is launched, so the whole launch shows up in one trace.
+	ctx = withJobBaggage(ctx, job)
+	ctx, span := startSpan(ctx, "LaunchAppHandler")
+	defer func() { endSpan(span, err) }()
+
+	if err = i.checkMaintenance(); err != nil {
+		return err
+	}
+
+	if err = i.checkDemoRequest(opts); err != nil {
 		return err
 	}
 
-	if status, err := i.validateJob(ctx, job); err != nil {
+	if err = validateSubmission(job); err != nil {
+		return err
+	}
+
+	if err = applyDatasetMetadata(job, opts); err != nil {
+		return err
+	}
+
+	// Wait for a turn before anything talks to the cluster, so that a burst
+	// of launches doesn't swamp the k8s API.
+	release, err := i.acquireLaunchSlot(c)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	// Apply the launch options first, so that the quota and GPU checks see
+	// the job that will actually run.
+	if err = i.applyResourcePreset(job, opts); err != nil {
+		return err
+	}
+
+	if err = i.applySharedMemory(job, opts); err != nil {
+		return err
+	}
+
+	if err = i.applySnapshotRestore(ctx, job, opts); err != nil {
+		return err
+	}
+
+	countQuota := !i.skipsQuota(opts)
+	status := http.StatusInternalServerError
+
+	// The GPU limit doesn't depend on QMS, so it's checked before the job
+	// limits. Users who may not use GPUs at all find out right away.
+	if countQuota {
+		err = i.checkUserGPULimit(ctx, job)
+	}
+	if err == nil {
+		status, err = i.validateJob(ctx, job, countQuota)
+	}
+	if err == nil {
+		err = i.checkAppLimits(ctx, job.AppID)
+	}
+	recordQuotaDecision(ctx, job.Submitter, countQuota, err)
+	if err != nil {
 		if validationErr, ok := err.(common.ErrorResponse); ok {
 			return validationErr
 		}
 		return echo.NewHTTPError(status, err.Error())
 	}
 
+	settings, err := i.getToolSettings(ctx, job)
+	if err != nil {
+		return err
+	}
+
+	if err = validateRunAs(job, settings); err != nil {
+		return err
+	}
+
+	if err = validateEntryPoint(job); err != nil {
+		return err
+	}
+
+	if err = i.validateGPURequest(ctx, job, settings); err != nil {
+		return err
+	}
+
+	if err = i.checkImagePullSecret(ctx); err != nil {
+		return err
+	}
+
+	if err = i.checkRegistryPullSecrets(ctx, job); err != nil {
+		return err
+	}
+
+	if err = i.checkImageAccess(ctx, job); err != nil {
+		return err
+	}
+
+	if err = i.checkImagePlatforms(ctx, job); err != nil {
+		return err
+	}
+
+	deployment, err := i.getDeployment(ctx, job, settings)
+	if err != nil {
+		return err
+	}
+	setResourcePresetLabel(deployment, opts)
+	i.applyDemoMode(deployment, job, opts)
+
+	// Give the policy service a chance to change or reject the Deployment
+	// before anything is reserved for it.
+	deployment, err = i.applyDeploymentPolicy(ctx, job, deployment)
+	if err != nil {
+		return err
+	}
+
+	// Make sure the cluster accepts everything before creating any of it.
+	if err = i.dryRunLaunch(ctx, job, deployment, settings); err != nil {
+		return err
+	}
+
+	// Remove whatever was created if the launch fails partway, so that
+	// half-created analyses aren't left behind.
+	if err = i.createLaunchResources(ctx, job, deployment, settings, opts); err != nil {
+		return i.rollBackLaunch(ctx, job, err)
+	}
+
+	return nil
+}
+
+// createLaunchResources creates the resources for the analysis and reserves
+// its millicores.
+func (i *Internal) createLaunchResources(ctx context.Context, job *model.Job, deployment *appsv1.Deployment, settings *ToolSettings, opts *launchOptions) error {
+	var err error
+
 	// Create the excludes file ConfigMap for the job.
 	if err = i.UpsertExcludesConfigMap(ctx, job); err != nil {
 		return err
@@ -385,8 +751,13 @@ func (i *Internal) LaunchAppHandler(c echo.Context) error {
 		return err
 	}
 
-	deployment, err := i.getDeployment(ctx, job)
-	if err != nil {
+	// Create the Secret containing the vice-proxy credentials.
+	if err = i.UpsertProxyCredentialsSecret(ctx, job); err != nil {
+		return err
+	}
+
+	// Create the Secret containing the session token if the tool uses one.
+	if err = i.UpsertSessionTokenSecret(ctx, job, settings); err != nil {
 		return err
 	}
 
@@ -395,12 +766,25 @@ func (i *Internal) LaunchAppHandler(c echo.Context) error {
 		return err
 	}
 
-	if err = i.apps.SetMillicoresReserved(job, millicores); err != nil {
+	if err = i.reserveMillicores(job, millicores, opts); err != nil {
 		return err
 	}
 
 	// Create the deployment for the job.
-	if err = i.UpsertDeployment(ctx, deployment, job); err != nil {
+	if err = i.UpsertDeployment(ctx, deployment, job, settings); err != nil {
+		return err
+	}
+
+	// Record how the analysis was launched so its results can be reproduced.
+	i.recordProvenance(ctx, job, deployment, opts)
+
+	// Create the PodDisruptionBudget for the job if it needs one.
+	if err = i.UpsertPodDisruptionBudget(ctx, job, settings); err != nil {
+		return err
+	}
+
+	// Create the NetworkPolicy limiting the job's egress if it needs one.
+	if err = i.UpsertEgressNetworkPolicy(ctx, job, settings); err != nil {
 		return err
 	}
 
@@ -453,7 +837,13 @@ func (i *Internal) AdminTriggerUploadsHandler(c echo.Context) error {
 	return i.doFileTransfer(ctx, externalID, uploadBasePath, uploadKind, true)
 }
 
-func (i *Internal) doExit(ctx context.Context, externalID string) error {
+func (i *Internal) doExit(ctx context.Context, externalID string) (err error) {
+	ctx = withExternalIDBaggage(ctx, externalID)
+	ctx, span := startSpan(ctx, "doExit")
+
+	var running bool
+	defer func() { recordTermination(running, err); endSpan(span, err) }()
+
 	set := labels.Set(map[string]string{
 		"external-id": externalID,
 	})
@@ -471,7 +861,7 @@ func (i *Internal) doExit(ctx context.Context, externalID string) error {
 
 	for _, ingress := range ingresslist.Items {
 		if err = ingressclient.Delete(ctx, ingress.Name, metav1.DeleteOptions{}); err != nil {
-			log.Error(err)
+			log.WithContext(ctx).Error(err)
 		}
 	}
 
@@ -484,10 +874,39 @@ func (i *Internal) doExit(ctx context.Context, externalID string) error {
 
 	for _, svc := range svclist.Items {
 		if err = svcclient.Delete(ctx, svc.Name, metav1.DeleteOptions{}); err != nil {
-			log.Error(err)
+			log.WithContext(ctx).Error(err)
 		}
 	}
 
+	// Record how the containers ran before the pods go away.
+	if err = i.saveContainerSummaries(ctx, externalID); err != nil {
+		log.WithContext(ctx).Error(err)
+	}
+
+	// Keep the ends of the containers' logs so that failures can still be
+	// debugged after the pods go away.
+	if i.LogArchive.Enabled {
+		if err = i.archiveContainerLogs(ctx, externalID); err != nil {
+			log.WithContext(ctx).Error(err)
+		}
+	}
+
+	// Mark the analysis's provenance manifest as finished. Outputs written
+	// through the CSI driver are already in the data store, so the manifest
+	// is deposited with them here.
+	if err = i.updateProvenance(ctx, externalID, i.UseCSIDriver, true); err != nil {
+		log.WithContext(ctx).Error(err)
+	}
+
+	// Remember where the analysis ran so the user's next one lands nearby.
+	if err = i.learnPlacement(ctx, externalID); err != nil {
+		log.WithContext(ctx).Error(err)
+	}
+
+	// The outputs were either uploaded by a save-and-exit or are meant to
+	// be discarded, so the pods shouldn't upload them as they stop.
+	i.skipOutputFlush(ctx, externalID)
+
 	// Delete the deployment
 	depclient := i.clientset.AppsV1().Deployments(i.ViceNamespace)
 	deplist, err := depclient.List(ctx, listoptions)
@@ -497,9 +916,10 @@ func (i *Internal) doExit(ctx context.Context, externalID string) error {
 
 	for _, dep := range deplist.Items {
 		if err = depclient.Delete(ctx, dep.Name, metav1.DeleteOptions{}); err != nil {
-			log.Error(err)
+			log.WithContext(ctx).Error(err)
 		}
 	}
+	running = len(deplist.Items) > 0
 
 	// Delete volumes used by the deployment
 	// Delete persistent volume claims.
@@ -512,7 +932,7 @@ func (i *Internal) doExit(ctx context.Context, externalID string) error {
 
 	for _, pvc := range pvclist.Items {
 		if err = pvcclient.Delete(ctx, pvc.Name, metav1.DeleteOptions{}); err != nil {
-			log.Error(err)
+			log.WithContext(ctx).Error(err)
 		}
 	}
 
@@ -526,7 +946,46 @@ func (i *Internal) doExit(ctx context.Context, externalID string) error {
 
 	for _, pv := range pvlist.Items {
 		if err = pvclient.Delete(ctx, pv.Name, metav1.DeleteOptions{}); err != nil {
-			log.Error(err)
+			log.WithContext(ctx).Error(err)
+		}
+	}
+
+	// Delete the vice-proxy credentials secret
+	secretclient := i.clientset.CoreV1().Secrets(i.ViceNamespace)
+	secretlist, err := secretclient.List(ctx, listoptions)
+	if err != nil {
+		return err
+	}
+
+	for _, secret := range secretlist.Items {
+		if err = secretclient.Delete(ctx, secret.Name, metav1.DeleteOptions{}); err != nil {
+			log.WithContext(ctx).Error(err)
+		}
+	}
+
+	// Delete the pod disruption budget
+	pdbclient := i.clientset.PolicyV1().PodDisruptionBudgets(i.ViceNamespace)
+	pdblist, err := pdbclient.List(ctx, listoptions)
+	if err != nil {
+		return err
+	}
+
+	for _, pdb := range pdblist.Items {
+		if err = pdbclient.Delete(ctx, pdb.Name, metav1.DeleteOptions{}); err != nil {
+			log.WithContext(ctx).Error(err)
+		}
+	}
+
+	// Delete the egress network policy
+	npclient := i.clientset.NetworkingV1().NetworkPolicies(i.ViceNamespace)
+	nplist, err := npclient.List(ctx, listoptions)
+	if err != nil {
+		return err
+	}
+
+	for _, np := range nplist.Items {
+		if err = npclient.Delete(ctx, np.Name, metav1.DeleteOptions{}); err != nil {
+			log.WithContext(ctx).Error(err)
 		}
 	}
 
@@ -537,12 +996,26 @@ func (i *Internal) doExit(ctx context.Context, externalID string) error {
 		return err
 	}
 
-	log.Infof("number of configmaps to be deleted for %s: %d", externalID, len(cmlist.Items))
+	log.WithContext(ctx).Infof("number of configmaps to be deleted for %s: %d", externalID, len(cmlist.Items))
 
 	for _, cm := range cmlist.Items {
-		log.Infof("deleting configmap %s for %s", cm.Name, externalID)
+		log.WithContext(ctx).Infof("deleting configmap %s for %s", cm.Name, externalID)
 		if err = cmclient.Delete(ctx, cm.Name, metav1.DeleteOptions{}); err != nil {
-			log.Error(err)
+			log.WithContext(ctx).Error(err)
+		}
+	}
+
+	i.readyStates.forget(externalID)
+
+	if running {
+		err = i.notify(ctx, &analysisNotification{
+			ExternalID: externalID,
+			Event:      NotificationCompleted,
+			Subject:    "Your analysis has completed",
+			Message:    "Your VICE analysis has stopped and its resources have been cleaned up.",
+		})
+		if err != nil {
+			log.WithContext(ctx).Error(err)
 		}
 	}
 
@@ -575,36 +1048,10 @@ func (i *Internal) AdminExitHandler(c echo.Context) error {
 	return i.doExit(ctx, externalID)
 }
 
-// getIDFromHost returns the external ID for the running VICE app, which
-// is assumed to be the same as the name of the ingress.
-func (i *Internal) getIDFromHost(ctx context.Context, host string) (string, error) {
-	ingressclient := i.clientset.NetworkingV1().Ingresses(i.ViceNamespace)
-	ingresslist, err := ingressclient.List(ctx, metav1.ListOptions{})
-	if err != nil {
-		return "", err
-	}
-
-	for _, ingress := range ingresslist.Items {
-		for _, rule := range ingress.Spec.Rules {
-			if rule.Host == host {
-				return ingress.Name, nil
-			}
-		}
-	}
-
-	return "", fmt.Errorf("no ingress found for host %s", host)
-}
-
 // URLReadyHandler returns whether or not a VICE app is ready
 // for users to access it. This version will check the user's permissions
 // and return an error if they aren't allowed to access the running app.
 func (i *Internal) URLReadyHandler(c echo.Context) error {
-	var (
-		ingressExists bool
-		serviceExists bool
-		podReady      bool
-	)
-
 	ctx := c.Request().Context()
 
 	user := c.QueryParam("user")
@@ -623,51 +1070,11 @@ func (i *Internal) URLReadyHandler(c echo.Context) error {
 		return err
 	}
 
-	host := c.Param("host")
-
-	// Use the name of the ingress to retrieve the externalID
-	id, err := i.getIDFromHost(ctx, host)
-	if err != nil {
-		return err
-	}
-
-	// If getIDFromHost returns without an error, then the ingress exists
-	// since the ingresses are looked at for the host.
-	ingressExists = true
-
-	set := labels.Set(map[string]string{
-		"external-id": id,
-	})
-
-	listoptions := metav1.ListOptions{
-		LabelSelector: set.AsSelector().String(),
-	}
-
-	// check the service existence
-	svcclient := i.clientset.CoreV1().Services(i.ViceNamespace)
-	svclist, err := svcclient.List(ctx, listoptions)
-	if err != nil {
-		return err
-	}
-	if len(svclist.Items) > 0 {
-		serviceExists = true
-	}
-
-	// Check pod status through the deployment
-	depclient := i.clientset.AppsV1().Deployments(i.ViceNamespace)
-	deplist, err := depclient.List(ctx, listoptions)
+	readiness, err := i.urlReadiness(ctx, c.Param("host"))
 	if err != nil {
 		return err
 	}
-	for _, dep := range deplist.Items {
-		if dep.Status.ReadyReplicas > 0 {
-			podReady = true
-		}
-	}
-
-	data := map[string]bool{
-		"ready": ingressExists && serviceExists && podReady,
-	}
+	id := readiness.ExternalID
 
 	analysisID, err := i.apps.GetAnalysisIDByExternalID(ctx, id)
 	if err != nil {
@@ -688,7 +1095,11 @@ func (i *Internal) URLReadyHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("user %s cannot access analysis %s", user, analysisID))
 	}
 
-	return c.JSON(http.StatusOK, data)
+	if i.readyStates.update(id, readiness.Ready) {
+		i.notifyURLReady(ctx, id)
+	}
+
+	return c.JSON(http.StatusOK, readiness)
 }
 
 // AdminURLReadyHandler handles requests to check the status of a running VICE app in K8s.
@@ -696,60 +1107,12 @@ func (i *Internal) URLReadyHandler(c echo.Context) error {
 // the app's pod. Uses the state of the readiness checks in K8s, along with the
 // existence of the various resources created for the app.
 func (i *Internal) AdminURLReadyHandler(c echo.Context) error {
-	var (
-		ingressExists bool
-		serviceExists bool
-		podReady      bool
-	)
-
-	ctx := c.Request().Context()
-	host := c.Param("host")
-
-	// Use the name of the ingress to retrieve the externalID
-	id, err := i.getIDFromHost(ctx, host)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusNotFound, err.Error())
-	}
-
-	// If getIDFromHost returns without an error, then the ingress exists
-	// since the ingresses are looked at for the host.
-	ingressExists = true
-
-	set := labels.Set(map[string]string{
-		"external-id": id,
-	})
-
-	listoptions := metav1.ListOptions{
-		LabelSelector: set.AsSelector().String(),
-	}
-
-	// check the service existence
-	svcclient := i.clientset.CoreV1().Services(i.ViceNamespace)
-	svclist, err := svcclient.List(ctx, listoptions)
+	readiness, err := i.urlReadiness(c.Request().Context(), c.Param("host"))
 	if err != nil {
 		return err
 	}
-	if len(svclist.Items) > 0 {
-		serviceExists = true
-	}
-
-	// Check pod status through the deployment
-	depclient := i.clientset.AppsV1().Deployments(i.ViceNamespace)
-	deplist, err := depclient.List(ctx, listoptions)
-	if err != nil {
-		return err
-	}
-	for _, dep := range deplist.Items {
-		if dep.Status.ReadyReplicas > 0 {
-			podReady = true
-		}
-	}
-
-	data := map[string]bool{
-		"ready": ingressExists && serviceExists && podReady,
-	}
 
-	return c.JSON(http.StatusOK, data)
+	return c.JSON(http.StatusOK, readiness)
 }
 
 // SaveAndExitHandler handles requests to save the output files in iRODS and then exit.
@@ -861,7 +1224,7 @@ const getUserIDSQL = `
 // TimeLimitUpdateHandler handles requests to update the time limit on an already running VICE app.
 func (i *Internal) TimeLimitUpdateHandler(c echo.Context) error {
 	ctx := c.Request().Context()
-	log.Info("update time limit called")
+	log.WithContext(ctx).Info("update time limit called")
 
 	var (
 		err  error
@@ -879,13 +1242,18 @@ func (i *Internal) TimeLimitUpdateHandler(c echo.Context) error {
 	id = c.Param("analysis-id")
 	if id == "" {
 		idErr := echo.NewHTTPError(http.StatusBadRequest, "id parameter is empty")
-		log.Error(idErr)
+		log.WithContext(ctx).Error(idErr)
 		return idErr
 	}
 
+	if err = i.checkDemoTimeLimitExtension(ctx, id); err != nil {
+		log.WithContext(ctx).Error(err)
+		return err
+	}
+
 	outputMap, err := i.updateTimeLimit(ctx, user, id)
 	if err != nil {
-		log.Error(err)
+		log.WithContext(ctx).Error(err)
 		return err
 	}
 
@@ -913,6 +1281,10 @@ func (i *Internal) AdminTimeLimitUpdateHandler(c echo.Context) error {
 		return err
 	}
 
+	if err = i.checkDemoTimeLimitExtension(ctx, id); err != nil {
+		return err
+	}
+
 	outputMap, err := i.updateTimeLimit(ctx, user, id)
 	if err != nil {
 		return err
@@ -924,7 +1296,7 @@ func (i *Internal) AdminTimeLimitUpdateHandler(c echo.Context) error {
 // GetTimeLimitHandler implements the handler for getting the current time limit from the database.
 func (i *Internal) GetTimeLimitHandler(c echo.Context) error {
 	ctx := c.Request().Context()
-	log.Info("get time limit called")
+	log.WithContext(ctx).Info("get time limit called")
 
 	var (
 		err        error
@@ -963,7 +1335,7 @@ func (i *Internal) GetTimeLimitHandler(c echo.Context) error {
 // any user information in the request.
 func (i *Internal) AdminGetTimeLimitHandler(c echo.Context) error {
 	ctx := c.Request().Context()
-	log.Info("get time limit called")
+	log.WithContext(ctx).Info("get time limit called")
 
 	var (
 		err        error
@@ -0,0 +1,241 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// JobLimitGroup is a set of users who share a concurrent job limit, such as
+// the students in a course or the members of a lab.
+type JobLimitGroup struct {
+	Name           string         `json:"name" db:"name"`
+	ConcurrentJobs int            `json:"concurrent_jobs" db:"concurrent_jobs"`
+	Members        pq.StringArray `json:"members" db:"members"`
+}
+
+// AdminGetUserJobLimitHandler returns the user's concurrent job limit, where
+// it came from, and the number of jobs the user is running.
+func (i *Internal) AdminGetUserJobLimitHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	user := c.Param("username")
+	if user == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "username parameter is empty")
+	}
+
+	jobLimit, err := i.getJobLimitForUser(user)
+	if err != nil {
+		return errors.Wrapf(err, "unable to determine the concurrent job limit for %s", user)
+	}
+	if jobLimit == nil {
+		defaultJobLimit, err := i.getDefaultJobLimit()
+		if err != nil {
+			return errors.Wrap(err, "unable to determine the default concurrent job limit")
+		}
+		jobLimit = &JobLimit{Username: user, ConcurrentJobs: defaultJobLimit, Source: jobLimitDefault}
+	}
+
+	running, err := i.countJobsForUser(ctx, labelValueString(user))
+	if err != nil {
+		return errors.Wrapf(err, "unable to determine the number of jobs that %s is currently running", user)
+	}
+	jobLimit.Running = &running
+
+	return c.JSON(http.StatusOK, jobLimit)
+}
+
+// setUserJobLimitSQL updates the user's row in job_limits, or adds one if
+// they don't have one yet.
+const setUserJobLimitSQL = `
+	WITH updated AS (
+		UPDATE job_limits
+		   SET concurrent_jobs = $2
+		 WHERE launcher = regexp_replace($1, '-', '_')
+		RETURNING launcher
+	)
+	INSERT INTO job_limits (launcher, concurrent_jobs)
+	SELECT regexp_replace($1, '-', '_'), $2
+	 WHERE NOT EXISTS (SELECT 1 FROM updated)
+`
+
+// AdminSetUserJobLimitHandler overrides the user's concurrent job limit. It
+// takes precedence over the limits of the user's groups and the default, so
+// it can raise a user's limit as well as lower it. The jobs the user is
+// already running keep going.
+func (i *Internal) AdminSetUserJobLimitHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	user := c.Param("username")
+	if user == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "username parameter is empty")
+	}
+
+	var body struct {
+		ConcurrentJobs *int `json:"concurrent_jobs"`
+	}
+	if err := json.NewDecoder(c.Request().Body).Decode(&body); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if body.ConcurrentJobs == nil || *body.ConcurrentJobs < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "concurrent_jobs must be set and must not be negative")
+	}
+
+	if _, err := i.db.ExecContext(ctx, setUserJobLimitSQL, user, *body.ConcurrentJobs); err != nil {
+		return errors.Wrapf(err, "error setting the concurrent job limit for %s", user)
+	}
+
+	return c.JSON(http.StatusOK, &JobLimit{
+		Username:       user,
+		ConcurrentJobs: *body.ConcurrentJobs,
+		Source:         jobLimitUser,
+	})
+}
+
+const deleteUserJobLimitSQL = `
+	DELETE FROM job_limits WHERE launcher = regexp_replace($1, '-', '_')
+`
+
+// AdminDeleteUserJobLimitHandler removes the user's own concurrent job limit,
+// so that the limits of their groups or the default apply again.
+func (i *Internal) AdminDeleteUserJobLimitHandler(c echo.Context) error {
+	user := c.Param("username")
+	if user == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "username parameter is empty")
+	}
+
+	if _, err := i.db.ExecContext(c.Request().Context(), deleteUserJobLimitSQL, user); err != nil {
+		return errors.Wrapf(err, "error deleting the concurrent job limit for %s", user)
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+const listJobLimitGroupsSQL = `
+	SELECT g.name, g.concurrent_jobs,
+	       array_remove(array_agg(m.launcher ORDER BY m.launcher), NULL) AS members
+	  FROM vice_job_limit_groups g
+	  LEFT JOIN vice_job_limit_group_members m ON m.group_name = g.name
+	 GROUP BY g.name, g.concurrent_jobs
+	 ORDER BY g.name
+`
+
+// AdminListJobLimitGroupsHandler lists the job limit groups and their
+// members.
+func (i *Internal) AdminListJobLimitGroupsHandler(c echo.Context) error {
+	groups := []JobLimitGroup{}
+	if err := i.db.SelectContext(c.Request().Context(), &groups, listJobLimitGroupsSQL); err != nil {
+		return errors.Wrap(err, "error listing the job limit groups")
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{"groups": groups})
+}
+
+const upsertJobLimitGroupSQL = `
+	INSERT INTO vice_job_limit_groups (name, concurrent_jobs)
+	VALUES ($1, $2)
+	ON CONFLICT (name) DO UPDATE
+	   SET concurrent_jobs = EXCLUDED.concurrent_jobs
+`
+
+const deleteJobLimitGroupMembersSQL = `
+	DELETE FROM vice_job_limit_group_members WHERE group_name = $1
+`
+
+const insertJobLimitGroupMemberSQL = `
+	INSERT INTO vice_job_limit_group_members (group_name, launcher)
+	VALUES ($1, regexp_replace($2, '-', '_'))
+	ON CONFLICT DO NOTHING
+`
+
+// replaceJobLimitGroup creates or replaces the group and its members.
+func (i *Internal) replaceJobLimitGroup(ctx context.Context, group *JobLimitGroup) error {
+	tx, err := i.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // nolint:errcheck
+
+	if _, err = tx.ExecContext(ctx, upsertJobLimitGroupSQL, group.Name, group.ConcurrentJobs); err != nil {
+		return errors.Wrapf(err, "error setting the concurrent job limit for group %s", group.Name)
+	}
+	if _, err = tx.ExecContext(ctx, deleteJobLimitGroupMembersSQL, group.Name); err != nil {
+		return errors.Wrapf(err, "error removing the members of group %s", group.Name)
+	}
+	for _, member := range group.Members {
+		if _, err = tx.ExecContext(ctx, insertJobLimitGroupMemberSQL, group.Name, member); err != nil {
+			return errors.Wrapf(err, "error adding %s to group %s", member, group.Name)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// AdminSetJobLimitGroupHandler creates or replaces a job limit group. Users
+// in several groups get the most generous of their groups' limits, and
+// users with their own row in job_limits aren't affected by their groups.
+func (i *Internal) AdminSetJobLimitGroupHandler(c echo.Context) error {
+	name := c.Param("name")
+	if name == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "name parameter is empty")
+	}
+
+	var body struct {
+		ConcurrentJobs *int     `json:"concurrent_jobs"`
+		Members        []string `json:"members"`
+	}
+	if err := json.NewDecoder(c.Request().Body).Decode(&body); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if body.ConcurrentJobs == nil || *body.ConcurrentJobs < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "concurrent_jobs must be set and must not be negative")
+	}
+	for _, member := range body.Members {
+		if member == "" {
+			return echo.NewHTTPError(http.StatusBadRequest, "members must not be empty")
+		}
+	}
+
+	group := &JobLimitGroup{
+		Name:           name,
+		ConcurrentJobs: *body.ConcurrentJobs,
+		Members:        pq.StringArray(body.Members),
+	}
+	if group.Members == nil {
+		group.Members = pq.StringArray{}
+	}
+
+	if err := i.replaceJobLimitGroup(c.Request().Context(), group); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, group)
+}
+
+const deleteJobLimitGroupSQL = `
+	DELETE FROM vice_job_limit_groups WHERE name = $1
+`
+
+// AdminDeleteJobLimitGroupHandler deletes a job limit group. Its members get
+// the limits of their other groups or the default.
+func (i *Internal) AdminDeleteJobLimitGroupHandler(c echo.Context) error {
+	name := c.Param("name")
+	if name == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "name parameter is empty")
+	}
+
+	result, err := i.db.ExecContext(c.Request().Context(), deleteJobLimitGroupSQL, name)
+	if err != nil {
+		return errors.Wrapf(err, "error deleting group %s", name)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("group %s was not found", name))
+	}
+
+	return c.NoContent(http.StatusOK)
+}
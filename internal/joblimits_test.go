@@ -0,0 +1,167 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestGetJobLimitForUser(t *testing.T) {
+	assert := assert.New(t)
+
+	mockdb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockdb.Close()
+
+	i := &Internal{db: sqlx.NewDb(mockdb, "sqlmock")}
+
+	mock.ExpectQuery(regexp.QuoteMeta("FROM vice_job_limit_groups")).WithArgs("student-1").
+		WillReturnRows(sqlmock.NewRows([]string{"source", "group_name", "concurrent_jobs"}).AddRow(jobLimitGroup, "bio101", 1))
+	jobLimit, err := i.getJobLimitForUser("student-1")
+	if assert.NoError(err) && assert.NotNil(jobLimit) {
+		assert.Equal(1, jobLimit.ConcurrentJobs)
+		assert.Equal(jobLimitGroup, jobLimit.Source)
+		assert.Equal("bio101", *jobLimit.Group)
+	}
+
+	// The default limit applies to users without a row or a group.
+	mock.ExpectQuery(regexp.QuoteMeta("FROM job_limits")).WithArgs("ipcdev").
+		WillReturnRows(sqlmock.NewRows([]string{"source", "group_name", "concurrent_jobs"}))
+	jobLimit, err = i.getJobLimitForUser("ipcdev")
+	assert.NoError(err)
+	assert.Nil(jobLimit)
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestAdminGetUserJobLimitHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	mockdb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockdb.Close()
+
+	i := &Internal{
+		Init: Init{ViceNamespace: "vice-apps"},
+		db:   sqlx.NewDb(mockdb, "sqlmock"),
+		clientset: fake.NewSimpleClientset(
+			gpuDeployment("rstudio", "ipcdev", nil, nil),
+			gpuDeployment("other", "someone-else", nil, nil),
+		),
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta("FROM job_limits")).WithArgs("ipcdev").
+		WillReturnRows(sqlmock.NewRows([]string{"source", "group_name", "concurrent_jobs"}))
+	mock.ExpectQuery(regexp.QuoteMeta("WHERE launcher IS NULL")).
+		WillReturnRows(sqlmock.NewRows([]string{"concurrent_jobs"}).AddRow(2))
+
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+	c.SetParamNames("username")
+	c.SetParamValues("ipcdev")
+	assert.NoError(i.AdminGetUserJobLimitHandler(c))
+
+	jobLimit := &JobLimit{}
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), jobLimit))
+	assert.Equal(2, jobLimit.ConcurrentJobs)
+	assert.Equal(jobLimitDefault, jobLimit.Source)
+	if assert.NotNil(jobLimit.Running) {
+		assert.Equal(1, *jobLimit.Running)
+	}
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestAdminSetUserJobLimitHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	mockdb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockdb.Close()
+
+	i := &Internal{db: sqlx.NewDb(mockdb, "sqlmock")}
+
+	newContext := func(body string) (echo.Context, *httptest.ResponseRecorder) {
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodPut, "/", strings.NewReader(body)), rec)
+		c.SetParamNames("username")
+		c.SetParamValues("ipcdev")
+		return c, rec
+	}
+
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO job_limits")).WithArgs("ipcdev", 5).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	c, rec := newContext(`{"concurrent_jobs": 5}`)
+	assert.NoError(i.AdminSetUserJobLimitHandler(c))
+	jobLimit := &JobLimit{}
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), jobLimit))
+	assert.Equal(5, jobLimit.ConcurrentJobs)
+	assert.Equal(jobLimitUser, jobLimit.Source)
+	assert.NoError(mock.ExpectationsWereMet())
+
+	for _, body := range []string{`{}`, `{"concurrent_jobs": -1}`, `not json`} {
+		c, _ = newContext(body)
+		err = i.AdminSetUserJobLimitHandler(c)
+		if assert.Error(err, body) {
+			assert.Equal(http.StatusBadRequest, err.(*echo.HTTPError).Code)
+		}
+	}
+}
+
+func TestAdminSetJobLimitGroupHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	mockdb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockdb.Close()
+
+	i := &Internal{db: sqlx.NewDb(mockdb, "sqlmock")}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO vice_job_limit_groups")).WithArgs("bio101", 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM vice_job_limit_group_members")).WithArgs("bio101").
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO vice_job_limit_group_members")).WithArgs("bio101", "student1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO vice_job_limit_group_members")).WithArgs("bio101", "student2").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodPut, "/", strings.NewReader(`{"concurrent_jobs": 1, "members": ["student1", "student2"]}`)), rec)
+	c.SetParamNames("name")
+	c.SetParamValues("bio101")
+	assert.NoError(i.AdminSetJobLimitGroupHandler(c))
+
+	group := &JobLimitGroup{}
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), group))
+	assert.Equal(1, group.ConcurrentJobs)
+	assert.Equal([]string{"student1", "student2"}, []string(group.Members))
+	assert.NoError(mock.ExpectationsWereMet())
+
+	c = echo.New().NewContext(httptest.NewRequest(http.MethodPut, "/", strings.NewReader(`{"concurrent_jobs": 1, "members": [""]}`)), httptest.NewRecorder())
+	c.SetParamNames("name")
+	c.SetParamValues("bio101")
+	err = i.AdminSetJobLimitGroupHandler(c)
+	if assert.Error(err) {
+		assert.Equal(http.StatusBadRequest, err.(*echo.HTTPError).Code)
+	}
+}
@@ -0,0 +1,197 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// KubeResource is a k8s resource belonging to an analysis. Namespace is empty
+// for cluster-scoped resources.
+type KubeResource struct {
+	Kind      string `json:"kind"`
+	Name      string `json:"name"`
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// KubeResources lists the k8s resources belonging to an analysis, along with
+// kubectl commands for working with them.
+type KubeResources struct {
+	AnalysisID string         `json:"analysis_id"`
+	ExternalID string         `json:"external_id"`
+	Namespace  string         `json:"namespace"`
+	Selector   string         `json:"selector"`
+	Resources  []KubeResource `json:"resources"`
+	Commands   []string       `json:"commands"`
+}
+
+// kubectlName returns the kind/name form of the resource used by kubectl.
+func (r KubeResource) kubectlName() string {
+	return fmt.Sprintf("%s/%s", strings.ToLower(r.Kind), r.Name)
+}
+
+// kubectlCommands returns kubectl commands for inspecting the resources.
+func (k *KubeResources) kubectlCommands() []string {
+	commands := []string{
+		fmt.Sprintf("kubectl -n %s get all,pvc,configmap,secret,ingress -l %s", k.Namespace, k.Selector),
+	}
+
+	for _, resource := range k.Resources {
+		if resource.Namespace == "" {
+			commands = append(commands, fmt.Sprintf("kubectl describe %s", resource.kubectlName()))
+		} else {
+			commands = append(commands, fmt.Sprintf("kubectl -n %s describe %s", resource.Namespace, resource.kubectlName()))
+		}
+
+		if resource.Kind == "Pod" {
+			commands = append(commands,
+				fmt.Sprintf("kubectl -n %s logs %s -c %s", resource.Namespace, resource.Name, analysisContainerName),
+				fmt.Sprintf("kubectl -n %s exec -it %s -c %s -- sh", resource.Namespace, resource.Name, analysisContainerName),
+			)
+		}
+	}
+
+	return commands
+}
+
+// text formats the resources as plain text that can be pasted into a shell.
+func (k *KubeResources) text() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "# analysis %s (external ID %s)\n", k.AnalysisID, k.ExternalID)
+	for _, resource := range k.Resources {
+		if resource.Namespace == "" {
+			fmt.Fprintf(&b, "# %s\n", resource.kubectlName())
+		} else {
+			fmt.Fprintf(&b, "# %s -n %s\n", resource.kubectlName(), resource.Namespace)
+		}
+	}
+	for _, command := range k.Commands {
+		fmt.Fprintln(&b, command)
+	}
+
+	return b.String()
+}
+
+// kubeResources lists the k8s resources belonging to the analysis with the
+// external ID.
+func (i *Internal) kubeResources(ctx context.Context, externalID string) (*KubeResources, error) {
+	set := labels.Set(map[string]string{"external-id": externalID})
+	selector := set.AsSelector().String()
+	listOptions := metav1.ListOptions{LabelSelector: selector}
+
+	result := &KubeResources{
+		ExternalID: externalID,
+		Namespace:  i.ViceNamespace,
+		Selector:   selector,
+		Resources:  []KubeResource{},
+	}
+
+	add := func(kind, name string, namespaced bool) {
+		resource := KubeResource{Kind: kind, Name: name}
+		if namespaced {
+			resource.Namespace = i.ViceNamespace
+		}
+		result.Resources = append(result.Resources, resource)
+	}
+
+	deployments, err := i.clientset.AppsV1().Deployments(i.ViceNamespace).List(ctx, listOptions)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to list the deployments for %s", externalID)
+	}
+	for _, deployment := range deployments.Items {
+		add("Deployment", deployment.Name, true)
+	}
+
+	pods, err := i.clientset.CoreV1().Pods(i.ViceNamespace).List(ctx, listOptions)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to list the pods for %s", externalID)
+	}
+	for _, pod := range pods.Items {
+		add("Pod", pod.Name, true)
+	}
+
+	services, err := i.clientset.CoreV1().Services(i.ViceNamespace).List(ctx, listOptions)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to list the services for %s", externalID)
+	}
+	for _, service := range services.Items {
+		add("Service", service.Name, true)
+	}
+
+	ingresses, err := i.clientset.NetworkingV1().Ingresses(i.ViceNamespace).List(ctx, listOptions)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to list the ingresses for %s", externalID)
+	}
+	for _, ingress := range ingresses.Items {
+		add("Ingress", ingress.Name, true)
+	}
+
+	configmaps, err := i.clientset.CoreV1().ConfigMaps(i.ViceNamespace).List(ctx, listOptions)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to list the config maps for %s", externalID)
+	}
+	for _, configmap := range configmaps.Items {
+		add("ConfigMap", configmap.Name, true)
+	}
+
+	pvcs, err := i.clientset.CoreV1().PersistentVolumeClaims(i.ViceNamespace).List(ctx, listOptions)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to list the persistent volume claims for %s", externalID)
+	}
+	for _, pvc := range pvcs.Items {
+		add("PersistentVolumeClaim", pvc.Name, true)
+	}
+
+	pvs, err := i.clientset.CoreV1().PersistentVolumes().List(ctx, listOptions)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to list the persistent volumes for %s", externalID)
+	}
+	for _, pv := range pvs.Items {
+		add("PersistentVolume", pv.Name, false)
+	}
+
+	result.Commands = result.kubectlCommands()
+
+	return result, nil
+}
+
+// AdminKubeResourcesHandler returns the names of the k8s resources belonging
+// to an analysis, along with kubectl commands for inspecting them. The
+// response is plain text suitable for pasting into a shell if the 'format'
+// query parameter is set to 'text', and JSON otherwise.
+func (i *Internal) AdminKubeResourcesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	analysisID := c.Param("analysis-id")
+	if analysisID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "analysis-id parameter is empty")
+	}
+
+	format := c.QueryParam("format")
+	if format != "" && format != "json" && format != "text" {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("unknown format %q", format))
+	}
+
+	externalID, err := i.getExternalIDByAnalysisID(ctx, analysisID)
+	if err != nil {
+		return err
+	}
+
+	resources, err := i.kubeResources(withExternalIDBaggage(ctx, externalID), externalID)
+	if err != nil {
+		return err
+	}
+	resources.AnalysisID = analysisID
+
+	if format == "text" {
+		return c.String(http.StatusOK, resources.text())
+	}
+	return c.JSON(http.StatusOK, resources)
+}
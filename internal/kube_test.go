@@ -0,0 +1,43 @@
+package internal
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestKubeResources(t *testing.T) {
+	assert := assert.New(t)
+
+	analysisLabels := map[string]string{"external-id": "e1"}
+	clientset := fake.NewSimpleClientset(
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "e1", Namespace: "vice-apps", Labels: analysisLabels}},
+		&apiv1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "e1-abcde", Namespace: "vice-apps", Labels: analysisLabels}},
+		&apiv1.Service{ObjectMeta: metav1.ObjectMeta{Name: "vice-e1", Namespace: "vice-apps", Labels: analysisLabels}},
+		&apiv1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: "csi-data-volume-e1", Labels: analysisLabels}},
+		&apiv1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "e2-abcde", Namespace: "vice-apps", Labels: map[string]string{"external-id": "e2"}}},
+	)
+	i := &Internal{Init: Init{ViceNamespace: "vice-apps"}, clientset: clientset}
+
+	resources, err := i.kubeResources(context.Background(), "e1")
+	assert.NoError(err)
+	assert.Equal("external-id=e1", resources.Selector)
+	assert.Equal([]KubeResource{
+		{Kind: "Deployment", Name: "e1", Namespace: "vice-apps"},
+		{Kind: "Pod", Name: "e1-abcde", Namespace: "vice-apps"},
+		{Kind: "Service", Name: "vice-e1", Namespace: "vice-apps"},
+		{Kind: "PersistentVolume", Name: "csi-data-volume-e1"},
+	}, resources.Resources)
+
+	assert.Contains(resources.Commands, "kubectl -n vice-apps logs e1-abcde -c analysis")
+	assert.Contains(resources.Commands, "kubectl describe persistentvolume/csi-data-volume-e1")
+
+	text := resources.text()
+	assert.Contains(text, "# pod/e1-abcde -n vice-apps\n")
+	assert.Contains(text, "kubectl -n vice-apps get all,pvc,configmap,secret,ingress -l external-id=e1\n")
+}
@@ -0,0 +1,110 @@
+package internal
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// kueueQueueLabel is the label Kueue uses to find the LocalQueue a workload
+// is submitted to.
+const kueueQueueLabel = "kueue.x-k8s.io/queue-name"
+
+// kueueAdmissionGate is the scheduling gate Kueue puts on pods until their
+// workload is admitted.
+const kueueAdmissionGate = "kueue.x-k8s.io/admission"
+
+// addQueueLabel adds the Kueue queue label to the labels if a LocalQueue is
+// configured for VICE analyses. Kueue then holds the analysis pod until the
+// queue has enough quota for it.
+func (i *Internal) addQueueLabel(labels map[string]string) {
+	if i.KueueQueueName == "" {
+		return
+	}
+	labels[kueueQueueLabel] = i.KueueQueueName
+}
+
+// awaitingAdmission returns true if Kueue is still holding the pod.
+func awaitingAdmission(pod *apiv1.Pod) bool {
+	for _, gate := range pod.Spec.SchedulingGates {
+		if gate.Name == kueueAdmissionGate {
+			return true
+		}
+	}
+	return false
+}
+
+// scheduledAt returns when the pod was scheduled, or the zero time if it
+// hasn't been.
+func scheduledAt(pod *apiv1.Pod) time.Time {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == apiv1.PodScheduled && condition.Status == apiv1.ConditionTrue {
+			return condition.LastTransitionTime.Time
+		}
+	}
+	return time.Time{}
+}
+
+// queueStatus is where an analysis is in the Kueue queue.
+type queueStatus struct {
+	// Queued is true if Kueue hasn't admitted any of the analysis's pods.
+	Queued bool
+
+	// AdmittedAt is when the analysis's most recent pod was scheduled after
+	// Kueue admitted it.
+	AdmittedAt time.Time
+}
+
+// startupWindowStart returns when the analysis's startup window starts. Time
+// spent waiting in the queue doesn't count against the startup timeout.
+func (s *queueStatus) startupWindowStart(started time.Time) time.Time {
+	if s != nil && s.AdmittedAt.After(started) {
+		return s.AdmittedAt
+	}
+	return started
+}
+
+// queueStatuses returns the queue status of each analysis with pods matching
+// the labels in the namespace, keyed by external ID. Returns nil if Kueue
+// isn't used.
+func (i *Internal) queueStatuses(ctx context.Context, namespace string, set labels.Set) (map[string]*queueStatus, error) {
+	if i.KueueQueueName == "" {
+		return nil, nil
+	}
+
+	pods, err := i.clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: set.AsSelector().String(),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to list the analysis pods")
+	}
+
+	statuses := map[string]*queueStatus{}
+	for idx := range pods.Items {
+		pod := &pods.Items[idx]
+		if pod.DeletionTimestamp != nil {
+			continue
+		}
+
+		externalID := pod.Labels["external-id"]
+		status, ok := statuses[externalID]
+		if !ok {
+			status = &queueStatus{Queued: true}
+			statuses[externalID] = status
+		}
+
+		if awaitingAdmission(pod) {
+			continue
+		}
+		status.Queued = false
+		if scheduled := scheduledAt(pod); scheduled.After(status.AdmittedAt) {
+			status.AdmittedAt = scheduled
+		}
+	}
+
+	return statuses, nil
+}
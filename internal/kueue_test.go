@@ -0,0 +1,106 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestAddQueueLabel(t *testing.T) {
+	assert := assert.New(t)
+
+	labels := map[string]string{}
+	i := &Internal{}
+	i.addQueueLabel(labels)
+	assert.Empty(labels)
+
+	i.KueueQueueName = "vice"
+	i.addQueueLabel(labels)
+	assert.Equal("vice", labels[kueueQueueLabel])
+}
+
+func kueueTestPod(name, externalID string, gated bool, scheduled time.Time) *apiv1.Pod {
+	pod := &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "vice-apps",
+			Labels:    map[string]string{"external-id": externalID, "app-type": "interactive"},
+		},
+	}
+	if gated {
+		pod.Spec.SchedulingGates = []apiv1.PodSchedulingGate{{Name: kueueAdmissionGate}}
+	}
+	if !scheduled.IsZero() {
+		pod.Status.Conditions = []apiv1.PodCondition{{
+			Type:               apiv1.PodScheduled,
+			Status:             apiv1.ConditionTrue,
+			LastTransitionTime: metav1.NewTime(scheduled),
+		}}
+	}
+	return pod
+}
+
+func TestQueueStatuses(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	i := &Internal{
+		clientset: fake.NewSimpleClientset(
+			kueueTestPod("queued-1", "queued", true, time.Time{}),
+			kueueTestPod("admitted-1", "admitted", false, now.Add(-time.Minute)),
+		),
+	}
+	set := labels.Set{"app-type": "interactive"}
+
+	// Nothing is queued without Kueue.
+	statuses, err := i.queueStatuses(context.Background(), "vice-apps", set)
+	assert.NoError(err)
+	assert.Nil(statuses)
+
+	i.KueueQueueName = "vice"
+	statuses, err = i.queueStatuses(context.Background(), "vice-apps", set)
+	assert.NoError(err)
+	assert.True(statuses["queued"].Queued)
+	assert.False(statuses["admitted"].Queued)
+	assert.Equal(now.Add(-time.Minute).Unix(), statuses["admitted"].AdmittedAt.Unix())
+
+	started := now.Add(-time.Hour)
+	assert.Equal(statuses["admitted"].AdmittedAt, statuses["admitted"].startupWindowStart(started))
+	assert.Equal(started, statuses["missing"].startupWindowStart(started))
+}
+
+func TestCheckStartupsQueued(t *testing.T) {
+	assert := assert.New(t)
+
+	// Both analyses were created long enough ago to have timed out, but one
+	// is still waiting in the queue and the other was only just admitted.
+	now := time.Now()
+	statuses := failedStatuses{}
+	i := &Internal{
+		Init: Init{ViceNamespace: "vice-apps", KueueQueueName: "vice"},
+		clientset: fake.NewSimpleClientset(
+			startupTestDeployment("queued", now.Add(-time.Hour), "20m0s", 0),
+			startupTestDeployment("admitted", now.Add(-time.Hour), "20m0s", 0),
+			kueueTestPod("queued-1", "queued", true, time.Time{}),
+			kueueTestPod("admitted-1", "admitted", false, now.Add(-5*time.Minute)),
+		),
+		statusPublisher: statuses,
+	}
+
+	failed, err := i.checkStartups(context.Background(), now)
+	assert.NoError(err)
+	assert.Equal(0, failed)
+	assert.Empty(statuses)
+
+	// The admitted analysis still times out once its window has passed.
+	failed, err = i.checkStartups(context.Background(), now.Add(20*time.Minute))
+	assert.NoError(err)
+	assert.Equal(1, failed)
+	assert.Contains(statuses, "admitted")
+}
@@ -0,0 +1,352 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// defaultMaintenanceMessage is shown to users when maintenance mode doesn't
+// have its own message.
+const defaultMaintenanceMessage = "VICE is down for maintenance; new analyses can't be launched right now"
+
+// maxEvaluatedInstantLaunches limits the number of instant launches that can
+// be evaluated in one request.
+const maxEvaluatedInstantLaunches = 500
+
+// MaintenanceConfig contains the settings for maintenance mode, which stops
+// new analyses from being launched while the analyses that are already
+// running keep going.
+type MaintenanceConfig struct {
+	Enabled bool
+
+	// Message is shown to users who try to launch analyses.
+	Message string
+
+	// Windows are the scheduled maintenance windows announced on the status
+	// page. They don't turn on maintenance mode by themselves.
+	Windows []MaintenanceWindow
+}
+
+// Validate returns an error if the configuration can't be used.
+func (c *MaintenanceConfig) Validate() error {
+	for _, window := range c.Windows {
+		if window.Start.IsZero() || window.End.IsZero() {
+			return fmt.Errorf("maintenance windows must have start and end times")
+		}
+		if !window.End.After(window.Start) {
+			return fmt.Errorf("the maintenance window starting at %s must end after it starts", window.Start.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// checkMaintenance returns an error if new analyses can't be launched
+// because VICE is in maintenance mode.
+func (i *Internal) checkMaintenance() error {
+	maintenance := i.reloadable().Maintenance
+	if !maintenance.Enabled {
+		return nil
+	}
+
+	message := maintenance.Message
+	if message == "" {
+		message = defaultMaintenanceMessage
+	}
+
+	return common.ErrorResponse{
+		ErrorCode: "ERR_MAINTENANCE",
+		Message:   message,
+	}
+}
+
+// AppLimits contains the limits on the VICE analyses of an app.
+type AppLimits struct {
+	AppID string `json:"app_id" db:"app_id"`
+
+	// MaxConcurrentAnalyses is the number of analyses of the app that may
+	// run at once across all users. There's no limit if it's null.
+	MaxConcurrentAnalyses *int `json:"max_concurrent_analyses" db:"max_concurrent_analyses"`
+}
+
+const getAppLimitsSQL = `
+	SELECT app_id, max_concurrent_analyses
+	  FROM vice_app_limits
+	 WHERE app_id = ANY($1)
+`
+
+const upsertAppLimitsSQL = `
+	INSERT INTO vice_app_limits (app_id, max_concurrent_analyses)
+	VALUES ($1, $2)
+	ON CONFLICT (app_id) DO UPDATE
+	   SET max_concurrent_analyses = EXCLUDED.max_concurrent_analyses
+`
+
+// getAppLimits returns the limits for the apps that have them, keyed by app
+// ID.
+func (i *Internal) getAppLimits(ctx context.Context, appIDs []string) (map[string]*AppLimits, error) {
+	rows := []AppLimits{}
+	if err := i.db.SelectContext(ctx, &rows, getAppLimitsSQL, pq.Array(appIDs)); err != nil {
+		return nil, errors.Wrap(err, "error looking up the app limits")
+	}
+
+	limits := map[string]*AppLimits{}
+	for idx := range rows {
+		limits[rows[idx].AppID] = &rows[idx]
+	}
+	return limits, nil
+}
+
+// countAnalysesByApp returns the number of VICE analyses running for each
+// app, keyed by app ID.
+func (i *Internal) countAnalysesByApp(ctx context.Context) (map[string]int, error) {
+	set := labels.Set(map[string]string{
+		"app-type": "interactive",
+	})
+	deployments, err := i.clientset.AppsV1().Deployments(i.ViceNamespace).List(ctx, metav1.ListOptions{
+		LabelSelector: set.AsSelector().String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	counts := map[string]int{}
+	for _, deployment := range deployments.Items {
+		if deployment.DeletionTimestamp != nil {
+			continue
+		}
+		counts[deployment.Labels["app-id"]]++
+	}
+	return counts, nil
+}
+
+// appLimitError returns the error for an app that's running as many
+// analyses as it may, or nil if it can run more.
+func appLimitError(appID string, limits *AppLimits, running int) error {
+	if limits == nil || limits.MaxConcurrentAnalyses == nil || running < *limits.MaxConcurrentAnalyses {
+		return nil
+	}
+
+	return common.ErrorResponse{
+		ErrorCode: "ERR_APP_LIMIT_REACHED",
+		Message:   fmt.Sprintf("the app is already running %d or more analyses, which is as many as it may run at once", *limits.MaxConcurrentAnalyses),
+		Details: &map[string]interface{}{
+			"app_id":                  appID,
+			"running":                 running,
+			"max_concurrent_analyses": *limits.MaxConcurrentAnalyses,
+		},
+	}
+}
+
+// checkAppLimits returns an error if the app is already running as many
+// analyses as it may.
+func (i *Internal) checkAppLimits(ctx context.Context, appID string) error {
+	if appID == "" {
+		return nil
+	}
+
+	limits, err := i.getAppLimits(ctx, []string{appID})
+	if err != nil {
+		return err
+	}
+	if limits[appID] == nil || limits[appID].MaxConcurrentAnalyses == nil {
+		return nil
+	}
+
+	counts, err := i.countAnalysesByApp(ctx)
+	if err != nil {
+		return err
+	}
+
+	return appLimitError(appID, limits[appID], counts[appID])
+}
+
+// AdminGetAppLimitsHandler returns the limits on the VICE analyses of an app.
+func (i *Internal) AdminGetAppLimitsHandler(c echo.Context) error {
+	appID := c.Param("app-id")
+	if appID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "app-id parameter is empty")
+	}
+
+	limits, err := i.getAppLimits(c.Request().Context(), []string{appID})
+	if err != nil {
+		return err
+	}
+	if limits[appID] == nil {
+		return c.JSON(http.StatusOK, &AppLimits{AppID: appID})
+	}
+
+	return c.JSON(http.StatusOK, limits[appID])
+}
+
+// AdminUpdateAppLimitsHandler replaces the limits on the VICE analyses of an
+// app.
+func (i *Internal) AdminUpdateAppLimitsHandler(c echo.Context) error {
+	appID := c.Param("app-id")
+	if appID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "app-id parameter is empty")
+	}
+
+	limits := &AppLimits{}
+	if err := c.Bind(limits); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	limits.AppID = appID
+
+	if limits.MaxConcurrentAnalyses != nil && *limits.MaxConcurrentAnalyses < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "max_concurrent_analyses must not be negative")
+	}
+
+	if _, err := i.db.ExecContext(c.Request().Context(), upsertAppLimitsSQL, appID, limits.MaxConcurrentAnalyses); err != nil {
+		return errors.Wrapf(err, "error updating the limits for app %s", appID)
+	}
+
+	return c.JSON(http.StatusOK, limits)
+}
+
+// InstantLaunchEvaluation reports whether a user can launch an instant launch
+// right now and, if not, why.
+type InstantLaunchEvaluation struct {
+	InstantLaunchID string                 `json:"instant_launch_id"`
+	AppID           string                 `json:"app_id,omitempty"`
+	CanLaunch       bool                   `json:"can_launch"`
+	Reasons         []common.ErrorResponse `json:"reasons"`
+}
+
+// instantLaunchApp is the app used by an instant launch.
+type instantLaunchApp struct {
+	ID       string `db:"id"`
+	AppID    string `db:"app_id"`
+	Deleted  bool   `db:"deleted"`
+	Disabled bool   `db:"disabled"`
+}
+
+const getInstantLaunchAppsSQL = `
+	SELECT il.id, ql.app_id, v.deleted, v.disabled
+	  FROM instant_launches il
+	  JOIN quick_launches ql ON il.quick_launch_id = ql.id
+	  JOIN app_versions v ON ql.app_version_id = v.id
+	 WHERE il.id = ANY($1)
+`
+
+// evaluateInstantLaunches reports whether each of the instant launches can be
+// launched right now. The user's own limits are checked once by the caller,
+// and userErr is the result. The apps, their limits, and the running analyses
+// are looked up once for all of the instant launches.
+func (i *Internal) evaluateInstantLaunches(ctx context.Context, ids []string, userErr error) ([]InstantLaunchEvaluation, error) {
+	apps := []instantLaunchApp{}
+	if err := i.db.SelectContext(ctx, &apps, getInstantLaunchAppsSQL, pq.Array(ids)); err != nil {
+		return nil, errors.Wrap(err, "error looking up the apps for the instant launches")
+	}
+
+	appsByID := map[string]*instantLaunchApp{}
+	appIDs := []string{}
+	for idx := range apps {
+		appsByID[apps[idx].ID] = &apps[idx]
+		appIDs = append(appIDs, apps[idx].AppID)
+	}
+
+	limits, err := i.getAppLimits(ctx, appIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	var counts map[string]int
+	if len(limits) > 0 {
+		if counts, err = i.countAnalysesByApp(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	// These apply to all of the instant launches.
+	shared := []common.ErrorResponse{}
+	if err = i.checkMaintenance(); err != nil {
+		shared = append(shared, common.NewErrorResponse(err))
+	}
+	if userErr != nil {
+		shared = append(shared, common.NewErrorResponse(userErr))
+	}
+
+	evaluations := []InstantLaunchEvaluation{}
+	for _, id := range ids {
+		evaluation := InstantLaunchEvaluation{
+			InstantLaunchID: id,
+			Reasons:         append([]common.ErrorResponse{}, shared...),
+		}
+
+		app := appsByID[id]
+		switch {
+		case app == nil:
+			evaluation.Reasons = append(evaluation.Reasons, common.ErrorResponse{
+				ErrorCode: "ERR_NOT_FOUND",
+				Message:   fmt.Sprintf("instant launch %s doesn't exist", id),
+			})
+		case app.Deleted || app.Disabled:
+			evaluation.AppID = app.AppID
+			evaluation.Reasons = append(evaluation.Reasons, common.ErrorResponse{
+				ErrorCode: "ERR_APP_DISABLED",
+				Message:   "the app used by the instant launch has been disabled or deleted",
+			})
+		default:
+			evaluation.AppID = app.AppID
+			if err = appLimitError(app.AppID, limits[app.AppID], counts[app.AppID]); err != nil {
+				evaluation.Reasons = append(evaluation.Reasons, common.NewErrorResponse(err))
+			}
+		}
+
+		evaluation.CanLaunch = len(evaluation.Reasons) == 0
+		evaluations = append(evaluations, evaluation)
+	}
+
+	return evaluations, nil
+}
+
+// EvaluateInstantLaunchesHandler reports whether the user in the user query
+// parameter can launch each of the instant launches in the request body right
+// now, so that the instant launch dashboard can disable the ones that would
+// fail. The user's job limits and resource overages, the apps' concurrency
+// limits, and maintenance mode are checked.
+func (i *Internal) EvaluateInstantLaunchesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	user := c.QueryParam("user")
+	if user == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "user query parameter must be set")
+	}
+
+	body := struct {
+		InstantLaunchIDs []string `json:"instant_launch_ids"`
+	}{}
+	if err := c.Bind(&body); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if len(body.InstantLaunchIDs) > maxEvaluatedInstantLaunches {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("at most %d instant launches can be evaluated at once", maxEvaluatedInstantLaunches))
+	}
+
+	var userErr error
+	if status, err := i.checkUserJobLimits(ctx, user); err != nil {
+		if status == http.StatusInternalServerError {
+			return err
+		}
+		userErr = err
+	}
+
+	evaluations, err := i.evaluateInstantLaunches(ctx, body.InstantLaunchIDs, userErr)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"user":             user,
+		"instant_launches": evaluations,
+	})
+}
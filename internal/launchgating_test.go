@@ -0,0 +1,120 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestCheckMaintenance(t *testing.T) {
+	assert := assert.New(t)
+
+	i := &Internal{}
+	assert.NoError(i.checkMaintenance())
+
+	i.Maintenance.Enabled = true
+	err := i.checkMaintenance()
+	if assert.Error(err) {
+		assert.Equal("ERR_MAINTENANCE", err.(common.ErrorResponse).ErrorCode)
+		assert.Equal(defaultMaintenanceMessage, err.(common.ErrorResponse).Message)
+	}
+
+	i.Maintenance.Message = "back at 5pm"
+	assert.Equal("back at 5pm", i.checkMaintenance().(common.ErrorResponse).Message)
+}
+
+func TestCheckAppLimits(t *testing.T) {
+	assert := assert.New(t)
+
+	mockdb, mock, err := sqlmock.New()
+	assert.NoError(err)
+	defer mockdb.Close()
+
+	i := &Internal{
+		Init:      Init{ViceNamespace: "vice-apps"},
+		db:        sqlx.NewDb(mockdb, "sqlmock"),
+		clientset: fake.NewSimpleClientset(appDeployment("e1", "a1", "jupyter"), appDeployment("e2", "a1", "jupyter")),
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta("FROM vice_app_limits")).
+		WillReturnRows(sqlmock.NewRows([]string{"app_id", "max_concurrent_analyses"}).AddRow("a1", 2))
+	err = i.checkAppLimits(context.Background(), "a1")
+	if assert.Error(err) {
+		assert.Equal("ERR_APP_LIMIT_REACHED", err.(common.ErrorResponse).ErrorCode)
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta("FROM vice_app_limits")).
+		WillReturnRows(sqlmock.NewRows([]string{"app_id", "max_concurrent_analyses"}).AddRow("a1", 3))
+	assert.NoError(i.checkAppLimits(context.Background(), "a1"))
+
+	// Apps without limits don't need the running analyses to be counted.
+	mock.ExpectQuery(regexp.QuoteMeta("FROM vice_app_limits")).
+		WillReturnRows(sqlmock.NewRows([]string{"app_id", "max_concurrent_analyses"}))
+	assert.NoError(i.checkAppLimits(context.Background(), "a2"))
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestEvaluateInstantLaunches(t *testing.T) {
+	assert := assert.New(t)
+
+	mockdb, mock, err := sqlmock.New()
+	assert.NoError(err)
+	defer mockdb.Close()
+
+	i := &Internal{
+		Init:      Init{ViceNamespace: "vice-apps"},
+		db:        sqlx.NewDb(mockdb, "sqlmock"),
+		clientset: fake.NewSimpleClientset(appDeployment("e1", "a1", "jupyter")),
+	}
+
+	// The apps and their limits are looked up once for all of the instant
+	// launches.
+	mock.ExpectQuery(regexp.QuoteMeta("FROM instant_launches il")).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "app_id", "deleted", "disabled"}).
+			AddRow("il1", "a1", false, false).
+			AddRow("il2", "a2", false, false).
+			AddRow("il3", "a3", false, true))
+	mock.ExpectQuery(regexp.QuoteMeta("FROM vice_app_limits")).
+		WillReturnRows(sqlmock.NewRows([]string{"app_id", "max_concurrent_analyses"}).AddRow("a1", 1))
+
+	evaluations, err := i.evaluateInstantLaunches(context.Background(), []string{"il1", "il2", "il3", "il4"}, nil)
+	assert.NoError(err)
+	if assert.Len(evaluations, 4) {
+		assert.False(evaluations[0].CanLaunch)
+		assert.Equal("ERR_APP_LIMIT_REACHED", evaluations[0].Reasons[0].ErrorCode)
+		assert.True(evaluations[1].CanLaunch)
+		assert.Empty(evaluations[1].Reasons)
+		assert.Equal("ERR_APP_DISABLED", evaluations[2].Reasons[0].ErrorCode)
+		assert.Equal("ERR_NOT_FOUND", evaluations[3].Reasons[0].ErrorCode)
+	}
+
+	// The user's limits and maintenance mode apply to every instant launch.
+	i.Maintenance.Enabled = true
+	mock.ExpectQuery(regexp.QuoteMeta("FROM instant_launches il")).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "app_id", "deleted", "disabled"}).AddRow("il2", "a2", false, false))
+	mock.ExpectQuery(regexp.QuoteMeta("FROM vice_app_limits")).
+		WillReturnRows(sqlmock.NewRows([]string{"app_id", "max_concurrent_analyses"}))
+
+	userErr := common.ErrorResponse{ErrorCode: "ERR_LIMIT_REACHED", Message: "too many jobs"}
+	evaluations, err = i.evaluateInstantLaunches(context.Background(), []string{"il2"}, userErr)
+	assert.NoError(err)
+	if assert.Len(evaluations, 1) && assert.Len(evaluations[0].Reasons, 2) {
+		assert.False(evaluations[0].CanLaunch)
+		assert.Equal("ERR_MAINTENANCE", evaluations[0].Reasons[0].ErrorCode)
+		assert.Equal("ERR_LIMIT_REACHED", evaluations[0].Reasons[1].ErrorCode)
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta("FROM instant_launches il")).WillReturnError(errors.New("connection reset"))
+	_, err = i.evaluateInstantLaunches(context.Background(), []string{"il1"}, nil)
+	assert.Error(err)
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
@@ -0,0 +1,225 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const defaultLaunchQueueTimeout = 30 * time.Second
+
+// LaunchLimiterConfig contains the settings for limiting the number of
+// launches that are in flight at once. A burst of launches, such as a class
+// starting the same app at the same time, would otherwise all hit the k8s
+// API and the iRODS CSI driver together.
+type LaunchLimiterConfig struct {
+	Enabled bool
+
+	// MaxInFlight is the number of launches that may be in progress at once.
+	MaxInFlight int
+
+	// MaxQueued is the number of launches that may wait for one of the
+	// in-flight launches to finish. Launches beyond that are refused right
+	// away. Zero means that launches never wait.
+	MaxQueued int
+
+	// QueueTimeout is how long a launch waits before it's refused.
+	QueueTimeout time.Duration
+}
+
+// Validate returns an error if the limiter is enabled without room for any
+// launches.
+func (c *LaunchLimiterConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.MaxInFlight <= 0 {
+		return fmt.Errorf("the maximum number of in-flight launches must be positive")
+	}
+	if c.MaxQueued < 0 {
+		return fmt.Errorf("the maximum number of queued launches must not be negative")
+	}
+	if c.QueueTimeout < 0 {
+		return fmt.Errorf("the launch queue timeout must not be negative")
+	}
+	return nil
+}
+
+// LaunchLimiterStats describes the launches that have gone through the
+// limiter since app-exposer started.
+type LaunchLimiterStats struct {
+	Enabled     bool `json:"enabled"`
+	MaxInFlight int  `json:"max_in_flight"`
+	MaxQueued   int  `json:"max_queued"`
+
+	InFlight int `json:"in_flight"`
+	Queued   int `json:"queued"`
+
+	// Admitted counts the launches that were allowed to proceed, including
+	// the ones that had to wait.
+	Admitted int64 `json:"admitted"`
+	Waited   int64 `json:"waited"`
+
+	// RejectedQueueFull counts the launches that were refused because the
+	// queue was full, and TimedOut counts the ones that gave up waiting.
+	RejectedQueueFull int64 `json:"rejected_queue_full"`
+	TimedOut          int64 `json:"timed_out"`
+
+	TotalWaitMS int64 `json:"total_wait_ms"`
+	MaxWaitMS   int64 `json:"max_wait_ms"`
+}
+
+// launchLimiterError is returned for launches that are refused by the
+// limiter.
+type launchLimiterError struct {
+	message    string
+	retryAfter time.Duration
+}
+
+// Error implements the error interface.
+func (e *launchLimiterError) Error() string {
+	return e.message
+}
+
+// LaunchLimiter is a semaphore for launches that lets a limited number of
+// them wait for a turn.
+type LaunchLimiter struct {
+	slots        chan struct{}
+	maxQueued    int
+	queueTimeout time.Duration
+
+	mu    sync.Mutex
+	stats LaunchLimiterStats
+}
+
+// NewLaunchLimiter returns a new *LaunchLimiter.
+func NewLaunchLimiter(cfg *LaunchLimiterConfig) *LaunchLimiter {
+	queueTimeout := cfg.QueueTimeout
+	if queueTimeout <= 0 {
+		queueTimeout = defaultLaunchQueueTimeout
+	}
+	return &LaunchLimiter{
+		slots:        make(chan struct{}, cfg.MaxInFlight),
+		maxQueued:    cfg.MaxQueued,
+		queueTimeout: queueTimeout,
+		stats: LaunchLimiterStats{
+			Enabled:     true,
+			MaxInFlight: cfg.MaxInFlight,
+			MaxQueued:   cfg.MaxQueued,
+		},
+	}
+}
+
+// admitted records a launch that was allowed to proceed after waiting.
+func (l *LaunchLimiter) admitted(wait time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.stats.InFlight++
+	l.stats.Admitted++
+	if wait > 0 {
+		l.stats.Waited++
+		l.stats.TotalWaitMS += wait.Milliseconds()
+		if wait.Milliseconds() > l.stats.MaxWaitMS {
+			l.stats.MaxWaitMS = wait.Milliseconds()
+		}
+	}
+}
+
+// release frees the launch's slot.
+func (l *LaunchLimiter) release() {
+	l.mu.Lock()
+	l.stats.InFlight--
+	l.mu.Unlock()
+
+	<-l.slots
+}
+
+// Acquire waits for a launch slot. The returned function must be called to
+// free the slot once the launch is done. Launches are refused if too many
+// are already waiting, or if a slot doesn't open up before the queue
+// timeout.
+func (l *LaunchLimiter) Acquire(ctx context.Context) (func(), error) {
+	select {
+	case l.slots <- struct{}{}:
+		l.admitted(0)
+		return l.release, nil
+	default:
+	}
+
+	l.mu.Lock()
+	if l.stats.Queued >= l.maxQueued {
+		l.stats.RejectedQueueFull++
+		l.mu.Unlock()
+		return nil, &launchLimiterError{
+			message:    "too many analyses are being launched right now; please try again shortly",
+			retryAfter: l.queueTimeout,
+		}
+	}
+	l.stats.Queued++
+	l.mu.Unlock()
+
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+
+	start := time.Now()
+	defer func() {
+		l.mu.Lock()
+		l.stats.Queued--
+		l.mu.Unlock()
+	}()
+
+	select {
+	case l.slots <- struct{}{}:
+		l.admitted(time.Since(start))
+		return l.release, nil
+	case <-timer.C:
+		l.mu.Lock()
+		l.stats.TimedOut++
+		l.mu.Unlock()
+		return nil, &launchLimiterError{
+			message:    fmt.Sprintf("the launch waited %s without its turn coming up; please try again shortly", l.queueTimeout),
+			retryAfter: l.queueTimeout,
+		}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Stats returns a snapshot of the limiter's statistics.
+func (l *LaunchLimiter) Stats() LaunchLimiterStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.stats
+}
+
+// acquireLaunchSlot waits for the launch's turn if the limiter is enabled.
+// Launches that are refused get a 503 with a Retry-After header so that the
+// DE knows to try again later.
+func (i *Internal) acquireLaunchSlot(c echo.Context) (func(), error) {
+	if i.launchLimiter == nil {
+		return func() {}, nil
+	}
+
+	release, err := i.launchLimiter.Acquire(c.Request().Context())
+	if limiterErr, ok := err.(*launchLimiterError); ok {
+		c.Response().Header().Set("Retry-After", fmt.Sprintf("%d", int64(math.Ceil(limiterErr.retryAfter.Seconds()))))
+		return nil, echo.NewHTTPError(http.StatusServiceUnavailable, limiterErr.Error())
+	}
+	return release, err
+}
+
+// AdminLaunchLimiterHandler returns the number of launches that are in
+// flight and waiting, along with counts of the launches that have gone
+// through the limiter.
+func (i *Internal) AdminLaunchLimiterHandler(c echo.Context) error {
+	if i.launchLimiter == nil {
+		return c.JSON(http.StatusOK, LaunchLimiterStats{})
+	}
+	return c.JSON(http.StatusOK, i.launchLimiter.Stats())
+}
@@ -0,0 +1,86 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLaunchLimiter(t *testing.T) {
+	assert := assert.New(t)
+
+	l := NewLaunchLimiter(&LaunchLimiterConfig{MaxInFlight: 1, MaxQueued: 1, QueueTimeout: time.Second})
+
+	release, err := l.Acquire(context.Background())
+	assert.NoError(err)
+
+	// The second launch waits for the first one to finish.
+	admitted := make(chan func())
+	go func() {
+		waiting, err := l.Acquire(context.Background())
+		assert.NoError(err)
+		admitted <- waiting
+	}()
+	assert.Eventually(func() bool { return l.Stats().Queued == 1 }, time.Second, time.Millisecond)
+
+	// The queue is full, so the third launch is refused right away.
+	_, err = l.Acquire(context.Background())
+	assert.IsType(&launchLimiterError{}, err)
+
+	release()
+	waiting := <-admitted
+
+	stats := l.Stats()
+	assert.Equal(1, stats.InFlight)
+	assert.Equal(0, stats.Queued)
+	assert.Equal(int64(2), stats.Admitted)
+	assert.Equal(int64(1), stats.Waited)
+	assert.Equal(int64(1), stats.RejectedQueueFull)
+
+	// Launches that wait too long give up.
+	l.queueTimeout = 10 * time.Millisecond
+	_, err = l.Acquire(context.Background())
+	assert.IsType(&launchLimiterError{}, err)
+	assert.Equal(int64(1), l.Stats().TimedOut)
+
+	// So do launches whose requests are canceled.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	l.queueTimeout = time.Second
+	_, err = l.Acquire(ctx)
+	assert.ErrorIs(err, context.Canceled)
+
+	waiting()
+	assert.Equal(0, l.Stats().InFlight)
+}
+
+func TestAcquireLaunchSlot(t *testing.T) {
+	assert := assert.New(t)
+
+	// Launches aren't limited when the limiter is disabled.
+	i := &Internal{}
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodPost, "/vice/launch", nil), httptest.NewRecorder())
+	release, err := i.acquireLaunchSlot(c)
+	assert.NoError(err)
+	release()
+
+	i.launchLimiter = NewLaunchLimiter(&LaunchLimiterConfig{MaxInFlight: 1, QueueTimeout: 2 * time.Second})
+	release, err = i.acquireLaunchSlot(c)
+	assert.NoError(err)
+	defer release()
+
+	rec := httptest.NewRecorder()
+	c = echo.New().NewContext(httptest.NewRequest(http.MethodPost, "/vice/launch", nil), rec)
+	_, err = i.acquireLaunchSlot(c)
+	if assert.Error(err) {
+		httpErr, ok := err.(*echo.HTTPError)
+		assert.True(ok)
+		assert.Equal(http.StatusServiceUnavailable, httpErr.Code)
+	}
+	assert.Equal("2", rec.Header().Get("Retry-After"))
+}
@@ -0,0 +1,155 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/cyverse-de/model/v6"
+	"github.com/labstack/echo/v4"
+	apiv1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// redactedSecretValue replaces the values of the Secrets in launch previews.
+const redactedSecretValue = "REDACTED"
+
+// LaunchPreview contains the resources that would be created for a launch
+// request.
+type LaunchPreview struct {
+	// Resources are the manifests of the resources, in the order they would
+	// be created.
+	Resources []json.RawMessage `json:"resources"`
+}
+
+// redactSecret returns a copy of the Secret without its values, so that
+// previews don't expose the proxy credentials or session tokens.
+func redactSecret(secret *apiv1.Secret) *apiv1.Secret {
+	redacted := secret.DeepCopy()
+	for key := range redacted.Data {
+		redacted.Data[key] = []byte(redactedSecretValue)
+	}
+	for key := range redacted.StringData {
+		redacted.StringData[key] = redactedSecretValue
+	}
+	return redacted
+}
+
+// previewLaunch builds the resources for the job the same way launches do,
+// without creating anything or checking the user's quota. The job must
+// already have been bound and validated.
+func (i *Internal) previewLaunch(ctx context.Context, job *model.Job, opts *launchOptions) (*LaunchPreview, error) {
+	if err := applyDatasetMetadata(job, opts); err != nil {
+		return nil, err
+	}
+
+	if err := i.applyResourcePreset(job, opts); err != nil {
+		return nil, err
+	}
+
+	if err := i.applySharedMemory(job, opts); err != nil {
+		return nil, err
+	}
+
+	settings, err := i.getToolSettings(ctx, job)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = validateRunAs(job, settings); err != nil {
+		return nil, err
+	}
+
+	if err = validateEntryPoint(job); err != nil {
+		return nil, err
+	}
+
+	deployment, err := i.getDeployment(ctx, job, settings)
+	if err != nil {
+		return nil, err
+	}
+	setResourcePresetLabel(deployment, opts)
+	i.applyDemoMode(deployment, job, opts)
+
+	deployment, err = i.applyDeploymentPolicy(ctx, job, deployment)
+	if err != nil {
+		return nil, err
+	}
+
+	resources, err := i.dryRunResources(ctx, job, deployment, settings)
+	if err != nil {
+		return nil, err
+	}
+
+	preview := &LaunchPreview{
+		Resources: []json.RawMessage{},
+	}
+	for _, resource := range resources {
+		if secret, ok := resource.object.(*apiv1.Secret); ok {
+			resource.object = redactSecret(secret)
+		}
+
+		data, err := applyPatchData(resource)
+		if err != nil {
+			return nil, err
+		}
+		preview.Resources = append(preview.Resources, data)
+	}
+
+	return preview, nil
+}
+
+// previewYAML returns the resources in the preview as a multi-document YAML
+// stream.
+func previewYAML(preview *LaunchPreview) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, resource := range preview.Resources {
+		data, err := yaml.JSONToYAML(resource)
+		if err != nil {
+			return nil, err
+		}
+		buf.WriteString("---\n")
+		buf.Write(data)
+	}
+	return buf.Bytes(), nil
+}
+
+// LaunchPreviewHandler returns the Deployment, Service, Ingress, ConfigMaps,
+// Secrets, and volumes that would be created for the submission in the
+// request body, without creating anything in the cluster. The Secrets' values
+// are redacted. The resources are returned as JSON, or as YAML if the format
+// query parameter is yaml.
+func (i *Internal) LaunchPreviewHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	format := c.QueryParam("format")
+	if format != "" && format != "json" && format != "yaml" {
+		return echo.NewHTTPError(http.StatusBadRequest, "format must be json or yaml")
+	}
+
+	job := &model.Job{}
+	opts, err := bindLaunchRequest(c, job)
+	if err != nil {
+		return err
+	}
+
+	if err = validateSubmission(job); err != nil {
+		return err
+	}
+
+	preview, err := i.previewLaunch(ctx, job, opts)
+	if err != nil {
+		return err
+	}
+
+	if format == "yaml" {
+		data, err := previewYAML(preview)
+		if err != nil {
+			return err
+		}
+		return c.Blob(http.StatusOK, "application/yaml", data)
+	}
+
+	return c.JSON(http.StatusOK, preview)
+}
@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cyverse-de/app-exposer/jobgen"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func launchPreviewRequest(t *testing.T, format string) (*Internal, *fake.Clientset, *httptest.ResponseRecorder, error) {
+	t.Helper()
+
+	i, mock, clientset := newLaunchTestInternal(t)
+	expectLaunchSpecQueries(mock)
+
+	generator := &jobgen.Generator{UserSuffix: "@example.org"}
+	job, err := generator.Generate(&jobgen.Descriptor{User: "ipcdev", UserID: "u1", Name: "preview"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(job)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target := "/vice/launch/preview"
+	if format != "" {
+		target += "?format=" + format
+	}
+	req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(string(body)))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	err = i.LaunchPreviewHandler(echo.New().NewContext(req, rec))
+
+	return i, clientset, rec, err
+}
+
+func TestLaunchPreviewHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	_, clientset, rec, err := launchPreviewRequest(t, "")
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal(http.StatusOK, rec.Code)
+
+	preview := struct {
+		Resources []struct {
+			APIVersion string            `json:"apiVersion"`
+			Kind       string            `json:"kind"`
+			Data       map[string]string `json:"data"`
+		} `json:"resources"`
+	}{}
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &preview))
+
+	kinds := []string{}
+	for _, resource := range preview.Resources {
+		kinds = append(kinds, resource.Kind)
+		if resource.Kind == "Secret" {
+			for _, value := range resource.Data {
+				// Secret data is base64-encoded in the manifest.
+				assert.Equal("UkVEQUNURUQ=", value)
+			}
+		}
+	}
+	assert.Equal([]string{"ConfigMap", "ConfigMap", "Secret", "Deployment", "Service", "Ingress"}, kinds)
+	assert.Equal("apps/v1", preview.Resources[3].APIVersion)
+
+	// Nothing is created.
+	assert.Empty(clientset.Actions())
+}
+
+func TestLaunchPreviewHandlerYAML(t *testing.T) {
+	assert := assert.New(t)
+
+	_, _, rec, err := launchPreviewRequest(t, "yaml")
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal("application/yaml", rec.Header().Get(echo.HeaderContentType))
+	assert.Equal(6, strings.Count(rec.Body.String(), "---\n"))
+	assert.Contains(rec.Body.String(), "kind: Deployment\n")
+
+	req := httptest.NewRequest(http.MethodPost, "/vice/launch/preview?format=xml", nil)
+	err = (&Internal{}).LaunchPreviewHandler(echo.New().NewContext(req, httptest.NewRecorder()))
+	if assert.Error(err) {
+		assert.Equal(http.StatusBadRequest, err.(*echo.HTTPError).Code)
+	}
+}
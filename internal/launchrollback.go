@@ -0,0 +1,75 @@
+package internal
+
+import (
+	"context"
+	"time"
+
+	"github.com/cyverse-de/model/v6"
+)
+
+// launchRollbackTimeout limits the time it takes to delete the resources of
+// a launch that failed partway.
+const launchRollbackTimeout = 2 * time.Minute
+
+// LaunchRollbackError is returned when a launch failed after some of the
+// analysis's resources were created and app-exposer tried to delete them
+// again.
+type LaunchRollbackError struct {
+	// Err is the error that made the launch fail.
+	Err error
+
+	// CleanedUp lists the resources that were deleted, as kind/name.
+	CleanedUp []string
+
+	// CleanupErr is set if some of the resources couldn't be deleted.
+	CleanupErr error
+}
+
+// Error returns the message of the error that made the launch fail.
+func (e *LaunchRollbackError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the error that made the launch fail.
+func (e *LaunchRollbackError) Unwrap() error {
+	return e.Err
+}
+
+// Details returns the details added to the error response. rolled_back is
+// only true if everything that was created was deleted.
+func (e *LaunchRollbackError) Details() map[string]interface{} {
+	details := map[string]interface{}{
+		"rolled_back": e.CleanupErr == nil,
+		"cleaned_up":  e.CleanedUp,
+	}
+	if e.CleanupErr != nil {
+		details["cleanup_error"] = e.CleanupErr.Error()
+	}
+	return details
+}
+
+// rollBackLaunch deletes the resources created for a launch that failed with
+// launchErr and returns the error to respond with. The resources are left
+// alone unless launch rollbacks are enabled.
+func (i *Internal) rollBackLaunch(ctx context.Context, job *model.Job, launchErr error) error {
+	if !i.LaunchRollback {
+		return launchErr
+	}
+
+	// The request may have been canceled, but the resources still need to go.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), launchRollbackTimeout)
+	defer cancel()
+
+	cleanedUp, err := i.deleteAnalysisResources(ctx, job.InvocationID)
+	if err != nil {
+		log.WithContext(ctx).Errorf("unable to roll back the launch of %s: %s", job.InvocationID, err)
+	} else {
+		log.WithContext(ctx).Infof("rolled back the launch of %s, deleting %v", job.InvocationID, cleanedUp)
+	}
+
+	return &LaunchRollbackError{
+		Err:        launchErr,
+		CleanedUp:  cleanedUp,
+		CleanupErr: err,
+	}
+}
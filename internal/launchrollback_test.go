@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/cyverse-de/model/v6"
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestRollBackLaunch(t *testing.T) {
+	assert := assert.New(t)
+
+	meta := func(name, externalID string) metav1.ObjectMeta {
+		return metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "vice-apps",
+			Labels:    map[string]string{"external-id": externalID},
+		}
+	}
+
+	clientset := fake.NewSimpleClientset(
+		&apiv1.ConfigMap{ObjectMeta: meta("excludes-file-e1", "e1")},
+		&apiv1.Secret{ObjectMeta: meta("proxy-e1", "e1")},
+		&appsv1.Deployment{ObjectMeta: meta("e1", "e1")},
+		&appsv1.Deployment{ObjectMeta: meta("e2", "e2")},
+	)
+	i := &Internal{
+		Init:      Init{ViceNamespace: "vice-apps"},
+		clientset: clientset,
+	}
+	job := &model.Job{InvocationID: "e1"}
+	launchErr := errors.New("ingress creation failed")
+
+	// Nothing is deleted unless rollbacks are enabled.
+	assert.Equal(launchErr, i.rollBackLaunch(context.Background(), job, launchErr))
+	assert.Empty(clientset.Actions())
+
+	i.LaunchRollback = true
+	err := i.rollBackLaunch(context.Background(), job, launchErr)
+	rollback, ok := err.(*LaunchRollbackError)
+	if !assert.True(ok) {
+		return
+	}
+	assert.Equal(launchErr.Error(), rollback.Error())
+	assert.ErrorIs(rollback, launchErr)
+	assert.Equal([]string{"Deployment/e1", "ConfigMap/excludes-file-e1", "Secret/proxy-e1"}, rollback.CleanedUp)
+	assert.Equal(map[string]interface{}{
+		"rolled_back": true,
+		"cleaned_up":  []string{"Deployment/e1", "ConfigMap/excludes-file-e1", "Secret/proxy-e1"},
+	}, rollback.Details())
+
+	// Other analyses are left alone.
+	deployments, err := clientset.AppsV1().Deployments("vice-apps").List(context.Background(), metav1.ListOptions{})
+	assert.NoError(err)
+	if assert.Len(deployments.Items, 1) {
+		assert.Equal("e2", deployments.Items[0].Name)
+	}
+}
+
+func TestRollBackLaunchCleanupError(t *testing.T) {
+	assert := assert.New(t)
+
+	clientset := fake.NewSimpleClientset(
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{
+			Name:      "e1",
+			Namespace: "vice-apps",
+			Labels:    map[string]string{"external-id": "e1"},
+		}},
+	)
+	clientset.PrependReactor("delete", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("the server is on fire")
+	})
+	i := &Internal{
+		Init:      Init{ViceNamespace: "vice-apps", LaunchRollback: true},
+		clientset: clientset,
+	}
+
+	err := i.rollBackLaunch(context.Background(), &model.Job{InvocationID: "e1"}, errors.New("ingress creation failed"))
+	rollback, ok := err.(*LaunchRollbackError)
+	if !assert.True(ok) {
+		return
+	}
+	assert.Empty(rollback.CleanedUp)
+	details := rollback.Details()
+	assert.Equal(false, details["rolled_back"])
+	assert.Contains(details["cleanup_error"], "the server is on fire")
+}
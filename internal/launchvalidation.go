@@ -0,0 +1,187 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/cyverse-de/model/v6"
+	"github.com/labstack/echo/v4"
+)
+
+// The checks made when a submission is validated, in the order they're made.
+const (
+	checkSubmission          = "submission"
+	checkDatasetMetadata     = "dataset-metadata"
+	checkResourcePreset      = "resource-preset"
+	checkSharedMemory        = "shared-memory"
+	checkSnapshotRestore     = "snapshot-restore"
+	checkRunAs               = "run-as"
+	checkEntryPoint          = "entry-point"
+	checkGPURequest          = "gpu-request"
+	checkImagePullSecret     = "image-pull-secret"
+	checkRegistryPullSecrets = "registry-pull-secrets"
+	checkImageAccess         = "image-access"
+	checkImagePlatforms      = "image-platforms"
+	checkDeploymentPolicy    = "deployment-policy"
+	checkClusterDryRun       = "cluster-dry-run"
+)
+
+// LaunchProblem is a reason a submission couldn't be launched, along with the
+// check that found it.
+type LaunchProblem struct {
+	Check string `json:"check"`
+	common.ErrorResponse
+}
+
+// LaunchValidation reports the problems found with a submission without
+// launching it.
+type LaunchValidation struct {
+	Valid    bool            `json:"valid"`
+	Problems []LaunchProblem `json:"problems"`
+
+	// Skipped lists the checks that weren't made, either because they're
+	// disabled or because an earlier problem kept them from being made.
+	Skipped []string `json:"skipped"`
+}
+
+// add records the result of a check. The error is returned if the check
+// couldn't be made, rather than finding a problem with the submission.
+func (v *LaunchValidation) add(check string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if launchOutcome(err) != launchRejected {
+		return err
+	}
+
+	problem := LaunchProblem{Check: check}
+	if httpErr, ok := err.(*echo.HTTPError); ok {
+		problem.ErrorResponse = common.ErrorResponse{Message: fmt.Sprint(httpErr.Message)}
+	} else {
+		problem.ErrorResponse = common.NewErrorResponse(err)
+	}
+	v.Problems = append(v.Problems, problem)
+	return nil
+}
+
+// skip records the checks that weren't made.
+func (v *LaunchValidation) skip(checks ...string) {
+	v.Skipped = append(v.Skipped, checks...)
+}
+
+// validateLaunch makes the checks a launch would make of the submission and
+// reports every problem found, rather than stopping at the first one. The
+// user's quota and the launch gates aren't checked, and nothing is created.
+// The cluster is only asked to validate the resources if the launch dry run
+// is enabled, since app-exposer may not have permission otherwise.
+func (i *Internal) validateLaunch(ctx context.Context, job *model.Job, opts *launchOptions) (*LaunchValidation, error) {
+	v := &LaunchValidation{
+		Problems: []LaunchProblem{},
+		Skipped:  []string{},
+	}
+
+	// The resources can't be built from a submission missing the fields
+	// they're built from.
+	if err := v.add(checkSubmission, validateSubmission(job)); err != nil {
+		return nil, err
+	}
+	if len(v.Problems) > 0 {
+		v.skip(
+			checkDatasetMetadata, checkResourcePreset, checkSharedMemory, checkSnapshotRestore,
+			checkRunAs, checkEntryPoint, checkGPURequest, checkImagePullSecret, checkRegistryPullSecrets,
+			checkImageAccess, checkImagePlatforms, checkDeploymentPolicy, checkClusterDryRun,
+		)
+		return v, nil
+	}
+
+	checks := []struct {
+		name  string
+		check func() error
+	}{
+		{checkDatasetMetadata, func() error { return applyDatasetMetadata(job, opts) }},
+		{checkResourcePreset, func() error { return i.applyResourcePreset(job, opts) }},
+		{checkSharedMemory, func() error { return i.applySharedMemory(job, opts) }},
+		{checkSnapshotRestore, func() error { return i.applySnapshotRestore(ctx, job, opts) }},
+	}
+	for _, c := range checks {
+		if err := v.add(c.name, c.check()); err != nil {
+			return nil, err
+		}
+	}
+
+	settings, err := i.getToolSettings(ctx, job)
+	if err != nil {
+		return nil, err
+	}
+
+	checks = []struct {
+		name  string
+		check func() error
+	}{
+		{checkRunAs, func() error { return validateRunAs(job, settings) }},
+		{checkEntryPoint, func() error { return validateEntryPoint(job) }},
+		{checkGPURequest, func() error { return i.validateGPURequest(ctx, job, settings) }},
+		{checkImagePullSecret, func() error { return i.checkImagePullSecret(ctx) }},
+		{checkRegistryPullSecrets, func() error { return i.checkRegistryPullSecrets(ctx, job) }},
+		{checkImageAccess, func() error { return i.checkImageAccess(ctx, job) }},
+		{checkImagePlatforms, func() error { return i.checkImagePlatforms(ctx, job) }},
+	}
+	for _, c := range checks {
+		if err = v.add(c.name, c.check()); err != nil {
+			return nil, err
+		}
+	}
+
+	// The entry points and the run-as settings are needed to build the
+	// Deployment.
+	if len(v.Problems) > 0 {
+		v.skip(checkDeploymentPolicy, checkClusterDryRun)
+		v.Valid = false
+		return v, nil
+	}
+
+	deployment, err := i.getDeployment(ctx, job, settings)
+	if err != nil {
+		return nil, err
+	}
+	setResourcePresetLabel(deployment, opts)
+	i.applyDemoMode(deployment, job, opts)
+
+	deployment, err = i.applyDeploymentPolicy(ctx, job, deployment)
+	if err = v.add(checkDeploymentPolicy, err); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case len(v.Problems) > 0 || !i.LaunchDryRun:
+		v.skip(checkClusterDryRun)
+	default:
+		if err = v.add(checkClusterDryRun, i.dryRunLaunch(ctx, job, deployment, settings)); err != nil {
+			return nil, err
+		}
+	}
+
+	v.Valid = len(v.Problems) == 0
+	return v, nil
+}
+
+// ValidateLaunchHandler checks the submission in the request body the way
+// POST /vice/launch would and reports every problem found, without creating
+// anything in the cluster. Tool integrators can use it to check a submission
+// before launching it.
+func (i *Internal) ValidateLaunchHandler(c echo.Context) error {
+	job := &model.Job{}
+	opts, err := bindLaunchRequest(c, job)
+	if err != nil {
+		return err
+	}
+
+	validation, err := i.validateLaunch(c.Request().Context(), job, opts)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, validation)
+}
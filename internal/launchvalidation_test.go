@@ -0,0 +1,124 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cyverse-de/app-exposer/jobgen"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func launchValidationRequest(t *testing.T, body string) (*fake.Clientset, *LaunchValidation, error) {
+	t.Helper()
+
+	i, mock, clientset := newLaunchTestInternal(t)
+	expectLaunchSpecQueries(mock)
+
+	req := httptest.NewRequest(http.MethodPost, "/vice/launch/validate", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	if err := i.ValidateLaunchHandler(echo.New().NewContext(req, rec)); err != nil {
+		return clientset, nil, err
+	}
+
+	validation := &LaunchValidation{}
+	if err := json.Unmarshal(rec.Body.Bytes(), validation); err != nil {
+		t.Fatal(err)
+	}
+	return clientset, validation, nil
+}
+
+// validationJob returns a valid submission with the launch options merged
+// into it.
+func validationJob(t *testing.T, opts map[string]interface{}) string {
+	t.Helper()
+
+	generator := &jobgen.Generator{UserSuffix: "@example.org"}
+	job, err := generator.Generate(&jobgen.Descriptor{User: "ipcdev", UserID: "u1", Name: "validate"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := json.Marshal(job)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := map[string]interface{}{}
+	if err = json.Unmarshal(raw, &body); err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range opts {
+		body[key] = value
+	}
+	raw, err = json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(raw)
+}
+
+func problemChecks(validation *LaunchValidation) []string {
+	checks := []string{}
+	for _, problem := range validation.Problems {
+		checks = append(checks, problem.Check)
+	}
+	return checks
+}
+
+func TestValidateLaunchHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	clientset, validation, err := launchValidationRequest(t, validationJob(t, nil))
+	if !assert.NoError(err) {
+		return
+	}
+	assert.True(validation.Valid)
+	assert.Empty(validation.Problems)
+
+	// The cluster is only asked to validate the resources if the dry run is
+	// enabled.
+	assert.Equal([]string{checkClusterDryRun}, validation.Skipped)
+
+	// Nothing is created.
+	assert.Empty(clientset.Actions())
+}
+
+func TestValidateLaunchHandlerProblems(t *testing.T) {
+	assert := assert.New(t)
+
+	// Every problem is reported, not just the first one.
+	_, validation, err := launchValidationRequest(t, validationJob(t, map[string]interface{}{
+		"resource_preset": "huge",
+		"shared_memory":   "4Gi",
+	}))
+	if !assert.NoError(err) {
+		return
+	}
+	assert.False(validation.Valid)
+	assert.Equal([]string{checkResourcePreset, checkSharedMemory}, problemChecks(validation))
+	assert.Contains(validation.Problems[1].Message, "can't be changed")
+	assert.Equal([]string{checkDeploymentPolicy, checkClusterDryRun}, validation.Skipped)
+
+	// The other checks can't be made without the fields the submission
+	// check requires.
+	_, validation, err = launchValidationRequest(t, `{"app_id": "a1"}`)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.False(validation.Valid)
+	if assert.Equal([]string{checkSubmission}, problemChecks(validation)) {
+		assert.Equal("ERR_INVALID_SUBMISSION", validation.Problems[0].ErrorCode)
+	}
+	assert.Contains(validation.Skipped, checkImageAccess)
+	assert.Contains(validation.Skipped, checkClusterDryRun)
+
+	_, _, err = launchValidationRequest(t, `not json`)
+	if assert.Error(err) {
+		assert.Equal(http.StatusBadRequest, err.(*echo.HTTPError).Code)
+	}
+}
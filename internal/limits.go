@@ -61,6 +61,12 @@ func (i *Internal) countJobsForUser(ctx context.Context, username string) (int,
 
 		labels := deployment.GetLabels()
 
+		// Demo analyses don't count against the job limit unless demo mode
+		// is configured to count them.
+		if labels[demoLabel] == "true" && !i.Demo.CountQuota {
+			continue
+		}
+
 		// If we don't have the external-id on the deployment, count it.
 		if externalID, ok = labels["external-id"]; !ok {
 			countedDeployments = append(countedDeployments, deployment)
@@ -70,7 +76,7 @@ func (i *Internal) countJobsForUser(ctx context.Context, username string) (int,
 		if analysisID, err = i.apps.GetAnalysisIDByExternalID(ctx, externalID); err != nil {
 			// If we failed to get it from the database, count it because it
 			// shouldn't be running.
-			log.Error(err)
+			log.WithContext(ctx).Error(err)
 			countedDeployments = append(countedDeployments, deployment)
 			continue
 		}
@@ -79,7 +85,7 @@ func (i *Internal) countJobsForUser(ctx context.Context, username string) (int,
 		if err != nil {
 			// If we failed to get the status, then something is horribly wrong.
 			// Count the analysis.
-			log.Error(err)
+			log.WithContext(ctx).Error(err)
 			countedDeployments = append(countedDeployments, deployment)
 			continue
 		}
@@ -96,21 +102,62 @@ func (i *Internal) countJobsForUser(ctx context.Context, username string) (int,
 	return len(countedDeployments), nil
 }
 
+// The sources of a user's concurrent job limit.
+const (
+	jobLimitUser    = "user"
+	jobLimitGroup   = "group"
+	jobLimitDefault = "default"
+)
+
+// JobLimit is the number of jobs a user may run at once and where it came
+// from.
+type JobLimit struct {
+	Username       string `json:"username" db:"-"`
+	ConcurrentJobs int    `json:"concurrent_jobs" db:"concurrent_jobs"`
+
+	// Source is user for the user's own row in job_limits, group for the
+	// limit of a group the user is in, or default.
+	Source string `json:"source" db:"source"`
+
+	// Group is the group the limit came from, if it came from one.
+	Group *string `json:"group,omitempty" db:"group_name"`
+
+	// Running is the number of jobs the user is running, which is only
+	// reported to administrators.
+	Running *int `json:"running,omitempty" db:"-"`
+}
+
+// getJobLimitForUserSQL returns the user's own job limit if they have one and
+// the most generous limit of the groups they're in otherwise.
 const getJobLimitForUserSQL = `
-	SELECT concurrent_jobs FROM job_limits
-	WHERE launcher = regexp_replace($1, '-', '_')
+	SELECT source, group_name, concurrent_jobs
+	  FROM (
+		SELECT 'user' AS source, NULL AS group_name, concurrent_jobs, 0 AS priority
+		  FROM job_limits
+		 WHERE launcher = regexp_replace($1, '-', '_')
+		 UNION ALL
+		SELECT 'group', g.name, g.concurrent_jobs, 1
+		  FROM vice_job_limit_groups g
+		  JOIN vice_job_limit_group_members m ON m.group_name = g.name
+		 WHERE m.launcher = regexp_replace($1, '-', '_')
+	  ) AS limits
+	 ORDER BY priority, concurrent_jobs DESC
+	 LIMIT 1
 `
 
-func (i *Internal) getJobLimitForUser(username string) (*int, error) {
-	var jobLimit int
-	err := i.db.QueryRow(getJobLimitForUserSQL, username).Scan(&jobLimit)
+// getJobLimitForUser returns the user's own job limit or the limit of their
+// groups, or nil if the default limit applies to them.
+func (i *Internal) getJobLimitForUser(username string) (*JobLimit, error) {
+	jobLimit := &JobLimit{}
+	err := i.db.Get(jobLimit, getJobLimitForUserSQL, username)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
 	if err != nil {
 		return nil, err
 	}
-	return &jobLimit, nil
+	jobLimit.Username = username
+	return jobLimit, nil
 }
 
 const getDefaultJobLimitSQL = `
@@ -221,26 +268,40 @@ func validateJobLimits(user string, defaultJobLimit, jobCount int, jobLimit *int
 	}
 }
 
-func (i *Internal) validateJob(ctx context.Context, job *model.Job) (int, error) {
+// validateJob returns an error if the job can't be launched. The user's job
+// limits and resource overages are only checked if countQuota is true.
+func (i *Internal) validateJob(ctx context.Context, job *model.Job, countQuota bool) (int, error) {
 
 	// Verify that the job type is supported by this service
 	if strings.ToLower(job.ExecutionTarget) != "interapps" {
 		return http.StatusInternalServerError, fmt.Errorf("job type %s is not supported by this service", job.Type)
 	}
 
-	// Get the username
-	usernameLabelValue := labelValueString(job.Submitter)
-	user := job.Submitter
+	if !countQuota {
+		return http.StatusOK, nil
+	}
+
+	return i.checkUserJobLimits(ctx, job.Submitter)
+}
+
+// checkUserJobLimits returns an error if the user has reached their
+// concurrent job limit, isn't allowed to run jobs, or has resource overages.
+func (i *Internal) checkUserJobLimits(ctx context.Context, user string) (int, error) {
+	usernameLabelValue := labelValueString(user)
 
 	// Validate the number of concurrent jobs for the user.
 	jobCount, err := i.countJobsForUser(ctx, usernameLabelValue)
 	if err != nil {
 		return http.StatusInternalServerError, errors.Wrapf(err, "unable to determine the number of jobs that %s is currently running", user)
 	}
-	jobLimit, err := i.getJobLimitForUser(user)
+	userJobLimit, err := i.getJobLimitForUser(user)
 	if err != nil {
 		return http.StatusInternalServerError, errors.Wrapf(err, "unable to determine the concurrent job limit for %s", user)
 	}
+	var jobLimit *int
+	if userJobLimit != nil {
+		jobLimit = &userJobLimit.ConcurrentJobs
+	}
 	defaultJobLimit, err := i.getDefaultJobLimit()
 	if err != nil {
 		return http.StatusInternalServerError, errors.Wrapf(err, "unable to determine the default concurrent job limit")
@@ -0,0 +1,216 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cyverse-de/model/v6"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// The types of liveness probes that may be configured for a tool.
+const (
+	livenessProbeHTTP = "http"
+	livenessProbeTCP  = "tcp"
+	livenessProbeExec = "exec"
+)
+
+// The defaults for the liveness probe settings that aren't configured. A
+// hung app is restarted after about five minutes of failed checks, and it has
+// five minutes to start up before it's checked at all.
+const (
+	defaultLivenessInitialDelaySeconds = 300
+	defaultLivenessPeriodSeconds       = 30
+	defaultLivenessTimeoutSeconds      = 10
+	defaultLivenessFailureThreshold    = 10
+)
+
+// livenessRestartReason is the reason recorded for restarts of containers that
+// failed their liveness probes.
+const livenessRestartReason = "LivenessProbeFailed"
+
+// LivenessProbe configures the liveness probe for the analysis container. The
+// kubelet restarts the container if the probe fails FailureThreshold times in
+// a row, so apps that hang without exiting get restarted instead of staying
+// ready forever.
+type LivenessProbe struct {
+	// Type is the kind of check to run: http, tcp, or exec.
+	Type string `json:"type"`
+
+	// Path is the path to request for http probes. Defaults to /.
+	Path string `json:"path,omitempty"`
+
+	// Port is the port to check for http and tcp probes. Defaults to the
+	// first port of the analysis container.
+	Port int32 `json:"port,omitempty"`
+
+	// Command is run in the analysis container for exec probes. The probe
+	// fails if it exits with a non-zero status.
+	Command []string `json:"command,omitempty"`
+
+	// InitialDelaySeconds is how long to wait after the container starts
+	// before it's checked. Defaults to 300.
+	InitialDelaySeconds int32 `json:"initial_delay_seconds,omitempty"`
+
+	// PeriodSeconds is how often the container is checked. Defaults to 30.
+	PeriodSeconds int32 `json:"period_seconds,omitempty"`
+
+	// TimeoutSeconds is how long a check may take before it fails. Defaults
+	// to 10.
+	TimeoutSeconds int32 `json:"timeout_seconds,omitempty"`
+
+	// FailureThreshold is the number of failed checks in a row that cause the
+	// container to be restarted. Defaults to 10.
+	FailureThreshold int32 `json:"failure_threshold,omitempty"`
+}
+
+// Validate returns an error if the liveness probe settings are invalid.
+func (p *LivenessProbe) Validate() error {
+	switch p.Type {
+	case livenessProbeHTTP:
+		if p.Path != "" && !strings.HasPrefix(p.Path, "/") {
+			return fmt.Errorf("the liveness probe path must start with /")
+		}
+	case livenessProbeTCP:
+	case livenessProbeExec:
+		if len(p.Command) == 0 {
+			return fmt.Errorf("exec liveness probes need a command")
+		}
+	default:
+		return fmt.Errorf("unknown liveness probe type %q; must be one of %s, %s, or %s", p.Type, livenessProbeHTTP, livenessProbeTCP, livenessProbeExec)
+	}
+
+	if p.Type != livenessProbeExec && len(p.Command) != 0 {
+		return fmt.Errorf("only exec liveness probes may have a command")
+	}
+	if p.Port < 0 || p.Port > 65535 {
+		return fmt.Errorf("invalid liveness probe port %d", p.Port)
+	}
+	if p.InitialDelaySeconds < 0 || p.PeriodSeconds < 0 || p.TimeoutSeconds < 0 || p.FailureThreshold < 0 {
+		return fmt.Errorf("the liveness probe thresholds must not be negative")
+	}
+	return nil
+}
+
+// valueOrDefault returns the value if it's set and the default otherwise.
+func valueOrDefault(value, def int32) int32 {
+	if value > 0 {
+		return value
+	}
+	return def
+}
+
+// probe returns the liveness probe for the analysis container of the job.
+func (p *LivenessProbe) probe(job *model.Job) *apiv1.Probe {
+	port := p.Port
+	if port == 0 && len(job.Steps[0].Component.Container.Ports) > 0 {
+		port = int32(job.Steps[0].Component.Container.Ports[0].ContainerPort)
+	}
+
+	probe := &apiv1.Probe{
+		InitialDelaySeconds: valueOrDefault(p.InitialDelaySeconds, defaultLivenessInitialDelaySeconds),
+		PeriodSeconds:       valueOrDefault(p.PeriodSeconds, defaultLivenessPeriodSeconds),
+		TimeoutSeconds:      valueOrDefault(p.TimeoutSeconds, defaultLivenessTimeoutSeconds),
+		FailureThreshold:    valueOrDefault(p.FailureThreshold, defaultLivenessFailureThreshold),
+		SuccessThreshold:    1,
+	}
+
+	switch p.Type {
+	case livenessProbeHTTP:
+		path := p.Path
+		if path == "" {
+			path = "/"
+		}
+		probe.HTTPGet = &apiv1.HTTPGetAction{
+			Port:   intstr.FromInt(int(port)),
+			Scheme: apiv1.URISchemeHTTP,
+			Path:   path,
+		}
+	case livenessProbeTCP:
+		probe.TCPSocket = &apiv1.TCPSocketAction{
+			Port: intstr.FromInt(int(port)),
+		}
+	case livenessProbeExec:
+		probe.Exec = &apiv1.ExecAction{
+			Command: p.Command,
+		}
+	}
+
+	return probe
+}
+
+// livenessProbe returns the liveness probe for the analysis container, or nil
+// if the tool doesn't have one.
+func (s *ToolSettings) livenessProbe(job *model.Job) *apiv1.Probe {
+	if s.LivenessProbe == nil {
+		return nil
+	}
+	return s.LivenessProbe.probe(job)
+}
+
+// ContainerRestart records a restart of a container in an analysis pod by the
+// kubelet after it failed its liveness probe.
+type ContainerRestart struct {
+	ExternalID    string    `json:"external_id" db:"external_id"`
+	PodName       string    `json:"pod_name" db:"pod_name"`
+	ContainerName string    `json:"container_name" db:"container_name"`
+	Reason        string    `json:"reason" db:"reason"`
+	Message       string    `json:"message" db:"message"`
+	RestartedAt   time.Time `json:"restarted_at" db:"restarted_at"`
+}
+
+// containerRestartFromEvent returns the restart described by a kubelet event
+// about an analysis pod, and false if the event isn't about a container that
+// the kubelet is restarting because it failed its liveness probe.
+func containerRestartFromEvent(externalID string, event *apiv1.Event) (*ContainerRestart, bool) {
+	if event.Reason != "Killing" || !strings.Contains(event.Message, "failed liveness probe") {
+		return nil, false
+	}
+
+	match := containerFieldPathRegexp.FindStringSubmatch(event.InvolvedObject.FieldPath)
+	if match == nil {
+		return nil, false
+	}
+
+	return &ContainerRestart{
+		ExternalID:    externalID,
+		PodName:       event.InvolvedObject.Name,
+		ContainerName: match[1],
+		Reason:        livenessRestartReason,
+		Message:       event.Message,
+		RestartedAt:   eventTime(event),
+	}, true
+}
+
+// The kubelet updates the time of the same event for each restart, so each
+// time is a separate restart. Recording the same one twice, which happens
+// when the watch restarts, is ignored.
+const insertContainerRestartSQL = `
+	INSERT INTO vice_container_restarts (
+		external_id, pod_name, container_name, reason, message, restarted_at
+	)
+	VALUES (
+		:external_id, :pod_name, :container_name, :reason, :message, :restarted_at
+	)
+	ON CONFLICT (external_id, pod_name, container_name, restarted_at) DO NOTHING
+`
+
+const listContainerRestartsSQL = `
+	SELECT external_id, pod_name, container_name, reason, message, restarted_at
+	  FROM vice_container_restarts
+	 WHERE external_id = $1
+	 ORDER BY restarted_at, pod_name, container_name
+`
+
+// listContainerRestarts returns the container restarts recorded for the
+// analysis, oldest first.
+func (i *Internal) listContainerRestarts(ctx context.Context, externalID string) ([]ContainerRestart, error) {
+	restarts := []ContainerRestart{}
+	if err := i.db.SelectContext(ctx, &restarts, listContainerRestartsSQL, externalID); err != nil {
+		return nil, err
+	}
+	return restarts, nil
+}
@@ -0,0 +1,113 @@
+package internal
+
+import (
+	"context"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cyverse-de/model/v6"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestLivenessProbeValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError((&LivenessProbe{Type: "http", Path: "/api/status"}).Validate())
+	assert.NoError((&LivenessProbe{Type: "tcp", Port: 8787, FailureThreshold: 3}).Validate())
+	assert.NoError((&LivenessProbe{Type: "exec", Command: []string{"pgrep", "rsession"}}).Validate())
+
+	assert.Error((&LivenessProbe{}).Validate())
+	assert.Error((&LivenessProbe{Type: "grpc"}).Validate())
+	assert.Error((&LivenessProbe{Type: "http", Path: "api"}).Validate())
+	assert.Error((&LivenessProbe{Type: "exec"}).Validate())
+	assert.Error((&LivenessProbe{Type: "tcp", Command: []string{"true"}}).Validate())
+	assert.Error((&LivenessProbe{Type: "tcp", Port: 70000}).Validate())
+	assert.Error((&LivenessProbe{Type: "tcp", PeriodSeconds: -1}).Validate())
+
+	assert.Error((&ToolSettings{LivenessProbe: &LivenessProbe{Type: "bogus"}}).Validate())
+}
+
+func TestAnalysisContainerLivenessProbe(t *testing.T) {
+	assert := assert.New(t)
+
+	i := &Internal{}
+	job := &model.Job{Steps: []model.Step{{}}}
+	job.Steps[0].Component.Container.Ports = []model.Ports{{ContainerPort: 8888}}
+
+	// Analysis containers don't have liveness probes unless they're
+	// configured.
+	assert.Nil(i.defineAnalysisContainer(job, &ToolSettings{}, nil).LivenessProbe)
+
+	settings := &ToolSettings{LivenessProbe: &LivenessProbe{Type: "http", FailureThreshold: 3}}
+	probe := i.defineAnalysisContainer(job, settings, nil).LivenessProbe
+	if assert.NotNil(probe) && assert.NotNil(probe.HTTPGet) {
+		assert.Equal(8888, probe.HTTPGet.Port.IntValue())
+		assert.Equal("/", probe.HTTPGet.Path)
+		assert.Equal(int32(3), probe.FailureThreshold)
+		assert.Equal(int32(defaultLivenessPeriodSeconds), probe.PeriodSeconds)
+		assert.Equal(int32(defaultLivenessInitialDelaySeconds), probe.InitialDelaySeconds)
+	}
+
+	settings.LivenessProbe = &LivenessProbe{Type: "tcp", Port: 8787}
+	probe = settings.livenessProbe(job)
+	if assert.NotNil(probe.TCPSocket) {
+		assert.Equal(8787, probe.TCPSocket.Port.IntValue())
+	}
+
+	settings.LivenessProbe = &LivenessProbe{Type: "exec", Command: []string{"pgrep", "rsession"}}
+	probe = settings.livenessProbe(job)
+	if assert.NotNil(probe.Exec) {
+		assert.Equal([]string{"pgrep", "rsession"}, probe.Exec.Command)
+	}
+}
+
+func TestContainerRestartFromEvent(t *testing.T) {
+	assert := assert.New(t)
+
+	restart, ok := containerRestartFromEvent("a1234", imagePullEvent("Killing", "Container analysis failed liveness probe, will be restarted", 2))
+	if assert.True(ok) {
+		assert.Equal("a1234-abcde", restart.PodName)
+		assert.Equal("analysis", restart.ContainerName)
+		assert.Equal(livenessRestartReason, restart.Reason)
+		assert.Equal(historyStart, restart.RestartedAt)
+	}
+
+	// Containers killed when the analysis stops aren't restarts.
+	_, ok = containerRestartFromEvent("a1234", imagePullEvent("Killing", "Stopping container analysis", 1))
+	assert.False(ok)
+
+	_, ok = containerRestartFromEvent("a1234", imagePullEvent("Unhealthy", "Liveness probe failed: connection refused", 3))
+	assert.False(ok)
+}
+
+func TestImagePullRecorderRecordsRestarts(t *testing.T) {
+	assert := assert.New(t)
+
+	mockdb, mock, err := sqlmock.New()
+	assert.NoError(err)
+	defer mockdb.Close()
+
+	pod := historyTestPod()
+	pod.Labels["app-type"] = "interactive"
+
+	i := &Internal{
+		Init:      Init{ViceNamespace: "vice-apps"},
+		clientset: fake.NewSimpleClientset(pod),
+		db:        sqlx.NewDb(mockdb, "sqlmock"),
+	}
+
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO vice_container_restarts")).
+		WithArgs("a1234", "a1234-abcde", "analysis", livenessRestartReason, sqlmock.AnyArg(), historyStart).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	NewImagePullRecorder(i).handleEvent(context.Background(), watch.Event{
+		Type:   watch.Modified,
+		Object: imagePullEvent("Killing", "Container analysis failed liveness probe, will be restarted", 1),
+	})
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
@@ -0,0 +1,176 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	defaultLogArchiveTailLines  = 1000
+	defaultLogArchiveLimitBytes = 1 << 20
+)
+
+// LogArchiveConfig contains the settings for keeping the ends of the
+// containers' logs after the analysis exits, so that users can find out why
+// an analysis failed once its pods are gone.
+type LogArchiveConfig struct {
+	Enabled bool
+
+	// TailLines is the number of lines kept from the end of each container's
+	// logs.
+	TailLines int64
+
+	// LimitBytes caps the size of the logs kept for each container.
+	LimitBytes int64
+}
+
+// Validate returns an error if the configuration can't be used.
+func (c *LogArchiveConfig) Validate() error {
+	if c.TailLines < 0 {
+		return fmt.Errorf("the number of archived log lines must not be negative")
+	}
+	if c.LimitBytes < 0 {
+		return fmt.Errorf("the archived log size limit must not be negative")
+	}
+	return nil
+}
+
+// ArchivedLogs is the end of a container's logs, recorded when its analysis
+// exited.
+type ArchivedLogs struct {
+	ExternalID    string    `json:"external_id" db:"external_id"`
+	PodName       string    `json:"pod_name" db:"pod_name"`
+	ContainerName string    `json:"container_name" db:"container_name"`
+	Logs          string    `json:"logs" db:"logs"`
+	RecordedAt    time.Time `json:"recorded_at" db:"recorded_at"`
+}
+
+// logArchiveOptions returns the options for reading the logs of a container
+// that are archived.
+func (i *Internal) logArchiveOptions(container string) *apiv1.PodLogOptions {
+	tailLines := i.LogArchive.TailLines
+	if tailLines <= 0 {
+		tailLines = defaultLogArchiveTailLines
+	}
+	limitBytes := i.LogArchive.LimitBytes
+	if limitBytes <= 0 {
+		limitBytes = defaultLogArchiveLimitBytes
+	}
+	return &apiv1.PodLogOptions{
+		Container:  container,
+		TailLines:  &tailLines,
+		LimitBytes: &limitBytes,
+	}
+}
+
+// readContainerLogs returns the end of a container's logs.
+func (i *Internal) readContainerLogs(ctx context.Context, podName, container string) (string, error) {
+	stream, err := i.clientset.CoreV1().Pods(i.ViceNamespace).GetLogs(podName, i.logArchiveOptions(container)).Stream(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer stream.Close()
+
+	logs, err := io.ReadAll(stream)
+	if err != nil {
+		return "", err
+	}
+	return string(logs), nil
+}
+
+const upsertArchivedLogsSQL = `
+	INSERT INTO vice_container_logs (external_id, pod_name, container_name, logs)
+	VALUES (:external_id, :pod_name, :container_name, :logs)
+	ON CONFLICT (external_id, pod_name, container_name) DO UPDATE
+	   SET logs = EXCLUDED.logs,
+	       recorded_at = now()
+`
+
+// archiveContainerLogs records the ends of the logs of the containers in the
+// analysis's pods so that they're still available after the pods are
+// deleted. Containers whose logs can't be read are skipped.
+func (i *Internal) archiveContainerLogs(ctx context.Context, externalID string) (err error) {
+	ctx, span := startResourceSpan(ctx, "archiveContainerLogs", "pod")
+	defer func() { endSpan(span, err) }()
+
+	set := labels.Set(map[string]string{
+		"external-id": externalID,
+	})
+
+	podlist, err := i.clientset.CoreV1().Pods(i.ViceNamespace).List(ctx, metav1.ListOptions{
+		LabelSelector: set.AsSelector().String(),
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, pod := range podlist.Items {
+		containers := []string{}
+		for _, status := range pod.Status.InitContainerStatuses {
+			containers = append(containers, status.Name)
+		}
+		for _, status := range pod.Status.ContainerStatuses {
+			containers = append(containers, status.Name)
+		}
+
+		for _, container := range containers {
+			logs, err := i.readContainerLogs(ctx, pod.Name, container)
+			if err != nil {
+				log.WithContext(ctx).Warn(errors.Wrapf(err, "unable to read the logs of container %s in pod %s", container, pod.Name))
+				continue
+			}
+
+			archived := &ArchivedLogs{
+				ExternalID:    externalID,
+				PodName:       pod.Name,
+				ContainerName: container,
+				Logs:          logs,
+			}
+			if _, err = i.db.NamedExecContext(ctx, upsertArchivedLogsSQL, archived); err != nil {
+				return errors.Wrapf(err, "error archiving the logs of container %s in pod %s", container, pod.Name)
+			}
+		}
+	}
+
+	return nil
+}
+
+const getArchivedLogsSQL = `
+	SELECT external_id, pod_name, container_name, logs, recorded_at
+	  FROM vice_container_logs
+	 WHERE external_id = $1
+	   AND container_name = $2
+	 ORDER BY recorded_at DESC
+	 LIMIT 1
+`
+
+// archivedLogs returns the archived logs of the container in the analysis's
+// pod, or nil if there aren't any.
+func (i *Internal) archivedLogs(ctx context.Context, externalID, container string) (*ArchivedLogs, error) {
+	archived := []ArchivedLogs{}
+	if err := i.db.SelectContext(ctx, &archived, getArchivedLogsSQL, externalID, container); err != nil {
+		return nil, errors.Wrapf(err, "error looking up the archived logs of container %s", container)
+	}
+	if len(archived) == 0 {
+		return nil, nil
+	}
+	return &archived[0], nil
+}
+
+// archivedLogLines splits archived logs into lines, keeping at most tailLines
+// of them from the end if tailLines is positive.
+func archivedLogLines(logs string, tailLines int64) []string {
+	lines := strings.Split(strings.TrimSuffix(logs, "\n"), "\n")
+	if tailLines > 0 && int64(len(lines)) > tailLines {
+		lines = lines[int64(len(lines))-tailLines:]
+	}
+	return lines
+}
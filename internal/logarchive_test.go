@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestArchiveContainerLogs(t *testing.T) {
+	assert := assert.New(t)
+
+	mockdb, mock, err := sqlmock.New()
+	assert.NoError(err)
+	defer mockdb.Close()
+
+	pod := &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "pod-1",
+			Namespace: "vice-apps",
+			Labels:    map[string]string{"external-id": "e1"},
+		},
+		Status: apiv1.PodStatus{
+			InitContainerStatuses: []apiv1.ContainerStatus{{Name: fileTransfersInitContainerName}},
+			ContainerStatuses:     []apiv1.ContainerStatus{{Name: analysisContainerName}},
+		},
+	}
+
+	i := &Internal{
+		Init:      Init{ViceNamespace: "vice-apps"},
+		db:        sqlx.NewDb(mockdb, "sqlmock"),
+		clientset: fake.NewSimpleClientset(pod),
+	}
+
+	for _, container := range []string{fileTransfersInitContainerName, analysisContainerName} {
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO vice_container_logs")).
+			WithArgs("e1", "pod-1", container, "fake logs").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+
+	assert.NoError(i.archiveContainerLogs(context.Background(), "e1"))
+	assert.NoError(mock.ExpectationsWereMet())
+
+	recorded := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	mock.ExpectQuery(regexp.QuoteMeta("FROM vice_container_logs")).
+		WithArgs("e1", analysisContainerName).
+		WillReturnRows(sqlmock.NewRows([]string{"external_id", "pod_name", "container_name", "logs", "recorded_at"}).
+			AddRow("e1", "pod-1", analysisContainerName, "one\ntwo\n", recorded))
+	mock.ExpectQuery(regexp.QuoteMeta("FROM vice_container_logs")).
+		WithArgs("e2", analysisContainerName).
+		WillReturnRows(sqlmock.NewRows([]string{"external_id", "pod_name", "container_name", "logs", "recorded_at"}))
+
+	archived, err := i.archivedLogs(context.Background(), "e1", analysisContainerName)
+	if assert.NoError(err) && assert.NotNil(archived) {
+		assert.Equal("one\ntwo\n", archived.Logs)
+		assert.Equal(recorded, archived.RecordedAt)
+	}
+
+	archived, err = i.archivedLogs(context.Background(), "e2", analysisContainerName)
+	assert.NoError(err)
+	assert.Nil(archived)
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestArchivedLogLines(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal([]string{"one", "two", "three"}, archivedLogLines("one\ntwo\nthree\n", 0))
+	assert.Equal([]string{"two", "three"}, archivedLogLines("one\ntwo\nthree\n", 2))
+	assert.Equal([]string{"one", "two", "three"}, archivedLogLines("one\ntwo\nthree", 5))
+}
+
+func TestLogArchiveOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	i := &Internal{}
+	opts := i.logArchiveOptions(analysisContainerName)
+	assert.Equal(analysisContainerName, opts.Container)
+	assert.Equal(int64(defaultLogArchiveTailLines), *opts.TailLines)
+	assert.Equal(int64(defaultLogArchiveLimitBytes), *opts.LimitBytes)
+
+	i.LogArchive = LogArchiveConfig{TailLines: 50, LimitBytes: 4096}
+	opts = i.logArchiveOptions(analysisContainerName)
+	assert.Equal(int64(50), *opts.TailLines)
+	assert.Equal(int64(4096), *opts.LimitBytes)
+
+	assert.Error((&LogArchiveConfig{TailLines: -1}).Validate())
+}
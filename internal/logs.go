@@ -91,8 +91,19 @@ func (i *Internal) getExternalIDs(ctx context.Context, user, analysisID string)
 type VICELogEntry struct {
 	SinceTime string   `json:"since_time"`
 	Lines     []string `json:"lines"`
+
+	// Source is pod if the lines were read from the analysis's pod, or
+	// archive if the pod is gone and the lines were archived when the
+	// analysis exited.
+	Source string `json:"source"`
 }
 
+// The sources of the lines in a VICELogEntry.
+const (
+	logSourcePod     = "pod"
+	logSourceArchive = "archive"
+)
+
 // LogsHandler handles requests to access the analysis container logs for a pod in a running
 // VICE app. Needs the 'id' and 'pod-name' mux Vars.
 //
@@ -218,7 +229,20 @@ func (i *Internal) LogsHandler(c echo.Context) error {
 	}
 
 	if len(podList) < 1 {
-		return fmt.Errorf("no pods found for analysis %s with external ID %s", id, externalID)
+		// The pods are deleted when the analysis exits, but the end of each
+		// container's logs may have been archived first.
+		archived, err := i.archivedLogs(ctx, externalID, container)
+		if err != nil {
+			return err
+		}
+		if archived == nil {
+			return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("no pods or archived logs found for analysis %s with external ID %s", id, externalID))
+		}
+		return c.JSON(http.StatusOK, &VICELogEntry{
+			SinceTime: fmt.Sprintf("%d", archived.RecordedAt.Unix()),
+			Lines:     archivedLogLines(archived.Logs, tailLines),
+			Source:    logSourceArchive,
+		})
 	}
 
 	podName = podList[0].Name
@@ -243,6 +267,7 @@ func (i *Internal) LogsHandler(c echo.Context) error {
 	return c.JSON(http.StatusOK, &VICELogEntry{
 		SinceTime: newSinceTime,
 		Lines:     bodyLines,
+		Source:    logSourcePod,
 	})
 
 }
@@ -0,0 +1,395 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cyverse-de/model/v6"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	mountCheckContainerName = "csi-mount-check"
+
+	// defaultMountCheckTimeout limits how long the mount check waits for each
+	// path when no timeout is configured.
+	defaultMountCheckTimeout = 2 * time.Minute
+
+	// maxMountErrors is the most CSI driver errors reported for an analysis.
+	maxMountErrors = 10
+)
+
+// The states reported for each mounted path.
+const (
+	mountStateOK      = "ok"
+	mountStateMissing = "missing"
+	mountStateTimeout = "timeout"
+	mountStateFailed  = "failed"
+	mountStatePending = "pending"
+)
+
+// The states reported for the mount check.
+const (
+	mountCheckDisabled = "disabled"
+	mountCheckPending  = "pending"
+	mountCheckRunning  = "running"
+	mountCheckPassed   = "passed"
+	mountCheckFailed   = "failed"
+)
+
+// mountCheckScript checks each path mounted by the CSI driver. A path that
+// can't be read before the timeout usually means the iRODS mount is hung.
+// The result for each path is written to the termination log so that the
+// status endpoint can report it. The script fails if a required path isn't
+// readable, which makes the kubelet retry the init container and keeps the
+// analysis from starting with broken mounts. The paths are passed as
+// positional parameters, each followed by required or optional, so that file
+// names from the analysis's inputs are never interpreted by the shell.
+const mountCheckScript = `
+status=0
+: > /dev/termination-log
+check_mount() {
+  timeout %[1]d stat "$1" > /dev/null 2>&1
+  rc=$?
+  if [ $rc -eq 0 ]; then state=%[2]s
+  elif [ $rc -eq 124 ]; then state=%[3]s; status=1
+  elif [ "$2" = optional ]; then state=%[4]s
+  else state=%[5]s; status=1
+  fi
+  printf '%%s %%s\n' "$state" "$1" | tee -a /dev/termination-log
+}
+while [ $# -gt 0 ]; do
+  check_mount "$1" "$2"
+  shift 2
+done
+exit $status
+`
+
+// MountState is the state of a single path mounted by the CSI driver.
+type MountState struct {
+	Path      string `json:"path"`
+	IRODSPath string `json:"irods_path"`
+	State     string `json:"state"`
+}
+
+// VolumeState is the state of one of the analysis's CSI volume resources.
+type VolumeState struct {
+	Kind  string `json:"kind"`
+	Name  string `json:"name"`
+	Phase string `json:"phase"`
+}
+
+// MountError is a recent error reported for the analysis's volumes.
+type MountError struct {
+	Time    time.Time `json:"time"`
+	Kind    string    `json:"kind"`
+	Name    string    `json:"name"`
+	Reason  string    `json:"reason"`
+	Message string    `json:"message"`
+}
+
+// MountStatus describes the state of the data store mounts of an analysis.
+type MountStatus struct {
+	ExternalID string        `json:"external_id"`
+	CSIDriver  bool          `json:"csi_driver"`
+	Check      string        `json:"check"`
+	Restarts   int32         `json:"restarts"`
+	Volumes    []VolumeState `json:"volumes"`
+	Mounts     []MountState  `json:"mounts"`
+	Errors     []MountError  `json:"errors"`
+}
+
+// parsePathMappings parses the path mappings stored in a CSI persistent
+// volume.
+func parsePathMappings(mappingsJSON string) ([]IRODSFSPathMapping, error) {
+	mappings := []IRODSFSPathMapping{}
+	if mappingsJSON == "" {
+		return mappings, nil
+	}
+	if err := json.Unmarshal([]byte(mappingsJSON), &mappings); err != nil {
+		return nil, err
+	}
+	return mappings, nil
+}
+
+// mountPath returns the path in the analysis pod where the mapping is
+// mounted.
+func mountPath(mapping IRODSFSPathMapping) string {
+	return path.Join(csiDriverLocalMountPath, mapping.MappingPath)
+}
+
+// mountCheckTimeout returns how long the mount check waits for each path.
+func (i *Internal) mountCheckTimeout() time.Duration {
+	if i.CSIMountCheckTimeout > 0 {
+		return i.CSIMountCheckTimeout
+	}
+	return defaultMountCheckTimeout
+}
+
+// mountCheckContainer returns the init container that verifies that the
+// paths mounted by the CSI driver are readable.
+func (i *Internal) mountCheckContainer(job *model.Job, settings *ToolSettings) (apiv1.Container, error) {
+	mappings, err := i.getDataPathMappings(job)
+	if err != nil {
+		return apiv1.Container{}, err
+	}
+
+	script := fmt.Sprintf(
+		mountCheckScript,
+		int(i.mountCheckTimeout().Seconds()),
+		mountStateOK,
+		mountStateTimeout,
+		mountStateMissing,
+		mountStateFailed,
+	)
+	command := []string{"bash", "-c", script, "bash"}
+	for _, mapping := range mappings {
+		required := "required"
+		if mapping.IgnoreNotExistError {
+			required = "optional"
+		}
+		command = append(command, mountPath(mapping), required)
+	}
+
+	volumeMounts := []apiv1.VolumeMount{}
+	for _, volumeMount := range i.getPersistentVolumeMounts(job) {
+		mount := *volumeMount
+		mount.ReadOnly = true
+		volumeMounts = append(volumeMounts, mount)
+	}
+
+	return apiv1.Container{
+		Name:                     mountCheckContainerName,
+		Image:                    fmt.Sprintf("%s:%s", i.PorklockImage, i.PorklockTag),
+		Command:                  command,
+		ImagePullPolicy:          apiv1.PullPolicy(apiv1.PullAlways),
+		VolumeMounts:             volumeMounts,
+		TerminationMessagePolicy: apiv1.TerminationMessageReadFile,
+		SecurityContext: &apiv1.SecurityContext{
+			RunAsUser:  int64Ptr(settings.runAsUser(job)),
+			RunAsGroup: int64Ptr(settings.runAsGroup(job)),
+			Capabilities: &apiv1.Capabilities{
+				Drop: []apiv1.Capability{"ALL"},
+			},
+		},
+	}, nil
+}
+
+// parseMountCheckMessage parses the termination message written by the mount
+// check. Returns the state of each path keyed by path.
+func parseMountCheckMessage(message string) map[string]string {
+	states := map[string]string{}
+	for _, line := range strings.Split(message, "\n") {
+		state, mountedPath, found := strings.Cut(strings.TrimSpace(line), " ")
+		if !found {
+			continue
+		}
+		states[mountedPath] = state
+	}
+	return states
+}
+
+// mountCheckState returns the state of the mount check in the pod, the number
+// of times it has restarted, and the termination message from its last run.
+func mountCheckState(pod *apiv1.Pod) (string, int32, string) {
+	for _, status := range pod.Status.InitContainerStatuses {
+		if status.Name != mountCheckContainerName {
+			continue
+		}
+
+		switch {
+		case status.State.Terminated != nil && status.State.Terminated.ExitCode == 0:
+			return mountCheckPassed, status.RestartCount, status.State.Terminated.Message
+		case status.State.Terminated != nil:
+			return mountCheckFailed, status.RestartCount, status.State.Terminated.Message
+		case status.LastTerminationState.Terminated != nil:
+			// The check is being retried after a failure.
+			return mountCheckFailed, status.RestartCount, status.LastTerminationState.Terminated.Message
+		case status.State.Running != nil:
+			return mountCheckRunning, status.RestartCount, ""
+		default:
+			return mountCheckPending, status.RestartCount, ""
+		}
+	}
+	return mountCheckPending, 0, ""
+}
+
+// isMountEvent returns true if the event looks like it's about mounting a
+// volume.
+func isMountEvent(event *apiv1.Event) bool {
+	if event.Type != apiv1.EventTypeWarning {
+		return false
+	}
+	if strings.Contains(event.Message, csiDriverName) {
+		return true
+	}
+	for _, word := range []string{"Mount", "Attach", "Volume", "Provision"} {
+		if strings.Contains(event.Reason, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// eventTime returns the most recent time the event happened.
+func eventTime(event *apiv1.Event) time.Time {
+	switch {
+	case !event.LastTimestamp.IsZero():
+		return event.LastTimestamp.Time
+	case !event.EventTime.IsZero():
+		return event.EventTime.Time
+	default:
+		return event.CreationTimestamp.Time
+	}
+}
+
+// mountErrors returns the most recent volume-related warnings for the named
+// objects, newest first.
+func (i *Internal) mountErrors(ctx context.Context, objects map[string]string) ([]MountError, error) {
+	events, err := i.clientset.CoreV1().Events(i.ViceNamespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	result := []MountError{}
+	for idx := range events.Items {
+		event := &events.Items[idx]
+		kind, ok := objects[event.InvolvedObject.Name]
+		if !ok || kind != event.InvolvedObject.Kind || !isMountEvent(event) {
+			continue
+		}
+		result = append(result, MountError{
+			Time:    eventTime(event),
+			Kind:    event.InvolvedObject.Kind,
+			Name:    event.InvolvedObject.Name,
+			Reason:  event.Reason,
+			Message: event.Message,
+		})
+	}
+
+	sort.Slice(result, func(a, b int) bool {
+		return result[a].Time.After(result[b].Time)
+	})
+	if len(result) > maxMountErrors {
+		result = result[:maxMountErrors]
+	}
+
+	return result, nil
+}
+
+// getMountStatus returns the state of the data store mounts of the analysis.
+func (i *Internal) getMountStatus(ctx context.Context, externalID string) (*MountStatus, error) {
+	status := &MountStatus{
+		ExternalID: externalID,
+		CSIDriver:  i.UseCSIDriver,
+		Check:      mountCheckDisabled,
+		Volumes:    []VolumeState{},
+		Mounts:     []MountState{},
+		Errors:     []MountError{},
+	}
+	if !i.UseCSIDriver {
+		return status, nil
+	}
+
+	set := labels.Set(map[string]string{"external-id": externalID})
+	listOptions := metav1.ListOptions{LabelSelector: set.AsSelector().String()}
+
+	// The objects whose events are reported, keyed by name.
+	objects := map[string]string{}
+
+	pvcs, err := i.clientset.CoreV1().PersistentVolumeClaims(i.ViceNamespace).List(ctx, listOptions)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to list the persistent volume claims for %s", externalID)
+	}
+	for _, pvc := range pvcs.Items {
+		status.Volumes = append(status.Volumes, VolumeState{Kind: "PersistentVolumeClaim", Name: pvc.Name, Phase: string(pvc.Status.Phase)})
+		objects[pvc.Name] = "PersistentVolumeClaim"
+	}
+
+	pvs, err := i.clientset.CoreV1().PersistentVolumes().List(ctx, listOptions)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to list the persistent volumes for %s", externalID)
+	}
+	for _, pv := range pvs.Items {
+		status.Volumes = append(status.Volumes, VolumeState{Kind: "PersistentVolume", Name: pv.Name, Phase: string(pv.Status.Phase)})
+		objects[pv.Name] = "PersistentVolume"
+	}
+
+	pods, err := i.clientset.CoreV1().Pods(i.ViceNamespace).List(ctx, listOptions)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to list the pods for %s", externalID)
+	}
+
+	// The paths that are checked come from the path mappings stored in the
+	// persistent volume.
+	var mappings []IRODSFSPathMapping
+	for _, pv := range pvs.Items {
+		if pv.Spec.CSI == nil {
+			continue
+		}
+		if mappings, err = parsePathMappings(pv.Spec.CSI.VolumeAttributes["path_mapping_json"]); err != nil {
+			log.WithContext(ctx).Warnf("unable to parse the path mappings for %s: %s", pv.Name, err)
+		}
+	}
+
+	states := map[string]string{}
+	if len(pods.Items) > 0 {
+		pod := &pods.Items[0]
+		objects[pod.Name] = "Pod"
+
+		if i.CSIMountCheck {
+			var message string
+			status.Check, status.Restarts, message = mountCheckState(pod)
+			states = parseMountCheckMessage(message)
+		}
+	} else if i.CSIMountCheck {
+		status.Check = mountCheckPending
+	}
+
+	for _, mapping := range mappings {
+		state, ok := states[mountPath(mapping)]
+		if !ok {
+			state = mountStatePending
+		}
+		status.Mounts = append(status.Mounts, MountState{
+			Path:      mountPath(mapping),
+			IRODSPath: mapping.IRODSPath,
+			State:     state,
+		})
+	}
+
+	if status.Errors, err = i.mountErrors(ctx, objects); err != nil {
+		return nil, errors.Wrapf(err, "unable to list the events for %s", externalID)
+	}
+
+	return status, nil
+}
+
+// MountStatusHandler returns the state of the data store mounts of an
+// analysis, along with recent errors reported for its volumes. Analyses that
+// don't use the CSI driver don't have any mounts to report.
+func (i *Internal) MountStatusHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	externalID := c.Param("id")
+	if externalID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "id parameter is empty")
+	}
+
+	status, err := i.getMountStatus(ctx, externalID)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, status)
+}
@@ -0,0 +1,182 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/model/v6"
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestMountCheckContainer(t *testing.T) {
+	assert := assert.New(t)
+
+	i := &Internal{Init: Init{UseCSIDriver: true, IRODSZone: "iplant", PorklockImage: "porklock", PorklockTag: "latest"}}
+	job := &model.Job{
+		InvocationID: "a1234",
+		UserHome:     "/iplant/home/ipcdev",
+		OutputDir:    "/iplant/home/ipcdev/analyses/out",
+		Steps:        []model.Step{{}},
+	}
+
+	container, err := i.mountCheckContainer(job, &ToolSettings{})
+	assert.NoError(err)
+	assert.Equal(mountCheckContainerName, container.Name)
+	assert.Equal(apiv1.TerminationMessageReadFile, container.TerminationMessagePolicy)
+	if assert.Len(container.VolumeMounts, 1) {
+		assert.True(container.VolumeMounts[0].ReadOnly)
+	}
+
+	assert.Equal([]string{"bash", "-c"}, container.Command[:2])
+	assert.Contains(container.Command[2], "timeout 120 stat")
+	args := container.Command[4:]
+	assert.Contains(args, "/data-store/output")
+	assert.Contains(args, "/data-store/iplant/home/ipcdev")
+	for idx := 0; idx < len(args); idx += 2 {
+		if args[idx] == "/data-store/output" {
+			assert.Equal("optional", args[idx+1])
+		}
+		if args[idx] == "/data-store/iplant/home/ipcdev" {
+			assert.Equal("required", args[idx+1])
+		}
+	}
+}
+
+func TestMountCheckContainerHostileNames(t *testing.T) {
+	assert := assert.New(t)
+
+	i := &Internal{Init: Init{UseCSIDriver: true, IRODSZone: "iplant"}}
+	hostile := `/iplant/home/ipcdev/it's "$(touch pwned)"; rm -rf ~ #.txt`
+	job := &model.Job{
+		InvocationID: "a1234",
+		OutputDir:    "/iplant/home/ipcdev/analyses/`id`",
+		Steps: []model.Step{{
+			Config: model.StepConfig{
+				Inputs: []model.StepInput{{Type: "FileInput", Value: hostile}},
+			},
+		}},
+	}
+
+	container, err := i.mountCheckContainer(job, &ToolSettings{})
+	assert.NoError(err)
+
+	// The names are only ever passed as whole arguments, never as part of the
+	// script.
+	script := container.Command[2]
+	assert.NotContains(script, "pwned")
+	assert.NotContains(script, "`id`")
+	assert.Contains(container.Command[4:], `/data-store/input/it's "$(touch pwned)"; rm -rf ~ #.txt`)
+}
+
+func TestMountCheckState(t *testing.T) {
+	assert := assert.New(t)
+
+	pod := &apiv1.Pod{}
+	state, _, _ := mountCheckState(pod)
+	assert.Equal(mountCheckPending, state)
+
+	pod.Status.InitContainerStatuses = []apiv1.ContainerStatus{{
+		Name:         mountCheckContainerName,
+		RestartCount: 2,
+		State:        apiv1.ContainerState{Running: &apiv1.ContainerStateRunning{}},
+		LastTerminationState: apiv1.ContainerState{Terminated: &apiv1.ContainerStateTerminated{
+			ExitCode: 1,
+			Message:  "ok /data-store/output\ntimeout /data-store/iplant/home/ipcdev\n",
+		}},
+	}}
+	state, restarts, message := mountCheckState(pod)
+	assert.Equal(mountCheckFailed, state)
+	assert.Equal(int32(2), restarts)
+	assert.Equal(map[string]string{
+		"/data-store/output":             mountStateOK,
+		"/data-store/iplant/home/ipcdev": mountStateTimeout,
+	}, parseMountCheckMessage(message))
+}
+
+func TestGetMountStatus(t *testing.T) {
+	assert := assert.New(t)
+
+	mappings, err := json.Marshal([]IRODSFSPathMapping{
+		{IRODSPath: "/iplant/home/ipcdev/out", MappingPath: "/output"},
+		{IRODSPath: "/iplant/home/ipcdev", MappingPath: "/iplant/home/ipcdev"},
+	})
+	assert.NoError(err)
+
+	analysisLabels := map[string]string{"external-id": "a1234"}
+	now := time.Now()
+
+	clientset := fake.NewSimpleClientset(
+		&apiv1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "csi-data-volume-a1234", Labels: analysisLabels},
+			Spec: apiv1.PersistentVolumeSpec{
+				PersistentVolumeSource: apiv1.PersistentVolumeSource{
+					CSI: &apiv1.CSIPersistentVolumeSource{
+						Driver:           csiDriverName,
+						VolumeAttributes: map[string]string{"path_mapping_json": string(mappings)},
+					},
+				},
+			},
+			Status: apiv1.PersistentVolumeStatus{Phase: apiv1.VolumeBound},
+		},
+		&apiv1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "a1234-abcde", Namespace: "vice-apps", Labels: analysisLabels},
+			Status: apiv1.PodStatus{
+				InitContainerStatuses: []apiv1.ContainerStatus{{
+					Name: mountCheckContainerName,
+					State: apiv1.ContainerState{Terminated: &apiv1.ContainerStateTerminated{
+						ExitCode: 1,
+						Message:  "ok /data-store/output\ntimeout /data-store/iplant/home/ipcdev\n",
+					}},
+				}},
+			},
+		},
+		&apiv1.Event{
+			ObjectMeta:     metav1.ObjectMeta{Name: "e1", Namespace: "vice-apps"},
+			InvolvedObject: apiv1.ObjectReference{Kind: "Pod", Name: "a1234-abcde"},
+			Type:           apiv1.EventTypeWarning,
+			Reason:         "FailedMount",
+			Message:        "MountVolume.SetUp failed for volume csi-data-volume-a1234",
+			LastTimestamp:  metav1.NewTime(now),
+		},
+		&apiv1.Event{
+			ObjectMeta:     metav1.ObjectMeta{Name: "e2", Namespace: "vice-apps"},
+			InvolvedObject: apiv1.ObjectReference{Kind: "Pod", Name: "a1234-abcde"},
+			Type:           apiv1.EventTypeNormal,
+			Reason:         "Pulled",
+			LastTimestamp:  metav1.NewTime(now),
+		},
+		&apiv1.Event{
+			ObjectMeta:     metav1.ObjectMeta{Name: "e3", Namespace: "vice-apps"},
+			InvolvedObject: apiv1.ObjectReference{Kind: "Pod", Name: "b5678-abcde"},
+			Type:           apiv1.EventTypeWarning,
+			Reason:         "FailedMount",
+			LastTimestamp:  metav1.NewTime(now),
+		},
+	)
+
+	i := &Internal{Init: Init{ViceNamespace: "vice-apps", UseCSIDriver: true, CSIMountCheck: true}, clientset: clientset}
+
+	status, err := i.getMountStatus(context.Background(), "a1234")
+	assert.NoError(err)
+	assert.Equal(mountCheckFailed, status.Check)
+	assert.Equal([]VolumeState{{Kind: "PersistentVolume", Name: "csi-data-volume-a1234", Phase: "Bound"}}, status.Volumes)
+	assert.Equal([]MountState{
+		{Path: "/data-store/output", IRODSPath: "/iplant/home/ipcdev/out", State: mountStateOK},
+		{Path: "/data-store/iplant/home/ipcdev", IRODSPath: "/iplant/home/ipcdev", State: mountStateTimeout},
+	}, status.Mounts)
+	if assert.Len(status.Errors, 1) {
+		assert.Equal("FailedMount", status.Errors[0].Reason)
+	}
+
+	// Analyses that don't use the CSI driver don't have mounts.
+	i.UseCSIDriver = false
+	status, err = i.getMountStatus(context.Background(), "a1234")
+	assert.NoError(err)
+	assert.Equal(mountCheckDisabled, status.Check)
+	assert.Empty(status.Mounts)
+}
@@ -0,0 +1,87 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// namespaceFilter is the listing query parameter that limits the results to
+// a single namespace. It isn't treated as a label.
+const namespaceFilter = "namespace"
+
+// NamespacesConfig contains the settings for the namespaces that the listing
+// endpoints look in, in addition to the VICE namespace.
+type NamespacesConfig struct {
+	// Selector is a label selector for the namespaces, for example
+	// cyverse.org/vice=true. The listings only include the VICE namespace if
+	// it's empty.
+	Selector string
+}
+
+// Validate returns an error if the configuration can't be used.
+func (c *NamespacesConfig) Validate() error {
+	if c.Selector == "" {
+		return nil
+	}
+	if _, err := labels.Parse(c.Selector); err != nil {
+		return errors.Wrapf(err, "invalid namespace selector %s", c.Selector)
+	}
+	return nil
+}
+
+// listingNamespaces returns the namespaces that the listing endpoints look in:
+// the VICE namespace, followed by the namespaces matching the configured
+// selector in alphabetical order.
+func (i *Internal) listingNamespaces(ctx context.Context) ([]string, error) {
+	namespaces := []string{i.ViceNamespace}
+	if i.Namespaces.Selector == "" {
+		return namespaces, nil
+	}
+
+	list, err := i.clientset.CoreV1().Namespaces().List(ctx, metav1.ListOptions{
+		LabelSelector: i.Namespaces.Selector,
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error listing the namespaces matching %s", i.Namespaces.Selector)
+	}
+
+	matching := []string{}
+	for _, namespace := range list.Items {
+		if namespace.Name != i.ViceNamespace {
+			matching = append(matching, namespace.Name)
+		}
+	}
+	sort.Strings(matching)
+
+	return append(namespaces, matching...), nil
+}
+
+// filterNamespaces returns the namespaces to list resources from for the
+// listing filter. If the filter includes a namespace, it's removed from the
+// filter and it must be one of the listing namespaces.
+func (i *Internal) filterNamespaces(ctx context.Context, filter map[string]string) ([]string, error) {
+	namespaces, err := i.listingNamespaces(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	requested, ok := filter[namespaceFilter]
+	if !ok {
+		return namespaces, nil
+	}
+	delete(filter, namespaceFilter)
+
+	for _, namespace := range namespaces {
+		if namespace == requested {
+			return []string{namespace}, nil
+		}
+	}
+	return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("namespace %s doesn't contain VICE analyses", requested))
+}
@@ -0,0 +1,99 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func labeledNamespace(name string, labels map[string]string) *apiv1.Namespace {
+	return &apiv1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels}}
+}
+
+func namespacedDeployment(externalID, namespace string) *appsv1.Deployment {
+	deployment := appDeployment(externalID, "a1", "jupyter")
+	deployment.Namespace = namespace
+	return deployment
+}
+
+func newNamespacesTestInternal(selector string) *Internal {
+	vice := map[string]string{"cyverse.org/vice": "true"}
+	return &Internal{
+		Init: Init{ViceNamespace: "vice-apps", Namespaces: NamespacesConfig{Selector: selector}},
+		clientset: fake.NewSimpleClientset(
+			labeledNamespace("vice-apps", vice),
+			labeledNamespace("vice-user-b", vice),
+			labeledNamespace("vice-user-a", vice),
+			labeledNamespace("other", nil),
+			namespacedDeployment("e1", "vice-apps"),
+			namespacedDeployment("e2", "vice-user-a"),
+			namespacedDeployment("e3", "other"),
+		),
+	}
+}
+
+func TestNamespacesConfigValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError((&NamespacesConfig{}).Validate())
+	assert.NoError((&NamespacesConfig{Selector: "cyverse.org/vice=true"}).Validate())
+	assert.Error((&NamespacesConfig{Selector: "cyverse.org/vice in ("}).Validate())
+}
+
+func TestListingNamespaces(t *testing.T) {
+	assert := assert.New(t)
+
+	namespaces, err := newNamespacesTestInternal("").listingNamespaces(context.Background())
+	assert.NoError(err)
+	assert.Equal([]string{"vice-apps"}, namespaces)
+
+	namespaces, err = newNamespacesTestInternal("cyverse.org/vice=true").listingNamespaces(context.Background())
+	assert.NoError(err)
+	assert.Equal([]string{"vice-apps", "vice-user-a", "vice-user-b"}, namespaces)
+}
+
+func TestFilterableDeploymentsAcrossNamespaces(t *testing.T) {
+	assert := assert.New(t)
+
+	i := newNamespacesTestInternal("cyverse.org/vice=true")
+	list := func(query string) ([]DeploymentInfo, error) {
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/"+query, nil), rec)
+		if err := i.FilterableDeploymentsHandler(c); err != nil {
+			return nil, err
+		}
+		var body map[string][]DeploymentInfo
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			return nil, err
+		}
+		return body["deployments"], nil
+	}
+
+	deployments, err := list("")
+	assert.NoError(err)
+	if assert.Len(deployments, 2) {
+		assert.Equal("vice-apps", deployments[0].Namespace)
+		assert.Equal("e2", deployments[1].ExternalID)
+		assert.Equal("vice-user-a", deployments[1].Namespace)
+	}
+
+	deployments, err = list("?namespace=vice-user-a")
+	assert.NoError(err)
+	if assert.Len(deployments, 1) {
+		assert.Equal("e2", deployments[0].ExternalID)
+	}
+
+	_, err = list("?namespace=other")
+	if assert.Error(err) {
+		assert.Equal(http.StatusBadRequest, err.(*echo.HTTPError).Code)
+	}
+}
@@ -0,0 +1,180 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+)
+
+// The kinds of names that are turned into label values by the naming service.
+const (
+	analysisNameKind = "analysis-name"
+	appNameKind      = "app-name"
+)
+
+// labelHashSeparator separates the readable part of a hashed label value from
+// its hash. labelValueString never produces two hyphens in a row, so hashed
+// values can't be mistaken for names that are used as they are.
+//
+// hashOnlyLabelPrefix is the readable part used for names that don't have
+// one, such as names made up entirely of punctuation.
+const (
+	labelHashSeparator  = "--"
+	hashOnlyLabelPrefix = "x"
+)
+
+// labelHashLengths are the lengths of the hash suffixes tried, in order, when
+// a name can't be used as a label value as it is. Longer hashes are only used
+// if a shorter one collides with a different name.
+var labelHashLengths = []int{8, 16, 32}
+
+// maxLabelValueLength is the longest value Kubernetes allows in a label.
+const maxLabelValueLength = 63
+
+// hashedLabelValue returns a label value for the name made up of as much of
+// the readable version of the name as fits and the first hashLength hex
+// digits of the name's SHA-256 hash. The result is always a valid label value
+// and is the same every time it's generated for the same name.
+func hashedLabelValue(name string, hashLength int) string {
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte(name)))[:hashLength]
+
+	readable := labelValueString(name)
+	if limit := maxLabelValueLength - len(labelHashSeparator) - hashLength; len(readable) > limit {
+		readable = readable[:limit]
+	}
+	readable = strings.TrimRight(readable, "-_.")
+	if readable == "" {
+		readable = hashOnlyLabelPrefix
+	}
+	return readable + labelHashSeparator + hash
+}
+
+// labelValueCache caches the label values generated for names that had to be
+// hashed, so that the database is only consulted once per name. The zero
+// value is ready to use.
+type labelValueCache struct {
+	mu     sync.Mutex
+	values map[string]string
+}
+
+// maxCachedLabelValues is the most entries kept in the label value cache.
+// The cache is cleared when it fills up; the entries are cheap to look up
+// again.
+const maxCachedLabelValues = 10000
+
+func labelValueCacheKey(kind, name string) string {
+	return kind + "\x00" + name
+}
+
+func (c *labelValueCache) get(kind, name string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	value, ok := c.values[labelValueCacheKey(kind, name)]
+	return value, ok
+}
+
+func (c *labelValueCache) set(kind, name, value string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.values == nil || len(c.values) >= maxCachedLabelValues {
+		c.values = map[string]string{}
+	}
+	c.values[labelValueCacheKey(kind, name)] = value
+}
+
+func (c *labelValueCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values = nil
+}
+
+// Claiming a value that's already taken leaves the row alone and returns the
+// name it belongs to, so the caller can tell whether it collided.
+const claimLabelValueSQL = `
+	INSERT INTO vice_label_values (kind, value, name)
+	VALUES ($1, $2, $3)
+	ON CONFLICT (kind, value) DO UPDATE SET kind = EXCLUDED.kind
+	RETURNING name
+`
+
+// labelValue returns the label value used for a name of the given kind, such
+// as an analysis name. Names that labelValueString leaves unchanged are used
+// as they are. Other names, including ones that are too long, get a hashed
+// value that's
+// recorded in the database so that it can be looked up later and so that two
+// names never share a value.
+func (i *Internal) labelValue(ctx context.Context, kind, name string) (string, error) {
+	if readable := labelValueString(name); readable == name {
+		return readable, nil
+	}
+
+	if value, ok := i.labelValues.get(kind, name); ok {
+		return value, nil
+	}
+
+	for _, hashLength := range labelHashLengths {
+		value := hashedLabelValue(name, hashLength)
+
+		var owner string
+		if err := i.db.QueryRowxContext(ctx, claimLabelValueSQL, kind, value, name).Scan(&owner); err != nil {
+			return "", errors.Wrapf(err, "error recording the %s label value for %q", kind, name)
+		}
+		if owner == name {
+			i.labelValues.set(kind, name, value)
+			return value, nil
+		}
+
+		log.WithContext(ctx).Warnf("%s label value %s for %q collides with %q", kind, value, name, owner)
+	}
+
+	return "", fmt.Errorf("unable to generate a unique %s label value for %q", kind, name)
+}
+
+// LabelValueName is a name and the label value generated for it.
+type LabelValueName struct {
+	Kind  string `json:"kind" db:"kind"`
+	Value string `json:"value" db:"value"`
+	Name  string `json:"name" db:"name"`
+}
+
+const getLabelValueNameSQL = `
+	SELECT kind, value, name
+	  FROM vice_label_values
+	 WHERE kind = $1
+	   AND value = $2
+`
+
+// AdminGetLabelValueNameHandler returns the name that a label value was
+// generated for, such as the full name of an analysis from its analysis-name
+// label.
+func (i *Internal) AdminGetLabelValueNameHandler(c echo.Context) error {
+	kind := c.Param("kind")
+	value := c.Param("value")
+
+	if kind != analysisNameKind && kind != appNameKind {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("unsupported label %s", kind))
+	}
+
+	// Values without a hash are the names themselves.
+	if !strings.Contains(value, labelHashSeparator) {
+		return c.JSON(http.StatusOK, LabelValueName{Kind: kind, Value: value, Name: value})
+	}
+
+	name := LabelValueName{}
+	err := i.db.GetContext(c.Request().Context(), &name, getLabelValueNameSQL, kind, value)
+	if err == sql.ErrNoRows {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("no name was recorded for %s %s", kind, value))
+	}
+	if err != nil {
+		return errors.Wrapf(err, "error looking up the name for %s %s", kind, value)
+	}
+
+	return c.JSON(http.StatusOK, name)
+}
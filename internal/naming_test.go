@@ -0,0 +1,134 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+func TestHashedLabelValue(t *testing.T) {
+	assert := assert.New(t)
+
+	long := strings.Repeat("Very Long Analysis Name ", 5)
+	names := []string{
+		long + "1",
+		long + "2",
+		"Análisis de secuencias",
+		"!!!",
+		"__init__",
+	}
+
+	seen := map[string]bool{}
+	for _, name := range names {
+		for _, hashLength := range labelHashLengths {
+			value := hashedLabelValue(name, hashLength)
+			assert.Empty(validation.IsValidLabelValue(value), value)
+			assert.Contains(value, labelHashSeparator)
+			assert.Equal(value, hashedLabelValue(name, hashLength))
+			assert.False(seen[value], value)
+			seen[value] = true
+		}
+	}
+
+	// Names that only differ past the length limit still get different
+	// values.
+	assert.NotEqual(hashedLabelValue(names[0], 8), hashedLabelValue(names[1], 8))
+	assert.True(strings.HasPrefix(hashedLabelValue(names[2], 8), "analisis-de-secuencias--"))
+}
+
+func TestLabelValue(t *testing.T) {
+	assert := assert.New(t)
+
+	mockdb, mock, err := sqlmock.New()
+	assert.NoError(err)
+	defer mockdb.Close()
+
+	i := &Internal{db: sqlx.NewDb(mockdb, "sqlmock")}
+	ctx := context.Background()
+
+	// Names that are already label values don't touch the database.
+	value, err := i.labelValue(ctx, analysisNameKind, "rstudio-test")
+	assert.NoError(err)
+	assert.Equal("rstudio-test", value)
+
+	value, err = i.labelValue(ctx, analysisNameKind, "")
+	assert.NoError(err)
+	assert.Equal("", value)
+
+	// The first value collides with another name, so a longer hash is used.
+	name := "RStudio Test"
+	short := hashedLabelValue(name, 8)
+	longer := hashedLabelValue(name, 16)
+	mock.ExpectQuery(regexp.QuoteMeta("INSERT INTO vice_label_values")).
+		WithArgs(analysisNameKind, short, name).
+		WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("Something Else"))
+	mock.ExpectQuery(regexp.QuoteMeta("INSERT INTO vice_label_values")).
+		WithArgs(analysisNameKind, longer, name).
+		WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow(name))
+
+	value, err = i.labelValue(ctx, analysisNameKind, name)
+	assert.NoError(err)
+	assert.Equal(longer, value)
+
+	// The value is cached after it's claimed.
+	value, err = i.labelValue(ctx, analysisNameKind, name)
+	assert.NoError(err)
+	assert.Equal(longer, value)
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestAdminGetLabelValueNameHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	mockdb, mock, err := sqlmock.New()
+	assert.NoError(err)
+	defer mockdb.Close()
+
+	i := &Internal{db: sqlx.NewDb(mockdb, "sqlmock")}
+
+	lookup := func(kind, value string) (*httptest.ResponseRecorder, error) {
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+		c.SetParamNames("kind", "value")
+		c.SetParamValues(kind, value)
+		return rec, i.AdminGetLabelValueNameHandler(c)
+	}
+
+	rec, err := lookup(analysisNameKind, "rstudio-test")
+	assert.NoError(err)
+	assert.Contains(rec.Body.String(), `"name":"rstudio-test"`)
+
+	value := hashedLabelValue("RStudio Test", 8)
+	mock.ExpectQuery(regexp.QuoteMeta("FROM vice_label_values")).
+		WithArgs(analysisNameKind, value).
+		WillReturnRows(sqlmock.NewRows([]string{"kind", "value", "name"}).
+			AddRow(analysisNameKind, value, "RStudio Test"))
+	rec, err = lookup(analysisNameKind, value)
+	assert.NoError(err)
+	assert.Contains(rec.Body.String(), `"name":"RStudio Test"`)
+
+	mock.ExpectQuery(regexp.QuoteMeta("FROM vice_label_values")).
+		WithArgs(appNameKind, "missing--00000000").
+		WillReturnRows(sqlmock.NewRows([]string{"kind", "value", "name"}))
+	_, err = lookup(appNameKind, "missing--00000000")
+	if assert.Error(err) {
+		assert.Equal(http.StatusNotFound, err.(*echo.HTTPError).Code)
+	}
+
+	_, err = lookup("username", "ipctest")
+	if assert.Error(err) {
+		assert.Equal(http.StatusBadRequest, err.(*echo.HTTPError).Code)
+	}
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
@@ -0,0 +1,433 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+)
+
+// The analysis events that users can be notified about.
+const (
+	NotificationURLReady  = "url-ready"
+	NotificationCompleted = "completed"
+	NotificationFailed    = "failed"
+	NotificationExpiring  = "about-to-expire"
+)
+
+// notificationEvents lists the events in the order their preferences are
+// returned in.
+var notificationEvents = []string{
+	NotificationURLReady,
+	NotificationCompleted,
+	NotificationFailed,
+	NotificationExpiring,
+}
+
+const (
+	// defaultNotificationTimeout is how long app-exposer waits for the
+	// notification-agent when the configuration doesn't say.
+	defaultNotificationTimeout = 10 * time.Second
+
+	// analysisNotificationType is the notification-agent type used for
+	// analysis notifications.
+	analysisNotificationType = "analysis"
+
+	// analysisEmailTemplate is the notification-agent email template used for
+	// analysis notifications.
+	analysisEmailTemplate = "analysis_status_change"
+)
+
+// NotificationsConfig contains the settings for the notifications sent to
+// users through the notification-agent when something happens to one of
+// their analyses.
+type NotificationsConfig struct {
+	Enabled bool
+
+	// URL is the base URL of the notification-agent.
+	URL string
+
+	// AnalysesURL is the URL of the analyses page in the DE, for example
+	// https://de.cyverse.org/analyses. Notifications link to the analysis
+	// under it if it's set.
+	AnalysesURL string
+
+	// Timeout limits how long sending a notification may take.
+	Timeout time.Duration
+}
+
+// Validate returns an error if the configuration can't be used.
+func (c *NotificationsConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.URL == "" {
+		return fmt.Errorf("the notification-agent URL must be set")
+	}
+	if _, err := url.Parse(c.URL); err != nil {
+		return errors.Wrapf(err, "invalid notification-agent URL %s", c.URL)
+	}
+	if _, err := url.Parse(c.AnalysesURL); err != nil {
+		return errors.Wrapf(err, "invalid analyses URL %s", c.AnalysesURL)
+	}
+	return nil
+}
+
+// NotificationPreference is a user's preference for one kind of analysis
+// event. Users who haven't set a preference for an event get notifications
+// and emails for it.
+type NotificationPreference struct {
+	Event   string `json:"event" db:"event"`
+	Enabled bool   `json:"enabled" db:"enabled"`
+	Email   bool   `json:"email" db:"email"`
+}
+
+// Notification is the request body sent to the notification-agent.
+type Notification struct {
+	Type          string              `json:"type"`
+	User          string              `json:"user"`
+	Subject       string              `json:"subject"`
+	Message       string              `json:"message"`
+	Email         bool                `json:"email"`
+	EmailTemplate string              `json:"email_template"`
+	Payload       NotificationPayload `json:"payload"`
+}
+
+// NotificationPayload contains the details of the analysis a notification is
+// about, including the links shown in the notification and email.
+type NotificationPayload struct {
+	Event       string `json:"action"`
+	AnalysisID  string `json:"analysis_id"`
+	ExternalID  string `json:"external_id"`
+	AnalysisURL string `json:"analysis_url,omitempty"`
+	AccessURL   string `json:"access_url,omitempty"`
+
+	// Links contains any other actions the user can take, keyed by name.
+	Links map[string]string `json:"links,omitempty"`
+}
+
+// analysisNotification is a notification to send to the owner of an
+// analysis.
+type analysisNotification struct {
+	ExternalID string
+	Event      string
+	Subject    string
+	Message    string
+	Links      map[string]string
+
+	// Key identifies the notification so that it's only sent once for the
+	// analysis. The event is used if it's empty.
+	Key string
+}
+
+// NotificationAgent sends notifications through the notification-agent
+// service.
+type NotificationAgent struct {
+	url    string
+	client *http.Client
+}
+
+// NewNotificationAgent returns a *NotificationAgent for the configuration.
+func NewNotificationAgent(cfg *NotificationsConfig) *NotificationAgent {
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = defaultNotificationTimeout
+	}
+
+	return &NotificationAgent{
+		url: cfg.URL,
+		client: &http.Client{
+			Transport: httpClient.Transport,
+			Timeout:   timeout,
+		},
+	}
+}
+
+// Send posts the notification to the notification-agent.
+func (n *NotificationAgent) Send(ctx context.Context, notification *Notification) error {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return errors.Wrapf(err, "error marshalling the notification for %s", notification.User)
+	}
+
+	u, err := url.JoinPath(n.url, "notification")
+	if err != nil {
+		return errors.Wrapf(err, "error building the notification-agent URL from %s", n.url)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrapf(err, "error creating the notification request for %s", notification.User)
+	}
+	req.Header.Set("content-type", "application/json")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "error sending the notification for %s", notification.User)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		respBody, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("the notification-agent returned %d for %s: %s", resp.StatusCode, notification.User, string(respBody))
+	}
+
+	return nil
+}
+
+const getNotificationPreferencesSQL = `
+	SELECT event, enabled, email
+	  FROM vice_notification_preferences
+	 WHERE user_id = $1
+`
+
+// getNotificationPreferences returns the user's preference for every event,
+// including the defaults for the events they haven't set one for.
+func (i *Internal) getNotificationPreferences(ctx context.Context, userID string) ([]NotificationPreference, error) {
+	stored := []NotificationPreference{}
+	if err := i.db.SelectContext(ctx, &stored, getNotificationPreferencesSQL, userID); err != nil {
+		return nil, errors.Wrapf(err, "error looking up the notification preferences for user %s", userID)
+	}
+
+	byEvent := map[string]NotificationPreference{}
+	for _, preference := range stored {
+		byEvent[preference.Event] = preference
+	}
+
+	preferences := make([]NotificationPreference, 0, len(notificationEvents))
+	for _, event := range notificationEvents {
+		preference, ok := byEvent[event]
+		if !ok {
+			preference = NotificationPreference{Event: event, Enabled: true, Email: true}
+		}
+		preferences = append(preferences, preference)
+	}
+
+	return preferences, nil
+}
+
+// getNotificationPreference returns the user's preference for the event.
+func (i *Internal) getNotificationPreference(ctx context.Context, userID, event string) (*NotificationPreference, error) {
+	preferences, err := i.getNotificationPreferences(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	for index := range preferences {
+		if preferences[index].Event == event {
+			return &preferences[index], nil
+		}
+	}
+	return nil, fmt.Errorf("unknown notification event %s", event)
+}
+
+// Claiming a notification that's already been sent doesn't insert a row.
+const claimNotificationSQL = `
+	INSERT INTO vice_sent_notifications (external_id, key)
+	VALUES ($1, $2)
+	ON CONFLICT (external_id, key) DO NOTHING
+`
+
+const releaseNotificationSQL = `
+	DELETE FROM vice_sent_notifications WHERE external_id = $1 AND key = $2
+`
+
+// claimNotification returns true if the notification hasn't already been
+// sent for the analysis, by this replica or another one.
+func (i *Internal) claimNotification(ctx context.Context, externalID, key string) (bool, error) {
+	result, err := i.db.ExecContext(ctx, claimNotificationSQL, externalID, key)
+	if err != nil {
+		return false, errors.Wrapf(err, "error recording the %s notification for %s", key, externalID)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, errors.Wrapf(err, "error recording the %s notification for %s", key, externalID)
+	}
+	return rows > 0, nil
+}
+
+// analysisAccessURL returns the URL users open the running analysis at.
+func (i *Internal) analysisAccessURL(ctx context.Context, userID, externalID string) (string, error) {
+	frontURL, err := url.Parse(i.FrontendBaseURL)
+	if err != nil || frontURL.Host == "" {
+		return "", nil
+	}
+	subdomain, err := i.analysisSubdomain(ctx, userID, externalID)
+	if err != nil {
+		return "", err
+	}
+	frontURL.Host = fmt.Sprintf("%s.%s", subdomain, frontURL.Host)
+	return frontURL.String(), nil
+}
+
+// notify sends the notification to the owner of the analysis, unless
+// notifications are disabled, the user turned off notifications for the
+// event, or it's already been sent. The notification can be sent again if
+// the notification-agent can't be reached.
+func (i *Internal) notify(ctx context.Context, n *analysisNotification) (err error) {
+	if i.notifications == nil {
+		return nil
+	}
+
+	ctx, span := startSpan(ctx, "notify")
+	defer func() { endSpan(span, err) }()
+
+	analysisID, err := i.apps.GetAnalysisIDByExternalID(ctx, n.ExternalID)
+	if err != nil {
+		return errors.Wrapf(err, "error looking up the analysis ID for %s", n.ExternalID)
+	}
+
+	username, userID, err := i.apps.GetUserByAnalysisID(ctx, analysisID)
+	if err != nil {
+		return errors.Wrapf(err, "error looking up the user for analysis %s", analysisID)
+	}
+
+	preference, err := i.getNotificationPreference(ctx, userID, n.Event)
+	if err != nil {
+		return err
+	}
+	if !preference.Enabled {
+		log.WithContext(ctx).Debugf("user %s turned off %s notifications, not notifying them about %s", username, n.Event, n.ExternalID)
+		return nil
+	}
+
+	key := n.Key
+	if key == "" {
+		key = n.Event
+	}
+	claimed, err := i.claimNotification(ctx, n.ExternalID, key)
+	if err != nil || !claimed {
+		return err
+	}
+
+	accessURL, err := i.analysisAccessURL(ctx, userID, n.ExternalID)
+	if err != nil {
+		return err
+	}
+
+	notification := &Notification{
+		Type:          analysisNotificationType,
+		User:          username,
+		Subject:       n.Subject,
+		Message:       n.Message,
+		Email:         preference.Email,
+		EmailTemplate: analysisEmailTemplate,
+		Payload: NotificationPayload{
+			Event:      n.Event,
+			AnalysisID: analysisID,
+			ExternalID: n.ExternalID,
+			AccessURL:  accessURL,
+			Links:      n.Links,
+		},
+	}
+	if i.Notifications.AnalysesURL != "" {
+		if notification.Payload.AnalysisURL, err = url.JoinPath(i.Notifications.AnalysesURL, analysisID); err != nil {
+			return errors.Wrapf(err, "error building the link to analysis %s", analysisID)
+		}
+	}
+
+	if err = i.notifications.Send(ctx, notification); err != nil {
+		if _, releaseErr := i.db.ExecContext(ctx, releaseNotificationSQL, n.ExternalID, key); releaseErr != nil {
+			log.WithContext(ctx).Error(releaseErr)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// notificationUserID returns the UUID of the user named in the request's
+// user query parameter.
+func (i *Internal) notificationUserID(c echo.Context) (string, error) {
+	user := c.QueryParam("user")
+	if user == "" {
+		return "", echo.NewHTTPError(http.StatusBadRequest, "user query parameter must be set")
+	}
+
+	userID, err := i.apps.GetUserID(c.Request().Context(), i.fixUsername(user))
+	if err == sql.ErrNoRows {
+		return "", echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("user %s not found", user))
+	}
+	return userID, err
+}
+
+// GetNotificationPreferencesHandler returns the user's notification
+// preferences for every analysis event.
+func (i *Internal) GetNotificationPreferencesHandler(c echo.Context) error {
+	userID, err := i.notificationUserID(c)
+	if err != nil {
+		return err
+	}
+
+	preferences, err := i.getNotificationPreferences(c.Request().Context(), userID)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, preferences)
+}
+
+const upsertNotificationPreferenceSQL = `
+	INSERT INTO vice_notification_preferences (user_id, event, enabled, email)
+	VALUES ($1, $2, $3, $4)
+	ON CONFLICT (user_id, event) DO UPDATE
+	   SET enabled = EXCLUDED.enabled,
+	       email = EXCLUDED.email
+`
+
+// UpdateNotificationPreferencesHandler sets the user's notification
+// preferences for the events in the request body. The preferences for the
+// other events are left alone. Returns the preferences for every event.
+func (i *Internal) UpdateNotificationPreferencesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID, err := i.notificationUserID(c)
+	if err != nil {
+		return err
+	}
+
+	var preferences []NotificationPreference
+	if err = json.NewDecoder(c.Request().Body).Decode(&preferences); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	for _, preference := range preferences {
+		known := false
+		for _, event := range notificationEvents {
+			known = known || preference.Event == event
+		}
+		if !known {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("unknown notification event %q", preference.Event))
+		}
+	}
+
+	tx, err := i.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // nolint:errcheck
+
+	for _, preference := range preferences {
+		if _, err = tx.ExecContext(ctx, upsertNotificationPreferenceSQL, userID, preference.Event, preference.Enabled, preference.Email); err != nil {
+			return errors.Wrapf(err, "error saving the %s notification preference for user %s", preference.Event, userID)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	updated, err := i.getNotificationPreferences(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, updated)
+}
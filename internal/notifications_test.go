@@ -0,0 +1,170 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cyverse-de/app-exposer/apps"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func newNotificationsTestInternal(t *testing.T, agentURL string) (*Internal, sqlmock.Sqlmock) {
+	mockdb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { mockdb.Close() })
+
+	db := sqlx.NewDb(mockdb, "sqlmock")
+	i := &Internal{
+		Init: Init{
+			UserSuffix:      "@example.org",
+			FrontendBaseURL: "https://cyverse.run",
+			Notifications: NotificationsConfig{
+				Enabled:     true,
+				URL:         agentURL,
+				AnalysesURL: "https://de.example.org/analyses",
+			},
+		},
+		db:   db,
+		apps: apps.NewApps(db, "@example.org"),
+	}
+	i.notifications = NewNotificationAgent(&i.Notifications)
+	return i, mock
+}
+
+func expectNotificationLookups(mock sqlmock.Sqlmock, preferences *sqlmock.Rows) {
+	mock.ExpectQuery("SELECT j.id").WithArgs("e1").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("a1"))
+	mock.ExpectQuery("SELECT u.username").WithArgs("a1").
+		WillReturnRows(sqlmock.NewRows([]string{"username", "id"}).AddRow("ipcdev@example.org", "u1"))
+	mock.ExpectQuery("FROM vice_notification_preferences").WithArgs("u1").WillReturnRows(preferences)
+}
+
+func TestNotify(t *testing.T) {
+	assert := assert.New(t)
+
+	received := []Notification{}
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("/notification", r.URL.Path)
+		notification := Notification{}
+		assert.NoError(json.NewDecoder(r.Body).Decode(&notification))
+		received = append(received, notification)
+	}))
+	defer agent.Close()
+
+	i, mock := newNotificationsTestInternal(t, agent.URL)
+	ctx := context.Background()
+	ready := &analysisNotification{ExternalID: "e1", Event: NotificationURLReady, Subject: "ready", Message: "ready"}
+	preferenceColumns := []string{"event", "enabled", "email"}
+
+	// Users get notifications and emails by default.
+	expectNotificationLookups(mock, sqlmock.NewRows(preferenceColumns))
+	mock.ExpectExec("INSERT INTO vice_sent_notifications").WithArgs("e1", NotificationURLReady).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	assert.NoError(i.notify(ctx, ready))
+
+	if assert.Len(received, 1) {
+		notification := received[0]
+		assert.Equal("ipcdev", notification.User)
+		assert.True(notification.Email)
+		assert.Equal(NotificationURLReady, notification.Payload.Event)
+		assert.Equal("https://de.example.org/analyses/a1", notification.Payload.AnalysisURL)
+		assert.Equal("https://"+IngressName("u1", "e1")+".cyverse.run", notification.Payload.AccessURL)
+	}
+
+	// Notifications that were already sent aren't sent again.
+	expectNotificationLookups(mock, sqlmock.NewRows(preferenceColumns))
+	mock.ExpectExec("INSERT INTO vice_sent_notifications").WithArgs("e1", NotificationURLReady).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	assert.NoError(i.notify(ctx, ready))
+	assert.Len(received, 1)
+
+	// Users can turn notifications off.
+	expectNotificationLookups(mock, sqlmock.NewRows(preferenceColumns).AddRow(NotificationURLReady, false, false))
+	assert.NoError(i.notify(ctx, ready))
+	assert.Len(received, 1)
+
+	// Or just the emails.
+	expectNotificationLookups(mock, sqlmock.NewRows(preferenceColumns).AddRow(NotificationFailed, true, false))
+	mock.ExpectExec("INSERT INTO vice_sent_notifications").WithArgs("e1", NotificationFailed).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	assert.NoError(i.notify(ctx, &analysisNotification{ExternalID: "e1", Event: NotificationFailed}))
+	if assert.Len(received, 2) {
+		assert.False(received[1].Email)
+	}
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestNotifyAgentFailure(t *testing.T) {
+	assert := assert.New(t)
+
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer agent.Close()
+
+	i, mock := newNotificationsTestInternal(t, agent.URL)
+
+	// The claim is released so that the notification can be sent later.
+	expectNotificationLookups(mock, sqlmock.NewRows([]string{"event", "enabled", "email"}))
+	mock.ExpectExec("INSERT INTO vice_sent_notifications").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM vice_sent_notifications").WithArgs("e1", NotificationCompleted).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	assert.Error(i.notify(context.Background(), &analysisNotification{ExternalID: "e1", Event: NotificationCompleted}))
+
+	assert.NoError(mock.ExpectationsWereMet())
+
+	// Nothing is looked up when notifications are disabled.
+	i.notifications = nil
+	assert.NoError(i.notify(context.Background(), &analysisNotification{ExternalID: "e1", Event: NotificationCompleted}))
+}
+
+func TestUpdateNotificationPreferencesHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := newNotificationsTestInternal(t, "http://notification-agent")
+
+	update := func(body string) (*httptest.ResponseRecorder, error) {
+		req := httptest.NewRequest(http.MethodPut, "/vice/notifications/preferences?user=ipcdev", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		return rec, i.UpdateNotificationPreferencesHandler(echo.New().NewContext(req, rec))
+	}
+
+	mock.ExpectQuery("SELECT u.id").WithArgs("ipcdev@example.org").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("u1"))
+	_, err := update(`[{"event": "reboot", "enabled": false}]`)
+	if assert.Error(err) {
+		assert.Equal(http.StatusBadRequest, err.(*echo.HTTPError).Code)
+	}
+
+	mock.ExpectQuery("SELECT u.id").WithArgs("ipcdev@example.org").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("u1"))
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO vice_notification_preferences")).
+		WithArgs("u1", NotificationCompleted, true, false).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectQuery("FROM vice_notification_preferences").WithArgs("u1").
+		WillReturnRows(sqlmock.NewRows([]string{"event", "enabled", "email"}).AddRow(NotificationCompleted, true, false))
+
+	rec, err := update(`[{"event": "completed", "enabled": true, "email": false}]`)
+	if assert.NoError(err) {
+		preferences := []NotificationPreference{}
+		assert.NoError(json.Unmarshal(rec.Body.Bytes(), &preferences))
+		assert.Len(preferences, len(notificationEvents))
+		assert.Contains(preferences, NotificationPreference{Event: NotificationCompleted, Enabled: true, Email: false})
+		assert.Contains(preferences, NotificationPreference{Event: NotificationURLReady, Enabled: true, Email: true})
+	}
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
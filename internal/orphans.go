@@ -0,0 +1,266 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	defaultOrphanReconcilerInterval    = 10 * time.Minute
+	defaultOrphanReconcilerGracePeriod = 15 * time.Minute
+)
+
+// OrphanReconcilerConfig contains the settings for the reconciler that removes
+// the resources of analyses that have ended or don't exist.
+type OrphanReconcilerConfig struct {
+	Interval time.Duration
+
+	// GracePeriod is how old an analysis's resources have to be before
+	// they're considered. It should be longer than the time it takes for a
+	// launch to be recorded and for a terminated analysis to be cleaned up.
+	GracePeriod time.Duration
+
+	// DryRun logs the orphaned analyses without deleting anything.
+	DryRun bool
+}
+
+// OrphanedAnalysis describes an analysis whose resources are still in the
+// cluster even though it has ended or doesn't exist.
+type OrphanedAnalysis struct {
+	ExternalID string `json:"external_id" db:"external_id"`
+
+	// Status is the status of the analysis, or empty if there's no analysis
+	// with the external ID.
+	Status string `json:"status" db:"status"`
+
+	// Deleted lists the resources that were deleted, as kind/name.
+	Deleted []string `json:"deleted"`
+
+	Error string `json:"error,omitempty" db:"error"`
+}
+
+// reason returns the reason the analysis's resources are orphaned.
+func (o *OrphanedAnalysis) reason() string {
+	if o.Status == "" {
+		return "no analysis has this external ID"
+	}
+	return fmt.Sprintf("the analysis is %s", o.Status)
+}
+
+const orphanStatusesSQL = `
+	SELECT s.external_id, j.status
+	  FROM jobs j
+	  JOIN job_steps s ON s.job_id = j.id
+	 WHERE s.external_id = ANY($1)
+`
+
+const insertOrphanDeletionSQL = `
+	INSERT INTO vice_orphan_deletions (external_id, status, deleted, error)
+	VALUES ($1, $2, $3, $4)
+`
+
+// OrphanReconciler periodically compares the analysis resources in the
+// cluster with the analyses in the database and deletes the resources of the
+// analyses that have completed, failed, or been canceled, or that don't
+// exist. Resources are left behind when a status update is missed, and they
+// use up cluster capacity and count against the users' limits.
+type OrphanReconciler struct {
+	internal    *Internal
+	interval    time.Duration
+	gracePeriod time.Duration
+	dryRun      bool
+	now         func() time.Time
+}
+
+// NewOrphanReconciler returns a new *OrphanReconciler.
+func NewOrphanReconciler(i *Internal) *OrphanReconciler {
+	r := &OrphanReconciler{
+		internal:    i,
+		interval:    i.OrphanReconciler.Interval,
+		gracePeriod: i.OrphanReconciler.GracePeriod,
+		dryRun:      i.OrphanReconciler.DryRun,
+		now:         time.Now,
+	}
+	if r.interval <= 0 {
+		r.interval = defaultOrphanReconcilerInterval
+	}
+	if r.gracePeriod <= 0 {
+		r.gracePeriod = defaultOrphanReconcilerGracePeriod
+	}
+	return r
+}
+
+// candidates returns the external IDs of the analyses that have Deployments,
+// Services, or Ingresses older than the grace period. Resources that are
+// already being deleted are left to the deletion reaper.
+func (r *OrphanReconciler) candidates(ctx context.Context) ([]string, error) {
+	opts := metav1.ListOptions{LabelSelector: "external-id"}
+
+	seen := map[string]bool{}
+	for _, kind := range r.internal.reapableKinds() {
+		switch kind.kind {
+		case "Deployment", "Service", "Ingress":
+		default:
+			continue
+		}
+
+		objs, err := kind.objects(ctx, opts)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to list the %s resources for analyses", kind.kind)
+		}
+
+		for _, obj := range objs {
+			externalID := obj.GetLabels()["external-id"]
+			if externalID == "" || obj.GetDeletionTimestamp() != nil {
+				continue
+			}
+			if r.now().Sub(obj.GetCreationTimestamp().Time) < r.gracePeriod {
+				continue
+			}
+			seen[externalID] = true
+		}
+	}
+
+	externalIDs := make([]string, 0, len(seen))
+	for externalID := range seen {
+		externalIDs = append(externalIDs, externalID)
+	}
+	sort.Strings(externalIDs)
+	return externalIDs, nil
+}
+
+// orphans returns the analyses among the candidates that have ended or don't
+// exist.
+func (r *OrphanReconciler) orphans(ctx context.Context, externalIDs []string) ([]OrphanedAnalysis, error) {
+	rows := []OrphanedAnalysis{}
+	if err := r.internal.db.SelectContext(ctx, &rows, orphanStatusesSQL, pq.Array(externalIDs)); err != nil {
+		return nil, errors.Wrap(err, "unable to look up the statuses of the running analyses")
+	}
+
+	statuses := map[string]string{}
+	for _, row := range rows {
+		statuses[row.ExternalID] = row.Status
+	}
+
+	orphans := []OrphanedAnalysis{}
+	for _, externalID := range externalIDs {
+		status, found := statuses[externalID]
+		if found && shouldCountStatus(status) {
+			continue
+		}
+		orphans = append(orphans, OrphanedAnalysis{
+			ExternalID: externalID,
+			Status:     status,
+			Deleted:    []string{},
+		})
+	}
+	return orphans, nil
+}
+
+// check deletes the resources of the orphaned analyses and returns what it
+// found. Nothing is deleted if the statuses can't be looked up.
+func (r *OrphanReconciler) check(ctx context.Context, dryRun bool) ([]OrphanedAnalysis, error) {
+	ctx, span := otel.Tracer(otelName).Start(ctx, "OrphanReconciler.check")
+	defer span.End()
+
+	externalIDs, err := r.candidates(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(externalIDs) == 0 {
+		return []OrphanedAnalysis{}, nil
+	}
+
+	orphans, err := r.orphans(ctx, externalIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	for idx := range orphans {
+		orphan := &orphans[idx]
+
+		if dryRun {
+			log.WithContext(ctx).Infof("the resources for %s are orphaned: %s", orphan.ExternalID, orphan.reason())
+			continue
+		}
+
+		deleted, err := r.internal.deleteAnalysisResources(ctx, orphan.ExternalID)
+		orphan.Deleted = deleted
+		if err != nil {
+			orphan.Error = err.Error()
+			log.WithContext(ctx).Error(errors.Wrapf(err, "unable to delete the orphaned resources for %s", orphan.ExternalID))
+		} else {
+			log.WithContext(ctx).Warnf("deleted the orphaned resources for %s because %s: %v", orphan.ExternalID, orphan.reason(), deleted)
+		}
+
+		if _, err = r.internal.db.ExecContext(
+			ctx,
+			insertOrphanDeletionSQL,
+			orphan.ExternalID,
+			orphan.Status,
+			pq.Array(orphan.Deleted),
+			orphan.Error,
+		); err != nil {
+			log.WithContext(ctx).Error(errors.Wrapf(err, "unable to record the deletion of the orphaned resources for %s", orphan.ExternalID))
+		}
+	}
+
+	return orphans, nil
+}
+
+// Run looks for orphaned analyses periodically until the context is canceled.
+func (r *OrphanReconciler) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := r.check(ctx, r.dryRun); err != nil {
+				log.WithContext(ctx).Error(err)
+			}
+		}
+	}
+}
+
+// RunOrphanReconciler starts deleting the resources of analyses that have
+// ended or don't exist. Blocks until the context is canceled.
+func (i *Internal) RunOrphanReconciler(ctx context.Context) {
+	NewOrphanReconciler(i).Run(ctx)
+}
+
+// AdminReconcileOrphansHandler runs the orphan reconciler immediately and
+// returns the orphaned analyses it found. Nothing is deleted if the dry-run
+// query parameter is true or the reconciler is configured for dry runs.
+func (i *Internal) AdminReconcileOrphansHandler(c echo.Context) error {
+	dryRun := i.OrphanReconciler.DryRun
+	if value := c.QueryParam("dry-run"); value != "" {
+		v, err := strconv.ParseBool(value)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "dry-run must be true or false")
+		}
+		dryRun = dryRun || v
+	}
+
+	orphans, err := NewOrphanReconciler(i).check(c.Request().Context(), dryRun)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"dry_run": dryRun,
+		"orphans": orphans,
+	})
+}
@@ -0,0 +1,150 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// orphanMeta returns the metadata for a resource of the analysis with the
+// external ID that was created the given amount of time before reaperNow.
+func orphanMeta(name, externalID string, age time.Duration) metav1.ObjectMeta {
+	return metav1.ObjectMeta{
+		Name:              name,
+		Namespace:         "vice-apps",
+		Labels:            map[string]string{"external-id": externalID},
+		CreationTimestamp: metav1.NewTime(reaperNow.Add(-age)),
+	}
+}
+
+func orphanTestReconciler(t *testing.T) (*OrphanReconciler, *fake.Clientset, sqlmock.Sqlmock) {
+	mockdb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { mockdb.Close() })
+
+	deleted := metav1.NewTime(reaperNow.Add(-time.Hour))
+	terminating := orphanMeta("e5", "e5", time.Hour)
+	terminating.DeletionTimestamp = &deleted
+	terminating.Finalizers = []string{"example.com/cleanup"}
+
+	clientset := fake.NewSimpleClientset(
+		// Completed.
+		&appsv1.Deployment{ObjectMeta: orphanMeta("e1", "e1", time.Hour)},
+		&apiv1.Service{ObjectMeta: orphanMeta("vice-e1", "e1", time.Hour)},
+		&apiv1.ConfigMap{ObjectMeta: orphanMeta("excludes-file-e1", "e1", time.Hour)},
+
+		// Running.
+		&appsv1.Deployment{ObjectMeta: orphanMeta("e2", "e2", time.Hour)},
+
+		// Not in the database.
+		&netv1.Ingress{ObjectMeta: orphanMeta("e3", "e3", time.Hour)},
+
+		// Too new to be checked.
+		&appsv1.Deployment{ObjectMeta: orphanMeta("e4", "e4", time.Minute)},
+
+		// Left to the deletion reaper.
+		&appsv1.Deployment{ObjectMeta: terminating},
+	)
+
+	i := &Internal{
+		Init:      Init{ViceNamespace: "vice-apps"},
+		clientset: clientset,
+		db:        sqlx.NewDb(mockdb, "sqlmock"),
+	}
+	r := NewOrphanReconciler(i)
+	r.now = func() time.Time { return reaperNow }
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT s.external_id, j.status")).
+		WithArgs(pq.Array([]string{"e1", "e2", "e3"})).
+		WillReturnRows(sqlmock.NewRows([]string{"external_id", "status"}).
+			AddRow("e1", "Completed").
+			AddRow("e2", "Running"))
+
+	return r, clientset, mock
+}
+
+func TestOrphanReconcilerCheck(t *testing.T) {
+	assert := assert.New(t)
+
+	r, clientset, mock := orphanTestReconciler(t)
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO vice_orphan_deletions")).
+		WithArgs("e1", "Completed", pq.Array([]string{"Deployment/e1", "Service/vice-e1", "ConfigMap/excludes-file-e1"}), "").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO vice_orphan_deletions")).
+		WithArgs("e3", "", pq.Array([]string{"Ingress/e3"}), "").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	orphans, err := r.check(context.Background(), false)
+	assert.NoError(err)
+	assert.Equal([]OrphanedAnalysis{
+		{ExternalID: "e1", Status: "Completed", Deleted: []string{"Deployment/e1", "Service/vice-e1", "ConfigMap/excludes-file-e1"}},
+		{ExternalID: "e3", Status: "", Deleted: []string{"Ingress/e3"}},
+	}, orphans)
+	assert.NoError(mock.ExpectationsWereMet())
+
+	deployments, err := clientset.AppsV1().Deployments("vice-apps").List(context.Background(), metav1.ListOptions{})
+	assert.NoError(err)
+	names := []string{}
+	for _, d := range deployments.Items {
+		names = append(names, d.Name)
+	}
+	assert.ElementsMatch([]string{"e2", "e4", "e5"}, names)
+}
+
+func TestOrphanReconcilerDryRun(t *testing.T) {
+	assert := assert.New(t)
+
+	r, clientset, mock := orphanTestReconciler(t)
+
+	orphans, err := r.check(context.Background(), true)
+	assert.NoError(err)
+	assert.Len(orphans, 2)
+	assert.NoError(mock.ExpectationsWereMet())
+
+	for _, action := range clientset.Actions() {
+		assert.NotEqual("delete", action.GetVerb())
+	}
+}
+
+func TestOrphanReconcilerDatabaseError(t *testing.T) {
+	assert := assert.New(t)
+
+	mockdb, mock, err := sqlmock.New()
+	assert.NoError(err)
+	defer mockdb.Close()
+
+	clientset := fake.NewSimpleClientset(
+		&appsv1.Deployment{ObjectMeta: orphanMeta("e1", "e1", time.Hour)},
+	)
+	i := &Internal{
+		Init:      Init{ViceNamespace: "vice-apps"},
+		clientset: clientset,
+		db:        sqlx.NewDb(mockdb, "sqlmock"),
+	}
+	r := NewOrphanReconciler(i)
+	r.now = func() time.Time { return reaperNow }
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT s.external_id, j.status")).
+		WillReturnError(errors.New("connection refused"))
+
+	// Nothing is deleted when the statuses are unknown.
+	_, err = r.check(context.Background(), false)
+	assert.Error(err)
+	for _, action := range clientset.Actions() {
+		assert.NotEqual("delete", action.GetVerb())
+	}
+}
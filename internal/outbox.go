@@ -0,0 +1,404 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/cyverse-de/messaging/v9"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultOutboxMaxAttempts   = 10
+	defaultOutboxRetryInterval = 30 * time.Second
+	outboxMaxBackoff           = 30 * time.Minute
+
+	// outboxClaimLease is how long a replica holds on to a message it has
+	// claimed for delivery before another replica may pick it up.
+	outboxClaimLease = 5 * time.Minute
+
+	// outboxQueueTimeout limits how long queueing a message may take once the
+	// caller's context is no longer in play.
+	outboxQueueTimeout = 30 * time.Second
+)
+
+// errOutboxMessageInFlight is returned by Replay when the message is
+// currently claimed by a retry worker.
+var errOutboxMessageInFlight = errors.New("outbox message is currently being delivered")
+
+// outboxDeliveryError wraps errors returned by the job-status-listener so
+// that they can be told apart from database errors.
+type outboxDeliveryError struct {
+	err error
+}
+
+func (e *outboxDeliveryError) Error() string {
+	return e.err.Error()
+}
+
+func (e *outboxDeliveryError) Unwrap() error {
+	return e.err
+}
+
+// OutboxMessage is a status update that could not be delivered on the first
+// attempt and is waiting in the outbox table to be retried.
+type OutboxMessage struct {
+	ID            string    `json:"id" db:"id"`
+	ExternalID    string    `json:"external_id" db:"external_id"`
+	State         string    `json:"state" db:"state"`
+	Message       string    `json:"message" db:"message"`
+	Attempts      int       `json:"attempts" db:"attempts"`
+	LastError     *string   `json:"last_error" db:"last_error"`
+	DeadLettered  bool      `json:"dead_lettered" db:"dead_lettered"`
+	CreatedAt     time.Time `json:"created_at" db:"created_at"`
+	NextAttemptAt time.Time `json:"next_attempt_at" db:"next_attempt_at"`
+}
+
+// OutboxPublisher is an AnalysisStatusPublisher that stores status updates
+// that could not be delivered in a persistent outbox so that they can be
+// retried later. Messages that exceed the maximum number of attempts are
+// dead-lettered and must be replayed by an administrator.
+//
+// Updates for an analysis are delivered in the order they were published. If
+// an update for an analysis is already waiting in the outbox, later updates
+// for the same analysis are queued behind it instead of being sent directly.
+type OutboxPublisher struct {
+	publisher     *JSLPublisher
+	db            *sqlx.DB
+	maxAttempts   int
+	retryInterval time.Duration
+}
+
+// NewOutboxPublisher returns a new *OutboxPublisher that delivers status
+// updates through the provided *JSLPublisher.
+func NewOutboxPublisher(publisher *JSLPublisher, db *sqlx.DB, maxAttempts int, retryInterval time.Duration) *OutboxPublisher {
+	if maxAttempts <= 0 {
+		maxAttempts = defaultOutboxMaxAttempts
+	}
+	if retryInterval <= 0 {
+		retryInterval = defaultOutboxRetryInterval
+	}
+	return &OutboxPublisher{
+		publisher:     publisher,
+		db:            db,
+		maxAttempts:   maxAttempts,
+		retryInterval: retryInterval,
+	}
+}
+
+// The columns selected for every query that returns outbox messages.
+const outboxColumns = `id, external_id, state, message, attempts, last_error, dead_lettered, created_at, next_attempt_at`
+
+const hasPendingOutboxMessagesSQL = `
+	SELECT EXISTS (
+		SELECT 1
+		  FROM vice_status_outbox
+		 WHERE external_id = $1
+		   AND NOT dead_lettered
+	)
+`
+
+const insertOutboxMessageSQL = `
+	INSERT INTO vice_status_outbox (external_id, state, message, attempts, last_error, next_attempt_at)
+	VALUES ($1, $2, $3, $4, $5, now() + $6 * interval '1 second')
+`
+
+func (o *OutboxPublisher) publish(ctx context.Context, jobID, msg string, jobState messaging.JobState) error {
+	// The outbox must keep working after the caller's context is canceled,
+	// otherwise an update that fails because of the cancellation is lost.
+	qctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), outboxQueueTimeout)
+	defer cancel()
+
+	var pending bool
+	if err := o.db.QueryRowContext(qctx, hasPendingOutboxMessagesSQL, jobID).Scan(&pending); err != nil {
+		log.WithContext(ctx).Error(errors.Wrapf(err, "unable to check the outbox for pending updates for %s", jobID))
+	}
+
+	if pending {
+		log.WithContext(ctx).Infof("queueing %s status for %s behind pending updates in the outbox", jobState, jobID)
+		if _, err := o.db.ExecContext(qctx, insertOutboxMessageSQL, jobID, string(jobState), msg, 0, nil, 0); err != nil {
+			return errors.Wrapf(err, "unable to queue %s status for %s", jobState, jobID)
+		}
+		return nil
+	}
+
+	err := o.publisher.postStatus(ctx, jobID, msg, jobState)
+	if err == nil {
+		return nil
+	}
+
+	log.WithContext(ctx).Error(errors.Wrapf(err, "queueing %s status for %s in the outbox", jobState, jobID))
+
+	if _, dberr := o.db.ExecContext(
+		qctx,
+		insertOutboxMessageSQL,
+		jobID,
+		string(jobState),
+		msg,
+		1,
+		err.Error(),
+		o.backoff(1).Seconds(),
+	); dberr != nil {
+		return errors.Wrapf(dberr, "unable to queue %s status for %s after delivery failure: %s", jobState, jobID, err.Error())
+	}
+
+	// The status update will be delivered by the retry worker, so the caller
+	// doesn't need to do anything else with the error.
+	return nil
+}
+
+// Fail sends an analysis failure update, queueing it for a retry if the
+// delivery fails.
+func (o *OutboxPublisher) Fail(ctx context.Context, jobID, msg string) error {
+	log.WithContext(ctx).Warnf("Sending failure job status update for external-id %s", jobID)
+	return o.publish(ctx, jobID, msg, messaging.FailedState)
+}
+
+// Success sends a success update, queueing it for a retry if the delivery
+// fails.
+func (o *OutboxPublisher) Success(ctx context.Context, jobID, msg string) error {
+	log.WithContext(ctx).Warnf("Sending success job status update for external-id %s", jobID)
+	return o.publish(ctx, jobID, msg, messaging.SucceededState)
+}
+
+// Running sends an analysis running update, queueing it for a retry if the
+// delivery fails.
+func (o *OutboxPublisher) Running(ctx context.Context, jobID, msg string) error {
+	log.WithContext(ctx).Warnf("Sending running job status update for external-id %s", jobID)
+	return o.publish(ctx, jobID, msg, messaging.RunningState)
+}
+
+// claimOutboxMessagesSQL claims the oldest pending message for each analysis
+// by pushing its next attempt time past the claim lease. Rows locked by other
+// replicas are skipped, so each message is only claimed by one replica at a
+// time.
+const claimOutboxMessagesSQL = `
+	UPDATE vice_status_outbox
+	   SET next_attempt_at = now() + $1 * interval '1 second'
+	 WHERE id IN (
+		SELECT o.id
+		  FROM vice_status_outbox o
+		 WHERE NOT o.dead_lettered
+		   AND o.next_attempt_at <= now()
+		   AND NOT EXISTS (
+			SELECT 1
+			  FROM vice_status_outbox p
+			 WHERE p.external_id = o.external_id
+			   AND NOT p.dead_lettered
+			   AND p.created_at < o.created_at
+		   )
+	  ORDER BY o.created_at ASC
+		 LIMIT 100
+		   FOR UPDATE SKIP LOCKED
+	 )
+	RETURNING ` + outboxColumns
+
+const deleteOutboxMessageSQL = `
+	DELETE FROM vice_status_outbox WHERE id = $1
+`
+
+const recordOutboxFailureSQL = `
+	UPDATE vice_status_outbox
+	   SET attempts = attempts + 1,
+	       last_error = $2,
+	       dead_lettered = $3,
+	       next_attempt_at = now() + $4 * interval '1 second'
+	 WHERE id = $1
+`
+
+// backoff returns the amount of time to wait before the next delivery
+// attempt for a message that has already been attempted the given number of
+// times.
+func (o *OutboxPublisher) backoff(attempts int) time.Duration {
+	wait := o.retryInterval
+	for n := 1; n < attempts; n++ {
+		wait *= 2
+		if wait >= outboxMaxBackoff {
+			return outboxMaxBackoff
+		}
+	}
+	return wait
+}
+
+// deliver attempts to send a single queued message, removing it from the
+// outbox on success and recording the failure otherwise. Errors returned by
+// the job-status-listener are wrapped in an *outboxDeliveryError.
+func (o *OutboxPublisher) deliver(ctx context.Context, m *OutboxMessage) error {
+	err := o.publisher.postStatus(ctx, m.ExternalID, m.Message, messaging.JobState(m.State))
+	if err == nil {
+		_, err = o.db.ExecContext(ctx, deleteOutboxMessageSQL, m.ID)
+		return err
+	}
+
+	attempts := m.Attempts + 1
+	deadLettered := attempts >= o.maxAttempts
+	if deadLettered {
+		log.WithContext(ctx).Errorf("dead-lettering %s status for %s after %d attempts", m.State, m.ExternalID, attempts)
+	}
+
+	if _, dberr := o.db.ExecContext(
+		ctx,
+		recordOutboxFailureSQL,
+		m.ID,
+		err.Error(),
+		deadLettered,
+		o.backoff(attempts).Seconds(),
+	); dberr != nil {
+		return dberr
+	}
+
+	return &outboxDeliveryError{err: err}
+}
+
+// RetryPending attempts to deliver all of the queued messages whose next
+// attempt time has passed. Only the oldest message for each analysis is
+// claimed at a time, so the claim is repeated for as long as deliveries
+// succeed.
+func (o *OutboxPublisher) RetryPending(ctx context.Context) error {
+	for {
+		messages := []OutboxMessage{}
+		if err := o.db.SelectContext(ctx, &messages, claimOutboxMessagesSQL, outboxClaimLease.Seconds()); err != nil {
+			return errors.Wrap(err, "error claiming pending outbox messages")
+		}
+
+		delivered := 0
+		for _, m := range messages {
+			if err := o.deliver(ctx, &m); err != nil {
+				log.WithContext(ctx).Error(errors.Wrapf(err, "error delivering outbox message %s", m.ID))
+				continue
+			}
+			delivered++
+		}
+
+		if delivered == 0 {
+			return nil
+		}
+	}
+}
+
+// Run retries delivery of queued status updates until the context is
+// canceled.
+func (o *OutboxPublisher) Run(ctx context.Context) {
+	ticker := time.NewTicker(o.retryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := o.RetryPending(ctx); err != nil {
+				log.WithContext(ctx).Error(err)
+			}
+		}
+	}
+}
+
+const listOutboxMessagesSQL = `
+	SELECT ` + outboxColumns + `
+	  FROM vice_status_outbox
+	 WHERE dead_lettered OR NOT $1
+  ORDER BY created_at ASC
+`
+
+// ListMessages returns the messages in the outbox. Only dead-lettered
+// messages are returned if deadOnly is true.
+func (o *OutboxPublisher) ListMessages(ctx context.Context, deadOnly bool) ([]OutboxMessage, error) {
+	messages := []OutboxMessage{}
+	if err := o.db.SelectContext(ctx, &messages, listOutboxMessagesSQL, deadOnly); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+const getOutboxMessageSQL = `
+	SELECT ` + outboxColumns + `
+	  FROM vice_status_outbox
+	 WHERE id = $1
+`
+
+// claimOutboxMessageSQL claims a single message for a replay. Messages that
+// are currently claimed by a retry worker are left alone.
+const claimOutboxMessageSQL = `
+	UPDATE vice_status_outbox
+	   SET next_attempt_at = now() + $2 * interval '1 second'
+	 WHERE id = $1
+	   AND (dead_lettered OR next_attempt_at <= now())
+	RETURNING ` + outboxColumns
+
+// Replay makes a single delivery attempt for the message with the given ID,
+// regardless of whether or not it has been dead-lettered. Returns
+// sql.ErrNoRows if the message doesn't exist and errOutboxMessageInFlight if a
+// retry worker is currently delivering it.
+func (o *OutboxPublisher) Replay(ctx context.Context, id string) error {
+	m := &OutboxMessage{}
+	err := o.db.GetContext(ctx, m, claimOutboxMessageSQL, id, outboxClaimLease.Seconds())
+	if err == sql.ErrNoRows {
+		if err = o.db.GetContext(ctx, m, getOutboxMessageSQL, id); err != nil {
+			return err
+		}
+		return errOutboxMessageInFlight
+	}
+	if err != nil {
+		return err
+	}
+
+	return o.deliver(ctx, m)
+}
+
+// RunStatusOutbox starts the worker that retries delivery of queued status
+// updates. Blocks until the context is canceled.
+func (i *Internal) RunStatusOutbox(ctx context.Context) {
+	i.outbox.Run(ctx)
+}
+
+// AdminListOutboxHandler lists the status updates waiting in the outbox. Only
+// dead-lettered messages are listed unless the 'all' query parameter is true.
+func (i *Internal) AdminListOutboxHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	all := false
+	if err := echo.QueryParamsBinder(c).Bool("all", &all).BindError(); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	messages, err := i.outbox.ListMessages(ctx, !all)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string][]OutboxMessage{
+		"messages": messages,
+	})
+}
+
+// AdminReplayOutboxHandler attempts to redeliver a single message from the
+// outbox. The message is removed from the outbox if delivery succeeds.
+func (i *Internal) AdminReplayOutboxHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	id := c.Param("id")
+	if id == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "id parameter is empty")
+	}
+
+	if err := i.outbox.Replay(ctx, id); err != nil {
+		var deliveryErr *outboxDeliveryError
+		switch {
+		case err == sql.ErrNoRows:
+			return echo.NewHTTPError(http.StatusNotFound, "outbox message not found")
+		case err == errOutboxMessageInFlight:
+			return echo.NewHTTPError(http.StatusConflict, err.Error())
+		case errors.As(err, &deliveryErr):
+			return echo.NewHTTPError(http.StatusBadGateway, err.Error())
+		default:
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+	}
+
+	return c.NoContent(http.StatusOK)
+}
@@ -0,0 +1,309 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+// setupOutbox returns an *OutboxPublisher backed by a mock database and a
+// stub job-status-listener that responds with the given status code. The
+// returned counter tracks the number of requests the stub received.
+func setupOutbox(t *testing.T, status int) (*OutboxPublisher, sqlmock.Sqlmock, *int32) {
+	t.Helper()
+
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+
+	mockdb, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatalf("error connecting to mock database %s", err)
+	}
+	db := sqlx.NewDb(mockdb, "sqlmock")
+	t.Cleanup(func() { db.Close() })
+
+	o := NewOutboxPublisher(&JSLPublisher{statusURL: srv.URL}, db, 3, 10*time.Second)
+	return o, mock, &hits
+}
+
+func outboxRows() *sqlmock.Rows {
+	return sqlmock.NewRows([]string{
+		"id", "external_id", "state", "message", "attempts", "last_error", "dead_lettered", "created_at", "next_attempt_at",
+	})
+}
+
+func TestOutboxBackoff(t *testing.T) {
+	assert := assert.New(t)
+
+	o := NewOutboxPublisher(&JSLPublisher{}, nil, 0, 10*time.Second)
+
+	assert.Equal(defaultOutboxMaxAttempts, o.maxAttempts)
+	assert.Equal(10*time.Second, o.backoff(1))
+	assert.Equal(20*time.Second, o.backoff(2))
+	assert.Equal(40*time.Second, o.backoff(3))
+	assert.Equal(outboxMaxBackoff, o.backoff(20))
+}
+
+func TestPostStatusErrorCode(t *testing.T) {
+	o, _, hits := setupOutbox(t, http.StatusServiceUnavailable)
+
+	err := o.publisher.postStatus(context.Background(), "job", "msg", "Running")
+	assert.Error(t, err, "a 503 from the job-status-listener should be an error")
+	assert.Equal(t, int32(1), atomic.LoadInt32(hits))
+}
+
+func TestOutboxPublishDelivered(t *testing.T) {
+	assert := assert.New(t)
+	o, mock, hits := setupOutbox(t, http.StatusOK)
+
+	mock.ExpectQuery(hasPendingOutboxMessagesSQL).
+		WithArgs("job").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+
+	assert.NoError(o.Running(context.Background(), "job", "msg"))
+	assert.Equal(int32(1), atomic.LoadInt32(hits))
+	assert.NoError(mock.ExpectationsWereMet(), "expectations were not met")
+}
+
+func TestOutboxPublishQueuesOnFailure(t *testing.T) {
+	assert := assert.New(t)
+	o, mock, hits := setupOutbox(t, http.StatusServiceUnavailable)
+
+	mock.ExpectQuery(hasPendingOutboxMessagesSQL).
+		WithArgs("job").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectExec(insertOutboxMessageSQL).
+		WithArgs("job", "Completed", "msg", 1, sqlmock.AnyArg(), float64(10)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	assert.NoError(o.Success(context.Background(), "job", "msg"))
+	assert.Equal(int32(1), atomic.LoadInt32(hits))
+	assert.NoError(mock.ExpectationsWereMet(), "expectations were not met")
+}
+
+func TestOutboxPublishQueuesWithCanceledContext(t *testing.T) {
+	assert := assert.New(t)
+	o, mock, _ := setupOutbox(t, http.StatusOK)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	mock.ExpectQuery(hasPendingOutboxMessagesSQL).
+		WithArgs("job").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectExec(insertOutboxMessageSQL).
+		WithArgs("job", "Failed", "msg", 1, sqlmock.AnyArg(), float64(10)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	assert.NoError(o.Fail(ctx, "job", "msg"))
+	assert.NoError(mock.ExpectationsWereMet(), "expectations were not met")
+}
+
+func TestOutboxPublishQueuesBehindPending(t *testing.T) {
+	assert := assert.New(t)
+	o, mock, hits := setupOutbox(t, http.StatusOK)
+
+	mock.ExpectQuery(hasPendingOutboxMessagesSQL).
+		WithArgs("job").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectExec(insertOutboxMessageSQL).
+		WithArgs("job", "Completed", "msg", 0, nil, 0).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	assert.NoError(o.Success(context.Background(), "job", "msg"))
+	assert.Equal(int32(0), atomic.LoadInt32(hits), "the update should not be sent ahead of pending updates")
+	assert.NoError(mock.ExpectationsWereMet(), "expectations were not met")
+}
+
+func TestOutboxDeliverDeletesOnSuccess(t *testing.T) {
+	assert := assert.New(t)
+	o, mock, _ := setupOutbox(t, http.StatusOK)
+
+	mock.ExpectExec(deleteOutboxMessageSQL).
+		WithArgs("1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	m := &OutboxMessage{ID: "1", ExternalID: "job", State: "Running", Attempts: 1}
+	assert.NoError(o.deliver(context.Background(), m))
+	assert.NoError(mock.ExpectationsWereMet(), "expectations were not met")
+}
+
+func TestOutboxDeliverRecordsFailure(t *testing.T) {
+	assert := assert.New(t)
+	o, mock, _ := setupOutbox(t, http.StatusServiceUnavailable)
+
+	mock.ExpectExec(recordOutboxFailureSQL).
+		WithArgs("1", sqlmock.AnyArg(), false, float64(20)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	m := &OutboxMessage{ID: "1", ExternalID: "job", State: "Running", Attempts: 1}
+	err := o.deliver(context.Background(), m)
+	var deliveryErr *outboxDeliveryError
+	assert.ErrorAs(err, &deliveryErr)
+	assert.NoError(mock.ExpectationsWereMet(), "expectations were not met")
+}
+
+func TestOutboxDeliverDeadLetters(t *testing.T) {
+	assert := assert.New(t)
+	o, mock, _ := setupOutbox(t, http.StatusServiceUnavailable)
+
+	mock.ExpectExec(recordOutboxFailureSQL).
+		WithArgs("1", sqlmock.AnyArg(), true, float64(40)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	m := &OutboxMessage{ID: "1", ExternalID: "job", State: "Running", Attempts: 2}
+	assert.Error(o.deliver(context.Background(), m))
+	assert.NoError(mock.ExpectationsWereMet(), "expectations were not met")
+}
+
+func TestOutboxRetryPending(t *testing.T) {
+	assert := assert.New(t)
+	o, mock, hits := setupOutbox(t, http.StatusOK)
+
+	now := time.Now()
+	mock.ExpectQuery(claimOutboxMessagesSQL).
+		WithArgs(outboxClaimLease.Seconds()).
+		WillReturnRows(outboxRows().AddRow("1", "job", "Running", "msg", 1, nil, false, now, now))
+	mock.ExpectExec(deleteOutboxMessageSQL).
+		WithArgs("1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(claimOutboxMessagesSQL).
+		WithArgs(outboxClaimLease.Seconds()).
+		WillReturnRows(outboxRows())
+
+	assert.NoError(o.RetryPending(context.Background()))
+	assert.Equal(int32(1), atomic.LoadInt32(hits))
+	assert.NoError(mock.ExpectationsWereMet(), "expectations were not met")
+}
+
+func TestOutboxListMessages(t *testing.T) {
+	assert := assert.New(t)
+	o, mock, _ := setupOutbox(t, http.StatusOK)
+
+	now := time.Now()
+	mock.ExpectQuery(listOutboxMessagesSQL).
+		WithArgs(true).
+		WillReturnRows(outboxRows().AddRow("1", "job", "Running", "msg", 3, "oops", true, now, now))
+
+	messages, err := o.ListMessages(context.Background(), true)
+	assert.NoError(err)
+	assert.Len(messages, 1)
+	assert.True(messages[0].DeadLettered)
+	assert.NoError(mock.ExpectationsWereMet(), "expectations were not met")
+}
+
+func TestOutboxReplay(t *testing.T) {
+	assert := assert.New(t)
+	o, mock, hits := setupOutbox(t, http.StatusOK)
+
+	now := time.Now()
+	mock.ExpectQuery(claimOutboxMessageSQL).
+		WithArgs("1", outboxClaimLease.Seconds()).
+		WillReturnRows(outboxRows().AddRow("1", "job", "Running", "msg", 3, "oops", true, now, now))
+	mock.ExpectExec(deleteOutboxMessageSQL).
+		WithArgs("1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	assert.NoError(o.Replay(context.Background(), "1"))
+	assert.Equal(int32(1), atomic.LoadInt32(hits))
+	assert.NoError(mock.ExpectationsWereMet(), "expectations were not met")
+}
+
+func TestOutboxReplayNotFound(t *testing.T) {
+	assert := assert.New(t)
+	o, mock, _ := setupOutbox(t, http.StatusOK)
+
+	mock.ExpectQuery(claimOutboxMessageSQL).
+		WithArgs("1", outboxClaimLease.Seconds()).
+		WillReturnRows(outboxRows())
+	mock.ExpectQuery(getOutboxMessageSQL).
+		WithArgs("1").
+		WillReturnRows(outboxRows())
+
+	assert.Equal(sql.ErrNoRows, o.Replay(context.Background(), "1"))
+	assert.NoError(mock.ExpectationsWereMet(), "expectations were not met")
+}
+
+func TestAdminReplayOutboxHandler(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name     string
+		status   int
+		setup    func(mock sqlmock.Sqlmock)
+		expected int
+	}{
+		{
+			name:   "not found",
+			status: http.StatusOK,
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(claimOutboxMessageSQL).WillReturnRows(outboxRows())
+				mock.ExpectQuery(getOutboxMessageSQL).WillReturnRows(outboxRows())
+			},
+			expected: http.StatusNotFound,
+		},
+		{
+			name:   "in flight",
+			status: http.StatusOK,
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(claimOutboxMessageSQL).WillReturnRows(outboxRows())
+				mock.ExpectQuery(getOutboxMessageSQL).
+					WillReturnRows(outboxRows().AddRow("1", "job", "Running", "msg", 1, nil, false, now, now))
+			},
+			expected: http.StatusConflict,
+		},
+		{
+			name:   "upstream failure",
+			status: http.StatusServiceUnavailable,
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(claimOutboxMessageSQL).
+					WillReturnRows(outboxRows().AddRow("1", "job", "Running", "msg", 3, nil, true, now, now))
+				mock.ExpectExec(recordOutboxFailureSQL).WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			expected: http.StatusBadGateway,
+		},
+		{
+			name:   "database failure",
+			status: http.StatusOK,
+			setup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(claimOutboxMessageSQL).WillReturnError(sql.ErrConnDone)
+			},
+			expected: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, mock, _ := setupOutbox(t, tt.status)
+			tt.setup(mock)
+
+			i := &Internal{outbox: o}
+			e := echo.New()
+			req := httptest.NewRequest(http.MethodPost, "/", nil)
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+			c.SetParamNames("id")
+			c.SetParamValues("1")
+
+			err := i.AdminReplayOutboxHandler(c)
+			httpErr, ok := err.(*echo.HTTPError)
+			if assert.True(t, ok, "expected an *echo.HTTPError") {
+				assert.Equal(t, tt.expected, httpErr.Code)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet(), "expectations were not met")
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/cyverse-de/model/v6"
+	policyv1 "k8s.io/api/policy/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// podDisruptionBudgetName returns the name of the PodDisruptionBudget for the
+// analysis.
+func podDisruptionBudgetName(job *model.Job) string {
+	return fmt.Sprintf("vice-pdb-%s", job.InvocationID)
+}
+
+// createPDB returns true if a PodDisruptionBudget should be created for the
+// analysis. The tool settings take precedence over the service-wide default.
+func (i *Internal) createPDB(settings *ToolSettings) bool {
+	if settings.CreatePDB != nil {
+		return *settings.CreatePDB
+	}
+	return i.CreatePDBs
+}
+
+// getPodDisruptionBudget returns the PodDisruptionBudget for the analysis, or
+// nil if the analysis shouldn't have one. This does NOT call the k8s API to
+// actually create the PodDisruptionBudget.
+func (i *Internal) getPodDisruptionBudget(ctx context.Context, job *model.Job, settings *ToolSettings) (*policyv1.PodDisruptionBudget, error) {
+	if !i.createPDB(settings) {
+		return nil, nil
+	}
+
+	labels, err := i.labelsFromJob(ctx, job)
+	if err != nil {
+		return nil, err
+	}
+
+	maxUnavailable := 0
+	if settings.PDBMaxUnavailable != nil {
+		maxUnavailable = *settings.PDBMaxUnavailable
+	}
+	maxUnavailableValue := intstr.FromInt(maxUnavailable)
+
+	return &policyv1.PodDisruptionBudget{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   podDisruptionBudgetName(job),
+			Labels: labels,
+		},
+		Spec: policyv1.PodDisruptionBudgetSpec{
+			MaxUnavailable: &maxUnavailableValue,
+			Selector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{
+					"external-id": job.InvocationID,
+				},
+			},
+		},
+	}, nil
+}
+
+// UpsertPodDisruptionBudget uses the Job passed in to assemble the
+// PodDisruptionBudget for the analysis. It then calls the k8s API to create
+// the PodDisruptionBudget if it does not already exist or to update it if it
+// does. Nothing is created if the analysis shouldn't have one.
+func (i *Internal) UpsertPodDisruptionBudget(ctx context.Context, job *model.Job, settings *ToolSettings) (err error) {
+	ctx, span := startResourceSpan(ctx, "UpsertPodDisruptionBudget", "poddisruptionbudget")
+	defer func() { recordUpsertError("poddisruptionbudget", err); endSpan(span, err) }()
+
+	pdb, err := i.getPodDisruptionBudget(ctx, job, settings)
+	if err != nil {
+		return err
+	}
+	if pdb == nil {
+		return nil
+	}
+
+	pdbclient := i.clientset.PolicyV1().PodDisruptionBudgets(i.ViceNamespace)
+
+	existing, err := pdbclient.Get(ctx, pdb.Name, metav1.GetOptions{})
+	if err != nil {
+		_, err = pdbclient.Create(ctx, pdb, metav1.CreateOptions{})
+		if err != nil {
+			return err
+		}
+	} else {
+		pdb.ResourceVersion = existing.ResourceVersion
+		_, err = pdbclient.Update(ctx, pdb, metav1.UpdateOptions{})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,37 @@
+package internal
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cyverse-de/model/v6"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestCreatePDB(t *testing.T) {
+	assert := assert.New(t)
+
+	enabled, disabled := true, false
+
+	i := &Internal{Init: Init{CreatePDBs: true}}
+	assert.True(i.createPDB(&ToolSettings{}))
+	assert.False(i.createPDB(&ToolSettings{CreatePDB: &disabled}))
+
+	i = &Internal{Init: Init{CreatePDBs: false}}
+	assert.False(i.createPDB(&ToolSettings{}))
+	assert.True(i.createPDB(&ToolSettings{CreatePDB: &enabled}))
+}
+
+func TestUpsertPodDisruptionBudgetDisabled(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	i := &Internal{Init: Init{ViceNamespace: "vice-apps"}, clientset: clientset}
+
+	job := &model.Job{InvocationID: "a"}
+	assert.NoError(t, i.UpsertPodDisruptionBudget(context.Background(), job, &ToolSettings{}))
+
+	pdbs, err := clientset.PolicyV1().PodDisruptionBudgets("vice-apps").List(context.Background(), metav1.ListOptions{})
+	assert.NoError(t, err)
+	assert.Empty(t, pdbs.Items)
+}
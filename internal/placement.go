@@ -0,0 +1,257 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// The sources of users' placements.
+const (
+	// placementLearned is recorded for placements taken from the node the
+	// user's most recent analysis ran on.
+	placementLearned = "learned"
+
+	// placementAdmin is recorded for placements set by an administrator.
+	// They're never replaced by learned placements.
+	placementAdmin = "admin"
+)
+
+// PlacementConfig contains the settings for sticky per-user placement, which
+// prefers scheduling a user's analyses in the same topology domain, such as a
+// zone, as their previous analysis, where their volumes and cached images
+// already are.
+type PlacementConfig struct {
+	Enabled bool
+
+	// TopologyKey is the node label whose value identifies the domain, for
+	// example topology.kubernetes.io/zone.
+	TopologyKey string
+
+	// Weight is the weight of the preferred node affinity term, from 1 to
+	// 100.
+	Weight int32
+}
+
+// Validate returns an error if the configuration can't be used.
+func (c *PlacementConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.TopologyKey == "" {
+		return fmt.Errorf("the sticky placement topology key must be set")
+	}
+	if c.Weight < 1 || c.Weight > 100 {
+		return fmt.Errorf("the sticky placement weight must be between 1 and 100")
+	}
+	return nil
+}
+
+// UserPlacement is the topology domain a user's analyses prefer.
+type UserPlacement struct {
+	UserID    string    `json:"user_id" db:"user_id"`
+	Domain    string    `json:"domain" db:"domain"`
+	Source    string    `json:"source" db:"source"`
+	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+}
+
+const getUserPlacementSQL = `
+	SELECT user_id, domain, source, updated_at
+	  FROM vice_user_placements
+	 WHERE user_id = $1
+`
+
+// getUserPlacement returns the user's placement, or nil if they don't have
+// one.
+func (i *Internal) getUserPlacement(ctx context.Context, userID string) (*UserPlacement, error) {
+	placement := &UserPlacement{}
+	err := i.db.GetContext(ctx, placement, getUserPlacementSQL, userID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "error looking up the placement for user %s", userID)
+	}
+	return placement, nil
+}
+
+// placementAffinity returns the preferred node affinity term for the user's
+// placement, or nil if sticky placement is disabled or the user doesn't have
+// a placement yet.
+func (i *Internal) placementAffinity(ctx context.Context, userID string) ([]apiv1.PreferredSchedulingTerm, error) {
+	if !i.Placement.Enabled || userID == "" {
+		return nil, nil
+	}
+
+	placement, err := i.getUserPlacement(ctx, userID)
+	if err != nil || placement == nil {
+		return nil, err
+	}
+
+	return []apiv1.PreferredSchedulingTerm{
+		{
+			Weight: i.Placement.Weight,
+			Preference: apiv1.NodeSelectorTerm{
+				MatchExpressions: []apiv1.NodeSelectorRequirement{
+					{
+						Key:      i.Placement.TopologyKey,
+						Operator: apiv1.NodeSelectorOpIn,
+						Values:   []string{placement.Domain},
+					},
+				},
+			},
+		},
+	}, nil
+}
+
+// Learned placements never replace placements set by an administrator.
+const learnUserPlacementSQL = `
+	INSERT INTO vice_user_placements (user_id, domain, source)
+	VALUES ($1, $2, 'learned')
+	ON CONFLICT (user_id) DO UPDATE
+	   SET domain = EXCLUDED.domain,
+	       updated_at = now()
+	 WHERE vice_user_placements.source = 'learned'
+`
+
+// learnPlacement records the topology domain of the node the analysis's pod
+// is running on as its user's placement. Called before the analysis's pods
+// are deleted.
+func (i *Internal) learnPlacement(ctx context.Context, externalID string) error {
+	if !i.Placement.Enabled {
+		return nil
+	}
+
+	set := labels.Set(map[string]string{
+		"external-id": externalID,
+	})
+	pods, err := i.clientset.CoreV1().Pods(i.ViceNamespace).List(ctx, metav1.ListOptions{
+		LabelSelector: set.AsSelector().String(),
+	})
+	if err != nil {
+		return errors.Wrapf(err, "unable to list the pods for %s", externalID)
+	}
+
+	for _, pod := range pods.Items {
+		userID := pod.Labels["user-id"]
+		if pod.Spec.NodeName == "" || userID == "" {
+			continue
+		}
+
+		node, err := i.clientset.CoreV1().Nodes().Get(ctx, pod.Spec.NodeName, metav1.GetOptions{})
+		if err != nil {
+			return errors.Wrapf(err, "unable to look up node %s", pod.Spec.NodeName)
+		}
+
+		domain := node.Labels[i.Placement.TopologyKey]
+		if domain == "" {
+			continue
+		}
+
+		if _, err = i.db.ExecContext(ctx, learnUserPlacementSQL, userID, domain); err != nil {
+			return errors.Wrapf(err, "unable to record the placement for user %s", userID)
+		}
+		return nil
+	}
+
+	return nil
+}
+
+// placementUserID returns the UUID of the user named in the request.
+func (i *Internal) placementUserID(c echo.Context) (string, error) {
+	username := c.Param("username")
+	if username == "" {
+		return "", echo.NewHTTPError(http.StatusBadRequest, "username parameter is empty")
+	}
+
+	userID, err := i.apps.GetUserID(c.Request().Context(), i.fixUsername(username))
+	if err == sql.ErrNoRows {
+		return "", echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("user %s not found", username))
+	}
+	return userID, err
+}
+
+// AdminGetUserPlacementHandler returns the user's placement.
+func (i *Internal) AdminGetUserPlacementHandler(c echo.Context) error {
+	userID, err := i.placementUserID(c)
+	if err != nil {
+		return err
+	}
+
+	placement, err := i.getUserPlacement(c.Request().Context(), userID)
+	if err != nil {
+		return err
+	}
+	if placement == nil {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("user %s has no placement", c.Param("username")))
+	}
+
+	return c.JSON(http.StatusOK, placement)
+}
+
+const setUserPlacementSQL = `
+	INSERT INTO vice_user_placements (user_id, domain, source)
+	VALUES ($1, $2, 'admin')
+	ON CONFLICT (user_id) DO UPDATE
+	   SET domain = EXCLUDED.domain,
+	       source = EXCLUDED.source,
+	       updated_at = now()
+	RETURNING user_id, domain, source, updated_at
+`
+
+// AdminSetUserPlacementHandler pins the user's analyses to a topology domain.
+// The placement is never replaced by the domains the user's analyses run in.
+func (i *Internal) AdminSetUserPlacementHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID, err := i.placementUserID(c)
+	if err != nil {
+		return err
+	}
+
+	var body struct {
+		Domain string `json:"domain"`
+	}
+	if err = json.NewDecoder(c.Request().Body).Decode(&body); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if body.Domain == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "domain must be set")
+	}
+
+	placement := &UserPlacement{}
+	if err = i.db.GetContext(ctx, placement, setUserPlacementSQL, userID, body.Domain); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, placement)
+}
+
+const deleteUserPlacementSQL = `
+	DELETE FROM vice_user_placements WHERE user_id = $1
+`
+
+// AdminDeleteUserPlacementHandler removes the user's placement, whether it
+// was learned or set by an administrator. The next analysis the user exits
+// sets a new learned placement.
+func (i *Internal) AdminDeleteUserPlacementHandler(c echo.Context) error {
+	userID, err := i.placementUserID(c)
+	if err != nil {
+		return err
+	}
+
+	if _, err = i.db.ExecContext(c.Request().Context(), deleteUserPlacementSQL, userID); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusOK)
+}
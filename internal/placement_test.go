@@ -0,0 +1,152 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cyverse-de/app-exposer/apps"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func testPlacementConfig() PlacementConfig {
+	return PlacementConfig{Enabled: true, TopologyKey: "topology.kubernetes.io/zone", Weight: 50}
+}
+
+func TestPlacementConfigValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError((&PlacementConfig{}).Validate())
+	config := testPlacementConfig()
+	assert.NoError(config.Validate())
+	assert.Error((&PlacementConfig{Enabled: true, Weight: 50}).Validate())
+	assert.Error((&PlacementConfig{Enabled: true, TopologyKey: "zone", Weight: 101}).Validate())
+}
+
+func TestPlacementAffinity(t *testing.T) {
+	assert := assert.New(t)
+
+	mockdb, mock, err := sqlmock.New()
+	assert.NoError(err)
+	defer mockdb.Close()
+
+	i := &Internal{db: sqlx.NewDb(mockdb, "sqlmock")}
+
+	// Nothing is looked up while sticky placement is disabled.
+	terms, err := i.placementAffinity(context.Background(), "u1")
+	assert.NoError(err)
+	assert.Nil(terms)
+
+	i.Placement = testPlacementConfig()
+	columns := []string{"user_id", "domain", "source", "updated_at"}
+	mock.ExpectQuery(regexp.QuoteMeta("FROM vice_user_placements")).
+		WithArgs("u1").
+		WillReturnRows(sqlmock.NewRows(columns).AddRow("u1", "us-west-1a", placementLearned, time.Now()))
+	mock.ExpectQuery(regexp.QuoteMeta("FROM vice_user_placements")).
+		WithArgs("u2").
+		WillReturnRows(sqlmock.NewRows(columns))
+
+	terms, err = i.placementAffinity(context.Background(), "u1")
+	assert.NoError(err)
+	if assert.Len(terms, 1) {
+		assert.Equal(int32(50), terms[0].Weight)
+		assert.Equal([]string{"us-west-1a"}, terms[0].Preference.MatchExpressions[0].Values)
+	}
+
+	terms, err = i.placementAffinity(context.Background(), "u2")
+	assert.NoError(err)
+	assert.Nil(terms)
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestLearnPlacement(t *testing.T) {
+	assert := assert.New(t)
+
+	mockdb, mock, err := sqlmock.New()
+	assert.NoError(err)
+	defer mockdb.Close()
+
+	clientset := fake.NewSimpleClientset(
+		&apiv1.Node{ObjectMeta: metav1.ObjectMeta{
+			Name:   "node-1",
+			Labels: map[string]string{"topology.kubernetes.io/zone": "us-west-1b"},
+		}},
+		&apiv1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "e1-pod",
+				Namespace: "vice-apps",
+				Labels:    map[string]string{"external-id": "e1", "user-id": "u1"},
+			},
+			Spec: apiv1.PodSpec{NodeName: "node-1"},
+		},
+	)
+	i := &Internal{
+		Init:      Init{ViceNamespace: "vice-apps", Placement: testPlacementConfig()},
+		clientset: clientset,
+		db:        sqlx.NewDb(mockdb, "sqlmock"),
+	}
+
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO vice_user_placements")).
+		WithArgs("u1", "us-west-1b").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	assert.NoError(i.learnPlacement(context.Background(), "e1"))
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestAdminSetUserPlacementHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	mockdb, mock, err := sqlmock.New()
+	assert.NoError(err)
+	defer mockdb.Close()
+
+	db := sqlx.NewDb(mockdb, "sqlmock")
+	i := &Internal{
+		Init: Init{UserSuffix: "@example.org"},
+		db:   db,
+		apps: apps.NewApps(db, "@example.org"),
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta("FROM users u")).
+		WithArgs("ipctest@example.org").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("u1"))
+	mock.ExpectQuery(regexp.QuoteMeta("INSERT INTO vice_user_placements")).
+		WithArgs("u1", "us-west-1c").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "domain", "source", "updated_at"}).
+			AddRow("u1", "us-west-1c", placementAdmin, time.Now()))
+
+	req := httptest.NewRequest(http.MethodPut, "/", strings.NewReader(`{"domain":"us-west-1c"}`))
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+	c.SetParamNames("username")
+	c.SetParamValues("ipctest")
+
+	assert.NoError(i.AdminSetUserPlacementHandler(c))
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Contains(rec.Body.String(), `"source":"admin"`)
+	assert.NoError(mock.ExpectationsWereMet())
+
+	req = httptest.NewRequest(http.MethodPut, "/", strings.NewReader(`{}`))
+	c = echo.New().NewContext(req, httptest.NewRecorder())
+	c.SetParamNames("username")
+	c.SetParamValues("ipctest")
+	mock.ExpectQuery(regexp.QuoteMeta("FROM users u")).
+		WithArgs("ipctest@example.org").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("u1"))
+	err = i.AdminSetUserPlacementHandler(c)
+	if assert.Error(err) {
+		assert.Equal(http.StatusBadRequest, err.(*echo.HTTPError).Code)
+	}
+}
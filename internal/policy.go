@@ -0,0 +1,184 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"time"
+
+	"github.com/cyverse-de/model/v6"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+)
+
+// defaultPolicyTimeout is how long app-exposer waits for the policy service
+// when the configuration doesn't say.
+const defaultPolicyTimeout = 10 * time.Second
+
+// PolicyConfig contains the settings for the external policy service.
+type PolicyConfig struct {
+	// URL is the endpoint that reviews launches. No policy service is called
+	// if it's empty.
+	URL string
+
+	// Timeout limits how long a review may take.
+	Timeout time.Duration
+
+	// FailOpen allows launches to continue when the policy service can't be
+	// reached or returns an error. Launches fail otherwise.
+	FailOpen bool
+}
+
+// DeploymentPolicy is the interface for types that review the Deployment
+// generated for an analysis before it's created. Implementations may return
+// a modified copy of the Deployment or reject the launch.
+type DeploymentPolicy interface {
+	Review(ctx context.Context, job *model.Job, deployment *appsv1.Deployment) (*appsv1.Deployment, error)
+}
+
+// PolicyRejection is returned by a DeploymentPolicy that doesn't allow the
+// analysis to launch.
+type PolicyRejection struct {
+	Reason string
+}
+
+func (r *PolicyRejection) Error() string {
+	return fmt.Sprintf("the launch was rejected by the policy service: %s", r.Reason)
+}
+
+// PolicyReview is the request body sent to the policy service.
+type PolicyReview struct {
+	Job        *model.Job         `json:"job"`
+	Deployment *appsv1.Deployment `json:"deployment"`
+}
+
+// PolicyReviewResponse is the response body returned by the policy service.
+// The Deployment is only needed if the policy service changed it.
+type PolicyReviewResponse struct {
+	Allowed    bool               `json:"allowed"`
+	Reason     string             `json:"reason,omitempty"`
+	Deployment *appsv1.Deployment `json:"deployment,omitempty"`
+}
+
+// WebhookPolicy is a DeploymentPolicy that posts the Deployment to an
+// external policy service, similar to a k8s admission webhook.
+type WebhookPolicy struct {
+	url    string
+	client *http.Client
+}
+
+// NewWebhookPolicy returns a *WebhookPolicy for the configuration.
+func NewWebhookPolicy(cfg *PolicyConfig) *WebhookPolicy {
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = defaultPolicyTimeout
+	}
+
+	return &WebhookPolicy{
+		url: cfg.URL,
+		client: &http.Client{
+			Transport: httpClient.Transport,
+			Timeout:   timeout,
+		},
+	}
+}
+
+// Review sends the job and Deployment to the policy service and returns the
+// Deployment it approved.
+func (w *WebhookPolicy) Review(ctx context.Context, job *model.Job, deployment *appsv1.Deployment) (*appsv1.Deployment, error) {
+	body, err := json.Marshal(&PolicyReview{Job: job, Deployment: deployment})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error marshalling the policy review for %s", job.InvocationID)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error creating the policy review request for %s", job.InvocationID)
+	}
+	req.Header.Set("content-type", "application/json")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error calling the policy service for %s", job.InvocationID)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading the policy service response for %s", job.InvocationID)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("the policy service returned %d for %s: %s", resp.StatusCode, job.InvocationID, string(respBody))
+	}
+
+	review := &PolicyReviewResponse{}
+	if err = json.Unmarshal(respBody, review); err != nil {
+		return nil, errors.Wrapf(err, "error parsing the policy service response for %s", job.InvocationID)
+	}
+
+	if !review.Allowed {
+		return nil, &PolicyRejection{Reason: review.Reason}
+	}
+
+	if review.Deployment == nil {
+		return deployment, nil
+	}
+
+	if err = validatePolicyMutation(deployment, review.Deployment); err != nil {
+		return nil, err
+	}
+
+	return review.Deployment, nil
+}
+
+// validatePolicyMutation makes sure the policy service didn't change the
+// parts of the Deployment that the rest of app-exposer uses to find the
+// analysis.
+func validatePolicyMutation(original, mutated *appsv1.Deployment) error {
+	if mutated.Name != original.Name || mutated.Namespace != original.Namespace {
+		return fmt.Errorf("the policy service may not rename the deployment %s", original.Name)
+	}
+	if !reflect.DeepEqual(mutated.Spec.Selector, original.Spec.Selector) {
+		return fmt.Errorf("the policy service may not change the selector of the deployment %s", original.Name)
+	}
+	for _, key := range []string{"external-id", "app-type"} {
+		if mutated.Labels[key] != original.Labels[key] || mutated.Spec.Template.Labels[key] != original.Spec.Template.Labels[key] {
+			return fmt.Errorf("the policy service may not change the %s label of the deployment %s", key, original.Name)
+		}
+	}
+	return nil
+}
+
+// applyDeploymentPolicy has the policy service, if one is configured, review
+// the Deployment for the analysis. Returns the Deployment to create.
+func (i *Internal) applyDeploymentPolicy(ctx context.Context, job *model.Job, deployment *appsv1.Deployment) (result *appsv1.Deployment, err error) {
+	if i.policy == nil {
+		return deployment, nil
+	}
+
+	ctx, span := startSpan(ctx, "applyDeploymentPolicy")
+	defer func() { endSpan(span, err) }()
+
+	result, err = i.policy.Review(ctx, job, deployment)
+	if err == nil {
+		return result, nil
+	}
+
+	var rejection *PolicyRejection
+	if errors.As(err, &rejection) {
+		return nil, echo.NewHTTPError(http.StatusForbidden, rejection.Error())
+	}
+
+	if i.Policy.FailOpen {
+		log.WithContext(ctx).Errorf("continuing without the policy review: %s", err)
+		return deployment, nil
+	}
+
+	return nil, err
+}
@@ -0,0 +1,124 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cyverse-de/model/v6"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func policyTestDeployment() *appsv1.Deployment {
+	labels := map[string]string{"external-id": "a1234", "app-type": "interactive"}
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "a1234", Labels: labels},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{"external-id": "a1234"},
+			},
+		},
+	}
+	deployment.Spec.Template.Labels = labels
+	return deployment
+}
+
+func policyServer(t *testing.T, handler func(review *PolicyReview) (int, *PolicyReviewResponse)) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		review := &PolicyReview{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(review))
+		status, resp := handler(review)
+		w.WriteHeader(status)
+		assert.NoError(t, json.NewEncoder(w).Encode(resp))
+	}))
+}
+
+func TestWebhookPolicyMutation(t *testing.T) {
+	assert := assert.New(t)
+
+	server := policyServer(t, func(review *PolicyReview) (int, *PolicyReviewResponse) {
+		deployment := review.Deployment
+		deployment.Spec.Template.Spec.PriorityClassName = "research"
+		return http.StatusOK, &PolicyReviewResponse{Allowed: true, Deployment: deployment}
+	})
+	defer server.Close()
+
+	policy := NewWebhookPolicy(&PolicyConfig{URL: server.URL})
+	result, err := policy.Review(context.Background(), &model.Job{InvocationID: "a1234"}, policyTestDeployment())
+	assert.NoError(err)
+	assert.Equal("research", result.Spec.Template.Spec.PriorityClassName)
+}
+
+func TestWebhookPolicyRejectsRelabeling(t *testing.T) {
+	server := policyServer(t, func(review *PolicyReview) (int, *PolicyReviewResponse) {
+		deployment := review.Deployment
+		deployment.Labels = map[string]string{"external-id": "b5678"}
+		return http.StatusOK, &PolicyReviewResponse{Allowed: true, Deployment: deployment}
+	})
+	defer server.Close()
+
+	policy := NewWebhookPolicy(&PolicyConfig{URL: server.URL})
+	_, err := policy.Review(context.Background(), &model.Job{InvocationID: "a1234"}, policyTestDeployment())
+	assert.Error(t, err)
+}
+
+func TestApplyDeploymentPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	allowed := true
+	server := policyServer(t, func(review *PolicyReview) (int, *PolicyReviewResponse) {
+		if !allowed {
+			return http.StatusOK, &PolicyReviewResponse{Reason: "GPUs require approval"}
+		}
+		return http.StatusOK, &PolicyReviewResponse{Allowed: true}
+	})
+	defer server.Close()
+
+	job := &model.Job{InvocationID: "a1234"}
+	original := policyTestDeployment()
+
+	// The Deployment is used as-is when no policy service is configured.
+	i := &Internal{}
+	result, err := i.applyDeploymentPolicy(context.Background(), job, original)
+	assert.NoError(err)
+	assert.Same(original, result)
+
+	i.policy = NewWebhookPolicy(&PolicyConfig{URL: server.URL})
+	result, err = i.applyDeploymentPolicy(context.Background(), job, original)
+	assert.NoError(err)
+	assert.Same(original, result)
+
+	allowed = false
+	_, err = i.applyDeploymentPolicy(context.Background(), job, original)
+	if assert.Error(err) {
+		assert.Equal(http.StatusForbidden, err.(*echo.HTTPError).Code)
+		assert.Contains(err.Error(), "GPUs require approval")
+	}
+}
+
+func TestApplyDeploymentPolicyFailOpen(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	job := &model.Job{InvocationID: "a1234"}
+	original := policyTestDeployment()
+
+	i := &Internal{}
+	i.policy = NewWebhookPolicy(&PolicyConfig{URL: server.URL})
+	_, err := i.applyDeploymentPolicy(context.Background(), job, original)
+	assert.Error(err)
+
+	i.Policy.FailOpen = true
+	result, err := i.applyDeploymentPolicy(context.Background(), job, original)
+	assert.NoError(err)
+	assert.Same(original, result)
+}
@@ -0,0 +1,507 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/cyverse-de/app-exposer/apps"
+	"github.com/cyverse-de/app-exposer/permissions"
+	"github.com/cyverse-de/model/v6"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// provenanceSchemaVersion is the version of the provenance manifest format.
+// It changes whenever fields are removed or change meaning.
+const provenanceSchemaVersion = 1
+
+const (
+	// provenanceChecksumTimeout limits how long the input checksums may take
+	// to compute. Inputs that aren't done in time are tried again the next
+	// time the manifest is deposited.
+	provenanceChecksumTimeout = 2 * time.Minute
+
+	// maxDepositedProvenanceBytes limits the size of the manifest written to
+	// the working directory. It's passed as a command-line argument, which
+	// can't be longer than 128 KiB.
+	maxDepositedProvenanceBytes = 96 << 10
+)
+
+// ProvenanceConfig contains the settings for recording provenance manifests
+// for analyses.
+type ProvenanceConfig struct {
+	Enabled bool
+
+	// ClusterName identifies the cluster the analyses run in.
+	ClusterName string
+
+	// FileName is the name of the manifest deposited with the outputs.
+	FileName string
+}
+
+// Validate returns an error if the configuration can't be used.
+func (c *ProvenanceConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.FileName == "" {
+		return fmt.Errorf("the provenance file name must be set")
+	}
+	if strings.Contains(c.FileName, "/") || c.FileName == "." || c.FileName == ".." {
+		return fmt.Errorf("the provenance file name must be a plain file name, got %q", c.FileName)
+	}
+	return nil
+}
+
+// ProvenanceTool describes the tool an analysis step ran.
+type ProvenanceTool struct {
+	Name  string `json:"name"`
+	Image string `json:"image"`
+
+	// ImageDigest is the digest of the image that was pulled, such as
+	// sha256:9f86d0.... It's empty until the analysis's pod has started
+	// unless the image was pinned to a digest.
+	ImageDigest string `json:"image_digest,omitempty"`
+}
+
+// ProvenanceParameter is a parameter value an analysis step ran with.
+type ProvenanceParameter struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	Type  string `json:"type"`
+}
+
+// ProvenanceInput is an input file or folder of an analysis.
+type ProvenanceInput struct {
+	ID           string `json:"id"`
+	Path         string `json:"path"`
+	Type         string `json:"type"`
+	Multiplicity string `json:"multiplicity"`
+
+	// Checksum is the SHA-256 checksum of the downloaded file, such as
+	// sha256:9f86d0.... It's empty for folders and for files that haven't
+	// been downloaded.
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// ProvenanceResources lists the resources requested for the analysis
+// container, as k8s quantities keyed by resource name.
+type ProvenanceResources struct {
+	Requests map[string]string `json:"requests"`
+	Limits   map[string]string `json:"limits"`
+}
+
+// ProvenanceManifest describes how an analysis was run, so that its results
+// can be reproduced.
+type ProvenanceManifest struct {
+	SchemaVersion int    `json:"schema_version"`
+	AnalysisID    string `json:"analysis_id,omitempty"`
+	ExternalID    string `json:"external_id"`
+	AnalysisName  string `json:"analysis_name"`
+	Submitter     string `json:"submitter"`
+	AppID         string `json:"app_id"`
+	AppName       string `json:"app_name"`
+
+	// AppVersion is the version of the app from the launch request. The job
+	// submission doesn't include it.
+	AppVersion string `json:"app_version,omitempty"`
+
+	Cluster    string                `json:"cluster,omitempty"`
+	Namespace  string                `json:"namespace"`
+	OutputDir  string                `json:"output_dir"`
+	Tools      []ProvenanceTool      `json:"tools"`
+	Parameters []ProvenanceParameter `json:"parameters"`
+	Inputs     []ProvenanceInput     `json:"inputs"`
+	Resources  ProvenanceResources   `json:"resources"`
+
+	SubmittedAt *time.Time `json:"submitted_at,omitempty"`
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+}
+
+// pinnedImageDigest returns the digest an image reference is pinned to, or an
+// empty string if it refers to a tag.
+func pinnedImageDigest(image string) string {
+	if idx := strings.LastIndex(image, "@"); idx >= 0 {
+		return image[idx+1:]
+	}
+	return ""
+}
+
+// provenanceResources returns the resources requested for the analysis
+// container in the Deployment.
+func provenanceResources(deployment *appsv1.Deployment) ProvenanceResources {
+	resources := ProvenanceResources{
+		Requests: map[string]string{},
+		Limits:   map[string]string{},
+	}
+	for _, container := range deployment.Spec.Template.Spec.Containers {
+		if container.Name != analysisContainerName {
+			continue
+		}
+		for name, quantity := range container.Resources.Requests {
+			resources.Requests[string(name)] = quantity.String()
+		}
+		for name, quantity := range container.Resources.Limits {
+			resources.Limits[string(name)] = quantity.String()
+		}
+	}
+	return resources
+}
+
+// newProvenanceManifest returns the manifest for an analysis that's being
+// launched with the Deployment.
+func (i *Internal) newProvenanceManifest(job *model.Job, deployment *appsv1.Deployment, opts *launchOptions, now time.Time) *ProvenanceManifest {
+	manifest := &ProvenanceManifest{
+		SchemaVersion: provenanceSchemaVersion,
+		AnalysisID:    job.ID,
+		ExternalID:    job.InvocationID,
+		AnalysisName:  job.Name,
+		Submitter:     strings.TrimSuffix(job.Submitter, i.UserSuffix),
+		AppID:         job.AppID,
+		AppName:       job.AppName,
+		AppVersion:    opts.AppVersion,
+		Cluster:       i.Provenance.ClusterName,
+		Namespace:     i.ViceNamespace,
+		OutputDir:     job.OutputDirectory(),
+		Tools:         []ProvenanceTool{},
+		Parameters:    []ProvenanceParameter{},
+		Inputs:        []ProvenanceInput{},
+		Resources:     provenanceResources(deployment),
+		UpdatedAt:     now,
+	}
+	if !job.DateSubmitted.IsZero() {
+		submitted := job.DateSubmitted
+		manifest.SubmittedAt = &submitted
+	}
+
+	for idx := range job.Steps {
+		step := &job.Steps[idx]
+		image := fmt.Sprintf("%s:%s", step.Component.Container.Image.Name, step.Component.Container.Image.Tag)
+		manifest.Tools = append(manifest.Tools, ProvenanceTool{
+			Name:        step.Component.Name,
+			Image:       image,
+			ImageDigest: pinnedImageDigest(image),
+		})
+		for _, param := range step.Config.Parameters() {
+			manifest.Parameters = append(manifest.Parameters, ProvenanceParameter{
+				ID:    param.ID,
+				Name:  param.Name,
+				Value: param.Value,
+				Type:  param.Type,
+			})
+		}
+	}
+
+	for _, input := range job.Inputs() {
+		manifest.Inputs = append(manifest.Inputs, ProvenanceInput{
+			ID:           input.ID,
+			Path:         input.IRODSPath(),
+			Type:         input.Type,
+			Multiplicity: input.Multiplicity,
+		})
+	}
+
+	return manifest
+}
+
+// updateFromPod fills in the image digest and the start time from the
+// analysis container's status. VICE analyses run the first step's tool in
+// the analysis container.
+func (m *ProvenanceManifest) updateFromPod(pod *apiv1.Pod) {
+	for idx := range pod.Status.ContainerStatuses {
+		status := &pod.Status.ContainerStatuses[idx]
+		if status.Name != analysisContainerName {
+			continue
+		}
+
+		if digest := pinnedImageDigest(status.ImageID); digest != "" && len(m.Tools) > 0 {
+			m.Tools[0].ImageDigest = digest
+		}
+
+		var started *time.Time
+		switch {
+		case status.State.Running != nil:
+			started = timePtr(status.State.Running.StartedAt)
+		case status.State.Terminated != nil:
+			started = timePtr(status.State.Terminated.StartedAt)
+		}
+		if started != nil && (m.StartedAt == nil || started.Before(*m.StartedAt)) {
+			m.StartedAt = started
+		}
+	}
+}
+
+// checksumCommand prints the SHA-256 checksums of the files in the directory
+// that exist. The directory and the file names are passed as positional
+// parameters so that they aren't interpreted by the shell.
+func checksumCommand(dir string, names []string) []string {
+	command := []string{
+		"sh", "-c",
+		`cd -- "$1" || exit 1; shift; for f; do if [ -f "$f" ]; then sha256sum -- "$f"; fi; done; exit 0`,
+		"sh", dir,
+	}
+	return append(command, names...)
+}
+
+// parseChecksums parses the output of checksumCommand into checksums keyed
+// by file name.
+func parseChecksums(output string) map[string]string {
+	checksums := map[string]string{}
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.SplitN(line, "  ", 2)
+		if len(fields) != 2 || len(fields[0]) != 64 {
+			continue
+		}
+		checksums[fields[1]] = "sha256:" + fields[0]
+	}
+	return checksums
+}
+
+// addInputChecksums computes the checksums of the input files that have been
+// downloaded to the working directory and don't have one yet.
+func (i *Internal) addInputChecksums(ctx context.Context, manifest *ProvenanceManifest, pod *apiv1.Pod) error {
+	if i.UseCSIDriver {
+		return nil
+	}
+
+	names := []string{}
+	for _, input := range manifest.Inputs {
+		if input.Checksum == "" && input.Multiplicity != "collection" {
+			names = append(names, path.Base(input.Path))
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+
+	container, root, err := workingDirLocation(pod)
+	if err != nil {
+		return err
+	}
+
+	execCtx, cancel := context.WithTimeout(ctx, provenanceChecksumTimeout)
+	defer cancel()
+
+	output, err := i.podExec(execCtx, pod.Namespace, pod.Name, container, checksumCommand(root, names))
+	if err != nil {
+		return err
+	}
+
+	checksums := parseChecksums(output)
+	for idx := range manifest.Inputs {
+		input := &manifest.Inputs[idx]
+		if input.Checksum == "" && input.Multiplicity != "collection" {
+			input.Checksum = checksums[path.Base(input.Path)]
+		}
+	}
+
+	return nil
+}
+
+// writeFileCommand writes the contents to the file. Both are passed as
+// positional parameters so that they aren't interpreted by the shell.
+func writeFileCommand(filePath, contents string) []string {
+	return []string{"sh", "-c", `printf '%s\n' "$2" > "$1"`, "sh", filePath, contents}
+}
+
+// depositProvenance writes the manifest to the analysis's working directory
+// so that it's saved along with the outputs.
+func (i *Internal) depositProvenance(ctx context.Context, manifest *ProvenanceManifest, pod *apiv1.Pod) error {
+	contents, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if len(contents) > maxDepositedProvenanceBytes {
+		return fmt.Errorf("the provenance manifest for %s is too large to deposit (%d bytes)", manifest.ExternalID, len(contents))
+	}
+
+	container, root, err := workingDirLocation(pod)
+	if err != nil {
+		return err
+	}
+
+	_, err = i.podExec(ctx, pod.Namespace, pod.Name, container, writeFileCommand(path.Join(root, i.Provenance.FileName), string(contents)))
+	return err
+}
+
+const upsertProvenanceSQL = `
+	INSERT INTO vice_provenance (external_id, manifest)
+	VALUES ($1, $2)
+	ON CONFLICT (external_id) DO UPDATE
+	   SET manifest = EXCLUDED.manifest,
+	       updated_at = now()
+`
+
+const getProvenanceSQL = `
+	SELECT manifest
+	  FROM vice_provenance
+	 WHERE external_id = $1
+`
+
+// saveProvenance records the manifest in the database.
+func (i *Internal) saveProvenance(ctx context.Context, manifest *ProvenanceManifest) error {
+	raw, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	if _, err = i.db.ExecContext(ctx, upsertProvenanceSQL, manifest.ExternalID, raw); err != nil {
+		return errors.Wrapf(err, "error saving the provenance manifest for %s", manifest.ExternalID)
+	}
+	return nil
+}
+
+// getProvenance returns the manifest recorded for the analysis, or nil if
+// there isn't one.
+func (i *Internal) getProvenance(ctx context.Context, externalID string) (*ProvenanceManifest, error) {
+	var raw []byte
+	err := i.db.QueryRowContext(ctx, getProvenanceSQL, externalID).Scan(&raw)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "error looking up the provenance manifest for %s", externalID)
+	}
+
+	manifest := &ProvenanceManifest{}
+	if err = json.Unmarshal(raw, manifest); err != nil {
+		return nil, errors.Wrapf(err, "error parsing the provenance manifest for %s", externalID)
+	}
+	return manifest, nil
+}
+
+// recordProvenance records the manifest for an analysis that's just been
+// launched. Failures are logged rather than returned, since the analysis is
+// already running.
+func (i *Internal) recordProvenance(ctx context.Context, job *model.Job, deployment *appsv1.Deployment, opts *launchOptions) {
+	if !i.Provenance.Enabled {
+		return
+	}
+	if err := i.saveProvenance(ctx, i.newProvenanceManifest(job, deployment, opts, time.Now())); err != nil {
+		log.WithContext(ctx).Error(err)
+	}
+}
+
+// updateProvenance brings the analysis's manifest up to date with its pod.
+// The manifest is deposited in the working directory if deposit is true, and
+// the analysis is marked as finished if finished is true. Analyses launched
+// before manifests were recorded are left alone.
+func (i *Internal) updateProvenance(ctx context.Context, externalID string, deposit, finished bool) (err error) {
+	if !i.Provenance.Enabled {
+		return nil
+	}
+
+	ctx, span := startResourceSpan(ctx, "updateProvenance", "pod")
+	defer func() { endSpan(span, err) }()
+
+	manifest, err := i.getProvenance(ctx, externalID)
+	if err != nil || manifest == nil {
+		return err
+	}
+
+	set := labels.Set(map[string]string{
+		"external-id": externalID,
+	})
+	podlist, err := i.clientset.CoreV1().Pods(i.ViceNamespace).List(ctx, metav1.ListOptions{
+		LabelSelector: set.AsSelector().String(),
+	})
+	if err != nil {
+		return err
+	}
+
+	var running *apiv1.Pod
+	for idx := range podlist.Items {
+		pod := &podlist.Items[idx]
+		manifest.updateFromPod(pod)
+		if pod.Status.Phase == apiv1.PodRunning && running == nil {
+			running = pod
+		}
+	}
+
+	if running != nil {
+		if err = i.addInputChecksums(ctx, manifest, running); err != nil {
+			log.WithContext(ctx).Warnf("unable to compute the input checksums for %s: %s", externalID, err)
+		}
+	}
+
+	now := time.Now()
+	manifest.UpdatedAt = now
+	if finished {
+		manifest.FinishedAt = &now
+	}
+
+	if err = i.saveProvenance(ctx, manifest); err != nil {
+		return err
+	}
+
+	if deposit && running != nil {
+		if err = i.depositProvenance(ctx, manifest, running); err != nil {
+			return errors.Wrapf(err, "error depositing the provenance manifest for %s", externalID)
+		}
+	}
+
+	return nil
+}
+
+// AnalysisProvenanceHandler returns the provenance manifest of an analysis.
+// The user must have access to the analysis. Manifests are only recorded for
+// VICE analyses launched while provenance recording is enabled.
+func (i *Internal) AnalysisProvenanceHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	analysisID := c.Param("analysis-id")
+	if analysisID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "analysis-id parameter is empty")
+	}
+
+	user := c.QueryParam("user")
+	if user == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "user query parameter must be set")
+	}
+
+	p := &permissions.Permissions{
+		BaseURL: i.PermissionsURL,
+	}
+
+	allowed, err := p.IsAllowed(ctx, user, analysisID)
+	if err != nil {
+		return err
+	}
+
+	if !allowed {
+		return echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("user %s cannot access analysis %s", user, analysisID))
+	}
+
+	summary, err := i.apps.GetAnalysisSummary(ctx, analysisID)
+	if err == sql.ErrNoRows {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("analysis %s not found", analysisID))
+	}
+	if err != nil {
+		return err
+	}
+
+	var manifest *ProvenanceManifest
+	if summary.JobType == apps.InteractiveJobType && summary.ExternalID != "" {
+		if manifest, err = i.getProvenance(ctx, summary.ExternalID); err != nil {
+			return err
+		}
+	}
+	if manifest == nil {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("no provenance manifest was recorded for analysis %s", analysisID))
+	}
+	manifest.AnalysisID = analysisID
+
+	return c.JSON(http.StatusOK, manifest)
+}
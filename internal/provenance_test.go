@@ -0,0 +1,194 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cyverse-de/model/v6"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const testChecksum = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+
+func provenanceTestJob() *model.Job {
+	return &model.Job{
+		ID:           "a1",
+		InvocationID: "e1",
+		Name:         "run",
+		Submitter:    "jdoe@example.org",
+		AppID:        "app1",
+		AppName:      "RStudio",
+		OutputDir:    "/iplant/home/jdoe/analyses/run",
+		Steps: []model.Step{
+			{
+				Component: model.StepComponent{
+					Name: "rstudio",
+					Container: model.Container{
+						Image: model.ContainerImage{Name: "harbor.cyverse.org/de/rstudio", Tag: "4.3"},
+					},
+				},
+				Config: model.StepConfig{
+					Params: []model.StepParam{
+						{ID: "p2", Name: "--threads", Value: "4", Order: 2, Type: "Integer"},
+						{ID: "p1", Name: "--mode", Value: "fast", Order: 1, Type: "Text"},
+					},
+					Inputs: []model.StepInput{
+						{ID: "i1", Value: "/iplant/home/jdoe/samples.csv", Multiplicity: "single", Type: "FileInput"},
+						{ID: "i2", Value: "/iplant/home/jdoe/reads", Multiplicity: "collection", Type: "FolderInput"},
+					},
+				},
+			},
+		},
+	}
+}
+
+func provenanceTestDeployment() *appsv1.Deployment {
+	return &appsv1.Deployment{
+		Spec: appsv1.DeploymentSpec{
+			Template: apiv1.PodTemplateSpec{
+				Spec: apiv1.PodSpec{
+					Containers: []apiv1.Container{
+						{
+							Name: analysisContainerName,
+							Resources: apiv1.ResourceRequirements{
+								Requests: apiv1.ResourceList{apiv1.ResourceCPU: resource.MustParse("1")},
+								Limits:   apiv1.ResourceList{apiv1.ResourceMemory: resource.MustParse("4Gi")},
+							},
+						},
+						{Name: fileTransfersContainerName},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestNewProvenanceManifest(t *testing.T) {
+	assert := assert.New(t)
+
+	i := &Internal{
+		Init: Init{
+			UserSuffix:    "@example.org",
+			ViceNamespace: "vice-apps",
+			Provenance:    ProvenanceConfig{Enabled: true, ClusterName: "tucson", FileName: "provenance.json"},
+		},
+	}
+
+	now := time.Date(2024, 1, 2, 3, 0, 0, 0, time.UTC)
+	manifest := i.newProvenanceManifest(provenanceTestJob(), provenanceTestDeployment(), &launchOptions{AppVersion: "1.2"}, now)
+
+	assert.Equal(provenanceSchemaVersion, manifest.SchemaVersion)
+	assert.Equal("a1", manifest.AnalysisID)
+	assert.Equal("e1", manifest.ExternalID)
+	assert.Equal("jdoe", manifest.Submitter)
+	assert.Equal("1.2", manifest.AppVersion)
+	assert.Equal("tucson", manifest.Cluster)
+	assert.Equal([]ProvenanceTool{{Name: "rstudio", Image: "harbor.cyverse.org/de/rstudio:4.3"}}, manifest.Tools)
+	if assert.Len(manifest.Parameters, 2) {
+		assert.Equal("p1", manifest.Parameters[0].ID)
+		assert.Equal("4", manifest.Parameters[1].Value)
+	}
+	if assert.Len(manifest.Inputs, 2) {
+		assert.Equal("/iplant/home/jdoe/samples.csv", manifest.Inputs[0].Path)
+		assert.Equal("/iplant/home/jdoe/reads/", manifest.Inputs[1].Path)
+	}
+	assert.Equal(map[string]string{"cpu": "1"}, manifest.Resources.Requests)
+	assert.Equal(map[string]string{"memory": "4Gi"}, manifest.Resources.Limits)
+	assert.Nil(manifest.StartedAt)
+
+	assert.Equal("sha256:abc", pinnedImageDigest("docker-pullable://harbor.cyverse.org/de/rstudio@sha256:abc"))
+	assert.Equal("", pinnedImageDigest("harbor.cyverse.org/de/rstudio:4.3"))
+}
+
+func TestUpdateProvenance(t *testing.T) {
+	assert := assert.New(t)
+
+	mockdb, mock, err := sqlmock.New()
+	assert.NoError(err)
+	defer mockdb.Close()
+
+	started := time.Date(2024, 1, 2, 3, 0, 0, 0, time.UTC)
+	pod := &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "e1-pod",
+			Namespace: "vice-apps",
+			Labels:    map[string]string{"external-id": "e1"},
+		},
+		Spec: apiv1.PodSpec{
+			Containers: []apiv1.Container{
+				{
+					Name:         fileTransfersContainerName,
+					VolumeMounts: []apiv1.VolumeMount{{Name: fileTransfersVolumeName, MountPath: fileTransfersInputsMountPath}},
+				},
+			},
+		},
+		Status: apiv1.PodStatus{
+			Phase: apiv1.PodRunning,
+			ContainerStatuses: []apiv1.ContainerStatus{
+				{
+					Name:    analysisContainerName,
+					ImageID: "harbor.cyverse.org/de/rstudio@sha256:abc",
+					State: apiv1.ContainerState{
+						Running: &apiv1.ContainerStateRunning{StartedAt: metav1.NewTime(started)},
+					},
+				},
+			},
+		},
+	}
+
+	i := &Internal{
+		Init: Init{
+			UserSuffix:    "@example.org",
+			ViceNamespace: "vice-apps",
+			Provenance:    ProvenanceConfig{Enabled: true, FileName: "provenance.json"},
+		},
+		clientset: fake.NewSimpleClientset(pod),
+		db:        sqlx.NewDb(mockdb, "sqlmock"),
+	}
+
+	var deposited string
+	i.podExec = func(_ context.Context, namespace, podName, container string, command []string) (string, error) {
+		assert.Equal(fileTransfersContainerName, container)
+		if strings.Contains(command[2], "sha256sum") {
+			assert.Equal([]string{fileTransfersInputsMountPath, "samples.csv"}, command[4:])
+			return testChecksum + "  samples.csv\n", nil
+		}
+		assert.Equal(fileTransfersInputsMountPath+"/provenance.json", command[4])
+		deposited = command[5]
+		return "", nil
+	}
+
+	initial, err := json.Marshal(i.newProvenanceManifest(provenanceTestJob(), provenanceTestDeployment(), &launchOptions{}, started))
+	assert.NoError(err)
+	mock.ExpectQuery("SELECT manifest").WithArgs("e1").
+		WillReturnRows(sqlmock.NewRows([]string{"manifest"}).AddRow(initial))
+	mock.ExpectExec("INSERT INTO vice_provenance").WithArgs("e1", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	assert.NoError(i.updateProvenance(context.Background(), "e1", true, false))
+	assert.NoError(mock.ExpectationsWereMet())
+
+	manifest := &ProvenanceManifest{}
+	if assert.NoError(json.Unmarshal([]byte(deposited), manifest)) {
+		assert.Equal("sha256:abc", manifest.Tools[0].ImageDigest)
+		assert.Equal("sha256:"+testChecksum, manifest.Inputs[0].Checksum)
+		assert.Empty(manifest.Inputs[1].Checksum)
+		assert.True(started.Equal(*manifest.StartedAt))
+		assert.Nil(manifest.FinishedAt)
+	}
+
+	// Analyses launched before manifests were recorded are left alone.
+	mock.ExpectQuery("SELECT manifest").WithArgs("e2").WillReturnRows(sqlmock.NewRows([]string{"manifest"}))
+	assert.NoError(i.updateProvenance(context.Background(), "e2", false, true))
+	assert.NoError(mock.ExpectationsWereMet())
+}
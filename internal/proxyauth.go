@@ -0,0 +1,224 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/cyverse-de/model/v6"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The names of the supported vice-proxy authentication backends.
+const (
+	KeycloakProxyAuthBackend = "keycloak"
+	OIDCProxyAuthBackend     = "oidc"
+	NoProxyAuthBackend       = "none"
+)
+
+// ProxyAuth is implemented by each of the authentication backends that the
+// vice-proxy container can be configured to use. Credentials are never placed
+// in the proxy command directly. They're stored in a per-analysis Secret that
+// gets exposed to the proxy as environment variables, and the command refers
+// to them with Kubernetes' $(VAR_NAME) syntax.
+type ProxyAuth interface {
+	// Name returns the name of the backend.
+	Name() string
+
+	// ProxyArgs returns the vice-proxy command-line arguments for the backend.
+	ProxyArgs() []string
+
+	// SecretData returns the environment variables that should be stored in
+	// the per-analysis Secret. May be empty if the backend doesn't need any
+	// credentials.
+	SecretData() map[string]string
+}
+
+// envRef returns a reference to an environment variable that Kubernetes will
+// expand when it starts the container.
+func envRef(name string) string {
+	return fmt.Sprintf("$(%s)", name)
+}
+
+// keycloakProxyAuth authenticates users with the Keycloak-specific settings
+// that vice-proxy has always supported.
+type keycloakProxyAuth struct {
+	baseURL      string
+	realm        string
+	clientID     string
+	clientSecret string
+}
+
+func (k *keycloakProxyAuth) Name() string {
+	return KeycloakProxyAuthBackend
+}
+
+func (k *keycloakProxyAuth) ProxyArgs() []string {
+	return []string{
+		"--keycloak-base-url", k.baseURL,
+		"--keycloak-realm", k.realm,
+		"--keycloak-client-id", envRef("KEYCLOAK_CLIENT_ID"),
+		"--keycloak-client-secret", envRef("KEYCLOAK_CLIENT_SECRET"),
+	}
+}
+
+func (k *keycloakProxyAuth) SecretData() map[string]string {
+	return map[string]string{
+		"KEYCLOAK_CLIENT_ID":     k.clientID,
+		"KEYCLOAK_CLIENT_SECRET": k.clientSecret,
+	}
+}
+
+// oidcProxyAuth authenticates users against a generic OpenID Connect
+// provider.
+type oidcProxyAuth struct {
+	issuerURL    string
+	clientID     string
+	clientSecret string
+}
+
+func (o *oidcProxyAuth) Name() string {
+	return OIDCProxyAuthBackend
+}
+
+func (o *oidcProxyAuth) ProxyArgs() []string {
+	return []string{
+		"--auth-backend", OIDCProxyAuthBackend,
+		"--oidc-issuer-url", o.issuerURL,
+		"--oidc-client-id", envRef("OIDC_CLIENT_ID"),
+		"--oidc-client-secret", envRef("OIDC_CLIENT_SECRET"),
+	}
+}
+
+func (o *oidcProxyAuth) SecretData() map[string]string {
+	return map[string]string{
+		"OIDC_CLIENT_ID":     o.clientID,
+		"OIDC_CLIENT_SECRET": o.clientSecret,
+	}
+}
+
+// noProxyAuth disables authentication in vice-proxy. Only intended for
+// development deployments.
+type noProxyAuth struct{}
+
+func (n *noProxyAuth) Name() string {
+	return NoProxyAuthBackend
+}
+
+func (n *noProxyAuth) ProxyArgs() []string {
+	return []string{"--auth-backend", NoProxyAuthBackend}
+}
+
+func (n *noProxyAuth) SecretData() map[string]string {
+	return map[string]string{}
+}
+
+// NewProxyAuth returns the ProxyAuth implementation selected by
+// init.ProxyAuthBackend. Keycloak is used if no backend is selected.
+func NewProxyAuth(init *Init) (ProxyAuth, error) {
+	switch init.ProxyAuthBackend {
+	case "", KeycloakProxyAuthBackend:
+		return &keycloakProxyAuth{
+			baseURL:      init.KeycloakBaseURL,
+			realm:        init.KeycloakRealm,
+			clientID:     init.KeycloakClientID,
+			clientSecret: init.KeycloakClientSecret,
+		}, nil
+	case OIDCProxyAuthBackend:
+		if init.OIDCIssuerURL == "" {
+			return nil, fmt.Errorf("an issuer URL is required for the %s proxy auth backend", OIDCProxyAuthBackend)
+		}
+		return &oidcProxyAuth{
+			issuerURL:    init.OIDCIssuerURL,
+			clientID:     init.OIDCClientID,
+			clientSecret: init.OIDCClientSecret,
+		}, nil
+	case NoProxyAuthBackend:
+		log.Warn("authentication is disabled for VICE analyses")
+		return &noProxyAuth{}, nil
+	default:
+		return nil, fmt.Errorf("unknown proxy auth backend %q", init.ProxyAuthBackend)
+	}
+}
+
+// proxyCredentialsSecretName returns the name of the Secret containing the
+// credentials used by the vice-proxy container.
+func proxyCredentialsSecretName(job *model.Job) string {
+	return fmt.Sprintf("vice-proxy-credentials-%s", job.InvocationID)
+}
+
+// proxyCredentialsSecret returns the Secret containing the credentials used
+// by the vice-proxy container. Returns nil if the configured backend doesn't
+// need any credentials. This does NOT call the k8s API to actually create the
+// Secret.
+func (i *Internal) proxyCredentialsSecret(ctx context.Context, job *model.Job) (*apiv1.Secret, error) {
+	data := i.ProxyAuth.SecretData()
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	labels, err := i.labelsFromJob(ctx, job)
+	if err != nil {
+		return nil, err
+	}
+
+	return &apiv1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   proxyCredentialsSecretName(job),
+			Labels: labels,
+		},
+		Type:       apiv1.SecretTypeOpaque,
+		StringData: data,
+	}, nil
+}
+
+// proxyCredentialsEnvFrom returns the EnvFromSource that exposes the
+// credentials Secret to the vice-proxy container.
+func (i *Internal) proxyCredentialsEnvFrom(job *model.Job) []apiv1.EnvFromSource {
+	if len(i.ProxyAuth.SecretData()) == 0 {
+		return nil
+	}
+
+	return []apiv1.EnvFromSource{
+		{
+			SecretRef: &apiv1.SecretEnvSource{
+				LocalObjectReference: apiv1.LocalObjectReference{
+					Name: proxyCredentialsSecretName(job),
+				},
+			},
+		},
+	}
+}
+
+// UpsertProxyCredentialsSecret uses the Job passed in to assemble the Secret
+// containing the vice-proxy credentials. It then calls the k8s API to create
+// the Secret if it does not already exist or to update it if it does.
+func (i *Internal) UpsertProxyCredentialsSecret(ctx context.Context, job *model.Job) (err error) {
+	ctx, span := startResourceSpan(ctx, "UpsertProxyCredentialsSecret", "secret")
+	defer func() { recordUpsertError("secret", err); endSpan(span, err) }()
+
+	secret, err := i.proxyCredentialsSecret(ctx, job)
+	if err != nil {
+		return err
+	}
+	if secret == nil {
+		return nil
+	}
+
+	secretclient := i.clientset.CoreV1().Secrets(i.ViceNamespace)
+
+	_, err = secretclient.Get(ctx, secret.Name, metav1.GetOptions{})
+	if err != nil {
+		_, err = secretclient.Create(ctx, secret, metav1.CreateOptions{})
+		if err != nil {
+			return err
+		}
+	} else {
+		_, err = secretclient.Update(ctx, secret, metav1.UpdateOptions{})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
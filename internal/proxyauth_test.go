@@ -0,0 +1,64 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewProxyAuth(t *testing.T) {
+	assert := assert.New(t)
+
+	auth, err := NewProxyAuth(&Init{})
+	assert.NoError(err)
+	assert.Equal(KeycloakProxyAuthBackend, auth.Name())
+
+	_, err = NewProxyAuth(&Init{ProxyAuthBackend: OIDCProxyAuthBackend})
+	assert.Error(err, "the oidc backend should require an issuer URL")
+
+	auth, err = NewProxyAuth(&Init{ProxyAuthBackend: OIDCProxyAuthBackend, OIDCIssuerURL: "https://issuer"})
+	assert.NoError(err)
+	assert.Equal(OIDCProxyAuthBackend, auth.Name())
+
+	auth, err = NewProxyAuth(&Init{ProxyAuthBackend: NoProxyAuthBackend})
+	assert.NoError(err)
+	assert.Empty(auth.SecretData())
+
+	_, err = NewProxyAuth(&Init{ProxyAuthBackend: "bogus"})
+	assert.Error(err)
+}
+
+func TestProxyArgsOmitSecrets(t *testing.T) {
+	inits := []*Init{
+		{
+			KeycloakBaseURL:      "https://keycloak",
+			KeycloakRealm:        "realm",
+			KeycloakClientID:     "client",
+			KeycloakClientSecret: "super-secret",
+		},
+		{
+			ProxyAuthBackend: OIDCProxyAuthBackend,
+			OIDCIssuerURL:    "https://issuer",
+			OIDCClientID:     "client",
+			OIDCClientSecret: "super-secret",
+		},
+	}
+
+	for _, init := range inits {
+		auth, err := NewProxyAuth(init)
+		assert.NoError(t, err)
+
+		args := strings.Join(auth.ProxyArgs(), " ")
+		assert.NotContains(t, args, "super-secret", "%s proxy args contain the client secret", auth.Name())
+
+		// Every variable referenced in the args must be provided by the Secret.
+		data := auth.SecretData()
+		for _, arg := range auth.ProxyArgs() {
+			if strings.HasPrefix(arg, "$(") {
+				name := strings.TrimSuffix(strings.TrimPrefix(arg, "$("), ")")
+				assert.Contains(t, data, name)
+			}
+		}
+	}
+}
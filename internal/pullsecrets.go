@@ -0,0 +1,414 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	apiv1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const defaultPullSecretSyncInterval = 10 * time.Minute
+
+const (
+	// pullSecretSourceAnnotation records the secret that a pull secret was
+	// copied from.
+	pullSecretSourceAnnotation = "vice.cyverse.org/pull-secret-source"
+
+	// pullSecretChecksumAnnotation records the checksum of the source
+	// secret's data when it was copied.
+	pullSecretChecksumAnnotation = "vice.cyverse.org/pull-secret-checksum"
+)
+
+// The actions taken on a namespace's pull secret when the pull secrets are
+// synced.
+const (
+	pullSecretCreated   = "created"
+	pullSecretUpdated   = "updated"
+	pullSecretUnchanged = "unchanged"
+	pullSecretFailed    = "failed"
+)
+
+// PullSecretsConfig contains the settings for managing the image pull secret
+// named by vice.image-pull-secret in the namespaces that VICE analyses run in.
+// The secret is copied from a source secret that administrators maintain, so
+// the registry credentials only need to be changed in one place.
+type PullSecretsConfig struct {
+	// SourceNamespace is the namespace containing the source secret.
+	SourceNamespace string
+
+	// SourceName is the name of the source secret. The pull secrets aren't
+	// managed if it's empty.
+	SourceName string
+
+	// SyncInterval is how often the pull secrets are synced with the source.
+	SyncInterval time.Duration
+}
+
+// Enabled returns true if the pull secrets are managed by app-exposer.
+func (c *PullSecretsConfig) Enabled() bool {
+	return c.SourceName != ""
+}
+
+// Validate returns an error if the configuration can't be used.
+func (c *PullSecretsConfig) Validate() error {
+	if c.Enabled() && c.SourceNamespace == "" {
+		return fmt.Errorf("the namespace of the source pull secret %s must be set", c.SourceName)
+	}
+	return nil
+}
+
+func (c *PullSecretsConfig) source() string {
+	return c.SourceNamespace + "/" + c.SourceName
+}
+
+// PullSecretStatus describes the image pull secret in a namespace that VICE
+// analyses run in.
+type PullSecretStatus struct {
+	Namespace string `json:"namespace"`
+	Exists    bool   `json:"exists"`
+
+	// Managed is true if the secret was copied from the source secret.
+	Managed bool `json:"managed"`
+
+	// InSync is true if the secret has the same data as the source secret, or
+	// if it exists and the pull secrets aren't managed.
+	InSync bool `json:"in_sync"`
+
+	// Action is the action taken on the secret when the pull secrets are
+	// synced.
+	Action string `json:"action,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// pullSecretChecksum returns a checksum of the secret's type and data.
+func pullSecretChecksum(secret *apiv1.Secret) string {
+	keys := make([]string, 0, len(secret.Data))
+	for key := range secret.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	hash := sha256.New()
+	hash.Write([]byte(secret.Type))
+	for _, key := range keys {
+		hash.Write([]byte{0})
+		hash.Write([]byte(key))
+		hash.Write([]byte{0})
+		hash.Write(secret.Data[key])
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// isPullSecretSource returns true if the namespace's pull secret is the
+// source secret, which is never overwritten.
+func (i *Internal) isPullSecretSource(namespace string) bool {
+	return namespace == i.PullSecrets.SourceNamespace && i.ImagePullSecretName == i.PullSecrets.SourceName
+}
+
+// sourcePullSecret returns the secret that the pull secrets are copied from.
+func (i *Internal) sourcePullSecret(ctx context.Context) (*apiv1.Secret, error) {
+	source, err := i.clientset.CoreV1().Secrets(i.PullSecrets.SourceNamespace).Get(ctx, i.PullSecrets.SourceName, metav1.GetOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting the source pull secret %s", i.PullSecrets.source())
+	}
+	return source, nil
+}
+
+// pullSecretStatus returns the status of the pull secret in the namespace.
+// The checksum is the source secret's, and is empty if the pull secrets
+// aren't managed.
+func (i *Internal) pullSecretStatus(ctx context.Context, namespace, checksum string) (*PullSecretStatus, *apiv1.Secret, error) {
+	status := &PullSecretStatus{Namespace: namespace}
+
+	secret, err := i.clientset.CoreV1().Secrets(namespace).Get(ctx, i.ImagePullSecretName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return status, nil, nil
+	}
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "error getting the pull secret %s in namespace %s", i.ImagePullSecretName, namespace)
+	}
+
+	status.Exists = true
+	status.Managed = secret.Annotations[pullSecretSourceAnnotation] == i.PullSecrets.source()
+	if checksum == "" || i.isPullSecretSource(namespace) {
+		status.InSync = true
+	} else {
+		status.InSync = pullSecretChecksum(secret) == checksum
+	}
+	return status, secret, nil
+}
+
+// copyPullSecret returns the copy of the source secret for the namespace.
+func (i *Internal) copyPullSecret(source *apiv1.Secret, namespace, checksum string) *apiv1.Secret {
+	data := map[string][]byte{}
+	for key, value := range source.Data {
+		data[key] = value
+	}
+
+	return &apiv1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      i.ImagePullSecretName,
+			Namespace: namespace,
+			Annotations: map[string]string{
+				pullSecretSourceAnnotation:   i.PullSecrets.source(),
+				pullSecretChecksumAnnotation: checksum,
+			},
+		},
+		Type: source.Type,
+		Data: data,
+	}
+}
+
+// syncPullSecret makes the pull secret in the namespace a copy of the source
+// secret. Secrets with the same name that weren't copied from the source are
+// replaced.
+func (i *Internal) syncPullSecret(ctx context.Context, source *apiv1.Secret, namespace string) *PullSecretStatus {
+	checksum := pullSecretChecksum(source)
+
+	status, existing, err := i.pullSecretStatus(ctx, namespace, checksum)
+	if err != nil {
+		return &PullSecretStatus{Namespace: namespace, Action: pullSecretFailed, Error: err.Error()}
+	}
+	if status.InSync && (status.Managed || i.isPullSecretSource(namespace)) {
+		status.Action = pullSecretUnchanged
+		return status
+	}
+
+	secret := i.copyPullSecret(source, namespace, checksum)
+	secretclient := i.clientset.CoreV1().Secrets(namespace)
+	if existing == nil {
+		_, err = secretclient.Create(ctx, secret, metav1.CreateOptions{})
+		status.Action = pullSecretCreated
+	} else {
+		secret.ResourceVersion = existing.ResourceVersion
+		_, err = secretclient.Update(ctx, secret, metav1.UpdateOptions{})
+		status.Action = pullSecretUpdated
+	}
+	if err != nil {
+		log.WithContext(ctx).Errorf("error syncing the pull secret %s in namespace %s: %s", i.ImagePullSecretName, namespace, err)
+		return &PullSecretStatus{
+			Namespace: namespace,
+			Exists:    status.Exists,
+			Managed:   status.Managed,
+			Action:    pullSecretFailed,
+			Error:     err.Error(),
+		}
+	}
+
+	log.WithContext(ctx).Infof("%s the pull secret %s in namespace %s from %s", status.Action, i.ImagePullSecretName, namespace, i.PullSecrets.source())
+	return &PullSecretStatus{Namespace: namespace, Exists: true, Managed: true, InSync: true, Action: status.Action}
+}
+
+// syncPullSecrets copies the source secret into every namespace that VICE
+// analyses run in.
+func (i *Internal) syncPullSecrets(ctx context.Context) ([]PullSecretStatus, error) {
+	ctx, span := startSpan(ctx, "syncPullSecrets")
+	defer span.End()
+
+	source, err := i.sourcePullSecret(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	namespaces, err := i.listingNamespaces(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := []PullSecretStatus{}
+	for _, namespace := range namespaces {
+		statuses = append(statuses, *i.syncPullSecret(ctx, source, namespace))
+	}
+	return statuses, nil
+}
+
+// pullSecretStatuses returns the status of the pull secret in every namespace
+// that VICE analyses run in.
+func (i *Internal) pullSecretStatuses(ctx context.Context) ([]PullSecretStatus, error) {
+	checksum := ""
+	if i.PullSecrets.Enabled() {
+		source, err := i.sourcePullSecret(ctx)
+		if err != nil {
+			return nil, err
+		}
+		checksum = pullSecretChecksum(source)
+	}
+
+	namespaces, err := i.listingNamespaces(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := []PullSecretStatus{}
+	for _, namespace := range namespaces {
+		status, _, err := i.pullSecretStatus(ctx, namespace, checksum)
+		if err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, *status)
+	}
+	return statuses, nil
+}
+
+// checkImagePullSecret returns an error if the image pull secret used by new
+// analyses doesn't exist in the VICE namespace. A missing secret is copied
+// from the source secret first if the pull secrets are managed.
+func (i *Internal) checkImagePullSecret(ctx context.Context) error {
+	if i.ImagePullSecretName == "" {
+		return nil
+	}
+
+	_, err := i.clientset.CoreV1().Secrets(i.ViceNamespace).Get(ctx, i.ImagePullSecretName, metav1.GetOptions{})
+	if err == nil {
+		return nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return errors.Wrapf(err, "error getting the image pull secret %s", i.ImagePullSecretName)
+	}
+
+	if i.PullSecrets.Enabled() {
+		source, err := i.sourcePullSecret(ctx)
+		if err != nil {
+			return err
+		}
+		if status := i.syncPullSecret(ctx, source, i.ViceNamespace); status.Action != pullSecretFailed {
+			return nil
+		}
+	}
+
+	return common.ErrorResponse{
+		ErrorCode: "ERR_IMAGE_PULL_SECRET_MISSING",
+		Message:   fmt.Sprintf("the image pull secret %s doesn't exist in namespace %s", i.ImagePullSecretName, i.ViceNamespace),
+		Details: &map[string]interface{}{
+			"secret":    i.ImagePullSecretName,
+			"namespace": i.ViceNamespace,
+		},
+	}
+}
+
+// RunPullSecretSync keeps the pull secrets in sync with the source secret.
+// Blocks until the context is canceled.
+func (i *Internal) RunPullSecretSync(ctx context.Context) {
+	if !i.PullSecrets.Enabled() || i.ImagePullSecretName == "" {
+		log.WithContext(ctx).Warn("the pull secrets aren't managed, so they won't be synced")
+		return
+	}
+
+	interval := i.PullSecrets.SyncInterval
+	if interval <= 0 {
+		interval = defaultPullSecretSyncInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := i.syncPullSecrets(ctx); err != nil {
+			log.WithContext(ctx).Error(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// requireManagedPullSecrets returns an error if the pull secrets aren't
+// managed by app-exposer.
+func (i *Internal) requireManagedPullSecrets() error {
+	if !i.PullSecrets.Enabled() || i.ImagePullSecretName == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "the image pull secrets aren't managed by app-exposer")
+	}
+	return nil
+}
+
+// AdminListPullSecretsHandler lists the status of the image pull secret in
+// each namespace that VICE analyses run in.
+func (i *Internal) AdminListPullSecretsHandler(c echo.Context) error {
+	if i.ImagePullSecretName == "" {
+		return c.JSON(http.StatusOK, []PullSecretStatus{})
+	}
+
+	statuses, err := i.pullSecretStatuses(c.Request().Context())
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, statuses)
+}
+
+// AdminSyncPullSecretsHandler copies the source secret into each namespace
+// that VICE analyses run in right away.
+func (i *Internal) AdminSyncPullSecretsHandler(c echo.Context) error {
+	if err := i.requireManagedPullSecrets(); err != nil {
+		return err
+	}
+
+	statuses, err := i.syncPullSecrets(c.Request().Context())
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, statuses)
+}
+
+// AdminRotatePullSecretsHandler replaces the registry credentials in the
+// source secret with the Docker config JSON in the request body, then copies
+// the source secret into each namespace that VICE analyses run in.
+func (i *Internal) AdminRotatePullSecretsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := i.requireManagedPullSecrets(); err != nil {
+		return err
+	}
+
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return err
+	}
+
+	var dockerConfig struct {
+		Auths map[string]json.RawMessage `json:"auths"`
+	}
+	if err = json.Unmarshal(body, &dockerConfig); err != nil || len(dockerConfig.Auths) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "the request body must be a Docker config JSON document with at least one registry in auths")
+	}
+
+	source, err := i.sourcePullSecret(ctx)
+	if err != nil {
+		return err
+	}
+	if source.Type != apiv1.SecretTypeDockerConfigJson {
+		return echo.NewHTTPError(
+			http.StatusBadRequest,
+			fmt.Sprintf("the source pull secret %s has type %s rather than %s", i.PullSecrets.source(), source.Type, apiv1.SecretTypeDockerConfigJson),
+		)
+	}
+
+	if source.Data == nil {
+		source.Data = map[string][]byte{}
+	}
+	source.Data[apiv1.DockerConfigJsonKey] = body
+	if _, err = i.clientset.CoreV1().Secrets(source.Namespace).Update(ctx, source, metav1.UpdateOptions{}); err != nil {
+		return errors.Wrapf(err, "error updating the source pull secret %s", i.PullSecrets.source())
+	}
+	log.WithContext(ctx).Infof("rotated the registry credentials in the source pull secret %s", i.PullSecrets.source())
+
+	statuses, err := i.syncPullSecrets(ctx)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, statuses)
+}
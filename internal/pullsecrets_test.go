@@ -0,0 +1,145 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func dockerConfigSecret(namespace, name, config string) *apiv1.Secret {
+	return &apiv1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Type:       apiv1.SecretTypeDockerConfigJson,
+		Data:       map[string][]byte{apiv1.DockerConfigJsonKey: []byte(config)},
+	}
+}
+
+func newPullSecretsTestInternal(objects ...*apiv1.Secret) *Internal {
+	vice := map[string]string{"cyverse.org/vice": "true"}
+	clientset := fake.NewSimpleClientset(
+		labeledNamespace("vice-apps", vice),
+		labeledNamespace("vice-user-a", vice),
+		dockerConfigSecret("admin", "registry-credentials", `{"auths":{"harbor.cyverse.org":{"auth":"b2xk"}}}`),
+	)
+	for _, object := range objects {
+		_ = clientset.Tracker().Add(object)
+	}
+
+	return &Internal{
+		Init: Init{
+			ViceNamespace:       "vice-apps",
+			ImagePullSecretName: "vice-image-pull-secret",
+			Namespaces:          NamespacesConfig{Selector: "cyverse.org/vice=true"},
+			PullSecrets:         PullSecretsConfig{SourceNamespace: "admin", SourceName: "registry-credentials"},
+		},
+		clientset: clientset,
+	}
+}
+
+func pullSecretConfig(t *testing.T, i *Internal, namespace string) string {
+	secret, err := i.clientset.CoreV1().Secrets(namespace).Get(context.Background(), i.ImagePullSecretName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(secret.Data[apiv1.DockerConfigJsonKey])
+}
+
+func TestPullSecretsConfigValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError((&PullSecretsConfig{}).Validate())
+	assert.NoError((&PullSecretsConfig{SourceNamespace: "admin", SourceName: "registry-credentials"}).Validate())
+	assert.Error((&PullSecretsConfig{SourceName: "registry-credentials"}).Validate())
+}
+
+func TestSyncPullSecrets(t *testing.T) {
+	assert := assert.New(t)
+
+	// The secret in vice-apps was created by hand, and is taken over.
+	i := newPullSecretsTestInternal(dockerConfigSecret("vice-apps", "vice-image-pull-secret", `{"auths":{}}`))
+	ctx := context.Background()
+
+	statuses, err := i.pullSecretStatuses(ctx)
+	assert.NoError(err)
+	assert.Equal([]PullSecretStatus{
+		{Namespace: "vice-apps", Exists: true},
+		{Namespace: "vice-user-a"},
+	}, statuses)
+
+	statuses, err = i.syncPullSecrets(ctx)
+	assert.NoError(err)
+	assert.Equal([]PullSecretStatus{
+		{Namespace: "vice-apps", Exists: true, Managed: true, InSync: true, Action: pullSecretUpdated},
+		{Namespace: "vice-user-a", Exists: true, Managed: true, InSync: true, Action: pullSecretCreated},
+	}, statuses)
+	assert.Equal(`{"auths":{"harbor.cyverse.org":{"auth":"b2xk"}}}`, pullSecretConfig(t, i, "vice-user-a"))
+
+	statuses, err = i.syncPullSecrets(ctx)
+	assert.NoError(err)
+	for _, status := range statuses {
+		assert.Equal(pullSecretUnchanged, status.Action)
+	}
+}
+
+func TestCheckImagePullSecret(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	// Missing secrets are copied from the source when they're managed.
+	i := newPullSecretsTestInternal()
+	assert.NoError(i.checkImagePullSecret(ctx))
+	assert.Equal(`{"auths":{"harbor.cyverse.org":{"auth":"b2xk"}}}`, pullSecretConfig(t, i, "vice-apps"))
+
+	// Launches fail when they aren't.
+	i = newPullSecretsTestInternal()
+	i.PullSecrets = PullSecretsConfig{}
+	err := i.checkImagePullSecret(ctx)
+	if assert.Error(err) {
+		assert.Equal("ERR_IMAGE_PULL_SECRET_MISSING", err.(common.ErrorResponse).ErrorCode)
+	}
+
+	// Nothing is checked without a pull secret.
+	i.ImagePullSecretName = ""
+	assert.NoError(i.checkImagePullSecret(ctx))
+}
+
+func TestAdminRotatePullSecretsHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	i := newPullSecretsTestInternal()
+	rotate := func(body string) (*httptest.ResponseRecorder, error) {
+		req := httptest.NewRequest(http.MethodPut, "/vice/admin/pull-secrets/credentials", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		return rec, i.AdminRotatePullSecretsHandler(echo.New().NewContext(req, rec))
+	}
+
+	_, err := rotate(`{"registries": {}}`)
+	if assert.Error(err) {
+		assert.Equal(http.StatusBadRequest, err.(*echo.HTTPError).Code)
+	}
+
+	config := `{"auths":{"harbor.cyverse.org":{"auth":"bmV3"}}}`
+	rec, err := rotate(config)
+	if assert.NoError(err) {
+		statuses := []PullSecretStatus{}
+		assert.NoError(json.Unmarshal(rec.Body.Bytes(), &statuses))
+		assert.Len(statuses, 2)
+		assert.Equal(config, pullSecretConfig(t, i, "vice-apps"))
+		assert.Equal(config, pullSecretConfig(t, i, "vice-user-a"))
+	}
+
+	// Rotation needs a source secret.
+	i.PullSecrets = PullSecretsConfig{}
+	_, err = rotate(config)
+	assert.Error(err)
+}
@@ -0,0 +1,65 @@
+package internal
+
+import (
+	"context"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/cyverse-de/app-exposer/metrics"
+)
+
+// The decisions recorded for the quota checks made when analyses are
+// launched.
+const (
+	quotaAllowed = "allowed"
+	quotaDenied  = "denied"
+
+	// quotaError is recorded when the quota couldn't be checked, for example
+	// because QMS didn't respond.
+	quotaError = "error"
+)
+
+// quotaDenialReasons maps the error codes returned by the quota checks to
+// the reasons recorded in the metrics.
+var quotaDenialReasons = map[string]string{
+	"ERR_LIMIT_REACHED":     "concurrent-limit",
+	"ERR_RESOURCE_OVERAGE":  "cpu-hours",
+	"ERR_PERMISSION_NEEDED": "permission-needed",
+	"ERR_FORBIDDEN":         "forbidden",
+	"ERR_APP_LIMIT_REACHED": "app-limit",
+	"ERR_GPU_LIMIT_REACHED": "gpu-limit",
+}
+
+var quotaDecisions = metrics.NewCounterVec(
+	"app_exposer_quota_decisions_total",
+	"The quota checks made when VICE analyses were launched, by decision and reason.",
+	"decision", "reason",
+)
+
+// quotaDecision returns the decision and reason to record for the result of
+// the quota checks.
+func quotaDecision(countQuota bool, err error) (string, string) {
+	if err == nil {
+		if !countQuota {
+			return quotaAllowed, "quota-skipped"
+		}
+		return quotaAllowed, "within-limits"
+	}
+
+	if errResp, ok := err.(common.ErrorResponse); ok {
+		if reason, ok := quotaDenialReasons[errResp.ErrorCode]; ok {
+			return quotaDenied, reason
+		}
+	}
+	return quotaError, "check-failed"
+}
+
+// recordQuotaDecision counts the result of the quota checks for a launch and
+// logs the launches that were denied.
+func recordQuotaDecision(ctx context.Context, user string, countQuota bool, err error) {
+	decision, reason := quotaDecision(countQuota, err)
+	metrics.Inc(quotaDecisions, decision, reason)
+
+	if decision == quotaDenied {
+		log.WithContext(ctx).Infof("denied a launch for %s: %s", user, reason)
+	}
+}
@@ -0,0 +1,39 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/cyverse-de/app-exposer/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuotaDecision(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		countQuota bool
+		err        error
+		decision   string
+		reason     string
+	}{
+		{true, nil, quotaAllowed, "within-limits"},
+		{false, nil, quotaAllowed, "quota-skipped"},
+		{true, common.ErrorResponse{ErrorCode: "ERR_LIMIT_REACHED"}, quotaDenied, "concurrent-limit"},
+		{true, common.ErrorResponse{ErrorCode: "ERR_RESOURCE_OVERAGE"}, quotaDenied, "cpu-hours"},
+		{true, common.ErrorResponse{ErrorCode: "ERR_APP_LIMIT_REACHED"}, quotaDenied, "app-limit"},
+		{true, common.ErrorResponse{ErrorCode: "ERR_GPU_LIMIT_REACHED"}, quotaDenied, "gpu-limit"},
+		{true, errors.New("nats: timeout"), quotaError, "check-failed"},
+	}
+	for _, test := range tests {
+		decision, reason := quotaDecision(test.countQuota, test.err)
+		assert.Equal(test.decision, decision)
+		assert.Equal(test.reason, reason)
+	}
+
+	before := metrics.CounterValue(quotaDecisions, quotaDenied, "forbidden")
+	recordQuotaDecision(context.Background(), "ipcdev", true, common.ErrorResponse{ErrorCode: "ERR_FORBIDDEN"})
+	assert.Equal(before+1, metrics.CounterValue(quotaDecisions, quotaDenied, "forbidden"))
+}
@@ -0,0 +1,143 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cyverse-de/model/v6"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// The types of readiness probes that may be configured for a tool.
+const (
+	readinessProbeHTTP = "http"
+	readinessProbeTCP  = "tcp"
+)
+
+// The defaults for the readiness probe settings that aren't configured. They
+// match the probe analysis containers had before it could be configured.
+const (
+	defaultReadinessInitialDelaySeconds = 0
+	defaultReadinessPeriodSeconds       = 31
+	defaultReadinessTimeoutSeconds      = 30
+	defaultReadinessSuccessThreshold    = 1
+	defaultReadinessFailureThreshold    = 10
+)
+
+// ReadinessProbe configures the readiness probe for the analysis container.
+// The analysis's URL isn't reported as ready until the probe succeeds, so apps
+// that don't return a 200 for a request to / at the first port, such as
+// RStudio with authentication or JupyterLab with a base URL, need one.
+type ReadinessProbe struct {
+	// Type is the kind of check to run: http or tcp. Defaults to http.
+	Type string `json:"type,omitempty"`
+
+	// Path is the path to request for http probes. Defaults to /.
+	Path string `json:"path,omitempty"`
+
+	// Port is the port to check. Defaults to the first port of the analysis
+	// container.
+	Port int32 `json:"port,omitempty"`
+
+	// Scheme is the scheme used by http probes: http or https. Defaults to
+	// http.
+	Scheme string `json:"scheme,omitempty"`
+
+	// InitialDelaySeconds is how long to wait after the container starts
+	// before it's checked. Defaults to 0.
+	InitialDelaySeconds int32 `json:"initial_delay_seconds,omitempty"`
+
+	// PeriodSeconds is how often the container is checked. Defaults to 31.
+	PeriodSeconds int32 `json:"period_seconds,omitempty"`
+
+	// TimeoutSeconds is how long a check may take before it fails. Defaults
+	// to 30.
+	TimeoutSeconds int32 `json:"timeout_seconds,omitempty"`
+
+	// SuccessThreshold is the number of successful checks in a row it takes
+	// for the container to become ready again after failing. Defaults to 1.
+	SuccessThreshold int32 `json:"success_threshold,omitempty"`
+
+	// FailureThreshold is the number of failed checks in a row that make the
+	// container unready. Defaults to 10.
+	FailureThreshold int32 `json:"failure_threshold,omitempty"`
+}
+
+// Validate returns an error if the readiness probe settings are invalid.
+func (p *ReadinessProbe) Validate() error {
+	switch p.Type {
+	case "", readinessProbeHTTP:
+		if p.Path != "" && !strings.HasPrefix(p.Path, "/") {
+			return fmt.Errorf("the readiness probe path must start with /")
+		}
+		switch strings.ToUpper(p.Scheme) {
+		case "", string(apiv1.URISchemeHTTP), string(apiv1.URISchemeHTTPS):
+		default:
+			return fmt.Errorf("unknown readiness probe scheme %q; must be http or https", p.Scheme)
+		}
+	case readinessProbeTCP:
+		if p.Path != "" || p.Scheme != "" {
+			return fmt.Errorf("only http readiness probes may have a path or scheme")
+		}
+	default:
+		return fmt.Errorf("unknown readiness probe type %q; must be %s or %s", p.Type, readinessProbeHTTP, readinessProbeTCP)
+	}
+
+	if p.Port < 0 || p.Port > 65535 {
+		return fmt.Errorf("invalid readiness probe port %d", p.Port)
+	}
+	if p.InitialDelaySeconds < 0 || p.PeriodSeconds < 0 || p.TimeoutSeconds < 0 || p.SuccessThreshold < 0 || p.FailureThreshold < 0 {
+		return fmt.Errorf("the readiness probe thresholds must not be negative")
+	}
+	return nil
+}
+
+// probe returns the readiness probe for the analysis container of the job.
+func (p *ReadinessProbe) probe(job *model.Job) *apiv1.Probe {
+	port := p.Port
+	if port == 0 && len(job.Steps[0].Component.Container.Ports) > 0 {
+		port = int32(job.Steps[0].Component.Container.Ports[0].ContainerPort)
+	}
+
+	probe := &apiv1.Probe{
+		InitialDelaySeconds: valueOrDefault(p.InitialDelaySeconds, defaultReadinessInitialDelaySeconds),
+		PeriodSeconds:       valueOrDefault(p.PeriodSeconds, defaultReadinessPeriodSeconds),
+		TimeoutSeconds:      valueOrDefault(p.TimeoutSeconds, defaultReadinessTimeoutSeconds),
+		SuccessThreshold:    valueOrDefault(p.SuccessThreshold, defaultReadinessSuccessThreshold),
+		FailureThreshold:    valueOrDefault(p.FailureThreshold, defaultReadinessFailureThreshold),
+	}
+
+	switch p.Type {
+	case readinessProbeTCP:
+		probe.TCPSocket = &apiv1.TCPSocketAction{
+			Port: intstr.FromInt(int(port)),
+		}
+	default:
+		path := p.Path
+		if path == "" {
+			path = "/"
+		}
+		scheme := apiv1.URISchemeHTTP
+		if p.Scheme != "" {
+			scheme = apiv1.URIScheme(strings.ToUpper(p.Scheme))
+		}
+		probe.HTTPGet = &apiv1.HTTPGetAction{
+			Port:   intstr.FromInt(int(port)),
+			Scheme: scheme,
+			Path:   path,
+		}
+	}
+
+	return probe
+}
+
+// readinessProbe returns the readiness probe for the analysis container. Tools
+// that don't have one configured get an HTTP GET of / at the first port of
+// the analysis container.
+func (s *ToolSettings) readinessProbe(job *model.Job) *apiv1.Probe {
+	if s.ReadinessProbe == nil {
+		return (&ReadinessProbe{}).probe(job)
+	}
+	return s.ReadinessProbe.probe(job)
+}
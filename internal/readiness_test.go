@@ -0,0 +1,64 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/cyverse-de/model/v6"
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+func TestReadinessProbeValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError((&ReadinessProbe{}).Validate())
+	assert.NoError((&ReadinessProbe{Type: "http", Path: "/lab", Scheme: "https"}).Validate())
+	assert.NoError((&ReadinessProbe{Type: "tcp", Port: 8787, PeriodSeconds: 5}).Validate())
+
+	assert.Error((&ReadinessProbe{Type: "exec"}).Validate())
+	assert.Error((&ReadinessProbe{Path: "lab"}).Validate())
+	assert.Error((&ReadinessProbe{Scheme: "ftp"}).Validate())
+	assert.Error((&ReadinessProbe{Type: "tcp", Path: "/"}).Validate())
+	assert.Error((&ReadinessProbe{Port: 70000}).Validate())
+	assert.Error((&ReadinessProbe{SuccessThreshold: -1}).Validate())
+
+	assert.Error((&ToolSettings{ReadinessProbe: &ReadinessProbe{Type: "bogus"}}).Validate())
+}
+
+func TestAnalysisContainerReadinessProbe(t *testing.T) {
+	assert := assert.New(t)
+
+	i := &Internal{}
+	job := &model.Job{Steps: []model.Step{{}}}
+	job.Steps[0].Component.Container.Ports = []model.Ports{{ContainerPort: 8888}}
+
+	// Without settings, the probe requests / at the first port.
+	probe := i.defineAnalysisContainer(job, &ToolSettings{}, nil).ReadinessProbe
+	if assert.NotNil(probe) && assert.NotNil(probe.HTTPGet) {
+		assert.Equal(8888, probe.HTTPGet.Port.IntValue())
+		assert.Equal("/", probe.HTTPGet.Path)
+		assert.Equal(apiv1.URISchemeHTTP, probe.HTTPGet.Scheme)
+		assert.Equal(int32(defaultReadinessPeriodSeconds), probe.PeriodSeconds)
+		assert.Equal(int32(defaultReadinessTimeoutSeconds), probe.TimeoutSeconds)
+		assert.Equal(int32(defaultReadinessFailureThreshold), probe.FailureThreshold)
+		assert.Equal(int32(1), probe.SuccessThreshold)
+	}
+
+	settings := &ToolSettings{ReadinessProbe: &ReadinessProbe{Path: "/lab/api/status", Port: 8889, Scheme: "https", PeriodSeconds: 5}}
+	probe = i.defineAnalysisContainer(job, settings, nil).ReadinessProbe
+	if assert.NotNil(probe) && assert.NotNil(probe.HTTPGet) {
+		assert.Equal(8889, probe.HTTPGet.Port.IntValue())
+		assert.Equal("/lab/api/status", probe.HTTPGet.Path)
+		assert.Equal(apiv1.URISchemeHTTPS, probe.HTTPGet.Scheme)
+		assert.Equal(int32(5), probe.PeriodSeconds)
+		assert.Equal(int32(defaultReadinessFailureThreshold), probe.FailureThreshold)
+	}
+
+	settings.ReadinessProbe = &ReadinessProbe{Type: "tcp", InitialDelaySeconds: 20}
+	probe = settings.readinessProbe(job)
+	assert.Nil(probe.HTTPGet)
+	if assert.NotNil(probe.TCPSocket) {
+		assert.Equal(8888, probe.TCPSocket.Port.IntValue())
+		assert.Equal(int32(20), probe.InitialDelaySeconds)
+	}
+}
@@ -0,0 +1,611 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	apiv1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	defaultReaperInterval  = 5 * time.Minute
+	defaultReaperThreshold = 15 * time.Minute
+
+	// reaperGraceMargin is how long past a pod's termination grace period
+	// the reaper waits before it treats the pod as stuck.
+	reaperGraceMargin = 5 * time.Minute
+)
+
+// The actions the deletion reaper takes on analysis resources that are stuck
+// terminating.
+const (
+	// reapForceDeleted is recorded for pods that were deleted without waiting
+	// for the kubelet to confirm that their containers stopped.
+	reapForceDeleted = "force-deleted"
+
+	// reapFinalizersRemoved is recorded for resources whose finalizers were
+	// removed so the API server could finish deleting them.
+	reapFinalizersRemoved = "finalizers-removed"
+
+	// reapEscalated is recorded for resources that can't be cleaned up safely
+	// and need an administrator's attention.
+	reapEscalated = "escalated"
+
+	// reapFailed is recorded when the reaper's own API calls fail.
+	reapFailed = "failed"
+)
+
+// removeFinalizersPatch is a merge patch that clears an object's finalizers.
+var removeFinalizersPatch = []byte(`{"metadata":{"finalizers":null}}`)
+
+// ReapedResource records an action the deletion reaper took on an analysis
+// resource that was stuck terminating.
+type ReapedResource struct {
+	ID                  string    `json:"id" db:"id"`
+	ExternalID          string    `json:"external_id" db:"external_id"`
+	Kind                string    `json:"kind" db:"kind"`
+	Name                string    `json:"name" db:"name"`
+	Action              string    `json:"action" db:"action"`
+	Detail              string    `json:"detail" db:"detail"`
+	DeletionRequestedAt time.Time `json:"deletion_requested_at" db:"deletion_requested_at"`
+	ReapedAt            time.Time `json:"reaped_at" db:"reaped_at"`
+}
+
+// reapableKind lists, patches, and deletes one kind of analysis resource.
+type reapableKind struct {
+	kind   string
+	list   func(ctx context.Context, opts metav1.ListOptions) (runtime.Object, error)
+	patch  func(ctx context.Context, name string, data []byte) error
+	remove func(ctx context.Context, name string) error
+}
+
+// objects returns the items in the list returned by the kind's list function.
+func (k *reapableKind) objects(ctx context.Context, opts metav1.ListOptions) ([]metav1.Object, error) {
+	list, err := k.list(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	items, err := meta.ExtractList(list)
+	if err != nil {
+		return nil, err
+	}
+
+	objs := make([]metav1.Object, 0, len(items))
+	for _, item := range items {
+		obj, err := meta.Accessor(item)
+		if err != nil {
+			return nil, err
+		}
+		objs = append(objs, obj)
+	}
+	return objs, nil
+}
+
+// deleteAnalysisResources deletes the resources created for an analysis
+// without recording anything or notifying the user, and returns the ones it
+// deleted as kind/name. The pods are left for their Deployment to remove.
+// It keeps going after a failure so that as much as possible is removed, and
+// returns the first error.
+func (i *Internal) deleteAnalysisResources(ctx context.Context, externalID string) ([]string, error) {
+	set := labels.Set(map[string]string{
+		"external-id": externalID,
+	})
+	listoptions := metav1.ListOptions{
+		LabelSelector: set.AsSelector().String(),
+	}
+
+	deleted := []string{}
+	var firstErr error
+	for _, kind := range i.reapableKinds() {
+		if kind.kind == "Pod" {
+			continue
+		}
+
+		objs, err := kind.objects(ctx, listoptions)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = errors.Wrapf(err, "error listing the %s resources", kind.kind)
+			}
+			continue
+		}
+
+		for _, obj := range objs {
+			if err = kind.remove(ctx, obj.GetName()); err != nil {
+				if firstErr == nil {
+					firstErr = errors.Wrapf(err, "error deleting %s %s", kind.kind, obj.GetName())
+				}
+				continue
+			}
+			deleted = append(deleted, fmt.Sprintf("%s/%s", kind.kind, obj.GetName()))
+		}
+	}
+	return deleted, firstErr
+}
+
+// reapableKinds returns the kinds of resources created for analyses, in the
+// order the reaper handles them. Pods come first, since a pod that's stuck
+// terminating holds on to its volumes.
+func (i *Internal) reapableKinds() []reapableKind {
+	ns := i.ViceNamespace
+	core := i.clientset.CoreV1()
+	mp := types.MergePatchType
+	po := metav1.PatchOptions{}
+	do := metav1.DeleteOptions{}
+
+	return []reapableKind{
+		{
+			kind: "Pod",
+			list: func(ctx context.Context, opts metav1.ListOptions) (runtime.Object, error) {
+				return core.Pods(ns).List(ctx, opts)
+			},
+			patch: func(ctx context.Context, name string, data []byte) error {
+				_, err := core.Pods(ns).Patch(ctx, name, mp, data, po)
+				return err
+			},
+			remove: func(ctx context.Context, name string) error {
+				return core.Pods(ns).Delete(ctx, name, do)
+			},
+		},
+		{
+			kind: "Deployment",
+			list: func(ctx context.Context, opts metav1.ListOptions) (runtime.Object, error) {
+				return i.clientset.AppsV1().Deployments(ns).List(ctx, opts)
+			},
+			patch: func(ctx context.Context, name string, data []byte) error {
+				_, err := i.clientset.AppsV1().Deployments(ns).Patch(ctx, name, mp, data, po)
+				return err
+			},
+			remove: func(ctx context.Context, name string) error {
+				return i.clientset.AppsV1().Deployments(ns).Delete(ctx, name, do)
+			},
+		},
+		{
+			kind: "Ingress",
+			list: func(ctx context.Context, opts metav1.ListOptions) (runtime.Object, error) {
+				return i.clientset.NetworkingV1().Ingresses(ns).List(ctx, opts)
+			},
+			patch: func(ctx context.Context, name string, data []byte) error {
+				_, err := i.clientset.NetworkingV1().Ingresses(ns).Patch(ctx, name, mp, data, po)
+				return err
+			},
+			remove: func(ctx context.Context, name string) error {
+				return i.clientset.NetworkingV1().Ingresses(ns).Delete(ctx, name, do)
+			},
+		},
+		{
+			kind: "Service",
+			list: func(ctx context.Context, opts metav1.ListOptions) (runtime.Object, error) {
+				return core.Services(ns).List(ctx, opts)
+			},
+			patch: func(ctx context.Context, name string, data []byte) error {
+				_, err := core.Services(ns).Patch(ctx, name, mp, data, po)
+				return err
+			},
+			remove: func(ctx context.Context, name string) error {
+				return core.Services(ns).Delete(ctx, name, do)
+			},
+		},
+		{
+			kind: "PodDisruptionBudget",
+			list: func(ctx context.Context, opts metav1.ListOptions) (runtime.Object, error) {
+				return i.clientset.PolicyV1().PodDisruptionBudgets(ns).List(ctx, opts)
+			},
+			patch: func(ctx context.Context, name string, data []byte) error {
+				_, err := i.clientset.PolicyV1().PodDisruptionBudgets(ns).Patch(ctx, name, mp, data, po)
+				return err
+			},
+			remove: func(ctx context.Context, name string) error {
+				return i.clientset.PolicyV1().PodDisruptionBudgets(ns).Delete(ctx, name, do)
+			},
+		},
+		{
+			kind: "NetworkPolicy",
+			list: func(ctx context.Context, opts metav1.ListOptions) (runtime.Object, error) {
+				return i.clientset.NetworkingV1().NetworkPolicies(ns).List(ctx, opts)
+			},
+			patch: func(ctx context.Context, name string, data []byte) error {
+				_, err := i.clientset.NetworkingV1().NetworkPolicies(ns).Patch(ctx, name, mp, data, po)
+				return err
+			},
+			remove: func(ctx context.Context, name string) error {
+				return i.clientset.NetworkingV1().NetworkPolicies(ns).Delete(ctx, name, do)
+			},
+		},
+		{
+			kind: "ConfigMap",
+			list: func(ctx context.Context, opts metav1.ListOptions) (runtime.Object, error) {
+				return core.ConfigMaps(ns).List(ctx, opts)
+			},
+			patch: func(ctx context.Context, name string, data []byte) error {
+				_, err := core.ConfigMaps(ns).Patch(ctx, name, mp, data, po)
+				return err
+			},
+			remove: func(ctx context.Context, name string) error {
+				return core.ConfigMaps(ns).Delete(ctx, name, do)
+			},
+		},
+		{
+			kind: "Secret",
+			list: func(ctx context.Context, opts metav1.ListOptions) (runtime.Object, error) {
+				return core.Secrets(ns).List(ctx, opts)
+			},
+			patch: func(ctx context.Context, name string, data []byte) error {
+				_, err := core.Secrets(ns).Patch(ctx, name, mp, data, po)
+				return err
+			},
+			remove: func(ctx context.Context, name string) error {
+				return core.Secrets(ns).Delete(ctx, name, do)
+			},
+		},
+		{
+			kind: "PersistentVolumeClaim",
+			list: func(ctx context.Context, opts metav1.ListOptions) (runtime.Object, error) {
+				return core.PersistentVolumeClaims(ns).List(ctx, opts)
+			},
+			patch: func(ctx context.Context, name string, data []byte) error {
+				_, err := core.PersistentVolumeClaims(ns).Patch(ctx, name, mp, data, po)
+				return err
+			},
+			remove: func(ctx context.Context, name string) error {
+				return core.PersistentVolumeClaims(ns).Delete(ctx, name, do)
+			},
+		},
+		{
+			kind: "PersistentVolume",
+			list: func(ctx context.Context, opts metav1.ListOptions) (runtime.Object, error) {
+				return core.PersistentVolumes().List(ctx, opts)
+			},
+			patch: func(ctx context.Context, name string, data []byte) error {
+				_, err := core.PersistentVolumes().Patch(ctx, name, mp, data, po)
+				return err
+			},
+			remove: func(ctx context.Context, name string) error {
+				return core.PersistentVolumes().Delete(ctx, name, do)
+			},
+		},
+	}
+}
+
+// DeletionReaper periodically looks for analysis resources whose deletions
+// have been in progress for longer than a threshold, such as PVCs held by
+// finalizers or pods on nodes that went away, and finishes deleting them.
+// Leftover resources otherwise keep users from relaunching the same quick
+// launch.
+type DeletionReaper struct {
+	internal  *Internal
+	interval  time.Duration
+	threshold time.Duration
+	now       func() time.Time
+
+	// escalated keeps track of the resources that have already been
+	// escalated, so that they're only recorded once.
+	mu        sync.Mutex
+	escalated map[types.UID]bool
+}
+
+// NewDeletionReaper returns a new *DeletionReaper.
+func NewDeletionReaper(i *Internal) *DeletionReaper {
+	r := &DeletionReaper{
+		internal:  i,
+		interval:  i.ReaperInterval,
+		threshold: i.ReaperThreshold,
+		now:       time.Now,
+		escalated: map[types.UID]bool{},
+	}
+	if r.interval <= 0 {
+		r.interval = defaultReaperInterval
+	}
+	if r.threshold <= 0 {
+		r.threshold = defaultReaperThreshold
+	}
+	return r
+}
+
+// thresholdFor returns how long the object's deletion may be in progress
+// before it's considered stuck. Pods are always given their full termination
+// grace period plus a margin, so that analyses that are still shutting down
+// cleanly aren't force-deleted.
+func (r *DeletionReaper) thresholdFor(obj metav1.Object) time.Duration {
+	pod, ok := obj.(*apiv1.Pod)
+	if !ok {
+		return r.threshold
+	}
+
+	seconds := int64(apiv1.DefaultTerminationGracePeriodSeconds)
+	switch {
+	case pod.DeletionGracePeriodSeconds != nil:
+		seconds = *pod.DeletionGracePeriodSeconds
+	case pod.Spec.TerminationGracePeriodSeconds != nil:
+		seconds = *pod.Spec.TerminationGracePeriodSeconds
+	}
+
+	if minimum := time.Duration(seconds)*time.Second + reaperGraceMargin; minimum > r.threshold {
+		return minimum
+	}
+	return r.threshold
+}
+
+// stuck returns true if the object's deletion has been in progress for
+// longer than its threshold.
+func (r *DeletionReaper) stuck(obj metav1.Object) bool {
+	deleted := obj.GetDeletionTimestamp()
+	return deleted != nil && r.now().Sub(deleted.Time) > r.thresholdFor(obj)
+}
+
+// claimInUse returns the names of the pods that still mount the claim.
+func (r *DeletionReaper) claimInUse(ctx context.Context, claimName string) ([]string, error) {
+	pods, err := r.internal.clientset.CoreV1().Pods(r.internal.ViceNamespace).List(ctx, metav1.ListOptions{
+		LabelSelector: "external-id",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, pod := range pods.Items {
+		for _, volume := range pod.Spec.Volumes {
+			if volume.PersistentVolumeClaim != nil && volume.PersistentVolumeClaim.ClaimName == claimName {
+				names = append(names, pod.Name)
+				break
+			}
+		}
+	}
+	return names, nil
+}
+
+// volumeInUse returns what still uses the persistent volume: the nodes it's
+// attached to and the pods that mount the claim bound to it.
+func (r *DeletionReaper) volumeInUse(ctx context.Context, volume *apiv1.PersistentVolume) ([]string, error) {
+	attachments, err := r.internal.clientset.StorageV1().VolumeAttachments().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	users := []string{}
+	for _, attachment := range attachments.Items {
+		source := attachment.Spec.Source.PersistentVolumeName
+		if source != nil && *source == volume.Name {
+			users = append(users, fmt.Sprintf("node %s", attachment.Spec.NodeName))
+		}
+	}
+
+	if volume.Spec.ClaimRef != nil && volume.Spec.ClaimRef.Namespace == r.internal.ViceNamespace {
+		pods, err := r.claimInUse(ctx, volume.Spec.ClaimRef.Name)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, pods...)
+	}
+
+	return users, nil
+}
+
+// reap finishes deleting a single stuck object and returns what was done.
+func (r *DeletionReaper) reap(ctx context.Context, kind reapableKind, obj metav1.Object) *ReapedResource {
+	record := &ReapedResource{
+		ExternalID:          obj.GetLabels()["external-id"],
+		Kind:                kind.kind,
+		Name:                obj.GetName(),
+		DeletionRequestedAt: obj.GetDeletionTimestamp().Time,
+	}
+
+	finalizers := strings.Join(obj.GetFinalizers(), ", ")
+
+	switch kind.kind {
+	case "Pod":
+		// The kubelet confirms that a pod's containers have stopped before
+		// the pod is removed, which never happens if its node is gone.
+		zero := int64(0)
+		err := r.internal.clientset.CoreV1().Pods(r.internal.ViceNamespace).Delete(ctx, obj.GetName(), metav1.DeleteOptions{
+			GracePeriodSeconds: &zero,
+		})
+		if err != nil && !apierrors.IsNotFound(err) {
+			record.Action = reapFailed
+			record.Detail = err.Error()
+			return record
+		}
+		record.Action = reapForceDeleted
+		if len(obj.GetFinalizers()) == 0 {
+			return record
+		}
+
+	case "PersistentVolumeClaim":
+		// Removing the protection finalizer from a claim that a pod still
+		// mounts could delete data the pod is using.
+		pods, err := r.claimInUse(ctx, obj.GetName())
+		if err != nil {
+			record.Action = reapFailed
+			record.Detail = err.Error()
+			return record
+		}
+		if len(pods) > 0 {
+			record.Action = reapEscalated
+			record.Detail = fmt.Sprintf("the claim is still mounted by %s", strings.Join(pods, ", "))
+			return record
+		}
+
+	case "PersistentVolume":
+		// The same goes for a volume that's still attached to a node or
+		// mounted through its claim.
+		volume, ok := obj.(*apiv1.PersistentVolume)
+		if !ok {
+			record.Action = reapFailed
+			record.Detail = fmt.Sprintf("unexpected type %T", obj)
+			return record
+		}
+		users, err := r.volumeInUse(ctx, volume)
+		if err != nil {
+			record.Action = reapFailed
+			record.Detail = err.Error()
+			return record
+		}
+		if len(users) > 0 {
+			record.Action = reapEscalated
+			record.Detail = fmt.Sprintf("the volume is still in use by %s", strings.Join(users, ", "))
+			return record
+		}
+	}
+
+	if len(obj.GetFinalizers()) == 0 {
+		// Nothing the reaper can do will help an object that has no
+		// finalizers left.
+		record.Action = reapEscalated
+		record.Detail = "the object has no finalizers but hasn't been removed"
+		return record
+	}
+
+	if err := kind.patch(ctx, obj.GetName(), removeFinalizersPatch); err != nil && !apierrors.IsNotFound(err) {
+		record.Action = reapFailed
+		record.Detail = err.Error()
+		return record
+	}
+
+	if record.Action == "" {
+		record.Action = reapFinalizersRemoved
+	}
+	record.Detail = fmt.Sprintf("removed finalizers: %s", finalizers)
+
+	return record
+}
+
+const insertReapedResourceSQL = `
+	INSERT INTO vice_reaped_resources (external_id, kind, name, action, detail, deletion_requested_at)
+	VALUES (:external_id, :kind, :name, :action, :detail, :deletion_requested_at)
+`
+
+// check finishes deleting the analysis resources that are stuck terminating
+// and returns the actions it took.
+func (r *DeletionReaper) check(ctx context.Context) ([]ReapedResource, error) {
+	ctx, span := otel.Tracer(otelName).Start(ctx, "DeletionReaper.check")
+	defer span.End()
+
+	opts := metav1.ListOptions{LabelSelector: "external-id"}
+	actions := []ReapedResource{}
+
+	for _, kind := range r.internal.reapableKinds() {
+		objs, err := kind.objects(ctx, opts)
+		if err != nil {
+			return actions, errors.Wrapf(err, "unable to list the %s resources for analyses", kind.kind)
+		}
+
+		for _, obj := range objs {
+			if !r.stuck(obj) {
+				continue
+			}
+
+			record := r.reap(ctx, kind, obj)
+
+			// Escalations are repeated on every pass until an administrator
+			// steps in, so they're only recorded once.
+			if record.Action == reapEscalated {
+				r.mu.Lock()
+				seen := r.escalated[obj.GetUID()]
+				r.escalated[obj.GetUID()] = true
+				r.mu.Unlock()
+				if seen {
+					continue
+				}
+				log.WithContext(ctx).Errorf("%s %s for %s is stuck terminating: %s", record.Kind, record.Name, record.ExternalID, record.Detail)
+			} else {
+				log.WithContext(ctx).Warnf("%s %s for %s was stuck terminating: %s (%s)", record.Kind, record.Name, record.ExternalID, record.Action, record.Detail)
+			}
+
+			if _, err = r.internal.db.NamedExecContext(ctx, insertReapedResourceSQL, record); err != nil {
+				log.WithContext(ctx).Error(errors.Wrapf(err, "unable to record the reaping of %s %s", record.Kind, record.Name))
+			}
+
+			record.ReapedAt = r.now()
+			actions = append(actions, *record)
+		}
+	}
+
+	return actions, nil
+}
+
+// Run checks for stuck deletions periodically until the context is canceled.
+func (r *DeletionReaper) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := r.check(ctx); err != nil {
+				log.WithContext(ctx).Error(err)
+			}
+		}
+	}
+}
+
+// RunDeletionReaper starts reaping analysis resources that are stuck
+// terminating. Blocks until the context is canceled.
+func (i *Internal) RunDeletionReaper(ctx context.Context) {
+	NewDeletionReaper(i).Run(ctx)
+}
+
+const listReapedResourcesSQL = `
+	SELECT id, external_id, kind, name, action, detail, deletion_requested_at, reaped_at
+	  FROM vice_reaped_resources
+	 WHERE ($1 = '' OR external_id = $1)
+	 ORDER BY reaped_at DESC
+	 LIMIT $2
+`
+
+// defaultReapedResourcesLimit is the number of records listed if the request
+// doesn't say.
+const defaultReapedResourcesLimit = 100
+
+// AdminListReapedResourcesHandler lists the actions the deletion reaper has
+// taken, newest first. The optional external-id query parameter limits the
+// list to a single analysis.
+func (i *Internal) AdminListReapedResourcesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	limit := defaultReapedResourcesLimit
+	if value := c.QueryParam("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit must be a positive integer")
+		}
+		limit = n
+	}
+
+	records := []ReapedResource{}
+	if err := i.db.SelectContext(ctx, &records, listReapedResourcesSQL, c.QueryParam("external-id"), limit); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"actions": records,
+	})
+}
+
+// AdminReapHandler runs the deletion reaper immediately and returns the
+// actions it took.
+func (i *Internal) AdminReapHandler(c echo.Context) error {
+	actions, err := NewDeletionReaper(i).check(c.Request().Context())
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"actions": actions,
+	})
+}
@@ -0,0 +1,284 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+var reaperNow = time.Date(2024, 1, 2, 3, 0, 0, 0, time.UTC)
+
+// terminatingMeta returns the metadata for an analysis resource whose deletion
+// was requested the given amount of time before reaperNow.
+func terminatingMeta(name string, age time.Duration, finalizers ...string) metav1.ObjectMeta {
+	deleted := metav1.NewTime(reaperNow.Add(-age))
+	return metav1.ObjectMeta{
+		Name:              name,
+		Namespace:         "vice-apps",
+		UID:               types.UID("uid-" + name),
+		Labels:            map[string]string{"external-id": "e1"},
+		DeletionTimestamp: &deleted,
+		Finalizers:        finalizers,
+	}
+}
+
+func TestDeletionReaperCheck(t *testing.T) {
+	assert := assert.New(t)
+
+	mockdb, mock, err := sqlmock.New()
+	assert.NoError(err)
+	defer mockdb.Close()
+
+	clientset := fake.NewSimpleClientset(
+		// Stuck long enough to be reaped.
+		&apiv1.Pod{ObjectMeta: terminatingMeta("e1-pod", time.Hour)},
+		&netv1.Ingress{ObjectMeta: terminatingMeta("e1-ingress", time.Hour, "example.com/ingress-cleanup")},
+		&apiv1.PersistentVolumeClaim{ObjectMeta: terminatingMeta("e1-pvc", time.Hour, "kubernetes.io/pvc-protection")},
+
+		// Not stuck long enough yet.
+		&apiv1.Service{ObjectMeta: terminatingMeta("e1-svc", time.Minute, "example.com/svc-cleanup")},
+
+		// Not being deleted.
+		&apiv1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "e1-cm", Namespace: "vice-apps", Labels: map[string]string{"external-id": "e1"}}},
+	)
+
+	i := &Internal{
+		Init:      Init{ViceNamespace: "vice-apps"},
+		clientset: clientset,
+		db:        sqlx.NewDb(mockdb, "sqlmock"),
+	}
+	r := NewDeletionReaper(i)
+	r.now = func() time.Time { return reaperNow }
+
+	for n := 0; n < 3; n++ {
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO vice_reaped_resources")).
+			WithArgs(anyArgs(6)...).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+
+	actions, err := r.check(context.Background())
+	assert.NoError(err)
+
+	byName := map[string]ReapedResource{}
+	for _, action := range actions {
+		byName[action.Name] = action
+	}
+	assert.Len(byName, 3)
+	assert.Equal(reapForceDeleted, byName["e1-pod"].Action)
+	assert.Equal(reapFinalizersRemoved, byName["e1-ingress"].Action)
+	assert.Equal("Ingress", byName["e1-ingress"].Kind)
+	assert.Equal("e1", byName["e1-ingress"].ExternalID)
+	assert.Equal(reapFinalizersRemoved, byName["e1-pvc"].Action)
+
+	_, err = clientset.CoreV1().Pods("vice-apps").Get(context.Background(), "e1-pod", metav1.GetOptions{})
+	assert.Error(err)
+
+	ingress, err := clientset.NetworkingV1().Ingresses("vice-apps").Get(context.Background(), "e1-ingress", metav1.GetOptions{})
+	assert.NoError(err)
+	assert.Empty(ingress.Finalizers)
+
+	svc, err := clientset.CoreV1().Services("vice-apps").Get(context.Background(), "e1-svc", metav1.GetOptions{})
+	assert.NoError(err)
+	assert.NotEmpty(svc.Finalizers)
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestDeletionReaperEscalatesMountedClaims(t *testing.T) {
+	assert := assert.New(t)
+
+	mockdb, mock, err := sqlmock.New()
+	assert.NoError(err)
+	defer mockdb.Close()
+
+	pod := &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "e1-pod", Namespace: "vice-apps", Labels: map[string]string{"external-id": "e1"}},
+		Spec: apiv1.PodSpec{
+			Volumes: []apiv1.Volume{
+				{
+					Name: "data",
+					VolumeSource: apiv1.VolumeSource{
+						PersistentVolumeClaim: &apiv1.PersistentVolumeClaimVolumeSource{ClaimName: "e1-pvc"},
+					},
+				},
+			},
+		},
+	}
+	clientset := fake.NewSimpleClientset(
+		pod,
+		&apiv1.PersistentVolumeClaim{ObjectMeta: terminatingMeta("e1-pvc", time.Hour, "kubernetes.io/pvc-protection")},
+	)
+
+	i := &Internal{
+		Init:      Init{ViceNamespace: "vice-apps"},
+		clientset: clientset,
+		db:        sqlx.NewDb(mockdb, "sqlmock"),
+	}
+	r := NewDeletionReaper(i)
+	r.now = func() time.Time { return reaperNow }
+
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO vice_reaped_resources")).
+		WithArgs(anyArgs(6)...).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	actions, err := r.check(context.Background())
+	assert.NoError(err)
+	if assert.Len(actions, 1) {
+		assert.Equal(reapEscalated, actions[0].Action)
+		assert.Contains(actions[0].Detail, "e1-pod")
+	}
+
+	pvc, err := clientset.CoreV1().PersistentVolumeClaims("vice-apps").Get(context.Background(), "e1-pvc", metav1.GetOptions{})
+	assert.NoError(err)
+	assert.NotEmpty(pvc.Finalizers)
+
+	// Escalations are only recorded once.
+	actions, err = r.check(context.Background())
+	assert.NoError(err)
+	assert.Empty(actions)
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestAdminListReapedResourcesHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	mockdb, mock, err := sqlmock.New()
+	assert.NoError(err)
+	defer mockdb.Close()
+
+	i := &Internal{db: sqlx.NewDb(mockdb, "sqlmock")}
+
+	mock.ExpectQuery(regexp.QuoteMeta("FROM vice_reaped_resources")).
+		WithArgs("e1", defaultReapedResourcesLimit).
+		WillReturnRows(sqlmock.NewRows([]string{
+			"id", "external_id", "kind", "name", "action", "detail", "deletion_requested_at", "reaped_at",
+		}).AddRow("r1", "e1", "Ingress", "e1-ingress", reapFinalizersRemoved, "", reaperNow, reaperNow))
+
+	req := httptest.NewRequest(http.MethodGet, "/?external-id=e1", nil)
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+
+	assert.NoError(i.AdminListReapedResourcesHandler(c))
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Contains(rec.Body.String(), `"action":"finalizers-removed"`)
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestDeletionReaperWaitsForGracePeriod(t *testing.T) {
+	assert := assert.New(t)
+
+	grace := int64(3600)
+	pod := &apiv1.Pod{
+		ObjectMeta: terminatingMeta("e1-pod", time.Hour),
+		Spec:       apiv1.PodSpec{TerminationGracePeriodSeconds: &grace},
+	}
+
+	r := NewDeletionReaper(&Internal{Init: Init{ViceNamespace: "vice-apps"}})
+	r.now = func() time.Time { return reaperNow }
+
+	// A pod that's still within its grace period isn't stuck, even though
+	// its deletion has taken longer than the threshold.
+	assert.Equal(time.Hour+reaperGraceMargin, r.thresholdFor(pod))
+	assert.False(r.stuck(pod))
+
+	pod.ObjectMeta = terminatingMeta("e1-pod", 2*time.Hour)
+	assert.True(r.stuck(pod))
+
+	// Other resources only wait for the threshold.
+	svc := &apiv1.Service{ObjectMeta: terminatingMeta("e1-svc", time.Hour)}
+	assert.Equal(defaultReaperThreshold, r.thresholdFor(svc))
+	assert.True(r.stuck(svc))
+}
+
+func TestDeletionReaperEscalatesVolumesInUse(t *testing.T) {
+	assert := assert.New(t)
+
+	mockdb, mock, err := sqlmock.New()
+	assert.NoError(err)
+	defer mockdb.Close()
+
+	attachedPV := &apiv1.PersistentVolume{ObjectMeta: terminatingMeta("e1-pv", time.Hour, "kubernetes.io/pv-protection")}
+	attachedName := attachedPV.Name
+	claimedPV := &apiv1.PersistentVolume{
+		ObjectMeta: terminatingMeta("e2-pv", time.Hour, "kubernetes.io/pv-protection"),
+		Spec: apiv1.PersistentVolumeSpec{
+			ClaimRef: &apiv1.ObjectReference{Namespace: "vice-apps", Name: "e2-pvc"},
+		},
+	}
+	claimedPV.Namespace = ""
+	attachedPV.Namespace = ""
+
+	clientset := fake.NewSimpleClientset(
+		attachedPV,
+		claimedPV,
+		&storagev1.VolumeAttachment{
+			ObjectMeta: metav1.ObjectMeta{Name: "attachment"},
+			Spec: storagev1.VolumeAttachmentSpec{
+				NodeName: "node-1",
+				Source:   storagev1.VolumeAttachmentSource{PersistentVolumeName: &attachedName},
+			},
+		},
+		&apiv1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "e2-pod", Namespace: "vice-apps", Labels: map[string]string{"external-id": "e2"}},
+			Spec: apiv1.PodSpec{
+				Volumes: []apiv1.Volume{
+					{
+						Name: "data",
+						VolumeSource: apiv1.VolumeSource{
+							PersistentVolumeClaim: &apiv1.PersistentVolumeClaimVolumeSource{ClaimName: "e2-pvc"},
+						},
+					},
+				},
+			},
+		},
+	)
+
+	i := &Internal{
+		Init:      Init{ViceNamespace: "vice-apps"},
+		clientset: clientset,
+		db:        sqlx.NewDb(mockdb, "sqlmock"),
+	}
+	r := NewDeletionReaper(i)
+	r.now = func() time.Time { return reaperNow }
+
+	for n := 0; n < 2; n++ {
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO vice_reaped_resources")).
+			WithArgs(anyArgs(6)...).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+
+	actions, err := r.check(context.Background())
+	assert.NoError(err)
+
+	byName := map[string]ReapedResource{}
+	for _, action := range actions {
+		byName[action.Name] = action
+	}
+	assert.Equal(reapEscalated, byName["e1-pv"].Action)
+	assert.Contains(byName["e1-pv"].Detail, "node-1")
+	assert.Equal(reapEscalated, byName["e2-pv"].Action)
+	assert.Contains(byName["e2-pv"].Detail, "e2-pod")
+
+	for _, name := range []string{"e1-pv", "e2-pv"} {
+		pv, err := clientset.CoreV1().PersistentVolumes().Get(context.Background(), name, metav1.GetOptions{})
+		assert.NoError(err)
+		assert.NotEmpty(pv.Finalizers)
+	}
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
@@ -0,0 +1,96 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+
+	apiv1 "k8s.io/api/core/v1"
+)
+
+// dockerHubRegistry is the registry that images without a registry are pulled
+// from.
+const dockerHubRegistry = "docker.io"
+
+// RegistryMirror rewrites the image references for one registry so that the
+// images are pulled from a mirror of it instead. Registry may include a path
+// prefix, such as harbor.cyverse.org/de, to only rewrite the images under it.
+type RegistryMirror struct {
+	Registry string `koanf:"registry"`
+	Mirror   string `koanf:"mirror"`
+}
+
+// RegistryMirrors lists the registry mirrors used by the cluster app-exposer
+// runs in. The image references in analysis submissions and tool settings
+// stay the same in every cluster, and are only rewritten when the analysis's
+// resources are built.
+type RegistryMirrors []RegistryMirror
+
+// Validate returns an error if the configuration can't be used.
+func (m RegistryMirrors) Validate() error {
+	seen := map[string]bool{}
+	for _, mirror := range m {
+		for _, value := range []string{mirror.Registry, mirror.Mirror} {
+			if value == "" || strings.Contains(value, "://") || strings.HasSuffix(value, "/") {
+				return fmt.Errorf("invalid registry mirror %q=%q: registries must be a host name with an optional path", mirror.Registry, mirror.Mirror)
+			}
+		}
+		if seen[mirror.Registry] {
+			return fmt.Errorf("registry %s has more than one mirror", mirror.Registry)
+		}
+		seen[mirror.Registry] = true
+	}
+	return nil
+}
+
+// normalizeImage returns the image reference with the registry included, the
+// same way that the container runtime resolves it. Images without a registry
+// are pulled from Docker Hub, and official Docker Hub images are under
+// library/.
+func normalizeImage(image string) string {
+	first, rest, found := strings.Cut(image, "/")
+	if found && (strings.ContainsAny(first, ".:") || first == "localhost") {
+		return image
+	}
+	if !found {
+		return dockerHubRegistry + "/library/" + first
+	}
+	return dockerHubRegistry + "/" + first + "/" + rest
+}
+
+// Rewrite returns the reference to the image in its registry's mirror, or the
+// image unchanged if its registry isn't mirrored. When more than one mirror
+// matches, the one with the longest registry is used.
+func (m RegistryMirrors) Rewrite(image string) string {
+	if len(m) == 0 || image == "" {
+		return image
+	}
+
+	normalized := normalizeImage(image)
+
+	var match *RegistryMirror
+	for index := range m {
+		mirror := &m[index]
+		if !strings.HasPrefix(normalized, mirror.Registry+"/") {
+			continue
+		}
+		if match == nil || len(mirror.Registry) > len(match.Registry) {
+			match = mirror
+		}
+	}
+	if match == nil {
+		return image
+	}
+
+	return match.Mirror + strings.TrimPrefix(normalized, match.Registry)
+}
+
+// rewriteImages points the containers in the pod spec at the registry
+// mirrors.
+func (i *Internal) rewriteImages(spec *apiv1.PodSpec) {
+	for index := range spec.InitContainers {
+		spec.InitContainers[index].Image = i.RegistryMirrors.Rewrite(spec.InitContainers[index].Image)
+	}
+	for index := range spec.Containers {
+		spec.Containers[index].Image = i.RegistryMirrors.Rewrite(spec.Containers[index].Image)
+	}
+}
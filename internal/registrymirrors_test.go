@@ -0,0 +1,70 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+func TestRegistryMirrorsValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(RegistryMirrors(nil).Validate())
+	assert.NoError(RegistryMirrors{{Registry: "harbor.cyverse.org", Mirror: "mirror.aws.cyverse.org"}}.Validate())
+	assert.Error(RegistryMirrors{{Registry: "harbor.cyverse.org"}}.Validate())
+	assert.Error(RegistryMirrors{{Registry: "https://harbor.cyverse.org", Mirror: "mirror.aws.cyverse.org"}}.Validate())
+	assert.Error(RegistryMirrors{{Registry: "harbor.cyverse.org", Mirror: "mirror.aws.cyverse.org/"}}.Validate())
+	assert.Error(RegistryMirrors{
+		{Registry: "harbor.cyverse.org", Mirror: "mirror.aws.cyverse.org"},
+		{Registry: "harbor.cyverse.org", Mirror: "mirror.gcp.cyverse.org"},
+	}.Validate())
+}
+
+func TestRegistryMirrorsRewrite(t *testing.T) {
+	mirrors := RegistryMirrors{
+		{Registry: "harbor.cyverse.org", Mirror: "mirror.aws.cyverse.org"},
+		{Registry: "harbor.cyverse.org/vice", Mirror: "vice-mirror.aws.cyverse.org/vice"},
+		{Registry: "docker.io", Mirror: "dockerhub.aws.cyverse.org"},
+	}
+
+	tests := []struct {
+		image    string
+		expected string
+	}{
+		{"harbor.cyverse.org/de/porklock:latest", "mirror.aws.cyverse.org/de/porklock:latest"},
+		{"harbor.cyverse.org/vice/proxy:qa", "vice-mirror.aws.cyverse.org/vice/proxy:qa"},
+		{"jupyter/datascience-notebook:latest", "dockerhub.aws.cyverse.org/jupyter/datascience-notebook:latest"},
+		{"ubuntu:22.04", "dockerhub.aws.cyverse.org/library/ubuntu:22.04"},
+		{"docker.io/rocker/rstudio", "dockerhub.aws.cyverse.org/rocker/rstudio"},
+		{"harbor.cyverse.org.evil.com/de/porklock", "harbor.cyverse.org.evil.com/de/porklock"},
+		{"quay.io/jupyter/base-notebook", "quay.io/jupyter/base-notebook"},
+		{"localhost:5000/test", "localhost:5000/test"},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, mirrors.Rewrite(test.image), test.image)
+	}
+
+	// Nothing changes without any mirrors.
+	assert.Equal(t, "ubuntu:22.04", RegistryMirrors(nil).Rewrite("ubuntu:22.04"))
+}
+
+func TestRewriteImages(t *testing.T) {
+	i := &Internal{
+		Init: Init{
+			RegistryMirrors: RegistryMirrors{{Registry: "harbor.cyverse.org", Mirror: "mirror.aws.cyverse.org"}},
+		},
+	}
+	spec := &apiv1.PodSpec{
+		InitContainers: []apiv1.Container{{Name: "input-files", Image: "harbor.cyverse.org/de/porklock:latest"}},
+		Containers: []apiv1.Container{
+			{Name: "analysis", Image: "jupyter/datascience-notebook:latest"},
+			{Name: "vice-proxy", Image: "harbor.cyverse.org/de/vice-proxy:latest"},
+		},
+	}
+
+	i.rewriteImages(spec)
+	assert.Equal(t, "mirror.aws.cyverse.org/de/porklock:latest", spec.InitContainers[0].Image)
+	assert.Equal(t, "jupyter/datascience-notebook:latest", spec.Containers[0].Image)
+	assert.Equal(t, "mirror.aws.cyverse.org/de/vice-proxy:latest", spec.Containers[1].Image)
+}
@@ -0,0 +1,109 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/cyverse-de/model/v6"
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// RegistryPullSecret names the image pull secret used for the images in one
+// registry. Registry may include a path prefix, such as harbor.cyverse.org/de,
+// to only use the secret for the images under it.
+type RegistryPullSecret struct {
+	Registry string `koanf:"registry"`
+	Secret   string `koanf:"secret"`
+}
+
+// RegistryPullSecrets lists the image pull secrets used for the images in
+// particular registries. They're added to an analysis's pod along with the
+// secret named by vice.image-pull-secret, so that each registry's
+// credentials can be kept in a secret of their own.
+type RegistryPullSecrets []RegistryPullSecret
+
+// Validate returns an error if the configuration can't be used.
+func (s RegistryPullSecrets) Validate() error {
+	seen := map[string]bool{}
+	for _, secret := range s {
+		if secret.Registry == "" || strings.Contains(secret.Registry, "://") || strings.HasSuffix(secret.Registry, "/") {
+			return fmt.Errorf("invalid registry %q for pull secret %q: registries must be a host name with an optional path", secret.Registry, secret.Secret)
+		}
+		if secret.Secret == "" {
+			return fmt.Errorf("the pull secret for registry %s must be set", secret.Registry)
+		}
+		if seen[secret.Registry] {
+			return fmt.Errorf("registry %s has more than one pull secret", secret.Registry)
+		}
+		seen[secret.Registry] = true
+	}
+	return nil
+}
+
+// SecretFor returns the name of the pull secret for the image, or an empty
+// string if its registry doesn't have one. When more than one registry
+// matches, the longest one is used.
+func (s RegistryPullSecrets) SecretFor(image string) string {
+	if len(s) == 0 || image == "" {
+		return ""
+	}
+
+	normalized := normalizeImage(image)
+
+	var match *RegistryPullSecret
+	for index := range s {
+		secret := &s[index]
+		if !strings.HasPrefix(normalized, secret.Registry+"/") {
+			continue
+		}
+		if match == nil || len(secret.Registry) > len(match.Registry) {
+			match = secret
+		}
+	}
+	if match == nil {
+		return ""
+	}
+	return match.Secret
+}
+
+// registryPullSecretNames returns the names of the pull secrets for the
+// registries of the job's images, without duplicates.
+func (i *Internal) registryPullSecretNames(job *model.Job) []string {
+	names := []string{}
+	seen := map[string]bool{}
+	for idx := range job.Steps {
+		name := i.RegistryPullSecrets.SecretFor(job.Steps[idx].Component.Container.Image.Name)
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	return names
+}
+
+// checkRegistryPullSecrets returns an error if the pull secrets for the
+// registries of the job's images don't exist in the VICE namespace.
+func (i *Internal) checkRegistryPullSecrets(ctx context.Context, job *model.Job) error {
+	for _, name := range i.registryPullSecretNames(job) {
+		_, err := i.clientset.CoreV1().Secrets(i.ViceNamespace).Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return common.ErrorResponse{
+				ErrorCode: "ERR_IMAGE_PULL_SECRET_MISSING",
+				Message:   fmt.Sprintf("the image pull secret %s doesn't exist in namespace %s", name, i.ViceNamespace),
+				Details: &map[string]interface{}{
+					"secret":    name,
+					"namespace": i.ViceNamespace,
+				},
+			}
+		}
+		if err != nil {
+			return errors.Wrapf(err, "error getting the image pull secret %s", name)
+		}
+	}
+	return nil
+}
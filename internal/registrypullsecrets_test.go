@@ -0,0 +1,106 @@
+package internal
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/cyverse-de/model/v6"
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+func TestRegistryPullSecretsValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(RegistryPullSecrets(nil).Validate())
+	assert.NoError(RegistryPullSecrets{{Registry: "ghcr.io", Secret: "ghcr-pull-secret"}}.Validate())
+	assert.Error(RegistryPullSecrets{{Registry: "ghcr.io"}}.Validate())
+	assert.Error(RegistryPullSecrets{{Registry: "https://ghcr.io", Secret: "ghcr-pull-secret"}}.Validate())
+	assert.Error(RegistryPullSecrets{{Registry: "ghcr.io/", Secret: "ghcr-pull-secret"}}.Validate())
+	assert.Error(RegistryPullSecrets{
+		{Registry: "ghcr.io", Secret: "ghcr-pull-secret"},
+		{Registry: "ghcr.io", Secret: "other-pull-secret"},
+	}.Validate())
+}
+
+func TestRegistryPullSecretsSecretFor(t *testing.T) {
+	secrets := RegistryPullSecrets{
+		{Registry: "harbor.cyverse.org", Secret: "harbor-pull-secret"},
+		{Registry: "harbor.cyverse.org/private", Secret: "harbor-private-pull-secret"},
+		{Registry: "docker.io", Secret: "dockerhub-pull-secret"},
+	}
+
+	tests := []struct {
+		image    string
+		expected string
+	}{
+		{"harbor.cyverse.org/de/rstudio", "harbor-pull-secret"},
+		{"harbor.cyverse.org/private/jupyter", "harbor-private-pull-secret"},
+		{"jupyter/datascience-notebook", "dockerhub-pull-secret"},
+		{"ubuntu", "dockerhub-pull-secret"},
+		{"harbor.cyverse.org.evil.com/de/rstudio", ""},
+		{"ghcr.io/cyverse/vscode", ""},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, secrets.SecretFor(test.image), test.image)
+	}
+
+	assert.Equal(t, "", RegistryPullSecrets(nil).SecretFor("ubuntu"))
+}
+
+// pullSecretTestJob returns a job with a step for each image.
+func pullSecretTestJob(images ...string) *model.Job {
+	job := &model.Job{}
+	for _, image := range images {
+		step := model.Step{}
+		step.Component.Container.Image.Name = image
+		job.Steps = append(job.Steps, step)
+	}
+	return job
+}
+
+func TestImagePullSecrets(t *testing.T) {
+	assert := assert.New(t)
+
+	i := &Internal{
+		Init: Init{
+			ImagePullSecretName: "vice-image-pull-secret",
+			RegistryPullSecrets: RegistryPullSecrets{
+				{Registry: "harbor.cyverse.org", Secret: "vice-image-pull-secret"},
+				{Registry: "ghcr.io", Secret: "ghcr-pull-secret"},
+			},
+		},
+	}
+
+	assert.Equal([]apiv1.LocalObjectReference{{Name: "vice-image-pull-secret"}, {Name: "ghcr-pull-secret"}},
+		i.imagePullSecrets(pullSecretTestJob("ghcr.io/cyverse/vscode", "harbor.cyverse.org/de/rstudio", "ghcr.io/cyverse/vscode-extras")))
+	assert.Equal([]apiv1.LocalObjectReference{{Name: "vice-image-pull-secret"}},
+		i.imagePullSecrets(pullSecretTestJob("quay.io/jupyter/base-notebook")))
+
+	i.ImagePullSecretName = ""
+	assert.Equal([]apiv1.LocalObjectReference{{Name: "ghcr-pull-secret"}},
+		i.imagePullSecrets(pullSecretTestJob("ghcr.io/cyverse/vscode")))
+	assert.Equal([]apiv1.LocalObjectReference{}, i.imagePullSecrets(pullSecretTestJob("ubuntu")))
+}
+
+func TestCheckRegistryPullSecrets(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	i := newPullSecretsTestInternal(dockerConfigSecret("vice-apps", "ghcr-pull-secret", `{"auths":{"ghcr.io":{"auth":"Z2g="}}}`))
+	i.RegistryPullSecrets = RegistryPullSecrets{
+		{Registry: "ghcr.io", Secret: "ghcr-pull-secret"},
+		{Registry: "quay.io", Secret: "quay-pull-secret"},
+	}
+
+	assert.NoError(i.checkRegistryPullSecrets(ctx, pullSecretTestJob("ghcr.io/cyverse/vscode")))
+	assert.NoError(i.checkRegistryPullSecrets(ctx, pullSecretTestJob("harbor.cyverse.org/de/rstudio")))
+
+	err := i.checkRegistryPullSecrets(ctx, pullSecretTestJob("quay.io/jupyter/base-notebook"))
+	if assert.Error(err) {
+		errResp := err.(common.ErrorResponse)
+		assert.Equal("ERR_IMAGE_PULL_SECRET_MISSING", errResp.ErrorCode)
+		assert.Equal("quay-pull-secret", (*errResp.Details)["secret"])
+	}
+}
@@ -0,0 +1,307 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/labstack/echo/v4"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// relabelableLabels are the labels that relabeling can fill in.
+var relabelableLabels = []string{"subdomain", "login-ip", "analysis-id"}
+
+// The statuses reported for each resource that's considered for relabeling.
+const (
+	relabelUnchanged   = "unchanged"
+	relabelWouldUpdate = "would-update"
+	relabelUpdated     = "updated"
+	relabelFailed      = "failed"
+)
+
+// RelabelRequest selects the VICE resources to relabel.
+type RelabelRequest struct {
+	// User limits relabeling to the analyses of a single user.
+	User string `json:"user"`
+
+	// ExternalID limits relabeling to a single analysis.
+	ExternalID string `json:"external_id"`
+
+	// MissingLabels limits relabeling to resources missing at least one of
+	// the labels. Defaults to all of the labels relabeling can fill in.
+	MissingLabels []string `json:"missing_labels"`
+
+	// DryRun reports what would change without updating anything.
+	DryRun bool `json:"dry_run"`
+}
+
+// RelabelResult describes what happened to a single resource.
+type RelabelResult struct {
+	Kind       string            `json:"kind"`
+	Name       string            `json:"name"`
+	ExternalID string            `json:"external_id"`
+	Status     string            `json:"status"`
+	Added      map[string]string `json:"added,omitempty"`
+	Errors     []string          `json:"errors,omitempty"`
+}
+
+// RelabelResponse is the response body for relabeling requests.
+type RelabelResponse struct {
+	DryRun  bool            `json:"dry_run"`
+	Results []RelabelResult `json:"results"`
+}
+
+// relabelTarget is a resource that may be relabeled.
+type relabelTarget struct {
+	kind   string
+	object metav1.Object
+	update func(ctx context.Context) error
+}
+
+// validate returns an error if the request asks for labels that relabeling
+// can't fill in.
+func (r *RelabelRequest) validate() error {
+	for _, label := range r.MissingLabels {
+		supported := false
+		for _, relabelable := range relabelableLabels {
+			if label == relabelable {
+				supported = true
+				break
+			}
+		}
+		if !supported {
+			return fmt.Errorf("label %s can't be filled in by relabeling; supported labels are %v", label, relabelableLabels)
+		}
+	}
+	return nil
+}
+
+// missingAny returns true if the labels are missing at least one of the keys.
+func missingAny(existing map[string]string, keys []string) bool {
+	for _, key := range keys {
+		if _, ok := existing[key]; !ok {
+			return true
+		}
+	}
+	return false
+}
+
+// desiredLabels returns a copy of the existing labels with the missing labels
+// filled in from the lookups, along with any labels that couldn't be filled
+// in as errors.
+func desiredLabels(lookups *labelLookups, existing map[string]string) (map[string]string, []error) {
+	desired := make(map[string]string, len(existing))
+	for k, v := range existing {
+		desired[k] = v
+	}
+
+	errs := []error{}
+	var err error
+
+	desired = populateSubdomain(desired)
+
+	if desired, err = populateLoginIP(lookups, desired); err != nil {
+		errs = append(errs, err)
+	}
+
+	if desired, err = populateAnalysisID(lookups, desired); err != nil {
+		errs = append(errs, err)
+	}
+
+	return desired, errs
+}
+
+// relabelTargets lists the resources matching the filter.
+func (i *Internal) relabelTargets(ctx context.Context, filter map[string]string) ([]relabelTarget, error) {
+	targets := []relabelTarget{}
+
+	deployments, err := i.deploymentList(ctx, i.ViceNamespace, filter, []string{})
+	if err != nil {
+		return nil, err
+	}
+	for idx := range deployments.Items {
+		deployment := &deployments.Items[idx]
+		targets = append(targets, relabelTarget{
+			kind:   "Deployment",
+			object: deployment,
+			update: func(ctx context.Context) error {
+				_, err := i.clientset.AppsV1().Deployments(i.ViceNamespace).Update(ctx, deployment, metav1.UpdateOptions{})
+				return err
+			},
+		})
+	}
+
+	cms, err := i.configmapsList(ctx, i.ViceNamespace, filter, []string{})
+	if err != nil {
+		return nil, err
+	}
+	for idx := range cms.Items {
+		configmap := &cms.Items[idx]
+		targets = append(targets, relabelTarget{
+			kind:   "ConfigMap",
+			object: configmap,
+			update: func(ctx context.Context) error {
+				_, err := i.clientset.CoreV1().ConfigMaps(i.ViceNamespace).Update(ctx, configmap, metav1.UpdateOptions{})
+				return err
+			},
+		})
+	}
+
+	svcs, err := i.serviceList(ctx, i.ViceNamespace, filter, []string{})
+	if err != nil {
+		return nil, err
+	}
+	for idx := range svcs.Items {
+		service := &svcs.Items[idx]
+		targets = append(targets, relabelTarget{
+			kind:   "Service",
+			object: service,
+			update: func(ctx context.Context) error {
+				_, err := i.clientset.CoreV1().Services(i.ViceNamespace).Update(ctx, service, metav1.UpdateOptions{})
+				return err
+			},
+		})
+	}
+
+	ingresses, err := i.ingressList(ctx, i.ViceNamespace, filter, []string{})
+	if err != nil {
+		return nil, err
+	}
+	for idx := range ingresses.Items {
+		ingress := &ingresses.Items[idx]
+		targets = append(targets, relabelTarget{
+			kind:   "Ingress",
+			object: ingress,
+			update: func(ctx context.Context) error {
+				_, err := i.clientset.NetworkingV1().Ingresses(i.ViceNamespace).Update(ctx, ingress, metav1.UpdateOptions{})
+				return err
+			},
+		})
+	}
+
+	return targets, nil
+}
+
+// relabel fills in the missing labels of the resources matching the filter.
+// Nothing is updated in a dry run.
+func (i *Internal) relabel(ctx context.Context, filter map[string]string, missingLabels []string, dryRun bool) ([]RelabelResult, error) {
+	if len(missingLabels) == 0 {
+		missingLabels = relabelableLabels
+	}
+
+	targets, err := i.relabelTargets(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	// The values for the missing labels are looked up for all of the targets
+	// at once.
+	selected := []relabelTarget{}
+	labelSets := []map[string]string{}
+	for _, target := range targets {
+		if missingAny(target.object.GetLabels(), missingLabels) {
+			selected = append(selected, target)
+			labelSets = append(labelSets, target.object.GetLabels())
+		}
+	}
+	lookups, lookupErr := i.lookupLabelValues(ctx, labelSets)
+
+	results := []RelabelResult{}
+	for _, target := range selected {
+		existing := target.object.GetLabels()
+
+		result := RelabelResult{
+			Kind:       target.kind,
+			Name:       target.object.GetName(),
+			ExternalID: existing["external-id"],
+			Added:      map[string]string{},
+		}
+
+		desired, errs := desiredLabels(lookups, existing)
+		if lookupErr != nil {
+			result.Errors = append(result.Errors, lookupErr.Error())
+		}
+		for _, err := range errs {
+			result.Errors = append(result.Errors, err.Error())
+		}
+
+		for k, v := range desired {
+			if _, ok := existing[k]; !ok {
+				result.Added[k] = v
+			}
+		}
+
+		switch {
+		case len(result.Added) == 0 && len(result.Errors) > 0:
+			result.Status = relabelFailed
+		case len(result.Added) == 0:
+			result.Status = relabelUnchanged
+		case dryRun:
+			result.Status = relabelWouldUpdate
+		default:
+			target.object.SetLabels(desired)
+			if err = target.update(ctx); err != nil {
+				result.Status = relabelFailed
+				result.Errors = append(result.Errors, err.Error())
+			} else {
+				result.Status = relabelUpdated
+			}
+		}
+
+		results = append(results, result)
+	}
+
+	sort.SliceStable(results, func(a, b int) bool {
+		return results[a].ExternalID < results[b].ExternalID
+	})
+
+	return results, nil
+}
+
+// AdminRelabelHandler fills in the missing labels of selected VICE resources
+// so that operators can repair specific analyses without relabeling the whole
+// namespace. The request body may limit relabeling to a user, an analysis, or
+// resources missing particular labels, and may ask for a dry run that only
+// reports what would change.
+func (i *Internal) AdminRelabelHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	req := &RelabelRequest{}
+	if err := c.Bind(req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if err := req.validate(); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	filter := map[string]string{}
+	if req.ExternalID != "" {
+		filter["external-id"] = req.ExternalID
+	}
+	if req.User != "" {
+		// Since some usernames don't come through the labelling process
+		// unscathed, we have to use the user ID.
+		user := i.fixUsername(req.User)
+		userID, err := i.apps.GetUserID(ctx, user)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("user %s not found", user))
+			}
+			return err
+		}
+		filter["user-id"] = userID
+	}
+
+	results, err := i.relabel(ctx, filter, req.MissingLabels, req.DryRun)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, &RelabelResponse{
+		DryRun:  req.DryRun,
+		Results: results,
+	})
+}
@@ -0,0 +1,99 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cyverse-de/app-exposer/apps"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestRelabelRequestValidate(t *testing.T) {
+	assert.NoError(t, (&RelabelRequest{MissingLabels: []string{"login-ip"}}).validate())
+	assert.Error(t, (&RelabelRequest{MissingLabels: []string{"app-name"}}).validate())
+}
+
+func TestRelabel(t *testing.T) {
+	assert := assert.New(t)
+
+	mockdb, mock, err := sqlmock.New()
+	assert.NoError(err)
+	defer mockdb.Close()
+
+	a := apps.NewApps(sqlx.NewDb(mockdb, "sqlmock"), "@example.org")
+	a.ConfigureCache(&apps.CacheConfig{MaxEntries: 10, AnalysisIDTTL: time.Hour, UserIPTTL: time.Hour})
+
+	labeled := &apiv1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "e1-labeled",
+			Namespace: "vice-apps",
+			Labels: map[string]string{
+				"app-type":    "interactive",
+				"external-id": "e1",
+				"user-id":     "u1",
+				"subdomain":   IngressName("u1", "e1"),
+				"login-ip":    "10.0.0.1",
+				"analysis-id": "a1",
+			},
+		},
+	}
+
+	clientset := fake.NewSimpleClientset(
+		warmTestDeployment("e1", "u1"),
+		warmTestDeployment("e2", "u2"),
+		labeled,
+	)
+	i := &Internal{Init: Init{ViceNamespace: "vice-apps"}, clientset: clientset, apps: a}
+
+	mock.ExpectQuery("SELECT s.external_id, j.id").
+		WithArgs(pq.Array([]string{"e1"})).
+		WillReturnRows(sqlmock.NewRows([]string{"external_id", "id"}).AddRow("e1", "a1"))
+	mock.ExpectQuery("l.ip_address").
+		WithArgs(pq.Array([]string{"u1"})).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "ip_address"}).AddRow("u1", "10.0.0.1"))
+
+	filter := map[string]string{"external-id": "e1"}
+
+	// A dry run reports the changes without making them.
+	results, err := i.relabel(context.Background(), filter, nil, true)
+	assert.NoError(err)
+	if assert.Len(results, 1) {
+		assert.Equal("Deployment", results[0].Kind)
+		assert.Equal(relabelWouldUpdate, results[0].Status)
+		assert.Equal(map[string]string{
+			"subdomain":   IngressName("u1", "e1"),
+			"login-ip":    "10.0.0.1",
+			"analysis-id": "a1",
+		}, results[0].Added)
+	}
+
+	deployment, err := clientset.AppsV1().Deployments("vice-apps").Get(context.Background(), "e1", metav1.GetOptions{})
+	assert.NoError(err)
+	assert.NotContains(deployment.Labels, "login-ip")
+
+	// The lookups are cached, so the second run doesn't query the database.
+	results, err = i.relabel(context.Background(), filter, nil, false)
+	assert.NoError(err)
+	if assert.Len(results, 1) {
+		assert.Equal(relabelUpdated, results[0].Status)
+	}
+
+	deployment, err = clientset.AppsV1().Deployments("vice-apps").Get(context.Background(), "e1", metav1.GetOptions{})
+	assert.NoError(err)
+	assert.Equal("10.0.0.1", deployment.Labels["login-ip"])
+	assert.Equal("a1", deployment.Labels["analysis-id"])
+
+	// Nothing is left to relabel.
+	results, err = i.relabel(context.Background(), filter, nil, false)
+	assert.NoError(err)
+	assert.Empty(results)
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
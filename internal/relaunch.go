@@ -0,0 +1,161 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/cyverse-de/app-exposer/permissions"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+)
+
+// RelaunchRequest is the optional request body for relaunching an analysis.
+// The fields that are set replace the ones in the original submission.
+type RelaunchRequest struct {
+	Name      *string `json:"name"`
+	OutputDir *string `json:"output_dir"`
+
+	// Config contains parameter values keyed by their IDs in the submission's
+	// config. Parameters that aren't listed keep their original values.
+	Config map[string]interface{} `json:"config"`
+}
+
+const getAnalysisSubmissionSQL = `
+	SELECT submission
+	  FROM jobs
+	 WHERE id = $1
+`
+
+// getAnalysisSubmission returns the submission the analysis was launched
+// from.
+func (i *Internal) getAnalysisSubmission(ctx context.Context, analysisID string) (map[string]interface{}, error) {
+	var submission []byte
+	err := i.db.QueryRowxContext(ctx, getAnalysisSubmissionSQL, analysisID).Scan(&submission)
+	if err == sql.ErrNoRows {
+		return nil, echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("analysis %s was not found", analysisID))
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "error looking up the submission for analysis %s", analysisID)
+	}
+	if len(submission) == 0 {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("analysis %s doesn't have a stored submission", analysisID))
+	}
+
+	body := map[string]interface{}{}
+	if err = json.Unmarshal(submission, &body); err != nil {
+		return nil, errors.Wrapf(err, "error parsing the submission for analysis %s", analysisID)
+	}
+	return body, nil
+}
+
+// relaunchSubmission returns the submission for relaunching the analysis
+// with the overrides applied. The outputs go to a new folder under the
+// original output folder if the user launched the original analysis, or
+// under the user's analyses folder if it was shared with them.
+func (i *Internal) relaunchSubmission(body map[string]interface{}, req *RelaunchRequest, user, owner string) (map[string]interface{}, error) {
+	if req.Name != nil {
+		name := strings.TrimSpace(*req.Name)
+		if name == "" {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "name must not be empty")
+		}
+		body["name"] = name
+	}
+
+	switch {
+	case req.OutputDir != nil:
+		if strings.TrimSpace(*req.OutputDir) == "" {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "output_dir must not be empty")
+		}
+		body["output_dir"] = *req.OutputDir
+	case user != owner:
+		body["output_dir"] = i.userAnalysesDir(user)
+	}
+	body["create_output_subdir"] = true
+
+	if len(req.Config) > 0 {
+		config, ok := body["config"].(map[string]interface{})
+		if !ok {
+			config = map[string]interface{}{}
+		}
+		for id, value := range req.Config {
+			config[id] = value
+		}
+		body["config"] = config
+	}
+
+	return body, nil
+}
+
+// RelaunchAnalysisHandler launches a new analysis from the submission of an
+// existing one, with the overrides in the request body applied, so that users
+// can repeat a run without filling in the launch form again. Users can
+// relaunch the analyses they can access; the new analysis belongs to the
+// user making the request. Both VICE and batch analyses can be relaunched.
+func (i *Internal) RelaunchAnalysisHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	analysisID := c.Param("analysis-id")
+	if analysisID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "analysis-id parameter is empty")
+	}
+
+	user := strings.TrimSuffix(c.QueryParam("user"), i.UserSuffix)
+	if user == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "user query parameter must be set")
+	}
+
+	req := &RelaunchRequest{}
+	if err := c.Bind(req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	p := &permissions.Permissions{
+		BaseURL: i.PermissionsURL,
+	}
+	allowed, err := p.IsAllowed(ctx, user, analysisID)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("user %s cannot access analysis %s", user, analysisID))
+	}
+
+	owner, _, err := i.apps.GetUserByAnalysisID(ctx, analysisID)
+	if err == sql.ErrNoRows {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("analysis %s was not found", analysisID))
+	}
+	if err != nil {
+		return errors.Wrapf(err, "error looking up the owner of analysis %s", analysisID)
+	}
+
+	body, err := i.getAnalysisSubmission(ctx, analysisID)
+	if err != nil {
+		return err
+	}
+
+	body, err = i.relaunchSubmission(body, req, user, owner)
+	if err != nil {
+		return err
+	}
+
+	// Submissions the apps service refuses, for example because the user
+	// has reached their job limit, are passed back to the caller.
+	newID, err := i.submitAnalysis(ctx, body, user)
+	if appsErr, ok := err.(*appsServiceError); ok && appsErr.statusCode < http.StatusInternalServerError {
+		return echo.NewHTTPError(appsErr.statusCode, appsErr.message)
+	}
+	if err != nil {
+		return err
+	}
+
+	log.WithContext(ctx).Infof("%s relaunched analysis %s as %s", user, analysisID, newID)
+
+	return c.JSON(http.StatusOK, map[string]string{
+		"analysis_id":     newID,
+		"relaunched_from": analysisID,
+	})
+}
@@ -0,0 +1,116 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cyverse-de/app-exposer/apps"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRelaunchAnalysisHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	permissionsServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/permissions/subjects/user/stranger/analysis/a1" {
+			w.Write([]byte(`{"permissions": []}`)) // nolint:errcheck
+			return
+		}
+		w.Write([]byte(`{"permissions": [{"permission_level": "read"}]}`)) // nolint:errcheck
+	}))
+	defer permissionsServer.Close()
+
+	var submitted map[string]interface{}
+	appsServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		submitted = map[string]interface{}{}
+		assert.NoError(json.NewDecoder(r.Body).Decode(&submitted))
+		if r.URL.Query().Get("user") == "limited" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`job limit reached`)) // nolint:errcheck
+			return
+		}
+		w.Write([]byte(`{"id": "a2"}`)) // nolint:errcheck
+	}))
+	defer appsServer.Close()
+
+	mockdb, mock, err := sqlmock.New()
+	assert.NoError(err)
+	defer mockdb.Close()
+	db := sqlx.NewDb(mockdb, "sqlmock")
+
+	i := &Internal{
+		Init: Init{
+			UserSuffix:         "@example.org",
+			IRODSZone:          "iplant",
+			PermissionsURL:     permissionsServer.URL,
+			AppsServiceBaseURL: appsServer.URL,
+		},
+		db:   db,
+		apps: apps.NewApps(db, "@example.org"),
+	}
+
+	relaunch := func(user, body string) (*httptest.ResponseRecorder, error) {
+		req := httptest.NewRequest(http.MethodPost, "/analyses/a1/relaunch?user="+user, strings.NewReader(body))
+		if body != "" {
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		}
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(req, rec)
+		c.SetParamNames("analysis-id")
+		c.SetParamValues("a1")
+		return rec, i.RelaunchAnalysisHandler(c)
+	}
+	expectLookups := func() {
+		mock.ExpectQuery("SELECT u.username").WithArgs("a1").
+			WillReturnRows(sqlmock.NewRows([]string{"username", "id"}).AddRow("ipcdev@example.org", "u1"))
+		mock.ExpectQuery("SELECT submission").WithArgs("a1").
+			WillReturnRows(sqlmock.NewRows([]string{"submission"}).AddRow(
+				`{"name": "run", "app_id": "app1", "output_dir": "/iplant/home/ipcdev/analyses/run", "config": {"s1_p1": "a", "s1_p2": "b"}}`,
+			))
+	}
+
+	// The owner's relaunch reuses the original output folder, with the
+	// overrides applied.
+	expectLookups()
+	rec, err := relaunch("ipcdev", `{"name": "run again", "config": {"s1_p2": "c"}}`)
+	assert.NoError(err)
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.JSONEq(`{"analysis_id": "a2", "relaunched_from": "a1"}`, rec.Body.String())
+	assert.Equal("run again", submitted["name"])
+	assert.Equal("app1", submitted["app_id"])
+	assert.Equal("/iplant/home/ipcdev/analyses/run", submitted["output_dir"])
+	assert.Equal(true, submitted["create_output_subdir"])
+	assert.Equal(map[string]interface{}{"s1_p1": "a", "s1_p2": "c"}, submitted["config"])
+	assert.NoError(mock.ExpectationsWereMet())
+
+	// Users the analysis was shared with get the outputs in their own folder.
+	expectLookups()
+	_, err = relaunch("friend", "")
+	assert.NoError(err)
+	assert.Equal("/iplant/home/friend/analyses", submitted["output_dir"])
+	assert.Equal("run", submitted["name"])
+	assert.NoError(mock.ExpectationsWereMet())
+
+	// Users who can't access the analysis can't relaunch it.
+	_, err = relaunch("stranger", "")
+	if assert.Error(err) {
+		assert.Equal(http.StatusForbidden, err.(*echo.HTTPError).Code)
+	}
+
+	// Launches the apps service refuses are passed back.
+	expectLookups()
+	_, err = relaunch("limited", "")
+	if assert.Error(err) {
+		httpErr := err.(*echo.HTTPError)
+		assert.Equal(http.StatusBadRequest, httpErr.Code)
+		assert.Equal("job limit reached", httpErr.Message)
+	}
+	assert.NoError(mock.ExpectationsWereMet())
+}
@@ -0,0 +1,75 @@
+package internal
+
+import (
+	"net/url"
+
+	"github.com/cyverse-de/app-exposer/resourcing"
+	"github.com/pkg/errors"
+)
+
+// ReloadableConfig contains the settings that can be changed while
+// app-exposer is running.
+type ReloadableConfig struct {
+	ResourcePresets resourcing.Presets
+	Embedding       EmbeddingConfig
+	Maintenance     MaintenanceConfig
+
+	// JobStatusURL is the base URL of the job-status-listener service that
+	// status updates are posted to.
+	JobStatusURL string
+}
+
+// Validate returns an error if the settings can't be used.
+func (c *ReloadableConfig) Validate() error {
+	if err := c.ResourcePresets.Validate(); err != nil {
+		return err
+	}
+	if err := c.Embedding.Validate(); err != nil {
+		return err
+	}
+	if err := c.Maintenance.Validate(); err != nil {
+		return err
+	}
+	if c.JobStatusURL == "" {
+		return errors.New("the job status URL must be set")
+	}
+	if _, err := url.Parse(c.JobStatusURL); err != nil {
+		return errors.Wrapf(err, "invalid job status URL %s", c.JobStatusURL)
+	}
+	return nil
+}
+
+// reloadable returns the settings that can be changed while app-exposer is
+// running. Use it instead of reading the settings from Init directly.
+func (i *Internal) reloadable() ReloadableConfig {
+	i.reloadMu.RLock()
+	defer i.reloadMu.RUnlock()
+	return ReloadableConfig{
+		ResourcePresets: i.ResourcePresets,
+		Embedding:       i.Embedding,
+		Maintenance:     i.Maintenance,
+		JobStatusURL:    i.JobStatusURL,
+	}
+}
+
+// Reload replaces the settings that can be changed while app-exposer is
+// running. Nothing is changed if the settings are invalid. Requests that are
+// already being handled may finish with the old settings.
+func (i *Internal) Reload(cfg *ReloadableConfig) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	i.reloadMu.Lock()
+	i.ResourcePresets = cfg.ResourcePresets
+	i.Embedding = cfg.Embedding
+	i.Maintenance = cfg.Maintenance
+	i.JobStatusURL = cfg.JobStatusURL
+	i.reloadMu.Unlock()
+
+	if i.jsl != nil {
+		i.jsl.setStatusURL(cfg.JobStatusURL)
+	}
+
+	return nil
+}
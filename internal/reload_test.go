@@ -0,0 +1,39 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/cyverse-de/app-exposer/resourcing"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReload(t *testing.T) {
+	assert := assert.New(t)
+
+	i := New(&Init{JobStatusURL: "http://job-status-listener"}, nil, nil, nil)
+	assert.NoError(i.checkMaintenance())
+
+	cfg := &ReloadableConfig{
+		ResourcePresets: resourcing.Presets{{Name: "small", CPUCores: 1, Memory: "4Gi"}},
+		Embedding:       EmbeddingConfig{Enabled: true, DefaultFrameAncestors: []string{"'self'"}},
+		Maintenance:     MaintenanceConfig{Enabled: true, Message: "back soon"},
+		JobStatusURL:    "http://job-status-listener.de",
+	}
+	assert.NoError(i.Reload(cfg))
+
+	assert.Contains(i.checkMaintenance().Error(), "back soon")
+	assert.Equal(cfg.ResourcePresets, i.reloadable().ResourcePresets)
+	assert.NotNil(i.ingressAnnotations(&ToolSettings{}))
+	assert.Equal("http://job-status-listener.de", i.jsl.getStatusURL())
+
+	// Nothing is changed if any of the settings are invalid.
+	assert.Error(i.Reload(&ReloadableConfig{
+		Maintenance:  MaintenanceConfig{Enabled: false},
+		Embedding:    EmbeddingConfig{DefaultFrameAncestors: []string{"*"}},
+		JobStatusURL: "http://job-status-listener",
+	}))
+	assert.Error(i.checkMaintenance())
+	assert.Equal("http://job-status-listener.de", i.jsl.getStatusURL())
+
+	assert.Error(i.Reload(&ReloadableConfig{}))
+}
@@ -8,8 +8,8 @@ import (
 	"net/url"
 	"strings"
 
-	"github.com/cyverse-de/app-exposer/apps"
 	"github.com/cyverse-de/app-exposer/permissions"
+	"github.com/cyverse-de/app-exposer/resourcing"
 	"github.com/labstack/echo/v4"
 	"github.com/pkg/errors"
 	v1 "k8s.io/api/apps/v1"
@@ -138,6 +138,7 @@ type MetaInfo struct {
 	UserID            string `json:"userID"`
 	Username          string `json:"username"`
 	CreationTimestamp string `json:"creationTimestamp"`
+	ResourcePreset    string `json:"resourcePreset,omitempty"`
 }
 
 // DeploymentInfo contains information returned about a Deployment.
@@ -148,6 +149,10 @@ type DeploymentInfo struct {
 	Port    int32    `json:"port"`
 	User    int64    `json:"user"`
 	Group   int64    `json:"group"`
+
+	// SharedMemory is the size of the analysis's /dev/shm volume, if it has
+	// one.
+	SharedMemory string `json:"sharedMemory,omitempty"`
 }
 
 func deploymentInfo(deployment *v1.Deployment) *DeploymentInfo {
@@ -184,6 +189,7 @@ func deploymentInfo(deployment *v1.Deployment) *DeploymentInfo {
 			UserID:            labels["user-id"],
 			Username:          labels["username"],
 			CreationTimestamp: deployment.GetCreationTimestamp().String(),
+			ResourcePreset:    labels[resourcing.PresetLabel],
 		},
 
 		Image:   image,
@@ -191,6 +197,8 @@ func deploymentInfo(deployment *v1.Deployment) *DeploymentInfo {
 		Port:    port,
 		User:    user,
 		Group:   group,
+
+		SharedMemory: deploymentSharedMemory(deployment),
 	}
 }
 
@@ -218,6 +226,7 @@ func podInfo(pod *corev1.Pod) *PodInfo {
 			UserID:            labels["user-id"],
 			Username:          labels["username"],
 			CreationTimestamp: pod.GetCreationTimestamp().String(),
+			ResourcePreset:    labels[resourcing.PresetLabel],
 		},
 		Phase:                 string(pod.Status.Phase),
 		Message:               pod.Status.Message,
@@ -333,17 +342,19 @@ func ingressInfo(ingress *netv1.Ingress) *IngressInfo {
 	}
 }
 
-func (i *Internal) getFilteredDeployments(ctx context.Context, filter map[string]string) ([]DeploymentInfo, error) {
-	depList, err := i.deploymentList(ctx, i.ViceNamespace, filter, []string{})
-	if err != nil {
-		return nil, err
-	}
-
+func (i *Internal) getFilteredDeployments(ctx context.Context, namespaces []string, filter map[string]string) ([]DeploymentInfo, error) {
 	deployments := []DeploymentInfo{}
 
-	for _, dep := range depList.Items {
-		info := deploymentInfo(&dep)
-		deployments = append(deployments, *info)
+	for _, namespace := range namespaces {
+		depList, err := i.deploymentList(ctx, namespace, filter, []string{})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, dep := range depList.Items {
+			info := deploymentInfo(&dep)
+			deployments = append(deployments, *info)
+		}
 	}
 
 	return deployments, nil
@@ -354,7 +365,12 @@ func (i *Internal) FilterableDeploymentsHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 	filter := filterMap(c.Request().URL.Query())
 
-	deployments, err := i.getFilteredDeployments(ctx, filter)
+	namespaces, err := i.filterNamespaces(ctx, filter)
+	if err != nil {
+		return err
+	}
+
+	deployments, err := i.getFilteredDeployments(ctx, namespaces, filter)
 	if err != nil {
 		return err
 	}
@@ -364,17 +380,19 @@ func (i *Internal) FilterableDeploymentsHandler(c echo.Context) error {
 	})
 }
 
-func (i *Internal) getFilteredPods(ctx context.Context, filter map[string]string) ([]PodInfo, error) {
-	podList, err := i.podList(ctx, i.ViceNamespace, filter, []string{})
-	if err != nil {
-		return nil, err
-	}
-
+func (i *Internal) getFilteredPods(ctx context.Context, namespaces []string, filter map[string]string) ([]PodInfo, error) {
 	pods := []PodInfo{}
 
-	for _, pod := range podList.Items {
-		info := podInfo(&pod)
-		pods = append(pods, *info)
+	for _, namespace := range namespaces {
+		podList, err := i.podList(ctx, namespace, filter, []string{})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, pod := range podList.Items {
+			info := podInfo(&pod)
+			pods = append(pods, *info)
+		}
 	}
 
 	return pods, nil
@@ -385,7 +403,12 @@ func (i *Internal) FilterablePodsHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 	filter := filterMap(c.Request().URL.Query())
 
-	pods, err := i.getFilteredPods(ctx, filter)
+	namespaces, err := i.filterNamespaces(ctx, filter)
+	if err != nil {
+		return err
+	}
+
+	pods, err := i.getFilteredPods(ctx, namespaces, filter)
 	if err != nil {
 		return err
 	}
@@ -395,17 +418,19 @@ func (i *Internal) FilterablePodsHandler(c echo.Context) error {
 	})
 }
 
-func (i *Internal) getFilteredConfigMaps(ctx context.Context, filter map[string]string) ([]ConfigMapInfo, error) {
-	cmList, err := i.configmapsList(ctx, i.ViceNamespace, filter, []string{})
-	if err != nil {
-		return nil, err
-	}
-
+func (i *Internal) getFilteredConfigMaps(ctx context.Context, namespaces []string, filter map[string]string) ([]ConfigMapInfo, error) {
 	cms := []ConfigMapInfo{}
 
-	for _, cm := range cmList.Items {
-		info := configMapInfo(&cm)
-		cms = append(cms, *info)
+	for _, namespace := range namespaces {
+		cmList, err := i.configmapsList(ctx, namespace, filter, []string{})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, cm := range cmList.Items {
+			info := configMapInfo(&cm)
+			cms = append(cms, *info)
+		}
 	}
 
 	return cms, nil
@@ -416,7 +441,12 @@ func (i *Internal) FilterableConfigMapsHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 	filter := filterMap(c.Request().URL.Query())
 
-	cms, err := i.getFilteredConfigMaps(ctx, filter)
+	namespaces, err := i.filterNamespaces(ctx, filter)
+	if err != nil {
+		return err
+	}
+
+	cms, err := i.getFilteredConfigMaps(ctx, namespaces, filter)
 	if err != nil {
 		return err
 	}
@@ -426,17 +456,19 @@ func (i *Internal) FilterableConfigMapsHandler(c echo.Context) error {
 	})
 }
 
-func (i *Internal) getFilteredServices(ctx context.Context, filter map[string]string) ([]ServiceInfo, error) {
-	svcList, err := i.serviceList(ctx, i.ViceNamespace, filter, []string{})
-	if err != nil {
-		return nil, err
-	}
-
+func (i *Internal) getFilteredServices(ctx context.Context, namespaces []string, filter map[string]string) ([]ServiceInfo, error) {
 	svcs := []ServiceInfo{}
 
-	for _, svc := range svcList.Items {
-		info := serviceInfo(&svc)
-		svcs = append(svcs, *info)
+	for _, namespace := range namespaces {
+		svcList, err := i.serviceList(ctx, namespace, filter, []string{})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, svc := range svcList.Items {
+			info := serviceInfo(&svc)
+			svcs = append(svcs, *info)
+		}
 	}
 
 	return svcs, nil
@@ -447,7 +479,12 @@ func (i *Internal) FilterableServicesHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 	filter := filterMap(c.Request().URL.Query())
 
-	svcs, err := i.getFilteredServices(ctx, filter)
+	namespaces, err := i.filterNamespaces(ctx, filter)
+	if err != nil {
+		return err
+	}
+
+	svcs, err := i.getFilteredServices(ctx, namespaces, filter)
 	if err != nil {
 		return err
 	}
@@ -457,17 +494,19 @@ func (i *Internal) FilterableServicesHandler(c echo.Context) error {
 	})
 }
 
-func (i *Internal) getFilteredIngresses(ctx context.Context, filter map[string]string) ([]IngressInfo, error) {
-	ingList, err := i.ingressList(ctx, i.ViceNamespace, filter, []string{})
-	if err != nil {
-		return nil, err
-	}
-
+func (i *Internal) getFilteredIngresses(ctx context.Context, namespaces []string, filter map[string]string) ([]IngressInfo, error) {
 	ingresses := []IngressInfo{}
 
-	for _, ingress := range ingList.Items {
-		info := ingressInfo(&ingress)
-		ingresses = append(ingresses, *info)
+	for _, namespace := range namespaces {
+		ingList, err := i.ingressList(ctx, namespace, filter, []string{})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, ingress := range ingList.Items {
+			info := ingressInfo(&ingress)
+			ingresses = append(ingresses, *info)
+		}
 	}
 
 	return ingresses, nil
@@ -478,7 +517,12 @@ func (i *Internal) FilterableIngressesHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 	filter := filterMap(c.Request().URL.Query())
 
-	ingresses, err := i.getFilteredIngresses(ctx, filter)
+	namespaces, err := i.filterNamespaces(ctx, filter)
+	if err != nil {
+		return err
+	}
+
+	ingresses, err := i.getFilteredIngresses(ctx, namespaces, filter)
 	if err != nil {
 		return err
 	}
@@ -511,28 +555,40 @@ func (i *Internal) fixUsername(username string) string {
 	return fmt.Sprintf("%s%s", username, userSuffix)
 }
 
+// doResourceListing returns the resources matching the filter in all of the
+// listing namespaces, or in the namespace named by the filter.
 func (i *Internal) doResourceListing(ctx context.Context, filter map[string]string) (*ResourceInfo, error) {
-	deployments, err := i.getFilteredDeployments(ctx, filter)
+	namespaces, err := i.filterNamespaces(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	return i.listResources(ctx, namespaces, filter)
+}
+
+// listResources returns the resources matching the filter in the namespaces.
+func (i *Internal) listResources(ctx context.Context, namespaces []string, filter map[string]string) (*ResourceInfo, error) {
+	deployments, err := i.getFilteredDeployments(ctx, namespaces, filter)
 	if err != nil {
 		return nil, err
 	}
 
-	pods, err := i.getFilteredPods(ctx, filter)
+	pods, err := i.getFilteredPods(ctx, namespaces, filter)
 	if err != nil {
 		return nil, err
 	}
 
-	cms, err := i.getFilteredConfigMaps(ctx, filter)
+	cms, err := i.getFilteredConfigMaps(ctx, namespaces, filter)
 	if err != nil {
 		return nil, err
 	}
 
-	svcs, err := i.getFilteredServices(ctx, filter)
+	svcs, err := i.getFilteredServices(ctx, namespaces, filter)
 	if err != nil {
 		return nil, err
 	}
 
-	ingresses, err := i.getFilteredIngresses(ctx, filter)
+	ingresses, err := i.getFilteredIngresses(ctx, namespaces, filter)
 	if err != nil {
 		return nil, err
 	}
@@ -569,14 +625,14 @@ func (i *Internal) AdminDescribeAnalysisHandler(c echo.Context) error {
 func (i *Internal) DescribeAnalysisHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
-	log.Info("in DescribeAnalysisHandler")
+	log.WithContext(ctx).Info("in DescribeAnalysisHandler")
 	host := c.Param("host")
 	user := c.QueryParam("user")
 	if user == "" {
 		return echo.NewHTTPError(http.StatusBadRequest, "user query parameter must be set")
 	}
 
-	log.Infof("user: %s, user suffix: %s, host: %s", user, i.UserSuffix, host)
+	log.WithContext(ctx).Infof("user: %s, user suffix: %s, host: %s", user, i.UserSuffix, host)
 
 	// Since some usernames don't come through the labelling process unscathed, we have to use
 	// the user ID.
@@ -589,7 +645,7 @@ func (i *Internal) DescribeAnalysisHandler(c echo.Context) error {
 		return err
 	}
 
-	log.Infof("2 user: %s, user suffix: %s, host: %s", user, i.UserSuffix, host)
+	log.WithContext(ctx).Infof("2 user: %s, user suffix: %s, host: %s", user, i.UserSuffix, host)
 
 	filter := map[string]string{
 		"subdomain": host,
@@ -654,9 +710,14 @@ func (i *Internal) FilterableResourcesHandler(c echo.Context) error {
 
 	filter["user-id"] = userID
 
-	log.Debugf("user ID is %s", userID)
+	log.WithContext(ctx).Debugf("user ID is %s", userID)
 
-	listing, err := i.doResourceListing(ctx, filter)
+	namespaces, err := i.filterNamespaces(ctx, filter)
+	if err != nil {
+		return err
+	}
+
+	listing, err := i.listResources(ctx, namespaces, filter)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
@@ -670,7 +731,12 @@ func (i *Internal) AdminFilterableResourcesHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 	filter := filterMap(c.Request().URL.Query())
 
-	listing, err := i.doResourceListing(ctx, filter)
+	namespaces, err := i.filterNamespaces(ctx, filter)
+	if err != nil {
+		return err
+	}
+
+	listing, err := i.listResources(ctx, namespaces, filter)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
@@ -678,17 +744,72 @@ func (i *Internal) AdminFilterableResourcesHandler(c echo.Context) error {
 	return c.JSON(http.StatusOK, listing)
 }
 
-func populateAnalysisID(ctx context.Context, a *apps.Apps, existingLabels map[string]string) (map[string]string, error) {
+// labelLookups contains the values from the database that are used to fill
+// in missing labels. They're looked up for every resource being labeled at
+// once rather than one resource at a time.
+type labelLookups struct {
+	// analysisIDs contains the analysis IDs keyed by external ID.
+	analysisIDs map[string]string
+
+	// loginIPs contains the users' latest login IPs keyed by user ID.
+	loginIPs map[string]string
+}
+
+// lookupLabelValues looks up the analysis IDs and login IPs needed to fill in
+// the missing labels in each of the label sets. The lookups are always
+// returned, but they may be incomplete if an error is returned.
+func (i *Internal) lookupLabelValues(ctx context.Context, labelSets []map[string]string) (*labelLookups, error) {
+	lookups := &labelLookups{
+		analysisIDs: map[string]string{},
+		loginIPs:    map[string]string{},
+	}
+
+	externalIDs := []string{}
+	userIDs := []string{}
+	for _, existingLabels := range labelSets {
+		if _, ok := existingLabels["analysis-id"]; !ok {
+			if externalID, ok := existingLabels["external-id"]; ok {
+				externalIDs = append(externalIDs, externalID)
+			}
+		}
+		if _, ok := existingLabels["login-ip"]; !ok {
+			if userID, ok := existingLabels["user-id"]; ok {
+				userIDs = append(userIDs, userID)
+			}
+		}
+	}
+
+	var err error
+	if len(externalIDs) > 0 {
+		analysisIDs, lookupErr := i.apps.GetAnalysisIDsByExternalIDs(ctx, externalIDs)
+		if lookupErr != nil {
+			err = errors.Wrap(lookupErr, "error getting the analysis IDs")
+		} else {
+			lookups.analysisIDs = analysisIDs
+		}
+	}
+	if len(userIDs) > 0 {
+		loginIPs, lookupErr := i.apps.GetUserIPs(ctx, userIDs)
+		if lookupErr != nil {
+			err = errors.Wrap(lookupErr, "error getting the login IPs")
+		} else {
+			lookups.loginIPs = loginIPs
+		}
+	}
+
+	return lookups, err
+}
+
+func populateAnalysisID(lookups *labelLookups, existingLabels map[string]string) (map[string]string, error) {
 	if _, ok := existingLabels["analysis-id"]; !ok {
 		externalID, ok := existingLabels["external-id"]
 		if !ok {
 			return existingLabels, fmt.Errorf("missing external-id key")
 		}
-		analysisID, err := a.GetAnalysisIDByExternalID(ctx, externalID)
-		if err != nil {
-			log.Debug(errors.Wrapf(err, "error getting analysis id for external id %s", externalID))
-		} else {
+		if analysisID, ok := lookups.analysisIDs[externalID]; ok {
 			existingLabels["analysis-id"] = analysisID
+		} else {
+			log.Debugf("no analysis id found for external id %s", externalID)
 		}
 	}
 	return existingLabels, nil
@@ -696,22 +817,22 @@ func populateAnalysisID(ctx context.Context, a *apps.Apps, existingLabels map[st
 
 func populateSubdomain(existingLabels map[string]string) map[string]string {
 	if _, ok := existingLabels["subdomain"]; !ok {
-		if externalID, ok := existingLabels["external-id"]; ok {
-			if userID, ok := existingLabels["user-id"]; ok {
-				existingLabels["subdomain"] = IngressName(userID, externalID)
-			}
+		_, hasExternalID := existingLabels["external-id"]
+		_, hasUserID := existingLabels["user-id"]
+		if hasExternalID && hasUserID {
+			existingLabels["subdomain"] = subdomainFromLabels(existingLabels)
 		}
 	}
 
 	return existingLabels
 }
 
-func populateLoginIP(ctx context.Context, a *apps.Apps, existingLabels map[string]string) (map[string]string, error) {
+func populateLoginIP(lookups *labelLookups, existingLabels map[string]string) (map[string]string, error) {
 	if _, ok := existingLabels["login-ip"]; !ok {
 		if userID, ok := existingLabels["user-id"]; ok {
-			ipAddr, err := a.GetUserIP(ctx, userID)
-			if err != nil {
-				return existingLabels, err
+			ipAddr, ok := lookups.loginIPs[userID]
+			if !ok {
+				return existingLabels, fmt.Errorf("no login IP found for user %s", userID)
 			}
 			existingLabels["login-ip"] = ipAddr
 		}
@@ -730,17 +851,26 @@ func (i *Internal) relabelDeployments(ctx context.Context) []error {
 		return errors
 	}
 
+	labelSets := []map[string]string{}
+	for _, deployment := range deployments.Items {
+		labelSets = append(labelSets, deployment.GetLabels())
+	}
+	lookups, err := i.lookupLabelValues(ctx, labelSets)
+	if err != nil {
+		errors = append(errors, err)
+	}
+
 	for _, deployment := range deployments.Items {
 		existingLabels := deployment.GetLabels()
 
 		existingLabels = populateSubdomain(existingLabels)
 
-		existingLabels, err = populateLoginIP(ctx, i.apps, existingLabels)
+		existingLabels, err = populateLoginIP(lookups, existingLabels)
 		if err != nil {
 			errors = append(errors, err)
 		}
 
-		existingLabels, err = populateAnalysisID(ctx, i.apps, existingLabels)
+		existingLabels, err = populateAnalysisID(lookups, existingLabels)
 		if err != nil {
 			errors = append(errors, err)
 		}
@@ -765,17 +895,26 @@ func (i *Internal) relabelConfigMaps(ctx context.Context) []error {
 		return errors
 	}
 
+	labelSets := []map[string]string{}
+	for _, configmap := range cms.Items {
+		labelSets = append(labelSets, configmap.GetLabels())
+	}
+	lookups, err := i.lookupLabelValues(ctx, labelSets)
+	if err != nil {
+		errors = append(errors, err)
+	}
+
 	for _, configmap := range cms.Items {
 		existingLabels := configmap.GetLabels()
 
 		existingLabels = populateSubdomain(existingLabels)
 
-		existingLabels, err = populateLoginIP(ctx, i.apps, existingLabels)
+		existingLabels, err = populateLoginIP(lookups, existingLabels)
 		if err != nil {
 			errors = append(errors, err)
 		}
 
-		existingLabels, err = populateAnalysisID(ctx, i.apps, existingLabels)
+		existingLabels, err = populateAnalysisID(lookups, existingLabels)
 		if err != nil {
 			errors = append(errors, err)
 		}
@@ -800,17 +939,26 @@ func (i *Internal) relabelServices(ctx context.Context) []error {
 		return errors
 	}
 
+	labelSets := []map[string]string{}
+	for _, service := range svcs.Items {
+		labelSets = append(labelSets, service.GetLabels())
+	}
+	lookups, err := i.lookupLabelValues(ctx, labelSets)
+	if err != nil {
+		errors = append(errors, err)
+	}
+
 	for _, service := range svcs.Items {
 		existingLabels := service.GetLabels()
 
 		existingLabels = populateSubdomain(existingLabels)
 
-		existingLabels, err = populateLoginIP(ctx, i.apps, existingLabels)
+		existingLabels, err = populateLoginIP(lookups, existingLabels)
 		if err != nil {
 			errors = append(errors, err)
 		}
 
-		existingLabels, err = populateAnalysisID(ctx, i.apps, existingLabels)
+		existingLabels, err = populateAnalysisID(lookups, existingLabels)
 		if err != nil {
 			errors = append(errors, err)
 		}
@@ -835,17 +983,26 @@ func (i *Internal) relabelIngresses(ctx context.Context) []error {
 		return errors
 	}
 
+	labelSets := []map[string]string{}
+	for _, ingress := range ingresses.Items {
+		labelSets = append(labelSets, ingress.GetLabels())
+	}
+	lookups, err := i.lookupLabelValues(ctx, labelSets)
+	if err != nil {
+		errors = append(errors, err)
+	}
+
 	for _, ingress := range ingresses.Items {
 		existingLabels := ingress.GetLabels()
 
 		existingLabels = populateSubdomain(existingLabels)
 
-		existingLabels, err = populateLoginIP(ctx, i.apps, existingLabels)
+		existingLabels, err = populateLoginIP(lookups, existingLabels)
 		if err != nil {
 			errors = append(errors, err)
 		}
 
-		existingLabels, err = populateAnalysisID(ctx, i.apps, existingLabels)
+		existingLabels, err = populateAnalysisID(lookups, existingLabels)
 		if err != nil {
 			errors = append(errors, err)
 		}
@@ -887,6 +1044,8 @@ func (i *Internal) ApplyAsyncLabels(ctx context.Context) []error {
 		errors = append(errors, labelIngressesErrors...)
 	}
 
+	log.WithContext(ctx).Debugf("lookup cache statistics after relabeling: %+v", i.apps.CacheStats())
+
 	return errors
 }
 
@@ -899,7 +1058,7 @@ func (i *Internal) ApplyAsyncLabelsHandler(c echo.Context) error {
 	if len(errs) > 0 {
 		var errMsg strings.Builder
 		for _, err := range errs {
-			log.Error(err)
+			log.WithContext(ctx).Error(err)
 			fmt.Fprintf(&errMsg, "%s\n", err.Error())
 		}
 
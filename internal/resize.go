@@ -0,0 +1,383 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	resourcev1 "k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/util/retry"
+)
+
+// AnalysisResources are the resource requests and limits of an analysis
+// container. Empty values aren't set.
+type AnalysisResources struct {
+	CPURequest              string `json:"cpu_request,omitempty"`
+	CPULimit                string `json:"cpu_limit,omitempty"`
+	MemoryRequest           string `json:"memory_request,omitempty"`
+	MemoryLimit             string `json:"memory_limit,omitempty"`
+	EphemeralStorageRequest string `json:"ephemeral_storage_request,omitempty"`
+	EphemeralStorageLimit   string `json:"ephemeral_storage_limit,omitempty"`
+}
+
+// ResourceChangeRequest is the request body for changing the resources of a
+// running analysis. Only the values that are set are changed.
+type ResourceChangeRequest struct {
+	AnalysisResources
+
+	// Reason is recorded with the change.
+	Reason string `json:"reason"`
+}
+
+// ResourceChange is a change to the resources of a running analysis.
+type ResourceChange struct {
+	AnalysisID string            `json:"analysis_id" db:"analysis_id"`
+	ExternalID string            `json:"external_id" db:"external_id"`
+	ChangedBy  string            `json:"changed_by" db:"changed_by"`
+	Reason     string            `json:"reason" db:"reason"`
+	Previous   AnalysisResources `json:"previous" db:"-"`
+	Resources  AnalysisResources `json:"resources" db:"-"`
+	ChangedAt  time.Time         `json:"changed_at" db:"changed_at"`
+}
+
+// fields pairs the values with the names of the resources they're for and
+// whether they're limits or requests.
+func (r *AnalysisResources) fields() []struct {
+	value    *string
+	resource apiv1.ResourceName
+	limit    bool
+} {
+	return []struct {
+		value    *string
+		resource apiv1.ResourceName
+		limit    bool
+	}{
+		{&r.CPURequest, apiv1.ResourceCPU, false},
+		{&r.CPULimit, apiv1.ResourceCPU, true},
+		{&r.MemoryRequest, apiv1.ResourceMemory, false},
+		{&r.MemoryLimit, apiv1.ResourceMemory, true},
+		{&r.EphemeralStorageRequest, apiv1.ResourceEphemeralStorage, false},
+		{&r.EphemeralStorageLimit, apiv1.ResourceEphemeralStorage, true},
+	}
+}
+
+// empty returns true if none of the values are set.
+func (r *AnalysisResources) empty() bool {
+	for _, field := range r.fields() {
+		if *field.value != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// validate returns an error if any of the values that are set aren't positive
+// quantities.
+func (r *AnalysisResources) validate() error {
+	for _, field := range r.fields() {
+		if *field.value == "" {
+			continue
+		}
+		quantity, err := resourcev1.ParseQuantity(*field.value)
+		if err != nil {
+			return fmt.Errorf("invalid %s quantity %q", field.resource, *field.value)
+		}
+		if quantity.Sign() <= 0 {
+			return fmt.Errorf("the %s quantity must be positive, got %s", field.resource, *field.value)
+		}
+	}
+	return nil
+}
+
+// containerResources returns the container's resource requests and limits.
+func containerResources(container *apiv1.Container) AnalysisResources {
+	resources := AnalysisResources{}
+	for _, field := range resources.fields() {
+		list := container.Resources.Requests
+		if field.limit {
+			list = container.Resources.Limits
+		}
+		if quantity, ok := list[field.resource]; ok {
+			*field.value = quantity.String()
+		}
+	}
+	return resources
+}
+
+// applyResources sets the values of the changes that are set on the
+// container. Returns an error if a request would end up larger than its
+// limit. The changes must have been validated.
+func applyResources(container *apiv1.Container, changes *AnalysisResources) error {
+	if container.Resources.Requests == nil {
+		container.Resources.Requests = apiv1.ResourceList{}
+	}
+	if container.Resources.Limits == nil {
+		container.Resources.Limits = apiv1.ResourceList{}
+	}
+
+	for _, field := range changes.fields() {
+		if *field.value == "" {
+			continue
+		}
+		list := container.Resources.Requests
+		if field.limit {
+			list = container.Resources.Limits
+		}
+		list[field.resource] = resourcev1.MustParse(*field.value)
+	}
+
+	for resource, request := range container.Resources.Requests {
+		if limit, ok := container.Resources.Limits[resource]; ok && request.Cmp(limit) > 0 {
+			return fmt.Errorf("the %s request %s would be larger than the limit %s", resource, request.String(), limit.String())
+		}
+	}
+	return nil
+}
+
+// analysisContainer returns the analysis container of the Deployment, or nil
+// if it doesn't have one.
+func analysisContainer(deployment *appsv1.Deployment) *apiv1.Container {
+	containers := deployment.Spec.Template.Spec.Containers
+	for idx := range containers {
+		if containers[idx].Name == analysisContainerName {
+			return &containers[idx]
+		}
+	}
+	return nil
+}
+
+const insertResourceChangeSQL = `
+	INSERT INTO vice_resource_changes (analysis_id, external_id, changed_by, reason, previous, resources)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	RETURNING changed_at
+`
+
+// recordResourceChange records a change to an analysis's resources.
+func (i *Internal) recordResourceChange(ctx context.Context, change *ResourceChange) error {
+	previous, err := json.Marshal(change.Previous)
+	if err != nil {
+		return err
+	}
+	resources, err := json.Marshal(change.Resources)
+	if err != nil {
+		return err
+	}
+
+	err = i.db.QueryRowxContext(
+		ctx, insertResourceChangeSQL,
+		change.AnalysisID, change.ExternalID, change.ChangedBy, change.Reason, previous, resources,
+	).Scan(&change.ChangedAt)
+	return errors.Wrapf(err, "error recording the resource change for %s", change.AnalysisID)
+}
+
+const listResourceChangesSQL = `
+	SELECT analysis_id, external_id, changed_by, reason, previous, resources, changed_at
+	  FROM vice_resource_changes
+	 WHERE analysis_id = $1
+	 ORDER BY changed_at
+`
+
+// resourceChanges returns the changes made to the resources of an analysis,
+// oldest first.
+func (i *Internal) resourceChanges(ctx context.Context, analysisID string) ([]ResourceChange, error) {
+	rows, err := i.db.QueryxContext(ctx, listResourceChangesSQL, analysisID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error listing the resource changes for %s", analysisID)
+	}
+	defer rows.Close()
+
+	changes := []ResourceChange{}
+	for rows.Next() {
+		var (
+			change              ResourceChange
+			previous, resources []byte
+		)
+		if err = rows.Scan(&change.AnalysisID, &change.ExternalID, &change.ChangedBy, &change.Reason, &previous, &resources, &change.ChangedAt); err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(previous, &change.Previous); err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(resources, &change.Resources); err != nil {
+			return nil, err
+		}
+		changes = append(changes, change)
+	}
+	return changes, rows.Err()
+}
+
+// analysisDeployment returns the Deployment of the analysis with the external
+// ID, or a 404 if there isn't one.
+func (i *Internal) analysisDeployment(ctx context.Context, externalID string) (*appsv1.Deployment, error) {
+	set := labels.Set(map[string]string{
+		"external-id": externalID,
+	})
+	deplist, err := i.clientset.AppsV1().Deployments(i.ViceNamespace).List(ctx, metav1.ListOptions{
+		LabelSelector: set.AsSelector().String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(deplist.Items) == 0 {
+		return nil, echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("no deployment found for %s", externalID))
+	}
+	return &deplist.Items[0], nil
+}
+
+// resizeAnalysis changes the resources of the analysis container of a running
+// analysis. Changing the Deployment's pod template replaces the pod, so the
+// analysis is restarted the same way the restart endpoint does it, keeping
+// its working directory and URL. The millicores reserved for the analysis are
+// updated and the change is recorded.
+func (i *Internal) resizeAnalysis(ctx context.Context, analysisID, externalID, user string, req *ResourceChangeRequest) (change *ResourceChange, err error) {
+	ctx = withExternalIDBaggage(ctx, externalID)
+	ctx, span := startSpan(ctx, "resizeAnalysis", attribute.String("vice.analysis-id", analysisID))
+	defer func() { endSpan(span, err) }()
+
+	existing, err := i.analysisDeployment(ctx, externalID)
+	if err != nil {
+		return nil, err
+	}
+
+	change = &ResourceChange{
+		AnalysisID: analysisID,
+		ExternalID: externalID,
+		ChangedBy:  user,
+		Reason:     req.Reason,
+	}
+
+	depclient := i.clientset.AppsV1().Deployments(i.ViceNamespace)
+	now := time.Now()
+	var updated *appsv1.Deployment
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		deployment, err := depclient.Get(ctx, existing.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		container := analysisContainer(deployment)
+		if container == nil {
+			return fmt.Errorf("could not find the analysis container in deployment %s", deployment.Name)
+		}
+
+		change.Previous = containerResources(container)
+		if err = applyResources(container, &req.AnalysisResources); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		change.Resources = containerResources(container)
+
+		restartDeployment(deployment, "", now)
+		updated, err = depclient.Update(ctx, deployment, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Demo analyses don't reserve anything unless they count against the
+	// user's quota.
+	if updated.Labels[demoLabel] != "true" || i.Demo.CountQuota {
+		millicores, err := getMillicoresFromDeployment(updated)
+		if err != nil {
+			return nil, err
+		}
+		if err = i.apps.SetAnalysisMillicoresReserved(ctx, analysisID, millicores); err != nil {
+			return nil, errors.Wrapf(err, "error updating the millicores reserved for %s", analysisID)
+		}
+	}
+
+	if err = i.recordResourceChange(ctx, change); err != nil {
+		return nil, err
+	}
+
+	log.WithContext(ctx).Infof("%s changed the resources of %s from %+v to %+v", user, analysisID, change.Previous, change.Resources)
+
+	return change, nil
+}
+
+// AdminGetAnalysisResourcesHandler returns the resource requests and limits
+// of a running analysis's container, along with the changes made to them.
+func (i *Internal) AdminGetAnalysisResourcesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	analysisID := c.Param("analysis-id")
+	if analysisID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "analysis-id parameter is empty")
+	}
+
+	externalID, err := i.getExternalIDByAnalysisID(ctx, analysisID)
+	if err != nil {
+		return err
+	}
+
+	deployment, err := i.analysisDeployment(ctx, externalID)
+	if err != nil {
+		return err
+	}
+	container := analysisContainer(deployment)
+	if container == nil {
+		return fmt.Errorf("could not find the analysis container in deployment %s", deployment.Name)
+	}
+
+	changes, err := i.resourceChanges(ctx, analysisID)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"analysis_id": analysisID,
+		"external_id": externalID,
+		"resources":   containerResources(container),
+		"changes":     changes,
+	})
+}
+
+// AdminUpdateAnalysisResourcesHandler changes the CPU, memory, and ephemeral
+// storage requests and limits of a running analysis's container. The
+// analysis's pod is replaced to apply them. The user query parameter names
+// the administrator making the change.
+func (i *Internal) AdminUpdateAnalysisResourcesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	analysisID := c.Param("analysis-id")
+	if analysisID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "analysis-id parameter is empty")
+	}
+
+	user := c.QueryParam("user")
+	if user == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "user query parameter must be set")
+	}
+
+	req := &ResourceChangeRequest{}
+	if err := c.Bind(req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if req.empty() {
+		return echo.NewHTTPError(http.StatusBadRequest, "at least one request or limit must be set")
+	}
+	if err := req.validate(); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	externalID, err := i.getExternalIDByAnalysisID(ctx, analysisID)
+	if err != nil {
+		return err
+	}
+
+	change, err := i.resizeAnalysis(ctx, analysisID, externalID, user, req)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, change)
+}
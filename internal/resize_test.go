@@ -0,0 +1,152 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cyverse-de/app-exposer/apps"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	resourcev1 "k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func resizeTestDeployment() *appsv1.Deployment {
+	deployment := restartTestDeployment()
+	deployment.Spec.Template.Spec.Containers[1].Resources = apiv1.ResourceRequirements{
+		Requests: apiv1.ResourceList{
+			apiv1.ResourceCPU:    resourcev1.MustParse("1"),
+			apiv1.ResourceMemory: resourcev1.MustParse("2Gi"),
+		},
+		Limits: apiv1.ResourceList{
+			apiv1.ResourceCPU:    resourcev1.MustParse("4"),
+			apiv1.ResourceMemory: resourcev1.MustParse("8Gi"),
+		},
+	}
+	return deployment
+}
+
+func TestApplyResources(t *testing.T) {
+	assert := assert.New(t)
+
+	container := &resizeTestDeployment().Spec.Template.Spec.Containers[1]
+	assert.Equal(AnalysisResources{
+		CPURequest:    "1",
+		CPULimit:      "4",
+		MemoryRequest: "2Gi",
+		MemoryLimit:   "8Gi",
+	}, containerResources(container))
+
+	assert.NoError(applyResources(container, &AnalysisResources{MemoryLimit: "16Gi", EphemeralStorageLimit: "20Gi"}))
+	assert.Equal(AnalysisResources{
+		CPURequest:            "1",
+		CPULimit:              "4",
+		MemoryRequest:         "2Gi",
+		MemoryLimit:           "16Gi",
+		EphemeralStorageLimit: "20Gi",
+	}, containerResources(container))
+
+	// Requests can't end up larger than their limits.
+	assert.Error(applyResources(container, &AnalysisResources{CPURequest: "8"}))
+
+	assert.NoError((&AnalysisResources{CPULimit: "500m"}).validate())
+	assert.Error((&AnalysisResources{CPULimit: "lots"}).validate())
+	assert.Error((&AnalysisResources{MemoryLimit: "0"}).validate())
+	assert.True((&AnalysisResources{}).empty())
+}
+
+func TestResizeAnalysis(t *testing.T) {
+	assert := assert.New(t)
+
+	mockdb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockdb.Close()
+
+	db := sqlx.NewDb(mockdb, "sqlmock")
+	clientset := fake.NewSimpleClientset(resizeTestDeployment())
+	i := &Internal{
+		Init:      Init{ViceNamespace: "vice-apps"},
+		db:        db,
+		clientset: clientset,
+		apps:      apps.NewApps(db, "@example.org"),
+	}
+
+	changedAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE jobs")).
+		WithArgs("a1", int64(8000)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta("INSERT INTO vice_resource_changes")).
+		WithArgs("a1", "a1234", "admin", "out of memory",
+			[]byte(`{"cpu_request":"1","cpu_limit":"4","memory_request":"2Gi","memory_limit":"8Gi"}`),
+			[]byte(`{"cpu_request":"1","cpu_limit":"8","memory_request":"2Gi","memory_limit":"32Gi"}`)).
+		WillReturnRows(sqlmock.NewRows([]string{"changed_at"}).AddRow(changedAt))
+
+	change, err := i.resizeAnalysis(context.Background(), "a1", "a1234", "admin", &ResourceChangeRequest{
+		AnalysisResources: AnalysisResources{CPULimit: "8", MemoryLimit: "32Gi"},
+		Reason:            "out of memory",
+	})
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal("4", change.Previous.CPULimit)
+	assert.Equal("32Gi", change.Resources.MemoryLimit)
+	assert.Equal(changedAt, change.ChangedAt)
+	assert.NoError(mock.ExpectationsWereMet())
+
+	// The pod is replaced with one using the new resources.
+	deployment, err := clientset.AppsV1().Deployments("vice-apps").Get(context.Background(), "a1234", metav1.GetOptions{})
+	assert.NoError(err)
+	assert.Equal("32Gi", deployment.Spec.Template.Spec.Containers[1].Resources.Limits.Memory().String())
+	assert.NotEmpty(deployment.Spec.Template.Annotations[restartedAtAnnotation])
+	assert.Equal(appsv1.RecreateDeploymentStrategyType, deployment.Spec.Strategy.Type)
+
+	// Requests larger than their limits are rejected without changing
+	// anything.
+	_, err = i.resizeAnalysis(context.Background(), "a1", "a1234", "admin", &ResourceChangeRequest{
+		AnalysisResources: AnalysisResources{MemoryRequest: "64Gi"},
+	})
+	if assert.Error(err) {
+		assert.Equal(http.StatusBadRequest, err.(*echo.HTTPError).Code)
+	}
+
+	_, err = i.resizeAnalysis(context.Background(), "a2", "missing", "admin", &ResourceChangeRequest{
+		AnalysisResources: AnalysisResources{MemoryLimit: "16Gi"},
+	})
+	if assert.Error(err) {
+		assert.Equal(http.StatusNotFound, err.(*echo.HTTPError).Code)
+	}
+}
+
+func TestAdminUpdateAnalysisResourcesHandlerValidation(t *testing.T) {
+	assert := assert.New(t)
+
+	i := &Internal{}
+	for _, tt := range []struct{ query, body string }{
+		{"", `{"memory_limit": "16Gi"}`},
+		{"?user=admin", `{"reason": "nothing to change"}`},
+		{"?user=admin", `{"memory_limit": "sixteen"}`},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/"+tt.query, strings.NewReader(tt.body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		c := echo.New().NewContext(req, httptest.NewRecorder())
+		c.SetParamNames("analysis-id")
+		c.SetParamValues("a1")
+
+		err := i.AdminUpdateAnalysisResourcesHandler(c)
+		if assert.Error(err, tt.body) {
+			assert.Equal(http.StatusBadRequest, err.(*echo.HTTPError).Code, tt.body)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package internal
+
+import (
+	"net/http"
+
+	"github.com/cyverse-de/app-exposer/resourcing"
+	"github.com/cyverse-de/model/v6"
+	"github.com/labstack/echo/v4"
+	appsv1 "k8s.io/api/apps/v1"
+)
+
+// applyResourcePreset replaces the resource values in the job with the ones
+// from the preset selected in the launch request, if there is one.
+func (i *Internal) applyResourcePreset(job *model.Job, opts *launchOptions) error {
+	if opts.ResourcePreset == "" {
+		return nil
+	}
+	if err := i.reloadable().ResourcePresets.Apply(job, opts.ResourcePreset); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return nil
+}
+
+// setResourcePresetLabel records the preset the analysis was launched with on
+// the Deployment and its pods so that it shows up in the analysis listings.
+func setResourcePresetLabel(deployment *appsv1.Deployment, opts *launchOptions) {
+	if opts.ResourcePreset == "" {
+		return
+	}
+	if deployment.Labels == nil {
+		deployment.Labels = map[string]string{}
+	}
+	deployment.Labels[resourcing.PresetLabel] = opts.ResourcePreset
+	if deployment.Spec.Template.Labels == nil {
+		deployment.Spec.Template.Labels = map[string]string{}
+	}
+	deployment.Spec.Template.Labels[resourcing.PresetLabel] = opts.ResourcePreset
+}
+
+// ResourcePresetsHandler lists the resource presets users may select when
+// they launch an analysis.
+func (i *Internal) ResourcePresetsHandler(c echo.Context) error {
+	presets := i.reloadable().ResourcePresets
+	if presets == nil {
+		presets = resourcing.Presets{}
+	}
+	return c.JSON(http.StatusOK, map[string]resourcing.Presets{
+		"presets": presets,
+	})
+}
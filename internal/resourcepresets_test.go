@@ -0,0 +1,63 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cyverse-de/app-exposer/resourcing"
+	"github.com/cyverse-de/model/v6"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+)
+
+func TestBindLaunchRequest(t *testing.T) {
+	assert := assert.New(t)
+
+	body := `{"name": "test", "resource_preset": "medium", "steps": [{"component": {"container": {"max_cpu_cores": 2}}}]}`
+	req := httptest.NewRequest(http.MethodPost, "/vice/launch", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	c := echo.New().NewContext(req, httptest.NewRecorder())
+
+	job := &model.Job{}
+	opts, err := bindLaunchRequest(c, job)
+	assert.NoError(err)
+	assert.Equal("medium", opts.ResourcePreset)
+	assert.Equal("test", job.Name)
+	assert.Equal(float32(2), job.Steps[0].Component.Container.MaxCPUCores)
+}
+
+func TestApplyResourcePreset(t *testing.T) {
+	assert := assert.New(t)
+
+	i := &Internal{Init: Init{ResourcePresets: resourcing.Presets{
+		{Name: "medium", CPUCores: 4, Memory: "16Gi"},
+	}}}
+
+	job := &model.Job{Steps: []model.Step{{}}}
+	assert.NoError(i.applyResourcePreset(job, &launchOptions{}))
+	assert.Zero(job.Steps[0].Component.Container.MaxCPUCores)
+
+	assert.NoError(i.applyResourcePreset(job, &launchOptions{ResourcePreset: "medium"}))
+	assert.Equal(float32(4), job.Steps[0].Component.Container.MaxCPUCores)
+
+	err := i.applyResourcePreset(job, &launchOptions{ResourcePreset: "huge"})
+	if assert.Error(err) {
+		assert.Equal(http.StatusBadRequest, err.(*echo.HTTPError).Code)
+	}
+}
+
+func TestSetResourcePresetLabel(t *testing.T) {
+	assert := assert.New(t)
+
+	deployment := &appsv1.Deployment{}
+	setResourcePresetLabel(deployment, &launchOptions{})
+	assert.Empty(deployment.Labels)
+
+	setResourcePresetLabel(deployment, &launchOptions{ResourcePreset: "gpu"})
+	assert.Equal("gpu", deployment.Labels[resourcing.PresetLabel])
+	assert.Equal("gpu", deployment.Spec.Template.Labels[resourcing.PresetLabel])
+	assert.Equal("gpu", deploymentInfo(deployment).ResourcePreset)
+}
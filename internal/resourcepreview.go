@@ -0,0 +1,72 @@
+package internal
+
+import (
+	"net/http"
+
+	"github.com/cyverse-de/model/v6"
+	"github.com/labstack/echo/v4"
+	apiv1 "k8s.io/api/core/v1"
+	resourcev1 "k8s.io/apimachinery/pkg/api/resource"
+)
+
+// ResourcePreview describes the resources the analysis container would get if
+// a submission were launched.
+type ResourcePreview struct {
+	// ResourcePreset is the preset from the launch request, if there is one.
+	ResourcePreset string `json:"resource_preset,omitempty"`
+
+	// Requirements contains the requests and limits for the analysis
+	// container.
+	Requirements apiv1.ResourceRequirements `json:"requirements"`
+
+	// SharedMemory is the size of the volume mounted at /dev/shm, if the
+	// analysis gets one.
+	SharedMemory *resourcev1.Quantity `json:"shared_memory,omitempty"`
+
+	// GPU is true if the analysis would be scheduled on a GPU node.
+	GPU bool `json:"gpu"`
+}
+
+// resourcePreview returns the preview for the job. The resource preset must
+// already have been applied.
+func resourcePreview(job *model.Job, settings *ToolSettings, opts *launchOptions) *ResourcePreview {
+	return &ResourcePreview{
+		ResourcePreset: opts.ResourcePreset,
+		Requirements:   analysisResources(job, settings),
+		SharedMemory:   sharedMemoryAmount(job),
+		GPU:            settings.needsGPU(job),
+	}
+}
+
+// ResourcePreviewHandler returns the resource requirements the analysis
+// container would get for the submission in the request body, after the
+// resource preset, shared memory size, tool settings, and defaults have been
+// applied. Nothing is launched.
+func (i *Internal) ResourcePreviewHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	job := &model.Job{}
+	opts, err := bindLaunchRequest(c, job)
+	if err != nil {
+		return err
+	}
+
+	if err = validateSubmissionResources(job); err != nil {
+		return err
+	}
+
+	if err = i.applyResourcePreset(job, opts); err != nil {
+		return err
+	}
+
+	if err = i.applySharedMemory(job, opts); err != nil {
+		return err
+	}
+
+	settings, err := i.getToolSettings(ctx, job)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, resourcePreview(job, settings, opts))
+}
@@ -0,0 +1,66 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cyverse-de/app-exposer/resourcing"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	resourcev1 "k8s.io/apimachinery/pkg/api/resource"
+)
+
+func previewRequest(t *testing.T, i *Internal, body string) (*ResourcePreview, error) {
+	req := httptest.NewRequest(http.MethodPost, "/resourcing/preview", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+
+	if err := i.ResourcePreviewHandler(echo.New().NewContext(req, rec)); err != nil {
+		return nil, err
+	}
+
+	preview := &ResourcePreview{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), preview))
+	return preview, nil
+}
+
+func TestResourcePreviewHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	i := &Internal{Init: Init{ResourcePresets: resourcing.Presets{
+		{Name: "gpu", CPUCores: 8, Memory: "32Gi", GPUs: 1},
+	}}}
+
+	// The defaults are used for the values that aren't in the submission.
+	preview, err := previewRequest(t, i, `{"steps": [{"component": {"container": {"max_cpu_cores": 2}}}]}`)
+	if assert.NoError(err) {
+		requests := preview.Requirements.Requests
+		limits := preview.Requirements.Limits
+		assert.True(defaultCPUResourceRequest.Equal(requests[apiv1.ResourceCPU]))
+		assert.True(resourcev1.MustParse("2").Equal(limits[apiv1.ResourceCPU]))
+		assert.True(defaultMemResourceLimit.Equal(limits[apiv1.ResourceMemory]))
+		assert.Nil(preview.SharedMemory)
+		assert.False(preview.GPU)
+	}
+
+	// Presets replace the submitted values and may add a GPU.
+	preview, err = previewRequest(t, i, `{"resource_preset": "gpu", "steps": [{"component": {"container": {"max_cpu_cores": 2, "container_devices": [{"host_path": "/dev/shm", "container_path": "1Gi"}]}}}]}`)
+	if assert.NoError(err) {
+		assert.Equal("gpu", preview.ResourcePreset)
+		limits := preview.Requirements.Limits
+		assert.True(resourcev1.MustParse("8").Equal(limits[apiv1.ResourceCPU]))
+		assert.True(resourcev1.MustParse("32Gi").Equal(limits[apiv1.ResourceMemory]))
+		assert.True(resourcev1.MustParse("1").Equal(limits["nvidia.com/gpu"]))
+		if assert.NotNil(preview.SharedMemory) {
+			assert.Equal("1Gi", preview.SharedMemory.String())
+		}
+		assert.True(preview.GPU)
+	}
+
+	_, err = previewRequest(t, i, `{"steps": []}`)
+	assert.Error(err)
+}
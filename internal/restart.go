@@ -0,0 +1,140 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel/attribute"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/util/retry"
+)
+
+// restartedAtAnnotation is the pod template annotation that kubectl rollout
+// restart uses. Changing it causes the Deployment to replace its pod.
+const restartedAtAnnotation = "kubectl.kubernetes.io/restartedAt"
+
+// imageTagRegexp matches valid container image tags.
+var imageTagRegexp = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+
+// RestartRequest is the optional body of a request to restart an analysis.
+type RestartRequest struct {
+	// ImageTag is the tag of the analysis container image to run after the
+	// restart. The current tag is kept if it's empty.
+	ImageTag string `json:"image_tag"`
+}
+
+// replaceImageTag returns the image with its tag or digest replaced by tag.
+func replaceImageTag(image, tag string) string {
+	// The registry host may include a port, so only the last path element is
+	// searched for the tag.
+	nameStart := strings.LastIndex(image, "/") + 1
+
+	if idx := strings.Index(image[nameStart:], "@"); idx >= 0 {
+		image = image[:nameStart+idx]
+	}
+	if idx := strings.Index(image[nameStart:], ":"); idx >= 0 {
+		image = image[:nameStart+idx]
+	}
+
+	return fmt.Sprintf("%s:%s", image, tag)
+}
+
+// restartDeployment updates the Deployment so that its pod is replaced,
+// switching the analysis container to the image tag if one is given.
+func restartDeployment(deployment *appsv1.Deployment, imageTag string, now time.Time) {
+	if deployment.Spec.Template.Annotations == nil {
+		deployment.Spec.Template.Annotations = map[string]string{}
+	}
+	deployment.Spec.Template.Annotations[restartedAtAnnotation] = now.Format(time.RFC3339)
+
+	// The old pod has to be gone before the new one starts, since they'd
+	// share the working directory.
+	deployment.Spec.Strategy = appsv1.DeploymentStrategy{
+		Type: appsv1.RecreateDeploymentStrategyType,
+	}
+
+	if imageTag == "" {
+		return
+	}
+
+	containers := deployment.Spec.Template.Spec.Containers
+	for idx := range containers {
+		if containers[idx].Name == analysisContainerName {
+			containers[idx].Image = replaceImageTag(containers[idx].Image, imageTag)
+		}
+	}
+}
+
+// restartAnalysis replaces the pod of the analysis with the external ID. Only
+// the Deployment is changed, so the analysis keeps its volumes, ConfigMaps,
+// Service, and Ingress.
+func (i *Internal) restartAnalysis(ctx context.Context, externalID, imageTag string) (err error) {
+	ctx = withExternalIDBaggage(ctx, externalID)
+	ctx, span := startSpan(ctx, "restartAnalysis", attribute.String("vice.image-tag", imageTag))
+	defer func() { endSpan(span, err) }()
+
+	set := labels.Set(map[string]string{
+		"external-id": externalID,
+	})
+
+	depclient := i.clientset.AppsV1().Deployments(i.ViceNamespace)
+	deplist, err := depclient.List(ctx, metav1.ListOptions{
+		LabelSelector: set.AsSelector().String(),
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(deplist.Items) == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("no deployment found for %s", externalID))
+	}
+
+	now := time.Now()
+	for _, dep := range deplist.Items {
+		name := dep.Name
+		err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			deployment, err := depclient.Get(ctx, name, metav1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			restartDeployment(deployment, imageTag, now)
+			_, err = depclient.Update(ctx, deployment, metav1.UpdateOptions{})
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RestartHandler restarts the pod of a running analysis, optionally pulling a
+// different tag of the analysis container image. The working directory and
+// the URL of the analysis are kept.
+func (i *Internal) RestartHandler(c echo.Context) error {
+	id := c.Param("id")
+	if id == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "id parameter is empty")
+	}
+
+	req := &RestartRequest{}
+	if c.Request().ContentLength != 0 {
+		if err := c.Bind(req); err != nil {
+			return err
+		}
+	}
+
+	if req.ImageTag != "" && !imageTagRegexp.MatchString(req.ImageTag) {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid image tag %q", req.ImageTag))
+	}
+
+	return i.restartAnalysis(c.Request().Context(), id, req.ImageTag)
+}
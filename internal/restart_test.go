@@ -0,0 +1,111 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestReplaceImageTag(t *testing.T) {
+	tests := []struct {
+		image, expected string
+	}{
+		{"discoenv/jupyter", "discoenv/jupyter:v2"},
+		{"discoenv/jupyter:latest", "discoenv/jupyter:v2"},
+		{"harbor.example.org:5000/de/jupyter:v1", "harbor.example.org:5000/de/jupyter:v2"},
+		{"harbor.example.org:5000/de/jupyter", "harbor.example.org:5000/de/jupyter:v2"},
+		{"discoenv/jupyter:v1@sha256:abcdef", "discoenv/jupyter:v2"},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, replaceImageTag(tt.image, "v2"), tt.image)
+	}
+}
+
+func restartTestDeployment() *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "a1234",
+			Namespace: "vice-apps",
+			Labels:    map[string]string{"external-id": "a1234"},
+		},
+		Spec: appsv1.DeploymentSpec{
+			Template: apiv1.PodTemplateSpec{
+				Spec: apiv1.PodSpec{
+					Containers: []apiv1.Container{
+						{Name: viceProxyContainerName, Image: "discoenv/vice-proxy:latest"},
+						{Name: analysisContainerName, Image: "discoenv/jupyter:v1"},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestRestartDeployment(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	deployment := restartTestDeployment()
+	restartDeployment(deployment, "", now)
+	assert.Equal("2024-01-02T03:04:05Z", deployment.Spec.Template.Annotations[restartedAtAnnotation])
+	assert.Equal(appsv1.RecreateDeploymentStrategyType, deployment.Spec.Strategy.Type)
+	assert.Equal("discoenv/jupyter:v1", deployment.Spec.Template.Spec.Containers[1].Image)
+
+	restartDeployment(deployment, "v2", now)
+	assert.Equal("discoenv/vice-proxy:latest", deployment.Spec.Template.Spec.Containers[0].Image)
+	assert.Equal("discoenv/jupyter:v2", deployment.Spec.Template.Spec.Containers[1].Image)
+}
+
+func TestRestartHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	clientset := fake.NewSimpleClientset(restartTestDeployment())
+	i := &Internal{Init: Init{ViceNamespace: "vice-apps"}, clientset: clientset}
+
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"image_tag": "v2"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	c := e.NewContext(req, httptest.NewRecorder())
+	c.SetParamNames("id")
+	c.SetParamValues("a1234")
+
+	assert.NoError(i.RestartHandler(c))
+
+	deployment, err := clientset.AppsV1().Deployments("vice-apps").Get(context.Background(), "a1234", metav1.GetOptions{})
+	assert.NoError(err)
+	assert.NotEmpty(deployment.Spec.Template.Annotations[restartedAtAnnotation])
+	assert.Equal("discoenv/jupyter:v2", deployment.Spec.Template.Spec.Containers[1].Image)
+
+	// Invalid tags are rejected.
+	req = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"image_tag": "v2; rm -rf /"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	c = e.NewContext(req, httptest.NewRecorder())
+	c.SetParamNames("id")
+	c.SetParamValues("a1234")
+	err = i.RestartHandler(c)
+	if assert.Error(err) {
+		assert.Equal(http.StatusBadRequest, err.(*echo.HTTPError).Code)
+	}
+
+	// Analyses that aren't running can't be restarted.
+	req = httptest.NewRequest(http.MethodPost, "/", nil)
+	c = e.NewContext(req, httptest.NewRecorder())
+	c.SetParamNames("id")
+	c.SetParamValues("b5678")
+	err = i.RestartHandler(c)
+	if assert.Error(err) {
+		assert.Equal(http.StatusNotFound, err.(*echo.HTTPError).Code)
+	}
+}
@@ -0,0 +1,309 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultRetentionInterval  = time.Hour
+	defaultRetentionBatchSize = 1000
+)
+
+// historyTable is a table of analysis history that grows with every analysis
+// and can be pruned once its rows are older than the retention window for
+// its type of history.
+type historyTable struct {
+	// name is the table's name.
+	name string
+
+	// column is the timestamp column that the rows' ages are based on.
+	column string
+}
+
+// historyTables are the tables that can be pruned, keyed by the name of the
+// type of history they contain. The names are the keys used in the
+// retention settings.
+var historyTables = map[string]historyTable{
+	"container-summaries": {name: "vice_container_summaries", column: "recorded_at"},
+	"container-logs":      {name: "vice_container_logs", column: "recorded_at"},
+	"image-pulls":         {name: "vice_image_pulls", column: "recorded_at"},
+	"container-restarts":  {name: "vice_container_restarts", column: "restarted_at"},
+	"command-audit":       {name: "vice_command_audit", column: "received_at"},
+	"reaped-resources":    {name: "vice_reaped_resources", column: "reaped_at"},
+	"sent-notifications":  {name: "vice_sent_notifications", column: "sent_at"},
+}
+
+// historyTypes returns the names of the types of history in a stable order.
+func historyTypes() []string {
+	types := make([]string, 0, len(historyTables))
+	for historyType := range historyTables {
+		types = append(types, historyType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// HistoryRetentionConfig contains the settings for pruning old analysis
+// history from the database.
+type HistoryRetentionConfig struct {
+	// Interval is how often the history is pruned.
+	Interval time.Duration
+
+	// BatchSize is the number of rows deleted from a table at a time, so that
+	// pruning a large backlog doesn't hold locks for long.
+	BatchSize int
+
+	// Retention is how long each type of history is kept, keyed by the names
+	// in historyTables. Types without a retention are kept forever.
+	Retention map[string]time.Duration
+}
+
+// Validate returns an error if the retention settings name an unknown type
+// of history or have negative durations.
+func (c *HistoryRetentionConfig) Validate() error {
+	for historyType, retention := range c.Retention {
+		if _, ok := historyTables[historyType]; !ok {
+			return fmt.Errorf("unknown history type %q in the retention settings; must be one of %v", historyType, historyTypes())
+		}
+		if retention < 0 {
+			return fmt.Errorf("the retention for %s must not be negative", historyType)
+		}
+	}
+	if c.Interval < 0 {
+		return fmt.Errorf("the history retention interval must not be negative")
+	}
+	if c.BatchSize < 0 {
+		return fmt.Errorf("the history retention batch size must not be negative")
+	}
+	return nil
+}
+
+// PrunedHistory is the number of rows pruned from a table of history.
+type PrunedHistory struct {
+	HistoryType string    `json:"history_type"`
+	Table       string    `json:"table"`
+	Cutoff      time.Time `json:"cutoff"`
+	Deleted     int64     `json:"deleted"`
+}
+
+// HistoryPruner periodically deletes the rows of analysis history that are
+// older than their retention windows, to keep the DE database from growing
+// without bound.
+type HistoryPruner struct {
+	internal  *Internal
+	interval  time.Duration
+	batchSize int
+	retention map[string]time.Duration
+	now       func() time.Time
+}
+
+// NewHistoryPruner returns a new *HistoryPruner.
+func NewHistoryPruner(i *Internal) *HistoryPruner {
+	p := &HistoryPruner{
+		internal:  i,
+		interval:  i.HistoryRetention.Interval,
+		batchSize: i.HistoryRetention.BatchSize,
+		retention: i.HistoryRetention.Retention,
+		now:       time.Now,
+	}
+	if p.interval <= 0 {
+		p.interval = defaultRetentionInterval
+	}
+	if p.batchSize <= 0 {
+		p.batchSize = defaultRetentionBatchSize
+	}
+	return p
+}
+
+// pruneSQL deletes a batch of rows older than the cutoff. Postgres doesn't
+// support LIMIT in DELETE statements, so the rows are selected by ctid.
+func pruneSQL(table historyTable) string {
+	return fmt.Sprintf(`
+	DELETE FROM %[1]s
+	 WHERE ctid IN (
+	       SELECT ctid
+	         FROM %[1]s
+	        WHERE %[2]s < $1
+	        LIMIT $2
+	 )
+`, pq.QuoteIdentifier(table.name), pq.QuoteIdentifier(table.column))
+}
+
+// pruneTable deletes the rows older than the cutoff from the table, a batch
+// at a time, and returns the number of rows deleted.
+func (p *HistoryPruner) pruneTable(ctx context.Context, table historyTable, cutoff time.Time) (int64, error) {
+	query := pruneSQL(table)
+
+	var total int64
+	for {
+		result, err := p.internal.db.ExecContext(ctx, query, cutoff, p.batchSize)
+		if err != nil {
+			return total, errors.Wrapf(err, "error pruning %s", table.name)
+		}
+		deleted, err := result.RowsAffected()
+		if err != nil {
+			return total, errors.Wrapf(err, "error pruning %s", table.name)
+		}
+		total += deleted
+
+		if deleted < int64(p.batchSize) || ctx.Err() != nil {
+			return total, ctx.Err()
+		}
+	}
+}
+
+// prune deletes the history that's older than its retention window from each
+// of the tables and returns the number of rows deleted from each. Tables
+// that can't be pruned are logged and skipped.
+func (p *HistoryPruner) prune(ctx context.Context) ([]PrunedHistory, error) {
+	pruned := []PrunedHistory{}
+
+	for _, historyType := range historyTypes() {
+		retention := p.retention[historyType]
+		if retention <= 0 {
+			continue
+		}
+
+		table := historyTables[historyType]
+		cutoff := p.now().Add(-retention)
+		deleted, err := p.pruneTable(ctx, table, cutoff)
+		if err != nil {
+			if ctx.Err() != nil {
+				return pruned, err
+			}
+			log.WithContext(ctx).Error(err)
+		}
+		if deleted > 0 {
+			log.WithContext(ctx).Infof("pruned %d rows older than %s from %s", deleted, cutoff.Format(time.RFC3339), table.name)
+		}
+
+		pruned = append(pruned, PrunedHistory{
+			HistoryType: historyType,
+			Table:       table.name,
+			Cutoff:      cutoff,
+			Deleted:     deleted,
+		})
+	}
+
+	return pruned, nil
+}
+
+// Run prunes the history periodically until the context is canceled.
+func (p *HistoryPruner) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := p.prune(ctx); err != nil {
+				log.WithContext(ctx).Error(err)
+			}
+		}
+	}
+}
+
+// RunHistoryPruner starts pruning old analysis history. Blocks until the
+// context is canceled.
+func (i *Internal) RunHistoryPruner(ctx context.Context) {
+	NewHistoryPruner(i).Run(ctx)
+}
+
+// HistoryStorage describes the space used by a table of analysis history.
+type HistoryStorage struct {
+	HistoryType string `json:"history_type" db:"-"`
+	Table       string `json:"table" db:"table_name"`
+
+	// EstimatedRows comes from the table's statistics, so it's only as
+	// current as the last ANALYZE.
+	EstimatedRows int64 `json:"estimated_rows" db:"estimated_rows"`
+
+	// TotalBytes includes the table's indexes and TOAST data.
+	TotalBytes int64 `json:"total_bytes" db:"total_bytes"`
+
+	// Retention is how long the history is kept, or null if it's kept
+	// forever.
+	Retention *string `json:"retention" db:"-"`
+}
+
+const historyStorageSQL = `
+	SELECT c.relname AS table_name,
+	       greatest(c.reltuples, 0)::bigint AS estimated_rows,
+	       pg_total_relation_size(c.oid) AS total_bytes
+	  FROM pg_class c
+	  JOIN pg_namespace n ON c.relnamespace = n.oid
+	 WHERE c.relname = ANY($1)
+	   AND c.relkind = 'r'
+	   AND n.nspname = current_schema()
+`
+
+// historyStorage returns the space used by each of the tables of analysis
+// history. Tables that haven't been created are left out.
+func (i *Internal) historyStorage(ctx context.Context) ([]HistoryStorage, error) {
+	names := []string{}
+	typesByTable := map[string]string{}
+	for _, historyType := range historyTypes() {
+		names = append(names, historyTables[historyType].name)
+		typesByTable[historyTables[historyType].name] = historyType
+	}
+
+	rows := []HistoryStorage{}
+	if err := i.db.SelectContext(ctx, &rows, historyStorageSQL, pq.Array(names)); err != nil {
+		return nil, errors.Wrap(err, "error looking up the sizes of the history tables")
+	}
+
+	for idx := range rows {
+		rows[idx].HistoryType = typesByTable[rows[idx].Table]
+		if retention := i.HistoryRetention.Retention[rows[idx].HistoryType]; retention > 0 {
+			value := retention.String()
+			rows[idx].Retention = &value
+		}
+	}
+	sort.Slice(rows, func(a, b int) bool {
+		return rows[a].TotalBytes > rows[b].TotalBytes
+	})
+
+	return rows, nil
+}
+
+// AdminHistoryStorageHandler reports the space used by each table of
+// analysis history, largest first, along with its retention window.
+func (i *Internal) AdminHistoryStorageHandler(c echo.Context) error {
+	tables, err := i.historyStorage(c.Request().Context())
+	if err != nil {
+		return err
+	}
+
+	var totalBytes int64
+	for _, table := range tables {
+		totalBytes += table.TotalBytes
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"total_bytes": totalBytes,
+		"tables":      tables,
+	})
+}
+
+// AdminPruneHistoryHandler prunes the analysis history immediately and
+// returns the number of rows deleted from each table.
+func (i *Internal) AdminPruneHistoryHandler(c echo.Context) error {
+	pruned, err := NewHistoryPruner(i).prune(c.Request().Context())
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"pruned": pruned,
+	})
+}
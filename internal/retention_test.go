@@ -0,0 +1,103 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistoryRetentionConfigValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError((&HistoryRetentionConfig{}).Validate())
+	assert.NoError((&HistoryRetentionConfig{Retention: map[string]time.Duration{"image-pulls": 24 * time.Hour, "command-audit": 0}}).Validate())
+
+	assert.Error((&HistoryRetentionConfig{Retention: map[string]time.Duration{"specs": time.Hour}}).Validate())
+	assert.Error((&HistoryRetentionConfig{Retention: map[string]time.Duration{"image-pulls": -time.Hour}}).Validate())
+	assert.Error((&HistoryRetentionConfig{Interval: -time.Minute}).Validate())
+}
+
+func TestHistoryPrunerPrune(t *testing.T) {
+	assert := assert.New(t)
+
+	mockdb, mock, err := sqlmock.New()
+	assert.NoError(err)
+	defer mockdb.Close()
+
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	i := &Internal{
+		Init: Init{HistoryRetention: HistoryRetentionConfig{
+			BatchSize: 2,
+			Retention: map[string]time.Duration{
+				"image-pulls":        24 * time.Hour,
+				"container-restarts": 48 * time.Hour,
+				"command-audit":      0,
+			},
+		}},
+		db: sqlx.NewDb(mockdb, "sqlmock"),
+	}
+	p := NewHistoryPruner(i)
+	p.now = func() time.Time { return now }
+
+	// Tables are pruned in batches until a batch comes up short, and types
+	// without a retention aren't pruned at all.
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "vice_container_restarts"`)).
+		WithArgs(now.Add(-48*time.Hour), 2).
+		WillReturnError(errors.New("relation does not exist"))
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "vice_image_pulls"`)).
+		WithArgs(now.Add(-24*time.Hour), 2).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM "vice_image_pulls"`)).
+		WithArgs(now.Add(-24*time.Hour), 2).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	pruned, err := p.prune(context.Background())
+	assert.NoError(err)
+	if assert.Len(pruned, 2) {
+		assert.Equal("container-restarts", pruned[0].HistoryType)
+		assert.Equal(int64(0), pruned[0].Deleted)
+		assert.Equal("vice_image_pulls", pruned[1].Table)
+		assert.Equal(int64(3), pruned[1].Deleted)
+		assert.Equal(now.Add(-24*time.Hour), pruned[1].Cutoff)
+	}
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestHistoryStorage(t *testing.T) {
+	assert := assert.New(t)
+
+	mockdb, mock, err := sqlmock.New()
+	assert.NoError(err)
+	defer mockdb.Close()
+
+	i := &Internal{
+		Init: Init{HistoryRetention: HistoryRetentionConfig{
+			Retention: map[string]time.Duration{"image-pulls": 2160 * time.Hour},
+		}},
+		db: sqlx.NewDb(mockdb, "sqlmock"),
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta("FROM pg_class c")).
+		WillReturnRows(sqlmock.NewRows([]string{"table_name", "estimated_rows", "total_bytes"}).
+			AddRow("vice_command_audit", 100, 8192).
+			AddRow("vice_image_pulls", 5000, 1048576))
+
+	tables, err := i.historyStorage(context.Background())
+	assert.NoError(err)
+	if assert.Len(tables, 2) {
+		assert.Equal("image-pulls", tables[0].HistoryType)
+		assert.Equal(int64(1048576), tables[0].TotalBytes)
+		if assert.NotNil(tables[0].Retention) {
+			assert.Equal("2160h0m0s", *tables[0].Retention)
+		}
+		assert.Equal("command-audit", tables[1].HistoryType)
+		assert.Nil(tables[1].Retention)
+	}
+	assert.NoError(mock.ExpectationsWereMet())
+}
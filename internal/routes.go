@@ -0,0 +1,112 @@
+package internal
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	apiv1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// routePathRegexp matches the paths that may be routed to a port of the
+// analysis container. Paths are matched by prefix, so they may not contain
+// wildcards or regular expression syntax.
+var routePathRegexp = regexp.MustCompile(`^(/[A-Za-z0-9._~-]+)+$`)
+
+// SubpathRoute sends the requests for a path under the analysis's subdomain
+// to a port of the analysis container, for tools that serve more than one
+// application from the same pod, such as TensorBoard alongside JupyterLab.
+//
+// Requests for the path go straight to the analysis container rather than
+// through vice-proxy, so they aren't authenticated. Only route paths to
+// ports that serve content that's safe to expose or that do their own
+// authentication.
+type SubpathRoute struct {
+	// Path is the path prefix to route, for example /tb.
+	Path string `json:"path"`
+
+	// Port is the port the analysis container serves the path on.
+	Port int32 `json:"port"`
+}
+
+// reservedRoutePorts are used by the other containers in the analysis pod or
+// by the analysis's Service, so routes can't use them.
+var reservedRoutePorts = map[int32]bool{
+	viceProxyPort:        true,
+	viceProxyServicePort: true,
+	fileTransfersPort:    true,
+}
+
+// validateRoutes returns an error if the routes are invalid. Each path must
+// be unique, and each port must be one the analysis container can listen on
+// without colliding with the other containers in the pod.
+func validateRoutes(routes []SubpathRoute) error {
+	paths := map[string]bool{}
+	for _, route := range routes {
+		if !routePathRegexp.MatchString(route.Path) || strings.Contains(route.Path, "/../") || strings.HasSuffix(route.Path, "/..") {
+			return fmt.Errorf("invalid route path %q", route.Path)
+		}
+		if paths[route.Path] {
+			return fmt.Errorf("the route path %s is listed more than once", route.Path)
+		}
+		paths[route.Path] = true
+
+		if route.Port < 1 || route.Port > 65535 {
+			return fmt.Errorf("invalid port %d for route path %s", route.Port, route.Path)
+		}
+		if reservedRoutePorts[route.Port] {
+			return fmt.Errorf("port %d for route path %s is reserved for VICE", route.Port, route.Path)
+		}
+	}
+	return nil
+}
+
+// routePortName returns the name of the Service port for a route port.
+func routePortName(port int32) string {
+	return fmt.Sprintf("tcp-route-%d", port)
+}
+
+// routeServicePorts returns the Service ports for the routes. Routes that
+// share a port share a Service port.
+func routeServicePorts(routes []SubpathRoute) []apiv1.ServicePort {
+	ports := []apiv1.ServicePort{}
+	seen := map[int32]bool{}
+	for _, route := range routes {
+		if seen[route.Port] {
+			continue
+		}
+		seen[route.Port] = true
+
+		ports = append(ports, apiv1.ServicePort{
+			Name:       routePortName(route.Port),
+			Protocol:   apiv1.ProtocolTCP,
+			Port:       route.Port,
+			TargetPort: intstr.FromInt(int(route.Port)),
+		})
+	}
+	return ports
+}
+
+// routeIngressPaths returns the Ingress paths for the routes. They go before
+// the path for vice-proxy, which matches everything else.
+func routeIngressPaths(serviceName string, routes []SubpathRoute) []netv1.HTTPIngressPath {
+	paths := []netv1.HTTPIngressPath{}
+	pathType := netv1.PathTypePrefix
+	for _, route := range routes {
+		paths = append(paths, netv1.HTTPIngressPath{
+			Path:     route.Path,
+			PathType: &pathType,
+			Backend: netv1.IngressBackend{
+				Service: &netv1.IngressServiceBackend{
+					Name: serviceName,
+					Port: netv1.ServiceBackendPort{
+						Number: route.Port,
+					},
+				},
+			},
+		})
+	}
+	return paths
+}
@@ -0,0 +1,86 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cyverse-de/app-exposer/apps"
+	"github.com/cyverse-de/model/v6"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	netv1 "k8s.io/api/networking/v1"
+)
+
+func TestValidateRoutes(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(validateRoutes(nil))
+	assert.NoError(validateRoutes([]SubpathRoute{{Path: "/tb", Port: 6006}, {Path: "/shiny/app", Port: 3838}}))
+	assert.NoError(validateRoutes([]SubpathRoute{{Path: "/a", Port: 8000}, {Path: "/b", Port: 8000}}))
+
+	assert.Error(validateRoutes([]SubpathRoute{{Path: "/", Port: 6006}}))
+	assert.Error(validateRoutes([]SubpathRoute{{Path: "tb", Port: 6006}}))
+	assert.Error(validateRoutes([]SubpathRoute{{Path: "/tb/", Port: 6006}}))
+	assert.Error(validateRoutes([]SubpathRoute{{Path: "/tb/..", Port: 6006}}))
+	assert.Error(validateRoutes([]SubpathRoute{{Path: "/tb(.*)", Port: 6006}}))
+	assert.Error(validateRoutes([]SubpathRoute{{Path: "/tb", Port: 6006}, {Path: "/tb", Port: 6007}}))
+	assert.Error(validateRoutes([]SubpathRoute{{Path: "/tb", Port: 0}}))
+	assert.Error(validateRoutes([]SubpathRoute{{Path: "/tb", Port: 70000}}))
+	assert.Error(validateRoutes([]SubpathRoute{{Path: "/tb", Port: viceProxyPort}}))
+	assert.Error(validateRoutes([]SubpathRoute{{Path: "/tb", Port: fileTransfersPort}}))
+
+	assert.Error((&ToolSettings{Routes: []SubpathRoute{{Path: "/tb", Port: viceProxyServicePort}}}).Validate())
+}
+
+func TestRoutedServiceAndIngress(t *testing.T) {
+	assert := assert.New(t)
+
+	mockdb, mock, err := sqlmock.New()
+	assert.NoError(err)
+	defer mockdb.Close()
+
+	a := apps.NewApps(sqlx.NewDb(mockdb, "sqlmock"), "@example.org")
+	a.ConfigureCache(&apps.CacheConfig{MaxEntries: 10, AnalysisIDTTL: time.Hour, UserIPTTL: time.Hour})
+	mock.ExpectQuery("SELECT l.ip_address").WithArgs("u1").WillReturnRows(sqlmock.NewRows([]string{"ip_address"}).AddRow("10.0.0.1"))
+
+	i := &Internal{
+		Init: Init{ViceDefaultBackendService: "vice-default-backend", ViceDefaultBackendServicePort: 80},
+		apps: a,
+	}
+	job := &model.Job{InvocationID: "e1", UserID: "u1", Name: "analysis"}
+	settings := &ToolSettings{Routes: []SubpathRoute{
+		{Path: "/tb", Port: 6006},
+		{Path: "/tb-data", Port: 6006},
+		{Path: "/shiny", Port: 3838},
+	}}
+
+	svc, err := i.getService(context.Background(), job, settings)
+	assert.NoError(err)
+	ports := map[string]int32{}
+	for _, port := range svc.Spec.Ports {
+		ports[port.Name] = port.TargetPort.IntVal
+	}
+	assert.Len(ports, 4)
+	assert.Equal(int32(6006), ports["tcp-route-6006"])
+	assert.Equal(int32(3838), ports["tcp-route-3838"])
+
+	ingress, err := i.getIngress(context.Background(), job, svc, settings, "nginx")
+	assert.NoError(err)
+	if assert.Len(ingress.Spec.Rules, 1) {
+		paths := ingress.Spec.Rules[0].HTTP.Paths
+		if assert.Len(paths, 4) {
+			assert.Equal("/tb", paths[0].Path)
+			assert.Equal(netv1.PathTypePrefix, *paths[0].PathType)
+			assert.Equal(int32(6006), paths[0].Backend.Service.Port.Number)
+			assert.Equal("/shiny", paths[2].Path)
+			assert.Equal(int32(3838), paths[2].Backend.Service.Port.Number)
+
+			// The proxy path comes last so it only gets what the routes don't.
+			assert.Equal("", paths[3].Path)
+			assert.Equal(viceProxyServicePort, paths[3].Backend.Service.Port.Number)
+		}
+	}
+	assert.NoError(mock.ExpectationsWereMet())
+}
@@ -0,0 +1,149 @@
+package internal
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// encryptedSecretPrefix starts the secrets stored in the database that are
+// encrypted. It's followed by the ID of the key that encrypted the secret and
+// the base64-encoded nonce and ciphertext, separated by colons. Secrets
+// without it were stored before encryption was configured.
+const encryptedSecretPrefix = "enc:"
+
+// SecretKey is an AES key used to encrypt the secrets app-exposer stores in
+// the database, such as the registry robot account secrets.
+type SecretKey struct {
+	// ID identifies the key in the encrypted values, for example 2024-06.
+	ID string `koanf:"id"`
+
+	// Key is the base64-encoded 16, 24, or 32 byte AES key.
+	Key string `koanf:"key"`
+}
+
+// SecretKeys is the key ring for the secrets stored in the database. The
+// first key encrypts new secrets, and every key can decrypt, so a key can be
+// rotated by adding its replacement to the front of the list, re-encrypting
+// the stored secrets, and then removing it. Secrets are stored unencrypted if
+// the list is empty.
+type SecretKeys []SecretKey
+
+// SecretKeyRing encrypts and decrypts the secrets stored in the database.
+type SecretKeyRing struct {
+	current string
+	aeads   map[string]cipher.AEAD
+}
+
+// NewSecretKeyRing returns a *SecretKeyRing for the keys, or nil if there
+// aren't any.
+func NewSecretKeyRing(keys SecretKeys) (*SecretKeyRing, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	ring := &SecretKeyRing{
+		current: keys[0].ID,
+		aeads:   map[string]cipher.AEAD{},
+	}
+	for _, key := range keys {
+		if key.ID == "" || strings.Contains(key.ID, ":") {
+			return nil, fmt.Errorf("invalid secret key ID %q; it must be set and can't contain colons", key.ID)
+		}
+		if _, ok := ring.aeads[key.ID]; ok {
+			return nil, fmt.Errorf("duplicate secret key ID %s", key.ID)
+		}
+
+		raw, err := base64.StdEncoding.DecodeString(key.Key)
+		if err != nil {
+			return nil, errors.Wrapf(err, "secret key %s isn't valid base64", key.ID)
+		}
+		block, err := aes.NewCipher(raw)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid secret key %s", key.ID)
+		}
+		if ring.aeads[key.ID], err = cipher.NewGCM(block); err != nil {
+			return nil, errors.Wrapf(err, "invalid secret key %s", key.ID)
+		}
+	}
+
+	return ring, nil
+}
+
+// CurrentKeyID returns the ID of the key that encrypts new secrets, or an
+// empty string if secrets aren't encrypted.
+func (r *SecretKeyRing) CurrentKeyID() string {
+	if r == nil {
+		return ""
+	}
+	return r.current
+}
+
+// Encrypt returns the value to store for the secret. The secret is returned
+// as it is if there are no keys.
+func (r *SecretKeyRing) Encrypt(secret string) (string, error) {
+	if r == nil {
+		return secret, nil
+	}
+
+	aead := r.aeads[r.current]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", errors.Wrap(err, "unable to generate a nonce")
+	}
+
+	sealed := aead.Seal(nonce, nonce, []byte(secret), []byte(r.current))
+	return encryptedSecretPrefix + r.current + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// secretKeyID returns the ID of the key that encrypted the stored value, or
+// an empty string if it isn't encrypted.
+func secretKeyID(value string) string {
+	if !strings.HasPrefix(value, encryptedSecretPrefix) {
+		return ""
+	}
+	id, _, _ := strings.Cut(strings.TrimPrefix(value, encryptedSecretPrefix), ":")
+	return id
+}
+
+// Decrypt returns the secret in the stored value. Values that aren't
+// encrypted are returned as they are.
+func (r *SecretKeyRing) Decrypt(value string) (string, error) {
+	if !strings.HasPrefix(value, encryptedSecretPrefix) {
+		return value, nil
+	}
+
+	id, encoded, found := strings.Cut(strings.TrimPrefix(value, encryptedSecretPrefix), ":")
+	if !found {
+		return "", fmt.Errorf("malformed encrypted secret")
+	}
+	if r == nil {
+		return "", fmt.Errorf("the secret was encrypted with key %s, but no secret keys are configured", id)
+	}
+	aead, ok := r.aeads[id]
+	if !ok {
+		return "", fmt.Errorf("the secret was encrypted with key %s, which isn't configured", id)
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("malformed encrypted secret")
+	}
+	secret, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(id))
+	if err != nil {
+		return "", errors.Wrapf(err, "unable to decrypt the secret with key %s", id)
+	}
+	return string(secret), nil
+}
+
+// Stale returns true if the stored value should be encrypted again with the
+// current key.
+func (r *SecretKeyRing) Stale(value string) bool {
+	return r != nil && secretKeyID(value) != r.current
+}
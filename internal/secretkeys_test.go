@@ -0,0 +1,174 @@
+package internal
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+// testSecretKey returns a 32 byte key filled with the byte.
+func testSecretKey(id string, b byte) SecretKey {
+	return SecretKey{ID: id, Key: base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(b), 32)))}
+}
+
+func TestNewSecretKeyRing(t *testing.T) {
+	assert := assert.New(t)
+
+	ring, err := NewSecretKeyRing(nil)
+	assert.NoError(err)
+	assert.Nil(ring)
+
+	_, err = NewSecretKeyRing(SecretKeys{testSecretKey("2024:06", 'a')})
+	assert.Error(err)
+	_, err = NewSecretKeyRing(SecretKeys{testSecretKey("", 'a')})
+	assert.Error(err)
+	_, err = NewSecretKeyRing(SecretKeys{testSecretKey("old", 'a'), testSecretKey("old", 'b')})
+	assert.Error(err)
+	_, err = NewSecretKeyRing(SecretKeys{{ID: "short", Key: base64.StdEncoding.EncodeToString([]byte("tooshort"))}})
+	assert.Error(err)
+	_, err = NewSecretKeyRing(SecretKeys{{ID: "bad", Key: "not base64!"}})
+	assert.Error(err)
+}
+
+func TestSecretKeyRingRotation(t *testing.T) {
+	assert := assert.New(t)
+
+	old, err := NewSecretKeyRing(SecretKeys{testSecretKey("old", 'a')})
+	assert.NoError(err)
+	stored, err := old.Encrypt("robot secret")
+	assert.NoError(err)
+	assert.True(strings.HasPrefix(stored, "enc:old:"))
+	assert.NotContains(stored, "robot secret")
+	assert.Equal("old", secretKeyID(stored))
+	assert.False(old.Stale(stored))
+
+	// The new key encrypts, and the old one can still decrypt.
+	rotated, err := NewSecretKeyRing(SecretKeys{testSecretKey("new", 'b'), testSecretKey("old", 'a')})
+	assert.NoError(err)
+	assert.Equal("new", rotated.CurrentKeyID())
+	assert.True(rotated.Stale(stored))
+	secret, err := rotated.Decrypt(stored)
+	assert.NoError(err)
+	assert.Equal("robot secret", secret)
+
+	reencrypted, err := rotated.Encrypt(secret)
+	assert.NoError(err)
+	assert.Equal("new", secretKeyID(reencrypted))
+	assert.False(rotated.Stale(reencrypted))
+
+	// Once the old key is removed, its secrets can't be read.
+	removed, err := NewSecretKeyRing(SecretKeys{testSecretKey("new", 'b')})
+	assert.NoError(err)
+	_, err = removed.Decrypt(stored)
+	assert.Error(err)
+
+	// Tampering is detected, including moving a secret to another key ID.
+	_, err = rotated.Decrypt(strings.Replace(reencrypted, "enc:new:", "enc:old:", 1))
+	assert.Error(err)
+
+	// Secrets stored before encryption was configured are read as they are,
+	// and need to be encrypted.
+	secret, err = rotated.Decrypt("plain")
+	assert.NoError(err)
+	assert.Equal("plain", secret)
+	assert.True(rotated.Stale("plain"))
+
+	// Without keys, nothing is encrypted.
+	var none *SecretKeyRing
+	stored, err = none.Encrypt("plain")
+	assert.NoError(err)
+	assert.Equal("plain", stored)
+	assert.False(none.Stale("plain"))
+	_, err = none.Decrypt(reencrypted)
+	assert.Error(err)
+}
+
+func TestRegistryCredentialReencryptsOnRead(t *testing.T) {
+	assert := assert.New(t)
+
+	mockdb, mock, err := sqlmock.New()
+	assert.NoError(err)
+	defer mockdb.Close()
+
+	ring, err := NewSecretKeyRing(SecretKeys{testSecretKey("new", 'b')})
+	assert.NoError(err)
+	i := &Internal{
+		Init: Init{SecretKeys: ring},
+		db:   sqlx.NewDb(mockdb, "sqlmock"),
+	}
+
+	mock.ExpectQuery("FROM vice_registry_credentials").WithArgs("harbor.cyverse.org", "private").
+		WillReturnRows(sqlmock.NewRows([]string{"registry", "project", "username", "secret"}).
+			AddRow("harbor.cyverse.org", "private", "robot$private", "secret"))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE vice_registry_credentials")).
+		WithArgs("harbor.cyverse.org", "private", "secret", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	credential, err := i.registryCredential(context.Background(), "harbor.cyverse.org", "private")
+	assert.NoError(err)
+	assert.Equal("secret", credential.Secret)
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestAdminReencryptRegistryCredentialsHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	mockdb, mock, err := sqlmock.New()
+	assert.NoError(err)
+	defer mockdb.Close()
+
+	old, err := NewSecretKeyRing(SecretKeys{testSecretKey("old", 'a')})
+	assert.NoError(err)
+	oldSecret, err := old.Encrypt("old secret")
+	assert.NoError(err)
+
+	ring, err := NewSecretKeyRing(SecretKeys{testSecretKey("new", 'b'), testSecretKey("old", 'a')})
+	assert.NoError(err)
+	current, err := ring.Encrypt("current secret")
+	assert.NoError(err)
+
+	i := &Internal{
+		Init: Init{SecretKeys: ring},
+		db:   sqlx.NewDb(mockdb, "sqlmock"),
+	}
+
+	mock.ExpectQuery("FROM vice_registry_credentials").
+		WillReturnRows(sqlmock.NewRows([]string{"registry", "project", "username", "secret"}).
+			AddRow("harbor.cyverse.org", "a", "robot$a", "plain secret").
+			AddRow("harbor.cyverse.org", "b", "robot$b", oldSecret).
+			AddRow("harbor.cyverse.org", "c", "robot$c", current).
+			AddRow("harbor.cyverse.org", "d", "robot$d", "enc:retired:AAAA"))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE vice_registry_credentials")).
+		WithArgs("harbor.cyverse.org", "a", "plain secret", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE vice_registry_credentials")).
+		WithArgs("harbor.cyverse.org", "b", oldSecret, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodPost, "/", nil), rec)
+	assert.NoError(i.AdminReencryptRegistryCredentialsHandler(c))
+	assert.Equal(http.StatusOK, rec.Code)
+
+	result := &SecretReencryption{}
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), result))
+	assert.Equal(&SecretReencryption{KeyID: "new", Reencrypted: 2, Failed: []string{"harbor.cyverse.org/d"}}, result)
+	assert.NoError(mock.ExpectationsWereMet())
+
+	// There's nothing to do without keys.
+	i.SecretKeys = nil
+	err = i.AdminReencryptRegistryCredentialsHandler(echo.New().NewContext(httptest.NewRequest(http.MethodPost, "/", nil), httptest.NewRecorder()))
+	if assert.Error(err) {
+		assert.Equal(http.StatusBadRequest, err.(*echo.HTTPError).Code)
+	}
+}
@@ -0,0 +1,124 @@
+package internal
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/cyverse-de/app-exposer/metrics"
+	"github.com/labstack/echo/v4"
+)
+
+// The outcomes recorded for launches.
+const (
+	launchLaunched = "launched"
+
+	// launchRejected is recorded for launches that were refused because of
+	// the request, such as launches over the user's quota or with invalid
+	// submissions.
+	launchRejected = "rejected"
+
+	// launchFailed is recorded for launches that app-exposer or the cluster
+	// couldn't complete.
+	launchFailed = "failed"
+)
+
+// The outcomes recorded for terminations.
+const (
+	// terminationStopped is recorded when the analysis's Deployment was
+	// deleted.
+	terminationStopped = "stopped"
+
+	// terminationCleanedUp is recorded when the analysis wasn't running, but
+	// its other resources were cleaned up.
+	terminationCleanedUp = "cleaned-up"
+
+	terminationFailed = "failed"
+)
+
+// The kinds of NATS messages counted when they can't be published.
+const (
+	natsTransferAccounting = "transfer-accounting"
+	NATSAPIReply           = "api-reply"
+)
+
+// launchDurationBuckets are the upper bounds, in seconds, of the launch
+// duration buckets. Launches wait for the launch limiter and call several
+// services, so they take longer than most requests.
+var launchDurationBuckets = []float64{0.25, 0.5, 1, 2.5, 5, 10, 20, 30, 60, 120}
+
+var (
+	launchDurations = metrics.NewHistogramVec(
+		"app_exposer_launch_duration_seconds",
+		"How long VICE launch requests took, by outcome.",
+		launchDurationBuckets,
+		"outcome",
+	)
+
+	terminations = metrics.NewCounterVec(
+		"app_exposer_terminations_total",
+		"The VICE analyses whose resources were deleted, by outcome.",
+		"outcome",
+	)
+
+	upsertErrors = metrics.NewCounterVec(
+		"app_exposer_upsert_errors_total",
+		"The k8s resources for VICE analyses that couldn't be created or updated, by kind.",
+		"resource",
+	)
+
+	natsPublishFailures = metrics.NewCounterVec(
+		"app_exposer_nats_publish_failures_total",
+		"The NATS messages that couldn't be published, by kind.",
+		"kind",
+	)
+)
+
+// launchOutcome returns the outcome to record for a launch that returned the
+// error.
+func launchOutcome(err error) string {
+	switch err := err.(type) {
+	case nil:
+		return launchLaunched
+	case common.ErrorResponse, *common.ErrorResponse:
+		return launchRejected
+	case *echo.HTTPError:
+		if err.Code < http.StatusInternalServerError {
+			return launchRejected
+		}
+	}
+	return launchFailed
+}
+
+// observeLaunch records how long a launch took.
+func observeLaunch(duration time.Duration, err error) {
+	metrics.Observe(launchDurations, duration.Seconds(), launchOutcome(err))
+}
+
+// recordTermination counts the deletion of an analysis's resources.
+func recordTermination(running bool, err error) {
+	switch {
+	case err != nil:
+		metrics.Inc(terminations, terminationFailed)
+	case running:
+		metrics.Inc(terminations, terminationStopped)
+	default:
+		metrics.Inc(terminations, terminationCleanedUp)
+	}
+}
+
+// recordUpsertError counts the error if a resource of the kind couldn't be
+// created or updated.
+func recordUpsertError(resource string, err error) {
+	if err != nil {
+		metrics.Inc(upsertErrors, resource)
+	}
+}
+
+// RecordNATSPublishError counts the error if a NATS message of the kind
+// couldn't be published.
+func RecordNATSPublishError(kind string, err error) {
+	if err != nil {
+		metrics.Inc(natsPublishFailures, kind)
+	}
+}
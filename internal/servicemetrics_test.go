@@ -0,0 +1,59 @@
+package internal
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/cyverse-de/app-exposer/metrics"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLaunchOutcome(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(launchLaunched, launchOutcome(nil))
+	assert.Equal(launchRejected, launchOutcome(common.ErrorResponse{ErrorCode: "ERR_LIMIT_REACHED"}))
+	assert.Equal(launchRejected, launchOutcome(&common.ErrorResponse{ErrorCode: "ERR_IMAGE_NOT_FOUND"}))
+	assert.Equal(launchRejected, launchOutcome(echo.NewHTTPError(http.StatusBadRequest, "bad submission")))
+	assert.Equal(launchFailed, launchOutcome(echo.NewHTTPError(http.StatusInternalServerError, "oops")))
+	assert.Equal(launchFailed, launchOutcome(&LaunchRollbackError{Err: errors.New("the ingress couldn't be created")}))
+	assert.Equal(launchFailed, launchOutcome(errors.New("connection refused")))
+
+	before := metrics.HistogramCount(launchDurations, launchRejected)
+	observeLaunch(2*time.Second, common.ErrorResponse{ErrorCode: "ERR_FORBIDDEN"})
+	assert.Equal(before+1, metrics.HistogramCount(launchDurations, launchRejected))
+}
+
+func TestRecordTermination(t *testing.T) {
+	assert := assert.New(t)
+
+	stopped := metrics.CounterValue(terminations, terminationStopped)
+	cleanedUp := metrics.CounterValue(terminations, terminationCleanedUp)
+	failed := metrics.CounterValue(terminations, terminationFailed)
+
+	recordTermination(true, nil)
+	recordTermination(false, nil)
+	recordTermination(true, errors.New("the k8s API is down"))
+
+	assert.Equal(stopped+1, metrics.CounterValue(terminations, terminationStopped))
+	assert.Equal(cleanedUp+1, metrics.CounterValue(terminations, terminationCleanedUp))
+	assert.Equal(failed+1, metrics.CounterValue(terminations, terminationFailed))
+}
+
+func TestRecordUpsertAndPublishErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	before := metrics.CounterValue(upsertErrors, "ingress")
+	recordUpsertError("ingress", nil)
+	recordUpsertError("ingress", errors.New("admission webhook denied the request"))
+	assert.Equal(before+1, metrics.CounterValue(upsertErrors, "ingress"))
+
+	before = metrics.CounterValue(natsPublishFailures, natsTransferAccounting)
+	RecordNATSPublishError(natsTransferAccounting, nil)
+	RecordNATSPublishError(natsTransferAccounting, errors.New("nats: connection closed"))
+	assert.Equal(before+1, metrics.CounterValue(natsPublishFailures, natsTransferAccounting))
+}
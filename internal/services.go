@@ -11,9 +11,13 @@ import (
 	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
-// getService assembles and returns the Service needed for the VICE analysis.
-// It does not call the k8s API.
-func (i *Internal) getService(ctx context.Context, job *model.Job) (*apiv1.Service, error) {
+// getService assembles and returns the Service needed for the VICE analysis,
+// including a port for each of the tool's subpath routes. It does not call
+// the k8s API.
+func (i *Internal) getService(ctx context.Context, job *model.Job, settings *ToolSettings) (*apiv1.Service, error) {
+	ctx, span := startResourceSpan(ctx, "getService", "service")
+	defer span.End()
+
 	labels, err := i.labelsFromJob(ctx, job)
 	if err != nil {
 		return nil, err
@@ -45,5 +49,7 @@ func (i *Internal) getService(ctx context.Context, job *model.Job) (*apiv1.Servi
 		},
 	}
 
+	svc.Spec.Ports = append(svc.Spec.Ports, routeServicePorts(settings.Routes)...)
+
 	return &svc, nil
 }
@@ -0,0 +1,205 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+
+	"github.com/cyverse-de/model/v6"
+	"github.com/pkg/errors"
+	apiv1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The defaults for the session token settings, which work with the stock
+// Jupyter images.
+const (
+	defaultSessionTokenEnvVar     = "JUPYTER_TOKEN"
+	defaultSessionTokenQueryParam = "token"
+)
+
+// sessionTokenKey is the key of the token in the session token Secret and
+// the environment variable vice-proxy reads it from.
+const sessionTokenKey = "VICE_SESSION_TOKEN"
+
+var (
+	// envVarNameRegexp matches the names that may be used for the environment
+	// variable containing the session token.
+	envVarNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+	// queryParamRegexp matches the names of the query parameters that
+	// vice-proxy may add the session token to.
+	queryParamRegexp = regexp.MustCompile(`^[A-Za-z0-9._~-]+$`)
+)
+
+// SessionToken configures the per-analysis token for tools whose images
+// require one, such as the stock Jupyter images. A random token is generated
+// for each analysis and passed to the analysis container in an environment
+// variable, and vice-proxy adds it to the requests it sends to the
+// container, so users don't get asked for it.
+type SessionToken struct {
+	// EnvVar is the environment variable the analysis container reads the
+	// token from. Defaults to JUPYTER_TOKEN.
+	EnvVar string `json:"env_var,omitempty"`
+
+	// QueryParam is the query parameter vice-proxy adds the token to.
+	// Defaults to token.
+	QueryParam string `json:"query_param,omitempty"`
+}
+
+// Validate returns an error if the session token settings are invalid.
+func (t *SessionToken) Validate() error {
+	if t.EnvVar != "" && !envVarNameRegexp.MatchString(t.EnvVar) {
+		return fmt.Errorf("invalid session token environment variable %q", t.EnvVar)
+	}
+	if t.QueryParam != "" && !queryParamRegexp.MatchString(t.QueryParam) {
+		return fmt.Errorf("invalid session token query parameter %q", t.QueryParam)
+	}
+	return nil
+}
+
+// envVar returns the environment variable the analysis container reads the
+// token from.
+func (t *SessionToken) envVar() string {
+	if t.EnvVar == "" {
+		return defaultSessionTokenEnvVar
+	}
+	return t.EnvVar
+}
+
+// queryParam returns the query parameter vice-proxy adds the token to.
+func (t *SessionToken) queryParam() string {
+	if t.QueryParam == "" {
+		return defaultSessionTokenQueryParam
+	}
+	return t.QueryParam
+}
+
+// sessionTokenSecretName returns the name of the Secret containing the
+// analysis's session token.
+func sessionTokenSecretName(job *model.Job) string {
+	return fmt.Sprintf("vice-session-token-%s", job.InvocationID)
+}
+
+// newSessionToken returns a new random session token.
+func newSessionToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", errors.Wrap(err, "error generating a session token")
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// sessionTokenSecretRef returns a reference to the token in the analysis's
+// session token Secret.
+func sessionTokenSecretRef(job *model.Job) *apiv1.EnvVarSource {
+	return &apiv1.EnvVarSource{
+		SecretKeyRef: &apiv1.SecretKeySelector{
+			LocalObjectReference: apiv1.LocalObjectReference{
+				Name: sessionTokenSecretName(job),
+			},
+			Key: sessionTokenKey,
+		},
+	}
+}
+
+// sessionTokenEnv returns the environment variables that pass the session
+// token to the analysis container. Returns nil if the tool doesn't use one.
+func (s *ToolSettings) sessionTokenEnv(job *model.Job) []apiv1.EnvVar {
+	if s.SessionToken == nil {
+		return nil
+	}
+	return []apiv1.EnvVar{
+		{Name: s.SessionToken.envVar(), ValueFrom: sessionTokenSecretRef(job)},
+	}
+}
+
+// sessionTokenProxyEnv returns the environment variables that pass the
+// session token to the vice-proxy container. Returns nil if the tool doesn't
+// use one.
+func (s *ToolSettings) sessionTokenProxyEnv(job *model.Job) []apiv1.EnvVar {
+	if s.SessionToken == nil {
+		return nil
+	}
+	return []apiv1.EnvVar{
+		{Name: sessionTokenKey, ValueFrom: sessionTokenSecretRef(job)},
+	}
+}
+
+// sessionTokenProxyArgs returns the vice-proxy command-line arguments that
+// make it add the session token to the requests it sends to the analysis.
+// The token is referenced through an environment variable so that it
+// doesn't show up in the pod spec.
+func (s *ToolSettings) sessionTokenProxyArgs() []string {
+	if s.SessionToken == nil {
+		return nil
+	}
+	return []string{
+		"--upstream-token", envRef(sessionTokenKey),
+		"--upstream-token-param", s.SessionToken.queryParam(),
+	}
+}
+
+// sessionTokenSecret returns the Secret containing a new session token for
+// the analysis. Returns nil if the tool doesn't use one. This does NOT call
+// the k8s API to actually create the Secret.
+func (i *Internal) sessionTokenSecret(ctx context.Context, job *model.Job, settings *ToolSettings) (*apiv1.Secret, error) {
+	if settings.SessionToken == nil {
+		return nil, nil
+	}
+
+	labels, err := i.labelsFromJob(ctx, job)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := newSessionToken()
+	if err != nil {
+		return nil, err
+	}
+
+	return &apiv1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   sessionTokenSecretName(job),
+			Labels: labels,
+		},
+		Type: apiv1.SecretTypeOpaque,
+		StringData: map[string]string{
+			sessionTokenKey: token,
+		},
+	}, nil
+}
+
+// UpsertSessionTokenSecret creates the Secret containing the analysis's
+// session token if the tool uses one and it doesn't already exist. An
+// existing token is kept so that the sessions users already have open keep
+// working.
+func (i *Internal) UpsertSessionTokenSecret(ctx context.Context, job *model.Job, settings *ToolSettings) (err error) {
+	ctx, span := startResourceSpan(ctx, "UpsertSessionTokenSecret", "secret")
+	defer func() { recordUpsertError("secret", err); endSpan(span, err) }()
+
+	if settings.SessionToken == nil {
+		return nil
+	}
+
+	secretclient := i.clientset.CoreV1().Secrets(i.ViceNamespace)
+
+	_, err = secretclient.Get(ctx, sessionTokenSecretName(job), metav1.GetOptions{})
+	if err == nil {
+		return nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	secret, err := i.sessionTokenSecret(ctx, job, settings)
+	if err != nil {
+		return err
+	}
+
+	_, err = secretclient.Create(ctx, secret, metav1.CreateOptions{})
+	return err
+}
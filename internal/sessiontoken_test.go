@@ -0,0 +1,101 @@
+package internal
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/cyverse-de/model/v6"
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSessionTokenValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError((&SessionToken{}).Validate())
+	assert.NoError((&SessionToken{EnvVar: "NOTEBOOK_TOKEN", QueryParam: "auth_token"}).Validate())
+	assert.Error((&SessionToken{EnvVar: "1TOKEN"}).Validate())
+	assert.Error((&SessionToken{EnvVar: "TOKEN=x"}).Validate())
+	assert.Error((&SessionToken{QueryParam: "token&admin=1"}).Validate())
+
+	assert.Error((&ToolSettings{SessionToken: &SessionToken{EnvVar: "bad var"}}).Validate())
+}
+
+func TestSessionTokenContainers(t *testing.T) {
+	assert := assert.New(t)
+
+	proxyAuth, err := NewProxyAuth(&Init{ProxyAuthBackend: NoProxyAuthBackend})
+	assert.NoError(err)
+
+	i := &Internal{Init: Init{FrontendBaseURL: "https://cyverse.run", ProxyAuth: proxyAuth}}
+	job := &model.Job{InvocationID: "e1", UserID: "u1"}
+	job.Steps = []model.Step{{}}
+	job.Steps[0].Component.Container.Ports = []model.Ports{{ContainerPort: 8888}}
+
+	containers := i.deploymentContainers(job, &ToolSettings{}, nil)
+	proxy := containers[0]
+	assert.Empty(proxy.Env)
+	assert.NotContains(strings.Join(proxy.Command, " "), "--upstream-token")
+
+	containers = i.deploymentContainers(job, &ToolSettings{SessionToken: &SessionToken{}}, nil)
+	proxy, analysis := containers[0], containers[len(containers)-1]
+
+	// The proxy and the analysis get the same token from the Secret.
+	command := strings.Join(proxy.Command, " ")
+	assert.Contains(command, "--upstream-token $(VICE_SESSION_TOKEN) --upstream-token-param token")
+	if assert.Len(proxy.Env, 1) {
+		assert.Equal(sessionTokenKey, proxy.Env[0].Name)
+		assert.Equal(sessionTokenSecretName(job), proxy.Env[0].ValueFrom.SecretKeyRef.Name)
+	}
+
+	var tokenEnv *apiv1.EnvVar
+	for idx := range analysis.Env {
+		if analysis.Env[idx].Name == "JUPYTER_TOKEN" {
+			tokenEnv = &analysis.Env[idx]
+		}
+	}
+	if assert.NotNil(tokenEnv) {
+		assert.Empty(tokenEnv.Value)
+		assert.Equal(sessionTokenKey, tokenEnv.ValueFrom.SecretKeyRef.Key)
+	}
+}
+
+func TestUpsertSessionTokenSecret(t *testing.T) {
+	assert := assert.New(t)
+
+	job := &model.Job{InvocationID: "e1", UserID: "u1"}
+	existing := &apiv1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: sessionTokenSecretName(job), Namespace: "vice-apps"},
+		Data:       map[string][]byte{sessionTokenKey: []byte("existing")},
+	}
+
+	i := &Internal{
+		Init:      Init{ViceNamespace: "vice-apps"},
+		clientset: fake.NewSimpleClientset(existing),
+	}
+	ctx := context.Background()
+
+	// Nothing is created for tools that don't use a token.
+	assert.NoError(i.UpsertSessionTokenSecret(ctx, &model.Job{InvocationID: "e2"}, &ToolSettings{}))
+
+	// The token is kept when the analysis is launched again, so that the
+	// sessions users already have open keep working.
+	assert.NoError(i.UpsertSessionTokenSecret(ctx, job, &ToolSettings{SessionToken: &SessionToken{}}))
+	secret, err := i.clientset.CoreV1().Secrets("vice-apps").Get(ctx, sessionTokenSecretName(job), metav1.GetOptions{})
+	if assert.NoError(err) {
+		assert.Equal("existing", string(secret.Data[sessionTokenKey]))
+	}
+
+	secrets, err := i.clientset.CoreV1().Secrets("vice-apps").List(ctx, metav1.ListOptions{})
+	if assert.NoError(err) {
+		assert.Len(secrets.Items, 1)
+	}
+
+	token, err := newSessionToken()
+	if assert.NoError(err) {
+		assert.Len(token, 64)
+	}
+}
@@ -0,0 +1,101 @@
+package internal
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/cyverse-de/model/v6"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/apps/v1"
+	resourcev1 "k8s.io/apimachinery/pkg/api/resource"
+)
+
+// SharedMemoryConfig contains the bounds for the /dev/shm sizes users may
+// request when they launch an analysis.
+type SharedMemoryConfig struct {
+	// Max is the largest size users may request, for example 16Gi. Users
+	// can't change the size if it's empty.
+	Max string
+}
+
+// Validate returns an error if the configuration can't be used.
+func (c *SharedMemoryConfig) Validate() error {
+	if c.Max == "" {
+		return nil
+	}
+	max, err := resourcev1.ParseQuantity(c.Max)
+	if err != nil {
+		return errors.Wrapf(err, "invalid maximum shared memory size %q", c.Max)
+	}
+	if max.Sign() <= 0 {
+		return fmt.Errorf("the maximum shared memory size must be greater than 0")
+	}
+	return nil
+}
+
+// setSharedMemoryDevice sets the size of the /dev/shm volume for the job. The
+// size is stored in the container path of the device, which is where the apps
+// service puts it.
+func setSharedMemoryDevice(job *model.Job, size resourcev1.Quantity) {
+	container := &job.Steps[0].Component.Container
+	for idx := range container.Devices {
+		if strings.HasPrefix(strings.ToLower(container.Devices[idx].HostPath), shmDevice) {
+			container.Devices[idx].ContainerPath = size.String()
+			return
+		}
+	}
+	container.Devices = append(container.Devices, model.Device{
+		HostPath:      shmDevice,
+		ContainerPath: size.String(),
+	})
+}
+
+// applySharedMemory replaces the /dev/shm size from the app with the one
+// requested in the launch request, if there is one. The size can't be larger
+// than the configured maximum or the analysis's memory limit, since the
+// volume's contents count against the limit. The resource preset must already
+// have been applied.
+func (i *Internal) applySharedMemory(job *model.Job, opts *launchOptions) error {
+	if opts.SharedMemory == "" {
+		return nil
+	}
+
+	if i.SharedMemory.Max == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "the shared memory size can't be changed")
+	}
+
+	size, err := resourcev1.ParseQuantity(opts.SharedMemory)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid shared memory size %q", opts.SharedMemory))
+	}
+	if size.Sign() <= 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "the shared memory size must be greater than 0")
+	}
+
+	max := resourcev1.MustParse(i.SharedMemory.Max)
+	if size.Cmp(max) > 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("the shared memory size can't be larger than %s", max.String()))
+	}
+
+	memLimit := memResourceLimit(job)
+	if size.Cmp(memLimit) > 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("the shared memory size can't be larger than the memory limit of %s", memLimit.String()))
+	}
+
+	setSharedMemoryDevice(job, size)
+
+	return nil
+}
+
+// deploymentSharedMemory returns the size of the /dev/shm volume in the
+// Deployment, or an empty string if it doesn't have one.
+func deploymentSharedMemory(deployment *v1.Deployment) string {
+	for _, volume := range deployment.Spec.Template.Spec.Volumes {
+		if volume.Name == sharedMemoryVolumeName && volume.EmptyDir != nil && volume.EmptyDir.SizeLimit != nil {
+			return volume.EmptyDir.SizeLimit.String()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,89 @@
+package internal
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/cyverse-de/model/v6"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	resourcev1 "k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestSharedMemoryConfigValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError((&SharedMemoryConfig{}).Validate())
+	assert.NoError((&SharedMemoryConfig{Max: "16Gi"}).Validate())
+	assert.Error((&SharedMemoryConfig{Max: "lots"}).Validate())
+	assert.Error((&SharedMemoryConfig{Max: "0"}).Validate())
+}
+
+func TestApplySharedMemory(t *testing.T) {
+	assert := assert.New(t)
+
+	newJob := func() *model.Job {
+		return &model.Job{Steps: []model.Step{{
+			Component: model.StepComponent{
+				Container: model.Container{
+					MemoryLimit: 8 * 1024 * 1024 * 1024,
+					Devices: []model.Device{
+						{HostPath: "/dev/shm", ContainerPath: "64Mi"},
+					},
+				},
+			},
+		}}}
+	}
+
+	assertBadRequest := func(err error) {
+		if assert.Error(err) {
+			assert.Equal(http.StatusBadRequest, err.(*echo.HTTPError).Code)
+		}
+	}
+
+	// Users can't change the size unless a maximum is configured.
+	i := &Internal{}
+	job := newJob()
+	assert.NoError(i.applySharedMemory(job, &launchOptions{}))
+	assertBadRequest(i.applySharedMemory(job, &launchOptions{SharedMemory: "1Gi"}))
+
+	i.SharedMemory.Max = "16Gi"
+	assert.NoError(i.applySharedMemory(job, &launchOptions{SharedMemory: "4Gi"}))
+	if assert.Len(job.Steps[0].Component.Container.Devices, 1) {
+		assert.Equal("4Gi", job.Steps[0].Component.Container.Devices[0].ContainerPath)
+	}
+	assert.Equal("4Gi", sharedMemoryAmount(job).String())
+
+	// The device is added if the app doesn't have one.
+	job = newJob()
+	job.Steps[0].Component.Container.Devices = nil
+	assert.NoError(i.applySharedMemory(job, &launchOptions{SharedMemory: "2Gi"}))
+	assert.Equal("2Gi", sharedMemoryAmount(job).String())
+
+	assertBadRequest(i.applySharedMemory(newJob(), &launchOptions{SharedMemory: "lots"}))
+	assertBadRequest(i.applySharedMemory(newJob(), &launchOptions{SharedMemory: "0"}))
+	assertBadRequest(i.applySharedMemory(newJob(), &launchOptions{SharedMemory: "32Gi"}))
+
+	// The volume counts against the memory limit.
+	assertBadRequest(i.applySharedMemory(newJob(), &launchOptions{SharedMemory: "12Gi"}))
+}
+
+func TestDeploymentSharedMemory(t *testing.T) {
+	assert := assert.New(t)
+
+	deployment := &appsv1.Deployment{}
+	assert.Equal("", deploymentSharedMemory(deployment))
+
+	size := resourcev1.MustParse("4Gi")
+	deployment.Spec.Template.Spec.Volumes = []apiv1.Volume{
+		{
+			Name: sharedMemoryVolumeName,
+			VolumeSource: apiv1.VolumeSource{
+				EmptyDir: &apiv1.EmptyDirVolumeSource{Medium: "Memory", SizeLimit: &size},
+			},
+		},
+	}
+	assert.Equal("4Gi", deploymentSharedMemory(deployment))
+}
@@ -0,0 +1,113 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cyverse-de/model/v6"
+	apiv1 "k8s.io/api/core/v1"
+	resourcev1 "k8s.io/apimachinery/pkg/api/resource"
+)
+
+// sidecarContainerPrefix is the prefix of the names of the containers run for
+// the steps after the first one.
+const sidecarContainerPrefix = "sidecar-"
+
+// sidecarContainerName returns the name of the container for the step at
+// index, which must be greater than zero.
+func sidecarContainerName(index int) string {
+	return fmt.Sprintf("%s%d", sidecarContainerPrefix, index)
+}
+
+// isSidecarContainer returns true if the container was created for one of the
+// steps after the first one.
+func isSidecarContainer(name string) bool {
+	return strings.HasPrefix(name, sidecarContainerPrefix)
+}
+
+// sidecarPorts returns the container ports of the sidecar for the step at
+// index. The names are unique within the pod.
+func sidecarPorts(index int, step *model.Step) []apiv1.ContainerPort {
+	ports := []apiv1.ContainerPort{}
+
+	for i, p := range step.Component.Container.Ports {
+		ports = append(ports, apiv1.ContainerPort{
+			ContainerPort: int32(p.ContainerPort),
+			Name:          fmt.Sprintf("tcp-s%d-%d", index, i),
+			Protocol:      apiv1.ProtocolTCP,
+		})
+	}
+
+	return ports
+}
+
+// sidecarResources returns the resource requests and limits for a sidecar.
+// Unlike the analysis container, sidecars don't get default requests; the
+// CPU and memory limits are required when the job is submitted.
+func sidecarResources(container *model.Container) apiv1.ResourceRequirements {
+	requests := apiv1.ResourceList{}
+	limits := apiv1.ResourceList{}
+
+	if container.MinCPUCores > 0 {
+		requests[apiv1.ResourceCPU] = *resourcev1.NewMilliQuantity(int64(container.MinCPUCores*1000), resourcev1.DecimalSI)
+	}
+	if container.MaxCPUCores > 0 {
+		limits[apiv1.ResourceCPU] = *resourcev1.NewMilliQuantity(int64(container.MaxCPUCores*1000), resourcev1.DecimalSI)
+	}
+	if container.MinMemoryLimit > 0 {
+		requests[apiv1.ResourceMemory] = *resourcev1.NewQuantity(container.MinMemoryLimit, resourcev1.BinarySI)
+	}
+	if container.MemoryLimit > 0 {
+		limits[apiv1.ResourceMemory] = *resourcev1.NewQuantity(container.MemoryLimit, resourcev1.BinarySI)
+	}
+
+	return apiv1.ResourceRequirements{
+		Limits:   limits,
+		Requests: requests,
+	}
+}
+
+// sidecarContainers returns the containers for the steps after the first one,
+// which run helper processes such as a database or a compute kernel next to
+// the analysis container. They share the analysis container's volumes, user,
+// and group, and are reachable from it on localhost. Only the analysis
+// container is exposed through the proxy.
+func (i *Internal) sidecarContainers(job *model.Job, settings *ToolSettings, defaultEnv map[string]string) []apiv1.Container {
+	containers := []apiv1.Container{}
+
+	for idx := 1; idx < len(job.Steps); idx++ {
+		step := &job.Steps[idx]
+		container := &step.Component.Container
+
+		sidecar := apiv1.Container{
+			Name:            sidecarContainerName(idx),
+			Image:           fmt.Sprintf("%s:%s", container.Image.Name, container.Image.Tag),
+			ImagePullPolicy: apiv1.PullPolicy(apiv1.PullAlways),
+			Env:             i.stepEnvironment(job, step, defaultEnv),
+			Resources:       sidecarResources(container),
+			VolumeMounts:    i.analysisVolumeMounts(job),
+			Ports:           sidecarPorts(idx, step),
+			SecurityContext: &apiv1.SecurityContext{
+				RunAsUser:  int64Ptr(settings.runAsUser(job)),
+				RunAsGroup: int64Ptr(settings.runAsGroup(job)),
+			},
+		}
+
+		// The entry points were validated when the analysis was launched.
+		if command, err := entryPointCommand(container.EntryPoint); err == nil {
+			sidecar.Command = command
+		}
+
+		if container.WorkingDir != "" {
+			sidecar.WorkingDir = container.WorkingDir
+		}
+
+		if len(step.Arguments()) != 0 {
+			sidecar.Args = append(sidecar.Args, step.Arguments()...)
+		}
+
+		containers = append(containers, sidecar)
+	}
+
+	return containers
+}
@@ -0,0 +1,91 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/cyverse-de/model/v6"
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+func sidecarJob() *model.Job {
+	job := &model.Job{
+		InvocationID: "e1",
+		Submitter:    "ipcdev",
+		Steps:        []model.Step{{}, {}},
+	}
+	job.Steps[0].Component.Container = model.Container{
+		Image:       model.ContainerImage{Name: "jupyter", Tag: "latest"},
+		Ports:       []model.Ports{{ContainerPort: 8888}},
+		MaxCPUCores: 2,
+	}
+	job.Steps[1].Component.Container = model.Container{
+		Image:       model.ContainerImage{Name: "postgres", Tag: "16"},
+		Ports:       []model.Ports{{ContainerPort: 5432}},
+		EntryPoint:  `["postgres", "-c", "fsync=off"]`,
+		MinCPUCores: 0.25,
+		MaxCPUCores: 0.5,
+		MemoryLimit: 512 * 1024 * 1024,
+		WorkingDir:  "/var/lib/postgresql",
+	}
+	job.Steps[1].Environment = map[string]string{"POSTGRES_DB": "notebooks"}
+	return job
+}
+
+func TestSidecarContainers(t *testing.T) {
+	assert := assert.New(t)
+
+	i := &Internal{Init: Init{UseCSIDriver: true}}
+	job := sidecarJob()
+
+	defaultEnv := map[string]string{"TZ": "UTC"}
+	analysis := i.defineAnalysisContainer(job, &ToolSettings{}, defaultEnv)
+	sidecars := i.sidecarContainers(job, &ToolSettings{}, defaultEnv)
+	if !assert.Len(sidecars, 1) {
+		return
+	}
+
+	sidecar := sidecars[0]
+	assert.Equal("sidecar-1", sidecar.Name)
+	assert.Equal("postgres:16", sidecar.Image)
+	assert.Equal([]string{"postgres", "-c", "fsync=off"}, sidecar.Command)
+	assert.Equal("/var/lib/postgresql", sidecar.WorkingDir)
+	assert.Equal([]apiv1.ContainerPort{{Name: "tcp-s1-0", ContainerPort: 5432, Protocol: apiv1.ProtocolTCP}}, sidecar.Ports)
+	assert.Equal("500m", sidecar.Resources.Limits.Cpu().String())
+	assert.Equal("250m", sidecar.Resources.Requests.Cpu().String())
+	assert.Equal("512Mi", sidecar.Resources.Limits.Memory().String())
+	_, ok := sidecar.Resources.Requests[apiv1.ResourceMemory]
+	assert.False(ok)
+	assert.Nil(sidecar.ReadinessProbe)
+
+	// The sidecar shares the analysis container's volumes.
+	assert.Equal(analysis.VolumeMounts, sidecar.VolumeMounts)
+
+	env := map[string]string{}
+	for _, v := range sidecar.Env {
+		env[v.Name] = v.Value
+	}
+	assert.Equal("notebooks", env["POSTGRES_DB"])
+	assert.Equal("UTC", env["TZ"])
+	assert.Equal("e1", env["IPLANT_EXECUTION_ID"])
+}
+
+func TestGetMillicoresFromDeploymentSidecars(t *testing.T) {
+	assert := assert.New(t)
+
+	i := &Internal{Init: Init{UseCSIDriver: true}}
+	deployment := &appsv1.Deployment{}
+	job := sidecarJob()
+	deployment.Spec.Template.Spec.Containers = append(
+		[]apiv1.Container{i.defineAnalysisContainer(job, &ToolSettings{}, nil)},
+		i.sidecarContainers(job, &ToolSettings{}, nil)...,
+	)
+
+	millicores, err := getMillicoresFromDeployment(deployment)
+	if assert.NoError(err) {
+		f, err := millicores.Float64()
+		assert.NoError(err)
+		assert.Equal(2500.0, f)
+	}
+}
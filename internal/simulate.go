@@ -0,0 +1,112 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/cyverse-de/app-exposer/apps"
+	"github.com/cyverse-de/model/v6"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"k8s.io/client-go/kubernetes"
+)
+
+// SimulatedResource is a Kubernetes object that would be created for a job.
+type SimulatedResource struct {
+	Kind   string                 `json:"kind"`
+	Name   string                 `json:"name"`
+	Object map[string]interface{} `json:"object"`
+}
+
+// Simulator generates the Kubernetes objects for jobs without creating
+// anything, so that the output of the spec builders can be compared across
+// changes. It only reads from the database; the label values for names that
+// would normally be recorded in the database are hashed without being
+// claimed.
+type Simulator struct {
+	i *Internal
+}
+
+// simulatorCacheEntries is the size of the simulator's lookup caches.
+const simulatorCacheEntries = 1000
+
+// NewSimulator returns a *Simulator that generates objects with the given
+// configuration. The clientset is only read from, so a fake clientset
+// containing the CA certificate ConfigMaps, if any, is enough.
+func NewSimulator(init *Init, db *sqlx.DB, clientset kubernetes.Interface) (*Simulator, error) {
+	// Each object's labels include the user's IP, so it's only looked up once.
+	a := apps.NewApps(db, init.UserSuffix)
+	a.ConfigureCache(&apps.CacheConfig{
+		MaxEntries:    simulatorCacheEntries,
+		AnalysisIDTTL: time.Hour,
+		UserIPTTL:     time.Hour,
+	})
+
+	sim := &Internal{
+		Init:      *init,
+		db:        db,
+		clientset: clientset,
+		apps:      a,
+	}
+
+	if sim.ProxyAuth == nil {
+		proxyAuth, err := NewProxyAuth(init)
+		if err != nil {
+			return nil, err
+		}
+		sim.ProxyAuth = proxyAuth
+	}
+
+	return &Simulator{i: sim}, nil
+}
+
+// Simulate returns the objects that a launch of the job would create, in the
+// order they'd be created in. Resource presets and other launch options
+// aren't applied, and neither is the deployment policy.
+func (s *Simulator) Simulate(ctx context.Context, job *model.Job) ([]SimulatedResource, error) {
+	// Use the shortest hash for names that would be claimed in the database,
+	// so that nothing is written to it.
+	s.i.labelValues.clear()
+	for kind, name := range map[string]string{appNameKind: job.AppName, analysisNameKind: job.Name} {
+		if labelValueString(name) != name {
+			s.i.labelValues.set(kind, name, hashedLabelValue(name, labelHashLengths[0]))
+		}
+	}
+
+	settings, err := s.i.getToolSettings(ctx, job)
+	if err != nil {
+		return nil, err
+	}
+
+	deployment, err := s.i.getDeployment(ctx, job, settings)
+	if err != nil {
+		return nil, err
+	}
+
+	resources, err := s.i.dryRunResources(ctx, job, deployment, settings)
+	if err != nil {
+		return nil, err
+	}
+
+	simulated := make([]SimulatedResource, 0, len(resources))
+	for _, resource := range resources {
+		data, err := applyPatchData(resource)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error encoding %s %s", resource.kind, resource.name)
+		}
+
+		object := map[string]interface{}{}
+		if err = json.Unmarshal(data, &object); err != nil {
+			return nil, errors.Wrapf(err, "error decoding %s %s", resource.kind, resource.name)
+		}
+
+		simulated = append(simulated, SimulatedResource{
+			Kind:   resource.kind,
+			Name:   resource.name,
+			Object: object,
+		})
+	}
+
+	return simulated, nil
+}
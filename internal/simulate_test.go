@@ -0,0 +1,77 @@
+package internal
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cyverse-de/model/v6"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSimulate(t *testing.T) {
+	assert := assert.New(t)
+
+	mockdb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockdb.Close()
+	mock.MatchExpectationsInOrder(false)
+
+	clientset := fake.NewSimpleClientset()
+	simulator, err := NewSimulator(&Init{
+		ViceNamespace:        "vice-apps",
+		KeycloakClientSecret: "secret",
+	}, sqlx.NewDb(mockdb, "sqlmock"), clientset)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mock.ExpectQuery("SELECT l.ip_address").WithArgs("u1").
+		WillReturnRows(sqlmock.NewRows([]string{"ip_address"}).AddRow("10.0.0.1"))
+	mock.ExpectQuery("FROM vice_app_env_vars").
+		WillReturnRows(sqlmock.NewRows([]string{"global", "name", "value"}))
+
+	job := &model.Job{
+		InvocationID: "e1",
+		UserID:       "u1",
+		Name:         "My Analysis!",
+		AppName:      "jupyter",
+		Steps: []model.Step{{
+			Component: model.StepComponent{
+				Container: model.Container{
+					Image: model.ContainerImage{Name: "jupyter", Tag: "latest"},
+					Ports: []model.Ports{{ContainerPort: 8888}},
+				},
+			},
+		}},
+	}
+
+	resources, err := simulator.Simulate(context.Background(), job)
+	assert.NoError(err)
+
+	kinds := []string{}
+	var deployment map[string]interface{}
+	for _, resource := range resources {
+		kinds = append(kinds, resource.Kind+"/"+resource.Name)
+		if resource.Kind == "Deployment" {
+			deployment = resource.Object
+		}
+		assert.NotEmpty(resource.Object["apiVersion"])
+		assert.Equal(resource.Kind, resource.Object["kind"])
+	}
+	assert.Contains(kinds, "Deployment/e1")
+	assert.Contains(kinds, "Service/vice-e1")
+
+	// The hashed analysis name isn't claimed in the database, and nothing is
+	// created in the cluster.
+	if assert.NotNil(deployment) {
+		labels := deployment["metadata"].(map[string]interface{})["labels"].(map[string]interface{})
+		assert.Equal(hashedLabelValue(job.Name, labelHashLengths[0]), labels["analysis-name"])
+	}
+	assert.Empty(clientset.Actions())
+	assert.NoError(mock.ExpectationsWereMet())
+}
@@ -0,0 +1,320 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/cyverse-de/app-exposer/jobgen"
+	"github.com/cyverse-de/model/v6"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	defaultSmokeTestImage          = "nginxinc/nginx-unprivileged:alpine"
+	defaultSmokeTestPort           = 8080
+	defaultSmokeTestTimeout        = 5 * time.Minute
+	defaultSmokeTestCleanupTimeout = 2 * time.Minute
+	defaultSmokeTestPollInterval   = 2 * time.Second
+)
+
+// smokeTestAppName is the name of the built-in app launched by the smoke
+// test. It's used for the analysis name as well, so that the smoke test's
+// analyses are easy to spot.
+const smokeTestAppName = "app-exposer-smoke-test"
+
+// The steps of a smoke test, in the order they run.
+const (
+	smokeTestStepSpec      = "spec"
+	smokeTestStepCreate    = "create"
+	smokeTestStepURLReady  = "url-ready"
+	smokeTestStepTerminate = "terminate"
+	smokeTestStepCleanup   = "cleanup"
+)
+
+// SmokeTestConfig contains the settings for the smoke test, which launches a
+// tiny app from start to finish so that monitoring can find problems with the
+// platform before users do.
+type SmokeTestConfig struct {
+	// User and UserID identify the account the test analyses are launched
+	// for. The user must have logged in to the DE.
+	User   string
+	UserID string
+
+	// Image is the app's image. It has to serve HTTP on Port.
+	Image string
+	Port  int
+
+	// Timeout limits the time it takes to build, create, and wait for the
+	// analysis. CleanupTimeout limits the time it takes to remove it
+	// afterwards.
+	Timeout        time.Duration
+	CleanupTimeout time.Duration
+
+	// PollInterval is how often the analysis is checked while waiting for it
+	// to become ready or go away.
+	PollInterval time.Duration
+}
+
+// Validate returns an error if the configuration can't be used.
+func (c *SmokeTestConfig) Validate() error {
+	if c.Port < 0 || c.Port > 65535 {
+		return fmt.Errorf("invalid smoke test port %d", c.Port)
+	}
+	if c.Timeout < 0 || c.CleanupTimeout < 0 || c.PollInterval < 0 {
+		return fmt.Errorf("the smoke test timeouts and poll interval must not be negative")
+	}
+	return nil
+}
+
+func (c *SmokeTestConfig) image() string {
+	if c.Image != "" {
+		return c.Image
+	}
+	return defaultSmokeTestImage
+}
+
+func (c *SmokeTestConfig) port() int {
+	if c.Port > 0 {
+		return c.Port
+	}
+	return defaultSmokeTestPort
+}
+
+func (c *SmokeTestConfig) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+	return defaultSmokeTestTimeout
+}
+
+func (c *SmokeTestConfig) cleanupTimeout() time.Duration {
+	if c.CleanupTimeout > 0 {
+		return c.CleanupTimeout
+	}
+	return defaultSmokeTestCleanupTimeout
+}
+
+func (c *SmokeTestConfig) pollInterval() time.Duration {
+	if c.PollInterval > 0 {
+		return c.PollInterval
+	}
+	return defaultSmokeTestPollInterval
+}
+
+// SmokeTestStep is the result of one step of a smoke test.
+type SmokeTestStep struct {
+	Name       string `json:"name"`
+	Succeeded  bool   `json:"succeeded"`
+	DurationMS int64  `json:"duration_ms"`
+	Error      string `json:"error,omitempty"`
+}
+
+// SmokeTestResult is the result of a smoke test. The steps that didn't run
+// because an earlier one failed are left out.
+type SmokeTestResult struct {
+	Succeeded  bool            `json:"succeeded"`
+	ExternalID string          `json:"external_id"`
+	Host       string          `json:"host"`
+	StartedAt  time.Time       `json:"started_at"`
+	DurationMS int64           `json:"duration_ms"`
+	Steps      []SmokeTestStep `json:"steps"`
+}
+
+// run runs a step of the smoke test and records its result. Returns false if
+// the step failed.
+func (r *SmokeTestResult) run(name string, step func() error) bool {
+	start := time.Now()
+	err := step()
+
+	result := SmokeTestStep{
+		Name:       name,
+		Succeeded:  err == nil,
+		DurationMS: time.Since(start).Milliseconds(),
+	}
+	if err != nil {
+		result.Error = err.Error()
+		r.Succeeded = false
+	}
+	r.Steps = append(r.Steps, result)
+
+	return err == nil
+}
+
+// smokeTestJob returns the job for the smoke test's analysis.
+func (i *Internal) smokeTestJob() (*model.Job, error) {
+	generator := &jobgen.Generator{UserSuffix: i.UserSuffix}
+	return generator.Generate(&jobgen.Descriptor{
+		Kind:      jobgen.VICEKind,
+		Name:      smokeTestAppName,
+		AppName:   smokeTestAppName,
+		User:      i.SmokeTest.User,
+		UserID:    i.SmokeTest.UserID,
+		Image:     i.SmokeTest.image(),
+		Port:      i.SmokeTest.port(),
+		MinCPU:    "100m",
+		MaxCPU:    "250m",
+		MinMemory: "64Mi",
+		MaxMemory: "256Mi",
+		TimeLimit: i.SmokeTest.timeout().String(),
+	})
+}
+
+// waitForSmokeTest calls check every poll interval until it returns true or
+// an error, or the context is done.
+func (i *Internal) waitForSmokeTest(ctx context.Context, what string, check func() (bool, error)) error {
+	ticker := time.NewTicker(i.SmokeTest.pollInterval())
+	defer ticker.Stop()
+
+	for {
+		done, err := check()
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "gave up waiting for %s", what)
+		case <-ticker.C:
+		}
+	}
+}
+
+// smokeTestGone returns true once the smoke test's analysis has no pods or
+// deployments left.
+func (i *Internal) smokeTestGone(ctx context.Context, externalID string) (bool, error) {
+	set := labels.Set(map[string]string{
+		"external-id": externalID,
+	})
+	listoptions := metav1.ListOptions{
+		LabelSelector: set.AsSelector().String(),
+	}
+
+	pods, err := i.clientset.CoreV1().Pods(i.ViceNamespace).List(ctx, listoptions)
+	if err != nil {
+		return false, err
+	}
+	deployments, err := i.clientset.AppsV1().Deployments(i.ViceNamespace).List(ctx, listoptions)
+	if err != nil {
+		return false, err
+	}
+	return len(pods.Items) == 0 && len(deployments.Items) == 0, nil
+}
+
+// runSmokeTest launches the smoke test's app, waits for it to be ready, and
+// removes it again. The analysis is removed even if a step fails, as long as
+// its resources might have been created.
+func (i *Internal) runSmokeTest(ctx context.Context) *SmokeTestResult {
+	result := &SmokeTestResult{
+		Succeeded: true,
+		StartedAt: time.Now().UTC(),
+		Steps:     []SmokeTestStep{},
+	}
+	defer func() {
+		result.DurationMS = time.Since(result.StartedAt).Milliseconds()
+	}()
+
+	launchCtx, cancel := context.WithTimeout(ctx, i.SmokeTest.timeout())
+	defer cancel()
+
+	var (
+		job        *model.Job
+		deployment *appsv1.Deployment
+		settings   = &ToolSettings{}
+	)
+	built := result.run(smokeTestStepSpec, func() error {
+		var err error
+		if job, err = i.smokeTestJob(); err != nil {
+			return err
+		}
+		result.ExternalID = job.InvocationID
+		if result.Host, err = i.subdomain(launchCtx, job); err != nil {
+			return err
+		}
+		deployment, err = i.getDeployment(launchCtx, job, settings)
+		return err
+	})
+	if !built {
+		return result
+	}
+
+	created := result.run(smokeTestStepCreate, func() error {
+		if err := i.UpsertExcludesConfigMap(launchCtx, job); err != nil {
+			return err
+		}
+		if err := i.UpsertInputPathListConfigMap(launchCtx, job); err != nil {
+			return err
+		}
+		if err := i.UpsertProxyCredentialsSecret(launchCtx, job); err != nil {
+			return err
+		}
+		return i.UpsertDeployment(launchCtx, deployment, job, settings)
+	})
+
+	if created {
+		result.run(smokeTestStepURLReady, func() error {
+			return i.waitForSmokeTest(launchCtx, "the analysis to become ready", func() (bool, error) {
+				readiness, err := i.urlReadiness(launchCtx, result.Host)
+				if err != nil {
+					return false, err
+				}
+				return readiness.Ready, nil
+			})
+		})
+	}
+
+	// Clean up even if the launch timed out or the request went away, since
+	// some of the resources may have been created.
+	cleanupCtx, cancelCleanup := context.WithTimeout(context.WithoutCancel(ctx), i.SmokeTest.cleanupTimeout())
+	defer cancelCleanup()
+
+	terminated := result.run(smokeTestStepTerminate, func() error {
+		_, err := i.deleteAnalysisResources(cleanupCtx, job.InvocationID)
+		return err
+	})
+	if terminated {
+		result.run(smokeTestStepCleanup, func() error {
+			return i.waitForSmokeTest(cleanupCtx, "the analysis to go away", func() (bool, error) {
+				return i.smokeTestGone(cleanupCtx, job.InvocationID)
+			})
+		})
+	}
+	i.hostLocations.remove(result.Host)
+
+	return result
+}
+
+// AdminSmokeTestHandler launches a tiny built-in app from start to finish and
+// reports how each step went. It's meant to be called by blackbox monitoring
+// every few minutes. Responds with a 503 if any step failed and a 409 if
+// another smoke test is already running.
+func (i *Internal) AdminSmokeTestHandler(c echo.Context) error {
+	if i.SmokeTest.UserID == "" || i.SmokeTest.User == "" {
+		return common.ErrorResponse{
+			ErrorCode: "ERR_NOT_CONFIGURED",
+			Message:   "the smoke test user isn't configured",
+		}
+	}
+
+	if !i.smokeTestMu.TryLock() {
+		return echo.NewHTTPError(http.StatusConflict, "a smoke test is already running")
+	}
+	defer i.smokeTestMu.Unlock()
+
+	ctx := c.Request().Context()
+	result := i.runSmokeTest(ctx)
+	if !result.Succeeded {
+		log.WithContext(ctx).Warnf("smoke test %s failed: %+v", result.ExternalID, result.Steps)
+		return c.JSON(http.StatusServiceUnavailable, result)
+	}
+	return c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,121 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func newSmokeTestInternal(t *testing.T) (*Internal, *fake.Clientset) {
+	i, mock, clientset := newLaunchTestInternal(t)
+	i.SmokeTest = SmokeTestConfig{
+		User:         "smoke-test",
+		UserID:       "u1",
+		Timeout:      100 * time.Millisecond,
+		PollInterval: 10 * time.Millisecond,
+	}
+	expectUserIP(mock)
+	mock.ExpectQuery(regexp.QuoteMeta("FROM vice_app_env_vars")).WillReturnRows(sqlmock.NewRows([]string{"global", "name", "value"}))
+	return i, clientset
+}
+
+func smokeTestSteps(result *SmokeTestResult) map[string]bool {
+	steps := map[string]bool{}
+	for _, step := range result.Steps {
+		steps[step.Name] = step.Succeeded
+	}
+	return steps
+}
+
+func TestRunSmokeTest(t *testing.T) {
+	assert := assert.New(t)
+
+	i, clientset := newSmokeTestInternal(t)
+
+	// The fake cluster doesn't run pods, so the Deployment is marked as ready
+	// as soon as it's created.
+	clientset.PrependReactor("create", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		action.(k8stesting.CreateAction).GetObject().(*appsv1.Deployment).Status.ReadyReplicas = 1
+		return false, nil, nil
+	})
+
+	result := i.runSmokeTest(context.Background())
+	assert.True(result.Succeeded, "%+v", result.Steps)
+	assert.NotEmpty(result.ExternalID)
+	assert.Equal(IngressName("u1", result.ExternalID), result.Host)
+	assert.Equal(map[string]bool{
+		smokeTestStepSpec:      true,
+		smokeTestStepCreate:    true,
+		smokeTestStepURLReady:  true,
+		smokeTestStepTerminate: true,
+		smokeTestStepCleanup:   true,
+	}, smokeTestSteps(result))
+
+	// Everything the smoke test created is gone.
+	deployments, err := clientset.AppsV1().Deployments("vice-apps").List(context.Background(), metav1.ListOptions{})
+	assert.NoError(err)
+	assert.Empty(deployments.Items)
+	ingresses, err := clientset.NetworkingV1().Ingresses("vice-apps").List(context.Background(), metav1.ListOptions{})
+	assert.NoError(err)
+	assert.Empty(ingresses.Items)
+	configMaps, err := clientset.CoreV1().ConfigMaps("vice-apps").List(context.Background(), metav1.ListOptions{})
+	assert.NoError(err)
+	assert.Empty(configMaps.Items)
+	secrets, err := clientset.CoreV1().Secrets("vice-apps").List(context.Background(), metav1.ListOptions{})
+	assert.NoError(err)
+	assert.Empty(secrets.Items)
+}
+
+func TestRunSmokeTestTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	i, clientset := newSmokeTestInternal(t)
+
+	// The analysis never becomes ready, but it's still cleaned up.
+	result := i.runSmokeTest(context.Background())
+	assert.False(result.Succeeded)
+	assert.Equal(map[string]bool{
+		smokeTestStepSpec:      true,
+		smokeTestStepCreate:    true,
+		smokeTestStepURLReady:  false,
+		smokeTestStepTerminate: true,
+		smokeTestStepCleanup:   true,
+	}, smokeTestSteps(result))
+	assert.Contains(result.Steps[2].Error, "gave up waiting for the analysis to become ready")
+
+	deployments, err := clientset.AppsV1().Deployments("vice-apps").List(context.Background(), metav1.ListOptions{})
+	assert.NoError(err)
+	assert.Empty(deployments.Items)
+}
+
+func TestAdminSmokeTestHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	i := &Internal{}
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodPost, "/", nil), httptest.NewRecorder())
+	assert.Error(i.AdminSmokeTestHandler(c))
+
+	// Only one smoke test runs at a time.
+	i.SmokeTest = SmokeTestConfig{User: "smoke-test", UserID: "u1"}
+	i.smokeTestMu.Lock()
+	err := i.AdminSmokeTestHandler(c)
+	if assert.Error(err) {
+		assert.Equal(http.StatusConflict, err.(*echo.HTTPError).Code)
+	}
+	i.smokeTestMu.Unlock()
+
+	assert.Error((&SmokeTestConfig{Port: 70000}).Validate())
+	assert.Error((&SmokeTestConfig{Timeout: -time.Second}).Validate())
+}
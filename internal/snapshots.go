@@ -0,0 +1,305 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cyverse-de/model/v6"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+const (
+	// snapshotTimeout limits how long archiving the working directory may
+	// run in the analysis pod.
+	snapshotTimeout = 10 * time.Minute
+
+	// snapshotDir is the directory in the working directory that snapshot
+	// archives are written to. It's left out of the archives, and it's
+	// uploaded to the analysis's output folder along with the outputs.
+	snapshotDir = ".vice-snapshots"
+
+	// snapshotInputID identifies the input added to a job to stage the
+	// archive of the snapshot it restores.
+	snapshotInputID = "vice-snapshot-restore"
+
+	// snapshotRestoreContainerName is the name of the init container that
+	// unpacks a restored snapshot into the working directory.
+	snapshotRestoreContainerName = "snapshot-restore"
+)
+
+// WorkingDirSnapshot is an archive of an analysis's working directory stored
+// in the data store.
+type WorkingDirSnapshot struct {
+	ID         string    `json:"id" db:"id"`
+	ExternalID string    `json:"external_id" db:"external_id"`
+	AnalysisID string    `json:"analysis_id" db:"analysis_id"`
+	AppID      string    `json:"app_id" db:"app_id"`
+	UserID     string    `json:"user_id" db:"user_id"`
+	Path       string    `json:"path" db:"path"`
+	SizeBytes  int64     `json:"size_bytes" db:"size_bytes"`
+	CreatedAt  time.Time `json:"created_at" db:"created_at"`
+}
+
+// snapshotCommand archives the working directory into the snapshot
+// directory, replacing the archives of earlier snapshots so that they don't
+// fill up the volume, and prints the size of the archive. tar exits with 1
+// when files change while they're archived, which is expected while the
+// analysis is running. The paths are passed as positional parameters so that
+// they aren't interpreted by the shell.
+func snapshotCommand(root, fileName string) []string {
+	return []string{
+		"sh", "-c",
+		`cd -- "$1" && rm -rf -- "$2" && mkdir -p -- "$2" && { tar -czf "$2/$3" --exclude="./$2" . || [ $? -eq 1 ]; } && stat -c %s -- "$2/$3"`,
+		"sh", root, snapshotDir, fileName,
+	}
+}
+
+// restoreCommand unpacks the staged archive into the working directory and
+// removes it.
+func restoreCommand(fileName string) []string {
+	return []string{"sh", "-c", `tar -xzf "$1" && rm -f -- "$1"`, "sh", fileName}
+}
+
+const getResultFolderSQL = `
+	SELECT result_folder_path
+	  FROM jobs
+	 WHERE id = $1
+`
+
+const insertSnapshotSQL = `
+	INSERT INTO vice_working_dir_snapshots (id, external_id, analysis_id, app_id, user_id, path, size_bytes)
+	VALUES ($1, $2, $3, $4, $5, $6, $7)
+	RETURNING created_at
+`
+
+const listSnapshotsSQL = `
+	SELECT id, external_id, analysis_id, app_id, user_id, path, size_bytes, created_at
+	  FROM vice_working_dir_snapshots
+	 WHERE external_id = $1
+	 ORDER BY created_at DESC
+`
+
+const getSnapshotSQL = `
+	SELECT id, external_id, analysis_id, app_id, user_id, path, size_bytes, created_at
+	  FROM vice_working_dir_snapshots
+	 WHERE id = $1
+`
+
+// requireFileTransfers returns an error if the cluster uses the CSI driver,
+// since snapshots are moved to and from the data store by the file transfer
+// containers.
+func (i *Internal) requireFileTransfers() error {
+	if i.UseCSIDriver {
+		return echo.NewHTTPError(http.StatusBadRequest, "working directory snapshots aren't supported when the iRODS CSI driver is used")
+	}
+	return nil
+}
+
+// snapshotWorkingDir archives the working directory of the running analysis,
+// uploads the archive to the analysis's output folder, and records it.
+func (i *Internal) snapshotWorkingDir(ctx context.Context, externalID string) (*WorkingDirSnapshot, error) {
+	ctx = withExternalIDBaggage(ctx, externalID)
+	ctx, span := startSpan(ctx, "snapshotWorkingDir")
+	defer span.End()
+
+	pod, err := i.runningAnalysisPod(ctx, externalID)
+	if err != nil {
+		return nil, err
+	}
+
+	container, root, err := workingDirLocation(pod)
+	if err != nil {
+		return nil, err
+	}
+
+	analysisID, err := i.apps.GetAnalysisIDByExternalID(ctx, externalID)
+	if err != nil {
+		return nil, err
+	}
+
+	var resultFolder string
+	if err = i.db.QueryRowxContext(ctx, getResultFolderSQL, analysisID).Scan(&resultFolder); err != nil {
+		return nil, errors.Wrapf(err, "error looking up the output folder of analysis %s", analysisID)
+	}
+
+	snapshot := &WorkingDirSnapshot{
+		ID:         uuid.New().String(),
+		ExternalID: externalID,
+		AnalysisID: analysisID,
+		AppID:      pod.Labels["app-id"],
+		UserID:     pod.Labels["user-id"],
+	}
+	fileName := snapshot.ID + ".tar.gz"
+	snapshot.Path = path.Join(resultFolder, snapshotDir, fileName)
+
+	execCtx, cancel := context.WithTimeout(ctx, snapshotTimeout)
+	defer cancel()
+
+	output, err := i.podExec(execCtx, pod.Namespace, pod.Name, container, snapshotCommand(root, fileName))
+	if err != nil {
+		return nil, err
+	}
+	if snapshot.SizeBytes, err = strconv.ParseInt(strings.TrimSpace(output), 10, 64); err != nil {
+		return nil, fmt.Errorf("unexpected snapshot size output: %q", output)
+	}
+
+	// The archive only survives the analysis once it's in the data store.
+	if err = i.doFileTransfer(ctx, externalID, uploadBasePath, uploadKind, false); err != nil {
+		return nil, errors.Wrapf(err, "error uploading the snapshot of %s", externalID)
+	}
+
+	err = i.db.QueryRowxContext(
+		ctx, insertSnapshotSQL,
+		snapshot.ID, snapshot.ExternalID, snapshot.AnalysisID, snapshot.AppID, snapshot.UserID, snapshot.Path, snapshot.SizeBytes,
+	).Scan(&snapshot.CreatedAt)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error recording the snapshot of %s", externalID)
+	}
+
+	log.WithContext(ctx).Infof("saved a %d byte snapshot of %s to %s", snapshot.SizeBytes, externalID, snapshot.Path)
+	return snapshot, nil
+}
+
+// getSnapshot returns the snapshot with the ID, or a 404 error if there
+// isn't one.
+func (i *Internal) getSnapshot(ctx context.Context, id string) (*WorkingDirSnapshot, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid snapshot ID %q", id))
+	}
+
+	snapshot := &WorkingDirSnapshot{}
+	err := i.db.GetContext(ctx, snapshot, getSnapshotSQL, id)
+	if err == sql.ErrNoRows {
+		return nil, echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("snapshot %s was not found", id))
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "error looking up snapshot %s", id)
+	}
+	return snapshot, nil
+}
+
+// applySnapshotRestore adds the archive of the snapshot named in the launch
+// options to the job's inputs, so that it's staged in the working directory
+// and unpacked before the analysis starts. Only the user who owns the
+// snapshot can restore it, and only into an analysis of the same app.
+func (i *Internal) applySnapshotRestore(ctx context.Context, job *model.Job, opts *launchOptions) error {
+	if opts.RestoreSnapshot == "" {
+		return nil
+	}
+	if err := i.requireFileTransfers(); err != nil {
+		return err
+	}
+
+	snapshot, err := i.getSnapshot(ctx, opts.RestoreSnapshot)
+	if err != nil {
+		return err
+	}
+	if snapshot.UserID != job.UserID {
+		return echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("snapshot %s belongs to another user", snapshot.ID))
+	}
+	if snapshot.AppID != job.AppID {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("snapshot %s was taken from an analysis of a different app", snapshot.ID))
+	}
+
+	job.Steps[0].Config.Inputs = append(job.Steps[0].Config.Inputs, model.StepInput{
+		ID:           snapshotInputID,
+		Multiplicity: "single",
+		Name:         path.Base(snapshot.Path),
+		Type:         "FileInput",
+		Value:        snapshot.Path,
+	})
+	return nil
+}
+
+// restoredSnapshot returns the input staging the archive of the snapshot the
+// job restores, or nil if it doesn't restore one.
+func restoredSnapshot(job *model.Job) *model.StepInput {
+	for _, input := range job.FilterInputsWithoutTickets() {
+		if input.ID == snapshotInputID {
+			return &input
+		}
+	}
+	return nil
+}
+
+// snapshotRestoreContainer returns the init container that unpacks the
+// restored snapshot into the working directory after the inputs are staged.
+// Like the working directory prep container, it uses the file transfer image
+// for its shell.
+func (i *Internal) snapshotRestoreContainer(job *model.Job, settings *ToolSettings, input *model.StepInput) apiv1.Container {
+	return apiv1.Container{
+		Name:            snapshotRestoreContainerName,
+		Image:           fmt.Sprintf("%s:%s", i.PorklockImage, i.PorklockTag),
+		Command:         restoreCommand(path.Base(input.Value)),
+		ImagePullPolicy: apiv1.PullPolicy(apiv1.PullAlways),
+		WorkingDir:      fileTransfersInputsMountPath,
+		VolumeMounts: []apiv1.VolumeMount{
+			{
+				Name:      fileTransfersVolumeName,
+				MountPath: fileTransfersInputsMountPath,
+			},
+		},
+		SecurityContext: &apiv1.SecurityContext{
+			RunAsUser:  int64Ptr(settings.runAsUser(job)),
+			RunAsGroup: int64Ptr(settings.runAsGroup(job)),
+			Capabilities: &apiv1.Capabilities{
+				Drop: []apiv1.Capability{
+					"SETPCAP",
+					"AUDIT_WRITE",
+					"KILL",
+					"SETGID",
+					"SETUID",
+					"NET_BIND_SERVICE",
+					"SYS_CHROOT",
+					"SETFCAP",
+					"FSETID",
+					"NET_RAW",
+					"MKNOD",
+				},
+			},
+		},
+	}
+}
+
+// CreateSnapshotHandler archives the working directory of a running
+// analysis and saves it to the analysis's output folder, so that the user's
+// scratch work can be restored into a new analysis if this one is lost.
+func (i *Internal) CreateSnapshotHandler(c echo.Context) error {
+	id := c.Param("id")
+	if id == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "id parameter is empty")
+	}
+	if err := i.requireFileTransfers(); err != nil {
+		return err
+	}
+
+	snapshot, err := i.snapshotWorkingDir(c.Request().Context(), id)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusCreated, snapshot)
+}
+
+// ListSnapshotsHandler lists the snapshots taken of an analysis, newest
+// first.
+func (i *Internal) ListSnapshotsHandler(c echo.Context) error {
+	id := c.Param("id")
+	if id == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "id parameter is empty")
+	}
+
+	snapshots := []WorkingDirSnapshot{}
+	if err := i.db.SelectContext(c.Request().Context(), &snapshots, listSnapshotsSQL, id); err != nil {
+		return errors.Wrapf(err, "error listing the snapshots of %s", id)
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"snapshots": snapshots})
+}
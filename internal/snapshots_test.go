@@ -0,0 +1,185 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cyverse-de/model/v6"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+// runLocalCommand runs the command locally in the directory and returns its
+// output.
+func runLocalCommand(t *testing.T, dir string, command []string) string {
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Dir = dir
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s failed: %s: %s", strings.Join(command, " "), err, output)
+	}
+	return string(output)
+}
+
+func TestSnapshotAndRestoreCommands(t *testing.T) {
+	assert := assert.New(t)
+
+	// The working directory has scratch work and an archive from an earlier
+	// snapshot, which is replaced rather than archived.
+	workingDir := t.TempDir()
+	assert.NoError(os.MkdirAll(filepath.Join(workingDir, "scratch", "notebooks"), 0755))
+	assert.NoError(os.WriteFile(filepath.Join(workingDir, "scratch", "notebooks", "analysis.ipynb"), []byte("{}"), 0644))
+	assert.NoError(os.WriteFile(filepath.Join(workingDir, ".Rhistory"), []byte("plot(x)\n"), 0644))
+	assert.NoError(os.MkdirAll(filepath.Join(workingDir, snapshotDir), 0755))
+	assert.NoError(os.WriteFile(filepath.Join(workingDir, snapshotDir, "old.tar.gz"), []byte("old"), 0644))
+
+	output := runLocalCommand(t, "/", snapshotCommand(workingDir, "new.tar.gz"))
+	archive := filepath.Join(workingDir, snapshotDir, "new.tar.gz")
+	info, err := os.Stat(archive)
+	assert.NoError(err)
+	assert.Equal(strconv.FormatInt(info.Size(), 10), strings.TrimSpace(output))
+	_, err = os.Stat(filepath.Join(workingDir, snapshotDir, "old.tar.gz"))
+	assert.True(os.IsNotExist(err))
+
+	// The archive is staged in the new working directory, then unpacked.
+	restoreDir := t.TempDir()
+	contents, err := os.ReadFile(archive)
+	assert.NoError(err)
+	assert.NoError(os.WriteFile(filepath.Join(restoreDir, "new.tar.gz"), contents, 0644))
+	runLocalCommand(t, restoreDir, restoreCommand("new.tar.gz"))
+
+	notebook, err := os.ReadFile(filepath.Join(restoreDir, "scratch", "notebooks", "analysis.ipynb"))
+	assert.NoError(err)
+	assert.Equal("{}", string(notebook))
+	_, err = os.Stat(filepath.Join(restoreDir, ".Rhistory"))
+	assert.NoError(err)
+	_, err = os.Stat(filepath.Join(restoreDir, "new.tar.gz"))
+	assert.True(os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(restoreDir, snapshotDir))
+	assert.True(os.IsNotExist(err))
+}
+
+// snapshotRows returns the rows for a snapshot of an analysis of the app.
+func snapshotRows(appID, userID string) *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"id", "external_id", "analysis_id", "app_id", "user_id", "path", "size_bytes", "created_at"}).
+		AddRow(
+			"1b4f4c3e-7d3f-4c71-9f43-3b3f2f9bd6c1", "ext-1", "a7e4c2b8-5d0f-4e38-9a37-62cbd2e8a5f1", appID, userID,
+			"/iplant/home/ipcdev/analyses/rstudio-1/.vice-snapshots/1b4f4c3e-7d3f-4c71-9f43-3b3f2f9bd6c1.tar.gz",
+			int64(2048), time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC),
+		)
+}
+
+func TestApplySnapshotRestore(t *testing.T) {
+	assert := assert.New(t)
+
+	mockdb, mock, err := sqlmock.New()
+	assert.NoError(err)
+	defer mockdb.Close()
+
+	i := &Internal{db: sqlx.NewDb(mockdb, "sqlmock")}
+	newJob := func() *model.Job {
+		job := &model.Job{AppID: "rstudio", UserID: "user-1"}
+		job.Steps = []model.Step{{}}
+		return job
+	}
+	opts := &launchOptions{RestoreSnapshot: "1b4f4c3e-7d3f-4c71-9f43-3b3f2f9bd6c1"}
+
+	// Nothing changes without a snapshot.
+	job := newJob()
+	assert.NoError(i.applySnapshotRestore(context.Background(), job, &launchOptions{}))
+	assert.Nil(restoredSnapshot(job))
+
+	mock.ExpectQuery("FROM vice_working_dir_snapshots").WithArgs(opts.RestoreSnapshot).
+		WillReturnRows(snapshotRows("rstudio", "user-1"))
+	assert.NoError(i.applySnapshotRestore(context.Background(), job, opts))
+	input := restoredSnapshot(job)
+	if assert.NotNil(input) {
+		assert.Equal("/iplant/home/ipcdev/analyses/rstudio-1/.vice-snapshots/1b4f4c3e-7d3f-4c71-9f43-3b3f2f9bd6c1.tar.gz", input.Value)
+		assert.Equal("FileInput", input.Type)
+
+		container := i.snapshotRestoreContainer(job, &ToolSettings{}, input)
+		assert.Equal(restoreCommand("1b4f4c3e-7d3f-4c71-9f43-3b3f2f9bd6c1.tar.gz"), container.Command)
+		assert.Equal(fileTransfersInputsMountPath, container.WorkingDir)
+	}
+
+	// Snapshots can't be restored by other users or into other apps.
+	mock.ExpectQuery("FROM vice_working_dir_snapshots").WillReturnRows(snapshotRows("rstudio", "user-2"))
+	err = i.applySnapshotRestore(context.Background(), newJob(), opts)
+	if assert.Error(err) {
+		assert.Equal(http.StatusForbidden, err.(*echo.HTTPError).Code)
+	}
+	mock.ExpectQuery("FROM vice_working_dir_snapshots").WillReturnRows(snapshotRows("jupyter", "user-1"))
+	err = i.applySnapshotRestore(context.Background(), newJob(), opts)
+	if assert.Error(err) {
+		assert.Equal(http.StatusBadRequest, err.(*echo.HTTPError).Code)
+	}
+
+	mock.ExpectQuery("FROM vice_working_dir_snapshots").WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	err = i.applySnapshotRestore(context.Background(), newJob(), opts)
+	if assert.Error(err) {
+		assert.Equal(http.StatusNotFound, err.(*echo.HTTPError).Code)
+	}
+
+	err = i.applySnapshotRestore(context.Background(), newJob(), &launchOptions{RestoreSnapshot: "latest"})
+	if assert.Error(err) {
+		assert.Equal(http.StatusBadRequest, err.(*echo.HTTPError).Code)
+	}
+	assert.NoError(mock.ExpectationsWereMet())
+
+	// The file transfer containers move the archives, so clusters using the
+	// CSI driver can't restore them.
+	i.UseCSIDriver = true
+	err = i.applySnapshotRestore(context.Background(), newJob(), opts)
+	if assert.Error(err) {
+		assert.Equal(http.StatusBadRequest, err.(*echo.HTTPError).Code)
+	}
+}
+
+func TestListSnapshotsHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	mockdb, mock, err := sqlmock.New()
+	assert.NoError(err)
+	defer mockdb.Close()
+
+	i := &Internal{db: sqlx.NewDb(mockdb, "sqlmock")}
+	mock.ExpectQuery("FROM vice_working_dir_snapshots").WithArgs("ext-1").WillReturnRows(snapshotRows("rstudio", "user-1"))
+
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/vice/ext-1/snapshots", nil), rec)
+	c.SetParamNames("id")
+	c.SetParamValues("ext-1")
+	assert.NoError(i.ListSnapshotsHandler(c))
+	assert.Equal(http.StatusOK, rec.Code)
+
+	body := struct {
+		Snapshots []WorkingDirSnapshot `json:"snapshots"`
+	}{}
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &body))
+	if assert.Len(body.Snapshots, 1) {
+		assert.Equal(int64(2048), body.Snapshots[0].SizeBytes)
+		assert.Equal("rstudio", body.Snapshots[0].AppID)
+	}
+	assert.NoError(mock.ExpectationsWereMet())
+
+	// Snapshots can't be taken when the CSI driver is used.
+	i.UseCSIDriver = true
+	c = echo.New().NewContext(httptest.NewRequest(http.MethodPost, "/vice/ext-1/snapshots", nil), httptest.NewRecorder())
+	c.SetParamNames("id")
+	c.SetParamValues("ext-1")
+	err = i.CreateSnapshotHandler(c)
+	if assert.Error(err) {
+		assert.Equal(http.StatusBadRequest, err.(*echo.HTTPError).Code)
+	}
+}
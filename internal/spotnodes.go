@@ -0,0 +1,77 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// SpotNodeLabel identifies the nodes in spot or preemptible node pools by one
+// of their labels, for example karpenter.sh/capacity-type=spot.
+type SpotNodeLabel struct {
+	Key string `koanf:"key"`
+
+	// Values are the label's values on spot nodes. Every node with the label
+	// is a spot node if there aren't any.
+	Values []string `koanf:"values"`
+}
+
+// SpotNodes lists the labels of the nodes in the cluster's spot or
+// preemptible node pools. VICE analyses are interactive, so they're kept off
+// of those nodes, which can be taken away at any time.
+type SpotNodes []SpotNodeLabel
+
+// Validate returns an error if the configuration can't be used.
+func (s SpotNodes) Validate() error {
+	for _, label := range s {
+		if errs := validation.IsQualifiedName(label.Key); len(errs) > 0 {
+			return fmt.Errorf("invalid spot node label %q: %s", label.Key, strings.Join(errs, "; "))
+		}
+		for _, value := range label.Values {
+			if errs := validation.IsValidLabelValue(value); len(errs) > 0 {
+				return fmt.Errorf("invalid value %q for spot node label %s: %s", value, label.Key, strings.Join(errs, "; "))
+			}
+		}
+	}
+	return nil
+}
+
+// nodeSelectorRequirements returns the node affinity requirements that keep
+// pods off of spot nodes.
+func (s SpotNodes) nodeSelectorRequirements() []apiv1.NodeSelectorRequirement {
+	requirements := []apiv1.NodeSelectorRequirement{}
+	for _, label := range s {
+		requirement := apiv1.NodeSelectorRequirement{
+			Key:      label.Key,
+			Operator: apiv1.NodeSelectorOpDoesNotExist,
+		}
+		if len(label.Values) > 0 {
+			requirement.Operator = apiv1.NodeSelectorOpNotIn
+			requirement.Values = label.Values
+		}
+		requirements = append(requirements, requirement)
+	}
+	return requirements
+}
+
+// selector returns a label selector for the nodes that aren't spot nodes,
+// starting from the given set of labels.
+func (s SpotNodes) selector(set labels.Set) (labels.Selector, error) {
+	selector := set.AsSelector()
+	for _, label := range s {
+		operator := selection.DoesNotExist
+		if len(label.Values) > 0 {
+			operator = selection.NotIn
+		}
+		requirement, err := labels.NewRequirement(label.Key, operator, label.Values)
+		if err != nil {
+			return nil, err
+		}
+		selector = selector.Add(*requirement)
+	}
+	return selector, nil
+}
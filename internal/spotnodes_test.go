@@ -0,0 +1,67 @@
+package internal
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSpotNodesValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(SpotNodes{}.Validate())
+	assert.NoError(SpotNodes{
+		{Key: "karpenter.sh/capacity-type", Values: []string{"spot"}},
+		{Key: "cloud.google.com/gke-preemptible"},
+	}.Validate())
+
+	assert.Error(SpotNodes{{Key: ""}}.Validate())
+	assert.Error(SpotNodes{{Key: "not a label"}}.Validate())
+	assert.Error(SpotNodes{{Key: "karpenter.sh/capacity-type", Values: []string{"spot instances"}}}.Validate())
+}
+
+func TestSpotNodeSelectorRequirements(t *testing.T) {
+	assert := assert.New(t)
+
+	spotNodes := SpotNodes{
+		{Key: "karpenter.sh/capacity-type", Values: []string{"spot"}},
+		{Key: "cloud.google.com/gke-preemptible"},
+	}
+	assert.Equal(
+		[]apiv1.NodeSelectorRequirement{
+			{Key: "karpenter.sh/capacity-type", Operator: apiv1.NodeSelectorOpNotIn, Values: []string{"spot"}},
+			{Key: "cloud.google.com/gke-preemptible", Operator: apiv1.NodeSelectorOpDoesNotExist},
+		},
+		spotNodes.nodeSelectorRequirements(),
+	)
+	assert.Empty(SpotNodes{}.nodeSelectorRequirements())
+}
+
+func TestClusterCapabilitiesSkipsSpotNodes(t *testing.T) {
+	assert := assert.New(t)
+
+	spot := gpuNode("spot", map[string]string{"nvidia.com/gpu": "4"})
+	spot.Labels["karpenter.sh/capacity-type"] = "spot"
+	onDemand := gpuNode("on-demand", map[string]string{"nvidia.com/gpu": "1"})
+	onDemand.Labels["karpenter.sh/capacity-type"] = "on-demand"
+
+	i := &Internal{
+		Init: Init{
+			SpotNodes: SpotNodes{{Key: "karpenter.sh/capacity-type", Values: []string{"spot"}}},
+		},
+		clientset: fake.NewSimpleClientset(spot, onDemand),
+	}
+
+	caps, err := i.clusterCapabilities(context.Background())
+	if assert.NoError(err) {
+		assert.Equal(map[string]int64{"nvidia.com/gpu": 1}, caps.GPUResources)
+	}
+
+	capacity, err := i.gpuCapacity(context.Background(), "nvidia.com/gpu")
+	if assert.NoError(err) {
+		assert.Equal(int64(1), capacity.Allocatable)
+	}
+}
@@ -0,0 +1,197 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cyverse-de/model/v6"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	defaultStartupTimeout         = 15 * time.Minute
+	defaultStartupMonitorInterval = time.Minute
+)
+
+// startupTimeoutAnnotation records the analysis's startup timeout on its
+// Deployment, so that it can be checked without looking up the tool.
+const startupTimeoutAnnotation = "vice.cyverse.org/startup-timeout"
+
+// startupProbePeriodSeconds is how often the startup probe checks the
+// analysis container.
+const startupProbePeriodSeconds = 10
+
+// StartupMonitorConfig contains the settings for failing analyses that don't
+// become ready in time.
+type StartupMonitorConfig struct {
+	Enabled bool
+
+	// Interval is how often the analyses are checked.
+	Interval time.Duration
+
+	// DefaultTimeout is how long analyses have to become ready if their tool
+	// doesn't set startup_timeout_seconds.
+	DefaultTimeout time.Duration
+}
+
+// Validate returns an error if the configuration can't be used.
+func (c *StartupMonitorConfig) Validate() error {
+	if c.Interval < 0 {
+		return fmt.Errorf("the startup monitor interval must not be negative")
+	}
+	if c.DefaultTimeout < 0 {
+		return fmt.Errorf("the default startup timeout must not be negative")
+	}
+	return nil
+}
+
+// startupTimeout returns how long the tool's analyses have to become ready.
+func (i *Internal) startupTimeout(settings *ToolSettings) time.Duration {
+	if settings.StartupTimeoutSeconds > 0 {
+		return time.Duration(settings.StartupTimeoutSeconds) * time.Second
+	}
+	if i.StartupMonitor.DefaultTimeout > 0 {
+		return i.StartupMonitor.DefaultTimeout
+	}
+	return defaultStartupTimeout
+}
+
+// startupProbe returns the startup probe for the analysis container, or nil if
+// it doesn't need one. Only containers with liveness probes need one, so that
+// apps that are slow to start aren't restarted before they're up.
+func (i *Internal) startupProbe(job *model.Job, settings *ToolSettings) *apiv1.Probe {
+	liveness := settings.livenessProbe(job)
+	if liveness == nil {
+		return nil
+	}
+
+	periods := int32((i.startupTimeout(settings) + startupProbePeriodSeconds*time.Second - 1) / (startupProbePeriodSeconds * time.Second))
+	return &apiv1.Probe{
+		ProbeHandler:     liveness.ProbeHandler,
+		PeriodSeconds:    startupProbePeriodSeconds,
+		TimeoutSeconds:   liveness.TimeoutSeconds,
+		FailureThreshold: periods,
+		SuccessThreshold: 1,
+	}
+}
+
+// startupWindow returns when the analysis running in the Deployment started
+// and how long it has to become ready. Restarting the analysis starts the
+// clock over.
+func (i *Internal) startupWindow(deployment *appsv1.Deployment) (time.Time, time.Duration) {
+	started := deployment.CreationTimestamp.Time
+	if restarted, err := time.Parse(time.RFC3339, deployment.Spec.Template.Annotations[restartedAtAnnotation]); err == nil && restarted.After(started) {
+		started = restarted
+	}
+
+	timeout, err := time.ParseDuration(deployment.Annotations[startupTimeoutAnnotation])
+	if err != nil || timeout <= 0 {
+		timeout = i.startupTimeout(&ToolSettings{})
+	}
+
+	return started, timeout
+}
+
+// startupDeadline returns the time by which the analysis running in the
+// Deployment has to be ready.
+func (i *Internal) startupDeadline(deployment *appsv1.Deployment) time.Time {
+	started, timeout := i.startupWindow(deployment)
+	return started.Add(timeout)
+}
+
+// failStartup marks the analysis as failed because it didn't become ready in
+// time, then shuts it down.
+func (i *Internal) failStartup(ctx context.Context, externalID string, timeout time.Duration) error {
+	log.WithContext(ctx).Warnf("analysis %s didn't become ready within %s", externalID, timeout)
+
+	msg := fmt.Sprintf(
+		"The analysis failed because it didn't become ready within %s of starting. If the app needs longer to start up, ask an administrator to raise its startup timeout.",
+		timeout,
+	)
+	if err := i.statusPublisher.Fail(ctx, externalID, msg); err != nil {
+		return err
+	}
+
+	return i.doExit(ctx, externalID)
+}
+
+// checkStartups fails the analyses that haven't become ready by their
+// startup deadlines. Returns the number of analyses that were failed.
+func (i *Internal) checkStartups(ctx context.Context, now time.Time) (int, error) {
+	ctx, span := otel.Tracer(otelName).Start(ctx, "checkStartups")
+	defer span.End()
+
+	set := labels.Set(map[string]string{
+		"app-type": "interactive",
+	})
+
+	deplist, err := i.clientset.AppsV1().Deployments(i.ViceNamespace).List(ctx, metav1.ListOptions{
+		LabelSelector: set.AsSelector().String(),
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to list the analysis deployments")
+	}
+
+	queued, err := i.queueStatuses(ctx, i.ViceNamespace, set)
+	if err != nil {
+		return 0, err
+	}
+
+	failed := 0
+	for idx := range deplist.Items {
+		deployment := &deplist.Items[idx]
+		if deployment.Status.ReadyReplicas > 0 || deployment.DeletionTimestamp != nil {
+			continue
+		}
+		if deployment.Spec.Replicas != nil && *deployment.Spec.Replicas == 0 {
+			continue
+		}
+
+		// Analyses waiting for Kueue to admit them haven't started yet.
+		status := queued[deployment.Labels["external-id"]]
+		if status != nil && status.Queued {
+			continue
+		}
+
+		started, timeout := i.startupWindow(deployment)
+		if now.Before(status.startupWindowStart(started).Add(timeout)) {
+			continue
+		}
+
+		failed++
+		if err = i.failStartup(ctx, deployment.Labels["external-id"], timeout); err != nil {
+			log.WithContext(ctx).Error(errors.Wrapf(err, "unable to fail analysis %s", deployment.Labels["external-id"]))
+		}
+	}
+
+	return failed, nil
+}
+
+// RunStartupMonitor fails the analyses that don't become ready before their
+// startup timeouts. Blocks until the context is canceled.
+func (i *Internal) RunStartupMonitor(ctx context.Context) {
+	interval := i.StartupMonitor.Interval
+	if interval <= 0 {
+		interval = defaultStartupMonitorInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if _, err := i.checkStartups(ctx, now); err != nil {
+				log.WithContext(ctx).Error(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/model/v6"
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// failedStatuses records the failure updates sent for analyses.
+type failedStatuses map[string]string
+
+func (f failedStatuses) Fail(_ context.Context, jobID, msg string) error {
+	f[jobID] = msg
+	return nil
+}
+
+func (f failedStatuses) Success(context.Context, string, string) error { return nil }
+func (f failedStatuses) Running(context.Context, string, string) error { return nil }
+
+func startupTestDeployment(externalID string, created time.Time, timeout string, ready int32) *appsv1.Deployment {
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              externalID,
+			Namespace:         "vice-apps",
+			Labels:            map[string]string{"external-id": externalID, "app-type": "interactive"},
+			CreationTimestamp: metav1.NewTime(created),
+		},
+		Status: appsv1.DeploymentStatus{ReadyReplicas: ready},
+	}
+	if timeout != "" {
+		deployment.Annotations = map[string]string{startupTimeoutAnnotation: timeout}
+	}
+	return deployment
+}
+
+func TestStartupTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	i := &Internal{}
+	assert.Equal(defaultStartupTimeout, i.startupTimeout(&ToolSettings{}))
+
+	i.StartupMonitor.DefaultTimeout = 5 * time.Minute
+	assert.Equal(5*time.Minute, i.startupTimeout(&ToolSettings{}))
+	assert.Equal(30*time.Minute, i.startupTimeout(&ToolSettings{StartupTimeoutSeconds: 1800}))
+
+	assert.Error((&ToolSettings{StartupTimeoutSeconds: -1}).Validate())
+}
+
+func TestStartupProbe(t *testing.T) {
+	assert := assert.New(t)
+
+	i := &Internal{}
+	job := &model.Job{Steps: []model.Step{{}}}
+	job.Steps[0].Component.Container.Ports = []model.Ports{{ContainerPort: 8888}}
+
+	// Analyses without liveness probes aren't restarted, so they don't need
+	// a startup probe.
+	assert.Nil(i.startupProbe(job, &ToolSettings{}))
+
+	settings := &ToolSettings{
+		LivenessProbe:         &LivenessProbe{Type: livenessProbeHTTP},
+		StartupTimeoutSeconds: 1205,
+	}
+	probe := i.startupProbe(job, settings)
+	if assert.NotNil(probe) {
+		assert.Equal(int32(startupProbePeriodSeconds), probe.PeriodSeconds)
+		assert.Equal(int32(121), probe.FailureThreshold)
+		assert.Equal(settings.livenessProbe(job).ProbeHandler, probe.ProbeHandler)
+	}
+}
+
+func TestCheckStartups(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	restarted := startupTestDeployment("restarted", now.Add(-time.Hour), "20m0s", 0)
+	restarted.Spec.Template.Annotations = map[string]string{restartedAtAnnotation: now.Add(-5 * time.Minute).Format(time.RFC3339)}
+
+	objects := []runtime.Object{
+		startupTestDeployment("ready", now.Add(-time.Hour), "20m0s", 1),
+		startupTestDeployment("starting", now.Add(-10*time.Minute), "20m0s", 0),
+		startupTestDeployment("slow", now.Add(-30*time.Minute), "20m0s", 0),
+		startupTestDeployment("default", now.Add(-30*time.Minute), "", 0),
+		restarted,
+	}
+	clientset := fake.NewSimpleClientset(objects...)
+	statuses := failedStatuses{}
+
+	i := &Internal{
+		Init:            Init{ViceNamespace: "vice-apps"},
+		clientset:       clientset,
+		statusPublisher: statuses,
+	}
+
+	failed, err := i.checkStartups(context.Background(), now)
+	assert.NoError(err)
+	assert.Equal(2, failed)
+	assert.Contains(statuses["slow"], "within 20m0s of starting")
+	assert.Contains(statuses["default"], "within 15m0s of starting")
+
+	deplist, err := clientset.AppsV1().Deployments("vice-apps").List(context.Background(), metav1.ListOptions{})
+	assert.NoError(err)
+	remaining := []string{}
+	for _, dep := range deplist.Items {
+		remaining = append(remaining, dep.Name)
+	}
+	assert.ElementsMatch([]string{"ready", "starting", "restarted"}, remaining)
+
+	deadline := i.startupDeadline(objects[1].(*appsv1.Deployment))
+	assert.Equal(now.Add(10*time.Minute).Unix(), deadline.Unix())
+}
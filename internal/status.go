@@ -4,10 +4,12 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"io"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
+	"sync"
 
 	"github.com/cyverse-de/messaging/v9"
 	"github.com/pkg/errors"
@@ -24,9 +26,23 @@ type AnalysisStatusPublisher interface {
 // JSLPublisher is a concrete implementation of AnalysisStatusPublisher that
 // posts status updates to the job-status-listener service.
 type JSLPublisher struct {
+	mu        sync.RWMutex
 	statusURL string
 }
 
+// setStatusURL changes the URL that status updates are posted to.
+func (j *JSLPublisher) setStatusURL(statusURL string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.statusURL = statusURL
+}
+
+func (j *JSLPublisher) getStatusURL() string {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	return j.statusURL
+}
+
 // AnalysisStatus contains the data needed to post a status update to the
 // notification-agent service.
 type AnalysisStatus struct {
@@ -42,12 +58,13 @@ func (j *JSLPublisher) postStatus(ctx context.Context, jobID, msg string, jobSta
 		Message: msg,
 	}
 
-	u, err := url.Parse(j.statusURL)
+	statusURL := j.getStatusURL()
+	u, err := url.Parse(statusURL)
 	if err != nil {
 		return errors.Wrapf(
 			err,
 			"error parsing URL %s for job %s before posting %s status",
-			j,
+			statusURL,
 			jobID,
 			jobState,
 		)
@@ -89,14 +106,14 @@ func (j *JSLPublisher) postStatus(ctx context.Context, jobID, msg string, jobSta
 	}
 	defer response.Body.Close()
 	if response.StatusCode < 200 || response.StatusCode > 399 {
-		return errors.Wrapf(
-			err,
+		body, _ := io.ReadAll(response.Body)
+		return errors.Errorf(
 			"error status code %d returned after posting %s status for job %s to %s: %s",
 			response.StatusCode,
 			jobState,
 			jobID,
 			u.String(),
-			response.Body,
+			body,
 		)
 	}
 	return nil
@@ -105,14 +122,14 @@ func (j *JSLPublisher) postStatus(ctx context.Context, jobID, msg string, jobSta
 // Fail sends an analysis failure update with the provided message via the AMQP
 // broker. Should be sent once.
 func (j *JSLPublisher) Fail(ctx context.Context, jobID, msg string) error {
-	log.Warnf("Sending failure job status update for external-id %s", jobID)
+	log.WithContext(ctx).Warnf("Sending failure job status update for external-id %s", jobID)
 
 	return j.postStatus(ctx, jobID, msg, messaging.FailedState)
 }
 
 // Success sends a success update via the AMQP broker. Should be sent once.
 func (j *JSLPublisher) Success(ctx context.Context, jobID, msg string) error {
-	log.Warnf("Sending success job status update for external-id %s", jobID)
+	log.WithContext(ctx).Warnf("Sending success job status update for external-id %s", jobID)
 
 	return j.postStatus(ctx, jobID, msg, messaging.SucceededState)
 }
@@ -120,7 +137,7 @@ func (j *JSLPublisher) Success(ctx context.Context, jobID, msg string) error {
 // Running sends an analysis running status update with the provided message via the
 // AMQP broker. May be sent multiple times, preferably with different messages.
 func (j *JSLPublisher) Running(ctx context.Context, jobID, msg string) error {
-	log.Warnf("Sending running job status update for external-id %s", jobID)
+	log.WithContext(ctx).Warnf("Sending running job status update for external-id %s", jobID)
 	return j.postStatus(ctx, jobID, msg, messaging.RunningState)
 }
 
@@ -0,0 +1,161 @@
+package internal
+
+import (
+	"context"
+	"time"
+
+	"github.com/cyverse-de/app-exposer/apps"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// The platform summary feeds the public status page, which anyone can read.
+// It only contains counts and the settings operators write for users, never
+// anything about individual users or analyses.
+
+// MaintenanceWindow is a period of scheduled maintenance that's announced on
+// the status page.
+type MaintenanceWindow struct {
+	Start   time.Time `koanf:"start" json:"start"`
+	End     time.Time `koanf:"end" json:"end"`
+	Message string    `koanf:"message" json:"message,omitempty"`
+}
+
+// LaunchSummary is the number of VICE analyses launched recently, and how
+// many of them have failed.
+type LaunchSummary struct {
+	WindowMinutes int `json:"window_minutes"`
+	Launched      int `json:"launched" db:"launched"`
+	Failed        int `json:"failed" db:"failed"`
+}
+
+// QueueSummary is the number of analyses waiting to start.
+type QueueSummary struct {
+	// Starting is the number of analyses that haven't become ready yet.
+	Starting int `json:"starting"`
+
+	// LaunchesInFlight and LaunchesQueued come from the launch limiter, if
+	// it's enabled.
+	LaunchesInFlight int `json:"launches_in_flight"`
+	LaunchesQueued   int `json:"launches_queued"`
+}
+
+// MaintenanceSummary describes the current and upcoming maintenance.
+type MaintenanceSummary struct {
+	Active  bool                `json:"active"`
+	Message string              `json:"message,omitempty"`
+	Windows []MaintenanceWindow `json:"windows"`
+}
+
+// PlatformSummary is the part of the status page that describes VICE. The
+// launches and queue are nil if they couldn't be looked up.
+type PlatformSummary struct {
+	Launches    *LaunchSummary     `json:"launches"`
+	Queue       *QueueSummary      `json:"queue"`
+	Maintenance MaintenanceSummary `json:"maintenance"`
+}
+
+const launchSummarySQL = `
+	SELECT count(*) AS launched,
+	       count(*) FILTER (WHERE j.status = 'Failed') AS failed
+	  FROM jobs j
+	  JOIN job_steps s ON s.job_id = j.id
+	  JOIN job_types t ON s.job_type_id = t.id
+	 WHERE t.name = $2
+	   AND s.step_number = 1
+	   AND j.start_date >= $1
+`
+
+// launchSummary returns the number of VICE analyses launched since the given
+// time, and how many of them have failed.
+func (i *Internal) launchSummary(ctx context.Context, since time.Time) (*LaunchSummary, error) {
+	summary := &LaunchSummary{}
+	if err := i.db.GetContext(ctx, summary, launchSummarySQL, since, apps.InteractiveJobType); err != nil {
+		return nil, errors.Wrap(err, "unable to count the recent launches")
+	}
+	return summary, nil
+}
+
+// queueSummary returns the number of analyses waiting to start.
+func (i *Internal) queueSummary(ctx context.Context) (*QueueSummary, error) {
+	set := labels.Set(map[string]string{
+		"app-type": "interactive",
+	})
+	deployments, err := i.clientset.AppsV1().Deployments(i.ViceNamespace).List(ctx, metav1.ListOptions{
+		LabelSelector: set.AsSelector().String(),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to list the analysis deployments")
+	}
+
+	summary := &QueueSummary{}
+	for _, deployment := range deployments.Items {
+		if deployment.DeletionTimestamp != nil || deployment.Status.ReadyReplicas > 0 {
+			continue
+		}
+		if deployment.Spec.Replicas != nil && *deployment.Spec.Replicas == 0 {
+			continue
+		}
+		summary.Starting++
+	}
+
+	if i.launchLimiter != nil {
+		stats := i.launchLimiter.Stats()
+		summary.LaunchesInFlight = stats.InFlight
+		summary.LaunchesQueued = stats.Queued
+	}
+
+	return summary, nil
+}
+
+// maintenanceSummary returns the current maintenance, along with the windows
+// that haven't ended yet.
+func (i *Internal) maintenanceSummary(now time.Time) MaintenanceSummary {
+	maintenance := i.reloadable().Maintenance
+
+	summary := MaintenanceSummary{
+		Active:  maintenance.Enabled,
+		Windows: []MaintenanceWindow{},
+	}
+	if maintenance.Enabled {
+		summary.Message = maintenance.Message
+		if summary.Message == "" {
+			summary.Message = defaultMaintenanceMessage
+		}
+	}
+
+	for _, window := range maintenance.Windows {
+		if window.End.After(now) {
+			summary.Windows = append(summary.Windows, window)
+		}
+	}
+
+	return summary
+}
+
+// PlatformSummary returns the launches during the window before now, the
+// analyses waiting to start, and the maintenance for the status page. Errors
+// are logged rather than returned, so that they can't leak onto the page.
+func (i *Internal) PlatformSummary(ctx context.Context, now time.Time, window time.Duration) *PlatformSummary {
+	summary := &PlatformSummary{
+		Maintenance: i.maintenanceSummary(now),
+	}
+
+	launches, err := i.launchSummary(ctx, now.Add(-window))
+	if err != nil {
+		log.WithContext(ctx).Error(err)
+	} else {
+		launches.WindowMinutes = int(window.Minutes())
+		summary.Launches = launches
+	}
+
+	queue, err := i.queueSummary(ctx)
+	if err != nil {
+		log.WithContext(ctx).Error(err)
+	} else {
+		summary.Queue = queue
+	}
+
+	return summary
+}
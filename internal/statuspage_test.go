@@ -0,0 +1,80 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestPlatformSummary(t *testing.T) {
+	assert := assert.New(t)
+
+	mockdb, mock, err := sqlmock.New()
+	assert.NoError(err)
+	defer mockdb.Close()
+
+	now := time.Date(2024, 1, 2, 3, 0, 0, 0, time.UTC)
+	ready := appDeployment("ready", "a1", "jupyter")
+	ready.Status.ReadyReplicas = 1
+
+	i := &Internal{
+		Init: Init{
+			ViceNamespace: "vice-apps",
+			Maintenance: MaintenanceConfig{
+				Windows: []MaintenanceWindow{
+					{Start: now.Add(-3 * time.Hour), End: now.Add(-2 * time.Hour), Message: "over"},
+					{Start: now.Add(time.Hour), End: now.Add(2 * time.Hour), Message: "upgrading storage"},
+				},
+			},
+		},
+		db:            sqlx.NewDb(mockdb, "sqlmock"),
+		clientset:     fake.NewSimpleClientset(ready, appDeployment("starting", "a1", "jupyter")),
+		launchLimiter: NewLaunchLimiter(&LaunchLimiterConfig{Enabled: true, MaxInFlight: 2, QueueTimeout: time.Second}),
+	}
+
+	release, err := i.launchLimiter.Acquire(context.Background())
+	assert.NoError(err)
+	defer release()
+
+	mock.ExpectQuery(regexp.QuoteMeta("FILTER (WHERE j.status = 'Failed')")).
+		WithArgs(now.Add(-time.Hour), "Interactive").
+		WillReturnRows(sqlmock.NewRows([]string{"launched", "failed"}).AddRow(12, 1))
+
+	summary := i.PlatformSummary(context.Background(), now, time.Hour)
+	assert.NoError(mock.ExpectationsWereMet())
+	assert.Equal(&LaunchSummary{WindowMinutes: 60, Launched: 12, Failed: 1}, summary.Launches)
+	assert.Equal(&QueueSummary{Starting: 1, LaunchesInFlight: 1}, summary.Queue)
+	assert.False(summary.Maintenance.Active)
+	assert.Empty(summary.Maintenance.Message)
+	if assert.Len(summary.Maintenance.Windows, 1) {
+		assert.Equal("upgrading storage", summary.Maintenance.Windows[0].Message)
+	}
+
+	// Parts that can't be looked up are left out rather than failing the
+	// whole summary.
+	i.Maintenance.Enabled = true
+	mock.ExpectQuery(regexp.QuoteMeta("FROM jobs j")).WillReturnError(errors.New("connection refused"))
+
+	summary = i.PlatformSummary(context.Background(), now, time.Hour)
+	assert.Nil(summary.Launches)
+	assert.NotNil(summary.Queue)
+	assert.True(summary.Maintenance.Active)
+	assert.Equal(defaultMaintenanceMessage, summary.Maintenance.Message)
+}
+
+func TestMaintenanceConfigValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	assert.NoError((&MaintenanceConfig{}).Validate())
+	assert.NoError((&MaintenanceConfig{Windows: []MaintenanceWindow{{Start: now, End: now.Add(time.Hour)}}}).Validate())
+	assert.Error((&MaintenanceConfig{Windows: []MaintenanceWindow{{Start: now}}}).Validate())
+	assert.Error((&MaintenanceConfig{Windows: []MaintenanceWindow{{Start: now, End: now.Add(-time.Hour)}}}).Validate())
+}
@@ -0,0 +1,217 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/cyverse-de/model/v6"
+	"github.com/pkg/errors"
+)
+
+// The schemes used to generate the subdomains that analyses are served from.
+const (
+	// SubdomainSchemeHash uses the first few characters of a hash of the
+	// user ID and the analysis's external ID, such as a1b2c3d4e. It matches
+	// the subdomain the apps service records for the analysis.
+	SubdomainSchemeHash = "hash"
+
+	// SubdomainSchemeReadable uses the username, the app name, and a short
+	// hash, such as jdoe-jupyter-lab-1a2b.
+	SubdomainSchemeReadable = "readable"
+)
+
+// readableSubdomainHashLengths are the lengths of the hash suffixes tried, in
+// order, for readable subdomains. Longer hashes are only used if a shorter
+// one is already taken by another analysis.
+var readableSubdomainHashLengths = []int{4, 8, 16}
+
+// maxReadableSubdomainUserLength limits the part of a readable subdomain
+// taken up by the username, so that there's room left for the app name.
+const maxReadableSubdomainUserLength = 20
+
+// maxSubdomainLength is the longest label allowed in a DNS name.
+const maxSubdomainLength = 63
+
+var subdomainInvalidCharsRegexp = regexp.MustCompile(`[^a-z0-9]+`)
+
+// SubdomainConfig contains the settings for generating the subdomains that
+// analyses are served from.
+type SubdomainConfig struct {
+	// Scheme is SubdomainSchemeHash or SubdomainSchemeReadable. The hash
+	// scheme is used if it's empty.
+	Scheme string
+}
+
+// Validate returns an error if the scheme isn't supported.
+func (c *SubdomainConfig) Validate() error {
+	switch c.Scheme {
+	case "", SubdomainSchemeHash, SubdomainSchemeReadable:
+		return nil
+	default:
+		return fmt.Errorf("unsupported subdomain scheme %q; must be %s or %s", c.Scheme, SubdomainSchemeHash, SubdomainSchemeReadable)
+	}
+}
+
+// subdomainHash returns the hex-encoded SHA-256 hash of the user ID and the
+// analysis's external ID.
+func subdomainHash(userID, externalID string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(userID+externalID)))
+}
+
+// subdomainPart returns the string as lowercase letters and digits separated
+// by single hyphens, cut down to the maximum length.
+func subdomainPart(str string, maxLength int) string {
+	part := strings.Trim(subdomainInvalidCharsRegexp.ReplaceAllString(strings.ToLower(str), "-"), "-")
+	if len(part) > maxLength {
+		part = strings.TrimRight(part[:maxLength], "-")
+	}
+	return part
+}
+
+// readableSubdomain returns the readable subdomain for an analysis made up of
+// as much of the username and the app name as fits and the first hashLength
+// hex digits of the analysis's hash. The result is always a valid DNS label
+// and is the same every time it's generated for the same analysis.
+func readableSubdomain(username, appName, userID, externalID string, hashLength int) string {
+	hash := subdomainHash(userID, externalID)[:hashLength]
+
+	// Leave room for the hash and a hyphen after each of the other parts.
+	available := maxSubdomainLength - hashLength - 2
+
+	parts := []string{}
+	user := subdomainPart(username, maxReadableSubdomainUserLength)
+	if user != "" {
+		parts = append(parts, user)
+		available -= len(user)
+	}
+	if app := subdomainPart(appName, available); app != "" {
+		parts = append(parts, app)
+	}
+	return strings.Join(append(parts, hash), "-")
+}
+
+// subdomainCache caches the subdomains claimed for analyses, keyed by
+// external ID, so that the database is only consulted once per analysis.
+// The zero value is ready to use.
+type subdomainCache struct {
+	mu         sync.Mutex
+	subdomains map[string]string
+}
+
+func (c *subdomainCache) get(externalID string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	subdomain, ok := c.subdomains[externalID]
+	return subdomain, ok
+}
+
+func (c *subdomainCache) set(externalID, subdomain string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.subdomains == nil || len(c.subdomains) >= maxCachedLabelValues {
+		c.subdomains = map[string]string{}
+	}
+	c.subdomains[externalID] = subdomain
+}
+
+// Claiming a subdomain that's already taken leaves the row alone and returns
+// the analysis it belongs to, so the caller can tell whether it collided.
+const claimSubdomainSQL = `
+	INSERT INTO vice_subdomains (subdomain, external_id)
+	VALUES ($1, $2)
+	ON CONFLICT (subdomain) DO UPDATE SET subdomain = EXCLUDED.subdomain
+	RETURNING external_id
+`
+
+const getSubdomainSQL = `
+	SELECT subdomain
+	  FROM vice_subdomains
+	 WHERE external_id = $1
+`
+
+// subdomain returns the subdomain the job's analysis is served from,
+// claiming it for the analysis if the scheme needs it to be recorded. It
+// must be called before the analysis's resources are generated; the label
+// helpers call it, so the resources that are built from the labels can use
+// jobSubdomain.
+func (i *Internal) subdomain(ctx context.Context, job *model.Job) (string, error) {
+	if i.Subdomains.Scheme != SubdomainSchemeReadable {
+		return IngressName(job.UserID, job.InvocationID), nil
+	}
+
+	if subdomain, ok := i.subdomains.get(job.InvocationID); ok {
+		return subdomain, nil
+	}
+
+	username := strings.TrimSuffix(job.Submitter, i.UserSuffix)
+	for _, hashLength := range readableSubdomainHashLengths {
+		subdomain := readableSubdomain(username, job.AppName, job.UserID, job.InvocationID, hashLength)
+
+		var owner string
+		if err := i.db.QueryRowxContext(ctx, claimSubdomainSQL, subdomain, job.InvocationID).Scan(&owner); err != nil {
+			return "", errors.Wrapf(err, "error recording the subdomain for analysis %s", job.InvocationID)
+		}
+		if owner == job.InvocationID {
+			i.subdomains.set(job.InvocationID, subdomain)
+			return subdomain, nil
+		}
+
+		log.WithContext(ctx).Warnf("subdomain %s for analysis %s collides with analysis %s", subdomain, job.InvocationID, owner)
+	}
+
+	return "", fmt.Errorf("unable to generate a unique subdomain for analysis %s", job.InvocationID)
+}
+
+// jobSubdomain returns the subdomain claimed for the job by subdomain. It's
+// for the code that generates resources without a context, which always runs
+// after the labels are generated.
+func (i *Internal) jobSubdomain(job *model.Job) string {
+	if subdomain, ok := i.subdomains.get(job.InvocationID); ok {
+		return subdomain
+	}
+	if i.Subdomains.Scheme == SubdomainSchemeReadable {
+		username := strings.TrimSuffix(job.Submitter, i.UserSuffix)
+		return readableSubdomain(username, job.AppName, job.UserID, job.InvocationID, readableSubdomainHashLengths[0])
+	}
+	return IngressName(job.UserID, job.InvocationID)
+}
+
+// subdomainFromLabels returns the subdomain of a running analysis from its
+// resources' labels. Resources created before the subdomain label was added
+// always used the hash scheme.
+func subdomainFromLabels(labels map[string]string) string {
+	if subdomain, ok := labels["subdomain"]; ok && subdomain != "" {
+		return subdomain
+	}
+	return IngressName(labels["user-id"], labels["external-id"])
+}
+
+// analysisSubdomain returns the subdomain of an analysis when its resources'
+// labels aren't at hand. Subdomains are only recorded with the readable
+// scheme, so analyses without a recorded subdomain use the hash scheme.
+func (i *Internal) analysisSubdomain(ctx context.Context, userID, externalID string) (string, error) {
+	if i.Subdomains.Scheme != SubdomainSchemeReadable {
+		return IngressName(userID, externalID), nil
+	}
+
+	if subdomain, ok := i.subdomains.get(externalID); ok {
+		return subdomain, nil
+	}
+
+	var subdomain string
+	err := i.db.QueryRowxContext(ctx, getSubdomainSQL, externalID).Scan(&subdomain)
+	if err == sql.ErrNoRows {
+		return IngressName(userID, externalID), nil
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "error looking up the subdomain for analysis %s", externalID)
+	}
+
+	i.subdomains.set(externalID, subdomain)
+	return subdomain, nil
+}
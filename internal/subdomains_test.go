@@ -0,0 +1,87 @@
+package internal
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cyverse-de/model/v6"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+func TestReadableSubdomain(t *testing.T) {
+	assert := assert.New(t)
+
+	hash := subdomainHash("u1", "e1")
+	assert.Equal("jdoe-jupyter-lab-"+hash[:4], readableSubdomain("JDoe", "Jupyter Lab", "u1", "e1", 4))
+	assert.Equal("jupyter-lab-"+hash[:8], readableSubdomain("___", "Jupyter Lab!", "u1", "e1", 8))
+	assert.Equal(hash[:4], readableSubdomain("", "", "u1", "e1", 4))
+
+	// Long names are cut down to fit in a DNS label.
+	long := readableSubdomain(strings.Repeat("user.", 10), strings.Repeat("app-", 30), "u1", "e1", 16)
+	assert.Empty(validation.IsDNS1123Label(long))
+	assert.True(strings.HasPrefix(long, "user-user-user-user-"))
+	assert.True(strings.HasSuffix(long, "-"+hash[:16]))
+}
+
+func TestSubdomain(t *testing.T) {
+	assert := assert.New(t)
+
+	mockdb, mock, err := sqlmock.New()
+	assert.NoError(err)
+	defer mockdb.Close()
+
+	job := &model.Job{UserID: "u1", InvocationID: "e1", Submitter: "jdoe@example.org", AppName: "RStudio"}
+	i := &Internal{
+		Init: Init{UserSuffix: "@example.org"},
+		db:   sqlx.NewDb(mockdb, "sqlmock"),
+	}
+
+	// The hash scheme doesn't record anything.
+	subdomain, err := i.subdomain(context.Background(), job)
+	assert.NoError(err)
+	assert.Equal(IngressName("u1", "e1"), subdomain)
+	assert.Equal(subdomain, i.jobSubdomain(job))
+
+	// Readable subdomains that are taken get longer hashes.
+	i.Subdomains.Scheme = SubdomainSchemeReadable
+	hash := subdomainHash("u1", "e1")
+	mock.ExpectQuery("INSERT INTO vice_subdomains").WithArgs("jdoe-rstudio-"+hash[:4], "e1").
+		WillReturnRows(sqlmock.NewRows([]string{"external_id"}).AddRow("e2"))
+	mock.ExpectQuery("INSERT INTO vice_subdomains").WithArgs("jdoe-rstudio-"+hash[:8], "e1").
+		WillReturnRows(sqlmock.NewRows([]string{"external_id"}).AddRow("e1"))
+
+	subdomain, err = i.subdomain(context.Background(), job)
+	assert.NoError(err)
+	assert.Equal("jdoe-rstudio-"+hash[:8], subdomain)
+	assert.NoError(mock.ExpectationsWereMet())
+
+	// The claimed subdomain is used for the rest of the launch and for
+	// later lookups without going back to the database.
+	assert.Equal(subdomain, i.jobSubdomain(job))
+	found, err := i.analysisSubdomain(context.Background(), "u1", "e1")
+	assert.NoError(err)
+	assert.Equal(subdomain, found)
+
+	// Analyses without a recorded subdomain were launched with the hash
+	// scheme.
+	mock.ExpectQuery("SELECT subdomain").WithArgs("e3").WillReturnRows(sqlmock.NewRows([]string{"subdomain"}))
+	found, err = i.analysisSubdomain(context.Background(), "u1", "e3")
+	assert.NoError(err)
+	assert.Equal(IngressName("u1", "e3"), found)
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestSubdomainFromLabels(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("jdoe-rstudio-1a2b", subdomainFromLabels(map[string]string{
+		"user-id": "u1", "external-id": "e1", "subdomain": "jdoe-rstudio-1a2b",
+	}))
+	assert.Equal(IngressName("u1", "e1"), subdomainFromLabels(map[string]string{
+		"user-id": "u1", "external-id": "e1",
+	}))
+}
@@ -0,0 +1,178 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/cyverse-de/model/v6"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// FieldError is a problem with a single field of a job submission. The field
+// is the path to it in the submission's JSON, for example
+// steps[0].component.container.ports.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// submissionErrors collects the problems found in a job submission.
+type submissionErrors []FieldError
+
+func (e *submissionErrors) add(field, format string, args ...interface{}) {
+	*e = append(*e, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+func (e *submissionErrors) require(field, value string) {
+	if strings.TrimSpace(value) == "" {
+		e.add(field, "is required")
+	}
+}
+
+func (e *submissionErrors) nonNegative(field string, value float64) {
+	if value < 0 {
+		e.add(field, "must not be negative, got %v", value)
+	}
+}
+
+// resources adds the problems with the resource requests of a step's
+// container. Zero quantities mean that the defaults are used.
+func (e *submissionErrors) resources(field string, container *model.Container) {
+	e.nonNegative(field+".min_cpu_cores", float64(container.MinCPUCores))
+	e.nonNegative(field+".max_cpu_cores", float64(container.MaxCPUCores))
+	e.nonNegative(field+".min_memory_limit", float64(container.MinMemoryLimit))
+	e.nonNegative(field+".memory_limit", float64(container.MemoryLimit))
+	e.nonNegative(field+".min_disk_space", float64(container.MinDiskSpace))
+	e.nonNegative(field+".pids_limit", float64(container.PIDsLimit))
+
+	if container.MaxCPUCores > 0 && container.MinCPUCores > container.MaxCPUCores {
+		e.add(field+".min_cpu_cores", "must not be more than max_cpu_cores (%v), got %v", container.MaxCPUCores, container.MinCPUCores)
+	}
+	if container.MemoryLimit > 0 && container.MinMemoryLimit > container.MemoryLimit {
+		e.add(field+".min_memory_limit", "must not be more than memory_limit (%d), got %d", container.MemoryLimit, container.MinMemoryLimit)
+	}
+}
+
+// container adds the problems with the container of a VICE analysis step.
+func (e *submissionErrors) container(field string, container *model.Container) {
+	e.require(field+".image.name", container.Image.Name)
+
+	if len(container.Ports) == 0 {
+		e.add(field+".ports", "interactive analyses need at least one container port")
+	}
+	for index, port := range container.Ports {
+		if port.ContainerPort < 1 || port.ContainerPort > 65535 {
+			e.add(fmt.Sprintf("%s.ports[%d].container_port", field, index), "must be between 1 and 65535, got %d", port.ContainerPort)
+		}
+	}
+
+	e.resources(field, container)
+}
+
+// sidecar adds the problems with the container of a step after the first
+// one. Sidecars don't need ports, but they can't reuse the ports of the
+// other steps, and their CPU and memory limits must be set so that they
+// count towards the analysis's quota.
+func (e *submissionErrors) sidecar(field string, container *model.Container, usedPorts map[int]string) {
+	e.require(field+".image.name", container.Image.Name)
+
+	for index, port := range container.Ports {
+		portField := fmt.Sprintf("%s.ports[%d].container_port", field, index)
+		if port.ContainerPort < 1 || port.ContainerPort > 65535 {
+			e.add(portField, "must be between 1 and 65535, got %d", port.ContainerPort)
+			continue
+		}
+		if other, ok := usedPorts[port.ContainerPort]; ok {
+			e.add(portField, "port %d is already used by %s", port.ContainerPort, other)
+			continue
+		}
+		usedPorts[port.ContainerPort] = field
+	}
+
+	if container.MaxCPUCores <= 0 {
+		e.add(field+".max_cpu_cores", "is required for sidecar steps")
+	}
+	if container.MemoryLimit <= 0 {
+		e.add(field+".memory_limit", "is required for sidecar steps")
+	}
+
+	e.resources(field, container)
+}
+
+// response returns the error response listing the problems, or nil if there
+// aren't any.
+func (e submissionErrors) response() error {
+	if len(e) == 0 {
+		return nil
+	}
+
+	fields := make([]string, 0, len(e))
+	for _, fieldErr := range e {
+		fields = append(fields, fieldErr.Field)
+	}
+
+	return common.ErrorResponse{
+		ErrorCode: "ERR_INVALID_SUBMISSION",
+		Message:   fmt.Sprintf("the job submission is invalid: %s", strings.Join(fields, ", ")),
+		Details: &map[string]interface{}{
+			"errors": []FieldError(e),
+		},
+	}
+}
+
+// validateSubmission checks that the fields the spec builders rely on are
+// present and usable, so that an incomplete submission is rejected with the
+// fields that need fixing rather than causing a panic or a broken spec.
+func validateSubmission(job *model.Job) error {
+	errs := submissionErrors{}
+
+	errs.require("uuid", job.InvocationID)
+	if job.InvocationID != "" {
+		// The invocation ID is used in the names of the analysis's resources.
+		for _, msg := range validation.IsDNS1123Label(job.InvocationID) {
+			errs.add("uuid", "%s", msg)
+		}
+	}
+	errs.require("username", job.Submitter)
+	errs.require("user_id", job.UserID)
+
+	if len(job.Steps) == 0 {
+		errs.add("steps", "the job doesn't have any steps")
+	} else {
+		step := &job.Steps[0]
+		errs.container("steps[0].component.container", &step.Component.Container)
+		if step.Component.TimeLimit < 0 {
+			errs.add("steps[0].component.time_limit_seconds", "must not be negative, got %d", step.Component.TimeLimit)
+		}
+
+		// The steps after the first one run as sidecars in the same pod, so
+		// their ports can't clash with the ports of the other containers.
+		usedPorts := map[int]string{
+			int(viceProxyPort):     "the VICE proxy",
+			int(fileTransfersPort): "the file transfers container",
+		}
+		for _, port := range step.Component.Container.Ports {
+			usedPorts[port.ContainerPort] = "steps[0].component.container"
+		}
+		for idx := 1; idx < len(job.Steps); idx++ {
+			errs.sidecar(fmt.Sprintf("steps[%d].component.container", idx), &job.Steps[idx].Component.Container, usedPorts)
+		}
+	}
+
+	return errs.response()
+}
+
+// validateSubmissionResources checks the fields of a submission that are
+// used to preview its resource requirements.
+func validateSubmissionResources(job *model.Job) error {
+	errs := submissionErrors{}
+
+	if len(job.Steps) == 0 {
+		errs.add("steps", "the job doesn't have any steps")
+	} else {
+		errs.resources("steps[0].component.container", &job.Steps[0].Component.Container)
+	}
+
+	return errs.response()
+}
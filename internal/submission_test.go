@@ -0,0 +1,122 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/cyverse-de/model/v6"
+	"github.com/stretchr/testify/assert"
+)
+
+func submissionFields(t *testing.T, err error) []string {
+	response, ok := err.(common.ErrorResponse)
+	if !assert.True(t, ok, "%v", err) {
+		return nil
+	}
+	assert.Equal(t, "ERR_INVALID_SUBMISSION", response.ErrorCode)
+
+	fields := []string{}
+	for _, fieldErr := range (*response.Details)["errors"].([]FieldError) {
+		fields = append(fields, fieldErr.Field)
+	}
+	return fields
+}
+
+func validSubmission() *model.Job {
+	return &model.Job{
+		InvocationID: "07bd1e3c-0a1c-4b4f-9bd5-3cbb6b8d1f5c",
+		Submitter:    "ipcdev",
+		UserID:       "u1",
+		Steps: []model.Step{{
+			Component: model.StepComponent{
+				Container: model.Container{
+					Image:       model.ContainerImage{Name: "jupyter"},
+					Ports:       []model.Ports{{ContainerPort: 8888}},
+					MinCPUCores: 1,
+					MaxCPUCores: 2,
+				},
+			},
+		}},
+	}
+}
+
+func TestValidateSubmission(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(validateSubmission(validSubmission()))
+
+	// Every problem is reported at once.
+	assert.Equal([]string{"uuid", "username", "user_id", "steps"}, submissionFields(t, validateSubmission(&model.Job{})))
+
+	job := validSubmission()
+	job.InvocationID = "Not A Name"
+	container := &job.Steps[0].Component.Container
+	container.Image.Name = ""
+	container.Ports = nil
+	container.MinCPUCores = 4
+	container.MemoryLimit = -1
+	assert.Equal([]string{
+		"uuid",
+		"steps[0].component.container.image.name",
+		"steps[0].component.container.ports",
+		"steps[0].component.container.memory_limit",
+		"steps[0].component.container.min_cpu_cores",
+	}, submissionFields(t, validateSubmission(job)))
+
+	job = validSubmission()
+	job.Steps[0].Component.Container.Ports = []model.Ports{{ContainerPort: 0}}
+	assert.Equal([]string{"steps[0].component.container.ports[0].container_port"}, submissionFields(t, validateSubmission(job)))
+}
+
+func TestValidateSubmissionSidecars(t *testing.T) {
+	assert := assert.New(t)
+
+	sidecar := func(ports ...int) model.Step {
+		step := model.Step{}
+		step.Component.Container = model.Container{
+			Image:       model.ContainerImage{Name: "postgres"},
+			MaxCPUCores: 1,
+			MemoryLimit: 1024 * 1024 * 1024,
+		}
+		for _, port := range ports {
+			step.Component.Container.Ports = append(step.Component.Container.Ports, model.Ports{ContainerPort: port})
+		}
+		return step
+	}
+
+	// Sidecars don't need ports.
+	job := validSubmission()
+	job.Steps = append(job.Steps, sidecar(5432), sidecar())
+	assert.NoError(validateSubmission(job))
+
+	// Ports can't be shared with the analysis, the proxy, or other sidecars.
+	job = validSubmission()
+	job.Steps = append(job.Steps, sidecar(8888, 5432), sidecar(5432, int(viceProxyPort)))
+	assert.Equal([]string{
+		"steps[1].component.container.ports[0].container_port",
+		"steps[2].component.container.ports[0].container_port",
+		"steps[2].component.container.ports[1].container_port",
+	}, submissionFields(t, validateSubmission(job)))
+
+	job = validSubmission()
+	job.Steps = append(job.Steps, model.Step{})
+	assert.Equal([]string{
+		"steps[1].component.container.image.name",
+		"steps[1].component.container.max_cpu_cores",
+		"steps[1].component.container.memory_limit",
+	}, submissionFields(t, validateSubmission(job)))
+}
+
+func TestValidateSubmissionResources(t *testing.T) {
+	assert := assert.New(t)
+
+	// Previews don't need the fields identifying the analysis.
+	job := &model.Job{Steps: []model.Step{{}}}
+	assert.NoError(validateSubmissionResources(job))
+
+	job.Steps[0].Component.Container.MinMemoryLimit = 2048
+	job.Steps[0].Component.Container.MemoryLimit = 1024
+	assert.Equal([]string{"steps[0].component.container.min_memory_limit"}, submissionFields(t, validateSubmissionResources(job)))
+
+	assert.Equal([]string{"steps"}, submissionFields(t, validateSubmissionResources(&model.Job{})))
+}
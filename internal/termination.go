@@ -0,0 +1,154 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/pkg/errors"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// skipFlushMarkerName is the file app-exposer writes to the working directory
+// before it deletes an analysis whose outputs have already been dealt with,
+// either because they were uploaded by a save-and-exit or because the user
+// chose to discard them. The preStop hook doesn't upload the outputs if it's
+// there.
+const skipFlushMarkerName = ".vice-skip-flush"
+
+// defaultMaxTerminationGracePeriod is the longest grace period an analysis
+// pod may be given if vice.termination.max-grace-period isn't set.
+const defaultMaxTerminationGracePeriod = time.Hour
+
+// flushOutputsScript asks the file transfers container to upload the outputs
+// and waits for the upload to finish. It runs in the file transfers
+// container, whose image provides sh, sed, and wget, rather than in the
+// analysis container, whose image is the tool's. The skip marker path, the
+// upload URL, and the final statuses are passed as positional parameters so
+// that the tool's working directory is never interpreted by the shell.
+const flushOutputsScript = `
+[ -e "$1" ] && exit 0
+url=$2
+id=$(wget -q -O - --post-data= "$url" | sed -n 's/.*"uuid" *: *"\([^"]*\)".*/\1/p')
+[ -n "$id" ] || exit 0
+while :; do
+  status=$(wget -q -O - "$url/$id" | sed -n 's/.*"status" *: *"\([^"]*\)".*/\1/p')
+  case "$status" in
+    "$3"|"$4"|"") exit 0 ;;
+  esac
+  sleep 5
+done
+`
+
+// flushOutputsOnStop returns true if the outputs should be uploaded when the
+// analysis pod stops. Outputs are written directly to the data store when the
+// CSI driver is used, so there's nothing to flush.
+func (i *Internal) flushOutputsOnStop(settings *ToolSettings) bool {
+	if i.UseCSIDriver {
+		return false
+	}
+	if settings.FlushOutputsOnStop != nil {
+		return *settings.FlushOutputsOnStop
+	}
+	return i.FlushOutputsOnStop
+}
+
+// maxTerminationGracePeriod returns the longest grace period an analysis
+// pod may be given.
+func (i *Internal) maxTerminationGracePeriod() time.Duration {
+	if i.TerminationMaxGracePeriod > 0 {
+		return i.TerminationMaxGracePeriod
+	}
+	return defaultMaxTerminationGracePeriod
+}
+
+// terminationGracePeriodSeconds returns the termination grace period for the
+// analysis pod, or nil to use the k8s default. The tool settings take
+// precedence over the service-wide default, and neither may be longer than
+// the configured maximum.
+func (i *Internal) terminationGracePeriodSeconds(settings *ToolSettings) *int64 {
+	var seconds int64
+	switch {
+	case settings.TerminationGracePeriodSeconds != nil:
+		seconds = *settings.TerminationGracePeriodSeconds
+	case i.TerminationGracePeriod > 0:
+		seconds = int64(i.TerminationGracePeriod.Seconds())
+	default:
+		return nil
+	}
+
+	if max := int64(i.maxTerminationGracePeriod().Seconds()); seconds > max {
+		seconds = max
+	}
+	return int64Ptr(seconds)
+}
+
+// fileTransfersLifecycle returns the lifecycle hooks for the file transfers
+// container, or nil if it doesn't need any. The working directory is shared
+// with the analysis container, so the outputs can be uploaded from here
+// without depending on the tools in the analysis's image.
+func (i *Internal) fileTransfersLifecycle(settings *ToolSettings) *apiv1.Lifecycle {
+	if !i.flushOutputsOnStop(settings) {
+		return nil
+	}
+
+	return &apiv1.Lifecycle{
+		PreStop: &apiv1.LifecycleHandler{
+			Exec: &apiv1.ExecAction{
+				Command: []string{
+					"sh", "-c", flushOutputsScript, "sh",
+					path.Join(fileTransfersInputsMountPath, skipFlushMarkerName),
+					fmt.Sprintf("http://127.0.0.1:%d%s", fileTransfersPort, uploadBasePath),
+					CompletedStatus,
+					FailedStatus,
+				},
+			},
+		},
+	}
+}
+
+// hasFlushHook returns true if the pod uploads its outputs when it stops.
+func hasFlushHook(pod *apiv1.Pod) bool {
+	for _, container := range pod.Spec.Containers {
+		if container.Name == fileTransfersContainerName && container.Lifecycle != nil && container.Lifecycle.PreStop != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// skipOutputFlush keeps the analysis's pods from uploading their outputs when
+// they're deleted. It's called when the exit path has already decided what
+// happens to the outputs. Pods that can't be reached are logged and skipped,
+// in which case their outputs are uploaded as if the pod had been stopped for
+// any other reason.
+func (i *Internal) skipOutputFlush(ctx context.Context, externalID string) {
+	if i.UseCSIDriver {
+		return
+	}
+
+	set := labels.Set(map[string]string{
+		"external-id": externalID,
+	})
+	pods, err := i.clientset.CoreV1().Pods(i.ViceNamespace).List(ctx, metav1.ListOptions{
+		LabelSelector: set.AsSelector().String(),
+	})
+	if err != nil {
+		log.WithContext(ctx).Error(errors.Wrapf(err, "unable to list the pods for %s", externalID))
+		return
+	}
+
+	for idx := range pods.Items {
+		pod := &pods.Items[idx]
+		if !hasFlushHook(pod) || pod.Status.Phase != apiv1.PodRunning {
+			continue
+		}
+		marker := path.Join(fileTransfersInputsMountPath, skipFlushMarkerName)
+		if _, err = i.execInPod(ctx, pod.Namespace, pod.Name, fileTransfersContainerName, []string{"touch", marker}); err != nil {
+			log.WithContext(ctx).Error(errors.Wrapf(err, "unable to turn off the output upload for pod %s", pod.Name))
+		}
+	}
+}
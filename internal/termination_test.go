@@ -0,0 +1,92 @@
+package internal
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+func TestTerminationGracePeriodSeconds(t *testing.T) {
+	assert := assert.New(t)
+
+	i := &Internal{}
+	assert.Nil(i.terminationGracePeriodSeconds(&ToolSettings{}))
+
+	i.TerminationGracePeriod = 5 * time.Minute
+	assert.Equal(int64(300), *i.terminationGracePeriodSeconds(&ToolSettings{}))
+
+	grace := int64(600)
+	assert.Equal(int64(600), *i.terminationGracePeriodSeconds(&ToolSettings{TerminationGracePeriodSeconds: &grace}))
+
+	// Tools can't hold up terminations for longer than the maximum.
+	grace = int64(24 * 60 * 60)
+	assert.Equal(int64(3600), *i.terminationGracePeriodSeconds(&ToolSettings{TerminationGracePeriodSeconds: &grace}))
+
+	i.TerminationMaxGracePeriod = 10 * time.Minute
+	assert.Equal(int64(600), *i.terminationGracePeriodSeconds(&ToolSettings{TerminationGracePeriodSeconds: &grace}))
+}
+
+func TestFlushOutputsOnStop(t *testing.T) {
+	assert := assert.New(t)
+
+	enabled := true
+	disabled := false
+
+	i := &Internal{}
+	assert.False(i.flushOutputsOnStop(&ToolSettings{}))
+	assert.True(i.flushOutputsOnStop(&ToolSettings{FlushOutputsOnStop: &enabled}))
+
+	i.FlushOutputsOnStop = true
+	assert.True(i.flushOutputsOnStop(&ToolSettings{}))
+	assert.False(i.flushOutputsOnStop(&ToolSettings{FlushOutputsOnStop: &disabled}))
+
+	// There's nothing to flush when the CSI driver is used.
+	i.UseCSIDriver = true
+	assert.False(i.flushOutputsOnStop(&ToolSettings{FlushOutputsOnStop: &enabled}))
+}
+
+func TestFileTransfersLifecycle(t *testing.T) {
+	assert := assert.New(t)
+
+	i := &Internal{}
+	assert.Nil(i.fileTransfersLifecycle(&ToolSettings{}))
+
+	i.FlushOutputsOnStop = true
+	transfers := i.fileTransfersLifecycle(&ToolSettings{})
+	if assert.NotNil(transfers) {
+		command := transfers.PreStop.Exec.Command
+		assert.Equal([]string{"sh", "-c", flushOutputsScript, "sh"}, command[:4])
+		assert.Equal("/input-files/"+skipFlushMarkerName, command[4])
+		assert.Equal("http://127.0.0.1:60001/upload", command[5])
+		assert.Equal([]string{CompletedStatus, FailedStatus}, command[6:])
+	}
+
+	pod := &apiv1.Pod{Spec: apiv1.PodSpec{Containers: []apiv1.Container{
+		{Name: analysisContainerName},
+		{Name: fileTransfersContainerName, Lifecycle: transfers},
+	}}}
+	assert.True(hasFlushHook(pod))
+	pod.Spec.Containers[1].Lifecycle = nil
+	assert.False(hasFlushHook(pod))
+}
+
+func TestFlushOutputsScript(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh isn't available")
+	}
+	assert := assert.New(t)
+
+	// The upload isn't started when the exit path has already dealt with the
+	// outputs. The URL can't be reached, so the script would fail to start
+	// the upload either way, but it must return without trying.
+	marker := filepath.Join(t.TempDir(), skipFlushMarkerName)
+	assert.NoError(os.WriteFile(marker, nil, 0644))
+	out, err := exec.Command("sh", "-c", flushOutputsScript+"echo uploaded", "sh", marker, "http://127.0.0.1:1/upload", CompletedStatus, FailedStatus).CombinedOutput()
+	assert.NoError(err)
+	assert.NotContains(string(out), "uploaded")
+}
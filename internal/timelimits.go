@@ -0,0 +1,330 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cyverse-de/model/v6"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const defaultTimeLimitInterval = time.Minute
+
+const (
+	// timeLimitAnnotation records the tool's time limit on the analysis's
+	// Deployment, so that it can be enforced without looking up the job.
+	timeLimitAnnotation = "vice.cyverse.org/time-limit"
+
+	// timeLimitEnforcedAnnotation is set on the Deployment by the replica
+	// that stops the analysis when it reaches its time limit.
+	timeLimitEnforcedAnnotation = "vice.cyverse.org/time-limit-enforcer"
+)
+
+// timeLimitRequester is recorded as the requester in the command audit table
+// when an analysis is stopped for reaching its time limit.
+const timeLimitRequester = "app-exposer"
+
+// TimeLimitsConfig contains the settings for stopping analyses that reach
+// their time limits.
+type TimeLimitsConfig struct {
+	Enabled bool
+
+	// Interval is how often the analyses are checked.
+	Interval time.Duration
+
+	// MaxDuration is how long any analysis may run, no matter what its tool's
+	// time limit is or how many times it's been extended. Zero means there's
+	// no maximum.
+	MaxDuration time.Duration
+
+	// Action is what's done to analyses that reach their time limits, either
+	// save-and-exit or terminate.
+	Action string
+}
+
+// Validate returns an error if the configuration can't be used.
+func (c *TimeLimitsConfig) Validate() error {
+	if c.Interval < 0 {
+		return fmt.Errorf("the time limit interval must not be negative")
+	}
+	if c.MaxDuration < 0 {
+		return fmt.Errorf("the maximum analysis duration must not be negative")
+	}
+	switch c.Action {
+	case "", saveAndExitCommand, terminateCommand:
+	default:
+		return fmt.Errorf("the time limit action must be %s or %s, got %q", saveAndExitCommand, terminateCommand, c.Action)
+	}
+	return nil
+}
+
+// toolTimeLimit returns the time limit of the analysis's tool, or zero if the
+// tool doesn't have one.
+func toolTimeLimit(job *model.Job) time.Duration {
+	if len(job.Steps) == 0 || job.Steps[0].Component.TimeLimit <= 0 {
+		return 0
+	}
+	return time.Duration(job.Steps[0].Component.TimeLimit) * time.Second
+}
+
+const getPlannedEndDateSQL = `
+	SELECT j.planned_end_date
+	  FROM jobs j
+	  JOIN job_steps s ON s.job_id = j.id
+	 WHERE s.external_id = $1
+`
+
+// TimeLimitEnforcer stops the analyses that run past their time limits. An
+// analysis's time limit is its tool's time_limit_seconds after it was
+// launched, pushed back to the planned end date if the user has extended it
+// past that, and capped at the DE-wide maximum duration.
+type TimeLimitEnforcer struct {
+	internal    *Internal
+	interval    time.Duration
+	maxDuration time.Duration
+	action      string
+	now         func() time.Time
+
+	// stop stops an analysis that reached its time limit. It's enforce
+	// outside of the tests.
+	stop func(ctx context.Context, externalID string, deadline time.Time) error
+
+	// running tracks the analyses that are being stopped.
+	running sync.WaitGroup
+}
+
+// NewTimeLimitEnforcer returns a new *TimeLimitEnforcer.
+func NewTimeLimitEnforcer(i *Internal) *TimeLimitEnforcer {
+	e := &TimeLimitEnforcer{
+		internal:    i,
+		interval:    i.TimeLimits.Interval,
+		maxDuration: i.TimeLimits.MaxDuration,
+		action:      i.TimeLimits.Action,
+		now:         time.Now,
+	}
+	e.stop = e.enforce
+	if e.interval <= 0 {
+		e.interval = defaultTimeLimitInterval
+	}
+	if e.action == "" {
+		e.action = saveAndExitCommand
+	}
+	return e
+}
+
+// plannedEndDate returns the planned end date of the analysis, or false if it
+// doesn't have one.
+func (e *TimeLimitEnforcer) plannedEndDate(ctx context.Context, externalID string) (time.Time, bool, error) {
+	var plannedEnd pq.NullTime
+	err := e.internal.db.QueryRowContext(ctx, getPlannedEndDateSQL, externalID).Scan(&plannedEnd)
+	if err == sql.ErrNoRows {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, errors.Wrapf(err, "error retrieving the planned end date of analysis %s", externalID)
+	}
+	return plannedEnd.Time, plannedEnd.Valid, nil
+}
+
+// deadline returns when the analysis running in the Deployment has to be
+// stopped, or false if it doesn't have a time limit. The planned end date is
+// only looked up once the tool's time limit has passed.
+func (e *TimeLimitEnforcer) deadline(ctx context.Context, deployment *appsv1.Deployment, now time.Time) (time.Time, bool, error) {
+	launched := deployment.CreationTimestamp.Time
+
+	var maxDeadline time.Time
+	if e.maxDuration > 0 {
+		maxDeadline = launched.Add(e.maxDuration)
+	}
+
+	seconds, err := strconv.ParseInt(deployment.Annotations[timeLimitAnnotation], 10, 64)
+	if err != nil || seconds <= 0 {
+		return maxDeadline, !maxDeadline.IsZero(), nil
+	}
+
+	deadline := launched.Add(time.Duration(seconds) * time.Second)
+	if !now.Before(deadline) {
+		plannedEnd, ok, err := e.plannedEndDate(ctx, deployment.Labels["external-id"])
+		if err != nil {
+			return time.Time{}, false, err
+		}
+		if ok && plannedEnd.After(deadline) {
+			deadline = plannedEnd
+		}
+	}
+
+	if !maxDeadline.IsZero() && maxDeadline.Before(deadline) {
+		deadline = maxDeadline
+	}
+	return deadline, true, nil
+}
+
+// claim marks the Deployment as being handled by this replica, returning
+// false if another replica has already done so. The update uses the
+// Deployment's resource version, so only one app-exposer replica can succeed.
+func (e *TimeLimitEnforcer) claim(ctx context.Context, deployment *appsv1.Deployment) (bool, error) {
+	if _, ok := deployment.Annotations[timeLimitEnforcedAnnotation]; ok {
+		return false, nil
+	}
+
+	updated := deployment.DeepCopy()
+	if updated.Annotations == nil {
+		updated.Annotations = map[string]string{}
+	}
+	updated.Annotations[timeLimitEnforcedAnnotation] = hostname()
+
+	depclient := e.internal.clientset.AppsV1().Deployments(deployment.Namespace)
+	if _, err := depclient.Update(ctx, updated, metav1.UpdateOptions{}); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// enforce stops the analysis and lets the user know why. The stop is
+// recorded in the command audit table like the commands sent by other DE
+// services.
+func (e *TimeLimitEnforcer) enforce(ctx context.Context, externalID string, deadline time.Time) error {
+	ctx = withExternalIDBaggage(ctx, externalID)
+	ctx, span := startSpan(ctx, "TimeLimitEnforcer.enforce")
+	defer span.End()
+
+	log.WithContext(ctx).Warnf("analysis %s reached its time limit at %s, running %s", externalID, deadline.Format(time.RFC3339), e.action)
+
+	msg := "The analysis reached its time limit and is being shut down."
+	if e.action == saveAndExitCommand {
+		msg = "The analysis reached its time limit. Saving output files before shutting it down."
+	}
+	if err := e.internal.statusPublisher.Running(ctx, externalID, msg); err != nil {
+		log.WithContext(ctx).Error(err)
+	}
+
+	cmd := &AnalysisCommand{
+		Command:     e.action,
+		ExternalID:  externalID,
+		RequestedBy: timeLimitRequester,
+		Reason:      fmt.Sprintf("the analysis reached its time limit at %s", deadline.Format(time.RFC3339)),
+	}
+	auditID, err := e.internal.auditCommand(ctx, cmd, 1, commandReceived)
+	if err != nil {
+		log.WithContext(ctx).Error(errors.Wrapf(err, "unable to record the %s command for %s", cmd.Command, externalID))
+	}
+
+	cmdErr := e.internal.runCommand(ctx, cmd)
+	if auditID != "" {
+		status := commandCompleted
+		if cmdErr != nil {
+			status = commandFailed
+		}
+		e.internal.finishCommandAudit(ctx, auditID, status, cmdErr)
+	}
+	if cmdErr != nil {
+		return errors.Wrapf(cmdErr, "unable to stop analysis %s after it reached its time limit", externalID)
+	}
+
+	err = e.internal.notify(ctx, &analysisNotification{
+		ExternalID: externalID,
+		Event:      NotificationCompleted,
+		Subject:    "Your analysis reached its time limit",
+		Message:    fmt.Sprintf("Your VICE analysis was stopped because it reached its time limit. %s", msg),
+	})
+	if err != nil {
+		log.WithContext(ctx).Error(err)
+	}
+
+	return nil
+}
+
+// check stops the analyses that are past their time limits. Returns the
+// external IDs of the analyses that this replica is stopping. Saving outputs
+// can take a long time, so the analyses are stopped in the background.
+func (e *TimeLimitEnforcer) check(ctx context.Context) ([]string, error) {
+	ctx, span := startSpan(ctx, "TimeLimitEnforcer.check")
+	defer span.End()
+
+	set := labels.Set(map[string]string{
+		"app-type": "interactive",
+	})
+
+	deplist, err := e.internal.clientset.AppsV1().Deployments(e.internal.ViceNamespace).List(ctx, metav1.ListOptions{
+		LabelSelector: set.AsSelector().String(),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to list the analysis deployments")
+	}
+
+	now := e.now()
+	stopped := []string{}
+	for idx := range deplist.Items {
+		deployment := &deplist.Items[idx]
+		externalID := deployment.Labels["external-id"]
+		if externalID == "" || deployment.DeletionTimestamp != nil {
+			continue
+		}
+		if _, ok := deployment.Annotations[timeLimitEnforcedAnnotation]; ok {
+			continue
+		}
+
+		deadline, ok, err := e.deadline(ctx, deployment, now)
+		if err != nil {
+			log.WithContext(ctx).Error(err)
+			continue
+		}
+		if !ok || now.Before(deadline) {
+			continue
+		}
+
+		claimed, err := e.claim(ctx, deployment)
+		if err != nil {
+			// Another replica may have claimed it first. Check again next time.
+			log.WithContext(ctx).Infof("unable to claim analysis %s for time limit enforcement: %s", externalID, err)
+			continue
+		}
+		if !claimed {
+			continue
+		}
+
+		stopped = append(stopped, externalID)
+		e.running.Add(1)
+		go func(externalID string, deadline time.Time) {
+			defer e.running.Done()
+			if err := e.stop(ctx, externalID, deadline); err != nil {
+				log.WithContext(ctx).Error(err)
+			}
+		}(externalID, deadline)
+	}
+
+	return stopped, nil
+}
+
+// Run checks the analyses every interval. Blocks until the context is
+// canceled.
+func (e *TimeLimitEnforcer) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := e.check(ctx); err != nil {
+				log.WithContext(ctx).Error(err)
+			}
+		}
+	}
+}
+
+// RunTimeLimitEnforcer starts stopping analyses that reach their time limits.
+// Blocks until the context is canceled.
+func (i *Internal) RunTimeLimitEnforcer(ctx context.Context) {
+	NewTimeLimitEnforcer(i).Run(ctx)
+}
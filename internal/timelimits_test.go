@@ -0,0 +1,244 @@
+package internal
+
+import (
+	"context"
+	"regexp"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/cyverse-de/model/v6"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+var timeLimitNow = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+func timeLimitTestDeployment(externalID string, age time.Duration, timeLimit string) *appsv1.Deployment {
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              externalID,
+			Namespace:         "vice-apps",
+			Labels:            map[string]string{"external-id": externalID, "app-type": "interactive"},
+			CreationTimestamp: metav1.NewTime(timeLimitNow.Add(-age)),
+		},
+	}
+	if timeLimit != "" {
+		deployment.Annotations = map[string]string{timeLimitAnnotation: timeLimit}
+	}
+	return deployment
+}
+
+func TestTimeLimitsConfigValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError((&TimeLimitsConfig{}).Validate())
+	assert.NoError((&TimeLimitsConfig{Action: terminateCommand, MaxDuration: 72 * time.Hour}).Validate())
+	assert.Error((&TimeLimitsConfig{Action: extendCommand}).Validate())
+	assert.Error((&TimeLimitsConfig{MaxDuration: -time.Hour}).Validate())
+	assert.Error((&TimeLimitsConfig{Interval: -time.Minute}).Validate())
+}
+
+func TestToolTimeLimit(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(time.Duration(0), toolTimeLimit(&model.Job{}))
+
+	job := &model.Job{Steps: []model.Step{{}}}
+	assert.Equal(time.Duration(0), toolTimeLimit(job))
+
+	job.Steps[0].Component.TimeLimit = 7200
+	assert.Equal(2*time.Hour, toolTimeLimit(job))
+}
+
+func TestTimeLimitDeadline(t *testing.T) {
+	extended := timeLimitNow.Add(time.Hour)
+
+	tests := []struct {
+		name        string
+		age         time.Duration
+		timeLimit   string
+		maxDuration time.Duration
+		plannedEnd  *time.Time
+		expected    time.Time
+		ok          bool
+	}{
+		{
+			name: "no limits",
+			age:  100 * time.Hour,
+		},
+		{
+			name:        "maximum duration only",
+			age:         time.Hour,
+			maxDuration: 48 * time.Hour,
+			expected:    timeLimitNow.Add(47 * time.Hour),
+			ok:          true,
+		},
+		{
+			name:      "tool limit not reached",
+			age:       time.Hour,
+			timeLimit: "7200",
+			expected:  timeLimitNow.Add(time.Hour),
+			ok:        true,
+		},
+		{
+			name:        "maximum duration before the tool limit",
+			age:         time.Hour,
+			timeLimit:   "7200",
+			maxDuration: 90 * time.Minute,
+			expected:    timeLimitNow.Add(30 * time.Minute),
+			ok:          true,
+		},
+		{
+			name:       "tool limit reached",
+			age:        3 * time.Hour,
+			timeLimit:  "7200",
+			plannedEnd: &time.Time{},
+			expected:   timeLimitNow.Add(-time.Hour),
+			ok:         true,
+		},
+		{
+			name:       "tool limit extended",
+			age:        3 * time.Hour,
+			timeLimit:  "7200",
+			plannedEnd: &extended,
+			expected:   extended,
+			ok:         true,
+		},
+		{
+			name:        "extension capped at the maximum duration",
+			age:         3 * time.Hour,
+			timeLimit:   "7200",
+			maxDuration: 210 * time.Minute,
+			plannedEnd:  &extended,
+			expected:    timeLimitNow.Add(30 * time.Minute),
+			ok:          true,
+		},
+		{
+			name:        "maximum duration reached",
+			age:         5 * time.Hour,
+			timeLimit:   "7200",
+			maxDuration: 4 * time.Hour,
+			plannedEnd:  &extended,
+			expected:    timeLimitNow.Add(-time.Hour),
+			ok:          true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			mockdb, mock, err := sqlmock.New()
+			assert.NoError(err)
+			defer mockdb.Close()
+
+			if tt.plannedEnd != nil {
+				rows := sqlmock.NewRows([]string{"planned_end_date"})
+				if tt.plannedEnd.IsZero() {
+					rows.AddRow(nil)
+				} else {
+					rows.AddRow(*tt.plannedEnd)
+				}
+				mock.ExpectQuery(regexp.QuoteMeta("SELECT j.planned_end_date")).
+					WithArgs("e1").
+					WillReturnRows(rows)
+			}
+
+			i := &Internal{
+				Init: Init{TimeLimits: TimeLimitsConfig{MaxDuration: tt.maxDuration}},
+				db:   sqlx.NewDb(mockdb, "sqlmock"),
+			}
+			e := NewTimeLimitEnforcer(i)
+
+			deadline, ok, err := e.deadline(context.Background(), timeLimitTestDeployment("e1", tt.age, tt.timeLimit), timeLimitNow)
+			assert.NoError(err)
+			assert.Equal(tt.ok, ok)
+			assert.True(tt.expected.Equal(deadline), "expected %s, got %s", tt.expected, deadline)
+			assert.NoError(mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestTimeLimitEnforcerCheck(t *testing.T) {
+	assert := assert.New(t)
+
+	mockdb, mock, err := sqlmock.New()
+	assert.NoError(err)
+	defer mockdb.Close()
+
+	claimed := timeLimitTestDeployment("e3", 5*time.Hour, "7200")
+	claimed.Annotations[timeLimitEnforcedAnnotation] = "app-exposer-1"
+
+	deleted := metav1.NewTime(timeLimitNow)
+	terminating := timeLimitTestDeployment("e4", 5*time.Hour, "7200")
+	terminating.DeletionTimestamp = &deleted
+	terminating.Finalizers = []string{"example.com/cleanup"}
+
+	clientset := fake.NewSimpleClientset(
+		// Past its time limit.
+		timeLimitTestDeployment("e1", 3*time.Hour, "7200"),
+
+		// Still has time left.
+		timeLimitTestDeployment("e2", time.Hour, "7200"),
+
+		// Already being stopped by another replica.
+		claimed,
+
+		// Already being deleted.
+		terminating,
+
+		// Past the maximum duration without a tool limit.
+		timeLimitTestDeployment("e5", 80*time.Hour, ""),
+	)
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT j.planned_end_date")).
+		WithArgs("e1").
+		WillReturnRows(sqlmock.NewRows([]string{"planned_end_date"}).AddRow(timeLimitNow.Add(-time.Hour)))
+
+	i := &Internal{
+		Init: Init{
+			ViceNamespace: "vice-apps",
+			TimeLimits:    TimeLimitsConfig{MaxDuration: 72 * time.Hour},
+		},
+		clientset: clientset,
+		db:        sqlx.NewDb(mockdb, "sqlmock"),
+	}
+	e := NewTimeLimitEnforcer(i)
+	e.now = func() time.Time { return timeLimitNow }
+
+	var mu sync.Mutex
+	stoppedAt := map[string]time.Time{}
+	e.stop = func(_ context.Context, externalID string, deadline time.Time) error {
+		mu.Lock()
+		defer mu.Unlock()
+		stoppedAt[externalID] = deadline
+		return nil
+	}
+
+	stopped, err := e.check(context.Background())
+	assert.NoError(err)
+	sort.Strings(stopped)
+	assert.Equal([]string{"e1", "e5"}, stopped)
+	assert.NoError(mock.ExpectationsWereMet())
+
+	e.running.Wait()
+	assert.True(stoppedAt["e1"].Equal(timeLimitNow.Add(-time.Hour)))
+	assert.True(stoppedAt["e5"].Equal(timeLimitNow.Add(-8 * time.Hour)))
+
+	// The analyses are marked so that they're only stopped once.
+	for _, externalID := range stopped {
+		deployment, err := clientset.AppsV1().Deployments("vice-apps").Get(context.Background(), externalID, metav1.GetOptions{})
+		assert.NoError(err)
+		assert.NotEmpty(deployment.Annotations[timeLimitEnforcedAnnotation])
+	}
+
+	stopped, err = e.check(context.Background())
+	assert.NoError(err)
+	assert.Empty(stopped)
+}
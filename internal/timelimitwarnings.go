@@ -0,0 +1,345 @@
+package internal
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cyverse-de/app-exposer/apps"
+	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+const defaultTimeLimitWarningInterval = time.Minute
+
+// The actions that time limit warning links can take.
+const (
+	timeLimitExtendAction = "extend"
+	timeLimitSnoozeAction = "snooze"
+)
+
+// TimeLimitWarningsConfig contains the settings for the notifications sent
+// to users before their analyses reach their time limits.
+type TimeLimitWarningsConfig struct {
+	Enabled bool
+
+	// Interval is how often the planned end dates are checked.
+	Interval time.Duration
+
+	// Before lists how long before the time limit each warning is sent, for
+	// example 4h and 30m.
+	Before []time.Duration
+
+	// ActionsURL is the public URL that the time limit action endpoint is
+	// exposed at. The warnings include links to extend the time limit or
+	// snooze the remaining warnings if it's set.
+	ActionsURL string
+
+	// LinkSecret is the key used to sign the action links.
+	LinkSecret string
+}
+
+// Validate returns an error if the configuration can't be used.
+func (c *TimeLimitWarningsConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if len(c.Before) == 0 {
+		return fmt.Errorf("at least one time limit warning must be configured")
+	}
+	for _, before := range c.Before {
+		if before <= 0 {
+			return fmt.Errorf("time limit warnings must be sent before the time limit, got %s", before)
+		}
+	}
+	if c.ActionsURL != "" {
+		if _, err := url.Parse(c.ActionsURL); err != nil {
+			return errors.Wrapf(err, "invalid time limit actions URL %s", c.ActionsURL)
+		}
+		if c.LinkSecret == "" {
+			return fmt.Errorf("the time limit action link secret must be set along with the actions URL")
+		}
+	}
+	return nil
+}
+
+// timeLimitAction is the content of a signed time limit action link. The
+// link only works while the analysis has the planned end date it was sent
+// for, so following an extend link twice only extends the time limit once.
+type timeLimitAction struct {
+	AnalysisID string `json:"analysis_id"`
+	Action     string `json:"action"`
+	PlannedEnd int64  `json:"planned_end"`
+}
+
+func (c *TimeLimitWarningsConfig) signature(payload string) string {
+	mac := hmac.New(sha256.New, []byte(c.LinkSecret))
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signTimeLimitAction returns the token for the action.
+func (c *TimeLimitWarningsConfig) signTimeLimitAction(action *timeLimitAction) (string, error) {
+	data, err := json.Marshal(action)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + c.signature(payload), nil
+}
+
+// parseTimeLimitAction returns the action in the token, or an error if the
+// token wasn't signed with the link secret.
+func (c *TimeLimitWarningsConfig) parseTimeLimitAction(token string) (*timeLimitAction, error) {
+	payload, signature, ok := strings.Cut(token, ".")
+	if !ok || c.LinkSecret == "" || !hmac.Equal([]byte(signature), []byte(c.signature(payload))) {
+		return nil, fmt.Errorf("invalid time limit action link")
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid time limit action link")
+	}
+
+	action := &timeLimitAction{}
+	if err = json.Unmarshal(data, action); err != nil {
+		return nil, errors.Wrap(err, "invalid time limit action link")
+	}
+	return action, nil
+}
+
+// timeLimitWarningKey identifies a warning in the sent notifications. The
+// planned end date is included so that the warnings are sent again after the
+// time limit is extended.
+func timeLimitWarningKey(before time.Duration, plannedEnd time.Time) string {
+	return fmt.Sprintf("%s:%s:%d", NotificationExpiring, before, plannedEnd.Unix())
+}
+
+// expiringAnalysis is a running VICE analysis close to its time limit.
+type expiringAnalysis struct {
+	AnalysisID       string    `db:"analysis_id"`
+	ExternalID       string    `db:"external_id"`
+	PlannedEndDate   time.Time `db:"planned_end_date"`
+	RemainingSeconds int64     `db:"remaining_seconds"`
+}
+
+const listExpiringAnalysesSQL = `
+	SELECT j.id AS analysis_id,
+	       s.external_id,
+	       j.planned_end_date,
+	       EXTRACT(EPOCH FROM (j.planned_end_date - now()))::bigint AS remaining_seconds
+	  FROM jobs j
+	  JOIN job_steps s ON s.job_id = j.id
+	  JOIN job_types t ON s.job_type_id = t.id
+	 WHERE t.name = $1
+	   AND s.step_number = 1
+	   AND j.status = 'Running'
+	   AND j.planned_end_date > now()
+	   AND j.planned_end_date <= now() + $2 * interval '1 second'
+`
+
+// TimeLimitWarner sends warnings to the owners of analyses that are about to
+// reach their time limits.
+type TimeLimitWarner struct {
+	internal *Internal
+	config   *TimeLimitWarningsConfig
+	interval time.Duration
+
+	// before is sorted from the earliest warning to the latest.
+	before []time.Duration
+}
+
+// NewTimeLimitWarner returns a new *TimeLimitWarner.
+func NewTimeLimitWarner(i *Internal) *TimeLimitWarner {
+	w := &TimeLimitWarner{
+		internal: i,
+		config:   &i.TimeLimitWarnings,
+		interval: i.TimeLimitWarnings.Interval,
+		before:   append([]time.Duration{}, i.TimeLimitWarnings.Before...),
+	}
+	if w.interval <= 0 {
+		w.interval = defaultTimeLimitWarningInterval
+	}
+	sort.Slice(w.before, func(a, b int) bool { return w.before[a] > w.before[b] })
+	return w
+}
+
+// warningDue returns the warning that's due for an analysis with the
+// remaining time left, or false if none are. Only the latest warning is sent
+// if several are due, for example after app-exposer was down for a while.
+func (w *TimeLimitWarner) warningDue(remaining time.Duration) (time.Duration, bool) {
+	for index := len(w.before) - 1; index >= 0; index-- {
+		if remaining <= w.before[index] {
+			return w.before[index], true
+		}
+	}
+	return 0, false
+}
+
+// links returns the extend and snooze links for the analysis, or nil if no
+// actions URL is configured.
+func (w *TimeLimitWarner) links(analysis *expiringAnalysis) (map[string]string, error) {
+	if w.config.ActionsURL == "" {
+		return nil, nil
+	}
+
+	links := map[string]string{}
+	for _, action := range []string{timeLimitExtendAction, timeLimitSnoozeAction} {
+		token, err := w.config.signTimeLimitAction(&timeLimitAction{
+			AnalysisID: analysis.AnalysisID,
+			Action:     action,
+			PlannedEnd: analysis.PlannedEndDate.Unix(),
+		})
+		if err != nil {
+			return nil, err
+		}
+		if links[action], err = url.JoinPath(w.config.ActionsURL, token); err != nil {
+			return nil, err
+		}
+	}
+	return links, nil
+}
+
+// warn sends the warning to the owner of the analysis.
+func (w *TimeLimitWarner) warn(ctx context.Context, analysis *expiringAnalysis, before time.Duration) error {
+	links, err := w.links(analysis)
+	if err != nil {
+		return errors.Wrapf(err, "error building the time limit links for analysis %s", analysis.AnalysisID)
+	}
+
+	remaining := (time.Duration(analysis.RemainingSeconds) * time.Second).Round(time.Minute)
+	return w.internal.notify(ctx, &analysisNotification{
+		ExternalID: analysis.ExternalID,
+		Event:      NotificationExpiring,
+		Key:        timeLimitWarningKey(before, analysis.PlannedEndDate),
+		Subject:    "Your analysis is about to reach its time limit",
+		Message: fmt.Sprintf(
+			"Your VICE analysis will be stopped when it reaches its time limit in about %s. Extend the time limit or save your work before then.",
+			remaining,
+		),
+		Links: links,
+	})
+}
+
+// check sends the warnings that are due. Returns the number of analyses that
+// had a warning due.
+func (w *TimeLimitWarner) check(ctx context.Context) (int, error) {
+	ctx, span := startSpan(ctx, "TimeLimitWarner.check")
+	defer span.End()
+
+	analyses := []expiringAnalysis{}
+	err := w.internal.db.SelectContext(ctx, &analyses, listExpiringAnalysesSQL, apps.InteractiveJobType, int64(w.before[0].Seconds()))
+	if err != nil {
+		return 0, errors.Wrap(err, "error listing the analyses close to their time limits")
+	}
+
+	due := 0
+	for index := range analyses {
+		analysis := &analyses[index]
+		before, ok := w.warningDue(time.Duration(analysis.RemainingSeconds) * time.Second)
+		if !ok {
+			continue
+		}
+		due++
+		if err = w.warn(ctx, analysis, before); err != nil {
+			log.WithContext(ctx).Error(err)
+		}
+	}
+
+	return due, nil
+}
+
+// Run checks for analyses that need a warning every interval. Blocks until
+// the context is canceled.
+func (w *TimeLimitWarner) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := w.check(ctx); err != nil {
+				log.WithContext(ctx).Error(err)
+			}
+		}
+	}
+}
+
+// RunTimeLimitWarner starts sending time limit warnings. Blocks until the
+// context is canceled. The warnings are sent as notifications, so nothing is
+// done if notifications are disabled.
+func (i *Internal) RunTimeLimitWarner(ctx context.Context) {
+	if i.notifications == nil {
+		log.WithContext(ctx).Warn("notifications are disabled, so time limit warnings won't be sent")
+		return
+	}
+	NewTimeLimitWarner(i).Run(ctx)
+}
+
+// TimeLimitActionHandler carries out the action in a signed link from a time
+// limit warning. Extending adds the usual amount to the time limit, and
+// snoozing stops the remaining warnings for the current time limit. Links
+// stop working once the time limit changes.
+func (i *Internal) TimeLimitActionHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	action, err := i.TimeLimitWarnings.parseTimeLimitAction(c.Param("token"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusForbidden, err.Error())
+	}
+
+	user, userID, err := i.apps.GetUserByAnalysisID(ctx, action.AnalysisID)
+	if err != nil {
+		return err
+	}
+
+	var plannedEnd pq.NullTime
+	if err = i.db.QueryRowContext(ctx, getTimeLimitSQL, userID, action.AnalysisID).Scan(&plannedEnd); err != nil {
+		return errors.Wrapf(err, "error retrieving time limit for user %s on analysis %s", userID, action.AnalysisID)
+	}
+	if !plannedEnd.Valid || plannedEnd.Time.Unix() != action.PlannedEnd {
+		return echo.NewHTTPError(http.StatusConflict, "the analysis's time limit has changed since this link was sent")
+	}
+
+	switch action.Action {
+	case timeLimitExtendAction:
+		if err = i.checkDemoTimeLimitExtension(ctx, action.AnalysisID); err != nil {
+			return err
+		}
+		outputMap, err := i.updateTimeLimit(ctx, user, action.AnalysisID)
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, outputMap)
+
+	case timeLimitSnoozeAction:
+		externalID, err := i.getExternalIDByAnalysisID(ctx, action.AnalysisID)
+		if err != nil {
+			return err
+		}
+		for _, before := range i.TimeLimitWarnings.Before {
+			if _, err = i.claimNotification(ctx, externalID, timeLimitWarningKey(before, plannedEnd.Time)); err != nil {
+				return err
+			}
+		}
+		outputMap, err := i.getTimeLimit(ctx, userID, action.AnalysisID)
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, outputMap)
+
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("unknown time limit action %s", action.Action))
+	}
+}
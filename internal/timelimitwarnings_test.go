@@ -0,0 +1,153 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTimeLimitWarningsTestInternal(t *testing.T, agentURL string) (*Internal, sqlmock.Sqlmock) {
+	i, mock := newNotificationsTestInternal(t, agentURL)
+	i.TimeLimitWarnings = TimeLimitWarningsConfig{
+		Enabled:    true,
+		Before:     []time.Duration{30 * time.Minute, 4 * time.Hour},
+		ActionsURL: "https://de.example.org/api/time-limit-actions",
+		LinkSecret: "secret",
+	}
+	return i, mock
+}
+
+func TestTimeLimitWarningsConfigValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError((&TimeLimitWarningsConfig{}).Validate())
+	assert.NoError((&TimeLimitWarningsConfig{Enabled: true, Before: []time.Duration{time.Hour}}).Validate())
+	assert.Error((&TimeLimitWarningsConfig{Enabled: true}).Validate())
+	assert.Error((&TimeLimitWarningsConfig{Enabled: true, Before: []time.Duration{-time.Hour}}).Validate())
+	assert.Error((&TimeLimitWarningsConfig{
+		Enabled:    true,
+		Before:     []time.Duration{time.Hour},
+		ActionsURL: "https://de.example.org/api/time-limit-actions",
+	}).Validate())
+}
+
+func TestTimeLimitWarningDue(t *testing.T) {
+	assert := assert.New(t)
+
+	i, _ := newTimeLimitWarningsTestInternal(t, "http://notification-agent")
+	w := NewTimeLimitWarner(i)
+	assert.Equal(defaultTimeLimitWarningInterval, w.interval)
+
+	_, ok := w.warningDue(5 * time.Hour)
+	assert.False(ok)
+
+	before, ok := w.warningDue(3 * time.Hour)
+	assert.True(ok)
+	assert.Equal(4*time.Hour, before)
+
+	// Only the latest warning is sent when several are due.
+	before, ok = w.warningDue(10 * time.Minute)
+	assert.True(ok)
+	assert.Equal(30*time.Minute, before)
+}
+
+func TestTimeLimitWarnerCheck(t *testing.T) {
+	assert := assert.New(t)
+
+	received := []Notification{}
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		notification := Notification{}
+		assert.NoError(json.NewDecoder(r.Body).Decode(&notification))
+		received = append(received, notification)
+	}))
+	defer agent.Close()
+
+	i, mock := newTimeLimitWarningsTestInternal(t, agent.URL)
+	plannedEnd := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	key := timeLimitWarningKey(30*time.Minute, plannedEnd)
+
+	mock.ExpectQuery("FROM jobs j").WithArgs("Interactive", int64(4*60*60)).
+		WillReturnRows(sqlmock.NewRows([]string{"analysis_id", "external_id", "planned_end_date", "remaining_seconds"}).
+			AddRow("a1", "e1", plannedEnd, 20*60))
+	expectNotificationLookups(mock, sqlmock.NewRows([]string{"event", "enabled", "email"}))
+	mock.ExpectExec("INSERT INTO vice_sent_notifications").WithArgs("e1", key).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	due, err := NewTimeLimitWarner(i).check(context.Background())
+	assert.NoError(err)
+	assert.Equal(1, due)
+
+	if assert.Len(received, 1) {
+		notification := received[0]
+		assert.Equal(NotificationExpiring, notification.Payload.Event)
+		assert.Contains(notification.Message, "20m0s")
+
+		// The links carry signed actions for the current time limit.
+		for _, action := range []string{timeLimitExtendAction, timeLimitSnoozeAction} {
+			link, err := url.Parse(notification.Payload.Links[action])
+			if assert.NoError(err) {
+				parsed, err := i.TimeLimitWarnings.parseTimeLimitAction(path.Base(link.Path))
+				if assert.NoError(err) {
+					assert.Equal(&timeLimitAction{AnalysisID: "a1", Action: action, PlannedEnd: plannedEnd.Unix()}, parsed)
+				}
+			}
+		}
+	}
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestTimeLimitActionHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := newTimeLimitWarningsTestInternal(t, "http://notification-agent")
+	plannedEnd := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+
+	act := func(token string) error {
+		req := httptest.NewRequest(http.MethodGet, "/vice/time-limit-actions/"+token, nil)
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(req, rec)
+		c.SetParamNames("token")
+		c.SetParamValues(token)
+		return i.TimeLimitActionHandler(c)
+	}
+	sign := func(action string) string {
+		token, err := i.TimeLimitWarnings.signTimeLimitAction(&timeLimitAction{
+			AnalysisID: "a1",
+			Action:     action,
+			PlannedEnd: plannedEnd.Unix(),
+		})
+		assert.NoError(err)
+		return token
+	}
+	expectTimeLimit := func(timeLimit time.Time) {
+		mock.ExpectQuery("SELECT u.username").WithArgs("a1").
+			WillReturnRows(sqlmock.NewRows([]string{"username", "id"}).AddRow("ipcdev@example.org", "u1"))
+		mock.ExpectQuery("SELECT planned_end_date").WithArgs("u1", "a1").
+			WillReturnRows(sqlmock.NewRows([]string{"planned_end_date"}).AddRow(timeLimit))
+	}
+
+	// Links that weren't signed with the secret are rejected.
+	err := act(sign(timeLimitExtendAction) + "x")
+	if assert.Error(err) {
+		assert.Equal(http.StatusForbidden, err.(*echo.HTTPError).Code)
+	}
+
+	// So are links sent before the time limit was last changed.
+	expectTimeLimit(plannedEnd.Add(72 * time.Hour))
+	err = act(sign(timeLimitExtendAction))
+	if assert.Error(err) {
+		assert.Equal(http.StatusConflict, err.(*echo.HTTPError).Code)
+	}
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
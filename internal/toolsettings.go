@@ -0,0 +1,361 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/cyverse-de/model/v6"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	apiv1 "k8s.io/api/core/v1"
+	resourcev1 "k8s.io/apimachinery/pkg/api/resource"
+)
+
+// migProfileRegexp matches the names of NVIDIA MIG profiles, such as
+// mig-1g.5gb or mig-2g.20gb.
+var migProfileRegexp = regexp.MustCompile(`^mig-[0-9]+g\.[0-9]+gb$`)
+
+// ToolSettings contains the settings for a tool that only apply to VICE
+// analyses and aren't included in job submissions. They're managed by
+// administrators and stored in the vice_tool_settings table.
+type ToolSettings struct {
+	// MIGProfile is the NVIDIA Multi-Instance GPU profile to request instead
+	// of a full GPU, for example mig-2g.20gb.
+	MIGProfile string `json:"mig_profile,omitempty"`
+
+	// CreatePDB overrides whether a PodDisruptionBudget is created for the
+	// analysis. Stateless apps that tolerate restarts can turn it off so that
+	// they don't block node drains.
+	CreatePDB *bool `json:"create_pdb,omitempty"`
+
+	// PDBMaxUnavailable is the MaxUnavailable value for the analysis's
+	// PodDisruptionBudget. Defaults to 0.
+	PDBMaxUnavailable *int `json:"pdb_max_unavailable,omitempty"`
+
+	// EphemeralStorageRequest is the amount of ephemeral storage to request
+	// for the analysis container, for example 10Gi. Overrides the minimum disk
+	// space in the job.
+	EphemeralStorageRequest string `json:"ephemeral_storage_request,omitempty"`
+
+	// EphemeralStorageLimit is the most ephemeral storage the analysis
+	// container may use before the kubelet evicts the pod, for example 50Gi.
+	EphemeralStorageLimit string `json:"ephemeral_storage_limit,omitempty"`
+
+	// TerminationGracePeriodSeconds is how long the analysis pod has to shut
+	// down before it's killed. Tools that flush their outputs when they stop
+	// need enough time for the upload to finish.
+	TerminationGracePeriodSeconds *int64 `json:"termination_grace_period_seconds,omitempty"`
+
+	// FlushOutputsOnStop overrides whether the outputs are uploaded by a
+	// preStop hook when the analysis pod stops. Only applies when the CSI
+	// driver isn't used.
+	FlushOutputsOnStop *bool `json:"flush_outputs_on_stop,omitempty"`
+
+	// EgressProfile limits the networks the analysis pod may reach. One of
+	// none, datastore-only, allowlist, or unrestricted.
+	EgressProfile string `json:"egress_profile,omitempty"`
+
+	// EgressAllowlist contains the CIDRs and host names the analysis may
+	// reach when the egress profile is allowlist.
+	EgressAllowlist []string `json:"egress_allowlist,omitempty"`
+
+	// Routes send the requests for paths under the analysis's subdomain to
+	// other ports of the analysis container. See SubpathRoute.
+	Routes []SubpathRoute `json:"routes,omitempty"`
+
+	// Privileged allows the tool's containers to run as root. Analyses of
+	// tools configured with UID 0 are rejected unless it's set.
+	Privileged bool `json:"privileged,omitempty"`
+
+	// GID is the group the analysis's containers run as and the group that
+	// owns their volumes. Defaults to the tool's UID.
+	GID *int64 `json:"gid,omitempty"`
+
+	// SupplementalGroups are added to the analysis's containers, for example
+	// to read reference data on NFS volumes that's only readable by a group.
+	SupplementalGroups []int64 `json:"supplemental_groups,omitempty"`
+
+	// ReadinessProbe replaces the analysis container's default readiness
+	// probe, which requests / at the first port.
+	ReadinessProbe *ReadinessProbe `json:"readiness_probe,omitempty"`
+
+	// LivenessProbe restarts the analysis container if it stops responding.
+	// Analysis containers only have readiness probes if it isn't set.
+	LivenessProbe *LivenessProbe `json:"liveness_probe,omitempty"`
+
+	// SessionToken passes a random per-analysis token to apps that require
+	// one, such as the stock Jupyter images. See SessionToken.
+	SessionToken *SessionToken `json:"session_token,omitempty"`
+
+	// FrameAncestors lists the sites that may embed the tool's analyses, for
+	// example a course's LMS pages. Overrides the service-wide default.
+	FrameAncestors []string `json:"frame_ancestors,omitempty"`
+
+	// StartupTimeoutSeconds is how long the tool's analyses have to become
+	// ready before they're marked as failed, for apps that build indexes or
+	// load large datasets when they start. Overrides the service-wide
+	// default.
+	StartupTimeoutSeconds int64 `json:"startup_timeout_seconds,omitempty"`
+}
+
+// Validate returns an error if the settings are invalid.
+func (s *ToolSettings) Validate() error {
+	if s.MIGProfile != "" && !migProfileRegexp.MatchString(s.MIGProfile) {
+		return fmt.Errorf("invalid MIG profile %q", s.MIGProfile)
+	}
+	if s.PDBMaxUnavailable != nil && *s.PDBMaxUnavailable < 0 {
+		return fmt.Errorf("pdb_max_unavailable must not be negative")
+	}
+	if s.TerminationGracePeriodSeconds != nil && *s.TerminationGracePeriodSeconds < 0 {
+		return fmt.Errorf("termination_grace_period_seconds must not be negative")
+	}
+	if err := validateEgress(s.EgressProfile, s.EgressAllowlist); err != nil {
+		return err
+	}
+	if err := validateRoutes(s.Routes); err != nil {
+		return err
+	}
+	if s.ReadinessProbe != nil {
+		if err := s.ReadinessProbe.Validate(); err != nil {
+			return err
+		}
+	}
+	if s.LivenessProbe != nil {
+		if err := s.LivenessProbe.Validate(); err != nil {
+			return err
+		}
+	}
+	if s.SessionToken != nil {
+		if err := s.SessionToken.Validate(); err != nil {
+			return err
+		}
+	}
+	if err := validateFrameAncestors(s.FrameAncestors); err != nil {
+		return err
+	}
+	if s.StartupTimeoutSeconds < 0 {
+		return fmt.Errorf("startup_timeout_seconds must not be negative")
+	}
+	if s.GID != nil && *s.GID < 0 {
+		return fmt.Errorf("gid must not be negative")
+	}
+	if s.GID != nil && *s.GID == 0 && !s.Privileged {
+		return fmt.Errorf("gid 0 is only allowed for privileged tools")
+	}
+	for _, group := range s.SupplementalGroups {
+		if group < 0 {
+			return fmt.Errorf("supplemental groups must not be negative")
+		}
+		if group == 0 && !s.Privileged {
+			return fmt.Errorf("supplemental group 0 is only allowed for privileged tools")
+		}
+	}
+	var request, limit resourcev1.Quantity
+	var err error
+	if s.EphemeralStorageRequest != "" {
+		if request, err = resourcev1.ParseQuantity(s.EphemeralStorageRequest); err != nil {
+			return fmt.Errorf("invalid ephemeral storage request %q", s.EphemeralStorageRequest)
+		}
+	}
+	if s.EphemeralStorageLimit != "" {
+		if limit, err = resourcev1.ParseQuantity(s.EphemeralStorageLimit); err != nil {
+			return fmt.Errorf("invalid ephemeral storage limit %q", s.EphemeralStorageLimit)
+		}
+		if s.EphemeralStorageRequest != "" && limit.Cmp(request) < 0 {
+			return fmt.Errorf("the ephemeral storage limit must not be less than the request")
+		}
+	}
+	return nil
+}
+
+// runAsUser returns the UID the analysis's containers run as, which is the
+// one configured for the tool.
+func (s *ToolSettings) runAsUser(job *model.Job) int64 {
+	return int64(job.Steps[0].Component.Container.UID)
+}
+
+// runAsGroup returns the GID the analysis's containers run as.
+func (s *ToolSettings) runAsGroup(job *model.Job) int64 {
+	if s.GID != nil {
+		return *s.GID
+	}
+	return s.runAsUser(job)
+}
+
+// validateRunAs returns an error if the analysis would run as a user or group
+// it isn't allowed to. Only privileged tools may run as root.
+func validateRunAs(job *model.Job, settings *ToolSettings) error {
+	uid := settings.runAsUser(job)
+	if uid < 0 {
+		return common.ErrorResponse{
+			ErrorCode: "ERR_INVALID_UID",
+			Message:   fmt.Sprintf("the tool's UID %d is invalid", uid),
+		}
+	}
+	if settings.Privileged {
+		return nil
+	}
+	if uid == 0 || settings.runAsGroup(job) == 0 {
+		return common.ErrorResponse{
+			ErrorCode: "ERR_ROOT_NOT_ALLOWED",
+			Message:   "the tool is configured to run as root, which is only allowed for privileged tools",
+		}
+	}
+	return nil
+}
+
+// ephemeralStorageRequest returns the amount of ephemeral storage to request
+// for the analysis container.
+func (s *ToolSettings) ephemeralStorageRequest(job *model.Job) resourcev1.Quantity {
+	if s.EphemeralStorageRequest != "" {
+		value, err := resourcev1.ParseQuantity(s.EphemeralStorageRequest)
+		if err == nil {
+			return value
+		}
+		log.Warn(err)
+	}
+	return storageRequest(job)
+}
+
+// ephemeralStorageLimit returns the ephemeral storage limit for the analysis
+// container and true, or false if the container shouldn't have a limit. The
+// limit is never less than the request.
+func (s *ToolSettings) ephemeralStorageLimit(job *model.Job) (resourcev1.Quantity, bool) {
+	if s.EphemeralStorageLimit == "" {
+		return resourcev1.Quantity{}, false
+	}
+
+	value, err := resourcev1.ParseQuantity(s.EphemeralStorageLimit)
+	if err != nil {
+		log.Warn(err)
+		return resourcev1.Quantity{}, false
+	}
+
+	if request := s.ephemeralStorageRequest(job); value.Cmp(request) < 0 {
+		return request, true
+	}
+
+	return value, true
+}
+
+// gpuResourceName returns the name of the extended resource to request for
+// the analysis container's GPU.
+func (s *ToolSettings) gpuResourceName() apiv1.ResourceName {
+	if s.MIGProfile != "" {
+		return apiv1.ResourceName(fmt.Sprintf("%s/%s", nvidiaResourcePrefix, s.MIGProfile))
+	}
+	return apiv1.ResourceName(fmt.Sprintf("%s/gpu", nvidiaResourcePrefix))
+}
+
+// needsGPU returns true if the analysis needs to be scheduled on a GPU node.
+func (s *ToolSettings) needsGPU(job *model.Job) bool {
+	return gpuEnabled(job) || s.MIGProfile != ""
+}
+
+const getToolSettingsSQL = `
+	SELECT s.settings
+	  FROM vice_tool_settings s
+	  JOIN container_settings c ON c.tool_id = s.tool_id
+	 WHERE c.id = $1
+`
+
+// getToolSettings returns the settings for the tool used by the job. Returns
+// the default settings if the tool doesn't have any.
+func (i *Internal) getToolSettings(ctx context.Context, job *model.Job) (*ToolSettings, error) {
+	settings := &ToolSettings{}
+
+	containerID := job.Steps[0].Component.Container.ID
+	if containerID == "" {
+		return settings, nil
+	}
+
+	var raw []byte
+	err := i.db.QueryRowContext(ctx, getToolSettingsSQL, containerID).Scan(&raw)
+	if err == sql.ErrNoRows {
+		return settings, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "error looking up the tool settings for container %s", containerID)
+	}
+
+	if err = json.Unmarshal(raw, settings); err != nil {
+		return nil, errors.Wrapf(err, "error parsing the tool settings for container %s", containerID)
+	}
+
+	return settings, nil
+}
+
+const getToolSettingsByToolIDSQL = `
+	SELECT settings
+	  FROM vice_tool_settings
+	 WHERE tool_id = $1
+`
+
+const upsertToolSettingsSQL = `
+	INSERT INTO vice_tool_settings (tool_id, settings)
+	VALUES ($1, $2)
+	ON CONFLICT (tool_id) DO UPDATE
+	   SET settings = EXCLUDED.settings
+`
+
+// AdminGetToolSettingsHandler returns the VICE settings for a tool.
+func (i *Internal) AdminGetToolSettingsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	toolID := c.Param("tool-id")
+	if toolID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "tool-id parameter is empty")
+	}
+
+	settings := &ToolSettings{}
+
+	var raw []byte
+	err := i.db.QueryRowContext(ctx, getToolSettingsByToolIDSQL, toolID).Scan(&raw)
+	switch {
+	case err == sql.ErrNoRows:
+		return c.JSON(http.StatusOK, settings)
+	case err != nil:
+		return err
+	}
+
+	if err = json.Unmarshal(raw, settings); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, settings)
+}
+
+// AdminUpdateToolSettingsHandler replaces the VICE settings for a tool.
+func (i *Internal) AdminUpdateToolSettingsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	toolID := c.Param("tool-id")
+	if toolID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "tool-id parameter is empty")
+	}
+
+	settings := &ToolSettings{}
+	if err := c.Bind(settings); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	if err := settings.Validate(); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	raw, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+
+	if _, err = i.db.ExecContext(ctx, upsertToolSettingsSQL, toolID, raw); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, settings)
+}
@@ -0,0 +1,188 @@
+package internal
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/cyverse-de/model/v6"
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	resourcev1 "k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestToolSettingsValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError((&ToolSettings{}).Validate())
+	assert.NoError((&ToolSettings{MIGProfile: "mig-2g.20gb"}).Validate())
+	assert.Error((&ToolSettings{MIGProfile: "2g.20gb"}).Validate())
+
+	negative := -1
+	assert.Error((&ToolSettings{PDBMaxUnavailable: &negative}).Validate())
+
+	negativeGrace := int64(-1)
+	assert.Error((&ToolSettings{TerminationGracePeriodSeconds: &negativeGrace}).Validate())
+
+	assert.Error((&ToolSettings{MIGProfile: "mig-2g.20gb; rm -rf /"}).Validate())
+
+	gid, rootGID, negativeGID := int64(2000), int64(0), int64(-1)
+	assert.NoError((&ToolSettings{GID: &gid, SupplementalGroups: []int64{3000}}).Validate())
+	assert.Error((&ToolSettings{GID: &negativeGID}).Validate())
+	assert.Error((&ToolSettings{GID: &rootGID}).Validate())
+	assert.NoError((&ToolSettings{GID: &rootGID, Privileged: true}).Validate())
+	assert.Error((&ToolSettings{SupplementalGroups: []int64{0}}).Validate())
+	assert.Error((&ToolSettings{SupplementalGroups: []int64{-5}}).Validate())
+}
+
+func uidJob(uid int) *model.Job {
+	job := &model.Job{Steps: []model.Step{{}}}
+	job.Steps[0].Component.Container.UID = uid
+	return job
+}
+
+func TestValidateRunAs(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(validateRunAs(uidJob(1000), &ToolSettings{}))
+	assert.NoError(validateRunAs(uidJob(0), &ToolSettings{Privileged: true}))
+
+	err := validateRunAs(uidJob(0), &ToolSettings{})
+	if assert.Error(err) {
+		assert.Equal("ERR_ROOT_NOT_ALLOWED", err.(common.ErrorResponse).ErrorCode)
+	}
+
+	// A GID other than 0 doesn't let an unprivileged tool run as root.
+	gid := int64(2000)
+	assert.Error(validateRunAs(uidJob(0), &ToolSettings{GID: &gid}))
+	assert.Error(validateRunAs(uidJob(-1), &ToolSettings{Privileged: true}))
+}
+
+func TestRunAsGroup(t *testing.T) {
+	assert := assert.New(t)
+
+	i := &Internal{}
+	job := uidJob(1000)
+	gid := int64(2000)
+	settings := &ToolSettings{GID: &gid, SupplementalGroups: []int64{3000}}
+
+	assert.Equal(int64(1000), (&ToolSettings{}).runAsGroup(job))
+
+	container := i.workingDirPrepContainer(job, settings)
+	assert.Equal(int64(1000), *container.SecurityContext.RunAsUser)
+	assert.Equal(int64(2000), *container.SecurityContext.RunAsGroup)
+}
+
+func TestGPUResourceName(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(apiv1.ResourceName("nvidia.com/gpu"), (&ToolSettings{}).gpuResourceName())
+	assert.Equal(apiv1.ResourceName("nvidia.com/mig-1g.5gb"), (&ToolSettings{MIGProfile: "mig-1g.5gb"}).gpuResourceName())
+}
+
+func gpuNode(name string, resources map[string]string) *apiv1.Node {
+	allocatable := apiv1.ResourceList{}
+	for k, v := range resources {
+		allocatable[apiv1.ResourceName(k)] = resourcev1.MustParse(v)
+	}
+	return &apiv1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: map[string]string{gpuAffinityKey: gpuAffinityValue},
+		},
+		Status: apiv1.NodeStatus{
+			Allocatable: allocatable,
+			Conditions: []apiv1.NodeCondition{
+				{Type: apiv1.NodeReady, Status: apiv1.ConditionTrue},
+			},
+		},
+	}
+}
+
+func TestValidateGPURequest(t *testing.T) {
+	assert := assert.New(t)
+
+	clientset := fake.NewSimpleClientset(
+		gpuNode("a", map[string]string{"nvidia.com/mig-1g.5gb": "7", "cpu": "8"}),
+		gpuNode("b", map[string]string{"nvidia.com/mig-1g.5gb": "7", "nvidia.com/gpu": "1"}),
+	)
+	i := &Internal{clientset: clientset}
+	job := &model.Job{Steps: []model.Step{{}}}
+
+	caps, err := i.clusterCapabilities(context.Background())
+	assert.NoError(err)
+	assert.Equal(map[string]int64{"nvidia.com/mig-1g.5gb": 14, "nvidia.com/gpu": 1}, caps.GPUResources)
+
+	assert.NoError(i.validateGPURequest(context.Background(), job, &ToolSettings{}))
+	assert.NoError(i.validateGPURequest(context.Background(), job, &ToolSettings{MIGProfile: "mig-1g.5gb"}))
+
+	err = i.validateGPURequest(context.Background(), job, &ToolSettings{MIGProfile: "mig-3g.40gb"})
+	if assert.Error(err) {
+		errResp, ok := err.(common.ErrorResponse)
+		assert.True(ok)
+		assert.Equal("ERR_GPU_PROFILE_UNAVAILABLE", errResp.ErrorCode)
+	}
+}
+
+func gpuPod(name, node string, phase apiv1.PodPhase, gpus string) *apiv1.Pod {
+	return &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "other"},
+		Spec: apiv1.PodSpec{
+			NodeName: node,
+			Containers: []apiv1.Container{
+				{
+					Name: "main",
+					Resources: apiv1.ResourceRequirements{
+						Limits: apiv1.ResourceList{"nvidia.com/gpu": resourcev1.MustParse(gpus)},
+					},
+				},
+			},
+		},
+		Status: apiv1.PodStatus{Phase: phase},
+	}
+}
+
+func TestValidateGPURequestCapacity(t *testing.T) {
+	assert := assert.New(t)
+
+	cordoned := gpuNode("c", map[string]string{"nvidia.com/gpu": "4"})
+	cordoned.Spec.Unschedulable = true
+
+	clientset := fake.NewSimpleClientset(
+		gpuNode("a", map[string]string{"nvidia.com/gpu": "2"}),
+		gpuNode("b", map[string]string{"nvidia.com/gpu": "1"}),
+		cordoned,
+		gpuPod("p1", "a", apiv1.PodRunning, "2"),
+		gpuPod("p2", "b", apiv1.PodPending, "1"),
+		gpuPod("p3", "b", apiv1.PodSucceeded, "1"),
+	)
+	i := &Internal{Init: Init{CheckGPUCapacity: true}, clientset: clientset}
+	job := &model.Job{Steps: []model.Step{{}}}
+	settings := &ToolSettings{}
+	job.Steps[0].Component.Container.Devices = []model.Device{{HostPath: "/dev/nvidia0"}}
+
+	capacity, err := i.gpuCapacity(context.Background(), "nvidia.com/gpu")
+	assert.NoError(err)
+	assert.Equal(int64(3), capacity.Allocatable)
+	assert.Equal(int64(3), capacity.Requested)
+
+	err = i.validateGPURequest(context.Background(), job, settings)
+	if assert.Error(err) {
+		errResp, ok := err.(common.ErrorResponse)
+		assert.True(ok)
+		assert.Equal("ERR_GPU_CAPACITY_UNAVAILABLE", errResp.ErrorCode)
+	}
+
+	// Analyses wait in the queue when Kueue is configured.
+	i.KueueQueueName = "vice"
+	assert.NoError(i.validateGPURequest(context.Background(), job, settings))
+	i.KueueQueueName = ""
+
+	// Jobs that don't need a GPU aren't checked.
+	assert.NoError(i.validateGPURequest(context.Background(), &model.Job{Steps: []model.Step{{}}}, settings))
+
+	assert.NoError(clientset.CoreV1().Pods("other").Delete(context.Background(), "p2", metav1.DeleteOptions{}))
+	assert.NoError(i.validateGPURequest(context.Background(), job, settings))
+}
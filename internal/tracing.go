@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"context"
+
+	"github.com/cyverse-de/model/v6"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The baggage keys used to identify the analysis a request is working on. The
+// baggage is propagated to every service app-exposer calls over HTTP, and
+// each span app-exposer starts gets a matching attribute.
+const (
+	externalIDBaggageKey = "vice.external-id"
+	userBaggageKey       = "vice.user"
+	appIDBaggageKey      = "vice.app-id"
+)
+
+// analysisBaggageKeys lists the baggage keys that are copied to span
+// attributes.
+var analysisBaggageKeys = []string{externalIDBaggageKey, userBaggageKey, appIDBaggageKey}
+
+// LogBaggageFields maps the analysis baggage keys to the log fields they're
+// copied to by common.ContextHook.
+var LogBaggageFields = map[string]string{
+	externalIDBaggageKey: "external-id",
+	userBaggageKey:       "user",
+	appIDBaggageKey:      "app-id",
+}
+
+// withBaggage adds the key and value to the context's baggage. Empty values
+// and values that can't be represented as baggage are skipped.
+func withBaggage(ctx context.Context, key, value string) context.Context {
+	if value == "" {
+		return ctx
+	}
+
+	member, err := baggage.NewMemberRaw(key, value)
+	if err != nil {
+		log.WithContext(ctx).Debugf("unable to add %s to the trace baggage: %s", key, err)
+		return ctx
+	}
+
+	bag, err := baggage.FromContext(ctx).SetMember(member)
+	if err != nil {
+		log.WithContext(ctx).Debugf("unable to add %s to the trace baggage: %s", key, err)
+		return ctx
+	}
+
+	return baggage.ContextWithBaggage(ctx, bag)
+}
+
+// withJobBaggage adds the identifiers of the analysis described by the job to
+// the context's baggage.
+func withJobBaggage(ctx context.Context, job *model.Job) context.Context {
+	ctx = withBaggage(ctx, externalIDBaggageKey, job.InvocationID)
+	ctx = withBaggage(ctx, userBaggageKey, job.Submitter)
+	return withBaggage(ctx, appIDBaggageKey, job.AppID)
+}
+
+// withExternalIDBaggage adds the external ID of an analysis to the context's
+// baggage, for requests that don't have the whole job.
+func withExternalIDBaggage(ctx context.Context, externalID string) context.Context {
+	return withBaggage(ctx, externalIDBaggageKey, externalID)
+}
+
+// baggageAttributes returns the analysis baggage in the context as span
+// attributes.
+func baggageAttributes(ctx context.Context) []attribute.KeyValue {
+	bag := baggage.FromContext(ctx)
+
+	var attrs []attribute.KeyValue
+	for _, key := range analysisBaggageKeys {
+		if value := bag.Member(key).Value(); value != "" {
+			attrs = append(attrs, attribute.String(key, value))
+		}
+	}
+
+	return attrs
+}
+
+// startSpan starts a span that's tagged with the analysis baggage in the
+// context along with any additional attributes.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	attrs = append(baggageAttributes(ctx), attrs...)
+	return otel.Tracer(otelName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// startResourceSpan starts a span for work on a single kind of k8s resource.
+func startResourceSpan(ctx context.Context, name, kind string) (context.Context, trace.Span) {
+	return startSpan(ctx, name, attribute.String("k8s.resource", kind))
+}
+
+// endSpan records the error, if there is one, and ends the span.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,50 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/cyverse-de/model/v6"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+func TestWithJobBaggage(t *testing.T) {
+	assert := assert.New(t)
+
+	job := &model.Job{
+		InvocationID: "07b04ce2-7757-4b21-9e15-0b4c2f44be26",
+		Submitter:    "ipcdev@iplantcollaborative.org",
+	}
+
+	ctx := withJobBaggage(context.Background(), job)
+
+	bag := baggage.FromContext(ctx)
+	assert.Equal(job.InvocationID, bag.Member(externalIDBaggageKey).Value())
+	assert.Equal(job.Submitter, bag.Member(userBaggageKey).Value())
+	assert.Equal("", bag.Member(appIDBaggageKey).Value(), "empty values should be skipped")
+
+	attrs := baggageAttributes(ctx)
+	assert.Contains(attrs, attribute.String(externalIDBaggageKey, job.InvocationID))
+	assert.Contains(attrs, attribute.String(userBaggageKey, job.Submitter))
+	assert.Len(attrs, 2)
+}
+
+func TestBaggagePropagation(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx := withExternalIDBaggage(context.Background(), "ext-1")
+
+	// The baggage must survive a round trip through the headers sent to other
+	// services.
+	headers := http.Header{}
+	propagator := propagation.Baggage{}
+	propagator.Inject(ctx, propagation.HeaderCarrier(headers))
+	assert.NotEmpty(headers.Get("baggage"))
+
+	extracted := propagator.Extract(context.Background(), propagation.HeaderCarrier(headers))
+	assert.Equal("ext-1", baggage.FromContext(extracted).Member(externalIDBaggageKey).Value())
+}
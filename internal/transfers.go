@@ -13,6 +13,7 @@ import (
 
 	"github.com/cyverse-de/model/v6"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/trace"
 
 	"github.com/pkg/errors"
@@ -93,7 +94,7 @@ func (i *Internal) fileTransfersVolumeMounts(job *model.Job) []apiv1.VolumeMount
 		})
 	}
 
-	return retval
+	return append(retval, i.caCertsVolumeMounts()...)
 }
 
 func requestTransfer(ctx context.Context, svc apiv1.Service, reqpath string) (*transferResponse, error) {
@@ -202,23 +203,43 @@ func isFinished(status string) bool {
 // analysis. We only need the ID of the job, nothing is required in the
 // body of the request.
 func (i *Internal) doFileTransfer(ctx context.Context, externalID, reqpath, kind string, async bool) error {
-	ctx, span := otel.Tracer(otelName).Start(ctx, "doFileTransfer")
+	ctx = withExternalIDBaggage(ctx, externalID)
+	ctx, span := startSpan(ctx, "doFileTransfer", attribute.String("vice.transfer-kind", kind))
 	defer span.End()
 
 	if i.UseCSIDriver {
 		// if we use CSI Driver, file transfer is not required.
 		msg := fmt.Sprintf("%s succeeded for job %s", kind, externalID)
 
-		log.Info(msg)
+		log.WithContext(ctx).Info(msg)
 
 		if successerr := i.statusPublisher.Running(ctx, externalID, msg); successerr != nil {
-			log.Error(successerr)
+			log.WithContext(ctx).Error(successerr)
 		}
 
 		return nil
 	}
 
-	log.Infof("starting %s transfers for job %s", kind, externalID)
+	// Demo analyses never upload their outputs.
+	if kind == uploadKind {
+		demo, err := i.isDemoAnalysis(ctx, externalID)
+		if err != nil {
+			return err
+		}
+		if demo {
+			log.WithContext(ctx).Infof("skipping %s transfers for demo analysis %s", kind, externalID)
+			return nil
+		}
+	}
+
+	// Save the provenance manifest along with the outputs.
+	if kind == uploadKind {
+		if err := i.updateProvenance(ctx, externalID, true, false); err != nil {
+			log.WithContext(ctx).Error(err)
+		}
+	}
+
+	log.WithContext(ctx).Infof("starting %s transfers for job %s", kind, externalID)
 
 	// Make sure that the list of services only comes from the VICE namespace.
 	svcclient := i.clientset.CoreV1().Services(i.ViceNamespace)
@@ -262,11 +283,11 @@ func (i *Internal) doFileTransfer(ctx context.Context, externalID, reqpath, kind
 				defer wg.Done()
 			}
 
-			log.Infof("%s transfer for %s", kind, externalID)
+			log.WithContext(ctx).Infof("%s transfer for %s", kind, externalID)
 
 			transferObj, xfererr := requestTransfer(ctx, svc, reqpath)
 			if xfererr != nil {
-				log.Error(xfererr)
+				log.WithContext(ctx).Error(xfererr)
 				err = xfererr
 				return
 			}
@@ -288,38 +309,40 @@ func (i *Internal) doFileTransfer(ctx context.Context, externalID, reqpath, kind
 
 					err = errors.New(msg)
 
-					log.Error(err)
+					log.WithContext(ctx).Error(err)
 
 					if failerr := i.statusPublisher.Running(ctx, externalID, msg); failerr != nil {
-						log.Error(failerr)
+						log.WithContext(ctx).Error(failerr)
 					}
 
 					return
 				case CompletedStatus:
 					msg := fmt.Sprintf("%s succeeded for job %s", kind, externalID)
 
-					log.Info(msg)
+					log.WithContext(ctx).Info(msg)
 
 					if successerr := i.statusPublisher.Running(ctx, externalID, msg); successerr != nil {
-						log.Error(successerr)
+						log.WithContext(ctx).Error(successerr)
 					}
 
+					i.recordTransferSize(ctx, externalID, kind)
+
 					return
 				case RequestedStatus:
 					msg := fmt.Sprintf("%s requested for job %s", kind, externalID)
 
 					if requestederr := i.statusPublisher.Running(ctx, externalID, msg); requestederr != nil {
-						log.Error(err)
+						log.WithContext(ctx).Error(err)
 					}
 
 				case UploadingStatus:
 					if !sentUploadStatus {
 						msg := fmt.Sprintf("%s is in progress for job %s", kind, externalID)
 
-						log.Info(msg)
+						log.WithContext(ctx).Info(msg)
 
 						if uploadingerr := i.statusPublisher.Running(ctx, externalID, msg); uploadingerr != nil {
-							log.Error(err)
+							log.WithContext(ctx).Error(err)
 						}
 
 						sentUploadStatus = true
@@ -328,10 +351,10 @@ func (i *Internal) doFileTransfer(ctx context.Context, externalID, reqpath, kind
 					if !sentDownloadStatus {
 						msg := fmt.Sprintf("%s is in progress for job %s", kind, externalID)
 
-						log.Info(msg)
+						log.WithContext(ctx).Info(msg)
 
 						if downloadingerr := i.statusPublisher.Running(ctx, externalID, msg); downloadingerr != nil {
-							log.Error(err)
+							log.WithContext(ctx).Error(err)
 						}
 
 						sentDownloadStatus = true
@@ -339,7 +362,7 @@ func (i *Internal) doFileTransfer(ctx context.Context, externalID, reqpath, kind
 				default:
 					err = fmt.Errorf("unknown status from %s: %s", svc.Spec.ClusterIP, transferObj.Status)
 
-					log.Error(err)
+					log.WithContext(ctx).Error(err)
 
 					return // return and not break because we want to fail out
 				}
@@ -348,13 +371,13 @@ func (i *Internal) doFileTransfer(ctx context.Context, externalID, reqpath, kind
 
 				transferObj, xfererr = getTransferDetails(ctx, svc, fullreqpath)
 				if xfererr != nil {
-					log.Error(errors.Wrapf(xfererr, "error getting transfer details for transferObj %s", fullreqpath))
+					log.WithContext(ctx).Error(errors.Wrapf(xfererr, "error getting transfer details for transferObj %s", fullreqpath))
 					err = xfererr
 					return
 				}
 
 				if transferObj == nil {
-					log.Error("transferObj is nil")
+					log.WithContext(ctx).Error("transferObj is nil")
 					return
 				}
 
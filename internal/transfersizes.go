@@ -0,0 +1,334 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cyverse-de/app-exposer/metrics"
+	"github.com/cyverse-de/model/v6"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// transferSizeTimeout limits how long measuring the files that were
+// transferred may take.
+const transferSizeTimeout = 2 * time.Minute
+
+var transferBytes = metrics.NewCounterVec(
+	"app_exposer_transfer_bytes_total",
+	"The number of bytes downloaded to and uploaded from VICE analyses, by kind.",
+	"kind",
+)
+
+// TransferAccountingConfig contains the settings for the accounting events
+// published when an analysis's files are transferred.
+type TransferAccountingConfig struct {
+	Enabled bool
+
+	// Subject is the NATS subject the events are published to.
+	Subject string
+}
+
+// Validate returns an error if the configuration can't be used.
+func (c *TransferAccountingConfig) Validate() error {
+	if c.Enabled && c.Subject == "" {
+		return errors.New("the transfer accounting subject must be set")
+	}
+	return nil
+}
+
+// TransferSize is the amount of data moved by a file transfer.
+type TransferSize struct {
+	Bytes int64 `json:"bytes"`
+	Files int   `json:"files"`
+}
+
+// TransferAccountingEvent is published each time an analysis's files are
+// transferred, so that storage transfers can be billed.
+type TransferAccountingEvent struct {
+	ExternalID string    `json:"external_id"`
+	AnalysisID string    `json:"analysis_id"`
+	Username   string    `json:"username"`
+	Kind       string    `json:"kind"`
+	Bytes      int64     `json:"bytes"`
+	Files      int       `json:"files"`
+	RecordedAt time.Time `json:"recorded_at"`
+}
+
+// TransferTotals is the amount of data transferred for an analysis.
+type TransferTotals struct {
+	BytesDownloaded int64 `json:"bytes_downloaded"`
+	BytesUploaded   int64 `json:"bytes_uploaded"`
+	Downloads       int   `json:"downloads"`
+	Uploads         int   `json:"uploads"`
+}
+
+// fileSizesCommand prints the size and path of each file under the paths in
+// the directory, one file per line. The directory and the paths are passed
+// as positional parameters so that they aren't interpreted by the shell.
+func fileSizesCommand(dir string, paths []string) []string {
+	command := []string{
+		"sh", "-c",
+		`cd -- "$1" || exit 1; shift; for f; do if [ -e "$f" ]; then find "./$f" -type f -exec stat -c '%s|%n' {} +; fi; done; exit 0`,
+		"sh", dir,
+	}
+	return append(command, paths...)
+}
+
+// excludedFromUpload returns true if the file, relative to the working
+// directory, matches one of the paths excluded from uploads.
+func excludedFromUpload(file string, excludes []string) bool {
+	for _, exclude := range excludes {
+		if file == exclude || strings.HasPrefix(file, exclude+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// parseFileSizes adds up the sizes printed by fileSizesCommand, skipping the
+// excluded files.
+func parseFileSizes(output string, excludes []string) *TransferSize {
+	size := &TransferSize{}
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.SplitN(line, "|", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		bytes, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		if excludedFromUpload(path.Clean(fields[1]), excludes) {
+			continue
+		}
+		size.Bytes += bytes
+		size.Files++
+	}
+	return size
+}
+
+// configMapLines returns the non-empty lines of a file in one of the
+// analysis's ConfigMaps.
+func (i *Internal) configMapLines(ctx context.Context, name, key string) ([]string, error) {
+	cm, err := i.clientset.CoreV1().ConfigMaps(i.ViceNamespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	lines := []string{}
+	for _, line := range strings.Split(cm.Data[key], "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+// transferredPaths returns the paths in the working directory that were
+// moved by a transfer of the kind, along with the paths to leave out. Inputs
+// are downloaded to the working directory under their own names, and
+// everything that isn't excluded is uploaded.
+func (i *Internal) transferredPaths(ctx context.Context, externalID, kind string) ([]string, []string, error) {
+	job := &model.Job{InvocationID: externalID}
+
+	if kind == downloadKind {
+		lines, err := i.configMapLines(ctx, inputPathListConfigMapName(job), inputPathListFileName)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// The first line identifies the file format.
+		paths := []string{}
+		for idx, line := range lines {
+			if idx > 0 {
+				paths = append(paths, path.Base(strings.TrimSuffix(line, "/")))
+			}
+		}
+		return paths, nil, nil
+	}
+
+	excludes, err := i.configMapLines(ctx, excludesConfigMapName(job), excludesFileName)
+	if err != nil {
+		return nil, nil, err
+	}
+	for idx := range excludes {
+		excludes[idx] = path.Clean(excludes[idx])
+	}
+	return []string{"."}, excludes, nil
+}
+
+// measureTransfer returns the amount of data moved by a transfer of the kind
+// that just finished, measured from the files in the working directory.
+func (i *Internal) measureTransfer(ctx context.Context, externalID, kind string) (*TransferSize, error) {
+	paths, excludes, err := i.transferredPaths(ctx, externalID, kind)
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return &TransferSize{}, nil
+	}
+
+	pod, err := i.runningAnalysisPod(ctx, externalID)
+	if err != nil {
+		return nil, err
+	}
+
+	container, root, err := workingDirLocation(pod)
+	if err != nil {
+		return nil, err
+	}
+
+	execCtx, cancel := context.WithTimeout(ctx, transferSizeTimeout)
+	defer cancel()
+
+	output, err := i.podExec(execCtx, pod.Namespace, pod.Name, container, fileSizesCommand(root, paths))
+	if err != nil {
+		return nil, err
+	}
+
+	return parseFileSizes(output, excludes), nil
+}
+
+const insertTransferSizeSQL = `
+	INSERT INTO vice_transfer_sizes (external_id, kind, bytes, files)
+	VALUES ($1, $2, $3, $4)
+`
+
+// publishTransferEvent publishes the accounting event for a transfer.
+func (i *Internal) publishTransferEvent(ctx context.Context, externalID, kind string, size *TransferSize) error {
+	if !i.TransferAccounting.Enabled || i.NATSEncodedConn == nil {
+		return nil
+	}
+
+	event := &TransferAccountingEvent{
+		ExternalID: externalID,
+		Kind:       kind,
+		Bytes:      size.Bytes,
+		Files:      size.Files,
+		RecordedAt: time.Now(),
+	}
+
+	analysisID, err := i.apps.GetAnalysisIDByExternalID(ctx, externalID)
+	if err != nil {
+		return err
+	}
+	event.AnalysisID = analysisID
+
+	username, _, err := i.apps.GetUserByAnalysisID(ctx, analysisID)
+	if err != nil {
+		return err
+	}
+	event.Username = strings.TrimSuffix(username, i.UserSuffix)
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	err = i.NATSEncodedConn.Conn.Publish(i.TransferAccounting.Subject, body)
+	RecordNATSPublishError(natsTransferAccounting, err)
+	return err
+}
+
+// recordTransferSize measures and records the amount of data moved by a
+// transfer of the kind that just completed, then publishes the accounting
+// event for it. Failures are logged, since the transfer itself succeeded.
+// Nothing is transferred when the CSI driver is used.
+func (i *Internal) recordTransferSize(ctx context.Context, externalID, kind string) {
+	if i.UseCSIDriver {
+		return
+	}
+
+	size, err := i.measureTransfer(ctx, externalID, kind)
+	if err != nil {
+		log.WithContext(ctx).Errorf("unable to measure the %s for %s: %s", kind, externalID, err)
+		return
+	}
+
+	metrics.Add(transferBytes, float64(size.Bytes), kind)
+	log.WithContext(ctx).Infof("%s for %s moved %d bytes in %d files", kind, externalID, size.Bytes, size.Files)
+
+	if _, err = i.db.ExecContext(ctx, insertTransferSizeSQL, externalID, kind, size.Bytes, size.Files); err != nil {
+		log.WithContext(ctx).Error(errors.Wrapf(err, "error recording the %s size for %s", kind, externalID))
+	}
+
+	if err = i.publishTransferEvent(ctx, externalID, kind, size); err != nil {
+		log.WithContext(ctx).Error(errors.Wrapf(err, "error publishing the %s accounting event for %s", kind, externalID))
+	}
+}
+
+const getTransferTotalsSQL = `
+	SELECT kind, coalesce(sum(bytes), 0) AS bytes, count(*) AS transfers
+	  FROM vice_transfer_sizes
+	 WHERE external_id = $1
+	 GROUP BY kind
+`
+
+// getTransferTotals returns the amount of data transferred for the analysis.
+func (i *Internal) getTransferTotals(ctx context.Context, externalID string) (*TransferTotals, error) {
+	rows, err := i.db.QueryxContext(ctx, getTransferTotalsSQL, externalID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error looking up the transfer sizes for %s", externalID)
+	}
+	defer rows.Close()
+
+	totals := &TransferTotals{}
+	for rows.Next() {
+		var (
+			kind      string
+			bytes     int64
+			transfers int
+		)
+		if err = rows.Scan(&kind, &bytes, &transfers); err != nil {
+			return nil, err
+		}
+		switch kind {
+		case downloadKind:
+			totals.BytesDownloaded, totals.Downloads = bytes, transfers
+		case uploadKind:
+			totals.BytesUploaded, totals.Uploads = bytes, transfers
+		}
+	}
+	return totals, rows.Err()
+}
+
+// TransfersPerDay is the amount of data transferred for VICE analyses during
+// a day.
+type TransfersPerDay struct {
+	Day             time.Time `json:"day" db:"day"`
+	BytesDownloaded int64     `json:"bytes_downloaded" db:"bytes_downloaded"`
+	BytesUploaded   int64     `json:"bytes_uploaded" db:"bytes_uploaded"`
+}
+
+const transfersPerDaySQL = `
+	SELECT date_trunc('day', recorded_at) AS day,
+	       coalesce(sum(bytes) FILTER (WHERE kind = $2), 0) AS bytes_downloaded,
+	       coalesce(sum(bytes) FILTER (WHERE kind = $3), 0) AS bytes_uploaded
+	  FROM vice_transfer_sizes
+	 WHERE recorded_at >= $1
+	 GROUP BY day
+	 ORDER BY day
+`
+
+// AdminTransfersPerDayHandler returns the amount of data downloaded to and
+// uploaded from VICE analyses during each day. The optional since query
+// parameter is a duration, such as 168h, and defaults to 30 days.
+func (i *Internal) AdminTransfersPerDayHandler(c echo.Context) error {
+	since, err := durationParam(c, "since", 30*24*time.Hour)
+	if err != nil {
+		return err
+	}
+
+	transfers := []TransfersPerDay{}
+	if err = i.db.SelectContext(c.Request().Context(), &transfers, transfersPerDaySQL, time.Now().Add(-since), downloadKind, uploadKind); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, transfers)
+}
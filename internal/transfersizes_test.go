@@ -0,0 +1,88 @@
+package internal
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestParseFileSizes(t *testing.T) {
+	assert := assert.New(t)
+
+	output := "100|././results/a.txt\n" +
+		"200|././logs/stdout\n" +
+		"300|././samples.csv\n" +
+		"not a size|./b\n" +
+		"400|././results-2/b.txt\n"
+
+	assert.Equal(&TransferSize{Bytes: 1000, Files: 4}, parseFileSizes(output, nil))
+	assert.Equal(&TransferSize{Bytes: 500, Files: 2}, parseFileSizes(output, []string{"logs", "samples.csv"}))
+	assert.True(excludedFromUpload("logs/stdout", []string{"logs"}))
+	assert.False(excludedFromUpload("logs-2/stdout", []string{"logs"}))
+}
+
+func TestRecordTransferSize(t *testing.T) {
+	assert := assert.New(t)
+
+	mockdb, mock, err := sqlmock.New()
+	assert.NoError(err)
+	defer mockdb.Close()
+
+	labels := map[string]string{"external-id": "e1"}
+	pod := &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "e1-pod", Namespace: "vice-apps", Labels: labels},
+		Spec: apiv1.PodSpec{
+			Containers: []apiv1.Container{
+				{
+					Name:         fileTransfersContainerName,
+					VolumeMounts: []apiv1.VolumeMount{{Name: fileTransfersVolumeName, MountPath: fileTransfersInputsMountPath}},
+				},
+			},
+		},
+		Status: apiv1.PodStatus{Phase: apiv1.PodRunning},
+	}
+	inputs := &apiv1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "input-path-list-e1", Namespace: "vice-apps", Labels: labels},
+		Data: map[string]string{
+			inputPathListFileName: "# application/vnd.de.multi-input-path-list+csv; version=1\n" +
+				"/iplant/home/jdoe/samples.csv\n/iplant/home/jdoe/reads/\n",
+		},
+	}
+	excludes := &apiv1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "excludes-file-e1", Namespace: "vice-apps", Labels: labels},
+		Data:       map[string]string{excludesFileName: "samples.csv\nreads\nlogs\n"},
+	}
+
+	i := &Internal{
+		Init:      Init{ViceNamespace: "vice-apps"},
+		clientset: fake.NewSimpleClientset(pod, inputs, excludes),
+		db:        sqlx.NewDb(mockdb, "sqlmock"),
+	}
+	i.podExec = func(_ context.Context, namespace, podName, container string, command []string) (string, error) {
+		assert.Equal(fileTransfersContainerName, container)
+		assert.Equal(fileTransfersInputsMountPath, command[4])
+		if command[5] == "." {
+			return "10|././samples.csv\n20|././reads/r1.fq\n30|././results/out.txt\n40|././logs/stderr\n", nil
+		}
+		assert.Equal([]string{"samples.csv", "reads"}, command[5:])
+		return "10|./samples.csv\n20|./reads/r1.fq\n25|./reads/r2.fq\n", nil
+	}
+
+	// Downloads are measured from the inputs.
+	mock.ExpectExec("INSERT INTO vice_transfer_sizes").WithArgs("e1", downloadKind, int64(55), 3).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	i.recordTransferSize(context.Background(), "e1", downloadKind)
+
+	// Uploads leave out the excluded files.
+	mock.ExpectExec("INSERT INTO vice_transfer_sizes").WithArgs("e1", uploadKind, int64(30), 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	i.recordTransferSize(context.Background(), "e1", uploadKind)
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
@@ -0,0 +1,251 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// hostLocationTTL is how long the namespace hosting an analysis is cached
+// for. Analyses don't move, so this only limits the size of the cache.
+const hostLocationTTL = 10 * time.Minute
+
+// urlReadyNotificationTimeout limits how long sending the URL-ready
+// notification may take. It's sent after the request that noticed the
+// analysis was ready has been answered.
+const urlReadyNotificationTimeout = 30 * time.Second
+
+// URLReadiness is the response of the URL-ready endpoints.
+type URLReadiness struct {
+	// Ready is true if the analysis can be used.
+	Ready bool `json:"ready"`
+
+	ExternalID string `json:"external_id"`
+	Namespace  string `json:"namespace"`
+
+	// Ingress, Service, and PodReady are true if the analysis's Ingress and
+	// Service exist and a pod in its Deployment is ready.
+	Ingress  bool `json:"ingress"`
+	Service  bool `json:"service"`
+	PodReady bool `json:"pod_ready"`
+
+	// Queued is true while the analysis is waiting for Kueue to admit it.
+	Queued bool `json:"queued,omitempty"`
+
+	// StartupDeadline is when the analysis will be marked as failed if it
+	// isn't ready yet. It's only set while the startup monitor is enabled
+	// and the analysis isn't queued.
+	StartupDeadline *time.Time `json:"startup_deadline,omitempty"`
+}
+
+// hostLocation is the analysis served from a host and the namespace its
+// resources are in.
+type hostLocation struct {
+	externalID string
+	namespace  string
+	expires    time.Time
+}
+
+// hostLocationCache caches the locations of the analyses served from each
+// host, so that the URL-ready checks the frontend polls for don't list the
+// Ingresses in every namespace each time. The zero value is ready to use.
+type hostLocationCache struct {
+	mu        sync.Mutex
+	locations map[string]hostLocation
+}
+
+func (c *hostLocationCache) get(host string, now time.Time) (hostLocation, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	location, ok := c.locations[host]
+	if !ok || now.After(location.expires) {
+		return hostLocation{}, false
+	}
+	return location, true
+}
+
+func (c *hostLocationCache) set(host string, location hostLocation) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.locations == nil || len(c.locations) >= maxCachedLabelValues {
+		c.locations = map[string]hostLocation{}
+	}
+	c.locations[host] = location
+}
+
+func (c *hostLocationCache) remove(host string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.locations, host)
+}
+
+// readyStates remembers the analyses that were ready the last time they were
+// checked, so that the URL-ready notification is only sent when an analysis
+// becomes ready rather than on every check. The zero value is ready to use.
+type readyStates struct {
+	mu    sync.Mutex
+	ready map[string]bool
+}
+
+// update records whether the analysis is ready and returns true if it just
+// became ready.
+func (s *readyStates) update(externalID string, ready bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !ready {
+		delete(s.ready, externalID)
+		return false
+	}
+	if s.ready[externalID] {
+		return false
+	}
+	if s.ready == nil || len(s.ready) >= maxCachedLabelValues {
+		s.ready = map[string]bool{}
+	}
+	s.ready[externalID] = true
+	return true
+}
+
+// forget stops tracking an analysis once it's been shut down.
+func (s *readyStates) forget(externalID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.ready, externalID)
+}
+
+// notifyURLReady tells the owner of the analysis that it's ready to use. The
+// notification is sent in the background with its own deadline, so that the
+// URL-ready checks aren't held up by the notification-agent.
+func (i *Internal) notifyURLReady(ctx context.Context, externalID string) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), urlReadyNotificationTimeout)
+	go func() {
+		defer cancel()
+		err := i.notify(ctx, &analysisNotification{
+			ExternalID: externalID,
+			Event:      NotificationURLReady,
+			Subject:    "Your analysis is ready",
+			Message:    "Your VICE analysis is running and ready to use.",
+		})
+		if err != nil {
+			log.WithContext(ctx).Error(err)
+		}
+	}()
+}
+
+// findHost returns the location of the analysis served from the host by
+// looking for its Ingress in the listing namespaces. The Ingress is named
+// after the analysis's external ID.
+func (i *Internal) findHost(ctx context.Context, host string) (*hostLocation, error) {
+	namespaces, err := i.listingNamespaces(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, namespace := range namespaces {
+		ingresslist, err := i.clientset.NetworkingV1().Ingresses(namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, ingress := range ingresslist.Items {
+			for _, rule := range ingress.Spec.Rules {
+				if ingressHostMatches(rule.Host, host) {
+					return &hostLocation{externalID: ingress.Name, namespace: namespace}, nil
+				}
+			}
+		}
+	}
+
+	return nil, echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("no ingress found for host %s", host))
+}
+
+// locateHost returns the location of the analysis served from the host.
+// Cached locations are used as long as the analysis's Ingress still exists.
+func (i *Internal) locateHost(ctx context.Context, host string) (*hostLocation, error) {
+	now := time.Now()
+	if location, ok := i.hostLocations.get(host, now); ok {
+		_, err := i.clientset.NetworkingV1().Ingresses(location.namespace).Get(ctx, location.externalID, metav1.GetOptions{})
+		if err == nil {
+			return &location, nil
+		}
+		if !k8serrors.IsNotFound(err) {
+			return nil, err
+		}
+		i.hostLocations.remove(host)
+	}
+
+	location, err := i.findHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	location.expires = now.Add(hostLocationTTL)
+	i.hostLocations.set(host, *location)
+
+	return location, nil
+}
+
+// urlReadiness checks whether the analysis served from the host is ready,
+// using the resources in the namespace that hosts it. Returns a 404 error if
+// there's no analysis served from the host.
+func (i *Internal) urlReadiness(ctx context.Context, host string) (*URLReadiness, error) {
+	location, err := i.locateHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	// The Ingress was found when the analysis was located.
+	readiness := &URLReadiness{
+		ExternalID: location.externalID,
+		Namespace:  location.namespace,
+		Ingress:    true,
+	}
+
+	set := labels.Set(map[string]string{
+		"external-id": location.externalID,
+	})
+	listoptions := metav1.ListOptions{
+		LabelSelector: set.AsSelector().String(),
+	}
+
+	svclist, err := i.clientset.CoreV1().Services(location.namespace).List(ctx, listoptions)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error listing the services for %s", location.externalID)
+	}
+	readiness.Service = len(svclist.Items) > 0
+
+	deplist, err := i.clientset.AppsV1().Deployments(location.namespace).List(ctx, listoptions)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error listing the deployments for %s", location.externalID)
+	}
+	queued, err := i.queueStatuses(ctx, location.namespace, set)
+	if err != nil {
+		return nil, err
+	}
+	status := queued[location.externalID]
+	readiness.Queued = status != nil && status.Queued
+
+	for idx := range deplist.Items {
+		dep := &deplist.Items[idx]
+		if dep.Status.ReadyReplicas > 0 {
+			readiness.PodReady = true
+		} else if i.StartupMonitor.Enabled {
+			started, timeout := i.startupWindow(dep)
+			deadline := status.startupWindowStart(started).Add(timeout)
+			readiness.StartupDeadline = &deadline
+		}
+	}
+
+	readiness.Ready = readiness.Ingress && readiness.Service && readiness.PodReady
+	if readiness.PodReady || readiness.Queued {
+		readiness.StartupDeadline = nil
+	}
+	return readiness, nil
+}
@@ -0,0 +1,120 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func urlReadyTestObjects(namespace, externalID, host string, readyReplicas int32) []runtime.Object {
+	labels := map[string]string{"external-id": externalID}
+	return []runtime.Object{
+		&netv1.Ingress{
+			ObjectMeta: metav1.ObjectMeta{Name: externalID, Namespace: namespace, Labels: labels},
+			Spec:       netv1.IngressSpec{Rules: []netv1.IngressRule{{Host: host}}},
+		},
+		&apiv1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "vice-" + externalID, Namespace: namespace, Labels: labels},
+		},
+		&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: externalID, Namespace: namespace, Labels: labels},
+			Status:     appsv1.DeploymentStatus{ReadyReplicas: readyReplicas},
+		},
+	}
+}
+
+func TestURLReadiness(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	objects := []runtime.Object{
+		&apiv1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "vice-apps"}},
+		&apiv1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "vice-jdoe", Labels: map[string]string{"cyverse.org/vice": "true"}}},
+	}
+	objects = append(objects, urlReadyTestObjects("vice-apps", "e1", "a1.cyverse.run", 0)...)
+	objects = append(objects, urlReadyTestObjects("vice-jdoe", "e2", "a2.cyverse.run", 1)...)
+	clientset := fake.NewSimpleClientset(objects...)
+
+	i := &Internal{
+		Init: Init{
+			ViceNamespace: "vice-apps",
+			Namespaces:    NamespacesConfig{Selector: "cyverse.org/vice=true"},
+		},
+		clientset: clientset,
+	}
+
+	readiness, err := i.urlReadiness(ctx, "a1.cyverse.run")
+	if assert.NoError(err) {
+		assert.Equal(&URLReadiness{ExternalID: "e1", Namespace: "vice-apps", Ingress: true, Service: true}, readiness)
+	}
+
+	// Analyses in other namespaces are checked where they're hosted.
+	readiness, err = i.urlReadiness(ctx, "a2.cyverse.run")
+	if assert.NoError(err) {
+		assert.True(readiness.Ready)
+		assert.Equal("vice-jdoe", readiness.Namespace)
+	}
+	_, cached := i.hostLocations.get("a2.cyverse.run", time.Now())
+	assert.True(cached)
+
+	// Cached locations are dropped once the analysis is gone.
+	assert.NoError(clientset.NetworkingV1().Ingresses("vice-jdoe").Delete(ctx, "e2", metav1.DeleteOptions{}))
+	_, err = i.urlReadiness(ctx, "a2.cyverse.run")
+	if assert.Error(err) {
+		assert.Equal(http.StatusNotFound, err.(*echo.HTTPError).Code)
+	}
+	_, cached = i.hostLocations.get("a2.cyverse.run", time.Now())
+	assert.False(cached)
+
+	// The admin endpoint returns the same response.
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+	c.SetParamNames("host")
+	c.SetParamValues("a1.cyverse.run")
+	assert.NoError(i.AdminURLReadyHandler(c))
+	assert.JSONEq(
+		`{"ready": false, "external_id": "e1", "namespace": "vice-apps", "ingress": true, "service": true, "pod_ready": false}`,
+		rec.Body.String(),
+	)
+
+	// Analyses that aren't ready yet report their startup deadlines while
+	// the startup monitor is enabled.
+	i.StartupMonitor.Enabled = true
+	readiness, err = i.urlReadiness(ctx, "a1.cyverse.run")
+	if assert.NoError(err) {
+		assert.NotNil(readiness.StartupDeadline)
+	}
+}
+
+func TestReadyStates(t *testing.T) {
+	assert := assert.New(t)
+
+	var states readyStates
+
+	// Only the change to ready is reported.
+	assert.False(states.update("e1", false))
+	assert.True(states.update("e1", true))
+	assert.False(states.update("e1", true))
+
+	// An analysis that stops being ready is reported again when it's ready
+	// again.
+	assert.False(states.update("e1", false))
+	assert.True(states.update("e1", true))
+
+	// Analyses are tracked separately.
+	assert.True(states.update("e2", true))
+
+	states.forget("e1")
+	assert.True(states.update("e1", true))
+}
@@ -138,31 +138,42 @@ func (i *Internal) getCSIDataVolumeLabels(ctx context.Context, job *model.Job) (
 	return labels, nil
 }
 
+// getDataPathMappings returns all of the path mappings for the analysis's CSI
+// data volume.
+func (i *Internal) getDataPathMappings(job *model.Job) ([]IRODSFSPathMapping, error) {
+	dataPathMappings := []IRODSFSPathMapping{}
+
+	// input output path
+	inputPathMappings, err := i.getInputPathMappings(job)
+	if err != nil {
+		return nil, err
+	}
+	dataPathMappings = append(dataPathMappings, inputPathMappings...)
+
+	outputPathMapping := i.getOutputPathMapping(job)
+	dataPathMappings = append(dataPathMappings, outputPathMapping)
+
+	// home path
+	if job.UserHome != "" {
+		homePathMapping := i.getHomePathMapping(job)
+		dataPathMappings = append(dataPathMappings, homePathMapping)
+	}
+
+	// shared path
+	sharedPathMapping := i.getSharedPathMapping()
+	dataPathMappings = append(dataPathMappings, sharedPathMapping)
+
+	return dataPathMappings, nil
+}
+
 // getPersistentVolumes returns the PersistentVolumes for the VICE analysis. It does
 // not call the k8s API.
-func (i *Internal) getPersistentVolumes(ctx context.Context, job *model.Job) ([]*apiv1.PersistentVolume, error) {
+func (i *Internal) getPersistentVolumes(ctx context.Context, job *model.Job, settings *ToolSettings) ([]*apiv1.PersistentVolume, error) {
 	if i.UseCSIDriver {
-		dataPathMappings := []IRODSFSPathMapping{}
-
-		// input output path
-		inputPathMappings, err := i.getInputPathMappings(job)
+		dataPathMappings, err := i.getDataPathMappings(job)
 		if err != nil {
 			return nil, err
 		}
-		dataPathMappings = append(dataPathMappings, inputPathMappings...)
-
-		outputPathMapping := i.getOutputPathMapping(job)
-		dataPathMappings = append(dataPathMappings, outputPathMapping)
-
-		// home path
-		if job.UserHome != "" {
-			homePathMapping := i.getHomePathMapping(job)
-			dataPathMappings = append(dataPathMappings, homePathMapping)
-		}
-
-		// shared path
-		sharedPathMapping := i.getSharedPathMapping()
-		dataPathMappings = append(dataPathMappings, sharedPathMapping)
 
 		// convert path mappings into json
 		dataPathMappingsJSONBytes, err := json.Marshal(dataPathMappings)
@@ -203,8 +214,8 @@ func (i *Internal) getPersistentVolumes(ctx context.Context, job *model.Job) ([]
 							"no_permission_check": "true",
 							// use proxy access
 							"clientUser": job.Submitter,
-							"uid":        fmt.Sprintf("%d", job.Steps[0].Component.Container.UID),
-							"gid":        fmt.Sprintf("%d", job.Steps[0].Component.Container.UID),
+							"uid":        fmt.Sprintf("%d", settings.runAsUser(job)),
+							"gid":        fmt.Sprintf("%d", settings.runAsGroup(job)),
 						},
 					},
 				},
@@ -0,0 +1,477 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx/types"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// maxWorkshopRoster is the largest number of users a workshop can be created
+// for.
+const maxWorkshopRoster = 500
+
+// The states of a workshop instance.
+const (
+	// workshopInstanceFailed is reported for instances that couldn't be
+	// launched.
+	workshopInstanceFailed = "failed"
+
+	// workshopInstanceStarting is reported for instances that are still being
+	// created or aren't ready yet.
+	workshopInstanceStarting = "starting"
+
+	// workshopInstanceReady is reported for instances that users can connect
+	// to.
+	workshopInstanceReady = "ready"
+
+	// workshopInstanceStopped is reported for instances whose analyses have
+	// ended.
+	workshopInstanceStopped = "stopped"
+)
+
+// WorkshopRequest is the request body for creating a workshop.
+type WorkshopRequest struct {
+	Name          string   `json:"name"`
+	QuickLaunchID string   `json:"quick_launch_id"`
+	Users         []string `json:"users"`
+}
+
+// WorkshopInstance is the analysis launched for one user on a workshop's
+// roster.
+type WorkshopInstance struct {
+	Username   string  `json:"username" db:"username"`
+	AnalysisID *string `json:"analysis_id" db:"analysis_id"`
+	Error      *string `json:"error,omitempty" db:"error"`
+	Status     string  `json:"status" db:"-"`
+}
+
+// Workshop is a set of analyses launched from the same quick launch for the
+// users on a roster.
+type Workshop struct {
+	ID            string             `json:"id" db:"id"`
+	Name          string             `json:"name" db:"name"`
+	QuickLaunchID string             `json:"quick_launch_id" db:"quick_launch_id"`
+	CreatedBy     string             `json:"created_by" db:"created_by"`
+	CreatedAt     time.Time          `json:"created_at" db:"created_at"`
+	TornDownAt    *time.Time         `json:"torn_down_at" db:"torn_down_at"`
+	Ready         int                `json:"ready" db:"-"`
+	Instances     []WorkshopInstance `json:"instances,omitempty" db:"-"`
+}
+
+const getQuickLaunchSubmissionSQL = `
+	SELECT submission
+	  FROM quick_launches
+	 WHERE id = $1
+`
+
+const insertWorkshopSQL = `
+	INSERT INTO vice_workshops (name, quick_launch_id, created_by)
+	VALUES ($1, $2, $3)
+	RETURNING id, name, quick_launch_id, created_by, created_at, torn_down_at
+`
+
+const insertWorkshopInstanceSQL = `
+	INSERT INTO vice_workshop_instances (workshop_id, username, analysis_id, error)
+	VALUES ($1, $2, $3, $4)
+`
+
+const listWorkshopsSQL = `
+	SELECT id, name, quick_launch_id, created_by, created_at, torn_down_at
+	  FROM vice_workshops
+	 ORDER BY created_at DESC
+`
+
+const getWorkshopSQL = `
+	SELECT id, name, quick_launch_id, created_by, created_at, torn_down_at
+	  FROM vice_workshops
+	 WHERE id = $1
+`
+
+const listWorkshopInstancesSQL = `
+	SELECT username, analysis_id, error
+	  FROM vice_workshop_instances
+	 WHERE workshop_id = $1
+	 ORDER BY username
+`
+
+const tearDownWorkshopSQL = `
+	UPDATE vice_workshops
+	   SET torn_down_at = now()
+	 WHERE id = $1
+	   AND torn_down_at IS NULL
+`
+
+const getWorkshopAnalysisSQL = `
+	SELECT j.status, s.external_id
+	  FROM jobs j
+	  JOIN job_steps s ON s.job_id = j.id
+	 WHERE j.id = $1
+	 ORDER BY s.step_number
+	 LIMIT 1
+`
+
+// endedJobStatuses are the statuses of analyses that are no longer running.
+var endedJobStatuses = map[string]bool{
+	"Completed": true,
+	"Failed":    true,
+	"Canceled":  true,
+}
+
+// parseWorkshopRequest returns the request with the usernames normalized and
+// deduplicated, or an error if the request can't be used.
+func (i *Internal) parseWorkshopRequest(c echo.Context) (*WorkshopRequest, error) {
+	req := &WorkshopRequest{}
+	if err := c.Bind(req); err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "name must be set")
+	}
+	if req.QuickLaunchID == "" {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "quick_launch_id must be set")
+	}
+
+	seen := map[string]bool{}
+	users := []string{}
+	for _, user := range req.Users {
+		user = strings.TrimSuffix(strings.TrimSpace(user), i.UserSuffix)
+		if user == "" || seen[user] {
+			continue
+		}
+		seen[user] = true
+		users = append(users, user)
+	}
+	if len(users) == 0 {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "users must list at least one user")
+	}
+	if len(users) > maxWorkshopRoster {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("workshops can have at most %d users", maxWorkshopRoster))
+	}
+	req.Users = users
+
+	return req, nil
+}
+
+// submitQuickLaunch submits the quick launch's submission to the apps service
+// on behalf of the user and returns the ID of the new analysis. The outputs
+// go to a new folder in the user's analyses folder, since the quick launch's
+// output folder belongs to its creator.
+func (i *Internal) submitQuickLaunch(ctx context.Context, submission types.JSONText, user string) (string, error) {
+	body := map[string]interface{}{}
+	if err := json.Unmarshal(submission, &body); err != nil {
+		return "", errors.Wrap(err, "error parsing the quick launch submission")
+	}
+	body["output_dir"] = i.userAnalysesDir(user)
+	body["create_output_subdir"] = true
+
+	return i.submitAnalysis(ctx, body, user)
+}
+
+// appsServiceError is returned for submissions the apps service refused.
+type appsServiceError struct {
+	statusCode int
+	message    string
+}
+
+// Error implements the error interface.
+func (e *appsServiceError) Error() string {
+	return fmt.Sprintf("the apps service returned %d: %s", e.statusCode, e.message)
+}
+
+// userAnalysesDir returns the path to the user's analyses folder.
+func (i *Internal) userAnalysesDir(user string) string {
+	return path.Join("/", i.IRODSZone, "home", user, "analyses")
+}
+
+// submitAnalysis submits the analysis to the apps service on behalf of the
+// user and returns the ID of the new analysis. The apps service launches
+// both VICE and batch analyses.
+func (i *Internal) submitAnalysis(ctx context.Context, body map[string]interface{}, user string) (string, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return "", err
+	}
+
+	submitURL, err := url.Parse(i.AppsServiceBaseURL)
+	if err != nil {
+		return "", errors.Wrapf(err, "error parsing url %s", i.AppsServiceBaseURL)
+	}
+	submitURL.Path = path.Join(submitURL.Path, "/analyses")
+	q := submitURL.Query()
+	q.Set("user", user)
+	submitURL.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, submitURL.String(), bytes.NewReader(data))
+	if err != nil {
+		return "", errors.Wrapf(err, "error from POST %s", submitURL.String())
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", errors.Wrapf(err, "error from POST %s", submitURL.String())
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", errors.Wrapf(err, "error reading response body from %s", submitURL.String())
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", &appsServiceError{statusCode: resp.StatusCode, message: strings.TrimSpace(string(respBody))}
+	}
+
+	analysis := struct {
+		ID string `json:"id"`
+	}{}
+	if err = json.Unmarshal(respBody, &analysis); err != nil {
+		return "", errors.Wrapf(err, "error unmarshalling JSON from %s", submitURL.String())
+	}
+	if analysis.ID == "" {
+		return "", fmt.Errorf("the apps service didn't return an analysis ID")
+	}
+
+	return analysis.ID, nil
+}
+
+// analysisResourcesReady returns true if the analysis's ingress and service
+// exist and its pod is ready.
+func (i *Internal) analysisResourcesReady(ctx context.Context, externalID string) (bool, error) {
+	listoptions := metav1.ListOptions{
+		LabelSelector: labels.Set(map[string]string{"external-id": externalID}).AsSelector().String(),
+	}
+
+	ingresses, err := i.clientset.NetworkingV1().Ingresses(i.ViceNamespace).List(ctx, listoptions)
+	if err != nil {
+		return false, err
+	}
+	services, err := i.clientset.CoreV1().Services(i.ViceNamespace).List(ctx, listoptions)
+	if err != nil {
+		return false, err
+	}
+	deployments, err := i.clientset.AppsV1().Deployments(i.ViceNamespace).List(ctx, listoptions)
+	if err != nil {
+		return false, err
+	}
+
+	podReady := false
+	for _, deployment := range deployments.Items {
+		if deployment.Status.ReadyReplicas > 0 {
+			podReady = true
+		}
+	}
+
+	return len(ingresses.Items) > 0 && len(services.Items) > 0 && podReady, nil
+}
+
+// workshopAnalysis returns the status and external ID of the instance's
+// analysis. The external ID is empty if the analysis hasn't been submitted to
+// app-exposer yet.
+func (i *Internal) workshopAnalysis(ctx context.Context, instance *WorkshopInstance) (string, string, error) {
+	var status, externalID sql.NullString
+	err := i.db.QueryRowContext(ctx, getWorkshopAnalysisSQL, *instance.AnalysisID).Scan(&status, &externalID)
+	if err == sql.ErrNoRows {
+		return "", "", nil
+	}
+	if err != nil {
+		return "", "", errors.Wrapf(err, "error looking up analysis %s", *instance.AnalysisID)
+	}
+	return status.String, externalID.String, nil
+}
+
+// setInstanceStatus sets the status of the workshop instance.
+func (i *Internal) setInstanceStatus(ctx context.Context, instance *WorkshopInstance) error {
+	if instance.AnalysisID == nil {
+		instance.Status = workshopInstanceFailed
+		return nil
+	}
+
+	status, externalID, err := i.workshopAnalysis(ctx, instance)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case endedJobStatuses[status]:
+		instance.Status = workshopInstanceStopped
+	case externalID == "":
+		instance.Status = workshopInstanceStarting
+	default:
+		ready, err := i.analysisResourcesReady(ctx, externalID)
+		if err != nil {
+			return err
+		}
+		instance.Status = workshopInstanceStarting
+		if ready {
+			instance.Status = workshopInstanceReady
+		}
+	}
+
+	return nil
+}
+
+// getWorkshop returns the workshop with the current status of each of its
+// instances.
+func (i *Internal) getWorkshop(ctx context.Context, id string) (*Workshop, error) {
+	workshop := &Workshop{}
+	if err := i.db.GetContext(ctx, workshop, getWorkshopSQL, id); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("workshop %s not found", id))
+		}
+		return nil, errors.Wrapf(err, "error getting workshop %s", id)
+	}
+
+	workshop.Instances = []WorkshopInstance{}
+	if err := i.db.SelectContext(ctx, &workshop.Instances, listWorkshopInstancesSQL, id); err != nil {
+		return nil, errors.Wrapf(err, "error listing the instances of workshop %s", id)
+	}
+
+	for index := range workshop.Instances {
+		instance := &workshop.Instances[index]
+		if err := i.setInstanceStatus(ctx, instance); err != nil {
+			return nil, err
+		}
+
+		// The analyses' statuses may not have caught up with the teardown yet.
+		if workshop.TornDownAt != nil && instance.Status == workshopInstanceStarting {
+			instance.Status = workshopInstanceStopped
+		}
+		if instance.Status == workshopInstanceReady {
+			workshop.Ready++
+		}
+	}
+
+	return workshop, nil
+}
+
+// AdminListWorkshopsHandler lists the workshops, most recent first. The
+// instances aren't included.
+func (i *Internal) AdminListWorkshopsHandler(c echo.Context) error {
+	workshops := []Workshop{}
+	if err := i.db.SelectContext(c.Request().Context(), &workshops, listWorkshopsSQL); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, map[string][]Workshop{
+		"workshops": workshops,
+	})
+}
+
+// AdminCreateWorkshopHandler launches an instance of a quick launch for each
+// user on a roster. Launches that fail are recorded with their errors rather
+// than failing the whole request.
+func (i *Internal) AdminCreateWorkshopHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	user := c.QueryParam("user")
+	if user == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "user query parameter must be set")
+	}
+
+	req, err := i.parseWorkshopRequest(c)
+	if err != nil {
+		return err
+	}
+
+	var submission types.JSONText
+	if err = i.db.QueryRowContext(ctx, getQuickLaunchSubmissionSQL, req.QuickLaunchID).Scan(&submission); err != nil {
+		if err == sql.ErrNoRows {
+			return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("quick launch %s not found", req.QuickLaunchID))
+		}
+		return errors.Wrapf(err, "error getting quick launch %s", req.QuickLaunchID)
+	}
+
+	workshop := &Workshop{}
+	if err = i.db.QueryRowxContext(ctx, insertWorkshopSQL, req.Name, req.QuickLaunchID, user).StructScan(workshop); err != nil {
+		return errors.Wrap(err, "error recording the workshop")
+	}
+
+	workshop.Instances = []WorkshopInstance{}
+	for _, rosterUser := range req.Users {
+		instance := WorkshopInstance{Username: rosterUser, Status: workshopInstanceStarting}
+
+		analysisID, err := i.submitQuickLaunch(ctx, submission, rosterUser)
+		if err != nil {
+			log.WithContext(ctx).Errorf("error launching quick launch %s for %s in workshop %s: %s", req.QuickLaunchID, rosterUser, workshop.ID, err)
+			message := err.Error()
+			instance.Error = &message
+			instance.Status = workshopInstanceFailed
+		} else {
+			instance.AnalysisID = &analysisID
+		}
+
+		if _, err = i.db.ExecContext(ctx, insertWorkshopInstanceSQL, workshop.ID, rosterUser, instance.AnalysisID, instance.Error); err != nil {
+			return errors.Wrapf(err, "error recording the instance for %s in workshop %s", rosterUser, workshop.ID)
+		}
+		workshop.Instances = append(workshop.Instances, instance)
+	}
+
+	return c.JSON(http.StatusOK, workshop)
+}
+
+// AdminGetWorkshopHandler returns a workshop with the status of each of its
+// instances and the number that are ready.
+func (i *Internal) AdminGetWorkshopHandler(c echo.Context) error {
+	workshop, err := i.getWorkshop(c.Request().Context(), c.Param("id"))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, workshop)
+}
+
+// AdminTearDownWorkshopHandler stops every instance in a workshop that's
+// still running. The outputs are uploaded the same way as when users exit
+// their analyses.
+func (i *Internal) AdminTearDownWorkshopHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	id := c.Param("id")
+
+	workshop, err := i.getWorkshop(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	for index := range workshop.Instances {
+		instance := &workshop.Instances[index]
+		if instance.Status != workshopInstanceReady && instance.Status != workshopInstanceStarting {
+			continue
+		}
+
+		_, externalID, err := i.workshopAnalysis(ctx, instance)
+		if err != nil {
+			return err
+		}
+		if externalID == "" {
+			continue
+		}
+		if err = i.doExit(ctx, externalID); err != nil {
+			log.WithContext(ctx).Errorf("error stopping analysis %s in workshop %s: %s", *instance.AnalysisID, id, err)
+		}
+	}
+
+	if _, err = i.db.ExecContext(ctx, tearDownWorkshopSQL, id); err != nil {
+		return errors.Wrapf(err, "error recording the teardown of workshop %s", id)
+	}
+
+	workshop, err = i.getWorkshop(ctx, id)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, workshop)
+}
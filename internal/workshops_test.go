@@ -0,0 +1,154 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+var workshopColumns = []string{"id", "name", "quick_launch_id", "created_by", "created_at", "torn_down_at"}
+
+func newWorkshopsTestInternal(t *testing.T, appsURL string) (*Internal, sqlmock.Sqlmock) {
+	mockdb, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { mockdb.Close() })
+
+	labels := map[string]string{"external-id": "e1"}
+	ready := appDeployment("e1", "a1", "jupyter")
+	ready.Namespace = "vice-apps"
+	ready.Status.ReadyReplicas = 1
+
+	return &Internal{
+		Init: Init{
+			ViceNamespace:      "vice-apps",
+			UserSuffix:         "@example.org",
+			IRODSZone:          "iplant",
+			AppsServiceBaseURL: appsURL,
+		},
+		db: sqlx.NewDb(mockdb, "sqlmock"),
+		clientset: fake.NewSimpleClientset(
+			ready,
+			&apiv1.Service{ObjectMeta: metav1.ObjectMeta{Name: "vice-e1", Namespace: "vice-apps", Labels: labels}},
+			&netv1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: "e1", Namespace: "vice-apps", Labels: labels}},
+		),
+	}, mock
+}
+
+func TestAdminCreateWorkshopHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	submitted := map[string]map[string]interface{}{}
+	apps := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("/analyses", r.URL.Path)
+		user := r.URL.Query().Get("user")
+		if user == "bob" {
+			http.Error(w, "job limit reached", http.StatusBadRequest)
+			return
+		}
+		body := map[string]interface{}{}
+		assert.NoError(json.NewDecoder(r.Body).Decode(&body))
+		submitted[user] = body
+		_, _ = w.Write([]byte(`{"id": "a-` + user + `"}`))
+	}))
+	defer apps.Close()
+
+	i, mock := newWorkshopsTestInternal(t, apps.URL)
+
+	create := func(body string) (*httptest.ResponseRecorder, error) {
+		req := httptest.NewRequest(http.MethodPost, "/vice/admin/workshops?user=instructor", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		return rec, i.AdminCreateWorkshopHandler(echo.New().NewContext(req, rec))
+	}
+
+	_, err := create(`{"name": "intro", "quick_launch_id": "q1", "users": []}`)
+	if assert.Error(err) {
+		assert.Equal(http.StatusBadRequest, err.(*echo.HTTPError).Code)
+	}
+
+	mock.ExpectQuery("FROM quick_launches").WithArgs("q1").
+		WillReturnRows(sqlmock.NewRows([]string{"submission"}).AddRow(`{"name": "jupyter", "output_dir": "/iplant/home/instructor/analyses"}`))
+	mock.ExpectQuery("INSERT INTO vice_workshops").WithArgs("intro", "q1", "instructor").
+		WillReturnRows(sqlmock.NewRows(workshopColumns).AddRow("w1", "intro", "q1", "instructor", time.Now(), nil))
+	mock.ExpectExec("INSERT INTO vice_workshop_instances").WithArgs("w1", "alice", "a-alice", nil).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO vice_workshop_instances").WithArgs("w1", "bob", nil, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	// Duplicates and the user suffix are removed from the roster.
+	rec, err := create(`{"name": "intro", "quick_launch_id": "q1", "users": ["alice", "alice@example.org", "bob"]}`)
+	if assert.NoError(err) {
+		workshop := Workshop{}
+		assert.NoError(json.Unmarshal(rec.Body.Bytes(), &workshop))
+		if assert.Len(workshop.Instances, 2) {
+			assert.Equal(workshopInstanceStarting, workshop.Instances[0].Status)
+			assert.Equal(workshopInstanceFailed, workshop.Instances[1].Status)
+			assert.Contains(*workshop.Instances[1].Error, "job limit reached")
+		}
+	}
+
+	// The outputs go to each user's own analyses folder.
+	assert.Equal("/iplant/home/alice/analyses", submitted["alice"]["output_dir"])
+	assert.Equal(true, submitted["alice"]["create_output_subdir"])
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestAdminGetWorkshopHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	i, mock := newWorkshopsTestInternal(t, "http://apps")
+
+	mock.ExpectQuery("FROM vice_workshops").WithArgs("w1").
+		WillReturnRows(sqlmock.NewRows(workshopColumns).AddRow("w1", "intro", "q1", "instructor", time.Now(), nil))
+	mock.ExpectQuery("FROM vice_workshop_instances").WithArgs("w1").
+		WillReturnRows(sqlmock.NewRows([]string{"username", "analysis_id", "error"}).
+			AddRow("alice", "a1", nil).
+			AddRow("bob", nil, "job limit reached").
+			AddRow("carol", "a3", nil).
+			AddRow("dave", "a4", nil))
+	mock.ExpectQuery("FROM jobs j").WithArgs("a1").
+		WillReturnRows(sqlmock.NewRows([]string{"status", "external_id"}).AddRow("Running", "e1"))
+	mock.ExpectQuery("FROM jobs j").WithArgs("a3").
+		WillReturnRows(sqlmock.NewRows([]string{"status", "external_id"}).AddRow("Submitted", "e3"))
+	mock.ExpectQuery("FROM jobs j").WithArgs("a4").
+		WillReturnRows(sqlmock.NewRows([]string{"status", "external_id"}).AddRow("Completed", "e4"))
+
+	req := httptest.NewRequest(http.MethodGet, "/vice/admin/workshops/w1", nil)
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+	c.SetParamNames("id")
+	c.SetParamValues("w1")
+
+	if assert.NoError(i.AdminGetWorkshopHandler(c)) {
+		workshop := Workshop{}
+		assert.NoError(json.Unmarshal(rec.Body.Bytes(), &workshop))
+		assert.Equal(1, workshop.Ready)
+		statuses := []string{}
+		for _, instance := range workshop.Instances {
+			statuses = append(statuses, instance.Status)
+		}
+		assert.Equal([]string{
+			workshopInstanceReady,
+			workshopInstanceFailed,
+			workshopInstanceStarting,
+			workshopInstanceStopped,
+		}, statuses)
+	}
+
+	assert.NoError(mock.ExpectationsWereMet())
+}
@@ -0,0 +1,484 @@
+// Package jobgen generates model.Job submissions from short YAML descriptors.
+// Writing submission JSON by hand is error-prone, so the generated jobs are
+// used for local testing and by the integration tests.
+package jobgen
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/cyverse-de/model/v6"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+	resourcev1 "k8s.io/apimachinery/pkg/api/resource"
+)
+
+// The kinds of jobs that can be generated.
+const (
+	VICEKind  = "vice"
+	BatchKind = "batch"
+)
+
+const (
+	defaultUser       = "ipcdev"
+	defaultUserSuffix = "@iplantcollaborative.org"
+	defaultImage      = "discoenv/jupyter-lab:latest"
+	defaultCommand    = "/bin/true"
+	defaultIRODSBase  = "/iplant/home"
+	defaultPort       = 8888
+	defaultUID        = 1000
+	defaultWorkingDir = "/home/jovyan/data"
+
+	// sharedMemoryDevice is the device the VICE spec builder looks for to size
+	// the analysis's /dev/shm volume.
+	sharedMemoryDevice = "/dev/shm"
+)
+
+// gpuDevices are the devices requested for jobs that need a GPU.
+var gpuDevices = []string{"/dev/nvidia0", "/dev/nvidiactl", "/dev/nvidia-uvm"}
+
+// Input is an input file or folder for the job.
+type Input struct {
+	// Path is the full iRODS path to the file or folder.
+	Path string `yaml:"path"`
+
+	// Folder is true if the path refers to a folder.
+	Folder bool `yaml:"folder"`
+
+	// Ticket is an optional download ticket for the input.
+	Ticket string `yaml:"ticket"`
+}
+
+// Volume is a host path mounted into the analysis container.
+type Volume struct {
+	HostPath      string `yaml:"host_path"`
+	ContainerPath string `yaml:"container_path"`
+	ReadOnly      bool   `yaml:"read_only"`
+}
+
+// DataContainer is a container image whose volumes are mounted into the
+// analysis container.
+type DataContainer struct {
+	Image         string `yaml:"image"`
+	NamePrefix    string `yaml:"name_prefix"`
+	ContainerPath string `yaml:"container_path"`
+	ReadOnly      bool   `yaml:"read_only"`
+}
+
+// Descriptor describes the job to generate. Every field is optional.
+type Descriptor struct {
+	// Kind is either vice or batch. Defaults to vice.
+	Kind string `yaml:"kind"`
+
+	Name        string `yaml:"name"`
+	Description string `yaml:"description"`
+	AppName     string `yaml:"app_name"`
+	AppID       string `yaml:"app_id"`
+
+	// User is the username without the user suffix.
+	User   string `yaml:"user"`
+	UserID string `yaml:"user_id"`
+
+	// Image is the container image, including the tag.
+	Image      string   `yaml:"image"`
+	Command    []string `yaml:"command"`
+	Port       int      `yaml:"port"`
+	WorkingDir string   `yaml:"working_dir"`
+	UID        int      `yaml:"uid"`
+
+	// EntryPoint overrides the image's entry point for VICE analyses. More
+	// than one element is passed in exec form, without a shell.
+	EntryPoint []string `yaml:"entrypoint"`
+
+	// The resources are Kubernetes quantities, for example 2, 500m, or 4Gi.
+	MinCPU       string `yaml:"min_cpu"`
+	MaxCPU       string `yaml:"max_cpu"`
+	MinMemory    string `yaml:"min_memory"`
+	MaxMemory    string `yaml:"max_memory"`
+	MinDisk      string `yaml:"min_disk"`
+	SharedMemory string `yaml:"shared_memory"`
+	GPU          bool   `yaml:"gpu"`
+
+	// TimeLimit is a Go duration, such as 72h.
+	TimeLimit string `yaml:"time_limit"`
+
+	Environment    map[string]string `yaml:"environment"`
+	Inputs         []Input           `yaml:"inputs"`
+	Volumes        []Volume          `yaml:"volumes"`
+	DataContainers []DataContainer   `yaml:"data_containers"`
+}
+
+// Load reads one or more YAML descriptors, separated by ---, from r.
+func Load(r io.Reader) ([]*Descriptor, error) {
+	var descriptors []*Descriptor
+
+	decoder := yaml.NewDecoder(r)
+	decoder.KnownFields(true)
+
+	for {
+		d := &Descriptor{}
+		err := decoder.Decode(d)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to parse descriptor %d", len(descriptors)+1)
+		}
+		descriptors = append(descriptors, d)
+	}
+
+	return descriptors, nil
+}
+
+// Generator turns descriptors into jobs. The zero value is ready to use; the
+// function fields can be replaced to make the output deterministic.
+type Generator struct {
+	// Now returns the submission time. Defaults to time.Now.
+	Now func() time.Time
+
+	// NewID returns new UUIDs. Defaults to uuid.NewString.
+	NewID func() string
+
+	// UserSuffix is appended to usernames. Defaults to @iplantcollaborative.org.
+	UserSuffix string
+}
+
+func (g *Generator) now() time.Time {
+	if g.Now != nil {
+		return g.Now()
+	}
+	return time.Now()
+}
+
+func (g *Generator) newID() string {
+	if g.NewID != nil {
+		return g.NewID()
+	}
+	return uuid.NewString()
+}
+
+func (g *Generator) userSuffix() string {
+	if g.UserSuffix != "" {
+		return g.UserSuffix
+	}
+	return defaultUserSuffix
+}
+
+// splitImage splits an image reference into its name and tag. Registries
+// with ports are handled by only looking for a tag after the last slash.
+func splitImage(image string) (string, string) {
+	slash := strings.LastIndex(image, "/")
+	colon := strings.LastIndex(image, ":")
+	if colon > slash {
+		return image[:colon], image[colon+1:]
+	}
+	return image, "latest"
+}
+
+// quantity parses a Kubernetes quantity, returning the zero value if s is
+// empty.
+func quantity(field, s string) (resourcev1.Quantity, error) {
+	if s == "" {
+		return resourcev1.Quantity{}, nil
+	}
+	q, err := resourcev1.ParseQuantity(s)
+	if err != nil {
+		return q, errors.Wrapf(err, "invalid %s %q", field, s)
+	}
+	return q, nil
+}
+
+// Generate returns the job described by d.
+func (g *Generator) Generate(d *Descriptor) (*model.Job, error) {
+	kind := d.Kind
+	if kind == "" {
+		kind = VICEKind
+	}
+	if kind != VICEKind && kind != BatchKind {
+		return nil, fmt.Errorf("unknown kind %q", d.Kind)
+	}
+	vice := kind == VICEKind
+
+	user := d.User
+	if user == "" {
+		user = defaultUser
+	}
+	userID := d.UserID
+	if userID == "" {
+		userID = g.newID()
+	}
+
+	name := d.Name
+	if name == "" {
+		name = fmt.Sprintf("jobgen-%s", kind)
+	}
+	appName := d.AppName
+	if appName == "" {
+		appName = name
+	}
+	appID := d.AppID
+	if appID == "" {
+		appID = g.newID()
+	}
+
+	image := d.Image
+	if image == "" {
+		image = defaultImage
+	}
+	imageName, imageTag := splitImage(image)
+
+	uid := d.UID
+	if uid == 0 {
+		uid = defaultUID
+	}
+
+	minCPU, err := quantity("min_cpu", d.MinCPU)
+	if err != nil {
+		return nil, err
+	}
+	maxCPU, err := quantity("max_cpu", d.MaxCPU)
+	if err != nil {
+		return nil, err
+	}
+	minMemory, err := quantity("min_memory", d.MinMemory)
+	if err != nil {
+		return nil, err
+	}
+	maxMemory, err := quantity("max_memory", d.MaxMemory)
+	if err != nil {
+		return nil, err
+	}
+	minDisk, err := quantity("min_disk", d.MinDisk)
+	if err != nil {
+		return nil, err
+	}
+	if d.SharedMemory != "" {
+		if _, err = quantity("shared_memory", d.SharedMemory); err != nil {
+			return nil, err
+		}
+	}
+
+	var timeLimit time.Duration
+	if d.TimeLimit != "" {
+		if timeLimit, err = time.ParseDuration(d.TimeLimit); err != nil {
+			return nil, errors.Wrapf(err, "invalid time_limit %q", d.TimeLimit)
+		}
+	}
+
+	submitted := g.now()
+	nowDate := submitted.Format("2006-01-02-15-04-05.000")
+	userHome := path.Join(defaultIRODSBase, user)
+
+	container := model.Container{
+		ID:             g.newID(),
+		Name:           fmt.Sprintf("%s-container", name),
+		NetworkMode:    "bridge",
+		MinCPUCores:    float32(minCPU.AsApproximateFloat64()),
+		MaxCPUCores:    float32(maxCPU.AsApproximateFloat64()),
+		MinMemoryLimit: minMemory.Value(),
+		MemoryLimit:    maxMemory.Value(),
+		MinDiskSpace:   minDisk.Value(),
+		UID:            uid,
+		Image: model.ContainerImage{
+			ID:   g.newID(),
+			Name: imageName,
+			Tag:  imageTag,
+		},
+	}
+
+	if vice {
+		port := d.Port
+		if port == 0 {
+			port = defaultPort
+		}
+		container.Ports = []model.Ports{{ContainerPort: port}}
+
+		container.WorkingDir = d.WorkingDir
+		if container.WorkingDir == "" {
+			container.WorkingDir = defaultWorkingDir
+		}
+
+		if container.EntryPoint, err = entryPoint(d.EntryPoint); err != nil {
+			return nil, err
+		}
+	} else {
+		container.WorkingDir = d.WorkingDir
+		container.EntryPoint = defaultCommand
+		if len(d.Command) > 0 {
+			container.EntryPoint = d.Command[0]
+		}
+	}
+
+	if d.GPU {
+		for _, device := range gpuDevices {
+			container.Devices = append(container.Devices, model.Device{
+				HostPath:          device,
+				ContainerPath:     device,
+				CgroupPermissions: "rwm",
+			})
+		}
+	}
+
+	if d.SharedMemory != "" {
+		// The spec builder reads the size of /dev/shm from the container path.
+		container.Devices = append(container.Devices, model.Device{
+			HostPath:      sharedMemoryDevice,
+			ContainerPath: d.SharedMemory,
+		})
+	}
+
+	for _, v := range d.Volumes {
+		container.Volumes = append(container.Volumes, model.Volume{
+			HostPath:      v.HostPath,
+			ContainerPath: v.ContainerPath,
+			ReadOnly:      v.ReadOnly,
+		})
+	}
+
+	for _, dc := range d.DataContainers {
+		dcName, dcTag := splitImage(dc.Image)
+		container.VolumesFrom = append(container.VolumesFrom, model.VolumesFrom{
+			Name:          dcName,
+			Tag:           dcTag,
+			NamePrefix:    dc.NamePrefix,
+			ContainerPath: dc.ContainerPath,
+			ReadOnly:      dc.ReadOnly,
+		})
+	}
+
+	var inputs []model.StepInput
+	for _, in := range d.Inputs {
+		inputType, multiplicity := "FileInput", "single"
+		if in.Folder {
+			inputType, multiplicity = "FolderInput", "collection"
+		}
+		inputs = append(inputs, model.StepInput{
+			ID:           g.newID(),
+			Name:         path.Base(in.Path),
+			Multiplicity: multiplicity,
+			Type:         inputType,
+			Value:        in.Path,
+			Ticket:       in.Ticket,
+		})
+	}
+
+	var params []model.StepParam
+	if !vice {
+		for idx, arg := range d.Command {
+			if idx == 0 {
+				continue
+			}
+			params = append(params, model.StepParam{
+				ID:    g.newID(),
+				Value: arg,
+				Order: idx,
+				Type:  "Text",
+			})
+		}
+	}
+
+	environment := model.StepEnvironment{}
+	for k, v := range d.Environment {
+		environment[k] = v
+	}
+
+	executionTarget, componentType := "condor", "executable"
+	if vice {
+		executionTarget, componentType = "interapps", "interactive"
+	}
+
+	step := model.Step{
+		Component: model.StepComponent{
+			Container:     container,
+			Type:          componentType,
+			Name:          appName,
+			Description:   d.Description,
+			TimeLimit:     int(timeLimit.Seconds()),
+			IsInteractive: vice,
+		},
+		Config: model.StepConfig{
+			Params: params,
+			Inputs: inputs,
+		},
+		Type:        executionTarget,
+		StdoutPath:  "logs/condor-stdout-0",
+		StderrPath:  "logs/condor-stderr-0",
+		LogFile:     "logs/logs-stdout-output",
+		Environment: environment,
+		Input:       inputs,
+	}
+
+	job := &model.Job{
+		AppDescription:  d.Description,
+		AppID:           appID,
+		AppName:         appName,
+		Description:     d.Description,
+		Email:           fmt.Sprintf("%s@example.org", user),
+		ExecutionTarget: executionTarget,
+		InvocationID:    g.newID(),
+		IRODSBase:       defaultIRODSBase,
+		Name:            name,
+		Notify:          true,
+		NowDate:         nowDate,
+		OutputDir:       path.Join(userHome, "analyses", fmt.Sprintf("%s-%s", name, nowDate)),
+		RequestType:     "submit",
+		Steps:           []model.Step{step},
+		SubmissionDate:  submitted.Format(time.RFC3339),
+		Submitter:       user + g.userSuffix(),
+		Type:            componentType,
+		UserID:          userID,
+		UserGroups:      []string{},
+		UserHome:        userHome,
+		DateSubmitted:   submitted,
+	}
+
+	return job, nil
+}
+
+// GenerateAll reads the descriptors from r and returns the generated jobs.
+func (g *Generator) GenerateAll(r io.Reader) ([]*model.Job, error) {
+	descriptors, err := Load(r)
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := make([]*model.Job, 0, len(descriptors))
+	for idx, d := range descriptors {
+		job, err := g.Generate(d)
+		if err != nil {
+			return nil, errors.Wrapf(err, "descriptor %d", idx+1)
+		}
+		jobs = append(jobs, job)
+	}
+
+	return jobs, nil
+}
+
+// GenerateBytes is a convenience wrapper around GenerateAll for descriptors
+// that are already in memory, such as those embedded in tests.
+func (g *Generator) GenerateBytes(data []byte) ([]*model.Job, error) {
+	return g.GenerateAll(bytes.NewReader(data))
+}
+
+// entryPoint encodes the entry point the way the VICE spec builder expects
+// it. A single element is used as is and anything longer is written as a JSON
+// array, which is run in exec form.
+func entryPoint(command []string) (string, error) {
+	switch len(command) {
+	case 0:
+		return "", nil
+	case 1:
+		return command[0], nil
+	}
+	encoded, err := json.Marshal(command)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to encode the entry point")
+	}
+	return string(encoded), nil
+}
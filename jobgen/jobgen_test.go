@@ -0,0 +1,128 @@
+package jobgen
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testGenerator() *Generator {
+	var n int
+	return &Generator{
+		Now: func() time.Time {
+			return time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+		},
+		NewID: func() string {
+			n++
+			return fmt.Sprintf("00000000-0000-0000-0000-%012d", n)
+		},
+	}
+}
+
+func TestGenerateFromDescriptors(t *testing.T) {
+	assert := assert.New(t)
+
+	f, err := os.Open("testdata/descriptors.yml")
+	if !assert.NoError(err) {
+		return
+	}
+	defer f.Close()
+
+	jobs, err := testGenerator().GenerateAll(f)
+	if !assert.NoError(err) || !assert.Len(jobs, 2) {
+		return
+	}
+
+	vice := jobs[0]
+	assert.Equal("interapps", vice.ExecutionTarget)
+	assert.Equal("ipcdev@iplantcollaborative.org", vice.Submitter)
+	assert.Equal("/iplant/home/ipcdev/analyses/jupyter-gpu-2024-03-01-12-00-00.000", vice.OutputDirectory())
+
+	container := vice.Steps[0].Component.Container
+	assert.True(vice.Steps[0].Component.IsInteractive)
+	assert.Equal("harbor.cyverse.org/vice/jupyter/pytorch", container.Image.Name)
+	assert.Equal("2.1", container.Image.Tag)
+	assert.Equal(8888, container.Ports[0].ContainerPort)
+	assert.Equal(float32(2), container.MinCPUCores)
+	assert.Equal(int64(16*1024*1024*1024), container.MemoryLimit)
+	assert.Equal(72*60*60, vice.Steps[0].Component.TimeLimit)
+	assert.Len(container.VolumesFrom, 1)
+	assert.Equal("ref", container.VolumesFrom[0].NamePrefix)
+
+	var gpu, shm bool
+	for _, device := range container.Devices {
+		if strings.HasPrefix(device.HostPath, "/dev/nvidia") {
+			gpu = true
+		}
+		if device.HostPath == sharedMemoryDevice {
+			shm = device.ContainerPath == "2Gi"
+		}
+	}
+	assert.True(gpu, "the GPU devices should be requested")
+	assert.True(shm, "the shared memory size should be set")
+
+	inputs := vice.Inputs()
+	assert.Len(inputs, 2)
+	assert.Equal("FolderInput", inputs[1].Type)
+	assert.Equal("reference", inputs[1].Name)
+
+	batch := jobs[1]
+	assert.Equal("condor", batch.ExecutionTarget)
+	assert.Equal("wc", batch.Steps[0].Component.Container.EntryPoint)
+	assert.Equal("latest", batch.Steps[0].Component.Container.Image.Tag)
+	assert.Len(batch.Steps[0].Config.Params, 2)
+	assert.Len(batch.FilterInputsWithTickets(), 1)
+}
+
+func TestGenerateEntryPoint(t *testing.T) {
+	assert := assert.New(t)
+
+	g := testGenerator()
+
+	job, err := g.Generate(&Descriptor{EntryPoint: []string{"/usr/bin/env"}})
+	assert.NoError(err)
+	assert.Equal("/usr/bin/env", job.Steps[0].Component.Container.EntryPoint)
+
+	job, err = g.Generate(&Descriptor{EntryPoint: []string{"python", "-c", `print("it's quoted")`}})
+	assert.NoError(err)
+	assert.Equal(`["python","-c","print(\"it's quoted\")"]`, job.Steps[0].Component.Container.EntryPoint)
+}
+
+func TestGenerateErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	g := testGenerator()
+
+	_, err := g.Generate(&Descriptor{Kind: "bogus"})
+	assert.Error(err)
+
+	_, err = g.Generate(&Descriptor{MinMemory: "lots"})
+	assert.Error(err)
+
+	_, err = g.Generate(&Descriptor{TimeLimit: "forever"})
+	assert.Error(err)
+
+	_, err = g.GenerateBytes([]byte("nmae: typo\n"))
+	assert.Error(err, "unknown fields should be rejected")
+}
+
+func TestSplitImage(t *testing.T) {
+	tests := []struct {
+		image, name, tag string
+	}{
+		{"discoenv/word-count", "discoenv/word-count", "latest"},
+		{"discoenv/word-count:1.0", "discoenv/word-count", "1.0"},
+		{"registry:5000/word-count", "registry:5000/word-count", "latest"},
+		{"registry:5000/word-count:2", "registry:5000/word-count", "2"},
+	}
+
+	for _, tt := range tests {
+		name, tag := splitImage(tt.image)
+		assert.Equal(t, tt.name, name, tt.image)
+		assert.Equal(t, tt.tag, tag, tt.image)
+	}
+}
@@ -0,0 +1,400 @@
+// Package kuberetry retries calls to the k8s API that fail because the API
+// server is briefly unavailable, such as during control plane upgrades. It
+// wraps the transport of the k8s client configuration, so every clientset
+// created from the configuration gets the same policy.
+//
+// Failed calls are retried with exponential backoff. Calls that may have
+// reached the API server are only retried if they can be repeated safely.
+// After enough calls in a row have failed, a circuit breaker fails calls
+// immediately until a cooldown passes, rather than piling more requests onto
+// a struggling API server. Calls that still fail return an *UnavailableError,
+// which the HTTP handlers turn into a 503 with a Retry-After header. Streams,
+// such as commands run in pods, are passed through untouched.
+package kuberetry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// Config contains the retry policy for k8s API calls.
+type Config struct {
+	// MaxAttempts is the most times a call is made, including the first
+	// attempt.
+	MaxAttempts int
+
+	// InitialBackoff is how long to wait before the first retry. The wait
+	// doubles after each retry.
+	InitialBackoff time.Duration
+
+	// MaxBackoff limits how long to wait between retries.
+	MaxBackoff time.Duration
+
+	// RequestTimeout is the deadline for calls that don't already have one.
+	// Watches and streams, such as commands run in pods, never get a
+	// deadline. No deadline is added if it's zero.
+	RequestTimeout time.Duration
+
+	// BreakerThreshold is the number of calls in a row that have to fail
+	// before the circuit breaker opens. The breaker is disabled if it's zero.
+	BreakerThreshold int
+
+	// BreakerCooldown is how long the circuit breaker stays open.
+	BreakerCooldown time.Duration
+}
+
+// Validate returns an error if the configuration can't be used.
+func (c *Config) Validate() error {
+	if c.MaxAttempts < 1 {
+		return errors.New("the k8s API retry max attempts must be at least 1")
+	}
+	if c.InitialBackoff < 0 || c.MaxBackoff < 0 || c.RequestTimeout < 0 || c.BreakerCooldown < 0 {
+		return errors.New("the k8s API retry durations can't be negative")
+	}
+	if c.BreakerThreshold < 0 {
+		return errors.New("the k8s API circuit breaker threshold can't be negative")
+	}
+	return nil
+}
+
+// UnavailableError is returned for calls that failed because the k8s API was
+// unavailable, after the retries were used up or while the circuit breaker was
+// open.
+type UnavailableError struct {
+	// RetryAfter is how long callers should wait before trying again.
+	RetryAfter time.Duration
+
+	// Err is the error from the last attempt, if one was made.
+	Err error
+}
+
+// Error implements the error interface.
+func (e *UnavailableError) Error() string {
+	if e.Err == nil {
+		return "the k8s API is unavailable"
+	}
+	return fmt.Sprintf("the k8s API is unavailable: %s", e.Err)
+}
+
+// Unwrap returns the error from the last attempt.
+func (e *UnavailableError) Unwrap() error {
+	return e.Err
+}
+
+// AsUnavailable returns the *UnavailableError in the error's chain, if there
+// is one.
+func AsUnavailable(err error) (*UnavailableError, bool) {
+	var unavailable *UnavailableError
+	if errors.As(err, &unavailable) {
+		return unavailable, true
+	}
+	return nil, false
+}
+
+// breaker counts calls that fail in a row and fails calls immediately while
+// it's open. Once the cooldown passes, calls are let through again; the first
+// one that fails reopens the breaker.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+// allow returns zero if a call may be made, or how long the breaker will stay
+// open otherwise.
+func (b *breaker) allow(now time.Time) time.Duration {
+	if b.threshold == 0 {
+		return 0
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if now.Before(b.openUntil) {
+		return b.openUntil.Sub(now)
+	}
+	return 0
+}
+
+// record records the outcome of a call.
+func (b *breaker) record(now time.Time, failed bool) {
+	if b.threshold == 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !failed {
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openUntil = now.Add(b.cooldown)
+	}
+}
+
+// transport applies the retry policy to calls made through the next
+// RoundTripper.
+type transport struct {
+	next    http.RoundTripper
+	config  Config
+	breaker *breaker
+	now     func() time.Time
+	sleep   func(ctx context.Context, d time.Duration) error
+}
+
+// sleepContext waits for the duration or until the context is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// idempotent returns true if the request can be repeated after it may have
+// reached the API server.
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	default:
+		return false
+	}
+}
+
+// connectionFailed returns true if the error means the request never reached
+// the API server, so it's safe to retry any request.
+func connectionFailed(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// unavailableError returns true if a call that failed with the error means
+// the API server may be unavailable.
+func unavailableError(req *http.Request, err error) bool {
+	return connectionFailed(err) || idempotent(req.Method)
+}
+
+// unavailableStatus returns true if a response with the status code means the
+// API server may be unavailable.
+func unavailableStatus(code int) bool {
+	switch code {
+	case http.StatusServiceUnavailable, http.StatusBadGateway, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// retryable returns true if a call that failed because the API server may be
+// unavailable can be made again. Requests that may have reached the API
+// server are only repeated if they don't change anything, since a load
+// balancer or a deadline can fail a request the API server went on to
+// process.
+func retryable(req *http.Request, err error) bool {
+	return idempotent(req.Method) || (err != nil && connectionFailed(err))
+}
+
+// isWatch returns true if the request is a watch, which stays open for as
+// long as the caller wants it to.
+func isWatch(req *http.Request) bool {
+	return req.URL.Query().Get("watch") == "true"
+}
+
+// streamSubresources are the pod subresources whose connections are upgraded
+// to streams.
+var streamSubresources = []string{"/exec", "/attach", "/portforward"}
+
+// isStream returns true if the request opens a stream, such as a command run
+// in a pod, which stays open for as long as the stream is in use. Streams
+// can't be replayed once they've started.
+func isStream(req *http.Request) bool {
+	for _, value := range req.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	for _, subresource := range streamSubresources {
+		if strings.HasSuffix(req.URL.Path, subresource) {
+			return true
+		}
+	}
+	return false
+}
+
+// cancelBody cancels the context of a call when the response body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+// Close implements io.Closer.
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// drain discards the rest of the response body and closes it, so that the
+// connection can be reused.
+func drain(resp *http.Response) {
+	if resp == nil {
+		return
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+// unavailable records the failed call and returns the error for it.
+func (t *transport) unavailable(err error) error {
+	t.breaker.record(t.now(), true)
+
+	retryAfter := t.config.MaxBackoff
+	if wait := t.breaker.allow(t.now()); wait > 0 {
+		retryAfter = wait
+	}
+
+	return &UnavailableError{RetryAfter: retryAfter, Err: err}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if wait := t.breaker.allow(t.now()); wait > 0 {
+		return nil, &UnavailableError{RetryAfter: wait}
+	}
+
+	// Streams are passed through without a deadline or retries.
+	if isStream(req) {
+		return t.next.RoundTrip(req)
+	}
+
+	// The deadline covers every attempt, including the backoff in between.
+	callerCtx := req.Context()
+	ctx, cancel := callerCtx, context.CancelFunc(func() {})
+	if _, ok := ctx.Deadline(); !ok && t.config.RequestTimeout > 0 && !isWatch(req) {
+		ctx, cancel = context.WithTimeout(ctx, t.config.RequestTimeout)
+		req = req.WithContext(ctx)
+	}
+
+	// Requests with bodies can only be retried if the body can be read
+	// again. The requests client-go makes always can.
+	replayable := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+
+	backoff := wait.Backoff{
+		Duration: t.config.InitialBackoff,
+		Factor:   2,
+		Jitter:   0.1,
+		Steps:    t.config.MaxAttempts,
+		Cap:      t.config.MaxBackoff,
+	}
+
+	for attempt := 1; ; attempt++ {
+		attemptReq := req
+		if attempt > 1 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				cancel()
+				return nil, err
+			}
+			attemptReq = req.Clone(ctx)
+			attemptReq.Body = body
+		}
+
+		resp, err := t.next.RoundTrip(attemptReq)
+
+		// Calls the caller gave up on don't say anything about the API
+		// server.
+		if callerCtx.Err() != nil {
+			drain(resp)
+			cancel()
+			if err == nil {
+				err = callerCtx.Err()
+			}
+			return nil, err
+		}
+
+		var failed bool
+		switch {
+		case ctx.Err() != nil:
+			// The request deadline passed.
+			failed = true
+		case err != nil:
+			failed = unavailableError(attemptReq, err)
+		default:
+			failed = unavailableStatus(resp.StatusCode)
+		}
+
+		if !failed {
+			// Errors that aren't retried, such as a 404, mean that the API
+			// server is up.
+			t.breaker.record(t.now(), false)
+			if err != nil {
+				cancel()
+				return nil, err
+			}
+			resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+			return resp, nil
+		}
+
+		if err == nil {
+			err = fmt.Errorf("%s %s returned %s", req.Method, req.URL.Path, resp.Status)
+		}
+		drain(resp)
+
+		delay := backoff.Step()
+		if attempt >= t.config.MaxAttempts || !replayable || !retryable(attemptReq, err) || ctx.Err() != nil {
+			cancel()
+			return nil, t.unavailable(err)
+		}
+
+		if sleepErr := t.sleep(ctx, delay); sleepErr != nil {
+			cancel()
+			if callerCtx.Err() != nil {
+				return nil, callerCtx.Err()
+			}
+			return nil, t.unavailable(err)
+		}
+	}
+}
+
+// WrapTransport returns a function for wrapping the transport of a k8s client
+// configuration so that its calls follow the retry policy. The breaker is
+// shared by every transport the function wraps.
+func WrapTransport(config Config) func(http.RoundTripper) http.RoundTripper {
+	b := &breaker{threshold: config.BreakerThreshold, cooldown: config.BreakerCooldown}
+	return func(rt http.RoundTripper) http.RoundTripper {
+		return &transport{
+			next:    rt,
+			config:  config,
+			breaker: b,
+			now:     time.Now,
+			sleep:   sleepContext,
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package kuberetry
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	apiv1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const configMapJSON = `{"kind":"ConfigMap","apiVersion":"v1","metadata":{"name":"cm","namespace":"vice-apps"}}`
+
+var testConfig = Config{
+	MaxAttempts:      3,
+	InitialBackoff:   time.Millisecond,
+	MaxBackoff:       10 * time.Millisecond,
+	RequestTimeout:   time.Second,
+	BreakerThreshold: 2,
+	BreakerCooldown:  time.Minute,
+}
+
+// testClientset returns a clientset for the server whose calls follow the
+// retry policy. The returned function moves the transport's clock forward.
+func testClientset(t *testing.T, url string, config Config) (kubernetes.Interface, func(time.Duration)) {
+	now := time.Now()
+	restConfig := &rest.Config{Host: url}
+	wrap := WrapTransport(config)
+	restConfig.Wrap(func(rt http.RoundTripper) http.RoundTripper {
+		tr := wrap(rt).(*transport)
+		tr.now = func() time.Time { return now }
+		tr.sleep = func(context.Context, time.Duration) error { return nil }
+		return tr
+	})
+
+	clientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return clientset, func(d time.Duration) { now = now.Add(d) }
+}
+
+// flakyServer returns a server that answers the first failures calls with the
+// status and the rest with a ConfigMap.
+func flakyServer(failures int32, status int) (*httptest.Server, *int32) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if atomic.AddInt32(&calls, 1) <= failures {
+			w.WriteHeader(status)
+			fmt.Fprintf(w, `{"kind":"Status","apiVersion":"v1","status":"Failure","code":%d}`, status)
+			return
+		}
+		w.Write([]byte(configMapJSON)) // nolint:errcheck
+	}))
+	return server, &calls
+}
+
+func TestConfigValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(testConfig.Validate())
+	assert.Error((&Config{}).Validate())
+	assert.Error((&Config{MaxAttempts: 1, InitialBackoff: -time.Second}).Validate())
+	assert.Error((&Config{MaxAttempts: 1, BreakerThreshold: -1}).Validate())
+}
+
+func TestRetriesUnavailableServer(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	server, calls := flakyServer(2, http.StatusServiceUnavailable)
+	defer server.Close()
+
+	clientset, _ := testClientset(t, server.URL, testConfig)
+
+	cm, err := clientset.CoreV1().ConfigMaps("vice-apps").Get(ctx, "cm", metav1.GetOptions{})
+	assert.NoError(err)
+	assert.Equal("cm", cm.Name)
+	assert.Equal(int32(3), atomic.LoadInt32(calls))
+
+	// A load balancer may answer with a 503 after the create reached the API
+	// server, so it isn't repeated.
+	atomic.StoreInt32(calls, 0)
+	_, err = clientset.CoreV1().ConfigMaps("vice-apps").Create(ctx, &apiv1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "cm"},
+	}, metav1.CreateOptions{})
+	_, ok := AsUnavailable(err)
+	assert.True(ok, "unexpected error: %v", err)
+	assert.Equal(int32(1), atomic.LoadInt32(calls))
+}
+
+func TestStreamsArePassedThrough(t *testing.T) {
+	assert := assert.New(t)
+
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if r.URL.Query().Get("fail") == "true" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	config := testConfig
+	config.RequestTimeout = 20 * time.Millisecond
+	rt := WrapTransport(config)(http.DefaultTransport)
+
+	do := func(method, path string, header http.Header) (*http.Response, error) {
+		req, err := http.NewRequest(method, server.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header != nil {
+			req.Header = header
+		}
+		return rt.RoundTrip(req)
+	}
+
+	// Commands run in pods can take longer than the request timeout.
+	resp, err := do(http.MethodPost, "/api/v1/namespaces/vice-apps/pods/p/exec", nil)
+	if assert.NoError(err) {
+		resp.Body.Close()
+		assert.Equal(http.StatusOK, resp.StatusCode)
+	}
+
+	resp, err = do(http.MethodGet, "/api/v1/namespaces/vice-apps/pods/p/log", http.Header{"Connection": {"keep-alive, Upgrade"}})
+	if assert.NoError(err) {
+		resp.Body.Close()
+	}
+
+	// Streams aren't retried either.
+	atomic.StoreInt32(&calls, 0)
+	resp, err = do(http.MethodGet, "/api/v1/namespaces/vice-apps/pods/p/portforward?fail=true", nil)
+	if assert.NoError(err) {
+		resp.Body.Close()
+		assert.Equal(http.StatusServiceUnavailable, resp.StatusCode)
+	}
+	assert.Equal(int32(1), atomic.LoadInt32(&calls))
+
+	// Other calls still get the deadline.
+	_, err = do(http.MethodGet, "/api/v1/namespaces/vice-apps/pods/p", nil)
+	assert.Error(err)
+}
+
+func TestDoesNotRetryOtherErrors(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	server, calls := flakyServer(1, http.StatusInternalServerError)
+	defer server.Close()
+
+	clientset, _ := testClientset(t, server.URL, testConfig)
+
+	_, err := clientset.CoreV1().ConfigMaps("vice-apps").Get(ctx, "cm", metav1.GetOptions{})
+	assert.True(apierrors.IsInternalError(err))
+	assert.Equal(int32(1), atomic.LoadInt32(calls))
+
+	// A create that may have reached the API server isn't repeated.
+	server2, calls2 := flakyServer(1, http.StatusGatewayTimeout)
+	defer server2.Close()
+
+	clientset, _ = testClientset(t, server2.URL, testConfig)
+	_, err = clientset.CoreV1().ConfigMaps("vice-apps").Create(ctx, &apiv1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "cm"},
+	}, metav1.CreateOptions{})
+	assert.Error(err)
+	assert.Equal(int32(1), atomic.LoadInt32(calls2))
+}
+
+func TestUnavailableAndBreaker(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	server, calls := flakyServer(1000, http.StatusServiceUnavailable)
+	defer server.Close()
+
+	clientset, advance := testClientset(t, server.URL, testConfig)
+	get := func() error {
+		_, err := clientset.CoreV1().ConfigMaps("vice-apps").Get(ctx, "cm", metav1.GetOptions{})
+		return err
+	}
+
+	// Every attempt is used before giving up.
+	err := get()
+	unavailable, ok := AsUnavailable(err)
+	if assert.True(ok, "unexpected error: %v", err) {
+		assert.Equal(testConfig.MaxBackoff, unavailable.RetryAfter)
+	}
+	assert.Equal(int32(3), atomic.LoadInt32(calls))
+
+	// The second failed call opens the breaker, so the third call fails
+	// without reaching the server.
+	err = get()
+	unavailable, ok = AsUnavailable(err)
+	if assert.True(ok) {
+		assert.Equal(testConfig.BreakerCooldown, unavailable.RetryAfter)
+	}
+	assert.Equal(int32(6), atomic.LoadInt32(calls))
+
+	_, ok = AsUnavailable(get())
+	assert.True(ok)
+	assert.Equal(int32(6), atomic.LoadInt32(calls))
+
+	// Calls go through again once the cooldown passes.
+	advance(testConfig.BreakerCooldown)
+	atomic.StoreInt32(calls, 998)
+	assert.NoError(get())
+	assert.Equal(int32(1001), atomic.LoadInt32(calls))
+}
+
+func TestConnectionRefused(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.NotFoundHandler())
+	url := server.URL
+	server.Close()
+
+	config := testConfig
+	config.BreakerThreshold = 0
+	clientset, _ := testClientset(t, url, config)
+
+	// Nothing reached the server, so even creates are retried before the
+	// call fails.
+	_, err := clientset.CoreV1().ConfigMaps("vice-apps").Create(context.Background(), &apiv1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "cm"},
+	}, metav1.CreateOptions{})
+	_, ok := AsUnavailable(err)
+	assert.True(ok, "unexpected error: %v", err)
+}
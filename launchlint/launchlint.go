@@ -0,0 +1,160 @@
+// Package launchlint checks job submissions against an app-exposer's launch
+// validation endpoint, so that tool integrators can find every problem with a
+// submission before launching it.
+package launchlint
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/cyverse-de/app-exposer/internal"
+	"github.com/cyverse-de/model/v6"
+	"github.com/pkg/errors"
+)
+
+// validatePath is the path of the launch validation endpoint.
+const validatePath = "/vice/launch/validate"
+
+// Result is the outcome of validating a submission.
+type Result struct {
+	Name         string `json:"name"`
+	InvocationID string `json:"uuid"`
+
+	// Validation is nil if the submission couldn't be validated, in which
+	// case Error says why.
+	Validation *internal.LaunchValidation `json:"validation,omitempty"`
+	Error      string                     `json:"error,omitempty"`
+}
+
+// valid returns true if the submission was validated and has no problems.
+func (r *Result) valid() bool {
+	return r.Validation != nil && r.Validation.Valid
+}
+
+// Linter validates submissions with an app-exposer. Nothing is launched.
+type Linter struct {
+	Client *http.Client
+
+	// URL is the base URL of the app-exposer.
+	URL string
+}
+
+// Validate posts the submission to the app-exposer's launch validation
+// endpoint and returns the problems it found.
+func (l *Linter) Validate(ctx context.Context, job *model.Job) (*internal.LaunchValidation, error) {
+	body, err := json.Marshal(job)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(l.URL, "/")+validatePath, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := l.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("POST %s returned %s: %s", validatePath, resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	validation := &internal.LaunchValidation{}
+	if err = json.NewDecoder(resp.Body).Decode(validation); err != nil {
+		return nil, errors.Wrapf(err, "unable to parse the response to POST %s", validatePath)
+	}
+	return validation, nil
+}
+
+// ValidateAll validates each of the submissions. It never fails; the
+// submissions that couldn't be validated have errors in their results.
+func (l *Linter) ValidateAll(ctx context.Context, jobs []*model.Job) []*Result {
+	results := make([]*Result, len(jobs))
+	for idx, job := range jobs {
+		result := &Result{Name: job.Name, InvocationID: job.InvocationID}
+		validation, err := l.Validate(ctx, job)
+		if err != nil {
+			result.Error = err.Error()
+		} else {
+			result.Validation = validation
+		}
+		results[idx] = result
+	}
+	return results
+}
+
+// WriteReport writes a line with the outcome of each validation, followed by
+// a line for each problem found and the checks that were skipped.
+func WriteReport(w io.Writer, results []*Result) error {
+	for _, r := range results {
+		var err error
+		switch {
+		case r.Validation == nil:
+			_, err = fmt.Fprintf(w, "%s (%s): error: %s\n", r.Name, r.InvocationID, r.Error)
+		case r.Validation.Valid:
+			_, err = fmt.Fprintf(w, "%s (%s): ok\n", r.Name, r.InvocationID)
+		default:
+			_, err = fmt.Fprintf(w, "%s (%s): %d problem(s)\n", r.Name, r.InvocationID, len(r.Validation.Problems))
+		}
+		if err != nil {
+			return err
+		}
+		if r.Validation == nil {
+			continue
+		}
+
+		for _, problem := range r.Validation.Problems {
+			line := fmt.Sprintf("  %s: %s", problem.Check, problem.Message)
+			if problem.ErrorCode != "" {
+				line += fmt.Sprintf(" [%s]", problem.ErrorCode)
+			}
+			if _, err = fmt.Fprintln(w, line); err != nil {
+				return err
+			}
+			if problem.Details == nil {
+				continue
+			}
+			details, err := json.Marshal(*problem.Details)
+			if err != nil {
+				return err
+			}
+			if _, err = fmt.Fprintf(w, "    %s\n", details); err != nil {
+				return err
+			}
+		}
+
+		if len(r.Validation.Skipped) > 0 {
+			if _, err = fmt.Fprintf(w, "  skipped: %s\n", strings.Join(r.Validation.Skipped, ", ")); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// WriteJSON writes the results as an indented JSON array.
+func WriteJSON(w io.Writer, results []*Result) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(results)
+}
+
+// Valid returns true if every submission was validated and has no problems.
+func Valid(results []*Result) bool {
+	for _, r := range results {
+		if !r.valid() {
+			return false
+		}
+	}
+	return true
+}
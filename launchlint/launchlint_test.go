@@ -0,0 +1,74 @@
+package launchlint
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cyverse-de/model/v6"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateAll(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != validatePath {
+			http.NotFound(w, r)
+			return
+		}
+
+		job := &model.Job{}
+		if err := json.NewDecoder(r.Body).Decode(job); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		switch job.Name {
+		case "good":
+			w.Write([]byte(`{"valid": true, "problems": [], "skipped": ["cluster-dry-run"]}`)) // nolint:errcheck
+		case "bad":
+			w.Write([]byte(`{"valid": false, "problems": [
+				{"check": "image-access", "message": "image discoenv/missing:latest doesn't exist", "error_code": "ERR_IMAGE_NOT_FOUND"},
+				{"check": "entry-point", "message": "the container doesn't have an entry point", "details": {"image": "discoenv/missing"}}
+			], "skipped": ["deployment-policy", "cluster-dry-run"]}`)) // nolint:errcheck
+		default:
+			http.Error(w, "database unavailable", http.StatusInternalServerError)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	linter := &Linter{Client: server.Client(), URL: server.URL + "/"}
+	results := linter.ValidateAll(context.Background(), []*model.Job{
+		{Name: "good", InvocationID: "1"},
+		{Name: "bad", InvocationID: "2"},
+		{Name: "broken", InvocationID: "3"},
+	})
+	if !assert.Len(results, 3) {
+		return
+	}
+
+	assert.True(results[0].valid())
+	assert.False(results[1].valid())
+	assert.Len(results[1].Validation.Problems, 2)
+	assert.Nil(results[2].Validation)
+	assert.Contains(results[2].Error, "database unavailable")
+	assert.False(Valid(results))
+	assert.True(Valid(results[:1]))
+
+	buf := &bytes.Buffer{}
+	assert.NoError(WriteReport(buf, results))
+	assert.Equal(`good (1): ok
+  skipped: cluster-dry-run
+bad (2): 2 problem(s)
+  image-access: image discoenv/missing:latest doesn't exist [ERR_IMAGE_NOT_FOUND]
+  entry-point: the container doesn't have an entry point
+    {"image":"discoenv/missing"}
+  skipped: deployment-policy, cluster-dry-run
+broken (3): error: POST /vice/launch/validate returned 500 Internal Server Error: database unavailable
+`, buf.String())
+}
@@ -4,11 +4,15 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/knadh/koanf"
@@ -18,6 +22,10 @@ import (
 
 	"github.com/cyverse-de/app-exposer/apps"
 	"github.com/cyverse-de/app-exposer/common"
+	"github.com/cyverse-de/app-exposer/dbrouter"
+	"github.com/cyverse-de/app-exposer/faults"
+	"github.com/cyverse-de/app-exposer/internal"
+	"github.com/cyverse-de/app-exposer/kuberetry"
 	"github.com/cyverse-de/go-mod/cfg"
 	"github.com/cyverse-de/go-mod/gotelnats"
 	"github.com/cyverse-de/go-mod/logging"
@@ -84,6 +92,7 @@ func main() {
 		checkResourceAccessService    = flag.String("check-resource-access-service", "check-resource-access", "The name of the service that validates whether a user can access a resource")
 		userSuffix                    = flag.String("user-suffix", "@iplantcollaborative.org", "The user suffix for all users in the DE installation")
 		logLevel                      = flag.String("log-level", "warn", "One of trace, debug, info, warn, error, fatal, or panic.")
+		logFormat                     = flag.String("log-format", "text", "The format of the log output, either text or json.")
 	)
 
 	var tracerCtx, cancel = context.WithCancel(context.Background())
@@ -107,6 +116,15 @@ func main() {
 
 	flag.Parse()
 	logging.SetupLogging(*logLevel)
+	switch *logFormat {
+	case "text":
+	case "json":
+		logrus.SetFormatter(&logrus.JSONFormatter{TimestampFormat: time.RFC3339Nano})
+	default:
+		log.Fatalf("unknown log format %q; must be text or json", *logFormat)
+	}
+	logrus.AddHook(common.ContextHook{BaggageFields: internal.LogBaggageFields})
+	logrus.AddHook(common.RedactHook{})
 
 	nats.RegisterEncoder("protojson", protobufjson.NewCodec(protobufjson.WithEmitUnpopulated()))
 
@@ -117,13 +135,14 @@ func main() {
 		log.Fatal(*configPath)
 	}
 
-	c, err = cfg.Init(&cfg.Settings{
+	configSettings := &cfg.Settings{
 		EnvPrefix:   *envPrefix,
 		ConfigPath:  *configPath,
 		DotEnvPath:  *dotEnvPath,
 		StrictMerge: false,
 		FileType:    cfg.YAML,
-	})
+	}
+	c, err = cfg.Init(configSettings)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -184,6 +203,26 @@ func main() {
 
 	config.Wrap(wrapOtelTransport)
 
+	if c.Bool("k8s.api-retry.enabled") {
+		retryConfig := kuberetry.Config{
+			MaxAttempts:      c.Int("k8s.api-retry.max-attempts"),
+			InitialBackoff:   c.Duration("k8s.api-retry.initial-backoff"),
+			MaxBackoff:       c.Duration("k8s.api-retry.max-backoff"),
+			RequestTimeout:   c.Duration("k8s.api-retry.request-timeout"),
+			BreakerThreshold: c.Int("k8s.api-retry.breaker-threshold"),
+			BreakerCooldown:  c.Duration("k8s.api-retry.breaker-cooldown"),
+		}
+		if err = retryConfig.Validate(); err != nil {
+			log.Fatal(err)
+		}
+		config.Wrap(kuberetry.WrapTransport(retryConfig))
+	}
+
+	if c.Bool("vice.test-mode.enabled") {
+		log.Warnf("test mode is enabled; faults requested in the %s header will be injected into k8s API calls", faults.Header)
+		config.Wrap(faults.WrapTransport(c.Duration("vice.test-mode.fault-timeout")))
+	}
+
 	clientset, err := kubernetes.NewForConfig(config)
 	if err != nil {
 		log.Fatal(errors.Wrap(err, "error creating clientset from config"))
@@ -199,7 +238,23 @@ func main() {
 
 	dbURI := c.String("db.uri")
 	db = otelsqlx.MustConnect("postgres", dbURI,
-		otelsql.WithAttributes(semconv.DBSystemPostgreSQL))
+		otelsql.WithAttributes(semconv.DBSystemPostgreSQL),
+		otelsql.WithMeterProvider(newDBMeterProvider("primary")))
+	defer db.Close() // nolint:errcheck
+
+	// The read replica is opened lazily so that app-exposer can start while
+	// it's down. Reads fall back to the primary until it's available.
+	var replica *sqlx.DB
+	if replicaURI := c.String("db.read-replica.uri"); replicaURI != "" {
+		replica, err = otelsqlx.Open("postgres", replicaURI,
+			otelsql.WithAttributes(semconv.DBSystemPostgreSQL),
+			otelsql.WithMeterProvider(newDBMeterProvider("replica")))
+		if err != nil {
+			log.Fatal(errors.Wrap(err, "error opening the read replica"))
+		}
+		defer replica.Close() // nolint:errcheck
+	}
+	dbRouter := dbrouter.New(db, replica, c.Duration("db.read-replica.cooldown"))
 
 	log.Infof("NATS TLS cert file is %s", *tlsCert)
 	log.Infof("NATS TLS key file is %s", *tlsKey)
@@ -215,18 +270,31 @@ func main() {
 		GetAnalysisIDService:          *getAnalysisIDService,
 		CheckResourceAccessService:    *checkResourceAccessService,
 		db:                            db,
+		dbRouter:                      dbRouter,
 		UserSuffix:                    *userSuffix,
 		IRODSZone:                     zone,
 		IngressClass:                  *ingressClass,
 		ClientSet:                     clientset,
+		RESTConfig:                    config,
 		NATSCluster:                   natsCluster,
 		NATSTLSKey:                    *tlsKey,
 		NATSTLSCert:                   *tlsCert,
 		NATSTLSCA:                     *caCert,
 		NATSCredsFilePath:             *credsPath,
+		LoadConfig: func() (*koanf.Koanf, error) {
+			return cfg.Init(configSettings)
+		},
 	}
 
 	a := apps.NewApps(db, *userSuffix)
+	a.UseRouter(dbRouter)
+	if c.Bool("apps.cache.enabled") {
+		a.ConfigureCache(&apps.CacheConfig{
+			MaxEntries:    c.Int("apps.cache.max-entries"),
+			AnalysisIDTTL: c.Duration("apps.cache.analysis-id-ttl"),
+			UserIPTTL:     c.Duration("apps.cache.user-ip-ttl"),
+		})
+	}
 	go a.Run()
 	defer a.Finish()
 	app := NewExposerApp(
@@ -234,6 +302,116 @@ func main() {
 		a,
 		c,
 	)
+
+	// The deferred calls tear everything down in the reverse of the order it
+	// was set up in, once the HTTP server has shut down.
+	shutdownConfig := shutdownConfigFromKoanf(c)
+	defer drainNATS(app.internal.NATSEncodedConn.Conn, shutdownConfig.Timeout)
+
+	workerCtx, cancelWorkers := context.WithCancel(context.Background())
+	defer cancelWorkers()
+	go app.internal.RunStatusOutbox(workerCtx)
+
+	if c.Bool("vice.eviction-saver.enabled") {
+		go app.internal.RunEvictionSaver(workerCtx)
+	}
+
+	if c.Bool("vice.image-pull-recorder.enabled") {
+		go app.internal.RunImagePullRecorder(workerCtx)
+	}
+
+	if c.Bool("vice.ephemeral-storage-monitor.enabled") {
+		go app.internal.RunEphemeralStorageMonitor(workerCtx)
+	}
+
+	if c.Bool("vice.deletion-reaper.enabled") {
+		go app.internal.RunDeletionReaper(workerCtx)
+	}
+
+	if c.Bool("vice.orphan-reconciler.enabled") {
+		go app.internal.RunOrphanReconciler(workerCtx)
+	}
+
+	if c.Bool("vice.history-retention.enabled") {
+		go app.internal.RunHistoryPruner(workerCtx)
+	}
+
+	if c.Bool("vice.startup-monitor.enabled") {
+		go app.internal.RunStartupMonitor(workerCtx)
+	}
+
+	if c.Bool("vice.time-limit-warnings.enabled") {
+		go app.internal.RunTimeLimitWarner(workerCtx)
+	}
+
+	if c.Bool("vice.time-limits.enabled") {
+		go app.internal.RunTimeLimitEnforcer(workerCtx)
+	}
+
+	if c.String("vice.pull-secrets.source-name") != "" {
+		go app.internal.RunPullSecretSync(workerCtx)
+	}
+
+	if c.Bool("apps.cache.enabled") {
+		if subject := c.String("apps.cache.invalidation-subject"); subject != "" {
+			sub, err := a.ListenForInvalidations(app.internal.NATSEncodedConn.Conn, subject)
+			if err != nil {
+				log.Fatal(errors.Wrap(err, "unable to subscribe to cache invalidations"))
+			}
+			defer sub.Drain() // nolint:errcheck
+		}
+
+		go func() {
+			if err := app.internal.WarmLookupCaches(workerCtx); err != nil {
+				log.Error(errors.Wrap(err, "unable to warm the lookup caches"))
+			}
+		}()
+	}
+
+	if c.Bool("vice.commands.enabled") {
+		sub, err := app.internal.ListenForCommands()
+		if err != nil {
+			log.Fatal(errors.Wrap(err, "unable to subscribe to analysis commands"))
+		}
+		defer sub.Drain() // nolint:errcheck
+	}
+
+	if natsAPIConfig := natsAPIConfigFromKoanf(c); natsAPIConfig.Enabled {
+		natsAPI := NewNATSAPI(natsAPIConfig, app.router)
+		sub, err := natsAPI.Subscribe(app.internal.NATSEncodedConn.Conn)
+		if err != nil {
+			log.Fatal(errors.Wrap(err, "unable to subscribe to the NATS API subjects"))
+		}
+		defer func() {
+			sub.Drain() // nolint:errcheck
+			natsAPI.Wait()
+		}()
+	}
+
+	// SIGHUP reloads the settings that can be changed without a restart.
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		for range hangups {
+			if _, err := app.ReloadConfig(); err != nil {
+				log.Error(errors.Wrap(err, "unable to reload the configuration"))
+			}
+		}
+	}()
+
+	// SIGTERM, which Kubernetes sends before stopping the pod, and SIGINT
+	// start a graceful shutdown.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%s", strconv.Itoa(*listenPort)))
+	if err != nil {
+		log.Fatal(err)
+	}
+	server := &http.Server{Handler: app.router}
+
 	log.Printf("listening on port %d", *listenPort)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", strconv.Itoa(*listenPort)), app.router))
+	if err = serve(ctx, server, listener, shutdownConfig, app.health.SetDraining); err != nil {
+		log.Error(err)
+	}
 }
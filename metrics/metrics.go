@@ -0,0 +1,125 @@
+// Package metrics holds the Prometheus registry app-exposer's metrics are
+// created in and serves it at /metrics, so that Prometheus can scrape
+// app-exposer and ops can alert on it.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/sirupsen/logrus"
+)
+
+var log = common.Log.WithFields(logrus.Fields{"package": "metrics"})
+
+// Registry is the registry that app-exposer's metrics are created in and
+// that /metrics serves. It includes the Go runtime and process metrics.
+var Registry = prometheus.NewRegistry()
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// NewCounterVec creates a counter in the registry. Like the rest of the
+// metrics, it's meant to be created when a package is initialized, and it
+// panics if the registry already has a metric with the name.
+func NewCounterVec(name, help string, labels ...string) *prometheus.CounterVec {
+	return promauto.With(Registry).NewCounterVec(prometheus.CounterOpts{
+		Name: name,
+		Help: help,
+	}, labels)
+}
+
+// NewHistogramVec creates a histogram in the registry with the buckets'
+// upper bounds. prometheus.DefBuckets are used if there are none. It panics
+// if the registry already has a metric with the name.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *prometheus.HistogramVec {
+	return promauto.With(Registry).NewHistogramVec(prometheus.HistogramOpts{
+		Name:    name,
+		Help:    help,
+		Buckets: buckets,
+	}, labels)
+}
+
+// Inc adds one to the counter with the label values, which must be given in
+// the same order as the label names.
+func Inc(c *prometheus.CounterVec, labelValues ...string) {
+	Add(c, 1, labelValues...)
+}
+
+// Add adds a value to the counter with the label values. Mistakes such as the
+// wrong number of label values or a negative value are logged rather than
+// failing the request that's being counted.
+func Add(c *prometheus.CounterVec, value float64, labelValues ...string) {
+	if value < 0 {
+		log.Errorf("counters can't be decreased, not adding %g", value)
+		return
+	}
+	counter, err := c.GetMetricWithLabelValues(labelValues...)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	counter.Add(value)
+}
+
+// Observe adds a value to the histogram with the label values. Mistakes are
+// logged rather than failing the request that's being measured.
+func Observe(h *prometheus.HistogramVec, value float64, labelValues ...string) {
+	observer, err := h.GetMetricWithLabelValues(labelValues...)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	observer.Observe(value)
+}
+
+// CounterValue returns the current value of the counter with the label
+// values, or zero if it can't be read.
+func CounterValue(c *prometheus.CounterVec, labelValues ...string) float64 {
+	counter, err := c.GetMetricWithLabelValues(labelValues...)
+	if err != nil {
+		return 0
+	}
+	m := &dto.Metric{}
+	if err = counter.Write(m); err != nil {
+		return 0
+	}
+	return m.GetCounter().GetValue()
+}
+
+// HistogramCount returns the number of values observed by the histogram with
+// the label values, or zero if it can't be read.
+func HistogramCount(h *prometheus.HistogramVec, labelValues ...string) uint64 {
+	observer, err := h.GetMetricWithLabelValues(labelValues...)
+	if err != nil {
+		return 0
+	}
+	metric, ok := observer.(prometheus.Metric)
+	if !ok {
+		return 0
+	}
+	m := &dto.Metric{}
+	if err = metric.Write(m); err != nil {
+		return 0
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+// Handler returns an http.Handler that serves the registry's metrics. Errors
+// gathering the metrics are logged, and the metrics that could be gathered
+// are still served.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{
+		ErrorLog:      log,
+		ErrorHandling: promhttp.ContinueOnError,
+	})
+}
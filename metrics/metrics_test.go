@@ -0,0 +1,73 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCounterVec(t *testing.T) {
+	assert := assert.New(t)
+
+	decisions := NewCounterVec("test_decisions_total", "Decisions made.", "decision", "reason")
+
+	Inc(decisions, "denied", "concurrent-limit")
+	Inc(decisions, "denied", "concurrent-limit")
+	Add(decisions, 3, "allowed", `quoted "reason"`)
+
+	assert.Equal(float64(2), CounterValue(decisions, "denied", "concurrent-limit"))
+	assert.Equal(float64(0), CounterValue(decisions, "denied", "cpu-hours"))
+
+	// Mistakes are ignored instead of panicking.
+	assert.NotPanics(func() { Inc(decisions, "denied") })
+	assert.NotPanics(func() { Add(decisions, -1, "denied", "concurrent-limit") })
+	assert.Equal(float64(2), CounterValue(decisions, "denied", "concurrent-limit"))
+
+	// Metrics can't be registered twice.
+	assert.Panics(func() { NewCounterVec("test_decisions_total", "Decisions made again.") })
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.True(strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain; version=0.0.4"))
+	assert.Contains(rec.Body.String(), `# TYPE test_decisions_total counter
+test_decisions_total{decision="allowed",reason="quoted \"reason\""} 3
+test_decisions_total{decision="denied",reason="concurrent-limit"} 2
+`)
+	assert.Contains(rec.Body.String(), "go_goroutines")
+}
+
+func TestHistogramVec(t *testing.T) {
+	assert := assert.New(t)
+
+	latencies := NewHistogramVec("test_duration_seconds", "Durations.", []float64{0.1, 1, 10}, "outcome")
+
+	Observe(latencies, 0.05, "ok")
+	Observe(latencies, 0.1, "ok")
+	Observe(latencies, 2, "ok")
+	Observe(latencies, 30, "failed")
+
+	assert.Equal(uint64(3), HistogramCount(latencies, "ok"))
+	assert.Equal(uint64(0), HistogramCount(latencies, "rejected"))
+	assert.NotPanics(func() { Observe(latencies, 1) })
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Contains(rec.Body.String(), `# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{outcome="failed",le="0.1"} 0
+test_duration_seconds_bucket{outcome="failed",le="1"} 0
+test_duration_seconds_bucket{outcome="failed",le="10"} 0
+test_duration_seconds_bucket{outcome="failed",le="+Inf"} 1
+test_duration_seconds_sum{outcome="failed"} 30
+test_duration_seconds_count{outcome="failed"} 1
+test_duration_seconds_bucket{outcome="ok",le="0.1"} 2
+test_duration_seconds_bucket{outcome="ok",le="1"} 2
+test_duration_seconds_bucket{outcome="ok",le="10"} 3
+test_duration_seconds_bucket{outcome="ok",le="+Inf"} 3
+test_duration_seconds_sum{outcome="ok"} 2.15
+test_duration_seconds_count{outcome="ok"} 3
+`)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/google/uuid"
+	"github.com/knadh/koanf"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// CORSConfig contains the settings for the CORS middleware. CORS headers are
+// only added to responses for the paths listed in Paths, so that browsers can
+// call selected endpoints directly without every endpoint being exposed.
+type CORSConfig struct {
+	Enabled          bool
+	AllowOrigins     []string
+	AllowMethods     []string
+	AllowHeaders     []string
+	AllowCredentials bool
+	MaxAge           int
+
+	// Paths contains patterns in the format used by path.Match, such as
+	// /vice/*/time-limit.
+	Paths []string
+}
+
+// PrefixConfig contains the settings for running app-exposer behind an API
+// gateway that mounts it under a path prefix.
+type PrefixConfig struct {
+	// PathPrefix is a fixed prefix that's removed from request paths.
+	PathPrefix string
+
+	// TrustForwardedPrefix enables removing the prefix sent by the gateway in
+	// the X-Forwarded-Prefix header.
+	TrustForwardedPrefix bool
+}
+
+// headerXForwardedPrefix is the header API gateways use to tell the service
+// the path prefix it's mounted under.
+const headerXForwardedPrefix = "X-Forwarded-Prefix"
+
+// ForwardedPrefixKey is the context key containing the prefix that was
+// removed from the request path, if any.
+const ForwardedPrefixKey = "forwarded-prefix"
+
+func corsConfigFromKoanf(c *koanf.Koanf) *CORSConfig {
+	return &CORSConfig{
+		Enabled:          c.Bool("http.cors.enabled"),
+		AllowOrigins:     c.Strings("http.cors.allow-origins"),
+		AllowMethods:     c.Strings("http.cors.allow-methods"),
+		AllowHeaders:     c.Strings("http.cors.allow-headers"),
+		AllowCredentials: c.Bool("http.cors.allow-credentials"),
+		MaxAge:           c.Int("http.cors.max-age"),
+		Paths:            c.Strings("http.cors.paths"),
+	}
+}
+
+func prefixConfigFromKoanf(c *koanf.Koanf) *PrefixConfig {
+	return &PrefixConfig{
+		PathPrefix:           c.String("http.path-prefix"),
+		TrustForwardedPrefix: c.Bool("http.trust-forwarded-prefix"),
+	}
+}
+
+// matchesAny returns true if the request path matches one of the patterns.
+func matchesAny(patterns []string, requestPath string) bool {
+	for _, pattern := range patterns {
+		if ok, err := path.Match(pattern, requestPath); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// corsMiddleware returns the CORS middleware for the configuration. Requests
+// for paths that aren't listed in the configuration are passed through
+// untouched.
+func corsMiddleware(cfg *CORSConfig) echo.MiddlewareFunc {
+	corsCfg := middleware.CORSConfig{
+		Skipper: func(c echo.Context) bool {
+			return !matchesAny(cfg.Paths, c.Request().URL.Path)
+		},
+		AllowOrigins:     cfg.AllowOrigins,
+		AllowMethods:     cfg.AllowMethods,
+		AllowHeaders:     cfg.AllowHeaders,
+		AllowCredentials: cfg.AllowCredentials,
+		MaxAge:           cfg.MaxAge,
+	}
+
+	if len(corsCfg.AllowMethods) == 0 {
+		corsCfg.AllowMethods = middleware.DefaultCORSConfig.AllowMethods
+	}
+
+	return middleware.CORSWithConfig(corsCfg)
+}
+
+// stripPrefix removes the prefix from the path if the path is under it.
+// Returns the path and true if the prefix was removed.
+func stripPrefix(requestPath, prefix string) (string, bool) {
+	prefix = "/" + strings.Trim(prefix, "/")
+	if prefix == "/" {
+		return requestPath, false
+	}
+
+	if requestPath == prefix {
+		return "/", true
+	}
+
+	if strings.HasPrefix(requestPath, prefix+"/") {
+		return strings.TrimPrefix(requestPath, prefix), true
+	}
+
+	return requestPath, false
+}
+
+// prefixMiddleware removes the gateway's path prefix from request paths
+// before they're routed. Gateways that already strip the prefix before
+// forwarding the request are unaffected, since the path won't start with it.
+func prefixMiddleware(cfg *PrefixConfig) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+
+			prefixes := []string{}
+			if cfg.TrustForwardedPrefix {
+				if forwarded := req.Header.Get(headerXForwardedPrefix); forwarded != "" {
+					prefixes = append(prefixes, forwarded)
+				}
+			}
+			if cfg.PathPrefix != "" {
+				prefixes = append(prefixes, cfg.PathPrefix)
+			}
+
+			for _, prefix := range prefixes {
+				if stripped, ok := stripPrefix(req.URL.Path, prefix); ok {
+					req.URL.Path = stripped
+					req.URL.RawPath = ""
+					c.Set(ForwardedPrefixKey, prefix)
+					break
+				}
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// requestIDRegexp matches the correlation IDs accepted from callers. IDs that
+// don't match are replaced, since they end up in every log line.
+var requestIDRegexp = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// requestIDMiddleware assigns each request a correlation ID, or keeps the one
+// in the caller's X-Request-ID header, and returns it in the response's
+// X-Request-ID header. The ID is added to the request's context so that it's
+// included in the lines logged with log.WithContext(ctx).
+func requestIDMiddleware() echo.MiddlewareFunc {
+	return middleware.RequestIDWithConfig(middleware.RequestIDConfig{
+		Generator: func() string {
+			return uuid.New().String()
+		},
+		RequestIDHandler: func(c echo.Context, requestID string) {
+			req := c.Request()
+			if !requestIDRegexp.MatchString(requestID) {
+				requestID = uuid.New().String()
+				req.Header.Set(echo.HeaderXRequestID, requestID)
+				c.Response().Header().Set(echo.HeaderXRequestID, requestID)
+			}
+			c.SetRequest(req.WithContext(common.WithRequestID(req.Context(), requestID)))
+		},
+	})
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func testRouter(prefix *PrefixConfig, cors *CORSConfig) *echo.Echo {
+	e := echo.New()
+	e.Pre(prefixMiddleware(prefix))
+	e.Use(corsMiddleware(cors))
+	e.GET("/vice/:host/url-ready", func(c echo.Context) error {
+		return c.String(http.StatusOK, "ready")
+	})
+	e.GET("/vice/listing", func(c echo.Context) error {
+		return c.String(http.StatusOK, "listing")
+	})
+	return e
+}
+
+func TestStripPrefix(t *testing.T) {
+	tests := []struct {
+		path, prefix, expected string
+		stripped               bool
+	}{
+		{"/api/vice/listing", "/api", "/vice/listing", true},
+		{"/api/vice/listing", "api/", "/vice/listing", true},
+		{"/api", "/api", "/", true},
+		{"/apis/vice", "/api", "/apis/vice", false},
+		{"/vice/listing", "/", "/vice/listing", false},
+	}
+
+	for _, tt := range tests {
+		path, stripped := stripPrefix(tt.path, tt.prefix)
+		assert.Equal(t, tt.expected, path, tt.path)
+		assert.Equal(t, tt.stripped, stripped, tt.path)
+	}
+}
+
+func TestPrefixMiddleware(t *testing.T) {
+	assert := assert.New(t)
+
+	e := testRouter(&PrefixConfig{TrustForwardedPrefix: true}, &CORSConfig{})
+
+	req := httptest.NewRequest(http.MethodGet, "/app-exposer/vice/listing", nil)
+	req.Header.Set(headerXForwardedPrefix, "/app-exposer")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Equal("listing", rec.Body.String())
+
+	// The header is ignored unless it's trusted.
+	e = testRouter(&PrefixConfig{}, &CORSConfig{})
+	req = httptest.NewRequest(http.MethodGet, "/app-exposer/vice/listing", nil)
+	req.Header.Set(headerXForwardedPrefix, "/app-exposer")
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusNotFound, rec.Code)
+}
+
+func TestCORSMiddleware(t *testing.T) {
+	assert := assert.New(t)
+
+	e := testRouter(&PrefixConfig{}, &CORSConfig{
+		AllowOrigins: []string{"https://de.example.org"},
+		Paths:        []string{"/vice/*/url-ready"},
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/vice/a1234/url-ready", nil)
+	req.Header.Set(echo.HeaderOrigin, "https://de.example.org")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal("https://de.example.org", rec.Header().Get(echo.HeaderAccessControlAllowOrigin))
+
+	// Preflight requests for the selected paths are answered.
+	req = httptest.NewRequest(http.MethodOptions, "/vice/a1234/url-ready", nil)
+	req.Header.Set(echo.HeaderOrigin, "https://de.example.org")
+	req.Header.Set(echo.HeaderAccessControlRequestMethod, http.MethodGet)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusNoContent, rec.Code)
+	assert.NotEmpty(rec.Header().Get(echo.HeaderAccessControlAllowMethods))
+
+	// Other paths don't get CORS headers.
+	req = httptest.NewRequest(http.MethodGet, "/vice/listing", nil)
+	req.Header.Set(echo.HeaderOrigin, "https://de.example.org")
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Empty(rec.Header().Get(echo.HeaderAccessControlAllowOrigin))
+}
+
+func TestRequestIDMiddleware(t *testing.T) {
+	assert := assert.New(t)
+
+	e := echo.New()
+	e.Pre(requestIDMiddleware())
+	e.GET("/vice/listing", func(c echo.Context) error {
+		return c.String(http.StatusOK, common.RequestIDFromContext(c.Request().Context()))
+	})
+
+	// The caller's ID is kept.
+	req := httptest.NewRequest(http.MethodGet, "/vice/listing", nil)
+	req.Header.Set(echo.HeaderXRequestID, "de-ui-1234")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal("de-ui-1234", rec.Body.String())
+	assert.Equal("de-ui-1234", rec.Header().Get(echo.HeaderXRequestID))
+
+	// An ID is generated if the caller didn't send one or sent one that
+	// can't be logged safely.
+	for _, callerID := range []string{"", "bad id\nwith a newline"} {
+		req = httptest.NewRequest(http.MethodGet, "/vice/listing", nil)
+		req.Header.Set(echo.HeaderXRequestID, callerID)
+		rec = httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		assert.Regexp(`^[0-9a-f-]{36}$`, rec.Body.String())
+		assert.Equal(rec.Body.String(), rec.Header().Get(echo.HeaderXRequestID))
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/cyverse-de/app-exposer/internal"
+	"github.com/cyverse-de/go-mod/gotelnats"
+	"github.com/knadh/koanf"
+	"github.com/labstack/echo/v4"
+	"github.com/nats-io/nats.go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+const (
+	defaultNATSAPISubjectPrefix = "cyverse.vice.api"
+	defaultNATSAPIQueue         = "app-exposer"
+)
+
+// NATSAPIConfig contains the settings for serving VICE endpoints over NATS
+// request/reply.
+type NATSAPIConfig struct {
+	Enabled bool
+
+	// SubjectPrefix is prepended to the operation names to get the subjects,
+	// such as cyverse.vice.api.launch.
+	SubjectPrefix string
+
+	// Queue is the queue group shared by the app-exposer replicas, so each
+	// request is only handled once.
+	Queue string
+}
+
+func natsAPIConfigFromKoanf(c *koanf.Koanf) *NATSAPIConfig {
+	cfg := &NATSAPIConfig{
+		Enabled:       c.Bool("vice.nats-api.enabled"),
+		SubjectPrefix: c.String("vice.nats-api.subject-prefix"),
+		Queue:         c.String("vice.nats-api.queue"),
+	}
+	if cfg.SubjectPrefix == "" {
+		cfg.SubjectPrefix = defaultNATSAPISubjectPrefix
+	}
+	if cfg.Queue == "" {
+		cfg.Queue = defaultNATSAPIQueue
+	}
+	return cfg
+}
+
+// natsOperation is the HTTP endpoint that a NATS operation is served by.
+// Path parameters in the path start with a colon, as in the Echo routes.
+type natsOperation struct {
+	method string
+	path   string
+}
+
+// natsOperations maps the operation at the end of each subject to the
+// endpoint it mirrors.
+var natsOperations = map[string]natsOperation{
+	"launch":    {http.MethodPost, "/vice/launch"},
+	"terminate": {http.MethodPost, "/vice/:id/exit"},
+	"status":    {http.MethodGet, "/vice/:host/description"},
+	"listing":   {http.MethodGet, "/vice/listing"},
+}
+
+// NATSAPIRequest is the message sent to one of the NATS API subjects.
+type NATSAPIRequest struct {
+	// Params contains the path parameters of the endpoint, such as id.
+	Params map[string]string `json:"params"`
+
+	// Query contains the query parameters, such as user.
+	Query map[string]string `json:"query"`
+
+	// Body is the request body of the endpoint, if it takes one.
+	Body json.RawMessage `json:"body,omitempty"`
+}
+
+// NATSAPIResponse is the reply to a NATS API request. Status and Body are the
+// HTTP status and response body the endpoint returned.
+type NATSAPIResponse struct {
+	Status int             `json:"status"`
+	Body   json.RawMessage `json:"body,omitempty"`
+}
+
+// natsAPIError returns a reply with the same body that the HTTP error handler
+// would send.
+func natsAPIError(status int, msg string) *NATSAPIResponse {
+	body, _ := json.Marshal(common.ErrorResponse{Message: msg})
+	return &NATSAPIResponse{Status: status, Body: body}
+}
+
+// NATSAPI serves the VICE launch, terminate, status, and listing endpoints
+// over NATS request/reply for DE services that don't speak HTTP. Requests are
+// passed through the HTTP router, so they get the same validation, rate
+// limits, error responses, and metrics as the HTTP endpoints.
+type NATSAPI struct {
+	cfg     *NATSAPIConfig
+	handler http.Handler
+
+	// inFlight tracks the requests that are being handled.
+	inFlight sync.WaitGroup
+}
+
+// NewNATSAPI returns a *NATSAPI that sends requests to handler.
+func NewNATSAPI(cfg *NATSAPIConfig, handler http.Handler) *NATSAPI {
+	return &NATSAPI{
+		cfg:     cfg,
+		handler: handler,
+	}
+}
+
+// operation returns the operation name at the end of subject.
+func (n *NATSAPI) operation(subject string) string {
+	return strings.TrimPrefix(subject, n.cfg.SubjectPrefix+".")
+}
+
+// requestPath fills in the path parameters of the operation's path.
+func requestPath(op natsOperation, params map[string]string) (string, error) {
+	segments := strings.Split(op.path, "/")
+	for idx, segment := range segments {
+		if !strings.HasPrefix(segment, ":") {
+			continue
+		}
+		name := strings.TrimPrefix(segment, ":")
+		value := params[name]
+		if value == "" {
+			return "", fmt.Errorf("params.%s must be set", name)
+		}
+		segments[idx] = url.PathEscape(value)
+	}
+	return strings.Join(segments, "/"), nil
+}
+
+// serve passes the request for the operation to the HTTP handler and returns
+// the reply. The headers of the NATS message, which carry the trace context,
+// are sent along as HTTP headers.
+func (n *NATSAPI) serve(ctx context.Context, operation string, header nats.Header, data []byte) *NATSAPIResponse {
+	op, ok := natsOperations[operation]
+	if !ok {
+		return natsAPIError(http.StatusNotFound, fmt.Sprintf("unknown operation %q", operation))
+	}
+
+	apiReq := &NATSAPIRequest{}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, apiReq); err != nil {
+			return natsAPIError(http.StatusBadRequest, fmt.Sprintf("unable to parse the request: %s", err))
+		}
+	}
+
+	reqPath, err := requestPath(op, apiReq.Params)
+	if err != nil {
+		return natsAPIError(http.StatusBadRequest, err.Error())
+	}
+
+	query := url.Values{}
+	for k, v := range apiReq.Query {
+		query.Set(k, v)
+	}
+	if len(query) > 0 {
+		reqPath = reqPath + "?" + query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, op.method, reqPath, bytes.NewReader(apiReq.Body))
+	if err != nil {
+		return natsAPIError(http.StatusBadRequest, err.Error())
+	}
+	for k, values := range header {
+		for _, v := range values {
+			req.Header.Add(k, v)
+		}
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	if len(apiReq.Body) > 0 {
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	}
+
+	rec := httptest.NewRecorder()
+	n.handler.ServeHTTP(rec, req)
+
+	resp := &NATSAPIResponse{Status: rec.Code}
+	body := bytes.TrimSpace(rec.Body.Bytes())
+	switch {
+	case len(body) == 0:
+	case json.Valid(body):
+		resp.Body = body
+	default:
+		// Plain text responses are sent as JSON strings.
+		resp.Body, _ = json.Marshal(string(body))
+	}
+	return resp
+}
+
+// handle replies to a single request.
+func (n *NATSAPI) handle(msg *nats.Msg) {
+	ctx, span := gotelnats.StartSpan(propagation.HeaderCarrier(msg.Header), msg.Subject, gotelnats.Process)
+	defer span.End()
+
+	resp := n.serve(ctx, n.operation(msg.Subject), msg.Header, msg.Data)
+	data, err := json.Marshal(resp)
+	if err != nil {
+		log.WithContext(ctx).Errorf("unable to encode the reply to %s: %s", msg.Subject, err)
+		return
+	}
+
+	err = msg.Respond(data)
+	internal.RecordNATSPublishError(internal.NATSAPIReply, err)
+	if err != nil {
+		log.WithContext(ctx).Errorf("unable to reply to %s: %s", msg.Subject, err)
+	}
+}
+
+// Subscribe starts handling requests sent to the NATS API subjects. Returns
+// the subscription so the caller can drain it on shutdown.
+func (n *NATSAPI) Subscribe(nc *nats.Conn) (*nats.Subscription, error) {
+	subject := n.cfg.SubjectPrefix + ".*"
+	log.Infof("serving the NATS API on %s in queue group %s", subject, n.cfg.Queue)
+
+	// Launches can take a while, so requests are handled in their own
+	// goroutines.
+	return nc.QueueSubscribe(subject, n.cfg.Queue, func(msg *nats.Msg) {
+		n.inFlight.Add(1)
+		go func() {
+			defer n.inFlight.Done()
+			n.handle(msg)
+		}()
+	})
+}
+
+// Wait blocks until the requests that are being handled have been answered.
+// Call it after the subscription has been drained.
+func (n *NATSAPI) Wait() {
+	n.inFlight.Wait()
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/cyverse-de/app-exposer/common"
+	"github.com/labstack/echo/v4"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+func natsAPITestRouter() *echo.Echo {
+	e := echo.New()
+	e.HTTPErrorHandler = func(err error, c echo.Context) {
+		code := http.StatusInternalServerError
+		if he, ok := err.(*echo.HTTPError); ok {
+			code = he.Code
+		}
+		c.JSON(code, common.NewErrorResponse(err)) // nolint:errcheck
+	}
+	e.POST("/vice/launch", func(c echo.Context) error {
+		body, err := io.ReadAll(c.Request().Body)
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, map[string]string{
+			"content_type": c.Request().Header.Get(echo.HeaderContentType),
+			"body":         string(body),
+		})
+	})
+	e.POST("/vice/:id/exit", func(c echo.Context) error {
+		return nil
+	})
+	e.GET("/vice/:host/description", func(c echo.Context) error {
+		if c.QueryParam("user") == "" {
+			return echo.NewHTTPError(http.StatusBadRequest, "user query parameter must be set")
+		}
+		return c.JSON(http.StatusOK, map[string]string{
+			"host":       c.Param("host"),
+			"user":       c.QueryParam("user"),
+			"request_id": c.Request().Header.Get("X-Request-Id"),
+		})
+	})
+	e.GET("/vice/listing", func(c echo.Context) error {
+		return c.String(http.StatusOK, "listing for "+c.QueryParam("user"))
+	})
+	return e
+}
+
+func TestNATSAPIServe(t *testing.T) {
+	assert := assert.New(t)
+
+	n := NewNATSAPI(&NATSAPIConfig{SubjectPrefix: "cyverse.vice.api"}, natsAPITestRouter())
+	serve := func(subject string, header nats.Header, req string) (*NATSAPIResponse, map[string]string) {
+		resp := n.serve(context.Background(), n.operation(subject), header, []byte(req))
+		body := map[string]string{}
+		json.Unmarshal(resp.Body, &body) // nolint:errcheck
+		return resp, body
+	}
+
+	resp, body := serve("cyverse.vice.api.launch", nil, `{"body": {"username": "ipcdev"}}`)
+	assert.Equal(http.StatusOK, resp.Status)
+	assert.Equal(echo.MIMEApplicationJSON, body["content_type"])
+	assert.JSONEq(`{"username": "ipcdev"}`, body["body"])
+
+	resp, body = serve(
+		"cyverse.vice.api.status",
+		nats.Header{"X-Request-Id": []string{"r1"}},
+		`{"params": {"host": "a1234"}, "query": {"user": "ipcdev"}}`,
+	)
+	assert.Equal(http.StatusOK, resp.Status)
+	assert.Equal(map[string]string{"host": "a1234", "user": "ipcdev", "request_id": "r1"}, body)
+
+	// Errors get the same status and body as over HTTP.
+	resp, body = serve("cyverse.vice.api.status", nil, `{"params": {"host": "a1234"}}`)
+	assert.Equal(http.StatusBadRequest, resp.Status)
+	assert.Contains(body["message"], "user query parameter must be set")
+
+	resp, _ = serve("cyverse.vice.api.terminate", nil, `{"params": {"id": "e1"}}`)
+	assert.Equal(http.StatusOK, resp.Status)
+	assert.Empty(resp.Body)
+
+	// Plain text responses are sent as JSON strings.
+	resp, _ = serve("cyverse.vice.api.listing", nil, `{"query": {"user": "ipcdev"}}`)
+	assert.Equal(http.StatusOK, resp.Status)
+	assert.JSONEq(`"listing for ipcdev"`, string(resp.Body))
+
+	resp, _ = serve("cyverse.vice.api.terminate", nil, `{}`)
+	assert.Equal(http.StatusBadRequest, resp.Status)
+
+	resp, _ = serve("cyverse.vice.api.launch", nil, `not json`)
+	assert.Equal(http.StatusBadRequest, resp.Status)
+
+	resp, _ = serve("cyverse.vice.api.restart", nil, `{}`)
+	assert.Equal(http.StatusNotFound, resp.Status)
+}
+
+func TestRequestPath(t *testing.T) {
+	assert := assert.New(t)
+
+	p, err := requestPath(natsOperations["terminate"], map[string]string{"id": "a/b"})
+	assert.NoError(err)
+	assert.Equal("/vice/a%2Fb/exit", p)
+
+	p, err = requestPath(natsOperations["listing"], nil)
+	assert.NoError(err)
+	assert.Equal("/vice/listing", p)
+
+	_, err = requestPath(natsOperations["status"], map[string]string{})
+	assert.EqualError(err, "params.host must be set")
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/knadh/koanf"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/time/rate"
+)
+
+// RateLimitRule limits the rate of requests to a set of endpoints. Each user
+// and each client IP address gets its own token bucket. A rate of zero
+// disables that limit.
+type RateLimitRule struct {
+	Name string `koanf:"name"`
+
+	// Paths contains patterns in the format used by path.Match, such as
+	// /vice/*/exit.
+	Paths []string `koanf:"paths"`
+
+	// UserRate is the number of requests per second allowed for each user.
+	UserRate  float64 `koanf:"user-rate"`
+	UserBurst int     `koanf:"user-burst"`
+
+	// IPRate is the number of requests per second allowed for each client IP
+	// address.
+	IPRate  float64 `koanf:"ip-rate"`
+	IPBurst int     `koanf:"ip-burst"`
+}
+
+// RateLimitConfig contains the settings for the rate limiting middleware.
+type RateLimitConfig struct {
+	Enabled bool
+
+	// ExpiresIn is how long an idle user's or IP address's bucket is kept.
+	ExpiresIn time.Duration
+
+	Rules []RateLimitRule
+}
+
+func rateLimitConfigFromKoanf(c *koanf.Koanf) (*RateLimitConfig, error) {
+	cfg := &RateLimitConfig{
+		Enabled:   c.Bool("http.rate-limits.enabled"),
+		ExpiresIn: c.Duration("http.rate-limits.expires-in"),
+	}
+	if err := c.Unmarshal("http.rate-limits.rules", &cfg.Rules); err != nil {
+		return nil, err
+	}
+	for _, rule := range cfg.Rules {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("rate limit rules must have names")
+		}
+		if rule.UserRate < 0 || rule.IPRate < 0 || rule.UserBurst < 0 || rule.IPBurst < 0 {
+			return nil, fmt.Errorf("rate limit rule %s has a negative rate or burst", rule.Name)
+		}
+	}
+	return cfg, nil
+}
+
+// rateLimitEntry is a token bucket and the last time it was used.
+type rateLimitEntry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// rateLimitStore contains the token buckets, keyed by rule and by user or IP
+// address. Buckets that haven't been used for a while are removed.
+type rateLimitStore struct {
+	mu          sync.Mutex
+	entries     map[string]*rateLimitEntry
+	expiresIn   time.Duration
+	lastCleanup time.Time
+	now         func() time.Time
+}
+
+func newRateLimitStore(expiresIn time.Duration) *rateLimitStore {
+	if expiresIn <= 0 {
+		expiresIn = 10 * time.Minute
+	}
+	return &rateLimitStore{
+		entries:   map[string]*rateLimitEntry{},
+		expiresIn: expiresIn,
+		now:       time.Now,
+	}
+}
+
+// reserve takes a token from each of the buckets. Returns how long the caller
+// has to wait if any of the buckets is empty, in which case no tokens are
+// taken.
+func (s *rateLimitStore) reserve(keys []string, limits []rate.Limit, bursts []int) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if now.Sub(s.lastCleanup) > s.expiresIn {
+		for key, entry := range s.entries {
+			if now.Sub(entry.lastSeen) > s.expiresIn {
+				delete(s.entries, key)
+			}
+		}
+		s.lastCleanup = now
+	}
+
+	reservations := make([]*rate.Reservation, 0, len(keys))
+	var wait time.Duration
+	for idx, key := range keys {
+		entry, ok := s.entries[key]
+		if !ok {
+			entry = &rateLimitEntry{limiter: rate.NewLimiter(limits[idx], bursts[idx])}
+			s.entries[key] = entry
+		}
+		entry.lastSeen = now
+
+		r := entry.limiter.ReserveN(now, 1)
+		reservations = append(reservations, r)
+		if !r.OK() {
+			wait = time.Duration(math.MaxInt64)
+		} else if delay := r.DelayFrom(now); delay > wait {
+			wait = delay
+		}
+	}
+
+	if wait > 0 {
+		for _, r := range reservations {
+			r.CancelAt(now)
+		}
+	}
+
+	return wait
+}
+
+// requestUser returns the user making the request. Most endpoints take the
+// user in the user query parameter. Launch requests contain the job, so the
+// submitter is read from the body, which is restored for the handler.
+func requestUser(c echo.Context) string {
+	if user := c.QueryParam("user"); user != "" {
+		return user
+	}
+
+	req := c.Request()
+	if req.Method != http.MethodPost || req.Body == nil ||
+		!strings.HasPrefix(req.Header.Get(echo.HeaderContentType), echo.MIMEApplicationJSON) {
+		return ""
+	}
+
+	body, err := io.ReadAll(req.Body)
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return ""
+	}
+
+	var submitter struct {
+		Username string `json:"username"`
+	}
+	if err = json.Unmarshal(body, &submitter); err != nil {
+		return ""
+	}
+	return submitter.Username
+}
+
+// retryAfterSeconds returns the value of the Retry-After header for the wait.
+func retryAfterSeconds(wait time.Duration) int64 {
+	if wait >= time.Duration(math.MaxInt64) {
+		return 60
+	}
+	seconds := int64(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	return seconds
+}
+
+// rateLimiter enforces a set of rate limit rules that can be replaced while
+// app-exposer is running.
+type rateLimiter struct {
+	mu    sync.RWMutex
+	rules []RateLimitRule
+	store *rateLimitStore
+}
+
+// newRateLimiter returns a rate limiter that enforces the rules in the
+// configuration, or none of them if rate limiting is disabled.
+func newRateLimiter(cfg *RateLimitConfig) *rateLimiter {
+	l := &rateLimiter{}
+	l.reload(cfg)
+	return l
+}
+
+// reload replaces the rules with the ones in the configuration. The token
+// buckets are replaced as well, so that the new limits apply right away.
+func (l *rateLimiter) reload(cfg *RateLimitConfig) {
+	var rules []RateLimitRule
+	if cfg.Enabled {
+		rules = cfg.Rules
+	}
+	store := newRateLimitStore(cfg.ExpiresIn)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rules = rules
+	l.store = store
+}
+
+func (l *rateLimiter) current() ([]RateLimitRule, *rateLimitStore) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.rules, l.store
+}
+
+// rateLimitMiddleware returns the middleware that enforces the rate limits.
+// Requests for paths that aren't covered by a rule are passed through
+// untouched. Requests over a limit get a 429 response with a Retry-After
+// header.
+func rateLimitMiddleware(cfg *RateLimitConfig) echo.MiddlewareFunc {
+	l := &rateLimiter{
+		rules: cfg.Rules,
+		store: newRateLimitStore(cfg.ExpiresIn),
+	}
+	return l.middleware()
+}
+
+// middleware returns the middleware that enforces the limiter's current
+// rules.
+func (l *rateLimiter) middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			rules, store := l.current()
+
+			var rule *RateLimitRule
+			for idx := range rules {
+				if matchesAny(rules[idx].Paths, c.Request().URL.Path) {
+					rule = &rules[idx]
+					break
+				}
+			}
+			if rule == nil {
+				return next(c)
+			}
+
+			var (
+				keys   []string
+				limits []rate.Limit
+				bursts []int
+			)
+			if rule.UserRate > 0 {
+				if user := requestUser(c); user != "" {
+					keys = append(keys, fmt.Sprintf("%s/user/%s", rule.Name, user))
+					limits = append(limits, rate.Limit(rule.UserRate))
+					bursts = append(bursts, rule.UserBurst)
+				}
+			}
+			if rule.IPRate > 0 {
+				keys = append(keys, fmt.Sprintf("%s/ip/%s", rule.Name, c.RealIP()))
+				limits = append(limits, rate.Limit(rule.IPRate))
+				bursts = append(bursts, rule.IPBurst)
+			}
+
+			if wait := store.reserve(keys, limits, bursts); wait > 0 {
+				c.Response().Header().Set("Retry-After", fmt.Sprintf("%d", retryAfterSeconds(wait)))
+				return echo.NewHTTPError(http.StatusTooManyRequests, fmt.Sprintf("rate limit exceeded for %s requests", rule.Name))
+			}
+
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func rateLimitTestRouter(cfg *RateLimitConfig) *echo.Echo {
+	e := echo.New()
+	e.Use(rateLimitMiddleware(cfg))
+	e.POST("/vice/launch", func(c echo.Context) error {
+		// The body must still be readable by the handler.
+		body, err := io.ReadAll(c.Request().Body)
+		if err != nil {
+			return err
+		}
+		return c.String(http.StatusOK, string(body))
+	})
+	e.GET("/vice/listing", func(c echo.Context) error {
+		return c.String(http.StatusOK, "listing")
+	})
+	return e
+}
+
+func launchRequest(user, ip string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/vice/launch", strings.NewReader(`{"username":"`+user+`"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.RemoteAddr = ip + ":1234"
+	return req
+}
+
+func TestRateLimitPerUser(t *testing.T) {
+	assert := assert.New(t)
+
+	e := rateLimitTestRouter(&RateLimitConfig{
+		Rules: []RateLimitRule{
+			{Name: "launch", Paths: []string{"/vice/launch"}, UserRate: 0.001, UserBurst: 2},
+		},
+	})
+
+	for n := 0; n < 2; n++ {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, launchRequest("ipcdev", "10.0.0.1"))
+		assert.Equal(http.StatusOK, rec.Code)
+		assert.Equal(`{"username":"ipcdev"}`, rec.Body.String())
+	}
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, launchRequest("ipcdev", "10.0.0.2"))
+	assert.Equal(http.StatusTooManyRequests, rec.Code)
+	assert.NotEmpty(rec.Header().Get("Retry-After"))
+
+	// Other users have their own buckets.
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, launchRequest("other", "10.0.0.1"))
+	assert.Equal(http.StatusOK, rec.Code)
+
+	// Paths without rules aren't limited.
+	for n := 0; n < 5; n++ {
+		rec = httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/vice/listing?user=ipcdev", nil))
+		assert.Equal(http.StatusOK, rec.Code)
+	}
+}
+
+func TestRateLimitPerIP(t *testing.T) {
+	assert := assert.New(t)
+
+	e := rateLimitTestRouter(&RateLimitConfig{
+		Rules: []RateLimitRule{
+			{Name: "listing", Paths: []string{"/vice/listing"}, UserRate: 100, UserBurst: 100, IPRate: 0.001, IPBurst: 1},
+		},
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/vice/listing?user=a", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusOK, rec.Code)
+
+	// A rejected request doesn't use up the user's tokens.
+	req = httptest.NewRequest(http.MethodGet, "/vice/listing?user=b", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusTooManyRequests, rec.Code)
+
+	req = httptest.NewRequest(http.MethodGet, "/vice/listing?user=b", nil)
+	req.RemoteAddr = "10.0.0.2:1234"
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusOK, rec.Code)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cyverse-de/app-exposer/internal"
+	"github.com/cyverse-de/app-exposer/resourcing"
+	"github.com/knadh/koanf"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+)
+
+// reloadableConfigFromKoanf returns the settings that can be changed while
+// app-exposer is running.
+func reloadableConfigFromKoanf(c *koanf.Koanf) (*internal.ReloadableConfig, error) {
+	cfg := &internal.ReloadableConfig{
+		Embedding: internal.EmbeddingConfig{
+			Enabled:               c.Bool("vice.embedding.enabled"),
+			DefaultFrameAncestors: c.Strings("vice.embedding.default-frame-ancestors"),
+		},
+		Maintenance: internal.MaintenanceConfig{
+			Enabled: c.Bool("vice.maintenance.enabled"),
+			Message: c.String("vice.maintenance.message"),
+		},
+		JobStatusURL: c.String("vice.job-status.base"),
+	}
+	if cfg.JobStatusURL == "" {
+		cfg.JobStatusURL = "http://job-status-listener"
+	}
+
+	var resourcePresets resourcing.Presets
+	if err := c.Unmarshal("vice.resource-presets", &resourcePresets); err != nil {
+		return nil, err
+	}
+	cfg.ResourcePresets = resourcePresets
+
+	var windows []internal.MaintenanceWindow
+	if err := c.Unmarshal("vice.maintenance.windows", &windows); err != nil {
+		return nil, err
+	}
+	cfg.Maintenance.Windows = windows
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// reloadableSettings lists the settings that are changed when the
+// configuration is reloaded.
+var reloadableSettings = []string{
+	"http.rate-limits",
+	"vice.embedding",
+	"vice.job-status.base",
+	"vice.maintenance",
+	"vice.resource-presets",
+}
+
+// ConfigReload is the response of the config reload endpoint.
+type ConfigReload struct {
+	ReloadedAt time.Time `json:"reloaded_at"`
+	Settings   []string  `json:"settings"`
+}
+
+// configHolder contains the configuration app-exposer is running with.
+type configHolder struct {
+	mu     sync.RWMutex
+	config *koanf.Koanf
+}
+
+func (h *configHolder) get() *koanf.Koanf {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.config
+}
+
+func (h *configHolder) set(c *koanf.Koanf) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.config = c
+}
+
+// ReloadConfig reads the configuration again and applies the settings that
+// can be changed while app-exposer is running. Nothing is changed if the
+// configuration can't be read or any of the settings are invalid. Everything
+// else in the configuration still requires a restart.
+func (e *ExposerApp) ReloadConfig() (*ConfigReload, error) {
+	if e.loadConfig == nil {
+		return nil, errors.New("the configuration can't be reloaded")
+	}
+
+	c, err := e.loadConfig()
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading the configuration")
+	}
+
+	reloadable, err := reloadableConfigFromKoanf(c)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid configuration")
+	}
+
+	rateLimitConfig, err := rateLimitConfigFromKoanf(c)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid configuration")
+	}
+
+	if err = e.internal.Reload(reloadable); err != nil {
+		return nil, errors.Wrap(err, "invalid configuration")
+	}
+	e.rateLimiter.reload(rateLimitConfig)
+	e.config.set(c)
+
+	log.Infof("reloaded the configuration: %v", reloadableSettings)
+
+	return &ConfigReload{
+		ReloadedAt: time.Now(),
+		Settings:   reloadableSettings,
+	}, nil
+}
+
+// ConfigReloadHandler reloads the configuration without restarting
+// app-exposer, so that launches and streams in progress aren't interrupted.
+func (e *ExposerApp) ConfigReloadHandler(c echo.Context) error {
+	reload, err := e.ReloadConfig()
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	return c.JSON(http.StatusOK, reload)
+}
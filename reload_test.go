@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/app-exposer/internal"
+	"github.com/knadh/koanf"
+	"github.com/knadh/koanf/providers/confmap"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func reloadTestConfig(t *testing.T, values map[string]interface{}) *koanf.Koanf {
+	t.Helper()
+	c := koanf.New(".")
+	if err := c.Load(confmap.Provider(values, "."), nil); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestReloadConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	current := reloadTestConfig(t, map[string]interface{}{
+		"vice.maintenance.enabled": true,
+		"vice.maintenance.message": "back soon",
+		"vice.maintenance.windows": []interface{}{
+			map[string]interface{}{"start": "2024-01-02T15:00:00Z", "end": "2024-01-02T17:00:00Z", "message": "upgrading storage"},
+		},
+		"http.rate-limits.enabled": true,
+		"http.rate-limits.rules": []interface{}{
+			map[string]interface{}{"name": "launch", "paths": []interface{}{"/vice/launch"}, "ip-rate": 0.001, "ip-burst": 1},
+		},
+	})
+
+	app := &ExposerApp{
+		internal:    internal.New(&internal.Init{JobStatusURL: "http://job-status-listener"}, nil, nil, nil),
+		rateLimiter: newRateLimiter(&RateLimitConfig{}),
+		loadConfig: func() (*koanf.Koanf, error) {
+			return current, nil
+		},
+	}
+
+	e := echo.New()
+	e.Use(app.rateLimiter.middleware())
+	e.POST("/vice/launch", func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	})
+	e.POST("/vice/admin/config/reload", app.ConfigReloadHandler)
+
+	launch := func() int {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, launchRequest("ipcdev", "10.0.0.1"))
+		return rec.Code
+	}
+	assert.Equal(http.StatusOK, launch())
+	assert.Equal(http.StatusOK, launch())
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/vice/admin/config/reload", nil))
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Contains(rec.Body.String(), `"vice.maintenance"`)
+
+	assert.True(app.internal.Maintenance.Enabled)
+	if assert.Len(app.internal.Maintenance.Windows, 1) {
+		assert.Equal(time.Date(2024, 1, 2, 17, 0, 0, 0, time.UTC), app.internal.Maintenance.Windows[0].End)
+	}
+	assert.Equal("http://job-status-listener", app.internal.JobStatusURL)
+	assert.Equal(current, app.config.get())
+	assert.Equal(http.StatusOK, launch())
+	assert.Equal(http.StatusTooManyRequests, launch())
+
+	// Nothing is changed if the configuration is invalid.
+	current = reloadTestConfig(t, map[string]interface{}{
+		"vice.maintenance.enabled":               false,
+		"vice.embedding.default-frame-ancestors": []interface{}{"*"},
+	})
+	_, err := app.ReloadConfig()
+	assert.Error(err)
+	assert.True(app.internal.Maintenance.Enabled)
+	assert.Equal(http.StatusTooManyRequests, launch())
+}
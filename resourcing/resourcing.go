@@ -0,0 +1,155 @@
+// Package resourcing translates the named resource presets that users select
+// when they submit an analysis into the concrete CPU, memory, and GPU values
+// used to schedule it.
+package resourcing
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/cyverse-de/model/v6"
+	resourcev1 "k8s.io/apimachinery/pkg/api/resource"
+)
+
+// PresetLabel is the label added to the k8s resources for an analysis that was
+// launched with a preset.
+const PresetLabel = "resource-preset"
+
+// gpuDevice is the device added to the job for presets that include a GPU.
+// Analyses that have an NVIDIA device are scheduled on the GPU nodes.
+const gpuDevice = "/dev/nvidia0"
+
+// maxGPUs is the most GPUs a preset may include. VICE analyses only request a
+// single GPU.
+const maxGPUs = 1
+
+// presetNameRegexp matches valid preset names. The names are used as label
+// values, so they're kept short and simple.
+var presetNameRegexp = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// Preset is a named set of resources defined by the administrators.
+type Preset struct {
+	// Name is the name users select in the submission, for example medium.
+	Name string `json:"name" koanf:"name"`
+
+	// Description is shown to users when they select a preset.
+	Description string `json:"description,omitempty" koanf:"description"`
+
+	// CPUCores is the number of CPU cores requested for the analysis, which
+	// is also its CPU limit.
+	CPUCores float32 `json:"cpu_cores" koanf:"cpu-cores"`
+
+	// Memory is the amount of memory requested for the analysis, which is
+	// also its memory limit, for example 16Gi.
+	Memory string `json:"memory" koanf:"memory"`
+
+	// GPUs is the number of GPUs requested for the analysis.
+	GPUs int `json:"gpus" koanf:"gpus"`
+}
+
+// Validate returns an error if the preset is invalid.
+func (p *Preset) Validate() error {
+	if !presetNameRegexp.MatchString(p.Name) {
+		return fmt.Errorf("invalid preset name %q", p.Name)
+	}
+	if p.CPUCores <= 0 {
+		return fmt.Errorf("preset %s: cpu_cores must be greater than 0", p.Name)
+	}
+	memory, err := resourcev1.ParseQuantity(p.Memory)
+	if err != nil {
+		return fmt.Errorf("preset %s: invalid memory %q", p.Name, p.Memory)
+	}
+	if memory.Sign() <= 0 {
+		return fmt.Errorf("preset %s: memory must be greater than 0", p.Name)
+	}
+	if p.GPUs < 0 || p.GPUs > maxGPUs {
+		return fmt.Errorf("preset %s: gpus must be between 0 and %d", p.Name, maxGPUs)
+	}
+	return nil
+}
+
+// memoryBytes returns the preset's memory in bytes. The preset must have been
+// validated.
+func (p *Preset) memoryBytes() int64 {
+	memory := resourcev1.MustParse(p.Memory)
+	return memory.Value()
+}
+
+// Presets contains the presets users may choose from.
+type Presets []Preset
+
+// Validate returns an error if any of the presets are invalid or if more than
+// one preset has the same name.
+func (ps Presets) Validate() error {
+	seen := make(map[string]bool, len(ps))
+	for idx := range ps {
+		if err := ps[idx].Validate(); err != nil {
+			return err
+		}
+		if seen[ps[idx].Name] {
+			return fmt.Errorf("duplicate preset name %q", ps[idx].Name)
+		}
+		seen[ps[idx].Name] = true
+	}
+	return nil
+}
+
+// Names returns the names of the presets in the order they were defined.
+func (ps Presets) Names() []string {
+	names := make([]string, len(ps))
+	for idx := range ps {
+		names[idx] = ps[idx].Name
+	}
+	return names
+}
+
+// Get returns the preset with the name and true, or false if there isn't one.
+func (ps Presets) Get(name string) (*Preset, bool) {
+	for idx := range ps {
+		if ps[idx].Name == name {
+			return &ps[idx], true
+		}
+	}
+	return nil, false
+}
+
+// hasGPUDevice returns true if the container already has an NVIDIA device.
+func hasGPUDevice(container *model.Container) bool {
+	for _, device := range container.Devices {
+		if strings.HasPrefix(strings.ToLower(device.HostPath), "/dev/nvidia") {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply replaces the resource values in the job with the ones from the named
+// preset. Any CPU or memory values in the submission are overwritten, so users
+// can't select a preset and then ask for more. Returns an error if the preset
+// doesn't exist.
+func (ps Presets) Apply(job *model.Job, name string) error {
+	preset, ok := ps.Get(name)
+	if !ok {
+		return fmt.Errorf("unknown resource preset %q; valid presets are: %s", name, strings.Join(ps.Names(), ", "))
+	}
+
+	if len(job.Steps) == 0 {
+		return fmt.Errorf("the job doesn't have any steps")
+	}
+
+	container := &job.Steps[0].Component.Container
+	container.MinCPUCores = preset.CPUCores
+	container.MaxCPUCores = preset.CPUCores
+	container.MinMemoryLimit = preset.memoryBytes()
+	container.MemoryLimit = preset.memoryBytes()
+
+	if preset.GPUs > 0 && !hasGPUDevice(container) {
+		container.Devices = append(container.Devices, model.Device{
+			HostPath:      gpuDevice,
+			ContainerPath: gpuDevice,
+		})
+	}
+
+	return nil
+}
@@ -0,0 +1,66 @@
+package resourcing
+
+import (
+	"testing"
+
+	"github.com/cyverse-de/model/v6"
+	"github.com/stretchr/testify/assert"
+)
+
+var testPresets = Presets{
+	{Name: "small", CPUCores: 1, Memory: "4Gi"},
+	{Name: "gpu", CPUCores: 8, Memory: "64Gi", GPUs: 1},
+}
+
+func TestPresetsValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(testPresets.Validate())
+	assert.NoError(Presets{}.Validate())
+
+	assert.Error(Presets{{Name: "Small", CPUCores: 1, Memory: "4Gi"}}.Validate())
+	assert.Error(Presets{{Name: "small", Memory: "4Gi"}}.Validate())
+	assert.Error(Presets{{Name: "small", CPUCores: 1, Memory: "lots"}}.Validate())
+	assert.Error(Presets{{Name: "small", CPUCores: 1, Memory: "0"}}.Validate())
+	assert.Error(Presets{{Name: "small", CPUCores: 1, Memory: "4Gi", GPUs: 2}}.Validate())
+	assert.Error(Presets{
+		{Name: "small", CPUCores: 1, Memory: "4Gi"},
+		{Name: "small", CPUCores: 2, Memory: "8Gi"},
+	}.Validate())
+}
+
+func TestApply(t *testing.T) {
+	assert := assert.New(t)
+
+	job := &model.Job{Steps: []model.Step{{}}}
+	job.Steps[0].Component.Container.MaxCPUCores = 64
+	job.Steps[0].Component.Container.MemoryLimit = 1 << 40
+
+	assert.NoError(testPresets.Apply(job, "small"))
+
+	container := job.Steps[0].Component.Container
+	assert.Equal(float32(1), container.MinCPUCores)
+	assert.Equal(float32(1), container.MaxCPUCores)
+	assert.Equal(int64(4*1024*1024*1024), container.MinMemoryLimit)
+	assert.Equal(int64(4*1024*1024*1024), container.MemoryLimit)
+	assert.Empty(container.Devices)
+}
+
+func TestApplyGPU(t *testing.T) {
+	assert := assert.New(t)
+
+	job := &model.Job{Steps: []model.Step{{}}}
+	assert.NoError(testPresets.Apply(job, "gpu"))
+	assert.Equal([]model.Device{{HostPath: gpuDevice, ContainerPath: gpuDevice}}, job.Steps[0].Component.Container.Devices)
+
+	// The device isn't added twice.
+	assert.NoError(testPresets.Apply(job, "gpu"))
+	assert.Len(job.Steps[0].Component.Container.Devices, 1)
+}
+
+func TestApplyUnknownPreset(t *testing.T) {
+	job := &model.Job{Steps: []model.Step{{}}}
+	err := testPresets.Apply(job, "huge")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "small, gpu")
+}
@@ -0,0 +1,12 @@
+-- Environment variables that are added to the analysis container of every VICE
+-- analysis (global variables, with a NULL app_id) or of the analyses for a
+-- single app. App variables take precedence over global variables, and the
+-- environment in the app's step takes precedence over both.
+CREATE TABLE IF NOT EXISTS vice_app_env_vars (
+    app_id uuid REFERENCES apps(id) ON DELETE CASCADE,
+    name text NOT NULL,
+    value text NOT NULL DEFAULT ''
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS vice_app_env_vars_global_idx ON vice_app_env_vars (name) WHERE app_id IS NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS vice_app_env_vars_app_idx ON vice_app_env_vars (app_id, name) WHERE app_id IS NOT NULL;
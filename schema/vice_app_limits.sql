@@ -0,0 +1,8 @@
+-- Limits on the VICE analyses of an app across all users. There's no limit on
+-- the number of analyses of an app that may run at once if it doesn't have a
+-- row or its max_concurrent_analyses is NULL.
+CREATE TABLE IF NOT EXISTS vice_app_limits (
+    app_id uuid NOT NULL REFERENCES apps(id) ON DELETE CASCADE,
+    max_concurrent_analyses integer CHECK (max_concurrent_analyses >= 0),
+    PRIMARY KEY (app_id)
+);
@@ -0,0 +1,24 @@
+-- Audit records for the analysis commands that other DE services send to
+-- app-exposer over JetStream. A record is written for every delivery of a
+-- command, including redeliveries and duplicates that were skipped. Completed
+-- records are also used to make command processing idempotent.
+CREATE TABLE IF NOT EXISTS vice_command_audit (
+    id uuid NOT NULL DEFAULT uuid_generate_v1(),
+    request_id character varying(64) NOT NULL DEFAULT '',
+    command character varying(32) NOT NULL,
+    external_id character varying(64) NOT NULL,
+    requested_by text NOT NULL DEFAULT '',
+    reason text NOT NULL DEFAULT '',
+    delivery_attempt integer NOT NULL DEFAULT 1,
+    status character varying(16) NOT NULL,
+    error text,
+    received_at timestamp with time zone NOT NULL DEFAULT now(),
+    completed_at timestamp with time zone,
+    PRIMARY KEY (id)
+);
+
+CREATE INDEX IF NOT EXISTS vice_command_audit_external_id_index
+    ON vice_command_audit (external_id, command, status);
+
+CREATE INDEX IF NOT EXISTS vice_command_audit_received_at_index
+    ON vice_command_audit (received_at);
@@ -0,0 +1,14 @@
+-- The ends of the logs of the containers in VICE analysis pods, recorded
+-- when the analysis exits so that they're available after the pods are
+-- deleted.
+CREATE TABLE IF NOT EXISTS vice_container_logs (
+    external_id character varying(64) NOT NULL,
+    pod_name text NOT NULL,
+    container_name text NOT NULL,
+    logs text NOT NULL DEFAULT '',
+    recorded_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (external_id, pod_name, container_name)
+);
+
+CREATE INDEX IF NOT EXISTS vice_container_logs_recorded_at_index
+    ON vice_container_logs (recorded_at);
@@ -0,0 +1,14 @@
+-- Restarts of the containers in VICE analysis pods by the kubelet after they
+-- failed their liveness probes, recorded from the kubelet's pod events.
+CREATE TABLE IF NOT EXISTS vice_container_restarts (
+    external_id character varying(64) NOT NULL,
+    pod_name text NOT NULL,
+    container_name text NOT NULL,
+    reason text NOT NULL,
+    message text NOT NULL DEFAULT '',
+    restarted_at timestamp with time zone NOT NULL,
+    PRIMARY KEY (external_id, pod_name, container_name, restarted_at)
+);
+
+CREATE INDEX IF NOT EXISTS vice_container_restarts_restarted_at_index
+    ON vice_container_restarts (restarted_at);
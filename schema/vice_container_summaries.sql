@@ -0,0 +1,22 @@
+-- Summaries of the containers in VICE analysis pods, recorded when the
+-- analysis exits so that the results are available after the pods are
+-- deleted.
+CREATE TABLE IF NOT EXISTS vice_container_summaries (
+    external_id character varying(64) NOT NULL,
+    pod_name text NOT NULL,
+    container_name text NOT NULL,
+    init_container boolean NOT NULL DEFAULT false,
+    image text NOT NULL DEFAULT '',
+    started_at timestamp with time zone,
+    finished_at timestamp with time zone,
+    exit_code integer,
+    reason text NOT NULL DEFAULT '',
+    restart_count integer NOT NULL DEFAULT 0,
+    last_exit_code integer,
+    last_reason text NOT NULL DEFAULT '',
+    recorded_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (external_id, pod_name, container_name)
+);
+
+CREATE INDEX IF NOT EXISTS vice_container_summaries_recorded_at_index
+    ON vice_container_summaries (recorded_at);
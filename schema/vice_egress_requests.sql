@@ -0,0 +1,20 @@
+-- Requests from tool integrators to change the egress profile of a tool.
+-- Requests for unrestricted egress stay pending until an administrator
+-- approves or denies them; the other profiles are approved when they're
+-- requested. Approved requests are copied into vice_tool_settings.
+CREATE TABLE IF NOT EXISTS vice_egress_requests (
+    id uuid NOT NULL DEFAULT uuid_generate_v1(),
+    tool_id uuid NOT NULL REFERENCES tools(id) ON DELETE CASCADE,
+    profile text NOT NULL,
+    allowlist jsonb NOT NULL DEFAULT '[]',
+    justification text NOT NULL DEFAULT '',
+    requested_by text NOT NULL,
+    status text NOT NULL DEFAULT 'pending',
+    decided_by text,
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    decided_at timestamp with time zone,
+    PRIMARY KEY (id),
+    CHECK (status IN ('pending', 'approved', 'denied'))
+);
+
+CREATE INDEX IF NOT EXISTS vice_egress_requests_status_idx ON vice_egress_requests (status, created_at);
@@ -0,0 +1,13 @@
+-- The number of GPUs each user's VICE analyses may use at once, whether they
+-- request whole GPUs or MIG partitions. Usernames are stored like the
+-- launchers in job_limits, with the first hyphen replaced by an underscore.
+-- The row with a NULL username is the default for users without a row of
+-- their own. Users can launch as many GPU analyses as their other limits
+-- allow if neither exists.
+CREATE TABLE IF NOT EXISTS vice_gpu_limits (
+    username text,
+    max_gpus integer NOT NULL CHECK (max_gpus >= 0)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS vice_gpu_limits_username_index
+    ON vice_gpu_limits ((COALESCE(username, '')));
@@ -0,0 +1,19 @@
+-- Image pulls for the containers in VICE analysis pods, recorded from the
+-- kubelet's pod events as the analyses start.
+CREATE TABLE IF NOT EXISTS vice_image_pulls (
+    external_id character varying(64) NOT NULL,
+    pod_name text NOT NULL,
+    container_name text NOT NULL,
+    image text NOT NULL DEFAULT '',
+    started_at timestamp with time zone,
+    finished_at timestamp with time zone,
+    pull_seconds double precision,
+    cached boolean NOT NULL DEFAULT false,
+    failures integer NOT NULL DEFAULT 0,
+    failure_message text NOT NULL DEFAULT '',
+    recorded_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (external_id, pod_name, container_name)
+);
+
+CREATE INDEX IF NOT EXISTS vice_image_pulls_recorded_at_index
+    ON vice_image_pulls (recorded_at);
@@ -0,0 +1,19 @@
+-- Groups of users who share a concurrent job limit, such as the students in a
+-- course. A user's own row in job_limits takes precedence over their groups,
+-- and users in several groups get the most generous of their groups' limits.
+-- Members are stored like the launchers in job_limits, with the first hyphen
+-- replaced by an underscore.
+CREATE TABLE IF NOT EXISTS vice_job_limit_groups (
+    name text NOT NULL,
+    concurrent_jobs integer NOT NULL CHECK (concurrent_jobs >= 0),
+    PRIMARY KEY (name)
+);
+
+CREATE TABLE IF NOT EXISTS vice_job_limit_group_members (
+    group_name text NOT NULL REFERENCES vice_job_limit_groups(name) ON DELETE CASCADE,
+    launcher text NOT NULL,
+    PRIMARY KEY (group_name, launcher)
+);
+
+CREATE INDEX IF NOT EXISTS vice_job_limit_group_members_launcher_index
+    ON vice_job_limit_group_members (launcher);
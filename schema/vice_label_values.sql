@@ -0,0 +1,10 @@
+-- The names that the app-name and analysis-name label values on VICE
+-- resources were generated from, for names that couldn't be used as label
+-- values as they are. Each value belongs to a single name.
+CREATE TABLE IF NOT EXISTS vice_label_values (
+    kind text NOT NULL,
+    value character varying(63) NOT NULL,
+    name text NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (kind, value)
+);
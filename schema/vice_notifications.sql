@@ -0,0 +1,22 @@
+-- Users' preferences for the notifications app-exposer sends about their VICE
+-- analyses. Users without a row for an event get notifications and emails
+-- for it.
+CREATE TABLE IF NOT EXISTS vice_notification_preferences (
+    user_id uuid NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    event text NOT NULL,
+    enabled boolean NOT NULL DEFAULT true,
+    email boolean NOT NULL DEFAULT true,
+    PRIMARY KEY (user_id, event)
+);
+
+-- The notifications that have been sent for each analysis, so that each one
+-- is only sent once across replicas.
+CREATE TABLE IF NOT EXISTS vice_sent_notifications (
+    external_id text NOT NULL,
+    key text NOT NULL,
+    sent_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (external_id, key)
+);
+
+CREATE INDEX IF NOT EXISTS vice_sent_notifications_sent_at_index
+    ON vice_sent_notifications (sent_at);
@@ -0,0 +1,17 @@
+-- The VICE analyses whose resources the orphan reconciler deleted because
+-- the analysis had ended or didn't exist.
+CREATE TABLE IF NOT EXISTS vice_orphan_deletions (
+    id uuid NOT NULL DEFAULT uuid_generate_v1(),
+    external_id character varying(64) NOT NULL,
+    status text NOT NULL DEFAULT '',
+    deleted text[] NOT NULL DEFAULT '{}',
+    error text NOT NULL DEFAULT '',
+    deleted_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (id)
+);
+
+CREATE INDEX IF NOT EXISTS vice_orphan_deletions_deleted_at_index
+    ON vice_orphan_deletions (deleted_at);
+
+CREATE INDEX IF NOT EXISTS vice_orphan_deletions_external_id_index
+    ON vice_orphan_deletions (external_id);
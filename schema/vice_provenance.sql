@@ -0,0 +1,9 @@
+-- Provenance manifests describing how VICE analyses were run, so that their
+-- results can be reproduced. The manifest is recorded when the analysis is
+-- launched and updated when its outputs are saved and when it exits.
+CREATE TABLE IF NOT EXISTS vice_provenance (
+    external_id character varying(64) PRIMARY KEY,
+    manifest jsonb NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    updated_at timestamp with time zone NOT NULL DEFAULT now()
+);
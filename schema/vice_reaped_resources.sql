@@ -0,0 +1,21 @@
+-- The actions the deletion reaper took on VICE analysis resources that were
+-- stuck terminating, such as PVCs held by finalizers or pods on nodes that
+-- went away.
+CREATE TABLE IF NOT EXISTS vice_reaped_resources (
+    id uuid NOT NULL DEFAULT uuid_generate_v1(),
+    external_id character varying(64) NOT NULL DEFAULT '',
+    kind text NOT NULL,
+    name text NOT NULL,
+    action text NOT NULL,
+    detail text NOT NULL DEFAULT '',
+    deletion_requested_at timestamp with time zone NOT NULL,
+    reaped_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (id),
+    CHECK (action IN ('force-deleted', 'finalizers-removed', 'escalated', 'failed'))
+);
+
+CREATE INDEX IF NOT EXISTS vice_reaped_resources_reaped_at_index
+    ON vice_reaped_resources (reaped_at);
+
+CREATE INDEX IF NOT EXISTS vice_reaped_resources_external_id_index
+    ON vice_reaped_resources (external_id);
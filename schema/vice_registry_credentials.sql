@@ -0,0 +1,10 @@
+-- Robot accounts that can pull the images in private projects of the DE's
+-- Harbor registries. They're used to check that an analysis's image exists
+-- and can be pulled before the analysis is launched.
+CREATE TABLE IF NOT EXISTS vice_registry_credentials (
+    registry text NOT NULL,
+    project text NOT NULL,
+    username text NOT NULL,
+    secret text NOT NULL,
+    PRIMARY KEY (registry, project)
+);
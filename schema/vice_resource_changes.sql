@@ -0,0 +1,18 @@
+-- Changes that administrators made to the resource requests and limits of
+-- running VICE analyses. The previous and new values are stored as JSON
+-- objects with the cpu_request, cpu_limit, memory_request, memory_limit,
+-- ephemeral_storage_request, and ephemeral_storage_limit fields.
+CREATE TABLE IF NOT EXISTS vice_resource_changes (
+    id uuid NOT NULL DEFAULT uuid_generate_v1(),
+    analysis_id uuid NOT NULL,
+    external_id text NOT NULL,
+    changed_by text NOT NULL,
+    reason text NOT NULL DEFAULT '',
+    previous jsonb NOT NULL,
+    resources jsonb NOT NULL,
+    changed_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (id)
+);
+
+CREATE INDEX IF NOT EXISTS vice_resource_changes_analysis_id_index
+    ON vice_resource_changes (analysis_id, changed_at);
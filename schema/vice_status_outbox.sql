@@ -0,0 +1,26 @@
+-- Status updates for VICE analyses that could not be delivered to the
+-- job-status-listener. Rows are removed once delivery succeeds. Rows that
+-- exceed the maximum number of delivery attempts are dead-lettered and are
+-- only retried when an administrator replays them.
+--
+-- The id, created_at and dead_lettered defaults are required; app-exposer
+-- doesn't supply those columns when it queues a message.
+CREATE TABLE IF NOT EXISTS vice_status_outbox (
+    id uuid NOT NULL DEFAULT uuid_generate_v1(),
+    external_id character varying(64) NOT NULL,
+    state character varying(64) NOT NULL,
+    message text NOT NULL,
+    attempts integer NOT NULL DEFAULT 0,
+    last_error text,
+    dead_lettered boolean NOT NULL DEFAULT false,
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    next_attempt_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (id)
+);
+
+CREATE INDEX IF NOT EXISTS vice_status_outbox_external_id_index
+    ON vice_status_outbox (external_id, created_at);
+
+CREATE INDEX IF NOT EXISTS vice_status_outbox_pending_index
+    ON vice_status_outbox (next_attempt_at)
+    WHERE NOT dead_lettered;
@@ -0,0 +1,8 @@
+-- The subdomains claimed by VICE analyses launched with the readable
+-- subdomain scheme. Each subdomain belongs to a single analysis. Analyses
+-- without a row use the hash-based subdomain recorded by the apps service.
+CREATE TABLE IF NOT EXISTS vice_subdomains (
+    subdomain character varying(63) PRIMARY KEY,
+    external_id text NOT NULL UNIQUE,
+    created_at timestamp with time zone NOT NULL DEFAULT now()
+);
@@ -0,0 +1,8 @@
+-- Settings for tools that only apply when they're used in VICE analyses. The
+-- settings column contains a JSON object; see the ToolSettings type in
+-- internal/toolsettings.go for the supported fields.
+CREATE TABLE IF NOT EXISTS vice_tool_settings (
+    tool_id uuid NOT NULL REFERENCES tools(id) ON DELETE CASCADE,
+    settings jsonb NOT NULL DEFAULT '{}',
+    PRIMARY KEY (tool_id)
+);
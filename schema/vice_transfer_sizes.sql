@@ -0,0 +1,16 @@
+-- The amount of data moved by each file transfer for a VICE analysis,
+-- measured from the working directory when the transfer completes.
+CREATE TABLE IF NOT EXISTS vice_transfer_sizes (
+    id uuid NOT NULL DEFAULT uuid_generate_v1() PRIMARY KEY,
+    external_id character varying(64) NOT NULL,
+    kind text NOT NULL,
+    bytes bigint NOT NULL,
+    files integer NOT NULL,
+    recorded_at timestamp with time zone NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS vice_transfer_sizes_external_id_index
+    ON vice_transfer_sizes (external_id);
+
+CREATE INDEX IF NOT EXISTS vice_transfer_sizes_recorded_at_index
+    ON vice_transfer_sizes (recorded_at);
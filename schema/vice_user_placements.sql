@@ -0,0 +1,11 @@
+-- The topology domain, such as a zone, that each user's VICE analyses prefer
+-- to be scheduled in. Learned placements are replaced by the domain of the
+-- user's most recent analysis; placements set by an administrator are not.
+CREATE TABLE IF NOT EXISTS vice_user_placements (
+    user_id uuid NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    domain text NOT NULL,
+    source text NOT NULL DEFAULT 'learned',
+    updated_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id),
+    CHECK (source IN ('learned', 'admin'))
+);
@@ -0,0 +1,19 @@
+-- Archives of the working directories of VICE analyses, saved to the
+-- analyses' output folders so that they can be restored into new analyses of
+-- the same app.
+CREATE TABLE IF NOT EXISTS vice_working_dir_snapshots (
+    id uuid NOT NULL PRIMARY KEY,
+    external_id character varying(64) NOT NULL,
+    analysis_id uuid NOT NULL,
+    app_id text NOT NULL,
+    user_id uuid NOT NULL,
+    path text NOT NULL,
+    size_bytes bigint NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS vice_working_dir_snapshots_external_id_index
+    ON vice_working_dir_snapshots (external_id);
+
+CREATE INDEX IF NOT EXISTS vice_working_dir_snapshots_user_id_index
+    ON vice_working_dir_snapshots (user_id);
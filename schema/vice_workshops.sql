@@ -0,0 +1,21 @@
+-- Workshops that had an instance of a quick launch launched for each user on
+-- a roster. The instances are torn down together when the workshop ends.
+CREATE TABLE IF NOT EXISTS vice_workshops (
+    id uuid NOT NULL DEFAULT uuid_generate_v1(),
+    name text NOT NULL,
+    quick_launch_id uuid NOT NULL,
+    created_by text NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    torn_down_at timestamp with time zone,
+    PRIMARY KEY (id)
+);
+
+-- The analyses launched for the users on a workshop's roster. The analysis
+-- ID is null and the error is set if the launch failed.
+CREATE TABLE IF NOT EXISTS vice_workshop_instances (
+    workshop_id uuid NOT NULL REFERENCES vice_workshops(id) ON DELETE CASCADE,
+    username text NOT NULL,
+    analysis_id uuid,
+    error text,
+    PRIMARY KEY (workshop_id, username)
+);
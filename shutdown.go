@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/knadh/koanf"
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultShutdownDrainDelay = 5 * time.Second
+	defaultShutdownTimeout    = 20 * time.Second
+)
+
+// ShutdownConfig contains the settings for shutting down gracefully when
+// Kubernetes stops the pod, such as during a rolling update. Together they
+// should be shorter than the pod's termination grace period.
+type ShutdownConfig struct {
+	// DrainDelay is how long the server keeps accepting requests after the
+	// readiness check starts failing, so that Kubernetes has time to stop
+	// sending it new ones.
+	DrainDelay time.Duration
+
+	// Timeout limits the time in-flight requests have to finish, and
+	// separately the time it takes to drain the NATS connection.
+	Timeout time.Duration
+}
+
+func shutdownConfigFromKoanf(c *koanf.Koanf) *ShutdownConfig {
+	cfg := &ShutdownConfig{
+		DrainDelay: c.Duration("http.shutdown.drain-delay"),
+		Timeout:    c.Duration("http.shutdown.timeout"),
+	}
+	if cfg.DrainDelay <= 0 {
+		cfg.DrainDelay = defaultShutdownDrainDelay
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultShutdownTimeout
+	}
+	return cfg
+}
+
+// serve serves requests on the listener until the context is canceled, then
+// shuts the server down gracefully. draining is called first so that the
+// readiness check fails, and the server keeps accepting requests for the
+// drain delay before it stops listening and waits for the in-flight requests
+// to finish. Returns an error if the server fails or the requests don't finish
+// before the timeout.
+func serve(ctx context.Context, server *http.Server, listener net.Listener, cfg *ShutdownConfig, draining func()) error {
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Serve(listener)
+	}()
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Infof("shutting down; draining requests for %s", cfg.DrainDelay)
+	draining()
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-time.After(cfg.DrainDelay):
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+	defer cancel()
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return errors.Wrap(err, "in-flight requests didn't finish before the shutdown timeout")
+	}
+	if err := <-serveErr; err != http.ErrServerClosed {
+		return err
+	}
+
+	log.Info("in-flight requests finished")
+	return nil
+}
+
+// drainNATS drains the connection's subscriptions, flushes the messages
+// waiting to be sent, and waits for the connection to close.
+func drainNATS(nc *nats.Conn, timeout time.Duration) {
+	if nc.IsClosed() {
+		return
+	}
+
+	if err := nc.Drain(); err != nil {
+		log.Error(errors.Wrap(err, "unable to drain the NATS connection"))
+		nc.Close()
+		return
+	}
+
+	deadline := time.Now().Add(timeout)
+	for !nc.IsClosed() {
+		if time.Now().After(deadline) {
+			log.Error("the NATS connection didn't drain before the shutdown timeout")
+			nc.Close()
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/knadh/koanf"
+	"github.com/knadh/koanf/providers/confmap"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShutdownConfigFromKoanf(t *testing.T) {
+	assert := assert.New(t)
+
+	c := koanf.New(".")
+	cfg := shutdownConfigFromKoanf(c)
+	assert.Equal(defaultShutdownDrainDelay, cfg.DrainDelay)
+	assert.Equal(defaultShutdownTimeout, cfg.Timeout)
+
+	assert.NoError(c.Load(confmap.Provider(map[string]interface{}{
+		"http.shutdown.drain-delay": "1s",
+		"http.shutdown.timeout":     "45s",
+	}, "."), nil))
+	cfg = shutdownConfigFromKoanf(c)
+	assert.Equal(time.Second, cfg.DrainDelay)
+	assert.Equal(45*time.Second, cfg.Timeout)
+}
+
+// startServe starts serving the handler on a random port and returns the
+// server's URL and a channel that receives the result of serve.
+func startServe(t *testing.T, ctx context.Context, handler http.Handler, cfg *ShutdownConfig, draining func()) (string, chan error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		result <- serve(ctx, &http.Server{Handler: handler}, listener, cfg, draining)
+	}()
+	return "http://" + listener.Addr().String(), result
+}
+
+func TestServeFinishesInFlightRequests(t *testing.T) {
+	assert := assert.New(t)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		io.WriteString(w, "launched") // nolint:errcheck
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	drained := make(chan struct{})
+	url, result := startServe(t, ctx, handler, &ShutdownConfig{DrainDelay: 10 * time.Millisecond, Timeout: 5 * time.Second}, func() {
+		close(drained)
+	})
+
+	type response struct {
+		body string
+		err  error
+	}
+	responses := make(chan response, 1)
+	go func() {
+		resp, err := http.Post(url+"/vice/launch", "application/json", nil)
+		if err != nil {
+			responses <- response{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		responses <- response{body: string(body), err: err}
+	}()
+
+	// Shut down while the request is in flight.
+	<-started
+	cancel()
+	<-drained
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	resp := <-responses
+	assert.NoError(resp.err)
+	assert.Equal("launched", resp.body)
+	assert.NoError(<-result)
+
+	// The server doesn't accept new requests afterwards.
+	_, err := http.Get(url + "/ready")
+	assert.Error(err)
+}
+
+func TestServeShutdownTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	url, result := startServe(t, ctx, handler, &ShutdownConfig{DrainDelay: time.Millisecond, Timeout: 50 * time.Millisecond}, func() {})
+
+	go http.Get(url) // nolint:errcheck
+	<-started
+	cancel()
+
+	select {
+	case err := <-result:
+		assert.Error(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve didn't return after the shutdown timeout")
+	}
+}
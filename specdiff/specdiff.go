@@ -0,0 +1,239 @@
+// Package specdiff compares the Kubernetes objects generated for the same
+// recorded jobs by two versions of the spec builders, so that refactors of
+// the builders can be checked for unintended changes.
+package specdiff
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+
+	"github.com/cyverse-de/app-exposer/internal"
+)
+
+// The types of changes in a report.
+const (
+	Added   = "added"
+	Removed = "removed"
+	Changed = "changed"
+)
+
+// Rendering is the objects generated for each job, keyed by the name of the
+// file the job was recorded in.
+type Rendering map[string][]internal.SimulatedResource
+
+// Change is a single difference between two renderings. Path is empty if the
+// whole object was added or removed.
+type Change struct {
+	Job    string      `json:"job"`
+	Kind   string      `json:"kind"`
+	Name   string      `json:"name"`
+	Path   string      `json:"path,omitempty"`
+	Type   string      `json:"type"`
+	Before interface{} `json:"before,omitempty"`
+	After  interface{} `json:"after,omitempty"`
+}
+
+// Report lists the differences between two renderings.
+type Report struct {
+	// Jobs is the number of jobs in either rendering.
+	Jobs int `json:"jobs"`
+
+	// ChangedJobs is the number of jobs with at least one difference.
+	ChangedJobs int `json:"changed_jobs"`
+
+	Changes []Change `json:"changes"`
+}
+
+// identifier matches the map keys that can be written after a dot in a
+// path. Other keys, such as label names, are quoted in brackets.
+var identifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func keyPath(path, key string) string {
+	if !identifier.MatchString(key) {
+		return fmt.Sprintf("%s[%q]", path, key)
+	}
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// elementNames returns the name field of each element of the list, or nil if
+// the elements aren't objects with unique names. Lists of named objects,
+// such as containers, volumes and environment variables, are compared by
+// name so that an insertion doesn't show up as a change to every later
+// element.
+func elementNames(list []interface{}) []string {
+	names := make([]string, 0, len(list))
+	seen := map[string]bool{}
+	for _, elem := range list {
+		object, ok := elem.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		name, ok := object["name"].(string)
+		if !ok || seen[name] {
+			return nil
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	return names
+}
+
+// diffValues calls change for each difference between the two decoded JSON
+// values.
+func diffValues(path string, before, after interface{}, change func(path, changeType string, before, after interface{})) {
+	switch b := before.(type) {
+	case map[string]interface{}:
+		a, ok := after.(map[string]interface{})
+		if !ok {
+			break
+		}
+		for _, key := range sortedKeys(b) {
+			if value, ok := a[key]; ok {
+				diffValues(keyPath(path, key), b[key], value, change)
+			} else {
+				change(keyPath(path, key), Removed, b[key], nil)
+			}
+		}
+		for _, key := range sortedKeys(a) {
+			if _, ok := b[key]; !ok {
+				change(keyPath(path, key), Added, nil, a[key])
+			}
+		}
+		return
+
+	case []interface{}:
+		a, ok := after.([]interface{})
+		if !ok {
+			break
+		}
+
+		beforeNames, afterNames := elementNames(b), elementNames(a)
+		if beforeNames != nil && afterNames != nil {
+			afterIndex := map[string]int{}
+			for index, name := range afterNames {
+				afterIndex[name] = index
+			}
+			beforeIndex := map[string]int{}
+			for index, name := range beforeNames {
+				beforeIndex[name] = index
+				elemPath := fmt.Sprintf("%s[name=%s]", path, name)
+				if ai, ok := afterIndex[name]; ok {
+					diffValues(elemPath, b[index], a[ai], change)
+				} else {
+					change(elemPath, Removed, b[index], nil)
+				}
+			}
+			for index, name := range afterNames {
+				if _, ok := beforeIndex[name]; !ok {
+					change(fmt.Sprintf("%s[name=%s]", path, name), Added, nil, a[index])
+				}
+			}
+			return
+		}
+
+		for index := 0; index < len(b) || index < len(a); index++ {
+			elemPath := fmt.Sprintf("%s[%d]", path, index)
+			switch {
+			case index >= len(a):
+				change(elemPath, Removed, b[index], nil)
+			case index >= len(b):
+				change(elemPath, Added, nil, a[index])
+			default:
+				diffValues(elemPath, b[index], a[index], change)
+			}
+		}
+		return
+	}
+
+	if !reflect.DeepEqual(before, after) {
+		change(path, Changed, before, after)
+	}
+}
+
+func resourceKey(resource *internal.SimulatedResource) string {
+	return resource.Kind + "/" + resource.Name
+}
+
+// diffJob appends the differences between the objects generated for a job to
+// the report's changes.
+func (r *Report) diffJob(job string, before, after []internal.SimulatedResource) {
+	afterByKey := map[string]*internal.SimulatedResource{}
+	for index := range after {
+		afterByKey[resourceKey(&after[index])] = &after[index]
+	}
+
+	beforeKeys := map[string]bool{}
+	for index := range before {
+		resource := &before[index]
+		beforeKeys[resourceKey(resource)] = true
+
+		other, ok := afterByKey[resourceKey(resource)]
+		if !ok {
+			r.Changes = append(r.Changes, Change{Job: job, Kind: resource.Kind, Name: resource.Name, Type: Removed})
+			continue
+		}
+
+		diffValues("", resource.Object, other.Object, func(path, changeType string, b, a interface{}) {
+			r.Changes = append(r.Changes, Change{
+				Job:    job,
+				Kind:   resource.Kind,
+				Name:   resource.Name,
+				Path:   path,
+				Type:   changeType,
+				Before: b,
+				After:  a,
+			})
+		})
+	}
+
+	for index := range after {
+		resource := &after[index]
+		if !beforeKeys[resourceKey(resource)] {
+			r.Changes = append(r.Changes, Change{Job: job, Kind: resource.Kind, Name: resource.Name, Type: Added})
+		}
+	}
+}
+
+// Compare returns the differences between two renderings of the same jobs.
+// Jobs that are only in one of the renderings show up as having had all of
+// their objects added or removed.
+func Compare(before, after Rendering) *Report {
+	jobs := map[string]bool{}
+	for job := range before {
+		jobs[job] = true
+	}
+	for job := range after {
+		jobs[job] = true
+	}
+
+	names := make([]string, 0, len(jobs))
+	for job := range jobs {
+		names = append(names, job)
+	}
+	sort.Strings(names)
+
+	report := &Report{Jobs: len(names), Changes: []Change{}}
+	for _, job := range names {
+		changes := len(report.Changes)
+		report.diffJob(job, before[job], after[job])
+		if len(report.Changes) > changes {
+			report.ChangedJobs++
+		}
+	}
+
+	return report
+}
@@ -0,0 +1,94 @@
+package specdiff
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/cyverse-de/app-exposer/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+func resource(t *testing.T, kind, name, object string) internal.SimulatedResource {
+	decoded := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(object), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	return internal.SimulatedResource{Kind: kind, Name: name, Object: decoded}
+}
+
+func TestCompare(t *testing.T) {
+	assert := assert.New(t)
+
+	before := Rendering{
+		"a.json": {
+			resource(t, "Deployment", "e1", `{
+				"metadata": {"labels": {"app-name": "jupyter", "cyverse.org/old": "x"}},
+				"spec": {"template": {"spec": {"containers": [
+					{"name": "input-files", "image": "porklock:1"},
+					{"name": "analysis", "image": "jupyter", "args": ["a", "b"]}
+				]}}}
+			}`),
+			resource(t, "Service", "vice-e1", `{"spec": {"ports": [80]}}`),
+		},
+		"b.json": {
+			resource(t, "Service", "vice-e2", `{"spec": {"ports": [80]}}`),
+		},
+	}
+	after := Rendering{
+		"a.json": {
+			resource(t, "Deployment", "e1", `{
+				"metadata": {"labels": {"app-name": "jupyter", "cyverse.org/new": "y"}},
+				"spec": {"template": {"spec": {"containers": [
+					{"name": "vice-proxy", "image": "proxy"},
+					{"name": "input-files", "image": "porklock:2"},
+					{"name": "analysis", "image": "jupyter", "args": ["a"]}
+				]}}}
+			}`),
+			resource(t, "Ingress", "e1", `{}`),
+		},
+		"b.json": {
+			resource(t, "Service", "vice-e2", `{"spec": {"ports": [80]}}`),
+		},
+	}
+
+	report := Compare(before, after)
+	assert.Equal(2, report.Jobs)
+	assert.Equal(1, report.ChangedJobs)
+
+	type summary struct{ kind, path, changeType string }
+	changes := []summary{}
+	for _, change := range report.Changes {
+		assert.Equal("a.json", change.Job)
+		changes = append(changes, summary{change.Kind, change.Path, change.Type})
+	}
+	assert.Equal([]summary{
+		{"Deployment", `metadata.labels["cyverse.org/old"]`, Removed},
+		{"Deployment", `metadata.labels["cyverse.org/new"]`, Added},
+		{"Deployment", "spec.template.spec.containers[name=input-files].image", Changed},
+		{"Deployment", "spec.template.spec.containers[name=analysis].args[1]", Removed},
+		{"Deployment", "spec.template.spec.containers[name=vice-proxy]", Added},
+		{"Service", "", Removed},
+		{"Ingress", "", Added},
+	}, changes)
+
+	assert.Equal("porklock:1", report.Changes[2].Before)
+	assert.Equal("porklock:2", report.Changes[2].After)
+
+	// Identical renderings don't have any changes.
+	report = Compare(before, before)
+	assert.Equal(0, report.ChangedJobs)
+	assert.Empty(report.Changes)
+}
+
+func TestDiffValuesTypeChange(t *testing.T) {
+	assert := assert.New(t)
+
+	var changes []Change
+	diffValues("spec", map[string]interface{}{"a": 1.0}, []interface{}{1.0}, func(path, changeType string, before, after interface{}) {
+		changes = append(changes, Change{Path: path, Type: changeType, Before: before, After: after})
+	})
+	if assert.Len(changes, 1) {
+		assert.Equal("spec", changes[0].Path)
+		assert.Equal(Changed, changes[0].Type)
+	}
+}
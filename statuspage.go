@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cyverse-de/app-exposer/internal"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultStatusPageCacheTTL       = 30 * time.Second
+	defaultStatusPageLaunchWindow   = time.Hour
+	defaultStatusPageSummaryTimeout = 5 * time.Second
+)
+
+// The overall statuses shown on the status page.
+const (
+	platformOperational = "operational"
+	platformDegraded    = "degraded"
+	platformMaintenance = "maintenance"
+)
+
+// PlatformStatus is the response body of the status page endpoint. It's
+// public, so it only reports whether each component is up, never why not.
+type PlatformStatus struct {
+	Status      string            `json:"status"`
+	GeneratedAt time.Time         `json:"generated_at"`
+	Components  map[string]string `json:"components"`
+	*internal.PlatformSummary
+}
+
+// StatusPage serves the data for a public status page, so that users can
+// tell whether a problem is theirs or the platform's. The status is cached so
+// that a crowd of users checking during an incident doesn't add to the load
+// on the dependencies.
+type StatusPage struct {
+	health    *HealthChecker
+	summarize func(ctx context.Context, now time.Time, window time.Duration) *internal.PlatformSummary
+
+	ttl    time.Duration
+	window time.Duration
+
+	mu      sync.Mutex
+	cached  *PlatformStatus
+	expires time.Time
+}
+
+// NewStatusPage returns a *StatusPage that caches the status for ttl and
+// counts the launches during the window before each update.
+func NewStatusPage(health *HealthChecker, i *internal.Internal, ttl, window time.Duration) *StatusPage {
+	if ttl <= 0 {
+		ttl = defaultStatusPageCacheTTL
+	}
+	if window <= 0 {
+		window = defaultStatusPageLaunchWindow
+	}
+	return &StatusPage{
+		health:    health,
+		summarize: i.PlatformSummary,
+		ttl:       ttl,
+		window:    window,
+	}
+}
+
+// build checks the platform and returns its status.
+func (s *StatusPage) build(ctx context.Context, now time.Time) *PlatformStatus {
+	status := &PlatformStatus{
+		Status:      platformOperational,
+		GeneratedAt: now.UTC(),
+		Components:  map[string]string{},
+	}
+
+	for name, dependency := range s.health.check(ctx).Dependencies {
+		status.Components[name] = dependency.Status
+		if dependency.Status != dependencyOK {
+			status.Status = platformDegraded
+		}
+	}
+
+	summaryCtx, cancel := context.WithTimeout(ctx, defaultStatusPageSummaryTimeout)
+	defer cancel()
+	status.PlatformSummary = s.summarize(summaryCtx, now, s.window)
+
+	if status.Launches == nil || status.Queue == nil {
+		status.Status = platformDegraded
+	}
+
+	maintenance := status.Maintenance.Active
+	for _, window := range status.Maintenance.Windows {
+		if !now.Before(window.Start) {
+			maintenance = true
+		}
+	}
+	if maintenance {
+		status.Status = platformMaintenance
+	}
+
+	return status
+}
+
+// status returns the cached status, updating it first if it has expired.
+// Concurrent requests wait for a single update.
+func (s *StatusPage) status(ctx context.Context, now time.Time) *PlatformStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cached == nil || !now.Before(s.expires) {
+		// The update is shared, so it shouldn't stop when the request that
+		// started it goes away.
+		s.cached = s.build(context.WithoutCancel(ctx), now)
+		s.expires = now.Add(s.ttl)
+	}
+
+	return s.cached
+}
+
+// StatusHandler returns the platform's status. It doesn't require
+// authentication, and can be cached by browsers and proxies for as long as
+// app-exposer caches it.
+func (s *StatusPage) StatusHandler(c echo.Context) error {
+	status := s.status(c.Request().Context(), time.Now())
+	c.Response().Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int64(s.ttl.Seconds())))
+	return c.JSON(http.StatusOK, status)
+}
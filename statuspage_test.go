@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/app-exposer/internal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatusPage(t *testing.T) {
+	assert := assert.New(t)
+
+	ok := func(context.Context) error { return nil }
+	health := &HealthChecker{
+		timeout: 50 * time.Millisecond,
+		checks:  map[string]dependencyCheck{"database": ok, "nats": ok, "kubernetes": ok},
+	}
+
+	summaries := 0
+	maintenance := internal.MaintenanceSummary{Windows: []internal.MaintenanceWindow{}}
+	s := &StatusPage{
+		health: health,
+		summarize: func(_ context.Context, _ time.Time, window time.Duration) *internal.PlatformSummary {
+			summaries++
+			return &internal.PlatformSummary{
+				Launches:    &internal.LaunchSummary{WindowMinutes: int(window.Minutes()), Launched: 5},
+				Queue:       &internal.QueueSummary{Starting: 2},
+				Maintenance: maintenance,
+			}
+		},
+		ttl:    30 * time.Second,
+		window: time.Hour,
+	}
+
+	rec := healthRequest(nil, s.StatusHandler)
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Equal("public, max-age=30", rec.Header().Get("Cache-Control"))
+	assert.Contains(rec.Body.String(), `"status":"operational"`)
+	assert.Contains(rec.Body.String(), `"launched":5`)
+	assert.Equal(1, summaries)
+
+	// The status is cached, so a dependency going down isn't reported until
+	// the cache expires, and the reason it's down never is.
+	health.checks["database"] = func(context.Context) error { return errors.New("password authentication failed for user de") }
+
+	now := time.Now()
+	assert.Equal(platformOperational, s.status(context.Background(), now).Status)
+	assert.Equal(1, summaries)
+
+	status := s.status(context.Background(), now.Add(time.Minute))
+	assert.Equal(2, summaries)
+	assert.Equal(platformDegraded, status.Status)
+	assert.Equal(dependencyUnavailable, status.Components["database"])
+	assert.Equal(dependencyOK, status.Components["nats"])
+
+	rec = healthRequest(nil, s.StatusHandler)
+	assert.NotContains(rec.Body.String(), "password")
+
+	// Maintenance takes precedence, whether it's turned on or a scheduled
+	// window has started.
+	maintenance.Windows = []internal.MaintenanceWindow{{Start: now.Add(2 * time.Minute), End: now.Add(time.Hour)}}
+	assert.Equal(platformDegraded, s.status(context.Background(), now.Add(2*time.Minute-time.Second)).Status)
+	assert.Equal(platformMaintenance, s.status(context.Background(), now.Add(5*time.Minute)).Status)
+}